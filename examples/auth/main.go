@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -69,16 +70,16 @@ type Auth struct {
 	AllowedTopics map[string][]string // A map of usernames and topics
 }
 
-// Authenticate returns true if a username and password are acceptable.
-func (a *Auth) Authenticate(user, password []byte) bool {
+// Authenticate returns a nil error if a username and password are acceptable.
+func (a *Auth) Authenticate(user, password []byte) (interface{}, error) {
 	// If the user exists in the auth users map, and the password is correct,
 	// then they can connect to the server. In the real world, this could be a database
 	// or cached users lookup.
 	if pass, ok := a.Users[string(user)]; ok && pass == string(password) {
-		return true
+		return nil, nil
 	}
 
-	return false
+	return nil, errors.New("invalid username or password")
 }
 
 // ACL returns true if a user has access permissions to read or write on a topic.
@@ -46,10 +46,10 @@ func main() {
 // Auth is an example auth provider for the server.
 type Auth struct{}
 
-// Authenticate returns true if a username and password are acceptable.
-// Auth always returns true.
-func (a *Auth) Authenticate(user, password []byte) bool {
-	return true
+// Authenticate returns a nil error if a username and password are acceptable.
+// Auth always accepts the connection.
+func (a *Auth) Authenticate(user, password []byte) (interface{}, error) {
+	return nil, nil
 }
 
 // ACL returns true if a user has access permissions to read or write on a topic.
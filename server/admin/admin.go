@@ -0,0 +1,205 @@
+// Package admin provides an HTTP API for listing the clients connected to the
+// server and their subscriptions, and forcibly disconnecting them.
+//
+// The API serves the following endpoints, relative to where the handler is
+// mounted:
+//
+//	GET  /clients                     list the connected clients.
+//	GET  /clients/{id}/subscriptions  list the subscriptions of a client.
+//	POST /clients/{id}/disconnect     disconnect a client.
+//
+// Every request must carry the configured token as a bearer token in the
+// Authorization header.
+//
+// Health serves the health of the server separately, without a token, so it
+// can be used as a readiness probe.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	mqtt "github.com/csymapp/mqtt/server"
+)
+
+const (
+	// ContentType is the content type of the API responses.
+	ContentType = "application/json"
+)
+
+// Error is the body of an unsuccessful response.
+type Error struct {
+	Error string `json:"error"` // a description of the error.
+}
+
+// HealthStatus is the body of a health check response.
+type HealthStatus struct {
+	Healthy    bool              `json:"healthy"`    // whether the server is ready to accept clients.
+	Components map[string]string `json:"components"` // the status of each component, as returned by server.Health.
+}
+
+// API serves the admin endpoints for a server.
+type API struct {
+	server *mqtt.Server // the server to manage.
+	token  string       // the bearer token required by every request.
+}
+
+// New returns a new API for a server, guarded by a bearer token. If the token
+// is empty, all requests are refused.
+func New(server *mqtt.Server, token string) *API {
+	return &API{
+		server: server,
+		token:  token,
+	}
+}
+
+// Handler returns an http.Handler which serves the API. To mount the API under
+// a path prefix, wrap the handler with http.StripPrefix.
+func (a *API) Handler() http.Handler {
+	return http.HandlerFunc(a.serveHTTP)
+}
+
+// Health returns an http.Handler which serves the health of a server, such as
+// at /healthz. It responds with 200 OK if the server is healthy, and 503 Service
+// Unavailable if not. No token is required, so any errors from the store are
+// visible to whoever can reach the handler.
+func Health(server *mqtt.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, http.MethodGet+", "+http.MethodHead)
+			return
+		}
+
+		ok, status := server.Health()
+		code := http.StatusOK
+		if !ok {
+			code = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, code, HealthStatus{
+			Healthy:    ok,
+			Components: status,
+		})
+	})
+}
+
+// serveHTTP authorizes a request and routes it to the matching endpoint.
+func (a *API) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mqtt"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "clients":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		a.listClients(w, r)
+
+	case len(parts) == 3 && parts[0] == "clients" && parts[2] == "subscriptions":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		id, err := url.PathUnescape(parts[1])
+		if err != nil || id == "" {
+			writeError(w, http.StatusBadRequest, "invalid client id")
+			return
+		}
+		a.listSubscriptions(w, r, id)
+
+	case len(parts) == 3 && parts[0] == "clients" && parts[2] == "disconnect":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+
+		id, err := url.PathUnescape(parts[1])
+		if err != nil || id == "" {
+			writeError(w, http.StatusBadRequest, "invalid client id")
+			return
+		}
+		a.disconnectClient(w, r, id)
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// authorized returns true if a request carries the bearer token.
+func (a *API) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return false
+	}
+
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(h, "Bearer ")), []byte(a.token)) == 1
+}
+
+// listClients writes a summary of each connected client.
+func (a *API) listClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.server.ConnectedClients())
+}
+
+// listSubscriptions writes the subscriptions of a connected client.
+func (a *API) listSubscriptions(w http.ResponseWriter, r *http.Request, id string) {
+	subs, err := a.server.ClientSubscriptions(id)
+	if errors.Is(err, mqtt.ErrClientNotConnected) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, subs)
+}
+
+// disconnectClient disconnects a client.
+func (a *API) disconnectClient(w http.ResponseWriter, r *http.Request, id string) {
+	err := a.server.DisconnectClient(id)
+	if errors.Is(err, mqtt.ErrClientNotConnected) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// methodNotAllowed writes a method not allowed response.
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// writeError writes an error response.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, Error{Error: msg})
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,225 @@
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/csymapp/mqtt/server"
+	"github.com/csymapp/mqtt/server/internal/circ"
+	"github.com/csymapp/mqtt/server/internal/clients"
+	"github.com/csymapp/mqtt/server/internal/packets"
+	"github.com/csymapp/mqtt/server/listeners"
+)
+
+const testToken = "secret"
+
+// addClient adds a connected client to a server.
+func addClient(t *testing.T, s *mqtt.Server, id string) *clients.Client {
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	cl := clients.NewClient(w, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
+	cl.ID = id
+	cl.Start()
+	s.Clients.Add(cl)
+	return cl
+}
+
+// request makes a request to the API and returns the response.
+func request(a *API, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	a.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNew(t *testing.T) {
+	s := mqtt.New()
+	a := New(s, testToken)
+	require.Equal(t, s, a.server)
+	require.Equal(t, testToken, a.token)
+}
+
+func TestUnauthorized(t *testing.T) {
+	a := New(mqtt.New(), testToken)
+
+	for _, token := range []string{"", "wrong"} {
+		rec := request(a, http.MethodGet, "/clients", token)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+		require.Equal(t, `Bearer realm="mqtt"`, rec.Header().Get("WWW-Authenticate"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/clients", nil)
+	req.Header.Set("Authorization", "Basic "+testToken)
+	rec := httptest.NewRecorder()
+	a.Handler().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestUnauthorizedNoToken(t *testing.T) {
+	a := New(mqtt.New(), "")
+	rec := request(a, http.MethodGet, "/clients", "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestNotFound(t *testing.T) {
+	a := New(mqtt.New(), testToken)
+	rec := request(a, http.MethodGet, "/sessions", testToken)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+}
+
+func TestListClients(t *testing.T) {
+	s := mqtt.New()
+	cl := addClient(t, s, "b")
+	cl.CleanSession = true
+	cl.NoteSubscription("a/b/c", 1)
+	addClient(t, s, "a")
+
+	offline := addClient(t, s, "c")
+	offline.Stop(nil)
+
+	rec := request(New(s, testToken), http.MethodGet, "/clients", testToken)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+
+	var got []mqtt.ClientSummary
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	require.Len(t, got, 2)
+	require.Equal(t, "a", got[0].ID)
+	require.Equal(t, "b", got[1].ID)
+	require.Equal(t, 1, got[1].Subscriptions)
+	require.True(t, got[1].CleanSession)
+	require.NotEqual(t, int64(0), got[1].ConnectedAt)
+}
+
+func TestListClientsMethodNotAllowed(t *testing.T) {
+	rec := request(New(mqtt.New(), testToken), http.MethodPost, "/clients", testToken)
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	require.Equal(t, http.MethodGet, rec.Header().Get("Allow"))
+}
+
+func TestListSubscriptions(t *testing.T) {
+	s := mqtt.New()
+	cl := addClient(t, s, "a/b")
+	cl.NoteSubscription("b/#", 2)
+	cl.NoteSubscriptionOptions("b/#", packets.SubOptions{RetainAsPublished: true, RetainHandling: 2})
+	cl.NoteSubscription("a/+", 0)
+
+	rec := request(New(s, testToken), http.MethodGet, "/clients/a%2Fb/subscriptions", testToken)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+
+	var got []mqtt.SubscriptionSummary
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	require.Equal(t, []mqtt.SubscriptionSummary{
+		{Filter: "a/+", Qos: 0},
+		{Filter: "b/#", Qos: 2, RetainAsPublished: true, RetainHandling: 2},
+	}, got)
+}
+
+func TestListSubscriptionsEmpty(t *testing.T) {
+	s := mqtt.New()
+	addClient(t, s, "mochi")
+
+	rec := request(New(s, testToken), http.MethodGet, "/clients/mochi/subscriptions", testToken)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, "[]", rec.Body.String())
+}
+
+func TestListSubscriptionsNotConnected(t *testing.T) {
+	rec := request(New(mqtt.New(), testToken), http.MethodGet, "/clients/mochi/subscriptions", testToken)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestListSubscriptionsMethodNotAllowed(t *testing.T) {
+	rec := request(New(mqtt.New(), testToken), http.MethodPost, "/clients/mochi/subscriptions", testToken)
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	require.Equal(t, http.MethodGet, rec.Header().Get("Allow"))
+}
+
+func TestListSubscriptionsInvalidID(t *testing.T) {
+	rec := request(New(mqtt.New(), testToken), http.MethodGet, "/clients//subscriptions", testToken)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestDisconnectClient(t *testing.T) {
+	s := mqtt.New()
+	cl := addClient(t, s, "a/b")
+
+	rec := request(New(s, testToken), http.MethodPost, "/clients/a%2Fb/disconnect", testToken)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.ErrorIs(t, cl.StopCause(), mqtt.ErrAdminDisconnect)
+}
+
+func TestDisconnectClientNotConnected(t *testing.T) {
+	rec := request(New(mqtt.New(), testToken), http.MethodPost, "/clients/mochi/disconnect", testToken)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	var got Error
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	require.Equal(t, mqtt.ErrClientNotConnected.Error(), got.Error)
+}
+
+func TestDisconnectClientMethodNotAllowed(t *testing.T) {
+	rec := request(New(mqtt.New(), testToken), http.MethodGet, "/clients/mochi/disconnect", testToken)
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	require.Equal(t, http.MethodPost, rec.Header().Get("Allow"))
+}
+
+func TestDisconnectClientInvalidID(t *testing.T) {
+	rec := request(New(mqtt.New(), testToken), http.MethodPost, "/clients//disconnect", testToken)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHealth(t *testing.T) {
+	s := mqtt.New()
+	h := Health(s)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	var status HealthStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	require.False(t, status.Healthy)
+	require.Equal(t, "none", status.Components["store"])
+
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"), nil)
+	require.NoError(t, err)
+	s.Listeners.Serve("t1", s.EstablishConnection)
+	defer s.Listeners.Close("t1", listeners.MockCloser)
+	require.Eventually(t, func() bool {
+		ok, _ := s.Health()
+		return ok
+	}, time.Second, time.Millisecond)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	require.True(t, status.Healthy)
+	require.Equal(t, "serving", status.Components["listener:t1"])
+}
+
+func TestHealthMethodNotAllowed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Health(mqtt.New()).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/healthz", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	require.Equal(t, "GET, HEAD", rec.Header().Get("Allow"))
+}
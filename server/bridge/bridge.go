@@ -0,0 +1,746 @@
+// Package bridge provides a bridge which forwards messages between the broker
+// and a remote MQTT broker.
+package bridge
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/csymapp/mqtt/server"
+	"github.com/csymapp/mqtt/server/events"
+	"github.com/csymapp/mqtt/server/internal/circ"
+	"github.com/csymapp/mqtt/server/internal/clients"
+	"github.com/csymapp/mqtt/server/internal/packets"
+	"github.com/csymapp/mqtt/server/listeners/auth"
+	"github.com/csymapp/mqtt/server/logger"
+	"github.com/csymapp/mqtt/server/system"
+)
+
+const (
+	defaultKeepalive  uint16 = 60               // the default keepalive for the remote connection, in seconds.
+	defaultMinBackoff        = time.Second      // the default initial delay between reconnection attempts.
+	defaultMaxBackoff        = 2 * time.Minute  // the default maximum delay between reconnection attempts.
+	defaultMaxPending        = 1024             // the default number of unacknowledged outbound messages held.
+	dialTimeout              = 10 * time.Second // the time allowed to establish a network connection.
+
+	// loopGuardExpiry is the number of seconds a forwarded message is
+	// remembered for, so it can be recognised if echoed by the remote broker.
+	loopGuardExpiry int64 = 30
+)
+
+var (
+	// ErrMissingAddress indicates that neither an address nor a dial function was set.
+	ErrMissingAddress = errors.New("bridge address not set")
+
+	// ErrInvalidMapping indicates that a topic mapping was not valid.
+	ErrInvalidMapping = errors.New("invalid topic mapping")
+
+	// ErrAlreadyServing indicates that Serve was called more than once.
+	ErrAlreadyServing = errors.New("bridge already serving")
+
+	// ErrConnectionRefused indicates that the remote broker refused the connection.
+	ErrConnectionRefused = errors.New("remote broker refused connection")
+
+	// ErrUnexpectedPacket indicates that the remote broker sent an unexpected packet.
+	ErrUnexpectedPacket = errors.New("unexpected packet from remote broker")
+
+	// ErrRemoteDisconnect indicates that the remote broker sent a disconnect packet.
+	ErrRemoteDisconnect = errors.New("remote broker disconnected")
+
+	// ErrSubscriptionRejected indicates that the remote broker rejected a subscription.
+	ErrSubscriptionRejected = errors.New("remote broker rejected subscription")
+
+	// ErrPendingFull indicates that an outbound message was dropped because too
+	// many messages were awaiting acknowledgement.
+	ErrPendingFull = errors.New("too many messages pending")
+
+	// ErrBridgeClosed indicates that the bridge was closed.
+	ErrBridgeClosed = errors.New("bridge closed")
+)
+
+// Mapping maps a set of topics between the local and remote brokers. A topic
+// matching LocalPrefix + Filter on the local broker corresponds to the topic on
+// the remote broker with LocalPrefix replaced by RemotePrefix, and vice versa.
+type Mapping struct {
+	Filter       string // the topic filter, relative to the prefixes.
+	LocalPrefix  string // the topic prefix on the local broker.
+	RemotePrefix string // the topic prefix on the remote broker.
+	Qos          byte   // the maximum qos messages are forwarded with.
+}
+
+// rewrite returns the topic with the from prefix replaced by the to prefix, and
+// true if the topic matches the mapping filter under the from prefix.
+func (m Mapping) rewrite(topic, from, to string) (string, bool) {
+	if !strings.HasPrefix(topic, from) || !auth.MatchTopic(from+m.Filter, topic) {
+		return "", false
+	}
+
+	return to + topic[len(from):], true
+}
+
+// Options contains configurable options for a bridge.
+type Options struct {
+	// Address is the network address of the remote broker, eg. broker.example.com:1883.
+	Address string
+
+	// TLSConfig enables tls for the remote connection if set.
+	TLSConfig *tls.Config
+
+	// Dial opens the connection to the remote broker, and may be set in place
+	// of Address, for example to connect through a proxy.
+	Dial func() (net.Conn, error)
+
+	// ClientID is the client id used to connect to the remote broker (default
+	// the id of the bridge).
+	ClientID string
+
+	// Username and Password are the credentials used to connect to the remote broker.
+	Username string
+	Password string
+
+	// CleanSession requests a clean session from the remote broker.
+	CleanSession bool
+
+	// Keepalive is the keepalive of the remote connection in seconds (default 60).
+	Keepalive uint16
+
+	// Out are the mappings of local topics which are forwarded to the remote broker.
+	Out []Mapping
+
+	// In are the mappings of remote topics which are subscribed to on the remote
+	// broker and republished on the local broker.
+	In []Mapping
+
+	// MinBackoff and MaxBackoff are the initial and maximum delays between
+	// reconnection attempts, which double after each failed attempt (default
+	// 1s and 2m).
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxPending is the maximum number of outbound qos messages held while
+	// awaiting acknowledgement or reconnection (default 1024).
+	MaxPending int
+}
+
+// Bridge forwards messages between the server and a remote broker, connecting
+// to the remote broker as a client. Messages published by local clients to
+// topics in the outbound mappings are forwarded to the remote broker, and
+// messages received from the remote broker for the inbound mappings are
+// republished on the server.
+//
+// Messages received from the remote broker are republished directly, so they
+// are never forwarded again by a bridge. Forwarded messages which are echoed
+// back by the remote broker are also recognised and dropped.
+type Bridge struct {
+	events.HookBase
+	sync.RWMutex
+	id       string                    // the id of the bridge.
+	opts     Options                   // configurable options for the bridge.
+	server   *mqtt.Server              // the server messages are bridged from.
+	system   *system.Info              // counters for the remote connection.
+	client   *clients.Client           // the connection to the remote broker, if connected.
+	pending  map[uint16]packets.Packet // outbound qos messages awaiting acknowledgement.
+	received map[uint16]bool           // inbound qos 2 messages awaiting release.
+	packetID uint16                    // the last packet id used for the remote connection.
+	guard    *loopGuard                // recognises forwarded messages echoed by the remote broker.
+	done     chan struct{}             // closed when the bridge is closed.
+	ended    chan struct{}             // closed when the bridge has stopped serving.
+	serving  uint32                    // indicates Serve has been called.
+	end      uint32                    // ensure the close method is only called once.
+}
+
+// New returns a new bridge between the server and a remote broker.
+func New(id string, s *mqtt.Server, o *Options) *Bridge {
+	if o == nil {
+		o = new(Options)
+	}
+
+	b := &Bridge{
+		id:       id,
+		opts:     *o,
+		server:   s,
+		system:   new(system.Info),
+		pending:  make(map[uint16]packets.Packet),
+		received: make(map[uint16]bool),
+		guard:    newLoopGuard(),
+		done:     make(chan struct{}),
+		ended:    make(chan struct{}),
+	}
+
+	if b.opts.ClientID == "" {
+		b.opts.ClientID = id
+	}
+
+	if b.opts.Keepalive == 0 {
+		b.opts.Keepalive = defaultKeepalive
+	}
+
+	if b.opts.MinBackoff <= 0 {
+		b.opts.MinBackoff = defaultMinBackoff
+	}
+
+	if b.opts.MaxBackoff < b.opts.MinBackoff {
+		b.opts.MaxBackoff = defaultMaxBackoff
+		if b.opts.MaxBackoff < b.opts.MinBackoff {
+			b.opts.MaxBackoff = b.opts.MinBackoff
+		}
+	}
+
+	if b.opts.MaxPending <= 0 {
+		b.opts.MaxPending = defaultMaxPending
+	}
+
+	return b
+}
+
+// ID returns the id of the bridge.
+func (b *Bridge) ID() string {
+	return b.id
+}
+
+// Connected returns true if the bridge is connected to the remote broker.
+func (b *Bridge) Connected() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.client != nil
+}
+
+// Serve registers the bridge as a hook on the server and begins connecting to
+// the remote broker, reconnecting with backoff whenever the connection is lost.
+func (b *Bridge) Serve() error {
+	if b.opts.Address == "" && b.opts.Dial == nil {
+		return ErrMissingAddress
+	}
+
+	for _, m := range append(append([]Mapping{}, b.opts.Out...), b.opts.In...) {
+		if m.Filter == "" || m.Qos > 2 {
+			return fmt.Errorf("%w: %q", ErrInvalidMapping, m.Filter)
+		}
+	}
+
+	if !atomic.CompareAndSwapUint32(&b.serving, 0, 1) {
+		return ErrAlreadyServing
+	}
+
+	b.server.AddHook(b)
+	go b.serve()
+
+	return nil
+}
+
+// Close disconnects from the remote broker and stops the bridge.
+func (b *Bridge) Close() {
+	if atomic.CompareAndSwapUint32(&b.end, 0, 1) {
+		close(b.done)
+	}
+
+	if atomic.LoadUint32(&b.serving) == 1 {
+		<-b.ended
+	}
+}
+
+// OnPublish forwards messages published to the server which match an outbound
+// mapping to the remote broker. The message itself is never modified.
+func (b *Bridge) OnPublish(cl events.Client, pk events.Packet) (events.Packet, error) {
+	if atomic.LoadUint32(&b.end) == 1 {
+		return pk, nil
+	}
+
+	for _, m := range b.opts.Out {
+		if topic, ok := m.rewrite(pk.TopicName, m.LocalPrefix, m.RemotePrefix); ok {
+			b.forward(topic, packets.Packet(pk), m.Qos)
+			break
+		}
+	}
+
+	return pk, nil
+}
+
+// forward sends a message to the remote broker. Qos messages are held until
+// acknowledged, and are resent on reconnection if the bridge is disconnected.
+func (b *Bridge) forward(topic string, pk packets.Packet, qos byte) {
+	out := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    pk.FixedHeader.Qos,
+			Retain: pk.FixedHeader.Retain,
+		},
+		TopicName: topic,
+		Payload:   pk.Payload,
+	}
+
+	if out.FixedHeader.Qos > qos {
+		out.FixedHeader.Qos = qos
+	}
+
+	b.Lock()
+	if out.FixedHeader.Qos > 0 {
+		if len(b.pending) >= b.opts.MaxPending {
+			b.Unlock()
+			b.onError(fmt.Errorf("%w: %s", ErrPendingFull, topic))
+			return
+		}
+
+		out.PacketID = b.nextPacketID()
+		b.pending[out.PacketID] = out
+	}
+	cl := b.client
+	b.Unlock()
+
+	if b.inbound(topic) {
+		b.guard.note(topic, out.Payload, time.Now().Unix())
+	}
+
+	if cl != nil {
+		_, err := cl.WritePacket(out)
+		b.onError(err)
+	}
+}
+
+// inbound returns true if a remote topic matches an inbound mapping, in which
+// case the remote broker may echo messages forwarded to it.
+func (b *Bridge) inbound(topic string) bool {
+	for _, m := range b.opts.In {
+		if _, ok := m.rewrite(topic, m.RemotePrefix, m.LocalPrefix); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextPacketID returns the next unused packet id. The bridge must be locked.
+func (b *Bridge) nextPacketID() uint16 {
+	for {
+		b.packetID++
+		if b.packetID == 0 {
+			b.packetID = 1
+		}
+
+		if _, ok := b.pending[b.packetID]; !ok {
+			return b.packetID
+		}
+	}
+}
+
+// serve maintains the connection to the remote broker until the bridge is closed.
+func (b *Bridge) serve() {
+	defer close(b.ended)
+
+	backoff := b.opts.MinBackoff
+	for {
+		connected, err := b.session()
+		if atomic.LoadUint32(&b.end) == 1 {
+			return
+		}
+
+		if connected {
+			backoff = b.opts.MinBackoff
+		}
+
+		b.onError(err)
+
+		select {
+		case <-b.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > b.opts.MaxBackoff {
+			backoff = b.opts.MaxBackoff
+		}
+	}
+}
+
+// dial opens a network connection to the remote broker.
+func (b *Bridge) dial() (net.Conn, error) {
+	if b.opts.Dial != nil {
+		return b.opts.Dial()
+	}
+
+	d := &net.Dialer{Timeout: dialTimeout}
+	if b.opts.TLSConfig != nil {
+		return tls.DialWithDialer(d, "tcp", b.opts.Address, b.opts.TLSConfig)
+	}
+
+	return d.Dial("tcp", b.opts.Address)
+}
+
+// session connects to the remote broker and bridges messages until the
+// connection is closed. connected is true if the remote broker accepted the
+// connection.
+func (b *Bridge) session() (connected bool, err error) {
+	conn, err := b.dial()
+	if err != nil {
+		return false, fmt.Errorf("dial: %w", err)
+	}
+
+	cl := clients.NewClient(conn, circ.NewReader(0, 0), circ.NewWriter(0, 0), b.system)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+		ProtocolName:     []byte("MQTT"),
+		ProtocolVersion:  4,
+		CleanSession:     b.opts.CleanSession,
+		Keepalive:        b.opts.Keepalive,
+		ClientIdentifier: b.opts.ClientID,
+	}
+
+	if b.opts.Username != "" {
+		pk.UsernameFlag = true
+		pk.Username = []byte(b.opts.Username)
+	}
+
+	if b.opts.Password != "" {
+		pk.PasswordFlag = true
+		pk.Password = []byte(b.opts.Password)
+	}
+
+	cl.Identify(b.id, pk, nil)
+	cl.Start()
+
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		cl.Stop(err)
+
+		b.Lock()
+		if b.client == cl {
+			b.client = nil
+		}
+		b.Unlock()
+	}()
+
+	go b.keepalive(cl, stop)
+
+	err = b.handshake(cl, pk)
+	if err != nil {
+		return false, err
+	}
+
+	b.server.Options.Logger.Info("bridge connected", "bridge", b.id, logger.KeyRemoteAddr, b.opts.Address)
+
+	err = cl.Read(b.processPacket)
+	if err == nil {
+		err = cl.StopCause()
+	}
+
+	return true, err
+}
+
+// handshake connects to the remote broker, subscribes to the inbound mappings,
+// and resends any unacknowledged messages.
+func (b *Bridge) handshake(cl *clients.Client, pk packets.Packet) error {
+	_, err := cl.WritePacket(pk)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+
+	fh := new(packets.FixedHeader)
+	err = cl.ReadFixedHeader(fh)
+	if err != nil {
+		return fmt.Errorf("connack: %w", err)
+	}
+
+	ack, err := cl.ReadPacket(fh)
+	if err != nil {
+		return fmt.Errorf("connack: %w", err)
+	}
+
+	if ack.FixedHeader.Type != packets.Connack {
+		return fmt.Errorf("%w: %d", ErrUnexpectedPacket, ack.FixedHeader.Type)
+	}
+
+	if ack.ReturnCode != packets.Accepted {
+		return fmt.Errorf("%w: code %d", ErrConnectionRefused, ack.ReturnCode)
+	}
+
+	b.Lock()
+	b.client = cl
+	sub := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+			Qos:  1,
+		},
+		PacketID: b.nextPacketID(),
+	}
+
+	ids := make([]int, 0, len(b.pending))
+	for id := range b.pending {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	resend := make([]packets.Packet, 0, len(ids))
+	for _, id := range ids {
+		out := b.pending[uint16(id)]
+		if out.FixedHeader.Type == packets.Publish {
+			out.FixedHeader.Dup = true
+		}
+		resend = append(resend, out)
+	}
+	b.Unlock()
+
+	for _, m := range b.opts.In {
+		sub.Topics = append(sub.Topics, m.RemotePrefix+m.Filter)
+		sub.Qoss = append(sub.Qoss, m.Qos)
+	}
+
+	if len(sub.Topics) > 0 {
+		_, err = cl.WritePacket(sub)
+		if err != nil {
+			return fmt.Errorf("subscribe: %w", err)
+		}
+	}
+
+	for _, out := range resend {
+		_, err = cl.WritePacket(out)
+		if err != nil {
+			return fmt.Errorf("resend: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// keepalive pings the remote broker until the connection is stopped, and
+// disconnects from the remote broker when the bridge is closed.
+func (b *Bridge) keepalive(cl *clients.Client, stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(b.opts.Keepalive) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-b.done:
+			_, _ = cl.WritePacket(packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Disconnect,
+				},
+			})
+			cl.Stop(ErrBridgeClosed)
+			return
+		case <-ticker.C:
+			_, err := cl.WritePacket(packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Pingreq,
+				},
+			})
+			b.onError(err)
+		}
+	}
+}
+
+// processPacket processes a packet received from the remote broker.
+func (b *Bridge) processPacket(cl *clients.Client, pk packets.Packet) error {
+	switch pk.FixedHeader.Type {
+	case packets.Publish:
+		return b.processPublish(cl, pk)
+	case packets.Puback, packets.Pubcomp:
+		b.Lock()
+		delete(b.pending, pk.PacketID)
+		b.Unlock()
+	case packets.Pubrec:
+		out := packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Pubrel,
+				Qos:  1,
+			},
+			PacketID: pk.PacketID,
+		}
+
+		b.Lock()
+		if _, ok := b.pending[pk.PacketID]; ok {
+			b.pending[pk.PacketID] = out // resend the release if disconnected.
+		}
+		b.Unlock()
+
+		_, err := cl.WritePacket(out)
+		return err
+	case packets.Pubrel:
+		b.Lock()
+		delete(b.received, pk.PacketID)
+		b.Unlock()
+
+		_, err := cl.WritePacket(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Pubcomp,
+			},
+			PacketID: pk.PacketID,
+		})
+		return err
+	case packets.Suback:
+		for i, code := range pk.ReturnCodes {
+			if code >= packets.ErrSubAckNetworkError && i < len(b.opts.In) {
+				m := b.opts.In[i]
+				b.onError(fmt.Errorf("%w: %s", ErrSubscriptionRejected, m.RemotePrefix+m.Filter))
+			}
+		}
+	case packets.Pingresp, packets.Unsuback:
+	case packets.Disconnect:
+		return ErrRemoteDisconnect
+	default:
+		return fmt.Errorf("%w: %d", ErrUnexpectedPacket, pk.FixedHeader.Type)
+	}
+
+	return nil
+}
+
+// processPublish acknowledges a message received from the remote broker and
+// republishes it on the server if it matches an inbound mapping.
+func (b *Bridge) processPublish(cl *clients.Client, pk packets.Packet) error {
+	switch pk.FixedHeader.Qos {
+	case 1:
+		_, err := cl.WritePacket(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Puback,
+			},
+			PacketID: pk.PacketID,
+		})
+		if err != nil {
+			return err
+		}
+	case 2:
+		b.Lock()
+		dup := b.received[pk.PacketID]
+		b.received[pk.PacketID] = true
+		b.Unlock()
+
+		_, err := cl.WritePacket(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Pubrec,
+			},
+			PacketID: pk.PacketID,
+		})
+		if err != nil || dup {
+			return err
+		}
+	}
+
+	if b.guard.echo(pk.TopicName, pk.Payload, time.Now().Unix()) {
+		return nil
+	}
+
+	for _, m := range b.opts.In {
+		if topic, ok := m.rewrite(pk.TopicName, m.RemotePrefix, m.LocalPrefix); ok {
+			b.onError(b.server.Publish(topic, pk.Payload, pk.FixedHeader.Qos, pk.FixedHeader.Retain))
+			break
+		}
+	}
+
+	return nil
+}
+
+// info returns client information describing the bridge, for use with events.
+func (b *Bridge) info() events.Client {
+	return events.Client{
+		ID:       b.opts.ClientID,
+		Remote:   b.opts.Address,
+		Listener: b.id,
+	}
+}
+
+// onError logs an error with the server's logger, and passes it to the
+// server's OnError event hook, if set.
+func (b *Bridge) onError(err error) {
+	if err == nil {
+		return
+	}
+
+	b.server.Options.Logger.Warn("bridge error",
+		"bridge", b.id,
+		logger.KeyRemoteAddr, b.opts.Address,
+		logger.KeyError, err,
+	)
+
+	if b.server.Events.OnError != nil {
+		b.server.Events.OnError(b.info(), fmt.Errorf("bridge %s: %w", b.id, err))
+	}
+}
+
+// loopGuard remembers messages recently forwarded to the remote broker, so
+// that they can be recognised and dropped if the remote broker echoes them.
+type loopGuard struct {
+	sync.Mutex
+	seen   map[uint64]guardEntry // forwarded messages, keyed on a hash of the topic and payload.
+	pruned int64                 // the last time expired messages were forgotten.
+}
+
+// guardEntry is a forwarded message remembered by a loopGuard.
+type guardEntry struct {
+	count   int   // the number of times the message was forwarded.
+	expires int64 // the unix time the message is forgotten.
+}
+
+// newLoopGuard returns a new loopGuard.
+func newLoopGuard() *loopGuard {
+	return &loopGuard{
+		seen: make(map[uint64]guardEntry),
+	}
+}
+
+// key returns the hash of a topic and payload.
+func (g *loopGuard) key(topic string, payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return h.Sum64()
+}
+
+// note remembers a forwarded message, and forgets any expired messages at most
+// once a second.
+func (g *loopGuard) note(topic string, payload []byte, now int64) {
+	k := g.key(topic, payload)
+
+	g.Lock()
+	defer g.Unlock()
+
+	if now > g.pruned {
+		g.pruned = now
+		for key, e := range g.seen {
+			if e.expires < now {
+				delete(g.seen, key)
+			}
+		}
+	}
+
+	e := g.seen[k]
+	e.count++
+	e.expires = now + loopGuardExpiry
+	g.seen[k] = e
+}
+
+// echo returns true if a message received from the remote broker was recently
+// forwarded to it, forgetting one instance of the forwarded message.
+func (g *loopGuard) echo(topic string, payload []byte, now int64) bool {
+	k := g.key(topic, payload)
+
+	g.Lock()
+	defer g.Unlock()
+
+	e, ok := g.seen[k]
+	if !ok || e.expires < now {
+		return false
+	}
+
+	e.count--
+	if e.count == 0 {
+		delete(g.seen, k)
+	} else {
+		g.seen[k] = e
+	}
+
+	return true
+}
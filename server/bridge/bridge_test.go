@@ -0,0 +1,493 @@
+package bridge
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/csymapp/mqtt/server"
+	"github.com/csymapp/mqtt/server/events"
+	"github.com/csymapp/mqtt/server/internal/packets"
+	"github.com/csymapp/mqtt/server/listeners/auth"
+)
+
+// writePacket encodes and writes a packet to a test client connection.
+func writePacket(t *testing.T, c net.Conn, pk packets.Packet) {
+	pk.ProtocolVersion = 4
+	buf := new(bytes.Buffer)
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		require.NoError(t, pk.ConnectEncode(buf))
+	case packets.Publish:
+		require.NoError(t, pk.PublishEncode(buf))
+	case packets.Subscribe:
+		require.NoError(t, pk.SubscribeEncode(buf))
+	}
+
+	_, err := c.Write(buf.Bytes())
+	require.NoError(t, err)
+}
+
+// readPacket reads and decodes a packet from a test client connection.
+func readPacket(t *testing.T, c net.Conn) packets.Packet {
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+
+	hb := make([]byte, 2)
+	_, err := io.ReadFull(c, hb)
+	require.NoError(t, err)
+
+	var pk packets.Packet
+	require.NoError(t, pk.FixedHeader.Decode(hb[0]))
+	pk.FixedHeader.Remaining = int(hb[1]) // test packets are always short.
+	pk.ProtocolVersion = 4
+
+	body := make([]byte, pk.FixedHeader.Remaining)
+	_, err = io.ReadFull(c, body)
+	require.NoError(t, err)
+
+	if pk.FixedHeader.Type == packets.Publish {
+		require.NoError(t, pk.PublishDecode(body))
+	}
+
+	return pk
+}
+
+// connectClient connects a test client to a server.
+func connectClient(t *testing.T, s *mqtt.Server, id string) net.Conn {
+	r, w := net.Pipe()
+	go s.EstablishConnection("test", r, new(auth.Allow))
+
+	writePacket(t, w, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+		ProtocolName:     []byte("MQTT"),
+		CleanSession:     true,
+		Keepalive:        30,
+		ClientIdentifier: id,
+	})
+	require.Equal(t, packets.Connack, readPacket(t, w).FixedHeader.Type)
+
+	return w
+}
+
+// subscribeClient subscribes a test client to a filter.
+func subscribeClient(t *testing.T, c net.Conn, filter string) {
+	writePacket(t, c, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+			Qos:  1,
+		},
+		PacketID: 1,
+		Topics:   []string{filter},
+		Qoss:     []byte{0},
+	})
+	require.Equal(t, packets.Suback, readPacket(t, c).FixedHeader.Type)
+}
+
+// publishClient publishes a qos 0 message from a test client.
+func publishClient(t *testing.T, c net.Conn, topic, payload string) {
+	writePacket(t, c, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: topic,
+		Payload:   []byte(payload),
+	})
+}
+
+// setupBridge returns a local and remote server, with a bridge between them
+// which connects to the remote server through a pipe.
+func setupBridge(t *testing.T, o *Options) (*mqtt.Server, *mqtt.Server, *Bridge) {
+	local := mqtt.New()
+	remote := mqtt.New()
+	require.NoError(t, local.Serve())
+	require.NoError(t, remote.Serve())
+
+	o.Dial = func() (net.Conn, error) {
+		r, w := net.Pipe()
+		go remote.EstablishConnection("bridge", r, new(auth.Allow))
+		return w, nil
+	}
+
+	b := New("cloud", local, o)
+	require.NoError(t, b.Serve())
+	require.Eventually(t, b.Connected, time.Second, 5*time.Millisecond)
+
+	t.Cleanup(func() {
+		b.Close()
+		local.Close()
+		remote.Close()
+	})
+
+	return local, remote, b
+}
+
+func TestMappingRewrite(t *testing.T) {
+	m := Mapping{Filter: "sensors/#", LocalPrefix: "site/", RemotePrefix: "cloud/site1/"}
+
+	topic, ok := m.rewrite("site/sensors/temp", m.LocalPrefix, m.RemotePrefix)
+	require.True(t, ok)
+	require.Equal(t, "cloud/site1/sensors/temp", topic)
+
+	topic, ok = m.rewrite("cloud/site1/sensors/temp", m.RemotePrefix, m.LocalPrefix)
+	require.True(t, ok)
+	require.Equal(t, "site/sensors/temp", topic)
+
+	_, ok = m.rewrite("site/actuators/fan", m.LocalPrefix, m.RemotePrefix)
+	require.False(t, ok)
+
+	_, ok = m.rewrite("other/sensors/temp", m.LocalPrefix, m.RemotePrefix)
+	require.False(t, ok)
+
+	m = Mapping{Filter: "a/+"}
+	topic, ok = m.rewrite("a/b", m.LocalPrefix, m.RemotePrefix)
+	require.True(t, ok)
+	require.Equal(t, "a/b", topic)
+}
+
+func TestLoopGuard(t *testing.T) {
+	g := newLoopGuard()
+	require.False(t, g.echo("a/b", []byte("hello"), 100))
+
+	g.note("a/b", []byte("hello"), 100)
+	g.note("a/b", []byte("hello"), 100)
+	require.False(t, g.echo("a/b", []byte("other"), 100))
+	require.False(t, g.echo("a/c", []byte("hello"), 100))
+	require.True(t, g.echo("a/b", []byte("hello"), 100))
+	require.True(t, g.echo("a/b", []byte("hello"), 100))
+	require.False(t, g.echo("a/b", []byte("hello"), 100))
+
+	g.note("a/b", []byte("hello"), 100)
+	require.False(t, g.echo("a/b", []byte("hello"), 100+loopGuardExpiry+1))
+
+	g.note("a/c", []byte("hello"), 200)
+	require.Len(t, g.seen, 1)
+}
+
+func TestNew(t *testing.T) {
+	b := New("cloud", mqtt.New(), nil)
+	require.Equal(t, "cloud", b.ID())
+	require.Equal(t, "cloud", b.opts.ClientID)
+	require.Equal(t, defaultKeepalive, b.opts.Keepalive)
+	require.Equal(t, defaultMinBackoff, b.opts.MinBackoff)
+	require.Equal(t, defaultMaxBackoff, b.opts.MaxBackoff)
+	require.Equal(t, defaultMaxPending, b.opts.MaxPending)
+	require.False(t, b.Connected())
+
+	b = New("cloud", mqtt.New(), &Options{
+		MinBackoff: 5 * time.Minute,
+	})
+	require.Equal(t, 5*time.Minute, b.opts.MaxBackoff)
+}
+
+func TestServeInvalid(t *testing.T) {
+	s := mqtt.New()
+	b := New("cloud", s, nil)
+	require.ErrorIs(t, b.Serve(), ErrMissingAddress)
+
+	b = New("cloud", s, &Options{
+		Address: "localhost:1883",
+		Out:     []Mapping{{Filter: "a/b", Qos: 3}},
+	})
+	require.ErrorIs(t, b.Serve(), ErrInvalidMapping)
+
+	b = New("cloud", s, &Options{
+		Address: "localhost:1883",
+		In:      []Mapping{{}},
+	})
+	require.ErrorIs(t, b.Serve(), ErrInvalidMapping)
+}
+
+func TestServeTwice(t *testing.T) {
+	_, _, b := setupBridge(t, &Options{})
+	require.ErrorIs(t, b.Serve(), ErrAlreadyServing)
+}
+
+func TestBridgeOut(t *testing.T) {
+	local, remote, _ := setupBridge(t, &Options{
+		Out: []Mapping{{Filter: "sensors/#", LocalPrefix: "site/", RemotePrefix: "cloud/site1/", Qos: 1}},
+	})
+
+	sub := connectClient(t, remote, "sub")
+	subscribeClient(t, sub, "cloud/#")
+
+	pub := connectClient(t, local, "pub")
+	publishClient(t, pub, "site/actuators/fan", "on")
+	publishClient(t, pub, "site/sensors/temp", "21")
+
+	pk := readPacket(t, sub)
+	require.Equal(t, "cloud/site1/sensors/temp", pk.TopicName)
+	require.Equal(t, []byte("21"), pk.Payload)
+}
+
+func TestBridgeOutQos(t *testing.T) {
+	_, _, b := setupBridge(t, &Options{
+		Out: []Mapping{{Filter: "a/#", Qos: 1}},
+	})
+
+	b.OnPublish(events.Client{}, events.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  2,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("hello"),
+	})
+
+	// The message is held until acknowledged by the remote broker.
+	require.Eventually(t, func() bool {
+		b.RLock()
+		defer b.RUnlock()
+		return len(b.pending) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestBridgeIn(t *testing.T) {
+	local, remote, _ := setupBridge(t, &Options{
+		In: []Mapping{{Filter: "commands/#", LocalPrefix: "site/", RemotePrefix: "cloud/site1/", Qos: 1}},
+	})
+
+	sub := connectClient(t, local, "sub")
+	subscribeClient(t, sub, "site/#")
+
+	// allow the bridge subscription to be established.
+	require.Eventually(t, func() bool {
+		return len(remote.Topics.Subscribers("cloud/site1/commands/reboot")) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, remote.Publish("cloud/site1/other", []byte("no"), 0, false))
+	require.NoError(t, remote.Publish("cloud/site1/commands/reboot", []byte("now"), 0, false))
+
+	pk := readPacket(t, sub)
+	require.Equal(t, "site/commands/reboot", pk.TopicName)
+	require.Equal(t, []byte("now"), pk.Payload)
+}
+
+func TestBridgeLoopPrevention(t *testing.T) {
+	var forwarded int
+	var mu sync.Mutex
+
+	local, remote, _ := setupBridge(t, &Options{
+		Out: []Mapping{{Filter: "a/#"}},
+		In:  []Mapping{{Filter: "a/#"}},
+	})
+
+	remote.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		mu.Lock()
+		forwarded++
+		mu.Unlock()
+		return pk, nil
+	}
+
+	require.Eventually(t, func() bool {
+		return len(remote.Topics.Subscribers("a/b")) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	sub := connectClient(t, local, "sub")
+	subscribeClient(t, sub, "a/#")
+
+	pub := connectClient(t, local, "pub")
+	publishClient(t, pub, "a/b", "hello")
+
+	pk := readPacket(t, sub)
+	require.Equal(t, "a/b", pk.TopicName)
+
+	// The echo from the remote broker must not be delivered again.
+	require.NoError(t, sub.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err := sub.Read(make([]byte, 1))
+	var nerr net.Error
+	require.True(t, errors.As(err, &nerr) && nerr.Timeout())
+
+	mu.Lock()
+	require.Equal(t, 1, forwarded)
+	mu.Unlock()
+}
+
+func TestBridgeReconnect(t *testing.T) {
+	local := mqtt.New()
+	remote := mqtt.New()
+	require.NoError(t, remote.Serve())
+	defer remote.Close()
+
+	errs := make(chan error, 10)
+	local.Events.OnError = func(cl events.Client, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	var attempts int
+	var mu sync.Mutex
+	b := New("cloud", local, &Options{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 4 * time.Millisecond,
+		Dial: func() (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if attempts < 3 {
+				return nil, errors.New("test")
+			}
+
+			r, w := net.Pipe()
+			go remote.EstablishConnection("bridge", r, new(auth.Allow))
+			return w, nil
+		},
+	})
+	require.NoError(t, b.Serve())
+	require.Eventually(t, b.Connected, time.Second, 5*time.Millisecond)
+	require.Contains(t, (<-errs).Error(), "dial")
+
+	cl, ok := remote.Clients.Get("cloud")
+	require.True(t, ok)
+	cl.Stop(errors.New("test"))
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts == 4 && b.Connected()
+	}, time.Second, 5*time.Millisecond)
+
+	b.Close()
+	require.False(t, b.Connected())
+}
+
+func TestBridgeConnectionRefused(t *testing.T) {
+	local := mqtt.New()
+	remote := mqtt.New()
+	require.NoError(t, remote.Serve())
+	defer remote.Close()
+
+	errs := make(chan error, 10)
+	local.Events.OnError = func(cl events.Client, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	b := New("cloud", local, &Options{
+		Dial: func() (net.Conn, error) {
+			r, w := net.Pipe()
+			go remote.EstablishConnection("bridge", r, new(auth.Disallow))
+			return w, nil
+		},
+	})
+	require.NoError(t, b.Serve())
+	defer b.Close()
+
+	require.ErrorIs(t, <-errs, ErrConnectionRefused)
+	require.False(t, b.Connected())
+}
+
+func TestBridgeResendPending(t *testing.T) {
+	local := mqtt.New()
+	remote := mqtt.New()
+	require.NoError(t, local.Serve())
+	require.NoError(t, remote.Serve())
+	defer local.Close()
+	defer remote.Close()
+
+	received := make(chan events.Packet, 1)
+	remote.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		received <- pk
+		return pk, nil
+	}
+
+	online := make(chan struct{})
+	b := New("cloud", local, &Options{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+		Out:        []Mapping{{Filter: "a/#", Qos: 1}},
+		Dial: func() (net.Conn, error) {
+			select {
+			case <-online:
+			default:
+				return nil, errors.New("offline")
+			}
+
+			r, w := net.Pipe()
+			go remote.EstablishConnection("bridge", r, new(auth.Allow))
+			return w, nil
+		},
+	})
+	require.NoError(t, b.Serve())
+	defer b.Close()
+
+	b.OnPublish(events.Client{}, events.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("queued"),
+	})
+
+	b.OnPublish(events.Client{}, events.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("dropped"),
+	})
+
+	close(online)
+
+	select {
+	case pk := <-received:
+		require.Equal(t, []byte("queued"), pk.Payload)
+		require.True(t, pk.FixedHeader.Dup)
+	case <-time.After(time.Second):
+		t.Fatal("expected pending message to be resent")
+	}
+}
+
+func TestBridgePendingFull(t *testing.T) {
+	s := mqtt.New()
+	var errs []error
+	s.Events.OnError = func(cl events.Client, err error) {
+		errs = append(errs, err)
+	}
+
+	b := New("cloud", s, &Options{
+		MaxPending: 1,
+		Out:        []Mapping{{Filter: "a/#", Qos: 1}},
+	})
+
+	pk := events.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		TopicName: "a/b",
+	}
+	b.OnPublish(events.Client{}, pk)
+	b.OnPublish(events.Client{}, pk)
+
+	require.Len(t, b.pending, 1)
+	require.Len(t, errs, 1)
+	require.ErrorIs(t, errs[0], ErrPendingFull)
+}
+
+func TestBridgeClosedDoesNotForward(t *testing.T) {
+	b := New("cloud", mqtt.New(), &Options{
+		Out: []Mapping{{Filter: "a/#", Qos: 1}},
+	})
+	b.Close()
+
+	b.OnPublish(events.Client{}, events.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		TopicName: "a/b",
+	})
+	require.Empty(t, b.pending)
+}
@@ -25,6 +25,10 @@ type Client struct {
 	Listener     string
 	Username     []byte
 	CleanSession bool
+
+	// UserProperties are the mqtt v5 user properties from the client's
+	// connect packet, in the order they were sent.
+	UserProperties []packets.UserProperty
 }
 
 // Clientlike is an interface for Clients and client-like objects that
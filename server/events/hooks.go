@@ -0,0 +1,209 @@
+package events
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrRejectPacket may be returned by OnProcessMessage or a hook's OnPublish
+// method to abandon any further processing of a publish packet.
+var ErrRejectPacket = errors.New("packet rejected")
+
+// Hook is an extension which is called by the server when events occur. Hooks
+// should embed HookBase so that they only need to implement the methods they
+// are interested in. As with the Events callbacks, the methods block the
+// server until they return.
+type Hook interface {
+	// OnConnect is called when a client successfully connects to the broker.
+	OnConnect(cl Client, pk Packet)
+
+	// OnDisconnect is called when a client disconnects from the broker. err is
+	// nil if the client disconnected normally.
+	OnDisconnect(cl Client, err error)
+
+	// OnPublish is called when a publish message is received from a client,
+	// before it is retained or routed to subscribers. The returned packet
+	// replaces the received packet. If an error is returned, any changes are
+	// discarded, and if the error is ErrRejectPacket the message is dropped.
+	OnPublish(cl Client, pk Packet) (Packet, error)
+
+	// OnSubscribe is called when a new subscription filter for a client is created.
+	OnSubscribe(filter string, cl Client, qos byte)
+
+	// OnUnsubscribe is called when an existing subscription filter for a client is removed.
+	OnUnsubscribe(filter string, cl Client)
+
+	// OnDisconnectReason is called before the server disconnects an MQTT v5
+	// client, with the reason code and the reason string it will be sent. The
+	// returned string replaces the reason string, and may be empty to send none.
+	OnDisconnectReason(cl Client, code byte, reason string) string
+
+	// OnListenerStarted is called when a listener starts serving connections.
+	OnListenerStarted(id string)
+
+	// OnListenerStopped is called when a listener is closed, after its clients
+	// have been disconnected.
+	OnListenerStopped(id string)
+
+	// OnListenerBindFailed is called when a listener being added fails to open
+	// its network address.
+	OnListenerBindFailed(id string, err error)
+
+	// OnStorageError is called when a call to the store fails, with the name of
+	// the store method (eg. "WriteInflight") and the error. cl is the client
+	// the call was made for, or the server's inline client.
+	OnStorageError(cl Client, op string, err error)
+}
+
+// HookBase provides no-op implementations of the Hook methods, and should be
+// embedded by hooks.
+type HookBase struct{}
+
+// OnConnect does nothing.
+func (HookBase) OnConnect(cl Client, pk Packet) {}
+
+// OnDisconnect does nothing.
+func (HookBase) OnDisconnect(cl Client, err error) {}
+
+// OnPublish returns the packet unchanged.
+func (HookBase) OnPublish(cl Client, pk Packet) (Packet, error) { return pk, nil }
+
+// OnSubscribe does nothing.
+func (HookBase) OnSubscribe(filter string, cl Client, qos byte) {}
+
+// OnUnsubscribe does nothing.
+func (HookBase) OnUnsubscribe(filter string, cl Client) {}
+
+// OnDisconnectReason returns the reason string unchanged.
+func (HookBase) OnDisconnectReason(cl Client, code byte, reason string) string { return reason }
+
+// OnListenerStarted does nothing.
+func (HookBase) OnListenerStarted(id string) {}
+
+// OnListenerStopped does nothing.
+func (HookBase) OnListenerStopped(id string) {}
+
+// OnListenerBindFailed does nothing.
+func (HookBase) OnListenerBindFailed(id string, err error) {}
+
+// OnStorageError does nothing.
+func (HookBase) OnStorageError(cl Client, op string, err error) {}
+
+// Hooks is a set of hooks which are called in the order they were added.
+type Hooks struct {
+	sync.RWMutex
+	internal []Hook // the hooks, in order of registration.
+}
+
+// Add adds a hook to the end of the set.
+func (h *Hooks) Add(hook Hook) {
+	h.Lock()
+	h.internal = append(h.internal, hook)
+	h.Unlock()
+}
+
+// Len returns the number of hooks in the set.
+func (h *Hooks) Len() int {
+	h.RLock()
+	n := len(h.internal)
+	h.RUnlock()
+	return n
+}
+
+// all returns a snapshot of the hooks, so they can be called without holding the lock.
+func (h *Hooks) all() []Hook {
+	h.RLock()
+	hooks := h.internal
+	h.RUnlock()
+	return hooks
+}
+
+// OnConnect calls the OnConnect method of each hook.
+func (h *Hooks) OnConnect(cl Client, pk Packet) {
+	for _, hook := range h.all() {
+		hook.OnConnect(cl, pk)
+	}
+}
+
+// OnDisconnect calls the OnDisconnect method of each hook.
+func (h *Hooks) OnDisconnect(cl Client, err error) {
+	for _, hook := range h.all() {
+		hook.OnDisconnect(cl, err)
+	}
+}
+
+// OnPublish calls the OnPublish method of each hook, passing the packet
+// returned by each hook to the next. If a hook returns ErrRejectPacket, no
+// further hooks are called and the error is returned. Other errors are passed
+// to onError, if set, and the packet from the failing hook is discarded.
+func (h *Hooks) OnPublish(cl Client, pk Packet, onError OnError) (Packet, error) {
+	for _, hook := range h.all() {
+		pkx, err := hook.OnPublish(cl, pk)
+		if err != nil {
+			if errors.Is(err, ErrRejectPacket) {
+				return pk, err
+			}
+
+			if onError != nil {
+				onError(cl, err)
+			}
+			continue
+		}
+
+		pk = pkx
+	}
+
+	return pk, nil
+}
+
+// OnSubscribe calls the OnSubscribe method of each hook.
+func (h *Hooks) OnSubscribe(filter string, cl Client, qos byte) {
+	for _, hook := range h.all() {
+		hook.OnSubscribe(filter, cl, qos)
+	}
+}
+
+// OnUnsubscribe calls the OnUnsubscribe method of each hook.
+func (h *Hooks) OnUnsubscribe(filter string, cl Client) {
+	for _, hook := range h.all() {
+		hook.OnUnsubscribe(filter, cl)
+	}
+}
+
+// OnDisconnectReason calls the OnDisconnectReason method of each hook, passing
+// the reason string returned by each hook to the next, and returns the last.
+func (h *Hooks) OnDisconnectReason(cl Client, code byte, reason string) string {
+	for _, hook := range h.all() {
+		reason = hook.OnDisconnectReason(cl, code, reason)
+	}
+
+	return reason
+}
+
+// OnListenerStarted calls the OnListenerStarted method of each hook.
+func (h *Hooks) OnListenerStarted(id string) {
+	for _, hook := range h.all() {
+		hook.OnListenerStarted(id)
+	}
+}
+
+// OnListenerStopped calls the OnListenerStopped method of each hook.
+func (h *Hooks) OnListenerStopped(id string) {
+	for _, hook := range h.all() {
+		hook.OnListenerStopped(id)
+	}
+}
+
+// OnListenerBindFailed calls the OnListenerBindFailed method of each hook.
+func (h *Hooks) OnListenerBindFailed(id string, err error) {
+	for _, hook := range h.all() {
+		hook.OnListenerBindFailed(id, err)
+	}
+}
+
+// OnStorageError calls the OnStorageError method of each hook.
+func (h *Hooks) OnStorageError(cl Client, op string, err error) {
+	for _, hook := range h.all() {
+		hook.OnStorageError(cl, op, err)
+	}
+}
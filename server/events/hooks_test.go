@@ -0,0 +1,165 @@
+package events
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordHook records the events it is called with.
+type recordHook struct {
+	HookBase
+	name   string
+	calls  *[]string
+	suffix string // appended to published payloads.
+	err    error  // returned from OnPublish.
+}
+
+func (h *recordHook) OnConnect(cl Client, pk Packet) {
+	*h.calls = append(*h.calls, h.name+":connect:"+cl.ID)
+}
+
+func (h *recordHook) OnDisconnect(cl Client, err error) {
+	*h.calls = append(*h.calls, h.name+":disconnect:"+cl.ID)
+}
+
+func (h *recordHook) OnPublish(cl Client, pk Packet) (Packet, error) {
+	*h.calls = append(*h.calls, h.name+":publish:"+string(pk.Payload))
+	if h.err != nil {
+		pk.Payload = []byte("discarded")
+		return pk, h.err
+	}
+
+	pk.Payload = append(pk.Payload, h.suffix...)
+	return pk, nil
+}
+
+func (h *recordHook) OnSubscribe(filter string, cl Client, qos byte) {
+	*h.calls = append(*h.calls, h.name+":subscribe:"+filter)
+}
+
+func (h *recordHook) OnUnsubscribe(filter string, cl Client) {
+	*h.calls = append(*h.calls, h.name+":unsubscribe:"+filter)
+}
+
+func (h *recordHook) OnDisconnectReason(cl Client, code byte, reason string) string {
+	return reason + "-" + h.name
+}
+
+func (h *recordHook) OnListenerStarted(id string) {
+	*h.calls = append(*h.calls, h.name+":started:"+id)
+}
+
+func (h *recordHook) OnListenerStopped(id string) {
+	*h.calls = append(*h.calls, h.name+":stopped:"+id)
+}
+
+func (h *recordHook) OnListenerBindFailed(id string, err error) {
+	*h.calls = append(*h.calls, h.name+":bind failed:"+id+":"+err.Error())
+}
+
+func (h *recordHook) OnStorageError(cl Client, op string, err error) {
+	*h.calls = append(*h.calls, h.name+":storage:"+op+":"+err.Error())
+}
+
+func TestHookBase(t *testing.T) {
+	var h Hook = HookBase{}
+	h.OnConnect(Client{}, Packet{})
+	h.OnDisconnect(Client{}, nil)
+	h.OnSubscribe("a/b/c", Client{}, 1)
+	h.OnUnsubscribe("a/b/c", Client{})
+
+	pk, err := h.OnPublish(Client{}, Packet{TopicName: "a/b/c"})
+	require.NoError(t, err)
+	require.Equal(t, Packet{TopicName: "a/b/c"}, pk)
+	require.Equal(t, "test", h.OnDisconnectReason(Client{}, 0x97, "test"))
+	h.OnListenerStarted("t1")
+	h.OnListenerStopped("t1")
+	h.OnListenerBindFailed("t1", errors.New("test"))
+	h.OnStorageError(Client{}, "WriteInflight", errors.New("test"))
+}
+
+func TestHooksAdd(t *testing.T) {
+	h := new(Hooks)
+	require.Equal(t, 0, h.Len())
+	h.Add(HookBase{})
+	h.Add(HookBase{})
+	require.Equal(t, 2, h.Len())
+}
+
+func TestHooksOrder(t *testing.T) {
+	var calls []string
+	h := new(Hooks)
+	h.Add(&recordHook{name: "a", calls: &calls})
+	h.Add(&recordHook{name: "b", calls: &calls})
+
+	cl := Client{ID: "mochi"}
+	h.OnConnect(cl, Packet{})
+	h.OnSubscribe("a/b/c", cl, 1)
+	h.OnUnsubscribe("a/b/c", cl)
+	h.OnDisconnect(cl, nil)
+	h.OnListenerStarted("t1")
+	h.OnListenerBindFailed("t2", errors.New("in use"))
+	h.OnListenerStopped("t1")
+	h.OnStorageError(cl, "WriteInflight", errors.New("disk full"))
+
+	require.Equal(t, []string{
+		"a:connect:mochi", "b:connect:mochi",
+		"a:subscribe:a/b/c", "b:subscribe:a/b/c",
+		"a:unsubscribe:a/b/c", "b:unsubscribe:a/b/c",
+		"a:disconnect:mochi", "b:disconnect:mochi",
+		"a:started:t1", "b:started:t1",
+		"a:bind failed:t2:in use", "b:bind failed:t2:in use",
+		"a:stopped:t1", "b:stopped:t1",
+		"a:storage:WriteInflight:disk full", "b:storage:WriteInflight:disk full",
+	}, calls)
+}
+
+func TestHooksOnPublish(t *testing.T) {
+	var calls []string
+	h := new(Hooks)
+	h.Add(&recordHook{name: "a", calls: &calls, suffix: "-a"})
+	h.Add(&recordHook{name: "b", calls: &calls, suffix: "-b"})
+
+	pk, err := h.OnPublish(Client{}, Packet{Payload: []byte("hello")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello-a-b"), pk.Payload)
+	require.Equal(t, []string{"a:publish:hello", "b:publish:hello-a"}, calls)
+}
+
+func TestHooksOnPublishError(t *testing.T) {
+	var calls []string
+	var errs []error
+	h := new(Hooks)
+	h.Add(&recordHook{name: "a", calls: &calls, err: errors.New("test")})
+	h.Add(&recordHook{name: "b", calls: &calls, suffix: "-b"})
+
+	pk, err := h.OnPublish(Client{}, Packet{Payload: []byte("hello")}, func(cl Client, err error) {
+		errs = append(errs, err)
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello-b"), pk.Payload)
+	require.Len(t, errs, 1)
+}
+
+func TestHooksOnPublishReject(t *testing.T) {
+	var calls []string
+	h := new(Hooks)
+	h.Add(&recordHook{name: "a", calls: &calls, err: ErrRejectPacket})
+	h.Add(&recordHook{name: "b", calls: &calls})
+
+	_, err := h.OnPublish(Client{}, Packet{Payload: []byte("hello")}, nil)
+	require.ErrorIs(t, err, ErrRejectPacket)
+	require.Equal(t, []string{"a:publish:hello"}, calls)
+}
+
+func TestHooksOnDisconnectReason(t *testing.T) {
+	var calls []string
+	h := new(Hooks)
+	require.Equal(t, "quota", h.OnDisconnectReason(Client{}, 0x97, "quota"))
+
+	h.Add(&recordHook{name: "a", calls: &calls})
+	h.Add(&recordHook{name: "b", calls: &calls})
+	require.Equal(t, "quota-a-b", h.OnDisconnectReason(Client{}, 0x97, "quota"))
+}
@@ -0,0 +1,122 @@
+// Package aclcache provides a least recently used cache of ACL results.
+package aclcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Key identifies an ACL check.
+type Key struct {
+	Listener string // the id of the listener whose auth controller made the check.
+	User     string // the username of the client.
+	Topic    string // the topic or filter being checked.
+	Write    bool   // true if the check is for publishing rather than subscribing.
+}
+
+// entry is a cached ACL result.
+type entry struct {
+	key     Key       // the check the result is for.
+	allowed bool      // the result of the check.
+	expires time.Time // when the result should no longer be used.
+}
+
+// Cache is a least recently used cache of ACL results which expire after a
+// fixed time to live.
+type Cache struct {
+	sync.Mutex
+	size    int                   // the maximum number of results held.
+	ttl     time.Duration         // how long each result is used for.
+	order   *list.List            // the results, most recently used first.
+	entries map[Key]*list.Element // the results keyed on their check.
+}
+
+// New returns a cache holding at most size results, each for ttl. The size is
+// always at least 1.
+func New(size int, ttl time.Duration) *Cache {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[Key]*list.Element{},
+	}
+}
+
+// Get returns the cached result of a check, and false if there is no result
+// or it has expired.
+func (c *Cache) Get(key Key, now time.Time) (allowed, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+
+	e := el.Value.(*entry)
+	if !now.Before(e.expires) {
+		c.remove(el)
+		return false, false
+	}
+
+	c.order.MoveToFront(el)
+	return e.allowed, true
+}
+
+// Set caches the result of a check, evicting the least recently used result
+// if the cache is full.
+func (c *Cache) Set(key Key, allowed bool, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry)
+		e.allowed = allowed
+		e.expires = now.Add(c.ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{
+		key:     key,
+		allowed: allowed,
+		expires: now.Add(c.ttl),
+	})
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Invalidate removes the cached results of a user on every listener.
+func (c *Cache) Invalidate(user string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*entry).key.User == user {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// Len returns the number of results in the cache, including any which have
+// expired but not yet been removed.
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+// remove removes a result from the cache. The cache must be locked.
+func (c *Cache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*entry).key)
+	c.order.Remove(el)
+}
@@ -0,0 +1,96 @@
+package aclcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	c := New(10, time.Minute)
+	require.Equal(t, 10, c.size)
+	require.Equal(t, time.Minute, c.ttl)
+	require.Equal(t, 0, c.Len())
+
+	c = New(0, time.Minute)
+	require.Equal(t, 1, c.size)
+}
+
+func TestCacheGetSet(t *testing.T) {
+	now := time.Now()
+	c := New(10, time.Minute)
+	k := Key{Listener: "t1", User: "mochi", Topic: "a/b", Write: true}
+
+	_, ok := c.Get(k, now)
+	require.False(t, ok)
+
+	c.Set(k, true, now)
+	allowed, ok := c.Get(k, now)
+	require.True(t, ok)
+	require.True(t, allowed)
+
+	_, ok = c.Get(Key{Listener: "t1", User: "mochi", Topic: "a/b"}, now)
+	require.False(t, ok)
+	_, ok = c.Get(Key{Listener: "t2", User: "mochi", Topic: "a/b", Write: true}, now)
+	require.False(t, ok)
+
+	c.Set(k, false, now)
+	allowed, ok = c.Get(k, now)
+	require.True(t, ok)
+	require.False(t, allowed)
+	require.Equal(t, 1, c.Len())
+}
+
+func TestCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := New(10, time.Minute)
+	k := Key{User: "mochi", Topic: "a/b"}
+
+	c.Set(k, true, now)
+	_, ok := c.Get(k, now.Add(time.Minute-time.Second))
+	require.True(t, ok)
+
+	_, ok = c.Get(k, now.Add(time.Minute))
+	require.False(t, ok)
+	require.Equal(t, 0, c.Len())
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	c := New(2, time.Minute)
+	a := Key{User: "mochi", Topic: "a"}
+	b := Key{User: "mochi", Topic: "b"}
+	d := Key{User: "mochi", Topic: "d"}
+
+	c.Set(a, true, now)
+	c.Set(b, true, now)
+	_, ok := c.Get(a, now) // a is now more recently used than b.
+	require.True(t, ok)
+
+	c.Set(d, true, now)
+	require.Equal(t, 2, c.Len())
+
+	_, ok = c.Get(b, now)
+	require.False(t, ok)
+	_, ok = c.Get(a, now)
+	require.True(t, ok)
+	_, ok = c.Get(d, now)
+	require.True(t, ok)
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	now := time.Now()
+	c := New(10, time.Minute)
+	c.Set(Key{Listener: "t1", User: "mochi", Topic: "a"}, true, now)
+	c.Set(Key{Listener: "t2", User: "mochi", Topic: "b", Write: true}, true, now)
+	c.Set(Key{Listener: "t1", User: "other", Topic: "a"}, true, now)
+
+	c.Invalidate("mochi")
+	require.Equal(t, 1, c.Len())
+
+	_, ok := c.Get(Key{Listener: "t1", User: "mochi", Topic: "a"}, now)
+	require.False(t, ok)
+	_, ok = c.Get(Key{Listener: "t1", User: "other", Topic: "a"}, now)
+	require.True(t, ok)
+}
@@ -2,7 +2,6 @@ package circ
 
 import (
 	"io"
-	"log"
 	"sync/atomic"
 )
 
@@ -62,7 +61,6 @@ func (b *Writer) WriteTo(w io.Writer) (total int64, err error) {
 		n, err = w.Write(p)
 		total += int64(n)
 		if err != nil {
-			log.Println("error writing to buffer io.Writer;", err)
 			return
 		}
 
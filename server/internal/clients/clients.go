@@ -2,10 +2,14 @@ package clients
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,6 +24,16 @@ import (
 	"github.com/csymapp/mqtt/server/system"
 )
 
+const (
+	// SessionExpiryNever is the session expiry interval of a session which is
+	// kept indefinitely after the client disconnects.
+	SessionExpiryNever uint32 = 0xFFFFFFFF
+
+	// maxPooledBuffer is the capacity above which an encoding buffer is not
+	// returned to the pool, so that one large packet does not pin its memory.
+	maxPooledBuffer = 64 * 1024
+)
+
 var (
 	// defaultKeepalive is the default connection keepalive value in seconds.
 	defaultKeepalive uint16 = 10
@@ -27,6 +41,23 @@ var (
 	// ErrConnectionClosed is returned when operating on a closed
 	// connection and/or when no error cause has been given.
 	ErrConnectionClosed = errors.New("connection not open")
+
+	// ErrReadTimeout indicates that a client did not send a complete packet
+	// within its read timeout.
+	ErrReadTimeout = errors.New("read timeout")
+
+	// ErrWriteTimeout indicates that a write to a client did not complete
+	// within its write timeout.
+	ErrWriteTimeout = errors.New("write timeout")
+
+	// bufferPool holds the buffers packets are encoded into before they are
+	// copied to a client's write buffer, so that a message fanned out to many
+	// subscribers does not allocate a new buffer for each of them.
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
 )
 
 // Clients contains a map of the clients known by the broker.
@@ -83,6 +114,19 @@ func (cl *Clients) Delete(id string) {
 	cl.Unlock()
 }
 
+// Remove removes a client from the internal map, unless it has been replaced
+// by another client with the same id. Returns true if the client was removed.
+func (cl *Clients) Remove(val *Client) bool {
+	cl.Lock()
+	defer cl.Unlock()
+	if cl.internal[val.ID] != val {
+		return false
+	}
+
+	delete(cl.internal, val.ID)
+	return true
+}
+
 // GetByListener returns clients matching a listener id.
 func (cl *Clients) GetByListener(id string) []*Client {
 	clients := make([]*Client, 0, cl.Len())
@@ -98,22 +142,112 @@ func (cl *Clients) GetByListener(id string) []*Client {
 
 // Client contains information about a client known by the broker.
 type Client struct {
-	State         State                // the operational state of the client.
-	LWT           LWT                  // the last will and testament for the client.
-	Inflight      *Inflight            // a map of in-flight qos messages.
-	sync.RWMutex                       // mutex
-	Username      []byte               // the username the client authenticated with.
-	AC            auth.Controller      // an auth controller inherited from the listener.
-	Listener      string               // the id of the listener the client is connected to.
-	ID            string               // the client id.
-	conn          net.Conn             // the net.Conn used to establish the connection.
-	R             *circ.Reader         // a reader for reading incoming bytes.
-	W             *circ.Writer         // a writer for writing outgoing bytes.
-	Subscriptions topics.Subscriptions // a map of the subscription filters a client maintains.
-	systemInfo    *system.Info         // pointers to server system info.
-	packetID      uint32               // the current highest packetID.
-	keepalive     uint16               // the number of seconds the connection can wait.
-	CleanSession  bool                 // indicates if the client expects a clean-session.
+	State           State                         // the operational state of the client.
+	LWT             LWT                           // the last will and testament for the client.
+	Inflight        *Inflight                     // a map of in-flight qos messages.
+	sync.RWMutex                                  // mutex
+	Username        []byte                        // the username the client authenticated with.
+	AC              auth.Controller               // an auth controller inherited from the listener.
+	Identity        interface{}                   // the value returned by the auth controller when the client authenticated.
+	Listener        string                        // the id of the listener the client is connected to.
+	ID              string                        // the client id.
+	conn            net.Conn                      // the net.Conn used to establish the connection.
+	R               *circ.Reader                  // a reader for reading incoming bytes.
+	W               *circ.Writer                  // a writer for writing outgoing bytes.
+	Subscriptions   topics.Subscriptions          // a map of the subscription filters a client maintains.
+	SubscriptionIDs map[string]int                // mqtt v5 subscription identifiers, keyed on subscription filter.
+	SubOptions      map[string]packets.SubOptions // mqtt v5 subscription options, keyed on subscription filter.
+	systemInfo      *system.Info                  // pointers to server system info.
+	keepalive       uint16                        // the number of seconds the connection can wait.
+	lastActivity    int64                         // the unix time in nanoseconds a packet was last read from the client (access atomically).
+	readTimeout     int64                         // the nanoseconds the client may go without sending a complete packet, 0 is none (access atomically).
+	writeTimeout    int64                         // the nanoseconds each write to the client may take, 0 is none (access atomically).
+	CleanSession    bool                          // indicates if the client expects a clean-session.
+	ProtocolVersion byte                          // the mqtt protocol version the client connected with.
+	MaxPacketSize   uint32                        // the maximum size of packets accepted from the client, 0 is unlimited.
+	TopicAliases    TopicAliases                  // mqtt v5 topic aliases for the current connection.
+	ReceiveMaximum  uint16                        // the maximum number of unacknowledged qos messages the client accepts (mqtt v5), 0 is unlimited.
+	inboundQos2     map[uint16]struct{}           // ids of qos 2 messages received from the client which are awaiting a pubrel.
+	inboundMu       sync.Mutex                    // guards inboundQos2, so it can be used while the client is locked.
+	ConnectedAt     int64                         // the time the client connected in unix seconds.
+	UserProperties  []packets.UserProperty        // the mqtt v5 user properties from the connect packet.
+	AssignedID      bool                          // indicates the client id was assigned by the server, as the client connected without one.
+	NoProblemInfo   bool                          // indicates the client asked not to be sent reason strings or user properties, except in publishes (mqtt v5).
+	ResponseInfo    bool                          // indicates the client asked for response information in the connack (mqtt v5).
+	Compression     string                        // the publish payload compression algorithm negotiated with the client, if any (mqtt v5).
+
+	SessionExpiryInterval uint32 // the number of seconds the session is kept after the client disconnects.
+	sessionExpires        int64  // the unix time the session expires, 0 while connected or if it never expires.
+}
+
+// TopicAliases contains the mqtt v5 topic aliases in use on a connection.
+// Aliases only last as long as the network connection, so a new set is used
+// whenever a client reconnects.
+type TopicAliases struct {
+	InboundMaximum  uint16            // the highest alias the client may send, set by the server.
+	OutboundMaximum uint16            // the highest alias the client accepts, from the connect packet.
+	inbound         map[uint16]string // topics set by the client, keyed on alias.
+	outbound        map[string]uint16 // aliases assigned by the server, keyed on topic.
+}
+
+// ResolveInbound sets the topic of a publish packet received from the client
+// which uses a topic alias. If the packet has both a topic and an alias, the
+// alias is mapped to the topic for later packets. The alias property is
+// removed once the topic is known, so it is not forwarded to subscribers.
+func (a *TopicAliases) ResolveInbound(pk *packets.Packet) error {
+	alias := pk.Properties.TopicAlias
+	if alias == 0 {
+		return nil
+	}
+
+	if alias > a.InboundMaximum {
+		return packets.ErrTopicAliasInvalid
+	}
+
+	if pk.TopicName == "" {
+		topic, ok := a.inbound[alias]
+		if !ok {
+			return packets.ErrTopicAliasUnknown
+		}
+		pk.TopicName = topic
+	} else {
+		if a.inbound == nil {
+			a.inbound = make(map[uint16]string)
+		}
+		a.inbound[alias] = pk.TopicName
+	}
+
+	pk.Properties.TopicAlias = 0
+	return nil
+}
+
+// applyOutbound replaces the topic of a publish packet being sent to the client
+// with an alias. The first packet for a topic is sent with both the topic and a
+// newly assigned alias, and later packets are sent with the alias alone. Once
+// every alias the client accepts is assigned, other topics are sent in full.
+// The caller must hold the client's writer lock.
+func (a *TopicAliases) applyOutbound(pk *packets.Packet) {
+	pk.Properties.TopicAlias = 0
+	if a.OutboundMaximum == 0 || pk.TopicName == "" {
+		return
+	}
+
+	if alias, ok := a.outbound[pk.TopicName]; ok {
+		pk.Properties.TopicAlias = alias
+		pk.TopicName = ""
+		return
+	}
+
+	if len(a.outbound) >= int(a.OutboundMaximum) {
+		return
+	}
+
+	if a.outbound == nil {
+		a.outbound = make(map[string]uint16)
+	}
+	alias := uint16(len(a.outbound) + 1)
+	a.outbound[pk.TopicName] = alias
+	pk.Properties.TopicAlias = alias
 }
 
 // State tracks the state of the client.
@@ -129,15 +263,18 @@ type State struct {
 // NewClient returns a new instance of Client.
 func NewClient(c net.Conn, r *circ.Reader, w *circ.Writer, s *system.Info) *Client {
 	cl := &Client{
-		conn:       c,
-		R:          r,
-		W:          w,
-		systemInfo: s,
-		keepalive:  defaultKeepalive,
+		conn:        c,
+		R:           r,
+		W:           w,
+		systemInfo:  s,
+		keepalive:   defaultKeepalive,
+		ConnectedAt: time.Now().Unix(),
 		Inflight: &Inflight{
 			internal: make(map[uint16]InflightMessage),
 		},
-		Subscriptions: make(map[string]byte),
+		Subscriptions:   make(map[string]byte),
+		SubscriptionIDs: make(map[string]int),
+		SubOptions:      make(map[string]packets.SubOptions),
 		State: State{
 			started: new(sync.WaitGroup),
 			endedW:  new(sync.WaitGroup),
@@ -145,7 +282,7 @@ func NewClient(c net.Conn, r *circ.Reader, w *circ.Writer, s *system.Info) *Clie
 		},
 	}
 
-	cl.refreshDeadline(cl.keepalive)
+	cl.refreshActivity()
 
 	return cl
 }
@@ -157,7 +294,9 @@ func NewClientStub(s *system.Info) *Client {
 		Inflight: &Inflight{
 			internal: make(map[uint16]InflightMessage),
 		},
-		Subscriptions: make(map[string]byte),
+		Subscriptions:   make(map[string]byte),
+		SubscriptionIDs: make(map[string]int),
+		SubOptions:      make(map[string]packets.SubOptions),
 		State: State{
 			Done: 1,
 		},
@@ -179,7 +318,20 @@ func (cl *Client) Identify(lid string, pk packets.Packet, ac auth.Controller) {
 
 	cl.Username = pk.Username
 	cl.CleanSession = pk.CleanSession
+	cl.ProtocolVersion = pk.ProtocolVersion
 	cl.keepalive = pk.Keepalive
+	cl.TopicAliases.OutboundMaximum = pk.Properties.TopicAliasMaximum
+	cl.ReceiveMaximum = pk.Properties.ReceiveMaximum
+	cl.UserProperties = pk.Properties.User
+	cl.NoProblemInfo = pk.Properties.RequestProblemInfoFlag && pk.Properties.RequestProblemInfo == 0
+	cl.ResponseInfo = pk.Properties.RequestResponseInfo == 1
+
+	// Sessions of MQTT v3 clients last until a clean session is started, so
+	// they are only discarded on disconnect if they are clean sessions.
+	cl.SessionExpiryInterval = pk.Properties.SessionExpiryInterval
+	if pk.ProtocolVersion < 5 && !pk.CleanSession {
+		cl.SessionExpiryInterval = SessionExpiryNever
+	}
 
 	if pk.WillFlag {
 		cl.LWT = LWT{
@@ -187,21 +339,117 @@ func (cl *Client) Identify(lid string, pk packets.Packet, ac auth.Controller) {
 			Message: pk.WillMessage,
 			Qos:     pk.WillQos,
 			Retain:  pk.WillRetain,
+			Delay:   pk.WillProperties.WillDelayInterval,
+
+			PayloadFormat:         pk.WillProperties.PayloadFormat,
+			PayloadFormatFlag:     pk.WillProperties.PayloadFormatFlag,
+			MessageExpiryInterval: pk.WillProperties.MessageExpiryInterval,
+			ContentType:           pk.WillProperties.ContentType,
+			ResponseTopic:         pk.WillProperties.ResponseTopic,
+			CorrelationData:       pk.WillProperties.CorrelationData,
+			User:                  pk.WillProperties.User,
 		}
 	}
 
-	cl.refreshDeadline(cl.keepalive)
+	cl.refreshActivity()
 }
 
-// refreshDeadline refreshes the read/write deadline for the net.Conn connection.
-func (cl *Client) refreshDeadline(keepalive uint16) {
-	if cl.conn != nil {
-		var expiry time.Time // Nil time can be used to disable deadline if keepalive = 0
-		if keepalive > 0 {
-			expiry = time.Now().Add(time.Duration(keepalive+(keepalive/2)) * time.Second)
-		}
-		_ = cl.conn.SetDeadline(expiry)
+// SetSessionExpires sets the unix time the session of a disconnected client
+// expires. 0 indicates the session does not expire.
+func (cl *Client) SetSessionExpires(at int64) {
+	atomic.StoreInt64(&cl.sessionExpires, at)
+}
+
+// SessionExpired returns true if the session of a disconnected client expired
+// before the given unix time.
+func (cl *Client) SessionExpired(now int64) bool {
+	at := atomic.LoadInt64(&cl.sessionExpires)
+	return at > 0 && at < now
+}
+
+// SessionExpires returns the unix time the session of a disconnected client
+// expires, or 0 if it does not expire.
+func (cl *Client) SessionExpires() int64 {
+	return atomic.LoadInt64(&cl.sessionExpires)
+}
+
+// Keepalive returns the keepalive of the client in seconds.
+func (cl *Client) Keepalive() uint16 {
+	return cl.keepalive
+}
+
+// SetKeepalive overrides the keepalive requested by the client, such as when
+// the server assigns a keepalive, and refreshes the activity time.
+func (cl *Client) SetKeepalive(keepalive uint16) {
+	cl.keepalive = keepalive
+	cl.refreshActivity()
+}
+
+// refreshActivity records that the client is active at the current time.
+func (cl *Client) refreshActivity() {
+	atomic.StoreInt64(&cl.lastActivity, time.Now().UnixNano())
+}
+
+// SetTimeouts sets how long the client may go without sending a complete
+// packet, and how long each write to it may take, before it is stopped. A
+// timeout of 0 or less is disabled. The read timeout runs from the call, and
+// restarts each time a packet is read.
+func (cl *Client) SetTimeouts(read, write time.Duration) {
+	if read < 0 {
+		read = 0
 	}
+
+	if write < 0 {
+		write = 0
+	}
+
+	atomic.StoreInt64(&cl.readTimeout, int64(read))
+	atomic.StoreInt64(&cl.writeTimeout, int64(write))
+
+	if read == 0 && cl.conn != nil {
+		_ = cl.conn.SetReadDeadline(time.Time{})
+	}
+	cl.refreshReadDeadline()
+}
+
+// refreshReadDeadline moves the read deadline of the connection to the read
+// timeout from now, if the client has a read timeout.
+func (cl *Client) refreshReadDeadline() {
+	d := atomic.LoadInt64(&cl.readTimeout)
+	if d > 0 && cl.conn != nil {
+		_ = cl.conn.SetReadDeadline(time.Now().Add(time.Duration(d)))
+	}
+}
+
+// timeoutWriter writes to the connection of a client, setting a write deadline
+// before each write if the client has a write timeout.
+type timeoutWriter struct {
+	cl *Client
+}
+
+// Write writes p to the connection of the client.
+func (w timeoutWriter) Write(p []byte) (int, error) {
+	if d := atomic.LoadInt64(&w.cl.writeTimeout); d > 0 {
+		_ = w.cl.conn.SetWriteDeadline(time.Now().Add(time.Duration(d)))
+	}
+
+	return w.cl.conn.Write(p)
+}
+
+// LastActivity returns the time a packet was last read from the client.
+func (cl *Client) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&cl.lastActivity))
+}
+
+// KeepaliveExpired returns true if nothing has been received from the client
+// within one and a half times its keepalive, in which case the connection must
+// be closed [MQTT-3.1.2-24]. A keepalive of 0 never expires.
+func (cl *Client) KeepaliveExpired(now time.Time) bool {
+	if cl.keepalive == 0 {
+		return false
+	}
+
+	return now.Sub(cl.LastActivity()) > time.Duration(cl.keepalive)*1500*time.Millisecond
 }
 
 // Info returns an event-version of a client, containing minimal information.
@@ -216,19 +464,20 @@ func (cl *Client) Info() events.Client {
 		Username:     cl.Username,
 		CleanSession: cl.CleanSession,
 		Listener:     cl.Listener,
+
+		UserProperties: cl.UserProperties,
 	}
 }
 
-// NextPacketID returns the next packet id for a client, looping back to 0
-// if the maximum ID has been reached.
-func (cl *Client) NextPacketID() uint32 {
-	i := atomic.LoadUint32(&cl.packetID)
-	if i == uint32(65535) || i == uint32(0) {
-		atomic.StoreUint32(&cl.packetID, 1)
-		return 1
+// TLSState returns the state of the client's tls connection, and true if the
+// client connected using tls and the handshake has completed.
+func (cl *Client) TLSState() (tls.ConnectionState, bool) {
+	if c, ok := cl.conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		cs := c.ConnectionState()
+		return cs, cs.HandshakeComplete
 	}
 
-	return atomic.AddUint32(&cl.packetID, 1)
+	return tls.ConnectionState{}, false
 }
 
 // NoteSubscription makes a note of a subscription for the client.
@@ -238,13 +487,181 @@ func (cl *Client) NoteSubscription(filter string, qos byte) {
 	cl.Unlock()
 }
 
+// Subscribed returns true if the client has a subscription to the filter.
+func (cl *Client) Subscribed(filter string) bool {
+	cl.RLock()
+	defer cl.RUnlock()
+	_, ok := cl.Subscriptions[filter]
+	return ok
+}
+
+// WriteBuffered returns the number of bytes waiting in the client's write
+// buffer to be written to its connection. Stub clients have no buffer.
+func (cl *Client) WriteBuffered() int {
+	if cl.W == nil {
+		return 0
+	}
+
+	return cl.W.CapDelta()
+}
+
+// CountSubscriptions returns the number of subscription filters the client maintains.
+func (cl *Client) CountSubscriptions() int {
+	cl.RLock()
+	defer cl.RUnlock()
+	return len(cl.Subscriptions)
+}
+
+// NoteSubscriptionID makes a note of the subscription identifier for a
+// subscription filter. An id of 0 removes any existing identifier.
+func (cl *Client) NoteSubscriptionID(filter string, id int) {
+	cl.Lock()
+	if id > 0 {
+		cl.SubscriptionIDs[filter] = id
+	} else {
+		delete(cl.SubscriptionIDs, filter)
+	}
+	cl.Unlock()
+}
+
+// NoteSubscriptionOptions makes a note of the subscription options for a
+// subscription filter. Default options remove any existing note.
+func (cl *Client) NoteSubscriptionOptions(filter string, opts packets.SubOptions) {
+	cl.Lock()
+	if opts != (packets.SubOptions{}) {
+		cl.SubOptions[filter] = opts
+	} else {
+		delete(cl.SubOptions, filter)
+	}
+	cl.Unlock()
+}
+
 // ForgetSubscription forgests a subscription note for the client.
 func (cl *Client) ForgetSubscription(filter string) {
 	cl.Lock()
 	delete(cl.Subscriptions, filter)
+	delete(cl.SubscriptionIDs, filter)
+	delete(cl.SubOptions, filter)
 	cl.Unlock()
 }
 
+// NoteInboundQos2 makes a note of a qos 2 message received from the client,
+// returning the number of qos 2 messages from the client awaiting a pubrel.
+func (cl *Client) NoteInboundQos2(id uint16) int {
+	cl.inboundMu.Lock()
+	defer cl.inboundMu.Unlock()
+	if cl.inboundQos2 == nil {
+		cl.inboundQos2 = make(map[uint16]struct{})
+	}
+	cl.inboundQos2[id] = struct{}{}
+	return len(cl.inboundQos2)
+}
+
+// ForgetInboundQos2 forgets a qos 2 message received from the client once
+// it has been released.
+func (cl *Client) ForgetInboundQos2(id uint16) {
+	cl.inboundMu.Lock()
+	delete(cl.inboundQos2, id)
+	cl.inboundMu.Unlock()
+}
+
+// InboundQos2Pending returns true if a qos 2 message with the packet id was
+// received from the client and has not yet been released.
+func (cl *Client) InboundQos2Pending(id uint16) bool {
+	cl.inboundMu.Lock()
+	defer cl.inboundMu.Unlock()
+	_, ok := cl.inboundQos2[id]
+	return ok
+}
+
+// InboundQos2 returns the ids of the qos 2 messages received from the client
+// which are awaiting a pubrel, in ascending order.
+func (cl *Client) InboundQos2() []uint16 {
+	cl.inboundMu.Lock()
+	defer cl.inboundMu.Unlock()
+	ids := make([]uint16, 0, len(cl.inboundQos2))
+	for id := range cl.inboundQos2 {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// InheritInboundQos2 takes the qos 2 messages awaiting a pubrel from the
+// session of an existing client which is being resumed.
+func (cl *Client) InheritInboundQos2(existing *Client) {
+	existing.inboundMu.Lock()
+	defer existing.inboundMu.Unlock()
+	cl.inboundMu.Lock()
+	defer cl.inboundMu.Unlock()
+	cl.inboundQos2 = existing.inboundQos2
+	existing.inboundQos2 = nil
+}
+
+// MatchingSubscriptionIDs returns the subscription identifiers of the client's
+// subscriptions which match a topic, in ascending order. If shared is set, only
+// the identifier for that shared subscription filter is returned, otherwise
+// shared subscriptions are ignored.
+func (cl *Client) MatchingSubscriptionIDs(topic, shared string) []int {
+	cl.RLock()
+	defer cl.RUnlock()
+
+	if shared != "" {
+		if id, ok := cl.SubscriptionIDs[shared]; ok {
+			return []int{id}
+		}
+		return nil
+	}
+
+	var ids []int
+	for filter, id := range cl.SubscriptionIDs {
+		if !strings.HasPrefix(filter, topics.SharePrefix) && auth.MatchTopic(filter, topic) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// MatchingSubscriptions returns the client's subscription filters which match
+// a topic, ignoring shared subscriptions.
+func (cl *Client) MatchingSubscriptions(topic string) []string {
+	cl.RLock()
+	defer cl.RUnlock()
+
+	var filters []string
+	for filter := range cl.Subscriptions {
+		if !strings.HasPrefix(filter, topics.SharePrefix) && auth.MatchTopic(filter, topic) {
+			filters = append(filters, filter)
+		}
+	}
+
+	return filters
+}
+
+// RetainAsPublished returns true if any of the client's subscriptions which
+// match a topic has the retain as published option set, so that forwarded
+// messages keep their retain flag. If shared is set, only that shared
+// subscription filter is checked, otherwise shared subscriptions are ignored.
+func (cl *Client) RetainAsPublished(topic, shared string) bool {
+	cl.RLock()
+	defer cl.RUnlock()
+
+	if shared != "" {
+		return cl.SubOptions[shared].RetainAsPublished
+	}
+
+	for filter, opts := range cl.SubOptions {
+		if opts.RetainAsPublished && !strings.HasPrefix(filter, topics.SharePrefix) && auth.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Start begins the client goroutines reading and writing packets.
 func (cl *Client) Start() {
 	cl.State.started.Add(2)
@@ -253,8 +670,10 @@ func (cl *Client) Start() {
 
 	go func() {
 		cl.State.started.Done()
-		_, err := cl.W.WriteTo(cl.conn)
-		if err != nil {
+		_, err := cl.W.WriteTo(timeoutWriter{cl})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = fmt.Errorf("writer: %w: %v", ErrWriteTimeout, err)
+		} else if err != nil {
 			err = fmt.Errorf("writer: %w", err)
 		}
 		cl.State.endedW.Done()
@@ -264,7 +683,9 @@ func (cl *Client) Start() {
 	go func() {
 		cl.State.started.Done()
 		_, err := cl.R.ReadFrom(cl.conn)
-		if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = fmt.Errorf("reader: %w: %v", ErrReadTimeout, err)
+		} else if err != nil {
 			err = fmt.Errorf("reader: %w", err)
 		}
 		cl.State.endedR.Done()
@@ -289,6 +710,13 @@ func (cl *Client) Stop(err error) {
 	}
 
 	cl.State.endOnce.Do(func() {
+		// The cause is stored before the buffers are stopped, as Read returns
+		// as soon as the reader stops.
+		if err == nil {
+			err = ErrConnectionClosed
+		}
+		cl.State.stopCause.Store(err)
+
 		cl.R.Stop()
 		cl.W.Stop()
 
@@ -298,11 +726,6 @@ func (cl *Client) Stop(err error) {
 
 		cl.State.endedR.Wait()
 		atomic.StoreUint32(&cl.State.Done, 1)
-
-		if err == nil {
-			err = ErrConnectionClosed
-		}
-		cl.State.stopCause.Store(err)
 	})
 }
 
@@ -356,6 +779,12 @@ func (cl *Client) ReadFixedHeader(fh *packets.FixedHeader) error {
 	rem, _ := binary.Uvarint(buf)
 	fh.Remaining = int(rem)
 
+	// Reject the packet before reading the payload if it is too large, where
+	// the size includes the header byte and the remaining length bytes.
+	if cl.MaxPacketSize > 0 && uint64(1+len(buf))+rem > uint64(cl.MaxPacketSize) {
+		return packets.ErrPacketTooLarge
+	}
+
 	// Having successfully read n bytes, commit the tail forward.
 	cl.R.CommitTail(n)
 	atomic.AddInt64(&cl.systemInfo.BytesRecv, int64(n))
@@ -371,7 +800,8 @@ func (cl *Client) Read(packetHandler func(*Client, packets.Packet) error) error
 			return nil
 		}
 
-		cl.refreshDeadline(cl.keepalive)
+		cl.refreshActivity()
+		cl.refreshReadDeadline()
 		fh := new(packets.FixedHeader)
 		err := cl.ReadFixedHeader(fh)
 		if err != nil {
@@ -395,6 +825,7 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 	atomic.AddInt64(&cl.systemInfo.MessagesRecv, 1)
 
 	pk.FixedHeader = *fh
+	pk.ProtocolVersion = cl.ProtocolVersion
 	if pk.FixedHeader.Remaining == 0 {
 		return
 	}
@@ -406,8 +837,13 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 	atomic.AddInt64(&cl.systemInfo.BytesRecv, int64(len(p)))
 
 	// Decode the remaining packet values using a fresh copy of the bytes,
-	// otherwise the next packet will change the data of this one.
-	px := append([]byte{}, p[:]...)
+	// otherwise the next packet will change the data of this one. The copy is
+	// shared by every subscriber a message is sent to. Acks without properties
+	// only hold a packet id and reason code, so they are decoded in place.
+	px := p
+	if !isBareAck(pk.FixedHeader) {
+		px = append([]byte{}, p[:]...)
+	}
 
 	switch pk.FixedHeader.Type {
 	case packets.Connect:
@@ -418,6 +854,7 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 		err = pk.PublishDecode(px)
 		if err == nil {
 			atomic.AddInt64(&cl.systemInfo.PublishRecv, 1)
+			atomic.AddInt64(&cl.systemInfo.PublishRecvQos[pk.FixedHeader.Qos%3], 1)
 		}
 	case packets.Puback:
 		err = pk.PubackDecode(px)
@@ -438,6 +875,9 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 	case packets.Pingreq:
 	case packets.Pingresp:
 	case packets.Disconnect:
+		err = pk.DisconnectDecode(px)
+	case packets.Auth:
+		err = pk.AuthDecode(px)
 	default:
 		err = fmt.Errorf("no valid packet available; %v", pk.FixedHeader.Type)
 	}
@@ -447,6 +887,16 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 	return
 }
 
+// isBareAck returns true if a packet is a publish acknowledgement without
+// properties, so its decoded values hold no references to its bytes.
+func isBareAck(fh packets.FixedHeader) bool {
+	switch fh.Type {
+	case packets.Puback, packets.Pubrec, packets.Pubrel, packets.Pubcomp:
+		return fh.Remaining <= 3
+	}
+	return false
+}
+
 // WritePacket encodes and writes a packet to the client.
 func (cl *Client) WritePacket(pk packets.Packet) (n int, err error) {
 	if atomic.LoadUint32(&cl.State.Done) == 1 {
@@ -456,16 +906,32 @@ func (cl *Client) WritePacket(pk packets.Packet) (n int, err error) {
 	cl.W.Mu.Lock()
 	defer cl.W.Mu.Unlock()
 
-	buf := new(bytes.Buffer)
+	// Packets are encoded for the protocol version the client connected with.
+	if pk.FixedHeader.Type != packets.Connect {
+		pk.ProtocolVersion = cl.ProtocolVersion
+	}
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			bufferPool.Put(buf)
+		}
+	}()
+
 	switch pk.FixedHeader.Type {
 	case packets.Connect:
 		err = pk.ConnectEncode(buf)
 	case packets.Connack:
 		err = pk.ConnackEncode(buf)
 	case packets.Publish:
+		if pk.ProtocolVersion == 5 {
+			cl.TopicAliases.applyOutbound(&pk)
+		}
 		err = pk.PublishEncode(buf)
 		if err == nil {
 			atomic.AddInt64(&cl.systemInfo.PublishSent, 1)
+			atomic.AddInt64(&cl.systemInfo.PublishSentQos[pk.FixedHeader.Qos%3], 1)
 		}
 	case packets.Puback:
 		err = pk.PubackEncode(buf)
@@ -489,6 +955,8 @@ func (cl *Client) WritePacket(pk packets.Packet) (n int, err error) {
 		err = pk.PingrespEncode(buf)
 	case packets.Disconnect:
 		err = pk.DisconnectEncode(buf)
+	case packets.Auth:
+		err = pk.AuthEncode(buf)
 	default:
 		err = fmt.Errorf("no valid packet available; %v", pk.FixedHeader.Type)
 	}
@@ -505,8 +973,6 @@ func (cl *Client) WritePacket(pk packets.Packet) (n int, err error) {
 	atomic.AddInt64(&cl.systemInfo.BytesSent, int64(n))
 	atomic.AddInt64(&cl.systemInfo.MessagesSent, 1)
 
-	cl.refreshDeadline(cl.keepalive)
-
 	return
 }
 
@@ -516,20 +982,40 @@ type LWT struct {
 	Topic   string // the topic the will message shall be sent to.
 	Qos     byte   // the quality of service desired.
 	Retain  bool   // indicates whether the will message should be retained
+	Delay   uint32 // the number of seconds to wait before sending the will message (mqtt v5).
+	Due     int64  // the unix time a delayed will message is due to be sent, once the client has disconnected.
+
+	PayloadFormat         byte                   // the payload format indicator of the will message (mqtt v5).
+	PayloadFormatFlag     bool                   // indicates the payload format indicator was set (mqtt v5).
+	MessageExpiryInterval uint32                 // the lifetime of the will message in seconds, 0 to never expire (mqtt v5).
+	ContentType           string                 // the content type of the will message (mqtt v5).
+	ResponseTopic         string                 // the topic name for a response to the will message (mqtt v5).
+	CorrelationData       []byte                 // the correlation data of the will message (mqtt v5).
+	User                  []packets.UserProperty // the user properties of the will message (mqtt v5).
 }
 
 // InflightMessage contains data about a packet which is currently in-flight.
 type InflightMessage struct {
-	Packet  packets.Packet // the packet currently in-flight.
-	Sent    int64          // the last time the message was sent (for retries) in unixtime.
-	Created int64          // the unix timestamp when the inflight message was created.
-	Resends int            // the number of times the message was attempted to be sent.
+	Packet   packets.Packet // the packet currently in-flight.
+	Sent     int64          // the last time the message was sent (for retries) in unixtime.
+	Created  int64          // the unix timestamp when the inflight message was created.
+	Resends  int            // the number of times the message was attempted to be sent.
+	Shared   string         // the shared subscription filter the message was delivered through, if any.
+	Sequence int64          // the order the message was first stored in, used to resend messages in their original order.
 }
 
-// Inflight is a map of InflightMessage keyed on packet id.
+// maxPacketID is the highest packet id, and so the most messages which can be
+// inflight to a client at once.
+const maxPacketID = 65535
+
+// Inflight is a map of InflightMessage keyed on packet id. The packet ids of
+// new inflight messages are allocated from those not held by any other
+// inflight message, including messages restored from a persistent store.
 type Inflight struct {
 	sync.RWMutex
 	internal map[uint16]InflightMessage // internal contains the inflight messages.
+	queued   []InflightMessage          // messages waiting for an inflight quota or a free packet id, in order.
+	lastID   uint16                     // the packet id last allocated to an inflight message.
 }
 
 // Set stores the packet of an Inflight message, keyed on message id. Returns
@@ -542,6 +1028,108 @@ func (i *Inflight) Set(key uint16, in InflightMessage) bool {
 	return !ok
 }
 
+// nextID returns the next packet id which is not held by an inflight message,
+// and false if every packet id is in use. The inflight map must be locked.
+func (i *Inflight) nextID() (uint16, bool) {
+	if len(i.internal) >= maxPacketID {
+		return 0, false
+	}
+
+	for {
+		i.lastID++
+		if i.lastID == 0 {
+			i.lastID = 1
+		}
+
+		if _, ok := i.internal[i.lastID]; !ok {
+			return i.lastID, true
+		}
+	}
+}
+
+// SetOrQueue stores a new in-flight message, unless max messages are already
+// in-flight, every packet id is in use, or earlier messages are still queued,
+// in which case the message is queued until Dequeue is called. A max of 0 or
+// less is unlimited. If the message has no packet id, a free one is allocated
+// once it is stored. Returns the message and true if it was stored and should
+// be sent.
+func (i *Inflight) SetOrQueue(in InflightMessage, max int) (InflightMessage, bool) {
+	i.Lock()
+	defer i.Unlock()
+	if len(i.queued) > 0 || (max > 0 && len(i.internal) >= max) {
+		i.queued = append(i.queued, in)
+		return in, false
+	}
+
+	if in.Packet.PacketID == 0 {
+		id, ok := i.nextID()
+		if !ok {
+			i.queued = append(i.queued, in)
+			return in, false
+		}
+		in.Packet.PacketID = id
+	}
+	i.internal[in.Packet.PacketID] = in
+	return in, true
+}
+
+// Dequeue stores the oldest queued message as an in-flight message, if fewer
+// than max messages are in-flight and a packet id is free. If the message has
+// no packet id, a free one is allocated, and the sent time of the message is
+// updated. Returns the message and true if one was stored and should be sent.
+func (i *Inflight) Dequeue(max int) (InflightMessage, bool) {
+	i.Lock()
+	defer i.Unlock()
+	if len(i.queued) == 0 || (max > 0 && len(i.internal) >= max) {
+		return InflightMessage{}, false
+	}
+
+	in := i.queued[0]
+	if in.Packet.PacketID == 0 {
+		id, ok := i.nextID()
+		if !ok {
+			return InflightMessage{}, false
+		}
+		in.Packet.PacketID = id
+	}
+
+	i.queued[0] = InflightMessage{}
+	i.queued = i.queued[1:]
+	in.Sent = time.Now().Unix()
+	i.internal[in.Packet.PacketID] = in
+	return in, true
+}
+
+// QueueLen returns the number of queued messages.
+func (i *Inflight) QueueLen() int {
+	i.RLock()
+	v := len(i.queued)
+	i.RUnlock()
+	return v
+}
+
+// TakeQueued removes and returns the queued messages for which fn returns true.
+func (i *Inflight) TakeQueued(fn func(InflightMessage) bool) []InflightMessage {
+	i.Lock()
+	defer i.Unlock()
+	var taken []InflightMessage
+	kept := i.queued[:0]
+	for _, in := range i.queued {
+		if fn(in) {
+			taken = append(taken, in)
+		} else {
+			kept = append(kept, in)
+		}
+	}
+
+	for j := len(kept); j < len(i.queued); j++ {
+		i.queued[j] = InflightMessage{}
+	}
+	i.queued = kept
+
+	return taken
+}
+
 // Get returns the value of an in-flight message if it exists.
 func (i *Inflight) Get(key uint16) (InflightMessage, bool) {
 	i.RLock()
@@ -570,6 +1158,26 @@ func (i *Inflight) GetAll() map[uint16]InflightMessage {
 	return m
 }
 
+// GetOrdered returns all the in-flight messages, in the order they were
+// first stored in.
+func (i *Inflight) GetOrdered() []InflightMessage {
+	i.RLock()
+	v := make([]InflightMessage, 0, len(i.internal))
+	for _, in := range i.internal {
+		v = append(v, in)
+	}
+	i.RUnlock()
+
+	sort.Slice(v, func(a, b int) bool {
+		if v[a].Sequence != v[b].Sequence {
+			return v[a].Sequence < v[b].Sequence
+		}
+		return v[a].Packet.PacketID < v[b].Packet.PacketID
+	})
+
+	return v
+}
+
 // Delete removes an in-flight message from the map. Returns true if the
 // message existed.
 func (i *Inflight) Delete(key uint16) bool {
@@ -584,11 +1192,23 @@ func (i *Inflight) Delete(key uint16) bool {
 // ClearExpired deletes any inflight messages that have remained longer than
 // the servers InflightTTL duration. Returns number of deleted inflights.
 func (i *Inflight) ClearExpired(expiry int64) int64 {
+	return i.ClearExpiredQos([3]int64{expiry, expiry, expiry})
+}
+
+// ClearExpiredQos deletes any inflight messages created before the expiry of
+// the qos of their delivery, indexed on qos. Pubrels belong to qos 2 deliveries,
+// though they carry qos 1 in their fixed header. Returns number of deleted inflights.
+func (i *Inflight) ClearExpiredQos(expiry [3]int64) int64 {
 	i.Lock()
 	defer i.Unlock()
 	var deleted int64
 	for k, m := range i.internal {
-		if m.Created < expiry || m.Created == 0 {
+		qos := m.Packet.FixedHeader.Qos
+		if m.Packet.FixedHeader.Type == packets.Pubrel {
+			qos = 2
+		}
+
+		if qos > 2 || m.Created < expiry[qos] || m.Created == 0 {
 			delete(i.internal, k)
 			deleted++
 		}
@@ -1,6 +1,7 @@
 package clients
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -127,6 +128,19 @@ func TestClientsDelete(t *testing.T) {
 	require.Nil(t, cl.internal["t1"])
 }
 
+func TestClientsRemove(t *testing.T) {
+	cl := New()
+	c1 := &Client{ID: "t1"}
+	cl.Add(c1)
+	require.True(t, cl.Remove(c1))
+	require.NotContains(t, cl.internal, "t1")
+
+	c2 := &Client{ID: "t1"}
+	cl.Add(c2)
+	require.False(t, cl.Remove(c1))
+	require.Equal(t, c2, cl.internal["t1"])
+}
+
 func BenchmarkClientsDelete(b *testing.B) {
 	cl := New()
 	cl.Add(&Client{ID: "t1"})
@@ -198,6 +212,31 @@ func TestClientInfoKnown(t *testing.T) {
 	}, cl.Info())
 }
 
+// tlsPipe is a net.Conn with a fixed tls connection state.
+type tlsPipe struct {
+	net.Conn
+	cs tls.ConnectionState
+}
+
+func (c *tlsPipe) ConnectionState() tls.ConnectionState {
+	return c.cs
+}
+
+func TestClientTLSState(t *testing.T) {
+	cl := genClient()
+	_, ok := cl.TLSState()
+	require.False(t, ok)
+
+	cl.conn = &tlsPipe{cl.conn, tls.ConnectionState{}}
+	_, ok = cl.TLSState()
+	require.False(t, ok)
+
+	cl.conn = &tlsPipe{cl.conn, tls.ConnectionState{HandshakeComplete: true, ServerName: "mochi.io"}}
+	cs, ok := cl.TLSState()
+	require.True(t, ok)
+	require.Equal(t, "mochi.io", cs.ServerName)
+}
+
 func BenchmarkNewClient(b *testing.B) {
 	c, _ := net.Pipe()
 	for n := 0; n < b.N; n++ {
@@ -238,6 +277,37 @@ func TestClientIdentify(t *testing.T) {
 	require.Equal(t, pk.Keepalive, cl.keepalive)
 	require.Equal(t, pk.CleanSession, cl.CleanSession)
 	require.Equal(t, pk.ClientIdentifier, cl.ID)
+	require.Equal(t, pk.ProtocolVersion, cl.ProtocolVersion)
+	require.Equal(t, uint32(0), cl.SessionExpiryInterval)
+}
+
+func TestClientIdentifySessionExpiry(t *testing.T) {
+	cl := genClient()
+	cl.Identify("tcp1", packets.Packet{ProtocolVersion: 4}, new(auth.Allow))
+	require.Equal(t, SessionExpiryNever, cl.SessionExpiryInterval)
+
+	cl.Identify("tcp1", packets.Packet{ProtocolVersion: 5}, new(auth.Allow))
+	require.Equal(t, uint32(0), cl.SessionExpiryInterval)
+
+	cl.Identify("tcp1", packets.Packet{
+		ProtocolVersion: 5,
+		CleanSession:    true,
+		Properties: packets.Properties{
+			SessionExpiryInterval: 30,
+		},
+	}, new(auth.Allow))
+	require.Equal(t, uint32(30), cl.SessionExpiryInterval)
+}
+
+func TestClientSessionExpires(t *testing.T) {
+	cl := genClient()
+	require.Equal(t, int64(0), cl.SessionExpires())
+	require.False(t, cl.SessionExpired(1000))
+
+	cl.SetSessionExpires(100)
+	require.Equal(t, int64(100), cl.SessionExpires())
+	require.False(t, cl.SessionExpired(100))
+	require.True(t, cl.SessionExpired(101))
 }
 
 func BenchmarkClientIdentify(b *testing.B) {
@@ -303,25 +373,279 @@ func TestClientIdentifyLWT(t *testing.T) {
 	require.Equal(t, pk.WillMessage, cl.LWT.Message)
 	require.Equal(t, pk.WillQos, cl.LWT.Qos)
 	require.Equal(t, pk.WillRetain, cl.LWT.Retain)
+	require.Equal(t, uint32(0), cl.LWT.Delay)
 }
 
-func TestClientNextPacketID(t *testing.T) {
+func TestClientIdentifyLWTDelay(t *testing.T) {
 	cl := genClient()
 
-	require.Equal(t, uint32(1), cl.NextPacketID())
-	require.Equal(t, uint32(2), cl.NextPacketID())
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+		ProtocolName:     []byte{'M', 'Q', 'T', 'T'},
+		ProtocolVersion:  5,
+		ClientIdentifier: "mochi",
+		WillFlag:         true,
+		WillTopic:        "lwt",
+		WillMessage:      []byte("lol gg"),
+		WillProperties: packets.Properties{
+			WillDelayInterval: 30,
+		},
+	}
 
-	cl.packetID = uint32(65534)
-	require.Equal(t, uint32(65535), cl.NextPacketID())
-	require.Equal(t, uint32(1), cl.NextPacketID())
+	cl.Identify("tcp1", pk, new(auth.Allow))
+	require.Equal(t, pk.WillTopic, cl.LWT.Topic)
+	require.Equal(t, uint32(30), cl.LWT.Delay)
 }
 
-func BenchmarkClientNextPacketID(b *testing.B) {
+func TestClientIdentifyLWTProperties(t *testing.T) {
 	cl := genClient()
 
-	for n := 0; n < b.N; n++ {
-		cl.NextPacketID()
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+		ProtocolName:     []byte{'M', 'Q', 'T', 'T'},
+		ProtocolVersion:  5,
+		ClientIdentifier: "mochi",
+		WillFlag:         true,
+		WillTopic:        "lwt",
+		WillMessage:      []byte{0x00, 0xff},
+		WillProperties: packets.Properties{
+			PayloadFormat:         1,
+			PayloadFormatFlag:     true,
+			MessageExpiryInterval: 60,
+			ContentType:           "text/plain",
+			ResponseTopic:         "reply",
+			CorrelationData:       []byte("corr"),
+			User:                  []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	}
+
+	cl.Identify("tcp1", pk, new(auth.Allow))
+	require.Equal(t, pk.WillMessage, cl.LWT.Message)
+	require.Equal(t, byte(1), cl.LWT.PayloadFormat)
+	require.True(t, cl.LWT.PayloadFormatFlag)
+	require.Equal(t, uint32(60), cl.LWT.MessageExpiryInterval)
+	require.Equal(t, "text/plain", cl.LWT.ContentType)
+	require.Equal(t, "reply", cl.LWT.ResponseTopic)
+	require.Equal(t, []byte("corr"), cl.LWT.CorrelationData)
+	require.Equal(t, []packets.UserProperty{{Key: "k", Val: "v"}}, cl.LWT.User)
+}
+
+func TestClientIdentifyUserProperties(t *testing.T) {
+	cl := genClient()
+
+	user := []packets.UserProperty{
+		{Key: "region", Val: "eu"},
+		{Key: "region", Val: "us"},
+	}
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+		ProtocolName:     []byte{'M', 'Q', 'T', 'T'},
+		ProtocolVersion:  5,
+		ClientIdentifier: "mochi",
+		Properties: packets.Properties{
+			User: user,
+		},
+	}
+
+	cl.Identify("tcp1", pk, new(auth.Allow))
+	require.Equal(t, user, cl.UserProperties)
+	require.Equal(t, user, cl.Info().UserProperties)
+}
+
+func TestClientIdentifyProblemInfo(t *testing.T) {
+	tt := []struct {
+		desc          string
+		props         packets.Properties
+		noProblemInfo bool
+		responseInfo  bool
+	}{
+		{desc: "defaults"},
+		{
+			desc:          "no problem info",
+			props:         packets.Properties{RequestProblemInfo: 0, RequestProblemInfoFlag: true},
+			noProblemInfo: true,
+		},
+		{
+			desc:  "problem info",
+			props: packets.Properties{RequestProblemInfo: 1, RequestProblemInfoFlag: true},
+		},
+		{
+			desc:         "response info",
+			props:        packets.Properties{RequestResponseInfo: 1},
+			responseInfo: true,
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			cl := genClient()
+			cl.Identify("tcp1", packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Connect,
+				},
+				ProtocolName:     []byte{'M', 'Q', 'T', 'T'},
+				ProtocolVersion:  5,
+				ClientIdentifier: "mochi",
+				Properties:       tx.props,
+			}, new(auth.Allow))
+			require.Equal(t, tx.noProblemInfo, cl.NoProblemInfo)
+			require.Equal(t, tx.responseInfo, cl.ResponseInfo)
+		})
+	}
+}
+
+func TestClientIdentifyTopicAliasMaximum(t *testing.T) {
+	cl := genClient()
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+		ProtocolName:     []byte{'M', 'Q', 'T', 'T'},
+		ProtocolVersion:  5,
+		ClientIdentifier: "mochi",
+		Properties: packets.Properties{
+			TopicAliasMaximum: 10,
+		},
+	}
+
+	cl.Identify("tcp1", pk, new(auth.Allow))
+	require.Equal(t, uint16(10), cl.TopicAliases.OutboundMaximum)
+}
+
+func TestClientIdentifyReceiveMaximum(t *testing.T) {
+	cl := genClient()
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+		ProtocolName:     []byte{'M', 'Q', 'T', 'T'},
+		ProtocolVersion:  5,
+		ClientIdentifier: "mochi",
+		Properties: packets.Properties{
+			ReceiveMaximum: 4,
+		},
 	}
+
+	cl.Identify("tcp1", pk, new(auth.Allow))
+	require.Equal(t, uint16(4), cl.ReceiveMaximum)
+}
+
+func TestClientNoteInboundQos2(t *testing.T) {
+	cl := genClient()
+	require.Equal(t, 1, cl.NoteInboundQos2(1))
+	require.Equal(t, 1, cl.NoteInboundQos2(1)) // duplicates are not counted again.
+	require.Equal(t, 2, cl.NoteInboundQos2(2))
+
+	cl.ForgetInboundQos2(1)
+	require.Equal(t, 2, cl.NoteInboundQos2(3))
+}
+
+func TestClientInboundQos2Pending(t *testing.T) {
+	cl := genClient()
+	require.False(t, cl.InboundQos2Pending(1))
+	require.Equal(t, []uint16{}, cl.InboundQos2())
+
+	cl.NoteInboundQos2(9)
+	cl.NoteInboundQos2(1)
+	require.True(t, cl.InboundQos2Pending(1))
+	require.Equal(t, []uint16{1, 9}, cl.InboundQos2())
+
+	cl.ForgetInboundQos2(1)
+	require.False(t, cl.InboundQos2Pending(1))
+}
+
+func TestClientInheritInboundQos2(t *testing.T) {
+	existing := genClient()
+	existing.NoteInboundQos2(3)
+
+	cl := genClient()
+	existing.Lock() // the session of the existing client is locked while it is inherited.
+	cl.InheritInboundQos2(existing)
+	existing.Unlock()
+
+	require.True(t, cl.InboundQos2Pending(3))
+	require.False(t, existing.InboundQos2Pending(3))
+}
+
+func TestTopicAliasesResolveInbound(t *testing.T) {
+	a := TopicAliases{InboundMaximum: 2}
+
+	pk := packets.Packet{TopicName: "a/b/c"}
+	require.NoError(t, a.ResolveInbound(&pk))
+	require.Equal(t, "a/b/c", pk.TopicName)
+
+	pk = packets.Packet{TopicName: "a/b/c", Properties: packets.Properties{TopicAlias: 1}}
+	require.NoError(t, a.ResolveInbound(&pk))
+	require.Equal(t, "a/b/c", pk.TopicName)
+	require.Equal(t, uint16(0), pk.Properties.TopicAlias)
+
+	pk = packets.Packet{Properties: packets.Properties{TopicAlias: 1}}
+	require.NoError(t, a.ResolveInbound(&pk))
+	require.Equal(t, "a/b/c", pk.TopicName)
+	require.Equal(t, uint16(0), pk.Properties.TopicAlias)
+
+	// A new topic replaces the existing mapping of an alias.
+	pk = packets.Packet{TopicName: "d/e/f", Properties: packets.Properties{TopicAlias: 1}}
+	require.NoError(t, a.ResolveInbound(&pk))
+	pk = packets.Packet{Properties: packets.Properties{TopicAlias: 1}}
+	require.NoError(t, a.ResolveInbound(&pk))
+	require.Equal(t, "d/e/f", pk.TopicName)
+}
+
+func TestTopicAliasesResolveInboundInvalid(t *testing.T) {
+	a := TopicAliases{InboundMaximum: 2}
+
+	pk := packets.Packet{TopicName: "a/b/c", Properties: packets.Properties{TopicAlias: 3}}
+	require.ErrorIs(t, a.ResolveInbound(&pk), packets.ErrTopicAliasInvalid)
+
+	pk = packets.Packet{Properties: packets.Properties{TopicAlias: 2}}
+	require.ErrorIs(t, a.ResolveInbound(&pk), packets.ErrTopicAliasUnknown)
+
+	a = TopicAliases{}
+	pk = packets.Packet{TopicName: "a/b/c", Properties: packets.Properties{TopicAlias: 1}}
+	require.ErrorIs(t, a.ResolveInbound(&pk), packets.ErrTopicAliasInvalid)
+}
+
+func TestTopicAliasesApplyOutbound(t *testing.T) {
+	a := TopicAliases{OutboundMaximum: 2}
+
+	pk := packets.Packet{TopicName: "a/b/c"}
+	a.applyOutbound(&pk)
+	require.Equal(t, "a/b/c", pk.TopicName)
+	require.Equal(t, uint16(1), pk.Properties.TopicAlias)
+
+	pk = packets.Packet{TopicName: "a/b/c"}
+	a.applyOutbound(&pk)
+	require.Equal(t, "", pk.TopicName)
+	require.Equal(t, uint16(1), pk.Properties.TopicAlias)
+
+	pk = packets.Packet{TopicName: "d/e/f"}
+	a.applyOutbound(&pk)
+	require.Equal(t, "d/e/f", pk.TopicName)
+	require.Equal(t, uint16(2), pk.Properties.TopicAlias)
+
+	// All aliases are assigned, so new topics are sent in full.
+	pk = packets.Packet{TopicName: "g/h/i"}
+	a.applyOutbound(&pk)
+	require.Equal(t, "g/h/i", pk.TopicName)
+	require.Equal(t, uint16(0), pk.Properties.TopicAlias)
+}
+
+func TestTopicAliasesApplyOutboundDisabled(t *testing.T) {
+	a := TopicAliases{}
+
+	pk := packets.Packet{TopicName: "a/b/c", Properties: packets.Properties{TopicAlias: 5}}
+	a.applyOutbound(&pk)
+	require.Equal(t, "a/b/c", pk.TopicName)
+	require.Equal(t, uint16(0), pk.Properties.TopicAlias)
 }
 
 func TestClientNoteSubscription(t *testing.T) {
@@ -332,6 +656,55 @@ func TestClientNoteSubscription(t *testing.T) {
 	require.Equal(t, byte(0), cl.Subscriptions["a/b/c"])
 }
 
+func TestClientSubscribed(t *testing.T) {
+	cl := genClient()
+	require.False(t, cl.Subscribed("a/b/c"))
+	require.Equal(t, 0, cl.CountSubscriptions())
+
+	cl.NoteSubscription("a/b/c", 0)
+	cl.NoteSubscription("d/e/f", 1)
+	require.True(t, cl.Subscribed("a/b/c"))
+	require.False(t, cl.Subscribed("a/b"))
+	require.Equal(t, 2, cl.CountSubscriptions())
+}
+
+func TestClientNoteSubscriptionID(t *testing.T) {
+	cl := genClient()
+
+	cl.NoteSubscriptionID("a/b/c", 3)
+	require.Equal(t, 3, cl.SubscriptionIDs["a/b/c"])
+
+	cl.NoteSubscriptionID("a/b/c", 0)
+	require.NotContains(t, cl.SubscriptionIDs, "a/b/c")
+}
+
+func TestClientMatchingSubscriptionIDs(t *testing.T) {
+	cl := genClient()
+	cl.NoteSubscriptionID("a/b/c", 3)
+	cl.NoteSubscriptionID("a/+/c", 1)
+	cl.NoteSubscriptionID("a/#", 2)
+	cl.NoteSubscriptionID("d/e/f", 4)
+	cl.NoteSubscriptionID("$share/g1/a/b/c", 5)
+
+	require.Equal(t, []int{1, 2, 3}, cl.MatchingSubscriptionIDs("a/b/c", ""))
+	require.Equal(t, []int{2}, cl.MatchingSubscriptionIDs("a/x", ""))
+	require.Empty(t, cl.MatchingSubscriptionIDs("x/y/z", ""))
+	require.Equal(t, []int{5}, cl.MatchingSubscriptionIDs("a/b/c", "$share/g1/a/b/c"))
+	require.Empty(t, cl.MatchingSubscriptionIDs("a/b/c", "$share/g2/a/b/c"))
+}
+
+func TestClientMatchingSubscriptions(t *testing.T) {
+	cl := genClient()
+	cl.NoteSubscription("a/b/c", 0)
+	cl.NoteSubscription("a/#", 1)
+	cl.NoteSubscription("d/e/f", 0)
+	cl.NoteSubscription("$share/g1/a/b/c", 1)
+
+	require.ElementsMatch(t, []string{"a/b/c", "a/#"}, cl.MatchingSubscriptions("a/b/c"))
+	require.Equal(t, []string{"a/#"}, cl.MatchingSubscriptions("a/x"))
+	require.Empty(t, cl.MatchingSubscriptions("x/y/z"))
+}
+
 func BenchmarkClientNoteSubscription(b *testing.B) {
 	cl := genClient()
 	for n := 0; n < b.N; n++ {
@@ -339,14 +712,41 @@ func BenchmarkClientNoteSubscription(b *testing.B) {
 	}
 }
 
+func TestClientNoteSubscriptionOptions(t *testing.T) {
+	cl := genClient()
+
+	cl.NoteSubscriptionOptions("a/b/c", packets.SubOptions{RetainHandling: packets.RetainDoNotSend})
+	require.Equal(t, packets.RetainDoNotSend, cl.SubOptions["a/b/c"].RetainHandling)
+
+	cl.NoteSubscriptionOptions("a/b/c", packets.SubOptions{})
+	require.NotContains(t, cl.SubOptions, "a/b/c")
+}
+
+func TestClientRetainAsPublished(t *testing.T) {
+	cl := genClient()
+	cl.NoteSubscriptionOptions("a/+/c", packets.SubOptions{RetainAsPublished: true})
+	cl.NoteSubscriptionOptions("d/#", packets.SubOptions{RetainHandling: packets.RetainSendIfNew})
+	cl.NoteSubscriptionOptions("$share/g1/e/f", packets.SubOptions{RetainAsPublished: true})
+
+	require.True(t, cl.RetainAsPublished("a/b/c", ""))
+	require.False(t, cl.RetainAsPublished("d/e/f", ""))
+	require.False(t, cl.RetainAsPublished("e/f", ""))
+	require.True(t, cl.RetainAsPublished("e/f", "$share/g1/e/f"))
+	require.False(t, cl.RetainAsPublished("a/b/c", "$share/g2/a/b/c"))
+}
+
 func TestClientForgetSubscription(t *testing.T) {
 	cl := genClient()
 	require.NotNil(t, cl)
 	cl.Subscriptions = map[string]byte{
 		"a/b/c/": 1,
 	}
+	cl.SubscriptionIDs["a/b/c/"] = 1
+	cl.SubOptions["a/b/c/"] = packets.SubOptions{RetainAsPublished: true}
 	cl.ForgetSubscription("a/b/c/")
 	require.Empty(t, cl.Subscriptions["a/b/c"])
+	require.Empty(t, cl.SubscriptionIDs)
+	require.Empty(t, cl.SubOptions)
 }
 
 func BenchmarkClientForgetSubscription(b *testing.B) {
@@ -357,18 +757,98 @@ func BenchmarkClientForgetSubscription(b *testing.B) {
 	}
 }
 
-func TestClientRefreshDeadline(t *testing.T) {
+func TestClientRefreshActivity(t *testing.T) {
+	cl := genClient()
+	atomic.StoreInt64(&cl.lastActivity, 0)
+	require.Equal(t, time.Unix(0, 0), cl.LastActivity())
+
+	cl.refreshActivity()
+	require.WithinDuration(t, time.Now(), cl.LastActivity(), time.Second)
+}
+
+func TestClientKeepaliveExpired(t *testing.T) {
 	cl := genClient()
-	cl.refreshDeadline(10)
+	cl.SetKeepalive(10)
+	now := cl.LastActivity()
+
+	require.False(t, cl.KeepaliveExpired(now))
+	require.False(t, cl.KeepaliveExpired(now.Add(15*time.Second)))
+	require.True(t, cl.KeepaliveExpired(now.Add(15*time.Second+time.Millisecond)))
+
+	cl.SetKeepalive(0)
+	require.False(t, cl.KeepaliveExpired(now.Add(time.Hour)))
+}
+
+func TestClientSetKeepalive(t *testing.T) {
+	cl := genClient()
+	require.Equal(t, defaultKeepalive, cl.Keepalive())
+
+	cl.SetKeepalive(30)
+	require.Equal(t, uint16(30), cl.Keepalive())
+}
+
+func TestClientSetTimeouts(t *testing.T) {
+	cl := genClient()
+	cl.SetTimeouts(time.Second, 2*time.Second)
+	require.Equal(t, int64(time.Second), atomic.LoadInt64(&cl.readTimeout))
+	require.Equal(t, int64(2*time.Second), atomic.LoadInt64(&cl.writeTimeout))
+
+	cl.SetTimeouts(-1, -1)
+	require.Equal(t, int64(0), atomic.LoadInt64(&cl.readTimeout))
+	require.Equal(t, int64(0), atomic.LoadInt64(&cl.writeTimeout))
+}
+
+func TestClientReadTimeout(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+	cl := NewClient(r, circ.NewReader(128, 8), circ.NewWriter(128, 8), new(system.Info))
+	cl.SetTimeouts(50*time.Millisecond, 0)
+	cl.Start()
+
+	o := make(chan error)
+	go func() {
+		o <- cl.Read(func(cl *Client, pk packets.Packet) error {
+			return nil
+		})
+	}()
+
+	// each complete packet restarts the read timeout.
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		_, err := w.Write([]byte{packets.Pingreq << 4, 0})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl.State.Done))
+
+	// a partial packet does not.
+	_, err := w.Write([]byte{packets.Publish << 4})
+	require.NoError(t, err)
+
+	require.Error(t, <-o)
+	require.ErrorIs(t, cl.StopCause(), ErrReadTimeout)
+}
+
+func TestClientWriteTimeout(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+	cl := NewClient(r, circ.NewReader(128, 8), circ.NewWriter(128, 8), new(system.Info))
+	cl.SetTimeouts(0, 10*time.Millisecond)
+	cl.Start()
+
+	// nothing reads from the other end of the pipe.
+	_, err := cl.W.Write([]byte{packets.Pingresp << 4, 0})
+	require.NoError(t, err)
 
-	// How do we check net.Conn deadline?
-	require.NotNil(t, cl.conn)
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint32(&cl.State.Done) == 1
+	}, time.Second, time.Millisecond)
+	require.ErrorIs(t, cl.StopCause(), ErrWriteTimeout)
 }
 
-func BenchmarkClientRefreshDeadline(b *testing.B) {
+func BenchmarkClientRefreshActivity(b *testing.B) {
 	cl := genClient()
 	for n := 0; n < b.N; n++ {
-		cl.refreshDeadline(10)
+		cl.refreshActivity()
 	}
 }
 
@@ -409,6 +889,26 @@ func TestClientReadFixedHeader(t *testing.T) {
 
 }
 
+func TestClientReadFixedHeaderTooLarge(t *testing.T) {
+	cl := genClient()
+	cl.MaxPacketSize = 129
+	cl.Start()
+	defer cl.Stop(errClientStop)
+
+	cl.R.Set([]byte{packets.Publish << 4, 0x80, 0x01}, 0, 3) // remaining 128, total 131.
+	cl.R.SetPos(0, 3)
+
+	fh := new(packets.FixedHeader)
+	err := cl.ReadFixedHeader(fh)
+	require.ErrorIs(t, err, packets.ErrPacketTooLarge)
+
+	cl.MaxPacketSize = 131
+	cl.R.SetPos(0, 3)
+	err = cl.ReadFixedHeader(fh)
+	require.NoError(t, err)
+	require.Equal(t, 128, fh.Remaining)
+}
+
 func TestClientReadFixedHeaderDecodeError(t *testing.T) {
 	cl := genClient()
 	cl.Start()
@@ -652,6 +1152,34 @@ func TestClientReadPacketOK(t *testing.T) {
 	}, pk)
 }
 
+func TestClientReadPacketV5(t *testing.T) {
+	cl := genClient()
+	cl.ProtocolVersion = 5
+	cl.Start()
+	defer cl.Stop(errClientStop)
+
+	b := []byte{
+		byte(packets.Publish << 4), 17, // Fixed header
+		0, 5,
+		'd', '/', 'e', '/', 'f',
+		5, packets.PropMessageExpiryInterval, 0, 0, 0, 60,
+		'y', 'e', 'a', 'h',
+	}
+	err := cl.R.Set(b, 0, len(b))
+	require.NoError(t, err)
+	cl.R.SetPos(0, int64(len(b)))
+
+	fh := new(packets.FixedHeader)
+	err = cl.ReadFixedHeader(fh)
+	require.NoError(t, err)
+
+	pk, err := cl.ReadPacket(fh)
+	require.NoError(t, err)
+	require.Equal(t, byte(5), pk.ProtocolVersion)
+	require.Equal(t, uint32(60), pk.Properties.MessageExpiryInterval)
+	require.Equal(t, []byte("yeah"), pk.Payload)
+}
+
 func TestClientReadPacket(t *testing.T) {
 	cl := genClient()
 	cl.Start()
@@ -673,6 +1201,7 @@ func TestClientReadPacket(t *testing.T) {
 		require.Equal(t, tt.packet, pk, "Mismatched packet: [i:%d] %d", i, tt.bytes[0])
 		if tt.packet.FixedHeader.Type == packets.Publish {
 			require.Equal(t, int64(1), atomic.LoadInt64(&cl.systemInfo.PublishRecv))
+			require.Equal(t, int64(1), atomic.LoadInt64(&cl.systemInfo.PublishRecvQos[tt.packet.FixedHeader.Qos]))
 		}
 	}
 }
@@ -723,6 +1252,89 @@ func TestClientReadPacketReadUnknown(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestClientWriteBuffered(t *testing.T) {
+	cl := genClient()
+	require.Equal(t, 0, cl.WriteBuffered())
+
+	n, err := cl.WritePacket(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingresp}})
+	require.NoError(t, err)
+	require.Equal(t, n, cl.WriteBuffered())
+
+	require.Equal(t, 0, NewClientStub(nil).WriteBuffered())
+}
+
+func TestIsBareAck(t *testing.T) {
+	require.True(t, isBareAck(packets.FixedHeader{Type: packets.Puback, Remaining: 2}))
+	require.True(t, isBareAck(packets.FixedHeader{Type: packets.Pubrel, Remaining: 3}))
+	require.False(t, isBareAck(packets.FixedHeader{Type: packets.Pubcomp, Remaining: 8}))
+	require.False(t, isBareAck(packets.FixedHeader{Type: packets.Publish, Remaining: 2}))
+	require.False(t, isBareAck(packets.FixedHeader{Type: packets.Subscribe, Remaining: 2}))
+}
+
+func TestClientReadPacketCopiesPayload(t *testing.T) {
+	cl := genClient()
+	cl.Start()
+	defer cl.Stop(errClientStop)
+
+	b := []byte{byte(packets.Publish << 4), 6, 0, 1, 'a', 'h', 'e', 'y'}
+	err := cl.R.Set(b, 0, len(b))
+	require.NoError(t, err)
+	cl.R.SetPos(0, int64(len(b)))
+
+	fh := new(packets.FixedHeader)
+	require.NoError(t, cl.ReadFixedHeader(fh))
+	pk, err := cl.ReadPacket(fh)
+	require.NoError(t, err)
+
+	// overwrite the read buffer, as the next packet would.
+	err = cl.R.Set(make([]byte, len(b)), 0, len(b))
+	require.NoError(t, err)
+	require.Equal(t, "a", pk.TopicName)
+	require.Equal(t, []byte("hey"), pk.Payload)
+}
+
+func BenchmarkClientReadPacketPuback(b *testing.B) {
+	cl := genClient()
+	cl.Start()
+	defer cl.Stop(errClientStop)
+
+	pk := []byte{byte(packets.Puback << 4), 2, 0, 11}
+	fh := new(packets.FixedHeader)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cl.R.Set(pk, 0, len(pk))
+		cl.R.SetPos(0, int64(len(pk)))
+		cl.ReadFixedHeader(fh)
+		cl.ReadPacket(fh)
+	}
+}
+
+func BenchmarkClientWritePacketPublish(b *testing.B) {
+	r, w := net.Pipe()
+	cl := NewClient(r, circ.NewReader(128, 8), circ.NewWriter(1<<16, 8), new(system.Info))
+	cl.Start()
+	defer cl.Stop(errClientStop)
+	go io.Copy(ioutil.Discard, w)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		PacketID:  11,
+		TopicName: "a/b/c",
+		Payload:   make([]byte, 512),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cl.WritePacket(pk)
+	}
+}
+
 func TestClientWritePacket(t *testing.T) {
 	for i, tt := range pkTable {
 		r, w := net.Pipe()
@@ -760,10 +1372,87 @@ func TestClientWritePacket(t *testing.T) {
 		require.Equal(t, int64(1), atomic.LoadInt64(&cl.systemInfo.MessagesSent))
 		if tt.packet.FixedHeader.Type == packets.Publish {
 			require.Equal(t, int64(1), atomic.LoadInt64(&cl.systemInfo.PublishSent))
+			require.Equal(t, int64(1), atomic.LoadInt64(&cl.systemInfo.PublishSentQos[tt.packet.FixedHeader.Qos]))
 		}
 	}
 }
 
+func TestClientWritePacketV5(t *testing.T) {
+	r, w := net.Pipe()
+	cl := NewClient(r, circ.NewReader(128, 8), circ.NewWriter(128, 8), new(system.Info))
+	cl.ProtocolVersion = 5
+	cl.Start()
+	defer cl.Stop(errClientStop)
+
+	o := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		require.NoError(t, err)
+		o <- buf
+	}()
+
+	_, err := cl.WritePacket(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("hi"),
+	})
+	require.NoError(t, err)
+
+	time.Sleep(2 * time.Millisecond)
+	r.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 8,
+		0, 3, 'a', '/', 'b',
+		0, // properties length
+		'h', 'i',
+	}, <-o)
+}
+
+func TestClientWritePacketTopicAlias(t *testing.T) {
+	r, w := net.Pipe()
+	cl := NewClient(r, circ.NewReader(128, 8), circ.NewWriter(128, 8), new(system.Info))
+	cl.ProtocolVersion = 5
+	cl.TopicAliases.OutboundMaximum = 1
+	cl.Start()
+	defer cl.Stop(errClientStop)
+
+	o := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		require.NoError(t, err)
+		o <- buf
+	}()
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("hi"),
+	}
+	_, err := cl.WritePacket(pk)
+	require.NoError(t, err)
+	_, err = cl.WritePacket(pk)
+	require.NoError(t, err)
+
+	time.Sleep(2 * time.Millisecond)
+	r.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 11,
+		0, 3, 'a', '/', 'b',
+		3, packets.PropTopicAlias, 0, 1, // properties
+		'h', 'i',
+		byte(packets.Publish << 4), 8,
+		0, 0, // empty topic
+		3, packets.PropTopicAlias, 0, 1, // properties
+		'h', 'i',
+	}, <-o)
+}
+
 func TestClientWritePacketWriteNoConn(t *testing.T) {
 	c, _ := net.Pipe()
 	cl := NewClient(c, circ.NewReader(16, 4), circ.NewWriter(16, 4), new(system.Info))
@@ -815,6 +1504,141 @@ func BenchmarkInflightSet(b *testing.B) {
 	}
 }
 
+func TestInflightSetOrQueue(t *testing.T) {
+	cl := genClient()
+
+	in, ok := cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "a"}}, 2)
+	require.True(t, ok)
+	require.Equal(t, uint16(1), in.Packet.PacketID)
+
+	in, ok = cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "b", PacketID: 7}}, 2)
+	require.True(t, ok)
+	require.Equal(t, uint16(7), in.Packet.PacketID)
+
+	_, ok = cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "c"}}, 2)
+	require.False(t, ok)
+	require.Equal(t, 2, cl.Inflight.Len())
+	require.Equal(t, 1, cl.Inflight.QueueLen())
+
+	// Messages are queued behind earlier queued messages, even with a free quota.
+	cl.Inflight.Delete(1)
+	_, ok = cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "d"}}, 2)
+	require.False(t, ok)
+	require.Equal(t, 2, cl.Inflight.QueueLen())
+}
+
+func TestInflightSetOrQueueUnlimited(t *testing.T) {
+	cl := genClient()
+
+	for i := 0; i < 3; i++ {
+		_, ok := cl.Inflight.SetOrQueue(InflightMessage{}, 0)
+		require.True(t, ok)
+	}
+	require.Equal(t, 3, cl.Inflight.Len())
+	require.Equal(t, 0, cl.Inflight.QueueLen())
+}
+
+func TestInflightDequeue(t *testing.T) {
+	cl := genClient()
+
+	_, ok := cl.Inflight.Dequeue(1)
+	require.False(t, ok)
+
+	cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "a"}}, 1)
+	cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "b"}}, 1)
+	cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "c"}}, 1)
+
+	_, ok = cl.Inflight.Dequeue(1)
+	require.False(t, ok) // the quota is used up.
+
+	cl.Inflight.Delete(1)
+	in, ok := cl.Inflight.Dequeue(1)
+	require.True(t, ok)
+	require.Equal(t, "b", in.Packet.TopicName)
+	require.Equal(t, uint16(2), in.Packet.PacketID)
+	require.NotEqual(t, int64(0), in.Sent)
+	require.Equal(t, 1, cl.Inflight.Len())
+	require.Equal(t, 1, cl.Inflight.QueueLen())
+
+	cl.Inflight.Delete(2)
+	in, ok = cl.Inflight.Dequeue(1)
+	require.True(t, ok)
+	require.Equal(t, "c", in.Packet.TopicName)
+	require.Equal(t, 0, cl.Inflight.QueueLen())
+}
+
+func TestInflightNextID(t *testing.T) {
+	cl := genClient()
+
+	in, _ := cl.Inflight.SetOrQueue(InflightMessage{}, 0)
+	require.Equal(t, uint16(1), in.Packet.PacketID)
+
+	// Packet ids held by restored messages are skipped.
+	cl.Inflight.Set(2, InflightMessage{Packet: packets.Packet{PacketID: 2}})
+	in, _ = cl.Inflight.SetOrQueue(InflightMessage{}, 0)
+	require.Equal(t, uint16(3), in.Packet.PacketID)
+
+	// Packet ids loop around, reusing those which have been freed.
+	cl.Inflight.lastID = maxPacketID
+	in, _ = cl.Inflight.SetOrQueue(InflightMessage{}, 0)
+	require.Equal(t, uint16(4), in.Packet.PacketID)
+
+	cl.Inflight.Delete(1)
+	cl.Inflight.lastID = maxPacketID
+	in, _ = cl.Inflight.SetOrQueue(InflightMessage{}, 0)
+	require.Equal(t, uint16(1), in.Packet.PacketID)
+}
+
+func TestInflightNextIDExhausted(t *testing.T) {
+	cl := genClient()
+	for id := 1; id <= maxPacketID; id++ {
+		cl.Inflight.Set(uint16(id), InflightMessage{})
+	}
+
+	// With every packet id in use, messages are queued rather than reusing a
+	// live packet id, even without a quota.
+	_, ok := cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "a"}}, 0)
+	require.False(t, ok)
+	require.Equal(t, 1, cl.Inflight.QueueLen())
+
+	_, ok = cl.Inflight.Dequeue(0)
+	require.False(t, ok)
+	require.Equal(t, 1, cl.Inflight.QueueLen())
+
+	cl.Inflight.Delete(300)
+	in, ok := cl.Inflight.Dequeue(0)
+	require.True(t, ok)
+	require.Equal(t, "a", in.Packet.TopicName)
+	require.Equal(t, uint16(300), in.Packet.PacketID)
+	require.Equal(t, 0, cl.Inflight.QueueLen())
+}
+
+func BenchmarkInflightSetOrQueue(b *testing.B) {
+	cl := genClient()
+	for n := 0; n < b.N; n++ {
+		in, _ := cl.Inflight.SetOrQueue(InflightMessage{}, 0)
+		cl.Inflight.Delete(in.Packet.PacketID)
+	}
+}
+
+func TestInflightTakeQueued(t *testing.T) {
+	cl := genClient()
+
+	cl.Inflight.SetOrQueue(InflightMessage{}, 1)
+	cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "a"}, Shared: "s"}, 1)
+	cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "b"}}, 1)
+	cl.Inflight.SetOrQueue(InflightMessage{Packet: packets.Packet{TopicName: "c"}, Shared: "s"}, 1)
+
+	taken := cl.Inflight.TakeQueued(func(in InflightMessage) bool {
+		return in.Shared != ""
+	})
+	require.Len(t, taken, 2)
+	require.Equal(t, "a", taken[0].Packet.TopicName)
+	require.Equal(t, "c", taken[1].Packet.TopicName)
+	require.Equal(t, 1, cl.Inflight.QueueLen())
+	require.Equal(t, 1, cl.Inflight.Len())
+}
+
 func TestInflightGet(t *testing.T) {
 	cl := genClient()
 	cl.Inflight.Set(2, InflightMessage{Packet: packets.Packet{}, Sent: 0})
@@ -843,6 +1667,20 @@ func TestInflightGetAll(t *testing.T) {
 	require.Equal(t, o, m)
 }
 
+func TestInflightGetOrdered(t *testing.T) {
+	cl := genClient()
+	cl.Inflight.Set(1, InflightMessage{Packet: packets.Packet{PacketID: 1}, Sequence: 3})
+	cl.Inflight.Set(2, InflightMessage{Packet: packets.Packet{PacketID: 2}, Sequence: 1})
+	cl.Inflight.Set(3, InflightMessage{Packet: packets.Packet{PacketID: 3}, Sequence: 2})
+	cl.Inflight.Set(4, InflightMessage{Packet: packets.Packet{PacketID: 4}, Sequence: 1})
+
+	var ids []uint16
+	for _, in := range cl.Inflight.GetOrdered() {
+		ids = append(ids, in.Packet.PacketID)
+	}
+	require.Equal(t, []uint16{2, 4, 3, 1}, ids)
+}
+
 func BenchmarkInflightGetAll(b *testing.B) {
 	cl := genClient()
 	cl.Inflight.Set(2, InflightMessage{Packet: packets.Packet{}, Sent: 0})
@@ -926,6 +1764,30 @@ func TestInflightClearExpired(t *testing.T) {
 	require.Equal(t, int64(2), deleted)
 }
 
+func TestInflightClearExpiredQos(t *testing.T) {
+	n := time.Now().Unix()
+	cl := genClient()
+
+	pk := func(typ, qos byte) packets.Packet {
+		return packets.Packet{FixedHeader: packets.FixedHeader{Type: typ, Qos: qos}}
+	}
+
+	cl.Inflight.Set(1, InflightMessage{Packet: pk(packets.Publish, 1), Created: n - 5})
+	cl.Inflight.Set(2, InflightMessage{Packet: pk(packets.Publish, 2), Created: n - 5})
+	cl.Inflight.Set(3, InflightMessage{Packet: pk(packets.Pubrel, 1), Created: n - 5})
+	cl.Inflight.Set(4, InflightMessage{Packet: pk(packets.Publish, 1), Created: n - 1})
+
+	deleted := cl.Inflight.ClearExpiredQos([3]int64{n - 10, n - 2, n - 10})
+	require.Equal(t, int64(1), deleted)
+
+	_, ok := cl.Inflight.Get(1)
+	require.False(t, ok)
+	for _, id := range []uint16{2, 3, 4} {
+		_, ok := cl.Inflight.Get(id)
+		require.True(t, ok)
+	}
+}
+
 var (
 	pkTable = []struct {
 		bytes  []byte
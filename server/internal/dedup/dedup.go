@@ -0,0 +1,86 @@
+// Package dedup provides a bounded window of recently seen message ids, for
+// suppressing messages which are republished by their sender.
+package dedup
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// seen is a message id and when it was first seen.
+type seen struct {
+	id      string    // the message id.
+	expires time.Time // when the id should be forgotten.
+}
+
+// Window remembers the message ids seen within a fixed time to live, up to a
+// maximum number of ids. When the window is full, the oldest id is forgotten.
+type Window struct {
+	sync.Mutex
+	size  int                      // the maximum number of ids remembered.
+	ttl   time.Duration            // how long each id is remembered.
+	order *list.List               // the ids, most recently seen first.
+	ids   map[string]*list.Element // the ids, keyed on id.
+}
+
+// New returns a window remembering at most size ids, each for ttl. The size
+// is always at least 1.
+func New(size int, ttl time.Duration) *Window {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Window{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		ids:   map[string]*list.Element{},
+	}
+}
+
+// Seen returns true if a message id has already been seen within the window.
+// Otherwise the id is remembered, and false is returned. The window of an id
+// starts when it is first seen, and is not extended by duplicates.
+func (w *Window) Seen(id string, now time.Time) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	w.expire(now)
+	if _, ok := w.ids[id]; ok {
+		return true
+	}
+
+	w.ids[id] = w.order.PushFront(&seen{
+		id:      id,
+		expires: now.Add(w.ttl),
+	})
+
+	for w.order.Len() > w.size {
+		w.remove(w.order.Back())
+	}
+
+	return false
+}
+
+// Len returns the number of ids remembered by the window.
+func (w *Window) Len() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.order.Len()
+}
+
+// expire forgets the ids which have outlived the window. As every id is kept
+// for the same time, they expire from the back of the list. The window must
+// be locked.
+func (w *Window) expire(now time.Time) {
+	for el := w.order.Back(); el != nil && !now.Before(el.Value.(*seen).expires); el = w.order.Back() {
+		w.remove(el)
+	}
+}
+
+// remove forgets an id. The window must be locked.
+func (w *Window) remove(el *list.Element) {
+	delete(w.ids, el.Value.(*seen).id)
+	w.order.Remove(el)
+}
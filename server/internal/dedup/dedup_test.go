@@ -0,0 +1,67 @@
+package dedup
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	w := New(10, time.Minute)
+	require.Equal(t, 10, w.size)
+	require.Equal(t, time.Minute, w.ttl)
+	require.Equal(t, 0, w.Len())
+
+	w = New(0, time.Minute)
+	require.Equal(t, 1, w.size)
+}
+
+func TestWindowSeen(t *testing.T) {
+	now := time.Now()
+	w := New(10, time.Minute)
+
+	require.False(t, w.Seen("a", now))
+	require.True(t, w.Seen("a", now))
+	require.False(t, w.Seen("b", now))
+	require.True(t, w.Seen("a", now.Add(time.Second)))
+	require.Equal(t, 2, w.Len())
+}
+
+func TestWindowExpiry(t *testing.T) {
+	now := time.Now()
+	w := New(10, time.Minute)
+
+	require.False(t, w.Seen("a", now))
+	require.False(t, w.Seen("b", now.Add(30*time.Second)))
+
+	// duplicates do not extend the window of an id.
+	require.True(t, w.Seen("a", now.Add(time.Minute-time.Second)))
+	require.False(t, w.Seen("a", now.Add(time.Minute)))
+	require.True(t, w.Seen("b", now.Add(time.Minute)))
+
+	require.False(t, w.Seen("c", now.Add(2*time.Minute)))
+	require.Equal(t, 1, w.Len()) // a and b have both expired.
+}
+
+func TestWindowSize(t *testing.T) {
+	now := time.Now()
+	w := New(3, time.Minute)
+
+	for i := 0; i < 5; i++ {
+		require.False(t, w.Seen(strconv.Itoa(i), now))
+	}
+	require.Equal(t, 3, w.Len())
+
+	require.False(t, w.Seen("0", now)) // forgotten to make room for newer ids.
+	require.True(t, w.Seen("4", now))
+}
+
+func BenchmarkWindowSeen(b *testing.B) {
+	now := time.Now()
+	w := New(1000, time.Minute)
+	for n := 0; n < b.N; n++ {
+		w.Seen(strconv.Itoa(n%2000), now)
+	}
+}
@@ -0,0 +1,111 @@
+// Package lastvalue provides a bounded cache of the last message published to
+// each topic, for replaying recent messages to new subscribers.
+package lastvalue
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/csymapp/mqtt/server/internal/packets"
+)
+
+// value is the last message published to a topic and when it was published.
+type value struct {
+	pk      packets.Packet // the last message published to the topic.
+	expires time.Time      // when the message should be forgotten.
+}
+
+// Cache remembers the last message published to each topic for a fixed time
+// to live, up to a maximum number of topics. When the cache is full, the topic
+// published to least recently is forgotten.
+type Cache struct {
+	sync.Mutex
+	size   int                      // the maximum number of topics remembered.
+	ttl    time.Duration            // how long each message is remembered.
+	order  *list.List               // the messages, most recently published first.
+	topics map[string]*list.Element // the messages, keyed on topic name.
+}
+
+// New returns a cache remembering the messages of at most size topics, each
+// for ttl. The size is always at least 1.
+func New(size int, ttl time.Duration) *Cache {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Cache{
+		size:   size,
+		ttl:    ttl,
+		order:  list.New(),
+		topics: map[string]*list.Element{},
+	}
+}
+
+// Set remembers a message as the last published to its topic, replacing any
+// earlier message and restarting the time to live of the topic.
+func (c *Cache) Set(pk packets.Packet, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.expire(now)
+	if el, ok := c.topics[pk.TopicName]; ok {
+		c.remove(el)
+	}
+
+	c.topics[pk.TopicName] = c.order.PushFront(&value{
+		pk:      pk,
+		expires: now.Add(c.ttl),
+	})
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Delete forgets the last message published to a topic.
+func (c *Cache) Delete(topic string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.topics[topic]; ok {
+		c.remove(el)
+	}
+}
+
+// Messages returns the messages remembered by the cache which have not
+// expired, least recently published first.
+func (c *Cache) Messages(now time.Time) []packets.Packet {
+	c.Lock()
+	defer c.Unlock()
+
+	c.expire(now)
+	pks := make([]packets.Packet, 0, c.order.Len())
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		pks = append(pks, el.Value.(*value).pk)
+	}
+
+	return pks
+}
+
+// Len returns the number of topics remembered by the cache.
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+// expire forgets the messages which have outlived the cache. As every message
+// is kept for the same time, they expire from the back of the list. The cache
+// must be locked.
+func (c *Cache) expire(now time.Time) {
+	for el := c.order.Back(); el != nil && !now.Before(el.Value.(*value).expires); el = c.order.Back() {
+		c.remove(el)
+	}
+}
+
+// remove forgets a message. The cache must be locked.
+func (c *Cache) remove(el *list.Element) {
+	delete(c.topics, el.Value.(*value).pk.TopicName)
+	c.order.Remove(el)
+}
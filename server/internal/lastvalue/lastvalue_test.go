@@ -0,0 +1,75 @@
+package lastvalue
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/csymapp/mqtt/server/internal/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func msg(topic, payload string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+	}
+}
+
+func TestNew(t *testing.T) {
+	c := New(10, time.Minute)
+	require.Equal(t, 10, c.size)
+	require.Equal(t, time.Minute, c.ttl)
+	require.Equal(t, 0, c.Len())
+
+	c = New(0, time.Minute)
+	require.Equal(t, 1, c.size)
+}
+
+func TestCacheSet(t *testing.T) {
+	now := time.Now()
+	c := New(10, time.Minute)
+
+	c.Set(msg("a/b", "1"), now)
+	c.Set(msg("a/c", "2"), now)
+	c.Set(msg("a/b", "3"), now)
+	require.Equal(t, 2, c.Len())
+	require.Equal(t, []packets.Packet{msg("a/c", "2"), msg("a/b", "3")}, c.Messages(now))
+}
+
+func TestCacheDelete(t *testing.T) {
+	now := time.Now()
+	c := New(10, time.Minute)
+
+	c.Set(msg("a/b", "1"), now)
+	c.Set(msg("a/c", "2"), now)
+	c.Delete("a/b")
+	c.Delete("a/d")
+	require.Equal(t, []packets.Packet{msg("a/c", "2")}, c.Messages(now))
+}
+
+func TestCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := New(10, time.Minute)
+
+	c.Set(msg("a", "1"), now)
+	c.Set(msg("b", "1"), now.Add(30*time.Second))
+
+	// publishing again restarts the time to live of a topic.
+	c.Set(msg("a", "2"), now.Add(45*time.Second))
+	require.Equal(t, []packets.Packet{msg("a", "2")}, c.Messages(now.Add(90*time.Second)))
+	require.Empty(t, c.Messages(now.Add(2*time.Minute)))
+	require.Equal(t, 0, c.Len())
+}
+
+func TestCacheSize(t *testing.T) {
+	now := time.Now()
+	c := New(3, time.Minute)
+
+	for i := 0; i < 5; i++ {
+		c.Set(msg(strconv.Itoa(i), "x"), now)
+	}
+	require.Equal(t, 3, c.Len())
+	require.Equal(t, []packets.Packet{msg("2", "x"), msg("3", "x"), msg("4", "x")}, c.Messages(now))
+}
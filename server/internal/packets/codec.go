@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"bytes"
 	"encoding/binary"
 	"unicode/utf8"
 	"unsafe"
@@ -21,6 +22,35 @@ func decodeUint16(buf []byte, offset int) (uint16, int, error) {
 	return binary.BigEndian.Uint16(buf[offset : offset+2]), offset + 2, nil
 }
 
+// decodeUint32 extracts the value of four bytes from a byte array.
+func decodeUint32(buf []byte, offset int) (uint32, int, error) {
+	if len(buf) < offset+4 {
+		return 0, 0, ErrOffsetUintOutOfRange
+	}
+
+	return binary.BigEndian.Uint32(buf[offset : offset+4]), offset + 4, nil
+}
+
+// decodeLength extracts a variable byte integer from a byte array, beginning at an offset.
+func decodeLength(buf []byte, offset int) (int, int, error) {
+	var value, multiplier int = 0, 1
+	for i := 0; i < 4; i++ {
+		if len(buf) <= offset {
+			return 0, 0, ErrOffsetByteOutOfRange
+		}
+
+		b := buf[offset]
+		offset++
+		value += int(b&127) * multiplier
+		if b&128 == 0 {
+			return value, offset, nil
+		}
+		multiplier *= 128
+	}
+
+	return 0, 0, ErrOversizedLengthIndicator
+}
+
 // decodeString extracts a string from a byte array, beginning at an offset.
 func decodeString(buf []byte, offset int) (string, int, error) {
 	b, n, err := decodeBytes(buf, offset)
@@ -92,6 +122,13 @@ func encodeUint16(val uint16) []byte {
 	return buf
 }
 
+// encodeUint32 encodes a uint32 value to a byte array.
+func encodeUint32(val uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, val)
+	return buf
+}
+
 // encodeString encodes a string to a byte array.
 func encodeString(val string) []byte {
 	// Like encodeBytes, we set the cap to a small number to avoid
@@ -110,7 +147,5 @@ func validUTF8(b []byte) bool {
 	}
 
 	// [MQTT-1.4.0-2] A UTF-8 encoded string MUST NOT include an encoding of the null character U+0000...
-	// ...
-	return true
-
+	return bytes.IndexByte(b, 0) < 0
 }
@@ -92,6 +92,11 @@ func TestDecodeString(t *testing.T) {
 			rawBytes:   []byte{0, 7, 0xc3, 0x28, 98, 47, 99, 47, 100},
 			shouldFail: ErrOffsetStrInvalidUTF8,
 		},
+		{
+			offset:     0,
+			rawBytes:   []byte{0, 5, 'a', '/', 0, '/', 'c'},
+			shouldFail: ErrOffsetStrInvalidUTF8,
+		},
 	}
 
 	for i, wanted := range expect {
@@ -270,6 +275,46 @@ func BenchmarkDecodeUint16(b *testing.B) {
 	}
 }
 
+func TestDecodeUint32(t *testing.T) {
+	result, offset, err := decodeUint32([]byte{0, 0, 1, 0, 7}, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(256), result)
+	require.Equal(t, 4, offset)
+
+	_, _, err = decodeUint32([]byte{0, 0, 1}, 0)
+	require.ErrorIs(t, err, ErrOffsetUintOutOfRange)
+}
+
+func TestDecodeLength(t *testing.T) {
+	expect := []struct {
+		rawBytes   []byte
+		result     int
+		offset     int
+		shouldFail error
+	}{
+		{rawBytes: []byte{0}, result: 0, offset: 1},
+		{rawBytes: []byte{127}, result: 127, offset: 1},
+		{rawBytes: []byte{0x80, 0x01}, result: 128, offset: 2},
+		{rawBytes: []byte{0xff, 0xff, 0xff, 0x7f}, result: 268435455, offset: 4},
+		{rawBytes: []byte{0x80}, shouldFail: ErrOffsetByteOutOfRange},
+		{rawBytes: []byte{0xff, 0xff, 0xff, 0xff, 0x01}, shouldFail: ErrOversizedLengthIndicator},
+	}
+
+	for i, wanted := range expect {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			result, offset, err := decodeLength(wanted.rawBytes, 0)
+			if wanted.shouldFail != nil {
+				require.True(t, errors.Is(err, wanted.shouldFail), "want %v to be a %v", err, wanted.shouldFail)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, wanted.result, result)
+			require.Equal(t, wanted.offset, offset)
+		})
+	}
+}
+
 func TestDecodeByteBool(t *testing.T) {
 	expect := []struct {
 		rawBytes   []byte
@@ -364,6 +409,12 @@ func BenchmarkEncodeUint16(b *testing.B) {
 	}
 }
 
+func TestEncodeUint32(t *testing.T) {
+	require.Equal(t, []byte{0x00, 0x00, 0x00, 0x00}, encodeUint32(0))
+	require.Equal(t, []byte{0x00, 0x00, 0x01, 0x00}, encodeUint32(256))
+	require.Equal(t, []byte{0xff, 0xff, 0xff, 0xff}, encodeUint32(4294967295))
+}
+
 func TestEncodeString(t *testing.T) {
 	result := encodeString("testing")
 	require.Equal(t, []uint8{0x00, 0x07, 0x74, 0x65, 0x73, 0x74, 0x69, 0x6e, 0x67}, result, "Incorrect encoded value, testing")
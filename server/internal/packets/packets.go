@@ -24,6 +24,7 @@ const (
 	Pingreq          // 12
 	Pingresp         // 13
 	Disconnect       // 14
+	Auth             // 15
 
 	Accepted                      byte = 0x00
 	Failed                        byte = 0xFF
@@ -35,6 +36,32 @@ const (
 	CodeConnectNetworkError       byte = 0xFE
 	CodeConnectProtocolViolation  byte = 0xFF
 	ErrSubAckNetworkError         byte = 0x80
+	CodeDisconnectWillMessage     byte = 0x04
+	CodeNoSubscriptionExisted     byte = 0x11
+	CodeContinueAuthentication    byte = 0x18
+	CodeUnspecifiedError          byte = 0x80
+	CodeProtocolError             byte = 0x82
+	CodeClientIDNotValid          byte = 0x85
+	CodeNotAuthorized             byte = 0x87
+	CodeBadAuthenticationMethod   byte = 0x8C
+	CodeServerUnavailable         byte = 0x88
+	CodeServerBusy                byte = 0x89
+	CodeServerShuttingDown        byte = 0x8B
+	CodeKeepAliveTimeout          byte = 0x8D
+	CodeSessionTakenOver          byte = 0x8E
+	CodeReceiveMaximumExceeded    byte = 0x93
+	CodeAdministrativeAction      byte = 0x98
+	CodeTopicAliasInvalid         byte = 0x94
+	CodePacketTooLarge            byte = 0x95
+	CodeMessageRateTooHigh        byte = 0x96
+	CodeQuotaExceeded             byte = 0x97
+	CodeTopicFilterInvalid        byte = 0x8F
+	CodeTopicNameInvalid          byte = 0x90
+	CodeRetainNotSupported        byte = 0x9A
+	CodeQosNotSupported           byte = 0x9B
+	CodeUseAnotherServer          byte = 0x9C
+	CodeServerMoved               byte = 0x9D
+	CodePayloadFormatInvalid      byte = 0x99
 )
 
 var (
@@ -58,7 +85,12 @@ var (
 	ErrMalformedPacketID = errors.New("malformed packet: packet id")
 
 	// SUBSCRIBE
-	ErrMalformedQoS = errors.New("malformed packet: qos")
+	ErrMalformedQoS        = errors.New("malformed packet: qos")
+	ErrMalformedSubOptions = errors.New("malformed packet: subscription options")
+
+	// PROPERTIES
+	ErrMalformedProperties = errors.New("malformed packet: properties")
+	ErrInvalidProperty     = errors.New("protocol violation: invalid property for packet type")
 
 	// PACKETS
 	ErrProtocolViolation        = errors.New("protocol violation")
@@ -71,18 +103,48 @@ var (
 	ErrOversizedLengthIndicator = errors.New("protocol violation: oversized length indicator")
 	ErrMissingPacketID          = errors.New("missing packet id")
 	ErrSurplusPacketID          = errors.New("surplus packet id")
+	ErrPacketTooLarge           = errors.New("packet exceeds maximum packet size")
+	ErrTopicAliasInvalid        = errors.New("protocol violation: topic alias invalid")
+	ErrTopicAliasUnknown        = errors.New("protocol violation: unknown topic alias")
+)
+
+// The MQTT v5 Retain Handling subscription options, which determine whether
+// retained messages are sent when a subscription is made.
+const (
+	RetainSendOnSubscribe byte = 0 // send retained messages at the time of the subscribe.
+	RetainSendIfNew       byte = 1 // send retained messages only if the subscription does not already exist.
+	RetainDoNotSend       byte = 2 // do not send retained messages at the time of the subscribe.
 )
 
+// SubOptions contains the MQTT v5 subscription options of a subscription
+// filter, other than its maximum QoS.
+type SubOptions struct {
+	RetainAsPublished bool // forwarded messages keep the retain flag they were published with.
+	RetainHandling    byte // whether retained messages are sent when the subscription is made.
+}
+
+// encode returns the subscription options as bits of the options byte.
+func (o SubOptions) encode() byte {
+	var b byte
+	if o.RetainAsPublished {
+		b |= 1 << 3
+	}
+	return b | o.RetainHandling<<4
+}
+
 // Packet is an MQTT packet. Instead of providing a packet interface and variant
 // packet structs, this is a single concrete packet type to cover all packet
 // types, which allows us to take advantage of various compiler optimizations.
 type Packet struct {
 	FixedHeader      FixedHeader
-	AllowClients     []string // For use with OnMessage event hook.
+	Properties       Properties // MQTT v5 properties.
+	WillProperties   Properties // MQTT v5 will properties of a connect packet.
+	AllowClients     []string   // For use with OnMessage event hook.
 	Topics           []string
 	ReturnCodes      []byte
 	ProtocolName     []byte
 	Qoss             []byte
+	SubOptions       []SubOptions // MQTT v5 subscription options for each of the Topics.
 	Payload          []byte
 	Username         []byte
 	Password         []byte
@@ -102,6 +164,7 @@ type Packet struct {
 	UsernameFlag     bool
 	PasswordFlag     bool
 	SessionPresent   bool
+	Created          int64 // the time the message was received in unixtime, for use with message expiry.
 }
 
 // ConnectEncode encodes a connect packet.
@@ -115,6 +178,15 @@ func (pk *Packet) ConnectEncode(buf *bytes.Buffer) error {
 
 	var willTopic, willFlag, usernameFlag, passwordFlag []byte
 
+	// MQTT v5 connect and will properties.
+	var props, willProps bytes.Buffer
+	if pk.ProtocolVersion == 5 {
+		pk.Properties.Encode(Connect, &props)
+		if pk.WillFlag {
+			pk.WillProperties.Encode(WillProperties, &willProps)
+		}
+	}
+
 	// If will flag is set, add topic and message.
 	if pk.WillFlag {
 		willTopic = encodeString(pk.WillTopic)
@@ -133,8 +205,8 @@ func (pk *Packet) ConnectEncode(buf *bytes.Buffer) error {
 
 	// Get a length for the connect header. This is not super pretty, but it works.
 	pk.FixedHeader.Remaining =
-		len(protoName) + 1 + 1 + len(keepalive) + len(clientID) +
-			len(willTopic) + len(willFlag) +
+		len(protoName) + 1 + 1 + len(keepalive) + props.Len() + len(clientID) +
+			willProps.Len() + len(willTopic) + len(willFlag) +
 			len(usernameFlag) + len(passwordFlag)
 
 	pk.FixedHeader.Encode(buf)
@@ -144,7 +216,9 @@ func (pk *Packet) ConnectEncode(buf *bytes.Buffer) error {
 	buf.WriteByte(protoVersion)
 	buf.WriteByte(flag)
 	buf.Write(keepalive)
+	buf.Write(props.Bytes())
 	buf.Write(clientID)
+	buf.Write(willProps.Bytes())
 	buf.Write(willTopic)
 	buf.Write(willFlag)
 	buf.Write(usernameFlag)
@@ -187,6 +261,14 @@ func (pk *Packet) ConnectDecode(buf []byte) error {
 		return fmt.Errorf("%s: %w", err, ErrMalformedKeepalive)
 	}
 
+	// Get MQTT v5 properties.
+	if pk.ProtocolVersion == 5 {
+		offset, err = pk.Properties.Decode(Connect, buf, offset)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Get client ID.
 	pk.ClientIdentifier, offset, err = decodeString(buf, offset)
 	if err != nil {
@@ -195,6 +277,13 @@ func (pk *Packet) ConnectDecode(buf []byte) error {
 
 	// Get Last Will and Testament topic and message if applicable.
 	if pk.WillFlag {
+		if pk.ProtocolVersion == 5 {
+			offset, err = pk.WillProperties.Decode(WillProperties, buf, offset)
+			if err != nil {
+				return err
+			}
+		}
+
 		pk.WillTopic, offset, err = decodeString(buf, offset)
 		if err != nil {
 			return fmt.Errorf("%s: %w", err, ErrMalformedWillTopic)
@@ -236,7 +325,7 @@ func (pk *Packet) ConnectValidate() (b byte, err error) {
 
 	// End if protocol version is bad.
 	if (bytes.Compare(pk.ProtocolName, []byte{'M', 'Q', 'I', 's', 'd', 'p'}) == 0 && pk.ProtocolVersion != 3) ||
-		(bytes.Compare(pk.ProtocolName, []byte{'M', 'Q', 'T', 'T'}) == 0 && pk.ProtocolVersion != 4) {
+		(bytes.Compare(pk.ProtocolName, []byte{'M', 'Q', 'T', 'T'}) == 0 && pk.ProtocolVersion != 4 && pk.ProtocolVersion != 5) {
 		return CodeConnectBadProtocolVersion, ErrProtocolViolation
 	}
 
@@ -270,10 +359,16 @@ func (pk *Packet) ConnectValidate() (b byte, err error) {
 
 // ConnackEncode encodes a Connack packet.
 func (pk *Packet) ConnackEncode(buf *bytes.Buffer) error {
-	pk.FixedHeader.Remaining = 2
+	var props bytes.Buffer
+	if pk.ProtocolVersion == 5 {
+		pk.Properties.Encode(Connack, &props)
+	}
+
+	pk.FixedHeader.Remaining = 2 + props.Len()
 	pk.FixedHeader.Encode(buf)
 	buf.WriteByte(encodeBool(pk.SessionPresent))
 	buf.WriteByte(pk.ReturnCode)
+	buf.Write(props.Bytes())
 	return nil
 }
 
@@ -287,20 +382,50 @@ func (pk *Packet) ConnackDecode(buf []byte) error {
 		return fmt.Errorf("%s: %w", err, ErrMalformedSessionPresent)
 	}
 
-	pk.ReturnCode, _, err = decodeByte(buf, offset)
+	pk.ReturnCode, offset, err = decodeByte(buf, offset)
 	if err != nil {
 		return fmt.Errorf("%s: %w", err, ErrMalformedReturnCode)
 	}
 
+	if pk.ProtocolVersion == 5 && offset < len(buf) {
+		_, err = pk.Properties.Decode(Connack, buf, offset)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // DisconnectEncode encodes a Disconnect packet.
 func (pk *Packet) DisconnectEncode(buf *bytes.Buffer) error {
+	if pk.ProtocolVersion == 5 {
+		return pk.reasonEncode(Disconnect, nil, buf)
+	}
+
 	pk.FixedHeader.Encode(buf)
 	return nil
 }
 
+// DisconnectDecode decodes a Disconnect packet.
+func (pk *Packet) DisconnectDecode(buf []byte) error {
+	if pk.ProtocolVersion == 5 {
+		return pk.reasonDecode(Disconnect, buf, 0)
+	}
+
+	return nil
+}
+
+// AuthEncode encodes an Auth packet (mqtt v5).
+func (pk *Packet) AuthEncode(buf *bytes.Buffer) error {
+	return pk.reasonEncode(Auth, nil, buf)
+}
+
+// AuthDecode decodes an Auth packet (mqtt v5).
+func (pk *Packet) AuthDecode(buf []byte) error {
+	return pk.reasonDecode(Auth, buf, 0)
+}
+
 // PingreqEncode encodes a Pingreq packet.
 func (pk *Packet) PingreqEncode(buf *bytes.Buffer) error {
 	pk.FixedHeader.Encode(buf)
@@ -315,6 +440,10 @@ func (pk *Packet) PingrespEncode(buf *bytes.Buffer) error {
 
 // PubackEncode encodes a Puback packet.
 func (pk *Packet) PubackEncode(buf *bytes.Buffer) error {
+	if pk.ProtocolVersion == 5 {
+		return pk.reasonEncode(Puback, encodeUint16(pk.PacketID), buf)
+	}
+
 	pk.FixedHeader.Remaining = 2
 	pk.FixedHeader.Encode(buf)
 	buf.Write(encodeUint16(pk.PacketID))
@@ -323,16 +452,25 @@ func (pk *Packet) PubackEncode(buf *bytes.Buffer) error {
 
 // PubackDecode decodes a Puback packet.
 func (pk *Packet) PubackDecode(buf []byte) error {
+	var offset int
 	var err error
-	pk.PacketID, _, err = decodeUint16(buf, 0)
+	pk.PacketID, offset, err = decodeUint16(buf, 0)
 	if err != nil {
 		return fmt.Errorf("%s: %w", err, ErrMalformedPacketID)
 	}
+
+	if pk.ProtocolVersion == 5 {
+		return pk.reasonDecode(Puback, buf, offset)
+	}
 	return nil
 }
 
 // PubcompEncode encodes a Pubcomp packet.
 func (pk *Packet) PubcompEncode(buf *bytes.Buffer) error {
+	if pk.ProtocolVersion == 5 {
+		return pk.reasonEncode(Pubcomp, encodeUint16(pk.PacketID), buf)
+	}
+
 	pk.FixedHeader.Remaining = 2
 	pk.FixedHeader.Encode(buf)
 	buf.Write(encodeUint16(pk.PacketID))
@@ -341,11 +479,16 @@ func (pk *Packet) PubcompEncode(buf *bytes.Buffer) error {
 
 // PubcompDecode decodes a Pubcomp packet.
 func (pk *Packet) PubcompDecode(buf []byte) error {
+	var offset int
 	var err error
-	pk.PacketID, _, err = decodeUint16(buf, 0)
+	pk.PacketID, offset, err = decodeUint16(buf, 0)
 	if err != nil {
 		return fmt.Errorf("%s: %w", err, ErrMalformedPacketID)
 	}
+
+	if pk.ProtocolVersion == 5 {
+		return pk.reasonDecode(Pubcomp, buf, offset)
+	}
 	return nil
 }
 
@@ -366,10 +509,16 @@ func (pk *Packet) PublishEncode(buf *bytes.Buffer) error {
 		packetID = encodeUint16(pk.PacketID)
 	}
 
-	pk.FixedHeader.Remaining = len(topicName) + len(packetID) + len(pk.Payload)
+	var props bytes.Buffer
+	if pk.ProtocolVersion == 5 {
+		pk.Properties.Encode(Publish, &props)
+	}
+
+	pk.FixedHeader.Remaining = len(topicName) + len(packetID) + props.Len() + len(pk.Payload)
 	pk.FixedHeader.Encode(buf)
 	buf.Write(topicName)
 	buf.Write(packetID)
+	buf.Write(props.Bytes())
 	buf.Write(pk.Payload)
 
 	return nil
@@ -393,6 +542,13 @@ func (pk *Packet) PublishDecode(buf []byte) error {
 		}
 	}
 
+	if pk.ProtocolVersion == 5 {
+		offset, err = pk.Properties.Decode(Publish, buf, offset)
+		if err != nil {
+			return err
+		}
+	}
+
 	pk.Payload = buf[offset:]
 
 	return nil
@@ -407,11 +563,20 @@ func (pk *Packet) PublishCopy() Packet {
 			Type:   Publish,
 			Retain: pk.FixedHeader.Retain,
 		},
-		TopicName: pk.TopicName,
-		Payload:   pk.Payload,
+		Properties: pk.Properties.publishCopy(),
+		TopicName:  pk.TopicName,
+		Payload:    pk.Payload,
+		Created:    pk.Created,
 	}
 }
 
+// Expired returns true if the message has a message expiry interval which
+// lapsed before the given unix time.
+func (pk *Packet) Expired(now int64) bool {
+	return pk.Properties.MessageExpiryInterval > 0 && pk.Created > 0 &&
+		pk.Created+int64(pk.Properties.MessageExpiryInterval) < now
+}
+
 // PublishValidate validates a publish packet.
 func (pk *Packet) PublishValidate() (byte, error) {
 
@@ -432,6 +597,10 @@ func (pk *Packet) PublishValidate() (byte, error) {
 
 // PubrecEncode encodes a Pubrec packet.
 func (pk *Packet) PubrecEncode(buf *bytes.Buffer) error {
+	if pk.ProtocolVersion == 5 {
+		return pk.reasonEncode(Pubrec, encodeUint16(pk.PacketID), buf)
+	}
+
 	pk.FixedHeader.Remaining = 2
 	pk.FixedHeader.Encode(buf)
 	buf.Write(encodeUint16(pk.PacketID))
@@ -440,17 +609,26 @@ func (pk *Packet) PubrecEncode(buf *bytes.Buffer) error {
 
 // PubrecDecode decodes a Pubrec packet.
 func (pk *Packet) PubrecDecode(buf []byte) error {
+	var offset int
 	var err error
-	pk.PacketID, _, err = decodeUint16(buf, 0)
+	pk.PacketID, offset, err = decodeUint16(buf, 0)
 	if err != nil {
 		return fmt.Errorf("%s: %w", err, ErrMalformedPacketID)
 	}
 
+	if pk.ProtocolVersion == 5 {
+		return pk.reasonDecode(Pubrec, buf, offset)
+	}
+
 	return nil
 }
 
 // PubrelEncode encodes a Pubrel packet.
 func (pk *Packet) PubrelEncode(buf *bytes.Buffer) error {
+	if pk.ProtocolVersion == 5 {
+		return pk.reasonEncode(Pubrel, encodeUint16(pk.PacketID), buf)
+	}
+
 	pk.FixedHeader.Remaining = 2
 	pk.FixedHeader.Encode(buf)
 	buf.Write(encodeUint16(pk.PacketID))
@@ -459,21 +637,33 @@ func (pk *Packet) PubrelEncode(buf *bytes.Buffer) error {
 
 // PubrelDecode decodes a Pubrel packet.
 func (pk *Packet) PubrelDecode(buf []byte) error {
+	var offset int
 	var err error
-	pk.PacketID, _, err = decodeUint16(buf, 0)
+	pk.PacketID, offset, err = decodeUint16(buf, 0)
 	if err != nil {
 		return fmt.Errorf("%s: %w", err, ErrMalformedPacketID)
 	}
+
+	if pk.ProtocolVersion == 5 {
+		return pk.reasonDecode(Pubrel, buf, offset)
+	}
 	return nil
 }
 
 // SubackEncode encodes a Suback packet.
 func (pk *Packet) SubackEncode(buf *bytes.Buffer) error {
 	packetID := encodeUint16(pk.PacketID)
-	pk.FixedHeader.Remaining = len(packetID) + len(pk.ReturnCodes) // Set length.
+
+	var props bytes.Buffer
+	if pk.ProtocolVersion == 5 {
+		pk.Properties.Encode(Suback, &props)
+	}
+
+	pk.FixedHeader.Remaining = len(packetID) + props.Len() + len(pk.ReturnCodes) // Set length.
 	pk.FixedHeader.Encode(buf)
 
 	buf.Write(packetID)       // Encode Packet ID.
+	buf.Write(props.Bytes())  // Encode MQTT v5 properties.
 	buf.Write(pk.ReturnCodes) // Encode granted QOS flags.
 
 	return nil
@@ -490,6 +680,13 @@ func (pk *Packet) SubackDecode(buf []byte) error {
 		return fmt.Errorf("%s: %w", err, ErrMalformedPacketID)
 	}
 
+	if pk.ProtocolVersion == 5 {
+		offset, err = pk.Properties.Decode(Suback, buf, offset)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Get Granted QOS flags.
 	pk.ReturnCodes = buf[offset:]
 
@@ -507,20 +704,30 @@ func (pk *Packet) SubscribeEncode(buf *bytes.Buffer) error {
 
 	packetID := encodeUint16(pk.PacketID)
 
+	var props bytes.Buffer
+	if pk.ProtocolVersion == 5 {
+		pk.Properties.Encode(Subscribe, &props)
+	}
+
 	// Count topics lengths and associated QOS flags.
 	var topicsLen int
 	for _, topic := range pk.Topics {
 		topicsLen += len(encodeString(topic)) + 1
 	}
 
-	pk.FixedHeader.Remaining = len(packetID) + topicsLen
+	pk.FixedHeader.Remaining = len(packetID) + props.Len() + topicsLen
 	pk.FixedHeader.Encode(buf)
 	buf.Write(packetID)
+	buf.Write(props.Bytes())
 
 	// Add all provided topic names and associated QOS flags.
 	for i, topic := range pk.Topics {
 		buf.Write(encodeString(topic))
-		buf.WriteByte(pk.Qoss[i])
+		if pk.ProtocolVersion == 5 && i < len(pk.SubOptions) {
+			buf.WriteByte(pk.Qoss[i] | pk.SubOptions[i].encode())
+		} else {
+			buf.WriteByte(pk.Qoss[i])
+		}
 	}
 
 	return nil
@@ -537,6 +744,13 @@ func (pk *Packet) SubscribeDecode(buf []byte) error {
 		return fmt.Errorf("%s: %w", err, ErrMalformedPacketID)
 	}
 
+	if pk.ProtocolVersion == 5 {
+		offset, err = pk.Properties.Decode(Subscribe, buf, offset)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Keep decoding until there's no space left.
 	for offset < len(buf) {
 
@@ -555,9 +769,29 @@ func (pk *Packet) SubscribeDecode(buf []byte) error {
 			return fmt.Errorf("%s: %w", err, ErrMalformedQoS)
 		}
 
-		// Ensure QoS byte is within range.
-		if !(qos >= 0 && qos <= 2) {
-			//if !validateQoS(qos) {
+		// MQTT v5 subscription options share the byte with the QoS flag, and
+		// the upper two bits are reserved.
+		if pk.ProtocolVersion == 5 {
+			if qos&0xC0 > 0 {
+				return ErrMalformedQoS
+			}
+
+			opts := SubOptions{
+				RetainAsPublished: qos&(1<<3) > 0,
+				RetainHandling:    qos >> 4 & 0x03,
+			}
+			if opts.RetainHandling > RetainDoNotSend {
+				return ErrMalformedSubOptions
+			}
+
+			pk.SubOptions = append(pk.SubOptions, opts)
+			qos &= 0x03
+		}
+
+		// A QoS out of range makes an MQTT v5 packet malformed. Earlier versions
+		// keep decoding, so that the server can refuse just that filter in the
+		// SUBACK, and the other filters of the packet are still processed.
+		if qos > 2 && pk.ProtocolVersion == 5 {
 			return ErrMalformedQoS
 		}
 
@@ -580,6 +814,17 @@ func (pk *Packet) SubscribeValidate() (byte, error) {
 
 // UnsubackEncode encodes an Unsuback packet.
 func (pk *Packet) UnsubackEncode(buf *bytes.Buffer) error {
+	if pk.ProtocolVersion == 5 {
+		var props bytes.Buffer
+		pk.Properties.Encode(Unsuback, &props)
+		pk.FixedHeader.Remaining = 2 + props.Len() + len(pk.ReturnCodes)
+		pk.FixedHeader.Encode(buf)
+		buf.Write(encodeUint16(pk.PacketID))
+		buf.Write(props.Bytes())
+		buf.Write(pk.ReturnCodes) // Encode reason codes.
+		return nil
+	}
+
 	pk.FixedHeader.Remaining = 2
 	pk.FixedHeader.Encode(buf)
 	buf.Write(encodeUint16(pk.PacketID))
@@ -588,11 +833,20 @@ func (pk *Packet) UnsubackEncode(buf *bytes.Buffer) error {
 
 // UnsubackDecode decodes an Unsuback packet.
 func (pk *Packet) UnsubackDecode(buf []byte) error {
+	var offset int
 	var err error
-	pk.PacketID, _, err = decodeUint16(buf, 0)
+	pk.PacketID, offset, err = decodeUint16(buf, 0)
 	if err != nil {
 		return fmt.Errorf("%s: %w", err, ErrMalformedPacketID)
 	}
+
+	if pk.ProtocolVersion == 5 {
+		offset, err = pk.Properties.Decode(Unsuback, buf, offset)
+		if err != nil {
+			return err
+		}
+		pk.ReturnCodes = buf[offset:]
+	}
 	return nil
 }
 
@@ -607,15 +861,21 @@ func (pk *Packet) UnsubscribeEncode(buf *bytes.Buffer) error {
 
 	packetID := encodeUint16(pk.PacketID)
 
+	var props bytes.Buffer
+	if pk.ProtocolVersion == 5 {
+		pk.Properties.Encode(Unsubscribe, &props)
+	}
+
 	// Count topics lengths.
 	var topicsLen int
 	for _, topic := range pk.Topics {
 		topicsLen += len(encodeString(topic))
 	}
 
-	pk.FixedHeader.Remaining = len(packetID) + topicsLen
+	pk.FixedHeader.Remaining = len(packetID) + props.Len() + topicsLen
 	pk.FixedHeader.Encode(buf)
 	buf.Write(packetID)
+	buf.Write(props.Bytes())
 
 	// Add all provided topic names.
 	for _, topic := range pk.Topics {
@@ -636,6 +896,13 @@ func (pk *Packet) UnsubscribeDecode(buf []byte) error {
 		return fmt.Errorf("%s: %w", err, ErrMalformedPacketID)
 	}
 
+	if pk.ProtocolVersion == 5 {
+		offset, err = pk.Properties.Decode(Unsubscribe, buf, offset)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Keep decoding until there's no space left.
 	for offset < len(buf) {
 		var t string
@@ -664,6 +931,47 @@ func (pk *Packet) UnsubscribeValidate() (byte, error) {
 	return Accepted, nil
 }
 
+// reasonEncode encodes an MQTT v5 packet consisting of an optional prefix, such as a
+// packet id, followed by a reason code and properties. The reason code and
+// properties are omitted if the reason code is success and there are no properties.
+func (pk *Packet) reasonEncode(pkt byte, prefix []byte, buf *bytes.Buffer) error {
+	var props bytes.Buffer
+	pk.Properties.Encode(pkt, &props)
+
+	var reason []byte
+	if pk.ReturnCode != Accepted || props.Len() > 1 {
+		reason = append([]byte{pk.ReturnCode}, props.Bytes()...)
+	}
+
+	pk.FixedHeader.Remaining = len(prefix) + len(reason)
+	pk.FixedHeader.Encode(buf)
+	buf.Write(prefix)
+	buf.Write(reason)
+	return nil
+}
+
+// reasonDecode decodes the optional reason code and properties of an MQTT v5 packet.
+func (pk *Packet) reasonDecode(pkt byte, buf []byte, offset int) error {
+	var err error
+	if offset >= len(buf) {
+		return nil
+	}
+
+	pk.ReturnCode, offset, err = decodeByte(buf, offset)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrMalformedReturnCode)
+	}
+
+	if offset < len(buf) {
+		_, err = pk.Properties.Decode(pkt, buf, offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // FormatID returns the PacketID field as a decimal integer.
 func (pk *Packet) FormatID() string {
 	return strconv.FormatUint(uint64(pk.PacketID), 10)
@@ -1145,9 +1145,10 @@ var expectedPackets = map[byte][]packetTestData{
 			},
 		},
 		{
-			desc:      "Malformed Subscribe - qos out of range",
-			group:     "decode",
-			failFirst: ErrMalformedQoS,
+			// An out of range QoS is decoded, so the server can refuse the filter
+			// in the SUBACK without dropping the other filters in the packet.
+			desc:  "Subscribe - qos out of range",
+			group: "decode",
 			rawBytes: []byte{
 				byte(Subscribe << 4), 2, // Fixed header
 				0, 22, // Packet ID - LSB+MSB
@@ -1157,6 +1158,11 @@ var expectedPackets = map[byte][]packetTestData{
 				5, // QoS
 
 			},
+			packet: &Packet{
+				PacketID: 22,
+				Topics:   []string{"c/d"},
+				Qoss:     []byte{5},
+			},
 		},
 
 		// Validation
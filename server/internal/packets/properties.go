@@ -0,0 +1,394 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// All of the valid MQTT v5 property identifiers.
+const (
+	PropPayloadFormat          byte = 0x01
+	PropMessageExpiryInterval  byte = 0x02
+	PropContentType            byte = 0x03
+	PropResponseTopic          byte = 0x08
+	PropCorrelationData        byte = 0x09
+	PropSubscriptionIdentifier byte = 0x0B
+	PropSessionExpiryInterval  byte = 0x11
+	PropAssignedClientID       byte = 0x12
+	PropServerKeepAlive        byte = 0x13
+	PropAuthenticationMethod   byte = 0x15
+	PropAuthenticationData     byte = 0x16
+	PropRequestProblemInfo     byte = 0x17
+	PropWillDelayInterval      byte = 0x18
+	PropRequestResponseInfo    byte = 0x19
+	PropResponseInfo           byte = 0x1A
+	PropServerReference        byte = 0x1C
+	PropReasonString           byte = 0x1F
+	PropReceiveMaximum         byte = 0x21
+	PropTopicAliasMaximum      byte = 0x22
+	PropTopicAlias             byte = 0x23
+	PropMaximumQos             byte = 0x24
+	PropRetainAvailable        byte = 0x25
+	PropUser                   byte = 0x26
+	PropMaximumPacketSize      byte = 0x27
+	PropWildcardSubAvailable   byte = 0x28
+	PropSubIDAvailable         byte = 0x29
+	PropSharedSubAvailable     byte = 0x2A
+
+	// WillProperties is a pseudo packet type used to encode and decode the
+	// will properties of a connect packet.
+	WillProperties byte = 0xFF
+)
+
+// validPacketProperties indicates the packet types which may carry each property.
+var validPacketProperties = map[byte]map[byte]bool{
+	PropPayloadFormat:          {Publish: true, WillProperties: true},
+	PropMessageExpiryInterval:  {Publish: true, WillProperties: true},
+	PropContentType:            {Publish: true, WillProperties: true},
+	PropResponseTopic:          {Publish: true, WillProperties: true},
+	PropCorrelationData:        {Publish: true, WillProperties: true},
+	PropSubscriptionIdentifier: {Publish: true, Subscribe: true},
+	PropSessionExpiryInterval:  {Connect: true, Connack: true, Disconnect: true},
+	PropAssignedClientID:       {Connack: true},
+	PropServerKeepAlive:        {Connack: true},
+	PropAuthenticationMethod:   {Connect: true, Connack: true, Auth: true},
+	PropAuthenticationData:     {Connect: true, Connack: true, Auth: true},
+	PropRequestProblemInfo:     {Connect: true},
+	PropWillDelayInterval:      {WillProperties: true},
+	PropRequestResponseInfo:    {Connect: true},
+	PropResponseInfo:           {Connack: true},
+	PropServerReference:        {Connack: true, Disconnect: true},
+	PropReasonString:           {Connack: true, Puback: true, Pubrec: true, Pubrel: true, Pubcomp: true, Suback: true, Unsuback: true, Disconnect: true, Auth: true},
+	PropReceiveMaximum:         {Connect: true, Connack: true},
+	PropTopicAliasMaximum:      {Connect: true, Connack: true},
+	PropTopicAlias:             {Publish: true},
+	PropMaximumQos:             {Connack: true},
+	PropRetainAvailable:        {Connack: true},
+	PropUser:                   {Connect: true, Connack: true, Publish: true, Puback: true, Pubrec: true, Pubrel: true, Pubcomp: true, Subscribe: true, Suback: true, Unsubscribe: true, Unsuback: true, Disconnect: true, Auth: true, WillProperties: true},
+	PropMaximumPacketSize:      {Connect: true, Connack: true},
+	PropWildcardSubAvailable:   {Connack: true},
+	PropSubIDAvailable:         {Connack: true},
+	PropSharedSubAvailable:     {Connack: true},
+}
+
+// UserProperty is an arbitrary key-value pair carried by an MQTT v5 packet.
+type UserProperty struct {
+	Key string
+	Val string
+}
+
+// Properties contains the MQTT v5 properties of a packet. Properties which are
+// only meaningful when present are accompanied by a Flag field indicating that
+// the property was set.
+type Properties struct {
+	CorrelationData           []byte
+	AuthenticationData        []byte
+	SubscriptionIdentifier    []int
+	User                      []UserProperty
+	ContentType               string
+	ResponseTopic             string
+	AssignedClientID          string
+	AuthenticationMethod      string
+	ResponseInfo              string
+	ServerReference           string
+	ReasonString              string
+	MessageExpiryInterval     uint32
+	SessionExpiryInterval     uint32
+	WillDelayInterval         uint32
+	MaximumPacketSize         uint32
+	ServerKeepAlive           uint16
+	ReceiveMaximum            uint16
+	TopicAliasMaximum         uint16
+	TopicAlias                uint16
+	PayloadFormat             byte
+	RequestProblemInfo        byte
+	RequestResponseInfo       byte
+	MaximumQos                byte
+	RetainAvailable           byte
+	WildcardSubAvailable      byte
+	SubIDAvailable            byte
+	SharedSubAvailable        byte
+	PayloadFormatFlag         bool
+	ServerKeepAliveFlag       bool
+	RequestProblemInfoFlag    bool
+	MaximumQosFlag            bool
+	RetainAvailableFlag       bool
+	WildcardSubAvailableFlag  bool
+	SubIDAvailableFlag        bool
+	SharedSubAvailableFlag    bool
+	SessionExpiryIntervalFlag bool
+}
+
+// Encode encodes the properties which are valid for a packet type to the
+// buffer, prefixed with the variable byte integer properties length.
+func (p *Properties) Encode(pkt byte, buf *bytes.Buffer) {
+	var b bytes.Buffer
+	valid := func(id byte) bool {
+		return validPacketProperties[id][pkt]
+	}
+
+	if p.PayloadFormatFlag && valid(PropPayloadFormat) {
+		b.WriteByte(PropPayloadFormat)
+		b.WriteByte(p.PayloadFormat)
+	}
+
+	if p.MessageExpiryInterval > 0 && valid(PropMessageExpiryInterval) {
+		b.WriteByte(PropMessageExpiryInterval)
+		b.Write(encodeUint32(p.MessageExpiryInterval))
+	}
+
+	if p.ContentType != "" && valid(PropContentType) {
+		b.WriteByte(PropContentType)
+		b.Write(encodeString(p.ContentType))
+	}
+
+	if p.ResponseTopic != "" && valid(PropResponseTopic) {
+		b.WriteByte(PropResponseTopic)
+		b.Write(encodeString(p.ResponseTopic))
+	}
+
+	if len(p.CorrelationData) > 0 && valid(PropCorrelationData) {
+		b.WriteByte(PropCorrelationData)
+		b.Write(encodeBytes(p.CorrelationData))
+	}
+
+	if valid(PropSubscriptionIdentifier) {
+		for _, id := range p.SubscriptionIdentifier {
+			if id > 0 {
+				b.WriteByte(PropSubscriptionIdentifier)
+				encodeLength(&b, int64(id))
+			}
+		}
+	}
+
+	if (p.SessionExpiryInterval > 0 || p.SessionExpiryIntervalFlag) && valid(PropSessionExpiryInterval) {
+		b.WriteByte(PropSessionExpiryInterval)
+		b.Write(encodeUint32(p.SessionExpiryInterval))
+	}
+
+	if p.AssignedClientID != "" && valid(PropAssignedClientID) {
+		b.WriteByte(PropAssignedClientID)
+		b.Write(encodeString(p.AssignedClientID))
+	}
+
+	if p.ServerKeepAliveFlag && valid(PropServerKeepAlive) {
+		b.WriteByte(PropServerKeepAlive)
+		b.Write(encodeUint16(p.ServerKeepAlive))
+	}
+
+	if p.AuthenticationMethod != "" && valid(PropAuthenticationMethod) {
+		b.WriteByte(PropAuthenticationMethod)
+		b.Write(encodeString(p.AuthenticationMethod))
+	}
+
+	if len(p.AuthenticationData) > 0 && valid(PropAuthenticationData) {
+		b.WriteByte(PropAuthenticationData)
+		b.Write(encodeBytes(p.AuthenticationData))
+	}
+
+	if p.RequestProblemInfoFlag && valid(PropRequestProblemInfo) {
+		b.WriteByte(PropRequestProblemInfo)
+		b.WriteByte(p.RequestProblemInfo)
+	}
+
+	if p.WillDelayInterval > 0 && valid(PropWillDelayInterval) {
+		b.WriteByte(PropWillDelayInterval)
+		b.Write(encodeUint32(p.WillDelayInterval))
+	}
+
+	if p.RequestResponseInfo > 0 && valid(PropRequestResponseInfo) {
+		b.WriteByte(PropRequestResponseInfo)
+		b.WriteByte(p.RequestResponseInfo)
+	}
+
+	if p.ResponseInfo != "" && valid(PropResponseInfo) {
+		b.WriteByte(PropResponseInfo)
+		b.Write(encodeString(p.ResponseInfo))
+	}
+
+	if p.ServerReference != "" && valid(PropServerReference) {
+		b.WriteByte(PropServerReference)
+		b.Write(encodeString(p.ServerReference))
+	}
+
+	if p.ReasonString != "" && valid(PropReasonString) {
+		b.WriteByte(PropReasonString)
+		b.Write(encodeString(p.ReasonString))
+	}
+
+	if p.ReceiveMaximum > 0 && valid(PropReceiveMaximum) {
+		b.WriteByte(PropReceiveMaximum)
+		b.Write(encodeUint16(p.ReceiveMaximum))
+	}
+
+	if p.TopicAliasMaximum > 0 && valid(PropTopicAliasMaximum) {
+		b.WriteByte(PropTopicAliasMaximum)
+		b.Write(encodeUint16(p.TopicAliasMaximum))
+	}
+
+	if p.TopicAlias > 0 && valid(PropTopicAlias) {
+		b.WriteByte(PropTopicAlias)
+		b.Write(encodeUint16(p.TopicAlias))
+	}
+
+	if p.MaximumQosFlag && valid(PropMaximumQos) {
+		b.WriteByte(PropMaximumQos)
+		b.WriteByte(p.MaximumQos)
+	}
+
+	if p.RetainAvailableFlag && valid(PropRetainAvailable) {
+		b.WriteByte(PropRetainAvailable)
+		b.WriteByte(p.RetainAvailable)
+	}
+
+	if valid(PropUser) {
+		for _, u := range p.User {
+			b.WriteByte(PropUser)
+			b.Write(encodeString(u.Key))
+			b.Write(encodeString(u.Val))
+		}
+	}
+
+	if p.MaximumPacketSize > 0 && valid(PropMaximumPacketSize) {
+		b.WriteByte(PropMaximumPacketSize)
+		b.Write(encodeUint32(p.MaximumPacketSize))
+	}
+
+	if p.WildcardSubAvailableFlag && valid(PropWildcardSubAvailable) {
+		b.WriteByte(PropWildcardSubAvailable)
+		b.WriteByte(p.WildcardSubAvailable)
+	}
+
+	if p.SubIDAvailableFlag && valid(PropSubIDAvailable) {
+		b.WriteByte(PropSubIDAvailable)
+		b.WriteByte(p.SubIDAvailable)
+	}
+
+	if p.SharedSubAvailableFlag && valid(PropSharedSubAvailable) {
+		b.WriteByte(PropSharedSubAvailable)
+		b.WriteByte(p.SharedSubAvailable)
+	}
+
+	encodeLength(buf, int64(b.Len()))
+	buf.Write(b.Bytes())
+}
+
+// Decode decodes the properties of a packet type from the buffer, beginning at
+// the properties length, and returns the offset of the first byte after them.
+func (p *Properties) Decode(pkt byte, buf []byte, offset int) (int, error) {
+	length, offset, err := decodeLength(buf, offset)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", err, ErrMalformedProperties)
+	}
+
+	end := offset + length
+	if end > len(buf) {
+		return 0, fmt.Errorf("%s: %w", ErrOffsetBytesOutOfRange, ErrMalformedProperties)
+	}
+
+	b := buf[:end]
+	for offset < end {
+		var id byte
+		id, offset, err = decodeByte(b, offset)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", err, ErrMalformedProperties)
+		}
+
+		if !validPacketProperties[id][pkt] {
+			return 0, fmt.Errorf("property 0x%02x: %w", id, ErrInvalidProperty)
+		}
+
+		switch id {
+		case PropPayloadFormat:
+			p.PayloadFormat, offset, err = decodeByte(b, offset)
+			p.PayloadFormatFlag = true
+		case PropMessageExpiryInterval:
+			p.MessageExpiryInterval, offset, err = decodeUint32(b, offset)
+		case PropContentType:
+			p.ContentType, offset, err = decodeString(b, offset)
+		case PropResponseTopic:
+			p.ResponseTopic, offset, err = decodeString(b, offset)
+		case PropCorrelationData:
+			p.CorrelationData, offset, err = decodeBytes(b, offset)
+		case PropSubscriptionIdentifier:
+			var sid int
+			sid, offset, err = decodeLength(b, offset)
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, sid)
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval, offset, err = decodeUint32(b, offset)
+			p.SessionExpiryIntervalFlag = true
+		case PropAssignedClientID:
+			p.AssignedClientID, offset, err = decodeString(b, offset)
+		case PropServerKeepAlive:
+			p.ServerKeepAlive, offset, err = decodeUint16(b, offset)
+			p.ServerKeepAliveFlag = true
+		case PropAuthenticationMethod:
+			p.AuthenticationMethod, offset, err = decodeString(b, offset)
+		case PropAuthenticationData:
+			p.AuthenticationData, offset, err = decodeBytes(b, offset)
+		case PropRequestProblemInfo:
+			p.RequestProblemInfo, offset, err = decodeByte(b, offset)
+			p.RequestProblemInfoFlag = true
+		case PropWillDelayInterval:
+			p.WillDelayInterval, offset, err = decodeUint32(b, offset)
+		case PropRequestResponseInfo:
+			p.RequestResponseInfo, offset, err = decodeByte(b, offset)
+		case PropResponseInfo:
+			p.ResponseInfo, offset, err = decodeString(b, offset)
+		case PropServerReference:
+			p.ServerReference, offset, err = decodeString(b, offset)
+		case PropReasonString:
+			p.ReasonString, offset, err = decodeString(b, offset)
+		case PropReceiveMaximum:
+			p.ReceiveMaximum, offset, err = decodeUint16(b, offset)
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum, offset, err = decodeUint16(b, offset)
+		case PropTopicAlias:
+			p.TopicAlias, offset, err = decodeUint16(b, offset)
+		case PropMaximumQos:
+			p.MaximumQos, offset, err = decodeByte(b, offset)
+			p.MaximumQosFlag = true
+		case PropRetainAvailable:
+			p.RetainAvailable, offset, err = decodeByte(b, offset)
+			p.RetainAvailableFlag = true
+		case PropUser:
+			var u UserProperty
+			u.Key, offset, err = decodeString(b, offset)
+			if err == nil {
+				u.Val, offset, err = decodeString(b, offset)
+			}
+			p.User = append(p.User, u)
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize, offset, err = decodeUint32(b, offset)
+		case PropWildcardSubAvailable:
+			p.WildcardSubAvailable, offset, err = decodeByte(b, offset)
+			p.WildcardSubAvailableFlag = true
+		case PropSubIDAvailable:
+			p.SubIDAvailable, offset, err = decodeByte(b, offset)
+			p.SubIDAvailableFlag = true
+		case PropSharedSubAvailable:
+			p.SharedSubAvailable, offset, err = decodeByte(b, offset)
+			p.SharedSubAvailableFlag = true
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("property 0x%02x: %s: %w", id, err, ErrMalformedProperties)
+		}
+	}
+
+	return end, nil
+}
+
+// publishCopy returns a copy of the properties which are forwarded with a
+// publish packet from the sender to its subscribers.
+func (p *Properties) publishCopy() Properties {
+	return Properties{
+		PayloadFormat:         p.PayloadFormat,
+		PayloadFormatFlag:     p.PayloadFormatFlag,
+		MessageExpiryInterval: p.MessageExpiryInterval,
+		ContentType:           p.ContentType,
+		ResponseTopic:         p.ResponseTopic,
+		CorrelationData:       p.CorrelationData,
+		User:                  p.User,
+	}
+}
@@ -0,0 +1,370 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPropertiesEncodeDecode(t *testing.T) {
+	props := Properties{
+		PayloadFormat:         1,
+		PayloadFormatFlag:     true,
+		MessageExpiryInterval: 120,
+		ContentType:           "text/plain",
+		ResponseTopic:         "a/b/reply",
+		CorrelationData:       []byte("corr"),
+		SubscriptionIdentifier: []int{
+			1, 200,
+		},
+		TopicAlias: 3,
+		User: []UserProperty{
+			{Key: "k", Val: "v"},
+			{Key: "k", Val: "w"},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	props.Encode(Publish, buf)
+
+	var decoded Properties
+	offset, err := decoded.Decode(Publish, buf.Bytes(), 0)
+	require.NoError(t, err)
+	require.Equal(t, buf.Len(), offset)
+	require.Equal(t, props, decoded)
+}
+
+func TestPropertiesEncodeInvalidForPacket(t *testing.T) {
+	props := Properties{
+		MessageExpiryInterval: 120,
+		SessionExpiryInterval: 30,
+		ReasonString:          "reason",
+	}
+
+	buf := new(bytes.Buffer)
+	props.Encode(Connect, buf)
+	require.Equal(t, []byte{5, PropSessionExpiryInterval, 0, 0, 0, 30}, buf.Bytes())
+
+	buf.Reset()
+	new(Properties).Encode(Publish, buf)
+	require.Equal(t, []byte{0}, buf.Bytes())
+}
+
+func TestPropertiesDecodeInvalidForPacket(t *testing.T) {
+	var props Properties
+	_, err := props.Decode(Connect, []byte{5, PropMessageExpiryInterval, 0, 0, 0, 30}, 0)
+	require.ErrorIs(t, err, ErrInvalidProperty)
+}
+
+func TestPropertiesDecodeMalformed(t *testing.T) {
+	var props Properties
+	_, err := props.Decode(Publish, []byte{5, PropMessageExpiryInterval, 0, 0}, 0)
+	require.ErrorIs(t, err, ErrMalformedProperties)
+
+	_, err = props.Decode(Publish, []byte{3, PropMessageExpiryInterval, 0, 0}, 0)
+	require.ErrorIs(t, err, ErrMalformedProperties)
+
+	_, err = props.Decode(Publish, []byte{0x80}, 0)
+	require.ErrorIs(t, err, ErrMalformedProperties)
+}
+
+func TestConnectV5(t *testing.T) {
+	pk := Packet{
+		FixedHeader:      FixedHeader{Type: Connect},
+		ProtocolName:     []byte("MQTT"),
+		ProtocolVersion:  5,
+		CleanSession:     true,
+		Keepalive:        30,
+		ClientIdentifier: "zen",
+		WillFlag:         true,
+		WillTopic:        "lwt",
+		WillMessage:      []byte("gone"),
+		Properties: Properties{
+			SessionExpiryInterval: 60,
+			ReceiveMaximum:        10,
+		},
+		WillProperties: Properties{
+			WillDelayInterval: 5,
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.ConnectEncode(buf))
+
+	out := Packet{FixedHeader: FixedHeader{Type: Connect}}
+	require.NoError(t, out.ConnectDecode(buf.Bytes()[2:]))
+	require.Equal(t, byte(5), out.ProtocolVersion)
+	require.Equal(t, "zen", out.ClientIdentifier)
+	require.Equal(t, uint32(60), out.Properties.SessionExpiryInterval)
+	require.Equal(t, uint16(10), out.Properties.ReceiveMaximum)
+	require.Equal(t, uint32(5), out.WillProperties.WillDelayInterval)
+	require.Equal(t, "lwt", out.WillTopic)
+	require.Equal(t, []byte("gone"), out.WillMessage)
+
+	code, err := out.ConnectValidate()
+	require.NoError(t, err)
+	require.Equal(t, Accepted, code)
+}
+
+func TestPublishV5(t *testing.T) {
+	pk := Packet{
+		FixedHeader:     FixedHeader{Type: Publish, Qos: 1},
+		ProtocolVersion: 5,
+		TopicName:       "a/b/c",
+		PacketID:        7,
+		Payload:         []byte("hello"),
+		Properties: Properties{
+			MessageExpiryInterval: 30,
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.PublishEncode(buf))
+	require.Equal(t, []byte{
+		byte(Publish<<4 | 2), 20,
+		0, 5, 'a', '/', 'b', '/', 'c',
+		0, 7,
+		5, PropMessageExpiryInterval, 0, 0, 0, 30,
+		'h', 'e', 'l', 'l', 'o',
+	}, buf.Bytes())
+
+	out := Packet{FixedHeader: FixedHeader{Type: Publish, Qos: 1}, ProtocolVersion: 5}
+	require.NoError(t, out.PublishDecode(buf.Bytes()[2:]))
+	require.Equal(t, uint32(30), out.Properties.MessageExpiryInterval)
+	require.Equal(t, []byte("hello"), out.Payload)
+}
+
+func TestPublishCopyProperties(t *testing.T) {
+	pk := Packet{
+		FixedHeader: FixedHeader{Type: Publish},
+		Properties: Properties{
+			MessageExpiryInterval:  30,
+			ContentType:            "text/plain",
+			TopicAlias:             4,
+			SubscriptionIdentifier: []int{2},
+		},
+		Created: 100,
+	}
+
+	copied := pk.PublishCopy()
+	require.Equal(t, uint32(30), copied.Properties.MessageExpiryInterval)
+	require.Equal(t, "text/plain", copied.Properties.ContentType)
+	require.Equal(t, uint16(0), copied.Properties.TopicAlias)
+	require.Empty(t, copied.Properties.SubscriptionIdentifier)
+	require.Equal(t, int64(100), copied.Created)
+}
+
+func TestPacketExpired(t *testing.T) {
+	pk := Packet{Created: 100}
+	require.False(t, pk.Expired(1000))
+
+	pk.Properties.MessageExpiryInterval = 10
+	require.False(t, pk.Expired(110))
+	require.True(t, pk.Expired(111))
+
+	pk.Created = 0
+	require.False(t, pk.Expired(1000))
+}
+
+func TestAcksV5(t *testing.T) {
+	for _, typ := range []byte{Puback, Pubrec, Pubrel, Pubcomp} {
+		pk := Packet{FixedHeader: FixedHeader{Type: typ}, ProtocolVersion: 5, PacketID: 9}
+		buf := new(bytes.Buffer)
+
+		var err error
+		switch typ {
+		case Puback:
+			err = pk.PubackEncode(buf)
+		case Pubrec:
+			err = pk.PubrecEncode(buf)
+		case Pubrel:
+			err = pk.PubrelEncode(buf)
+		case Pubcomp:
+			err = pk.PubcompEncode(buf)
+		}
+		require.NoError(t, err)
+		require.Equal(t, []byte{0, 9}, buf.Bytes()[2:], "success acks omit the reason code")
+	}
+
+	pk := Packet{
+		FixedHeader:     FixedHeader{Type: Puback},
+		ProtocolVersion: 5,
+		PacketID:        9,
+		ReturnCode:      0x10,
+		Properties:      Properties{ReasonString: "x"},
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.PubackEncode(buf))
+	require.Equal(t, []byte{byte(Puback << 4), 8, 0, 9, 0x10, 4, PropReasonString, 0, 1, 'x'}, buf.Bytes())
+
+	out := Packet{FixedHeader: FixedHeader{Type: Puback}, ProtocolVersion: 5}
+	require.NoError(t, out.PubackDecode(buf.Bytes()[2:]))
+	require.Equal(t, uint16(9), out.PacketID)
+	require.Equal(t, byte(0x10), out.ReturnCode)
+	require.Equal(t, "x", out.Properties.ReasonString)
+}
+
+func TestConnackV5(t *testing.T) {
+	pk := Packet{
+		FixedHeader:     FixedHeader{Type: Connack},
+		ProtocolVersion: 5,
+		SessionPresent:  true,
+		Properties: Properties{
+			AssignedClientID: "id",
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.ConnackEncode(buf))
+	require.Equal(t, []byte{byte(Connack << 4), 8, 1, 0, 5, PropAssignedClientID, 0, 2, 'i', 'd'}, buf.Bytes())
+
+	out := Packet{FixedHeader: FixedHeader{Type: Connack}, ProtocolVersion: 5}
+	require.NoError(t, out.ConnackDecode(buf.Bytes()[2:]))
+	require.True(t, out.SessionPresent)
+	require.Equal(t, "id", out.Properties.AssignedClientID)
+}
+
+func TestSubscribeV5(t *testing.T) {
+	pk := Packet{
+		FixedHeader:     FixedHeader{Type: Subscribe, Qos: 1},
+		ProtocolVersion: 5,
+		PacketID:        3,
+		Topics:          []string{"a/b"},
+		Qoss:            []byte{1 | 1<<2},
+		Properties:      Properties{SubscriptionIdentifier: []int{5}},
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.SubscribeEncode(buf))
+
+	out := Packet{FixedHeader: FixedHeader{Type: Subscribe, Qos: 1}, ProtocolVersion: 5}
+	require.NoError(t, out.SubscribeDecode(buf.Bytes()[2:]))
+	require.Equal(t, []string{"a/b"}, out.Topics)
+	require.Equal(t, []byte{1}, out.Qoss)
+	require.Equal(t, []SubOptions{{}}, out.SubOptions)
+	require.Equal(t, []int{5}, out.Properties.SubscriptionIdentifier)
+
+	out = Packet{FixedHeader: FixedHeader{Type: Subscribe, Qos: 1}, ProtocolVersion: 5}
+	require.ErrorIs(t, out.SubscribeDecode([]byte{0, 3, 0, 0, 1, 'a', 0xC1}), ErrMalformedQoS)
+
+	out = Packet{FixedHeader: FixedHeader{Type: Subscribe, Qos: 1}, ProtocolVersion: 5}
+	require.ErrorIs(t, out.SubscribeDecode([]byte{0, 3, 0, 0, 1, 'a', 0x31}), ErrMalformedSubOptions)
+
+	out = Packet{FixedHeader: FixedHeader{Type: Subscribe, Qos: 1}, ProtocolVersion: 5}
+	require.ErrorIs(t, out.SubscribeDecode([]byte{0, 3, 0, 0, 1, 'a', 0, 0, 1, 'b', 3}), ErrMalformedQoS)
+}
+
+func TestSubscribeV5Options(t *testing.T) {
+	pk := Packet{
+		FixedHeader:     FixedHeader{Type: Subscribe, Qos: 1},
+		ProtocolVersion: 5,
+		PacketID:        3,
+		Topics:          []string{"a/b", "c/d", "e/f"},
+		Qoss:            []byte{0, 1, 2},
+		SubOptions: []SubOptions{
+			{},
+			{RetainAsPublished: true, RetainHandling: RetainSendIfNew},
+			{RetainHandling: RetainDoNotSend},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.SubscribeEncode(buf))
+	require.Equal(t, []byte{0, 1 | 1<<3 | 1<<4, 2 | 2<<4}, []byte{buf.Bytes()[10], buf.Bytes()[16], buf.Bytes()[22]})
+
+	out := Packet{FixedHeader: FixedHeader{Type: Subscribe, Qos: 1}, ProtocolVersion: 5}
+	require.NoError(t, out.SubscribeDecode(buf.Bytes()[2:]))
+	require.Equal(t, pk.Topics, out.Topics)
+	require.Equal(t, pk.Qoss, out.Qoss)
+	require.Equal(t, pk.SubOptions, out.SubOptions)
+}
+
+func TestSubackUnsubackV5(t *testing.T) {
+	pk := Packet{FixedHeader: FixedHeader{Type: Suback}, ProtocolVersion: 5, PacketID: 3, ReturnCodes: []byte{1, 0x80}}
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.SubackEncode(buf))
+	require.Equal(t, []byte{byte(Suback << 4), 5, 0, 3, 0, 1, 0x80}, buf.Bytes())
+
+	out := Packet{FixedHeader: FixedHeader{Type: Suback}, ProtocolVersion: 5}
+	require.NoError(t, out.SubackDecode(buf.Bytes()[2:]))
+	require.Equal(t, []byte{1, 0x80}, out.ReturnCodes)
+
+	pk = Packet{FixedHeader: FixedHeader{Type: Unsuback}, ProtocolVersion: 5, PacketID: 3, ReturnCodes: []byte{0}}
+	buf.Reset()
+	require.NoError(t, pk.UnsubackEncode(buf))
+	require.Equal(t, []byte{byte(Unsuback << 4), 4, 0, 3, 0, 0}, buf.Bytes())
+
+	out = Packet{FixedHeader: FixedHeader{Type: Unsuback}, ProtocolVersion: 5}
+	require.NoError(t, out.UnsubackDecode(buf.Bytes()[2:]))
+	require.Equal(t, []byte{0}, out.ReturnCodes)
+}
+
+func TestUnsubscribeV5(t *testing.T) {
+	pk := Packet{
+		FixedHeader:     FixedHeader{Type: Unsubscribe, Qos: 1},
+		ProtocolVersion: 5,
+		PacketID:        3,
+		Topics:          []string{"a/b"},
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.UnsubscribeEncode(buf))
+	require.Equal(t, []byte{byte(Unsubscribe<<4 | 2), 8, 0, 3, 0, 0, 3, 'a', '/', 'b'}, buf.Bytes())
+
+	out := Packet{FixedHeader: FixedHeader{Type: Unsubscribe, Qos: 1}, ProtocolVersion: 5}
+	require.NoError(t, out.UnsubscribeDecode(buf.Bytes()[2:]))
+	require.Equal(t, []string{"a/b"}, out.Topics)
+}
+
+func TestDisconnectV5(t *testing.T) {
+	pk := Packet{FixedHeader: FixedHeader{Type: Disconnect}, ProtocolVersion: 5}
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.DisconnectEncode(buf))
+	require.Equal(t, []byte{byte(Disconnect << 4), 0}, buf.Bytes())
+
+	pk.ReturnCode = 0x8E
+	buf.Reset()
+	require.NoError(t, pk.DisconnectEncode(buf))
+	require.Equal(t, []byte{byte(Disconnect << 4), 2, 0x8E, 0}, buf.Bytes())
+
+	out := Packet{FixedHeader: FixedHeader{Type: Disconnect}, ProtocolVersion: 5}
+	require.NoError(t, out.DisconnectDecode(buf.Bytes()[2:]))
+	require.Equal(t, byte(0x8E), out.ReturnCode)
+
+	out = Packet{FixedHeader: FixedHeader{Type: Disconnect}}
+	require.NoError(t, out.DisconnectDecode([]byte{0x8E}))
+	require.Equal(t, byte(0), out.ReturnCode)
+}
+
+func TestAuthV5(t *testing.T) {
+	pk := Packet{FixedHeader: FixedHeader{Type: Auth}, ProtocolVersion: 5}
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.AuthEncode(buf))
+	require.Equal(t, []byte{byte(Auth << 4), 0}, buf.Bytes())
+
+	pk.ReturnCode = CodeContinueAuthentication
+	pk.Properties = Properties{
+		AuthenticationMethod: "X",
+		AuthenticationData:   []byte{1, 2},
+	}
+	buf.Reset()
+	require.NoError(t, pk.AuthEncode(buf))
+	require.Equal(t, []byte{
+		byte(Auth << 4), 11,
+		CodeContinueAuthentication,
+		9, // properties length
+		PropAuthenticationMethod, 0, 1, 'X',
+		PropAuthenticationData, 0, 2, 1, 2,
+	}, buf.Bytes())
+
+	out := Packet{FixedHeader: FixedHeader{Type: Auth}, ProtocolVersion: 5}
+	require.NoError(t, out.AuthDecode(buf.Bytes()[2:]))
+	require.Equal(t, CodeContinueAuthentication, out.ReturnCode)
+	require.Equal(t, "X", out.Properties.AuthenticationMethod)
+	require.Equal(t, []byte{1, 2}, out.Properties.AuthenticationData)
+
+	out = Packet{FixedHeader: FixedHeader{Type: Auth}, ProtocolVersion: 5}
+	require.NoError(t, out.AuthDecode(nil))
+	require.Equal(t, Accepted, out.ReturnCode)
+}
@@ -0,0 +1,146 @@
+// Package ratelimit provides a token bucket for limiting the rate of events.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket which is refilled at a constant rate up to a
+// maximum burst size. Each event takes a single token from the bucket.
+type Bucket struct {
+	sync.Mutex
+	rate   float64   // the number of tokens added per second.
+	burst  float64   // the maximum number of tokens the bucket can hold.
+	tokens float64   // the number of tokens currently available.
+	last   time.Time // the last time the tokens were refilled.
+}
+
+// NewBucket returns a full bucket which is refilled at rate tokens per second,
+// holding at most burst tokens. The burst is always at least 1.
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// refill adds the tokens accrued since the last refill.
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+
+	if b.last.IsZero() || now.After(b.last) {
+		b.last = now
+	}
+}
+
+// Allow takes a token from the bucket, returning false if none were available.
+func (b *Bucket) Allow(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Reserve takes a token from the bucket, even if none are available, and
+// returns the duration to wait before the token may be used. Events waiting
+// on reservations are spaced out at the rate of the bucket.
+func (b *Bucket) Reserve(now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// ReserveWithin takes a token from the bucket if one will be available within
+// max, returning the duration to wait before the token may be used. If the wait
+// would be longer than max, no token is taken and false is returned.
+func (b *Bucket) ReserveWithin(now time.Time, max time.Duration) (time.Duration, bool) {
+	return b.ReserveNWithin(now, 1, max)
+}
+
+// ReserveNWithin takes n tokens from the bucket if they will be available
+// within max, returning the duration to wait before the tokens may be used. If
+// the wait would be longer than max, no tokens are taken and false is returned.
+// Events taking more tokens than the burst of the bucket wait for the tokens
+// beyond the burst to be refilled.
+func (b *Bucket) ReserveNWithin(now time.Time, n float64, max time.Duration) (time.Duration, bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+
+	wait := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	if wait > max {
+		return 0, false
+	}
+
+	b.tokens -= n
+	return wait, true
+}
+
+// Meter measures the rate of events, as the total size of the events counted
+// in the last whole second.
+type Meter struct {
+	sync.Mutex
+	second  int64   // the unix second events are currently being counted in.
+	current float64 // the size of the events counted in the current second.
+	last    float64 // the size of the events counted in the previous second.
+}
+
+// roll moves the meter on to the second of now. The meter must be locked.
+func (m *Meter) roll(now time.Time) {
+	second := now.Unix()
+	if second <= m.second {
+		return
+	}
+
+	m.last = 0
+	if second == m.second+1 {
+		m.last = m.current
+	}
+
+	m.current = 0
+	m.second = second
+}
+
+// Mark counts an event of size n.
+func (m *Meter) Mark(now time.Time, n float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.roll(now)
+	m.current += n
+}
+
+// Rate returns the total size of the events counted in the second before now.
+func (m *Meter) Rate(now time.Time) float64 {
+	m.Lock()
+	defer m.Unlock()
+	m.roll(now)
+	return m.last
+}
@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBucket(t *testing.T) {
+	b := NewBucket(10, 5)
+	require.Equal(t, float64(10), b.rate)
+	require.Equal(t, float64(5), b.burst)
+	require.Equal(t, float64(5), b.tokens)
+
+	b = NewBucket(10, 0)
+	require.Equal(t, float64(1), b.burst)
+}
+
+func TestBucketAllow(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(2, 3)
+
+	for i := 0; i < 3; i++ {
+		require.True(t, b.Allow(now), "burst %d", i)
+	}
+	require.False(t, b.Allow(now))
+
+	now = now.Add(250 * time.Millisecond)
+	require.False(t, b.Allow(now))
+
+	now = now.Add(250 * time.Millisecond)
+	require.True(t, b.Allow(now))
+	require.False(t, b.Allow(now))
+
+	now = now.Add(time.Hour) // refills no higher than the burst.
+	for i := 0; i < 3; i++ {
+		require.True(t, b.Allow(now), "burst %d", i)
+	}
+	require.False(t, b.Allow(now))
+}
+
+func TestBucketAllowClockSkew(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(1, 1)
+	require.True(t, b.Allow(now))
+	require.False(t, b.Allow(now.Add(-time.Second)))
+	require.True(t, b.Allow(now.Add(time.Second)))
+}
+
+func TestBucketReserve(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(4, 2)
+
+	require.Equal(t, time.Duration(0), b.Reserve(now))
+	require.Equal(t, time.Duration(0), b.Reserve(now))
+	require.Equal(t, 250*time.Millisecond, b.Reserve(now))
+	require.Equal(t, 500*time.Millisecond, b.Reserve(now))
+	require.False(t, b.Allow(now))
+
+	require.Equal(t, 250*time.Millisecond, b.Reserve(now.Add(500*time.Millisecond)))
+}
+
+func TestBucketReserveWithin(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(4, 1)
+	d, ok := b.ReserveWithin(now, 0)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), d)
+
+	_, ok = b.ReserveWithin(now, 0)
+	require.False(t, ok)
+
+	_, ok = b.ReserveWithin(now, 100*time.Millisecond)
+	require.False(t, ok) // refused reservations take no token.
+
+	d, ok = b.ReserveWithin(now, 250*time.Millisecond)
+	require.True(t, ok)
+	require.Equal(t, 250*time.Millisecond, d)
+
+	d, ok = b.ReserveWithin(now, time.Second)
+	require.True(t, ok)
+	require.Equal(t, 500*time.Millisecond, d)
+}
+
+func TestBucketReserveNWithin(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(100, 100)
+	d, ok := b.ReserveNWithin(now, 60, 0)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), d)
+
+	_, ok = b.ReserveNWithin(now, 60, 100*time.Millisecond)
+	require.False(t, ok)
+
+	d, ok = b.ReserveNWithin(now, 60, time.Second)
+	require.True(t, ok)
+	require.Equal(t, 200*time.Millisecond, d)
+
+	// events larger than the burst wait for the tokens beyond it.
+	b = NewBucket(100, 10)
+	d, ok = b.ReserveNWithin(now, 60, time.Second)
+	require.True(t, ok)
+	require.Equal(t, 500*time.Millisecond, d)
+}
+
+func TestMeter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := new(Meter)
+	require.Equal(t, float64(0), m.Rate(now))
+
+	m.Mark(now, 2)
+	m.Mark(now.Add(500*time.Millisecond), 3)
+	require.Equal(t, float64(0), m.Rate(now.Add(900*time.Millisecond)))
+	require.Equal(t, float64(5), m.Rate(now.Add(time.Second)))
+
+	m.Mark(now.Add(1500*time.Millisecond), 1)
+	require.Equal(t, float64(1), m.Rate(now.Add(2*time.Second)))
+
+	// a second without events resets the rate.
+	require.Equal(t, float64(0), m.Rate(now.Add(4*time.Second)))
+
+	// events from before the current second are counted in it.
+	m.Mark(now, 4)
+	require.Equal(t, float64(4), m.Rate(now.Add(5*time.Second)))
+}
+
+func BenchmarkBucketAllow(b *testing.B) {
+	bk := NewBucket(1000, 100)
+	now := time.Now()
+	for n := 0; n < b.N; n++ {
+		bk.Allow(now)
+	}
+}
@@ -7,13 +7,43 @@ import (
 	"github.com/csymapp/mqtt/server/internal/packets"
 )
 
+// SharePrefix is the prefix of a shared subscription filter, which takes the
+// form $share/<group>/<filter>.
+const SharePrefix = "$share/"
+
 // Subscriptions is a map of subscriptions keyed on client.
 type Subscriptions map[string]byte
 
+// ParseShared splits a shared subscription filter into its group name and
+// topic filter. ok is false if the filter is not a valid shared subscription.
+func ParseShared(filter string) (group, f string, ok bool) {
+	if !strings.HasPrefix(filter, SharePrefix) {
+		return "", "", false
+	}
+
+	rest := filter[len(SharePrefix):]
+	i := strings.IndexByte(rest, '/')
+	if i < 1 || i == len(rest)-1 {
+		return "", "", false
+	}
+
+	group, f = rest[:i], rest[i+1:]
+	if strings.ContainsAny(group, "+#") {
+		return "", "", false
+	}
+
+	return group, f, true
+}
+
 // Index is a prefix/trie tree containing topic subscribers and retained messages.
+// Leaves are keyed on topic level, so finding the subscribers of a topic only
+// follows the level, + and # branches at each level of the topic, and does not
+// depend on the number of subscriptions. Lookups share a read lock.
 type Index struct {
-	mu   sync.RWMutex // a mutex for locking the whole index.
-	Root *Leaf        // a leaf containing a message and more leaves.
+	mu    sync.RWMutex // a mutex for locking the whole index.
+	Root  *Leaf        // a leaf containing a message and more leaves.
+	bytes int64        // the total payload size of the retained messages.
+	count int64        // the number of retained messages.
 }
 
 // New returns a pointer to a new instance of Index.
@@ -22,6 +52,7 @@ func New() *Index {
 		Root: &Leaf{
 			Leaves:  make(map[string]*Leaf),
 			Clients: make(map[string]byte),
+			Shared:  make(map[string]Subscriptions),
 		},
 	}
 }
@@ -36,6 +67,10 @@ func (x *Index) RetainMessage(msg packets.Packet) int64 {
 
 	// If there is a payload, we can store it.
 	if len(msg.Payload) > 0 {
+		if len(n.Message.Payload) == 0 {
+			x.count++
+		}
+		x.bytes += int64(len(msg.Payload) - len(n.Message.Payload))
 		n.Message = msg
 		return 1
 	}
@@ -46,17 +81,48 @@ func (x *Index) RetainMessage(msg packets.Packet) int64 {
 	if len(n.Message.Payload) > 0 && n.Message.FixedHeader.Retain == true {
 		r = -1
 	}
+	if len(n.Message.Payload) > 0 {
+		x.count--
+	}
+	x.bytes -= int64(len(n.Message.Payload))
 	x.unpoperate(msg.TopicName, "", true)
 
 	return r
 }
 
-// Subscribe creates a subscription filter for a client. Returns true if the
-// subscription was new.
+// RetainedBytes returns the total payload size of the retained messages.
+func (x *Index) RetainedBytes() int64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.bytes
+}
+
+// RetainedCount returns the number of retained messages. Replacing a retained
+// message does not change the count.
+func (x *Index) RetainedCount() int64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.count
+}
+
+// Subscribe creates a subscription filter for a client. Shared subscription
+// filters add the client to the share group for the filter. Returns true if
+// the subscription was new.
 func (x *Index) Subscribe(filter, client string, qos byte) bool {
 	x.mu.Lock()
 	defer x.mu.Unlock()
 
+	if group, f, ok := ParseShared(filter); ok {
+		n := x.poperate(f)
+		if _, ok := n.Shared[group]; !ok {
+			n.Shared[group] = make(Subscriptions)
+		}
+		_, ok := n.Shared[group][client]
+		n.Shared[group][client] = qos
+		n.Filter = f
+		return !ok
+	}
+
 	n := x.poperate(filter)
 	_, ok := n.Clients[client]
 	n.Clients[client] = qos
@@ -71,6 +137,17 @@ func (x *Index) Unsubscribe(filter, client string) bool {
 	x.mu.Lock()
 	defer x.mu.Unlock()
 
+	if group, f, ok := ParseShared(filter); ok {
+		n := x.poperate(f)
+		_, ok := n.Shared[group][client]
+		delete(n.Shared[group], client)
+		if len(n.Shared[group]) == 0 {
+			delete(n.Shared, group)
+		}
+
+		return x.unpoperate(f, "", false) && ok
+	}
+
 	n := x.poperate(filter)
 	_, ok := n.Clients[client]
 
@@ -116,7 +193,7 @@ func (x *Index) unpoperate(filter string, client string, message bool) bool {
 		}
 
 		// If this leaf is empty, note it as orphaned.
-		orphaned = len(e.Clients) == 0 && len(e.Leaves) == 0 && !e.Message.FixedHeader.Retain
+		orphaned = len(e.Clients) == 0 && len(e.Shared) == 0 && len(e.Leaves) == 0 && !e.Message.FixedHeader.Retain
 
 		// Traverse up the branch.
 		e = e.Parent
@@ -150,6 +227,7 @@ func (x *Index) poperate(topic string) *Leaf {
 				Parent:  n,
 				Leaves:  make(map[string]*Leaf),
 				Clients: make(map[string]byte),
+				Shared:  make(map[string]Subscriptions),
 			}
 			n.Leaves[particle] = child
 		}
@@ -160,12 +238,53 @@ func (x *Index) poperate(topic string) *Leaf {
 }
 
 // Subscribers returns a map of clients who are subscribed to matching filters.
+// A client with several overlapping filters which match the topic appears once,
+// with the highest QoS of those filters, so it receives a single copy.
 func (x *Index) Subscribers(topic string) Subscriptions {
 	x.mu.RLock()
 	defer x.mu.RUnlock()
 	return x.Root.scanSubscribers(topic, 0, make(Subscriptions))
 }
 
+// SharedSubscribers returns the members of each share group with a filter
+// matching the topic, keyed on the shared subscription filter.
+func (x *Index) SharedSubscribers(topic string) map[string]Subscriptions {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.Root.scanShared(topic, 0, make(map[string]Subscriptions))
+}
+
+// SharedMembers returns the members of the share group for a shared
+// subscription filter.
+func (x *Index) SharedMembers(filter string) Subscriptions {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	members := make(Subscriptions)
+	group, f, ok := ParseShared(filter)
+	if !ok {
+		return members
+	}
+
+	var d int
+	var particle string
+	var hasNext = true
+	n := x.Root
+	for hasNext {
+		particle, hasNext = isolateParticle(f, d)
+		d++
+		if n = n.Leaves[particle]; n == nil {
+			return members
+		}
+	}
+
+	for client, qos := range n.Shared[group] {
+		members[client] = qos
+	}
+
+	return members
+}
+
 // Messages returns a slice of retained topic messages which match a filter.
 func (x *Index) Messages(filter string) []packets.Packet {
 	// ReLeaf("messages", x.Root, 0)
@@ -176,12 +295,13 @@ func (x *Index) Messages(filter string) []packets.Packet {
 
 // Leaf is a child node on the tree.
 type Leaf struct {
-	Message packets.Packet   // a message which has been retained for a specific topic.
-	Key     string           // the key that was used to create the leaf.
-	Filter  string           // the path of the topic filter being matched.
-	Parent  *Leaf            // a pointer to the parent node for the leaf.
-	Leaves  map[string]*Leaf // a map of child nodes, keyed on particle id.
-	Clients map[string]byte  // a map of client ids subscribed to the topic.
+	Message packets.Packet           // a message which has been retained for a specific topic.
+	Key     string                   // the key that was used to create the leaf.
+	Filter  string                   // the path of the topic filter being matched.
+	Parent  *Leaf                    // a pointer to the parent node for the leaf.
+	Leaves  map[string]*Leaf         // a map of child nodes, keyed on particle id.
+	Clients map[string]byte          // a map of client ids subscribed to the topic.
+	Shared  map[string]Subscriptions // a map of share groups subscribed to the topic, keyed on group name.
 }
 
 // scanSubscribers recursively steps through a branch of leaves finding clients who
@@ -237,6 +357,53 @@ func (l *Leaf) scanSubscribers(topic string, d int, clients Subscriptions) Subsc
 	return clients
 }
 
+// scanShared recursively steps through a branch of leaves finding share groups
+// with filters matching a topic, in the same manner as scanSubscribers.
+func (l *Leaf) scanShared(topic string, d int, groups map[string]Subscriptions) map[string]Subscriptions {
+	part, hasNext := isolateParticle(topic, d)
+
+	for _, particle := range []string{part, "+", "#"} {
+		if d == 0 && len(part) > 0 && part[0] == '$' && (particle == "+" || particle == "#") {
+			continue
+		}
+
+		if child, ok := l.Leaves[particle]; ok {
+			if !hasNext || particle == "#" {
+				child.collectShared(groups)
+				if !hasNext {
+					if extra, ok := child.Leaves["#"]; ok {
+						extra.collectShared(groups)
+					}
+				}
+			}
+
+			if particle == "#" {
+				return groups
+			} else if hasNext {
+				groups = child.scanShared(topic, d+1, groups)
+			}
+		}
+	}
+
+	return groups
+}
+
+// collectShared copies the share groups of a leaf into a map keyed on the
+// shared subscription filter.
+func (l *Leaf) collectShared(groups map[string]Subscriptions) {
+	for group, members := range l.Shared {
+		if len(members) == 0 {
+			continue
+		}
+
+		m := make(Subscriptions, len(members))
+		for client, qos := range members {
+			m[client] = qos
+		}
+		groups[SharePrefix+group+"/"+l.Filter] = m
+	}
+}
+
 // scanMessages recursively steps through a branch of leaves finding retained messages
 // that match a topic filter. Setting `d` to -1 will enable wildhash mode, and will
 // recursively check ALL child leaves in every subsequent branch.
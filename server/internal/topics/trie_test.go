@@ -1,11 +1,13 @@
 package topics
 
 import (
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/csymapp/mqtt/server/internal/packets"
+	"github.com/csymapp/mqtt/server/listeners/auth"
 )
 
 func TestNew(t *testing.T) {
@@ -81,6 +83,43 @@ func BenchmarkUnpoperate(b *testing.B) {
 	}
 }
 
+func TestRetainedBytes(t *testing.T) {
+	index := New()
+	require.Equal(t, int64(0), index.RetainedBytes())
+
+	index.RetainMessage(packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")})
+	index.RetainMessage(packets.Packet{TopicName: "d/e/f", Payload: []byte("hi")})
+	require.Equal(t, int64(7), index.RetainedBytes())
+
+	index.RetainMessage(packets.Packet{TopicName: "a/b/c", Payload: []byte("hello world")})
+	require.Equal(t, int64(13), index.RetainedBytes())
+
+	index.RetainMessage(packets.Packet{TopicName: "a/b/c"})
+	require.Equal(t, int64(2), index.RetainedBytes())
+
+	index.RetainMessage(packets.Packet{TopicName: "x/y/z"})
+	require.Equal(t, int64(2), index.RetainedBytes())
+}
+
+func TestRetainedCount(t *testing.T) {
+	index := New()
+	require.Equal(t, int64(0), index.RetainedCount())
+
+	index.RetainMessage(packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")})
+	index.RetainMessage(packets.Packet{TopicName: "d/e/f", Payload: []byte("hi")})
+	require.Equal(t, int64(2), index.RetainedCount())
+
+	// replacing a retained message does not change the count.
+	index.RetainMessage(packets.Packet{TopicName: "a/b/c", Payload: []byte("hello world")})
+	require.Equal(t, int64(2), index.RetainedCount())
+
+	index.RetainMessage(packets.Packet{TopicName: "a/b/c"})
+	require.Equal(t, int64(1), index.RetainedCount())
+
+	index.RetainMessage(packets.Packet{TopicName: "x/y/z"})
+	require.Equal(t, int64(1), index.RetainedCount())
+}
+
 func TestRetainMessage(t *testing.T) {
 	pk := packets.Packet{
 		FixedHeader: packets.FixedHeader{
@@ -237,6 +276,138 @@ func BenchmarkUnsubscribe(b *testing.B) {
 	}
 }
 
+func TestParseShared(t *testing.T) {
+	tt := []struct {
+		filter string
+		group  string
+		f      string
+		ok     bool
+	}{
+		{filter: "$share/g/a/b", group: "g", f: "a/b", ok: true},
+		{filter: "$share/g/#", group: "g", f: "#", ok: true},
+		{filter: "$share/g/", ok: false},
+		{filter: "$share//a/b", ok: false},
+		{filter: "$share/g", ok: false},
+		{filter: "$share/g+/a", ok: false},
+		{filter: "$share/#/a", ok: false},
+		{filter: "a/b", ok: false},
+		{filter: "$SYS/a", ok: false},
+	}
+
+	for i, wanted := range tt {
+		group, f, ok := ParseShared(wanted.filter)
+		require.Equal(t, wanted.ok, ok, "Incorrect ok [i:%d] %s", i, wanted.filter)
+		require.Equal(t, wanted.group, group, "Incorrect group [i:%d] %s", i, wanted.filter)
+		require.Equal(t, wanted.f, f, "Incorrect filter [i:%d] %s", i, wanted.filter)
+	}
+}
+
+func TestSubscribeShared(t *testing.T) {
+	index := New()
+	q := index.Subscribe("$share/g1/a/b", "client-1", 1)
+	require.Equal(t, true, q)
+
+	q = index.Subscribe("$share/g1/a/b", "client-1", 2)
+	require.Equal(t, false, q)
+
+	q = index.Subscribe("$share/g1/a/b", "client-2", 0)
+	require.Equal(t, true, q)
+
+	q = index.Subscribe("$share/g2/a/b", "client-1", 0)
+	require.Equal(t, true, q)
+
+	leaf := index.Root.Leaves["a"].Leaves["b"]
+	require.Empty(t, leaf.Clients)
+	require.Equal(t, "a/b", leaf.Filter)
+	require.Equal(t, Subscriptions{"client-1": 2, "client-2": 0}, leaf.Shared["g1"])
+	require.Equal(t, Subscriptions{"client-1": 0}, leaf.Shared["g2"])
+	require.Nil(t, index.Root.Leaves["$share"])
+}
+
+func TestUnsubscribeShared(t *testing.T) {
+	index := New()
+	index.Subscribe("$share/g1/a/b", "client-1", 0)
+	index.Subscribe("$share/g1/a/b", "client-2", 0)
+
+	ok := index.Unsubscribe("$share/g1/a/b", "client-1")
+	require.Equal(t, true, ok)
+	require.Equal(t, Subscriptions{"client-2": 0}, index.Root.Leaves["a"].Leaves["b"].Shared["g1"])
+
+	ok = index.Unsubscribe("$share/g1/a/b", "client-1")
+	require.Equal(t, false, ok)
+
+	ok = index.Unsubscribe("$share/g1/a/b", "client-2")
+	require.Equal(t, true, ok)
+	require.Nil(t, index.Root.Leaves["a"])
+}
+
+func TestSharedSubscribers(t *testing.T) {
+	index := New()
+	index.Subscribe("a/b/c", "client-0", 0)
+	index.Subscribe("$share/g1/a/b/c", "client-1", 1)
+	index.Subscribe("$share/g1/a/b/c", "client-2", 2)
+	index.Subscribe("$share/g1/a/+/c", "client-3", 0)
+	index.Subscribe("$share/g2/a/#", "client-4", 1)
+	index.Subscribe("$share/g3/#", "client-5", 1)
+	index.Subscribe("$share/g4/d/e", "client-6", 1)
+
+	groups := index.SharedSubscribers("a/b/c")
+	require.Equal(t, map[string]Subscriptions{
+		"$share/g1/a/b/c": {"client-1": 1, "client-2": 2},
+		"$share/g1/a/+/c": {"client-3": 0},
+		"$share/g2/a/#":   {"client-4": 1},
+		"$share/g3/#":     {"client-5": 1},
+	}, groups)
+
+	require.Equal(t, Subscriptions{"client-0": 0}, index.Subscribers("a/b/c"))
+	require.Empty(t, index.SharedSubscribers("$SYS/info"))
+}
+
+func TestSharedMembers(t *testing.T) {
+	index := New()
+	index.Subscribe("$share/g1/a/b", "client-1", 1)
+	index.Subscribe("$share/g1/a/b", "client-2", 2)
+
+	require.Equal(t, Subscriptions{"client-1": 1, "client-2": 2}, index.SharedMembers("$share/g1/a/b"))
+	require.Empty(t, index.SharedMembers("$share/g2/a/b"))
+	require.Empty(t, index.SharedMembers("$share/g1/a/c"))
+	require.Empty(t, index.SharedMembers("a/b"))
+}
+
+func TestSubscribersOverlapping(t *testing.T) {
+	tt := []struct {
+		filters []string
+		topic   string
+	}{
+		{filters: []string{"a/#", "a/b"}, topic: "a/b"},
+		{filters: []string{"a/#", "a/+"}, topic: "a/b"},
+		{filters: []string{"a/#", "a"}, topic: "a"},
+		{filters: []string{"#", "a/#", "a/b/#"}, topic: "a/b/c"},
+		{filters: []string{"#", "+/#"}, topic: "a"},
+		{filters: []string{"+/+", "a/+", "+/b"}, topic: "a/b"},
+		{filters: []string{"a/+/#", "a/b/#"}, topic: "a/b"},
+		{filters: []string{"a/+/#", "a/b/#", "a/b/c/#"}, topic: "a/b/c/d"},
+		{filters: []string{"+/b/#", "a/+/c", "a/b/+"}, topic: "a/b/c"},
+		{filters: []string{"a/+/+", "a/#", "+/b/c"}, topic: "a/b/c"},
+	}
+
+	for _, tx := range tt {
+		for i := range tx.filters {
+			index := New()
+			for j, filter := range tx.filters {
+				qos := byte(0)
+				if i == j {
+					qos = 2 // the highest qos moves through each overlapping filter.
+				}
+				index.Subscribe(filter, "cl1", qos)
+			}
+			index.Subscribe("a/b/c/d/e", "cl2", 1)
+
+			require.Equal(t, Subscriptions{"cl1": 2}, index.Subscribers(tx.topic), "%v %s", tx.filters, tx.topic)
+		}
+	}
+}
+
 func TestSubscribersFind(t *testing.T) {
 	tt := []struct {
 		filter string
@@ -353,6 +524,96 @@ func BenchmarkSubscribers(b *testing.B) {
 	}
 }
 
+// manyFilters returns n subscription filters spread over a tree of sites and
+// devices, with a mix of exact, single level and multi level wildcard filters.
+func manyFilters(n int) []string {
+	filters := make([]string, n)
+	for i := range filters {
+		site, device := strconv.Itoa(i%1000), strconv.Itoa(i/1000)
+		switch i % 4 {
+		case 0:
+			filters[i] = "site/" + site + "/device/" + device + "/temp"
+		case 1:
+			filters[i] = "site/" + site + "/device/+/temp"
+		case 2:
+			filters[i] = "site/" + site + "/device/" + device + "/#"
+		default:
+			filters[i] = "site/+/device/" + device + "/humidity"
+		}
+	}
+
+	return filters
+}
+
+// matchLinear returns the subscribers of a topic by checking every filter,
+// as a reference for the index.
+func matchLinear(filters []string, topic string) Subscriptions {
+	clients := make(Subscriptions)
+	for i, filter := range filters {
+		if auth.MatchTopic(filter, topic) {
+			clients["client-"+strconv.Itoa(i)] = 0
+		}
+	}
+
+	return clients
+}
+
+func TestSubscribersMatchLinear(t *testing.T) {
+	filters := manyFilters(20000)
+	index := New()
+	for i, filter := range filters {
+		index.Subscribe(filter, "client-"+strconv.Itoa(i), 0)
+	}
+
+	for _, topic := range []string{
+		"site/1/device/0/temp",
+		"site/7/device/3/temp",
+		"site/7/device/3/humidity",
+		"site/7/device/3/a/b",
+		"site/999/device/19/temp",
+		"site/1000/device/0/temp",
+		"site/1/device",
+		"other/1/device/0/temp",
+	} {
+		require.Equal(t, matchLinear(filters, topic), index.Subscribers(topic), topic)
+	}
+}
+
+func BenchmarkSubscribersTrie(b *testing.B) {
+	index := New()
+	for i, filter := range manyFilters(200000) {
+		index.Subscribe(filter, "client-"+strconv.Itoa(i), 0)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		index.Subscribers("site/7/device/3/temp")
+	}
+}
+
+func BenchmarkSubscribersTrieParallel(b *testing.B) {
+	index := New()
+	for i, filter := range manyFilters(200000) {
+		index.Subscribe(filter, "client-"+strconv.Itoa(i), 0)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			index.Subscribers("site/7/device/3/temp")
+		}
+	})
+}
+
+func BenchmarkSubscribersLinear(b *testing.B) {
+	filters := manyFilters(200000)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		matchLinear(filters, "site/7/device/3/temp")
+	}
+}
+
 func TestIsolateParticle(t *testing.T) {
 	particle, hasNext := isolateParticle("path/to/my/mqtt", 0)
 	require.Equal(t, "path", particle)
@@ -1,5 +1,10 @@
 package utils
 
+import (
+	"crypto/rand"
+	"fmt"
+)
+
 // InSliceString returns true if a string exists in a slice of strings.
 // This temporary and should be replaced with a function from the new
 // go slices package in 1.19 when available.
@@ -12,3 +17,15 @@ func InSliceString(sl []string, st string) bool {
 	}
 	return false
 }
+
+// NewUUID returns a random (version 4) UUID in its canonical string form.
+func NewUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand only fails if the system has no entropy source.
+	}
+
+	b[6] = b[6]&0x0f | 0x40 // version 4.
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant.
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
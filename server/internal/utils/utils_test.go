@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"regexp"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -16,3 +17,9 @@ func TestInSliceString(t *testing.T) {
 	sl = []string{"a", "b", "c"}
 	require.Equal(t, false, InSliceString(sl, "d"))
 }
+
+func TestNewUUID(t *testing.T) {
+	id := NewUUID()
+	require.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+	require.NotEqual(t, id, NewUUID())
+}
@@ -0,0 +1,36 @@
+package auth
+
+// ErrorController is a Controller whose ACL checks can fail, such as when the
+// directory server holding the permissions is unreachable, so that the server
+// can tell a failed check apart from a denial.
+type ErrorController interface {
+	Controller
+
+	// ACLWithError returns true if a user has read or write access to a given
+	// topic. A non-nil error indicates that the check could not be made, in
+	// which case access is denied and the error is logged, and MQTT v5 clients
+	// are sent a reason code which allows them to retry.
+	ACLWithError(user []byte, topic string, write bool) (allowed bool, err error)
+}
+
+// WithError returns an ErrorController for an auth controller. Controllers
+// which already implement ErrorController are returned as-is, and controllers
+// which only implement ACL are wrapped so that ACLWithError calls ACL and
+// never fails.
+func WithError(ac Controller) ErrorController {
+	if ec, ok := ac.(ErrorController); ok {
+		return ec
+	}
+
+	return &errorAdapter{ac}
+}
+
+// errorAdapter adapts a Controller to the ErrorController interface.
+type errorAdapter struct {
+	Controller
+}
+
+// ACLWithError checks the topic access of the user, without an error.
+func (a *errorAdapter) ACLWithError(user []byte, topic string, write bool) (bool, error) {
+	return a.ACL(user, topic, write), nil
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingAuth fails every ACL check, as if its backend were unreachable.
+type failingAuth struct {
+	Allow
+}
+
+func (a *failingAuth) ACLWithError(user []byte, topic string, write bool) (bool, error) {
+	return false, errors.New("backend unavailable")
+}
+
+func TestWithErrorPassthrough(t *testing.T) {
+	ac := new(failingAuth)
+	ec := WithError(ac)
+	require.Equal(t, ac, ec)
+
+	ok, err := ec.ACLWithError([]byte("user"), "topic", true)
+	require.Error(t, err)
+	require.False(t, ok)
+}
+
+func TestWithErrorAdapter(t *testing.T) {
+	ok, err := WithError(new(Allow)).ACLWithError([]byte("user"), "topic", true)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = WithError(new(Disallow)).ACLWithError([]byte("user"), "topic", true)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
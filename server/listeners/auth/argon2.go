@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// argon2Prefix is the identifier of argon2id hashes in the PHC string format.
+	argon2Prefix = "$argon2id$"
+
+	// argon2SaltLen is the number of bytes of salt in an argon2id hash.
+	argon2SaltLen = 16
+
+	// The default cost parameters of argon2id hashes.
+	argon2DefaultTime    = 3
+	argon2DefaultMemory  = 64 * 1024
+	argon2DefaultThreads = 4
+	argon2DefaultKeyLen  = 32
+)
+
+var (
+	// ErrInvalidArgon2Hash indicates the hash is not a well-formed argon2id hash.
+	ErrInvalidArgon2Hash = errors.New("invalid argon2id hash")
+
+	// ErrIncompatibleArgon2Version indicates the hash was made by another
+	// version of argon2.
+	ErrIncompatibleArgon2Version = errors.New("incompatible argon2 version")
+)
+
+// withDefaults returns the hasher with any unset parameters replaced by the
+// defaults.
+func (h Argon2Hasher) withDefaults() Argon2Hasher {
+	if h.Time == 0 {
+		h.Time = argon2DefaultTime
+	}
+	if h.Memory == 0 {
+		h.Memory = argon2DefaultMemory
+	}
+	if h.Threads == 0 {
+		h.Threads = argon2DefaultThreads
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = argon2DefaultKeyLen
+	}
+	return h
+}
+
+// encodeArgon2 returns the argon2id hash of a password with a random salt, in
+// the PHC string format, eg. "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>".
+func encodeArgon2(password []byte, h Argon2Hasher) (string, error) {
+	h = h.withDefaults()
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey(password, salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// compareArgon2 compares an argon2id hash with a plaintext password,
+// returning true if they match.
+func compareArgon2(hash string, password []byte) bool {
+	h, salt, key, err := decodeArgon2(hash)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey(password, salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// decodeArgon2 splits an argon2id hash into the parameters it was created
+// with, its salt, and its key.
+func decodeArgon2(hash string) (h Argon2Hasher, salt, key []byte, err error) {
+	if !strings.HasPrefix(hash, argon2Prefix) {
+		return h, nil, nil, ErrInvalidArgon2Hash
+	}
+
+	parts := strings.Split(hash[len(argon2Prefix):], "$")
+	if len(parts) != 4 {
+		return h, nil, nil, ErrInvalidArgon2Hash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil {
+		return h, nil, nil, ErrInvalidArgon2Hash
+	}
+	if version != argon2.Version {
+		return h, nil, nil, ErrIncompatibleArgon2Version
+	}
+
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &h.Memory, &h.Time, &h.Threads); err != nil {
+		return h, nil, nil, ErrInvalidArgon2Hash
+	}
+	if h.Time < 1 || h.Threads < 1 {
+		return h, nil, nil, ErrInvalidArgon2Hash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return h, nil, nil, ErrInvalidArgon2Hash
+	}
+
+	key, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) < 4 {
+		return h, nil, nil, ErrInvalidArgon2Hash
+	}
+
+	h.KeyLen = uint32(len(key))
+	return h, salt, key, nil
+}
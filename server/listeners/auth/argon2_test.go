@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeArgon2(t *testing.T) {
+	h := Argon2Hasher{Time: 1, Memory: 64, Threads: 1}
+	hash, err := encodeArgon2([]byte("melon"), h)
+	require.NoError(t, err)
+	require.Regexp(t, `^\$argon2id\$v=19\$m=64,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`, hash)
+
+	require.True(t, compareArgon2(hash, []byte("melon")))
+	require.False(t, compareArgon2(hash, []byte("melons")))
+
+	other, err := encodeArgon2([]byte("melon"), h)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other)
+}
+
+func TestEncodeArgon2Defaults(t *testing.T) {
+	require.Equal(t, Argon2Hasher{
+		Time:    argon2DefaultTime,
+		Memory:  argon2DefaultMemory,
+		Threads: argon2DefaultThreads,
+		KeyLen:  argon2DefaultKeyLen,
+	}, Argon2Hasher{}.withDefaults())
+}
+
+func TestDecodeArgon2(t *testing.T) {
+	hash, err := encodeArgon2([]byte("melon"), Argon2Hasher{Time: 2, Memory: 32, Threads: 2, KeyLen: 16})
+	require.NoError(t, err)
+
+	h, salt, key, err := decodeArgon2(hash)
+	require.NoError(t, err)
+	require.Equal(t, Argon2Hasher{Time: 2, Memory: 32, Threads: 2, KeyLen: 16}, h)
+	require.Len(t, salt, argon2SaltLen)
+	require.Len(t, key, 16)
+}
+
+func TestDecodeArgon2Invalid(t *testing.T) {
+	tt := []struct {
+		hash string
+		err  error
+	}{
+		{"", ErrInvalidArgon2Hash},
+		{"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaGhhc2g", ErrInvalidArgon2Hash},
+		{"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ", ErrInvalidArgon2Hash},
+		{"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaGhhc2g", ErrIncompatibleArgon2Version},
+		{"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2g", ErrInvalidArgon2Hash},
+		{"$argon2id$v=19$m=64,t=1,p=1$!!$aGFzaGhhc2g", ErrInvalidArgon2Hash},
+		{"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$!!", ErrInvalidArgon2Hash},
+	}
+
+	for _, tx := range tt {
+		_, _, _, err := decodeArgon2(tx.hash)
+		require.ErrorIs(t, err, tx.err, tx.hash)
+		require.False(t, compareArgon2(tx.hash, nil))
+	}
+}
@@ -3,11 +3,23 @@ package auth
 // Controller is an interface for authentication controllers.
 type Controller interface {
 
-	// Authenticate authenticates a user on CONNECT and returns true if a user is
-	// allowed to join the server.
+	// Authenticate authenticates a user on CONNECT. A non-nil error indicates
+	// that the user is not allowed to join the server. On success, the returned
+	// value may be used to change the username the client is identified by:
+	// if it is a string or implements Principal, the client's username is
+	// replaced with it, and that username is passed to all subsequent ACL
+	// checks for the client. Any other value is ignored by the server.
 	// Authenticate(user, password []byte) bool
 	Authenticate(user, password []byte) (interface{}, error)
 
 	// ACL returns true if a user has read or write access to a given topic.
 	ACL(user []byte, topic string, write bool) bool
 }
+
+// Principal may be implemented by values returned from Authenticate which
+// identify the authenticated user, such as decoded token claims. Controllers
+// which need the value during ACL checks should implement IdentityController,
+// which is passed the value for the client being checked.
+type Principal interface {
+	Username() string
+}
@@ -0,0 +1,128 @@
+// Package chain provides an auth controller which composes an ordered list of
+// other auth controllers, such as trying a directory service before falling
+// back to a file of service accounts.
+package chain
+
+import (
+	"errors"
+
+	"github.com/csymapp/mqtt/server/listeners/auth"
+)
+
+// Policy determines how the ACL results of the chained controllers are combined.
+type Policy int
+
+const (
+	// FirstMatch allows access if any controller allows it, checking the
+	// controllers in order and stopping at the first which allows access.
+	FirstMatch Policy = iota
+
+	// AllMustAllow allows access only if every controller allows it.
+	AllMustAllow
+)
+
+var (
+	// ErrNoControllers indicates the chain does not contain any controllers.
+	ErrNoControllers = errors.New("no auth controllers in chain")
+)
+
+// Controller is an auth controller which delegates to an ordered list of controllers.
+type Controller struct {
+	policy      Policy            // how ACL results are combined.
+	controllers []auth.Controller // the controllers, in the order they are tried.
+}
+
+// New returns a new chain controller which tries each of the controllers in order.
+func New(policy Policy, controllers ...auth.Controller) *Controller {
+	return &Controller{
+		policy:      policy,
+		controllers: controllers,
+	}
+}
+
+// Authenticate returns the result of the first controller which successfully
+// authenticates the user. If no controller succeeds, the error from the last
+// controller is returned.
+func (c *Controller) Authenticate(user, password []byte) (interface{}, error) {
+	return c.AuthenticateConn(auth.ConnInfo{
+		Username: user,
+		Password: password,
+	})
+}
+
+// AuthenticateConn returns the result of the first controller which successfully
+// authenticates the connection, passing the connection info to controllers which
+// implement auth.ConnController.
+func (c *Controller) AuthenticateConn(info auth.ConnInfo) (interface{}, error) {
+	err := ErrNoControllers
+	for _, ac := range c.controllers {
+		var res interface{}
+		res, err = auth.Conn(ac).AuthenticateConn(info)
+		if err == nil {
+			return res, nil
+		}
+	}
+
+	return nil, err
+}
+
+// ACL returns true if the controllers grant access to the topic according to
+// the chain policy. A chain with no controllers denies all access.
+func (c *Controller) ACL(user []byte, topic string, write bool) bool {
+	ok, _ := c.ACLWithError(user, topic, write)
+	return ok
+}
+
+// ACLWithError returns true if the controllers grant access to the topic
+// according to the chain policy, checking controllers which implement
+// auth.ErrorController with ACLWithError. With FirstMatch, a controller whose
+// check fails is skipped, and the error is only returned if no other controller
+// allows access. With AllMustAllow, any failed check denies access.
+func (c *Controller) ACLWithError(user []byte, topic string, write bool) (bool, error) {
+	return c.ACLIdentity(nil, user, topic, write)
+}
+
+// ACLIdentity checks access as for ACLWithError, passing the identity returned
+// when the client authenticated to controllers which implement
+// auth.IdentityController.
+func (c *Controller) ACLIdentity(identity interface{}, user []byte, topic string, write bool) (bool, error) {
+	if len(c.controllers) == 0 {
+		return false, nil
+	}
+
+	var failed error
+	for _, ac := range c.controllers {
+		ok, err := auth.WithIdentity(ac).ACLIdentity(identity, user, topic, write)
+		if err != nil {
+			if c.policy == AllMustAllow {
+				return false, err
+			}
+
+			failed = err
+			continue
+		}
+
+		if ok && c.policy == FirstMatch {
+			return true, nil
+		}
+
+		if !ok && c.policy == AllMustAllow {
+			return false, nil
+		}
+	}
+
+	if c.policy == AllMustAllow {
+		return true, nil
+	}
+
+	return false, failed
+}
+
+// check the controller satisfies the auth.ConnController interface.
+var _ auth.ConnController = (*Controller)(nil)
+
+// check the controller satisfies the auth.ErrorController interface.
+var _ auth.ErrorController = (*Controller)(nil)
+
+// check the controller satisfies the auth.IdentityController interface.
+var _ auth.IdentityController = (*Controller)(nil)
@@ -0,0 +1,199 @@
+package chain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/csymapp/mqtt/server/listeners/auth"
+)
+
+var errDenied = errors.New("denied")
+
+// staticAuth accepts a single user and allows a single topic.
+type staticAuth struct {
+	user  string
+	topic string
+	res   interface{}
+	calls int
+}
+
+func (a *staticAuth) Authenticate(user, password []byte) (interface{}, error) {
+	a.calls++
+	if string(user) != a.user {
+		return nil, errDenied
+	}
+
+	return a.res, nil
+}
+
+func (a *staticAuth) ACL(user []byte, topic string, write bool) bool {
+	a.calls++
+	return topic == a.topic || a.topic == "#"
+}
+
+func TestSatisfies(t *testing.T) {
+	var x auth.Controller
+	x = New(FirstMatch)
+	require.NotNil(t, x)
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := &staticAuth{user: "ldap", res: "ldap-user"}
+	b := &staticAuth{user: "service", res: "service-user"}
+	c := New(FirstMatch, a, b)
+
+	res, err := c.Authenticate([]byte("ldap"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "ldap-user", res)
+	require.Equal(t, 1, a.calls)
+	require.Equal(t, 0, b.calls)
+
+	res, err = c.Authenticate([]byte("service"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "service-user", res)
+	require.Equal(t, 1, b.calls)
+
+	_, err = c.Authenticate([]byte("unknown"), nil)
+	require.ErrorIs(t, err, errDenied)
+}
+
+// addrAuth accepts connections from a single remote address.
+type addrAuth struct {
+	staticAuth
+	addr string
+}
+
+func (a *addrAuth) AuthenticateConn(info auth.ConnInfo) (interface{}, error) {
+	if info.RemoteAddr != a.addr {
+		return nil, errDenied
+	}
+
+	return info.ClientID, nil
+}
+
+func TestAuthenticateConn(t *testing.T) {
+	a := &addrAuth{addr: "127.0.0.1"}
+	b := &staticAuth{user: "service", res: "service-user"}
+	c := New(FirstMatch, a, b)
+
+	res, err := c.AuthenticateConn(auth.ConnInfo{RemoteAddr: "127.0.0.1", ClientID: "mochi"})
+	require.NoError(t, err)
+	require.Equal(t, "mochi", res)
+
+	res, err = c.AuthenticateConn(auth.ConnInfo{RemoteAddr: "10.0.0.1", Username: []byte("service")})
+	require.NoError(t, err)
+	require.Equal(t, "service-user", res)
+
+	_, err = c.AuthenticateConn(auth.ConnInfo{RemoteAddr: "10.0.0.1", Username: []byte("mochi")})
+	require.ErrorIs(t, err, errDenied)
+}
+
+func TestAuthenticateNoControllers(t *testing.T) {
+	_, err := New(FirstMatch).Authenticate([]byte("mochi"), nil)
+	require.ErrorIs(t, err, ErrNoControllers)
+}
+
+func TestACLFirstMatch(t *testing.T) {
+	a := &staticAuth{topic: "a/b"}
+	b := &staticAuth{topic: "c/d"}
+	c := New(FirstMatch, a, b)
+
+	require.True(t, c.ACL(nil, "a/b", true))
+	require.Equal(t, 0, b.calls)
+	require.True(t, c.ACL(nil, "c/d", true))
+	require.False(t, c.ACL(nil, "e/f", true))
+}
+
+func TestACLAllMustAllow(t *testing.T) {
+	a := &staticAuth{topic: "#"}
+	b := &staticAuth{topic: "c/d"}
+	c := New(AllMustAllow, a, b)
+
+	require.True(t, c.ACL(nil, "c/d", false))
+	require.False(t, c.ACL(nil, "a/b", false))
+
+	c = New(AllMustAllow, b, a)
+	a.calls = 0
+	require.False(t, c.ACL(nil, "a/b", false))
+	require.Equal(t, 0, a.calls)
+}
+
+func TestACLNoControllers(t *testing.T) {
+	require.False(t, New(FirstMatch).ACL(nil, "a/b", true))
+	require.False(t, New(AllMustAllow).ACL(nil, "a/b", true))
+}
+
+// downAuth fails every ACL check, as if its backend were unreachable.
+type downAuth struct {
+	staticAuth
+}
+
+func (a *downAuth) ACLWithError(user []byte, topic string, write bool) (bool, error) {
+	a.calls++
+	return false, errDenied
+}
+
+func TestACLWithErrorFirstMatch(t *testing.T) {
+	down := new(downAuth)
+	b := &staticAuth{topic: "c/d"}
+	c := New(FirstMatch, down, b)
+
+	ok, err := c.ACLWithError(nil, "c/d", true)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = c.ACLWithError(nil, "e/f", true)
+	require.ErrorIs(t, err, errDenied)
+	require.False(t, ok)
+	require.False(t, c.ACL(nil, "e/f", true))
+
+	ok, err = New(FirstMatch, b).ACLWithError(nil, "e/f", true)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestACLWithErrorAllMustAllow(t *testing.T) {
+	a := &staticAuth{topic: "#"}
+	down := new(downAuth)
+	c := New(AllMustAllow, a, down)
+
+	ok, err := c.ACLWithError(nil, "a/b", true)
+	require.ErrorIs(t, err, errDenied)
+	require.False(t, ok)
+
+	ok, err = New(AllMustAllow, a).ACLWithError(nil, "a/b", true)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = New(AllMustAllow).ACLWithError(nil, "a/b", true)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+// claimsAuth allows access to the topic named by the identity of the client.
+type claimsAuth struct {
+	staticAuth
+}
+
+func (a *claimsAuth) ACLIdentity(identity interface{}, user []byte, topic string, write bool) (bool, error) {
+	return identity == topic, nil
+}
+
+func TestACLIdentity(t *testing.T) {
+	b := &staticAuth{topic: "c/d"}
+	c := New(FirstMatch, new(claimsAuth), b)
+
+	ok, err := c.ACLIdentity("a/b", nil, "a/b", true)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = c.ACLIdentity("a/b", nil, "c/d", true)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = c.ACLIdentity("x/y", nil, "a/b", true)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
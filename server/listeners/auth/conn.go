@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/csymapp/mqtt/server/internal/packets"
+)
+
+// ConnInfo contains the details of a connecting client which are available to
+// an auth controller when authenticating the client.
+type ConnInfo struct {
+	Listener   string // the id of the listener the client connected to.
+	RemoteAddr string // the remote address of the client connection.
+	ClientID   string // the client id, generated by the server if none was requested.
+	Username   []byte // the username from the connect packet.
+	Password   []byte // the password from the connect packet.
+
+	UserProperties []packets.UserProperty // the mqtt v5 user properties from the connect packet, in order.
+
+	// The following fields are only set for tls connections.
+	ServerName  string            // the server name (SNI) requested by the client.
+	Certificate *x509.Certificate // the client certificate, if one was presented.
+	CommonName  string            // the subject common name of the client certificate.
+	SANs        []string          // the subject alternative names of the client certificate.
+}
+
+// SetTLS sets the tls details of the connection info from the state of a tls
+// connection. If the client presented a certificate, the leaf certificate and
+// its common name and subject alternative names are set.
+func (i *ConnInfo) SetTLS(cs tls.ConnectionState) {
+	i.ServerName = cs.ServerName
+	if len(cs.PeerCertificates) == 0 {
+		return
+	}
+
+	cert := cs.PeerCertificates[0]
+	i.Certificate = cert
+	i.CommonName = cert.Subject.CommonName
+	i.SANs = make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	i.SANs = append(i.SANs, cert.DNSNames...)
+	i.SANs = append(i.SANs, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		i.SANs = append(i.SANs, ip.String())
+	}
+	for _, u := range cert.URIs {
+		i.SANs = append(i.SANs, u.String())
+	}
+}
+
+// ConnController is a Controller which can authenticate clients using the
+// details of their connection, for example to restrict clients by remote address
+// or to pin credentials to a particular client id.
+type ConnController interface {
+	Controller
+
+	// AuthenticateConn authenticates a client on CONNECT. The result and error
+	// are handled in the same way as those of Authenticate.
+	AuthenticateConn(info ConnInfo) (interface{}, error)
+}
+
+// Conn returns a ConnController for an auth controller. Controllers which
+// already implement ConnController are returned as-is, and controllers which
+// only implement Authenticate are wrapped so that AuthenticateConn calls
+// Authenticate with the username and password from the connection info.
+func Conn(ac Controller) ConnController {
+	if cc, ok := ac.(ConnController); ok {
+		return cc
+	}
+
+	return &connAdapter{ac}
+}
+
+// connAdapter adapts a Controller to the ConnController interface.
+type connAdapter struct {
+	Controller
+}
+
+// AuthenticateConn authenticates the username and password of the connection.
+func (a *connAdapter) AuthenticateConn(info ConnInfo) (interface{}, error) {
+	return a.Authenticate(info.Username, info.Password)
+}
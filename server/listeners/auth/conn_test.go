@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// addrAuth only allows connections from a single remote address.
+type addrAuth struct {
+	Allow
+	addr string
+}
+
+func (a *addrAuth) AuthenticateConn(info ConnInfo) (interface{}, error) {
+	if info.RemoteAddr != a.addr {
+		return nil, errors.New("address not allowed")
+	}
+
+	return info.ClientID, nil
+}
+
+func TestConnPassthrough(t *testing.T) {
+	ac := &addrAuth{addr: "127.0.0.1"}
+	cc := Conn(ac)
+	require.Equal(t, ac, cc)
+
+	res, err := cc.AuthenticateConn(ConnInfo{RemoteAddr: "127.0.0.1", ClientID: "mochi"})
+	require.NoError(t, err)
+	require.Equal(t, "mochi", res)
+
+	_, err = cc.AuthenticateConn(ConnInfo{RemoteAddr: "10.0.0.1"})
+	require.Error(t, err)
+}
+
+func TestConnAdapter(t *testing.T) {
+	cc := Conn(new(Allow))
+	_, err := cc.AuthenticateConn(ConnInfo{Username: []byte("user"), Password: []byte("pass")})
+	require.NoError(t, err)
+	require.True(t, cc.ACL([]byte("user"), "topic", true))
+
+	cc = Conn(new(Disallow))
+	_, err = cc.AuthenticateConn(ConnInfo{Username: []byte("user"), Password: []byte("pass")})
+	require.Error(t, err)
+	require.False(t, cc.ACL([]byte("user"), "topic", true))
+}
+
+func TestConnInfoSetTLS(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "mochi"},
+		DNSNames:       []string{"mochi.io"},
+		EmailAddresses: []string{"mochi@mochi.io"},
+		IPAddresses:    []net.IP{net.ParseIP("127.0.0.1")},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "mochi.io", Path: "/client"}},
+	}
+
+	var info ConnInfo
+	info.SetTLS(tls.ConnectionState{
+		ServerName:       "tenant.mochi.io",
+		PeerCertificates: []*x509.Certificate{cert},
+	})
+
+	require.Equal(t, "tenant.mochi.io", info.ServerName)
+	require.Equal(t, cert, info.Certificate)
+	require.Equal(t, "mochi", info.CommonName)
+	require.Equal(t, []string{"mochi.io", "mochi@mochi.io", "127.0.0.1", "spiffe://mochi.io/client"}, info.SANs)
+}
+
+func TestConnInfoSetTLSNoCertificate(t *testing.T) {
+	var info ConnInfo
+	info.SetTLS(tls.ConnectionState{ServerName: "tenant.mochi.io"})
+	require.Equal(t, ConnInfo{ServerName: "tenant.mochi.io"}, info)
+}
@@ -8,7 +8,8 @@ import (
 
 func TestAllowAuth(t *testing.T) {
 	ac := new(Allow)
-	require.Equal(t, true, ac.Authenticate([]byte("user"), []byte("pass")))
+	_, err := ac.Authenticate([]byte("user"), []byte("pass"))
+	require.NoError(t, err)
 }
 
 func BenchmarkAllowAuth(b *testing.B) {
@@ -32,7 +33,8 @@ func BenchmarkAllowACL(b *testing.B) {
 
 func TestDisallowAuth(t *testing.T) {
 	ac := new(Disallow)
-	require.Equal(t, false, ac.Authenticate([]byte("user"), []byte("pass")))
+	_, err := ac.Authenticate([]byte("user"), []byte("pass"))
+	require.Error(t, err)
 }
 
 func BenchmarkDisallowAuth(b *testing.B) {
@@ -0,0 +1,33 @@
+package auth
+
+import "errors"
+
+// ErrBadAuthMethod indicates that a client requested an enhanced authentication
+// method which is not supported.
+var ErrBadAuthMethod = errors.New("unsupported authentication method")
+
+// Challenger carries out the MQTT v5 enhanced authentication exchange of a
+// single connection, such as a SCRAM challenge and response.
+type Challenger interface {
+
+	// Challenge is called with the authentication method and data sent by the
+	// client, first in its CONNECT and then in each AUTH packet it replies with.
+	// If done is false, response is sent to the client in an AUTH packet to
+	// continue the exchange. If done is true, the client is authenticated and
+	// response is sent to it in the CONNACK. A non-nil error refuses the
+	// connection, with the bad authentication method reason code if the error
+	// is ErrBadAuthMethod.
+	Challenge(method string, data []byte) (response []byte, done bool, err error)
+}
+
+// EnhancedController is a Controller which supports MQTT v5 enhanced
+// authentication. Clients which set an authentication method in their CONNECT
+// are authenticated by a Challenger instead of by Authenticate, while all other
+// clients are authenticated as usual.
+type EnhancedController interface {
+	Controller
+
+	// NewChallenger returns a Challenger for the enhanced authentication of a
+	// connecting client.
+	NewChallenger(info ConnInfo) Challenger
+}
@@ -0,0 +1,273 @@
+// Package file provides an auth controller which loads users, bcrypt or argon2id
+// password hashes, and per-user ACL rules from a YAML or JSON file.
+//
+// An example file:
+//
+//	users:
+//	  mochi:
+//	    password: $2a$10$...
+//	    acl:
+//	      - topic: sensors/secret/#
+//	        deny: true
+//	      - topic: sensors/#
+//	        access: read
+//	      - topic: devices/mochi/#
+//
+// ACL rules are checked in order, and the first rule which matches both the
+// topic and the type of access decides the result. Access may be read, write,
+// or readwrite (the default). Topics not matched by any rule are denied. A
+// subscription is denied by a deny rule which matches any of the topics the
+// subscription could receive, so in the example a subscription to sensors/#
+// is denied, while one to sensors/kitchen/# is allowed.
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/csymapp/mqtt/server/listeners/auth"
+)
+
+const (
+	// AccessRead grants read (subscribe) access to a topic.
+	AccessRead = "read"
+
+	// AccessWrite grants write (publish) access to a topic.
+	AccessWrite = "write"
+
+	// AccessReadWrite grants read and write access to a topic.
+	AccessReadWrite = "readwrite"
+)
+
+var (
+	// ErrInvalidCredentials indicates the username or password was incorrect.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+
+	// ErrInvalidAccess indicates a rule has an unknown access value.
+	ErrInvalidAccess = errors.New("invalid rule access")
+
+	// ErrMissingTopic indicates a rule has no topic.
+	ErrMissingTopic = errors.New("rule has no topic")
+)
+
+// Rule is an ACL rule for a topic filter.
+type Rule struct {
+	Topic  string `yaml:"topic" json:"topic"`                       // the topic filter the rule applies to.
+	Access string `yaml:"access,omitempty" json:"access,omitempty"` // read, write, or readwrite (default).
+	Deny   bool   `yaml:"deny,omitempty" json:"deny,omitempty"`     // deny rather than allow access.
+}
+
+// User is the password hash and ACL rules of a user.
+type User struct {
+	Password string `yaml:"password" json:"password"`           // the bcrypt or argon2id hash of the password.
+	ACL      []Rule `yaml:"acl,omitempty" json:"acl,omitempty"` // the ordered ACL rules.
+}
+
+// Ledger is the contents of an auth file.
+type Ledger struct {
+	Users map[string]User `yaml:"users" json:"users"` // users keyed on username.
+}
+
+// Controller is an auth controller backed by a YAML or JSON file.
+type Controller struct {
+	sync.RWMutex
+	path   string              // the path to the auth file.
+	users  map[string]User     // the users loaded from the file.
+	dummy  string              // a password hash compared for unknown users.
+	hasher auth.PasswordHasher // compares passwords with hashes; nil detects the algorithm.
+}
+
+// New returns a new file auth controller, loading the users from the file at
+// path. Files with a .json extension are decoded as JSON, otherwise as YAML.
+func New(path string) (*Controller, error) {
+	return NewWithHasher(path, nil)
+}
+
+// NewWithHasher returns a new file auth controller which compares passwords
+// using the given hasher. If hasher is nil, the algorithm of each password hash
+// is detected from its prefix.
+func NewWithHasher(path string, hasher auth.PasswordHasher) (*Controller, error) {
+	c := &Controller{
+		path:   path,
+		hasher: hasher,
+	}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload reads the auth file again, replacing the loaded users. If the file
+// cannot be loaded, the previously loaded users are kept.
+func (c *Controller) Reload() error {
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return fmt.Errorf("read auth file: %w", err)
+	}
+
+	var l Ledger
+	if strings.EqualFold(filepath.Ext(c.path), ".json") {
+		err = json.Unmarshal(b, &l)
+	} else {
+		err = yaml.Unmarshal(b, &l)
+	}
+	if err != nil {
+		return fmt.Errorf("decode auth file: %w", err)
+	}
+
+	if err := l.validate(); err != nil {
+		return err
+	}
+
+	// Unknown users are compared against the hash of a loaded user, so that
+	// they take as long to reject as known users and cannot be told apart.
+	var dummy string
+	for _, u := range l.Users {
+		dummy = u.Password
+		break
+	}
+
+	c.Lock()
+	c.users = l.Users
+	c.dummy = dummy
+	c.Unlock()
+
+	return nil
+}
+
+// ReloadOnSignal reloads the auth file whenever the process receives SIGHUP.
+// Any error encountered while reloading is passed to onError, if set. The
+// returned function stops listening for the signal.
+func (c *Controller) ReloadOnSignal(onError func(error)) (stop func()) {
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-sig:
+				if err := c.Reload(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(sig)
+			close(done)
+		})
+	}
+}
+
+// validate checks that the users and rules in the ledger are well formed.
+func (l *Ledger) validate() error {
+	for name, u := range l.Users {
+		if err := auth.ValidateHash(u.Password); err != nil {
+			return fmt.Errorf("user %s: %w", name, err)
+		}
+
+		for i, r := range u.ACL {
+			if r.Topic == "" {
+				return fmt.Errorf("user %s rule %d: %w", name, i, ErrMissingTopic)
+			}
+
+			switch r.Access {
+			case "", AccessRead, AccessWrite, AccessReadWrite:
+			default:
+				return fmt.Errorf("user %s rule %d %q: %w", name, i, r.Access, ErrInvalidAccess)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Authenticate returns nil if the password matches the user's password hash.
+func (c *Controller) Authenticate(user, password []byte) (interface{}, error) {
+	c.RLock()
+	u, ok := c.users[string(user)]
+	dummy := c.dummy
+	c.RUnlock()
+	if !ok {
+		c.compare(dummy, password)
+		return nil, ErrInvalidCredentials
+	}
+
+	if !c.compare(u.Password, password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return nil, nil
+}
+
+// compare returns true if the password matches the hash.
+func (c *Controller) compare(hash string, password []byte) bool {
+	if c.hasher == nil {
+		return auth.DetectAndCompare(hash, password)
+	}
+
+	return c.hasher.Compare(hash, password)
+}
+
+// ACL returns true if the first of the user's rules to match the topic and
+// type of access allows it. When subscribing, deny rules match any filter
+// they overlap, rather than only the filters they wholly cover, so that a
+// wider subscription cannot receive the messages of a denied topic.
+func (c *Controller) ACL(user []byte, topic string, write bool) bool {
+	c.RLock()
+	u, ok := c.users[string(user)]
+	c.RUnlock()
+	if !ok {
+		return false
+	}
+
+	for _, r := range u.ACL {
+		if !r.covers(write) {
+			continue
+		}
+
+		if r.Deny && !write && auth.OverlapTopic(r.Topic, topic) {
+			return false
+		}
+
+		if !auth.MatchTopic(r.Topic, topic) {
+			continue
+		}
+
+		return !r.Deny
+	}
+
+	return false
+}
+
+// covers returns true if the rule applies to the type of access.
+func (r Rule) covers(write bool) bool {
+	switch r.Access {
+	case AccessRead:
+		return !write
+	case AccessWrite:
+		return write
+	}
+
+	return true
+}
+
+// check the controller satisfies the auth.Controller interface.
+var _ auth.Controller = (*Controller)(nil)
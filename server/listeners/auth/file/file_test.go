@@ -0,0 +1,275 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/csymapp/mqtt/server/listeners/auth"
+)
+
+func hashPassword(t *testing.T, password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(h)
+}
+
+func writeFile(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+	return path
+}
+
+func yamlLedger(t *testing.T) string {
+	return `users:
+  mochi:
+    password: ` + hashPassword(t, "melon") + `
+    acl:
+      - topic: sensors/secret/#
+        deny: true
+      - topic: sensors/#
+        access: read
+      - topic: devices/mochi/#
+      - topic: commands/+
+        access: write
+`
+}
+
+func TestSatisfies(t *testing.T) {
+	var x auth.Controller
+	x, err := New(writeFile(t, "auth.yml", yamlLedger(t)))
+	require.NoError(t, err)
+	require.NotNil(t, x)
+}
+
+func TestNewYAML(t *testing.T) {
+	c, err := New(writeFile(t, "auth.yml", yamlLedger(t)))
+	require.NoError(t, err)
+	require.Contains(t, c.users, "mochi")
+	require.Len(t, c.users["mochi"].ACL, 4)
+	require.True(t, c.users["mochi"].ACL[0].Deny)
+	require.Equal(t, AccessRead, c.users["mochi"].ACL[1].Access)
+}
+
+func TestNewJSON(t *testing.T) {
+	path := writeFile(t, "auth.json", `{"users": {"mochi": {
+		"password": "`+hashPassword(t, "melon")+`",
+		"acl": [{"topic": "a/#", "access": "write"}]
+	}}}`)
+
+	c, err := New(path)
+	require.NoError(t, err)
+	require.Equal(t, []Rule{{Topic: "a/#", Access: AccessWrite}}, c.users["mochi"].ACL)
+}
+
+func TestNewFailures(t *testing.T) {
+	hash := hashPassword(t, "melon")
+
+	tt := []struct {
+		desc string
+		name string
+		data string
+		err  error
+	}{
+		{"bad yaml", "auth.yml", "users: [", nil},
+		{"bad json", "auth.json", "{", nil},
+		{"bad hash", "auth.yml", "users:\n  mochi:\n    password: melon\n", bcrypt.ErrHashTooShort},
+		{"bad argon2 hash", "auth.yml", "users:\n  mochi:\n    password: $argon2id$v=19$m=64\n", auth.ErrInvalidArgon2Hash},
+		{"no topic", "auth.yml", "users:\n  mochi:\n    password: " + hash + "\n    acl:\n      - access: read\n", ErrMissingTopic},
+		{"bad access", "auth.yml", "users:\n  mochi:\n    password: " + hash + "\n    acl:\n      - topic: a\n        access: all\n", ErrInvalidAccess},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			_, err := New(writeFile(t, tx.name, tx.data))
+			require.Error(t, err)
+			if tx.err != nil {
+				require.ErrorIs(t, err, tx.err)
+			}
+		})
+	}
+
+	_, err := New(filepath.Join(t.TempDir(), "missing.yml"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestAuthenticate(t *testing.T) {
+	c, err := New(writeFile(t, "auth.yml", yamlLedger(t)))
+	require.NoError(t, err)
+
+	res, err := c.Authenticate([]byte("mochi"), []byte("melon"))
+	require.NoError(t, err)
+	require.Nil(t, res)
+
+	_, err = c.Authenticate([]byte("mochi"), []byte("lemon"))
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+
+	_, err = c.Authenticate([]byte("zen"), []byte("melon"))
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+// countingHasher is a password hasher which counts its comparisons.
+type countingHasher struct {
+	auth.BcryptHasher
+	compares int
+}
+
+func (h *countingHasher) Compare(hash string, password []byte) bool {
+	h.compares++
+	return h.BcryptHasher.Compare(hash, password)
+}
+
+func TestAuthenticateUnknownUserCompares(t *testing.T) {
+	h := new(countingHasher)
+	c, err := NewWithHasher(writeFile(t, "auth.yml", yamlLedger(t)), h)
+	require.NoError(t, err)
+
+	// unknown users are compared against a hash, so they are not rejected
+	// any faster than known users.
+	_, err = c.Authenticate([]byte("zen"), []byte("melon"))
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	require.Equal(t, 1, h.compares)
+
+	_, err = c.Authenticate([]byte("zen"), []byte(""))
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	require.Equal(t, 2, h.compares)
+}
+
+func TestAuthenticateArgon2(t *testing.T) {
+	h, err := auth.Argon2Hasher{Time: 1, Memory: 64, Threads: 1}.Hash([]byte("melon"))
+	require.NoError(t, err)
+
+	c, err := New(writeFile(t, "auth.yml", "users:\n  mochi:\n    password: "+h+"\n  zen:\n    password: "+hashPassword(t, "lemon")+"\n"))
+	require.NoError(t, err)
+
+	_, err = c.Authenticate([]byte("mochi"), []byte("melon"))
+	require.NoError(t, err)
+
+	_, err = c.Authenticate([]byte("mochi"), []byte("lemon"))
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+
+	_, err = c.Authenticate([]byte("zen"), []byte("lemon"))
+	require.NoError(t, err)
+}
+
+func TestNewWithHasher(t *testing.T) {
+	h, err := auth.Argon2Hasher{Time: 1, Memory: 64, Threads: 1}.Hash([]byte("melon"))
+	require.NoError(t, err)
+
+	c, err := NewWithHasher(writeFile(t, "auth.yml", "users:\n  mochi:\n    password: "+h+"\n  zen:\n    password: "+hashPassword(t, "lemon")+"\n"), auth.Argon2Hasher{})
+	require.NoError(t, err)
+
+	_, err = c.Authenticate([]byte("mochi"), []byte("melon"))
+	require.NoError(t, err)
+
+	// the bcrypt hash is not compared by the argon2 hasher.
+	_, err = c.Authenticate([]byte("zen"), []byte("lemon"))
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestACL(t *testing.T) {
+	c, err := New(writeFile(t, "auth.yml", yamlLedger(t)))
+	require.NoError(t, err)
+
+	user := []byte("mochi")
+	tt := []struct {
+		topic string
+		write bool
+		allow bool
+	}{
+		{"sensors/temp", false, true},
+		{"sensors/temp", true, false},
+		{"sensors", false, true},
+		{"sensors/secret/key", false, false},
+		{"sensors/kitchen/+", false, true},
+		{"sensors/kitchen/#", false, true},
+		{"sensors/+", false, false}, // matches sensors/secret.
+		{"sensors/#", false, false},
+		{"sensors/+/key", false, false},
+		{"#", false, false},
+		{"devices/mochi/state", true, true},
+		{"devices/mochi/state", false, true},
+		{"devices/zen/state", true, false},
+		{"commands/reboot", true, true},
+		{"commands/reboot", false, false},
+		{"commands/a/b", true, false},
+		{"other", true, false},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.allow, c.ACL(user, tx.topic, tx.write), tx.topic)
+	}
+
+	require.False(t, c.ACL([]byte("zen"), "sensors/temp", false))
+}
+
+func TestReload(t *testing.T) {
+	path := writeFile(t, "auth.yml", yamlLedger(t))
+	c, err := New(path)
+	require.NoError(t, err)
+
+	_, err = c.Authenticate([]byte("zen"), []byte("lemon"))
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+
+	require.NoError(t, os.WriteFile(path, []byte("users:\n  zen:\n    password: "+hashPassword(t, "lemon")+"\n"), 0600))
+	require.NoError(t, c.Reload())
+
+	_, err = c.Authenticate([]byte("zen"), []byte("lemon"))
+	require.NoError(t, err)
+	_, err = c.Authenticate([]byte("mochi"), []byte("melon"))
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestReloadFailureKeepsUsers(t *testing.T) {
+	path := writeFile(t, "auth.yml", yamlLedger(t))
+	c, err := New(path)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("users: ["), 0600))
+	require.Error(t, c.Reload())
+
+	_, err = c.Authenticate([]byte("mochi"), []byte("melon"))
+	require.NoError(t, err)
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	path := writeFile(t, "auth.yml", yamlLedger(t))
+	c, err := New(path)
+	require.NoError(t, err)
+
+	errs := make(chan error, 1)
+	stop := c.ReloadOnSignal(func(err error) {
+		errs <- err
+	})
+	defer stop()
+
+	require.NoError(t, os.WriteFile(path, []byte("users:\n  zen:\n    password: "+hashPassword(t, "lemon")+"\n"), 0600))
+
+	p, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, p.Signal(syscall.SIGHUP))
+
+	require.Eventually(t, func() bool {
+		_, err := c.Authenticate([]byte("zen"), []byte("lemon"))
+		return err == nil
+	}, time.Second, time.Millisecond*5)
+
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, p.Signal(syscall.SIGHUP))
+
+	select {
+	case err := <-errs:
+		require.True(t, errors.Is(err, os.ErrNotExist))
+	case <-time.After(time.Second):
+		t.Fatal("expected reload error")
+	}
+
+	stop()
+	stop()
+}
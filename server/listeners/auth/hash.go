@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords and compares them with stored hashes, for
+// auth controllers which keep password hashes rather than passwords.
+type PasswordHasher interface {
+
+	// Hash returns the encoded hash of a password, including the algorithm
+	// and the cost parameters used.
+	Hash(password []byte) (string, error)
+
+	// Compare returns true if the password matches the hash.
+	Compare(hash string, password []byte) bool
+}
+
+// BcryptHasher hashes passwords with bcrypt.
+type BcryptHasher struct {
+	Cost int // the bcrypt cost, from bcrypt.MinCost to bcrypt.MaxCost; 0 uses the default.
+}
+
+// Hash returns the bcrypt hash of the password.
+func (h BcryptHasher) Hash(password []byte) (string, error) {
+	cost := h.Cost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	b, err := bcrypt.GenerateFromPassword(password, cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Compare returns true if the password matches the bcrypt hash.
+func (h BcryptHasher) Compare(hash string, password []byte) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+}
+
+// Argon2Hasher hashes passwords with argon2id. Any unset parameters use the
+// recommended defaults.
+type Argon2Hasher struct {
+	Time    uint32 // the number of passes over the memory.
+	Memory  uint32 // the amount of memory used, in KiB.
+	Threads uint8  // the number of lanes processed in parallel.
+	KeyLen  uint32 // the length in bytes of the derived hash.
+}
+
+// Hash returns the argon2id hash of the password in the PHC string format.
+func (h Argon2Hasher) Hash(password []byte) (string, error) {
+	return encodeArgon2(password, h)
+}
+
+// Compare returns true if the password matches the argon2id hash. The cost
+// parameters are read from the hash, so hashes made with other parameters
+// are still compared correctly.
+func (h Argon2Hasher) Compare(hash string, password []byte) bool {
+	return compareArgon2(hash, password)
+}
+
+// hasherFor returns a hasher able to compare the hash, chosen by the
+// algorithm prefix of the hash.
+func hasherFor(hash string) PasswordHasher {
+	switch {
+	case strings.HasPrefix(hash, argon2Prefix):
+		return Argon2Hasher{}
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return BcryptHasher{}
+	}
+
+	return nil
+}
+
+// DetectAndCompare returns true if the password matches the hash, using the
+// algorithm given by the prefix of the hash. Hashes of unknown algorithms
+// never match.
+func DetectAndCompare(hash string, password []byte) bool {
+	h := hasherFor(hash)
+	if h == nil {
+		return false
+	}
+
+	return h.Compare(hash, password)
+}
+
+// ValidateHash returns an error if the hash is not a well-formed hash of a
+// supported algorithm. Hashes without an argon2id prefix are checked as bcrypt.
+func ValidateHash(hash string) error {
+	if _, ok := hasherFor(hash).(Argon2Hasher); ok {
+		_, _, _, err := decodeArgon2(hash)
+		return err
+	}
+
+	_, err := bcrypt.Cost([]byte(hash))
+	return err
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashersSatisfy(t *testing.T) {
+	var h PasswordHasher
+	require.Implements(t, &h, BcryptHasher{})
+	require.Implements(t, &h, Argon2Hasher{})
+}
+
+func TestBcryptHasher(t *testing.T) {
+	h := BcryptHasher{Cost: bcrypt.MinCost}
+	hash, err := h.Hash([]byte("melon"))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$2a$04$"))
+
+	require.True(t, h.Compare(hash, []byte("melon")))
+	require.False(t, h.Compare(hash, []byte("melons")))
+	require.False(t, h.Compare("melon", []byte("melon")))
+}
+
+func TestBcryptHasherInvalidCost(t *testing.T) {
+	_, err := BcryptHasher{Cost: bcrypt.MaxCost + 1}.Hash([]byte("melon"))
+	require.IsType(t, bcrypt.InvalidCostError(0), err)
+}
+
+func TestArgon2Hasher(t *testing.T) {
+	h := Argon2Hasher{Time: 1, Memory: 64, Threads: 1}
+	hash, err := h.Hash([]byte("melon"))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$"))
+
+	require.True(t, h.Compare(hash, []byte("melon")))
+	require.False(t, h.Compare(hash, []byte("melons")))
+	require.False(t, h.Compare("melon", []byte("melon")))
+
+	// hashes made with other parameters still compare.
+	require.True(t, Argon2Hasher{}.Compare(hash, []byte("melon")))
+}
+
+func TestDetectAndCompare(t *testing.T) {
+	bh, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash([]byte("melon"))
+	require.NoError(t, err)
+
+	ah, err := Argon2Hasher{Time: 1, Memory: 64, Threads: 1}.Hash([]byte("melon"))
+	require.NoError(t, err)
+
+	require.True(t, DetectAndCompare(bh, []byte("melon")))
+	require.False(t, DetectAndCompare(bh, []byte("melons")))
+	require.True(t, DetectAndCompare("$2y"+bh[3:], []byte("melon")))
+	require.True(t, DetectAndCompare(ah, []byte("melon")))
+	require.False(t, DetectAndCompare(ah, []byte("melons")))
+	require.False(t, DetectAndCompare("melon", []byte("melon")))
+	require.False(t, DetectAndCompare("", nil))
+}
+
+func TestValidateHash(t *testing.T) {
+	bh, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash([]byte("melon"))
+	require.NoError(t, err)
+
+	ah, err := Argon2Hasher{Time: 1, Memory: 64, Threads: 1}.Hash([]byte("melon"))
+	require.NoError(t, err)
+
+	require.NoError(t, ValidateHash(bh))
+	require.NoError(t, ValidateHash(ah))
+	require.ErrorIs(t, ValidateHash("melon"), bcrypt.ErrHashTooShort)
+	require.ErrorIs(t, ValidateHash("$argon2id$v=19$m=64"), ErrInvalidArgon2Hash)
+}
@@ -0,0 +1,39 @@
+package auth
+
+// IdentityController is a Controller whose access decisions depend on the
+// value returned by Authenticate for the client being checked, such as the
+// claims of the token it connected with, rather than on the username alone.
+// The results are not cached, as they may differ between clients with the
+// same username.
+type IdentityController interface {
+	Controller
+
+	// ACLIdentity returns true if a client has read or write access to a given
+	// topic. identity is the value returned by Authenticate or AuthenticateConn
+	// when the client connected, which is nil for clients which were not
+	// authenticated. A non-nil error indicates that the check could not be
+	// made, as for ErrorController.
+	ACLIdentity(identity interface{}, user []byte, topic string, write bool) (allowed bool, err error)
+}
+
+// WithIdentity returns an IdentityController for an auth controller.
+// Controllers which already implement IdentityController are returned as-is,
+// and other controllers are wrapped so that ACLIdentity ignores the identity
+// and calls ACLWithError.
+func WithIdentity(ac Controller) IdentityController {
+	if ic, ok := ac.(IdentityController); ok {
+		return ic
+	}
+
+	return &identityAdapter{WithError(ac)}
+}
+
+// identityAdapter adapts a Controller to the IdentityController interface.
+type identityAdapter struct {
+	ErrorController
+}
+
+// ACLIdentity checks the topic access of the user, without the identity.
+func (a *identityAdapter) ACLIdentity(identity interface{}, user []byte, topic string, write bool) (bool, error) {
+	return a.ACLWithError(user, topic, write)
+}
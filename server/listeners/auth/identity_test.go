@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// identityAuth allows access to the topic named by the identity.
+type identityAuth struct {
+	Disallow
+}
+
+func (a *identityAuth) ACLIdentity(identity interface{}, user []byte, topic string, write bool) (bool, error) {
+	return identity == topic, nil
+}
+
+func TestWithIdentityPassthrough(t *testing.T) {
+	ac := new(identityAuth)
+	ic := WithIdentity(ac)
+	require.Equal(t, ac, ic)
+
+	ok, err := ic.ACLIdentity("a/b", []byte("user"), "a/b", true)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = ic.ACLIdentity("a/c", []byte("user"), "a/b", true)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestWithIdentityAdapter(t *testing.T) {
+	ok, err := WithIdentity(new(Allow)).ACLIdentity(nil, []byte("user"), "topic", true)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = WithIdentity(new(failingAuth)).ACLIdentity("ignored", []byte("user"), "topic", true)
+	require.Error(t, err)
+	require.False(t, ok)
+}
@@ -0,0 +1,227 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownKey indicates that no key matching the token kid could be found.
+	ErrUnknownKey = errors.New("unknown signing key")
+)
+
+// jwk is a single JSON Web Key as found in a JWKS document.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwks fetches and caches the public keys published at a JWKS URL. Keys are
+// fetched in the background, so that a slow or unavailable key server does not
+// hold up the clients whose keys are already cached.
+type jwks struct {
+	sync.RWMutex
+	url      string                 // the url of the JWKS document.
+	client   *http.Client           // the http client used to fetch the document.
+	refresh  time.Duration          // how often the keys should be refetched.
+	minWait  time.Duration          // the minimum time between fetches.
+	keys     map[string]interface{} // the public keys, keyed on kid.
+	err      error                  // the error of the last fetch, if it failed.
+	fetched  time.Time              // when the keys were last fetched.
+	attempts time.Time              // when a fetch was last started.
+	done     chan struct{}          // closed when the fetch in progress ends; nil if none.
+}
+
+// key returns the public key for a kid. Cached keys are returned at once, and
+// refreshed in the background once they are stale. Unknown kids wait for the
+// keys to be fetched again, unless they were fetched within the minimum wait.
+func (j *jwks) key(kid string) (interface{}, error) {
+	j.RLock()
+	k, ok := j.keys[kid]
+	stale := time.Since(j.fetched) > j.refresh
+	j.RUnlock()
+
+	if ok {
+		if stale {
+			j.start()
+		}
+		return k, nil
+	}
+
+	if done := j.start(); done != nil {
+		<-done
+	}
+
+	j.RLock()
+	defer j.RUnlock()
+
+	k, ok = j.keys[kid]
+	switch {
+	case ok:
+		return k, nil
+	case j.keys == nil && j.err != nil:
+		return nil, j.err
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// start starts fetching the keys in the background, returning a channel which
+// is closed when the fetch ends. If a fetch is already in progress, its channel
+// is returned instead. To avoid hammering the key server, such as with tokens
+// bearing unknown key ids, nil is returned if a fetch was started within the
+// minimum wait.
+func (j *jwks) start() <-chan struct{} {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.done != nil {
+		return j.done
+	}
+
+	if !j.attempts.IsZero() && time.Since(j.attempts) < j.minWait {
+		return nil
+	}
+
+	j.attempts = time.Now()
+	j.done = make(chan struct{})
+	go j.update(j.done)
+	return j.done
+}
+
+// update fetches the keys and replaces the cached keys, keeping them if the
+// fetch fails, then closes done.
+func (j *jwks) update(done chan struct{}) {
+	keys, err := j.fetch()
+
+	j.Lock()
+	j.err = err
+	if err == nil {
+		j.keys = keys
+		j.fetched = time.Now()
+	}
+	j.done = nil
+	j.Unlock()
+
+	close(done)
+}
+
+// fetch retrieves and decodes the JWKS document.
+func (j *jwks) fetch() (map[string]interface{}, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks: unexpected status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode jwks: %w", err)
+	}
+
+	keys := make(map[string]interface{}, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.publicKey()
+		if err != nil {
+			continue // skip keys we don't understand, rather than failing the whole set.
+		}
+		keys[k.Kid] = pub
+	}
+
+	return keys, nil
+}
+
+// publicKey decodes the public key held by the jwk.
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key size")
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer.
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,304 @@
+// Package jwt provides an auth controller which authenticates clients using
+// JSON Web Tokens passed in the password field of the CONNECT packet.
+//
+// A successful Authenticate returns the decoded token Claims. Claims implements
+// auth.Principal, so the server identifies the client by the token subject
+// ("sub"). The server keeps the claims of each client and passes them to
+// ACLIdentity, which checks access against the scopes of the token the client
+// connected with, so clients with the same subject but different tokens are
+// each limited to their own scopes.
+package jwt
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/csymapp/mqtt/server/listeners/auth"
+)
+
+const (
+	// defaultScopeClaim is the default name of the claim containing the ACL scopes.
+	defaultScopeClaim = "scope"
+
+	// defaultJWKSRefresh is the default interval at which JWKS keys are refetched.
+	defaultJWKSRefresh = time.Hour
+
+	// jwksMinWait is the minimum time between JWKS fetches.
+	jwksMinWait = time.Minute
+
+	// defaultJWKSTimeout is how long a JWKS fetch may take with the default
+	// http client.
+	defaultJWKSTimeout = 10 * time.Second
+)
+
+var (
+	// ErrNoKey indicates that neither a key nor a JWKS url was configured.
+	ErrNoKey = errors.New("no verification key configured")
+
+	// ErrTokenExpired indicates the token exp claim has passed.
+	ErrTokenExpired = errors.New("token expired")
+
+	// ErrTokenNotYetValid indicates the token nbf claim has not been reached.
+	ErrTokenNotYetValid = errors.New("token not yet valid")
+
+	// ErrMissingExpiry indicates the token does not carry an exp claim.
+	ErrMissingExpiry = errors.New("token has no expiry")
+
+	// ErrMissingSubject indicates the token does not carry a sub claim.
+	ErrMissingSubject = errors.New("token has no subject")
+
+	// ErrInvalidIssuer indicates the token iss claim did not match.
+	ErrInvalidIssuer = errors.New("invalid token issuer")
+
+	// ErrInvalidAudience indicates the token aud claim did not match.
+	ErrInvalidAudience = errors.New("invalid token audience")
+)
+
+// Options contains configurable options for the JWT controller.
+type Options struct {
+	// Key is a static key used to verify token signatures. It must be a []byte
+	// secret for HS* algorithms, an *rsa.PublicKey for RS* and PS*, an
+	// *ecdsa.PublicKey for ES*, or an ed25519.PublicKey for EdDSA.
+	Key interface{}
+
+	// JWKSURL is the url of a JWKS document containing the public keys used to
+	// verify token signatures, selected by the token kid header. It is used
+	// instead of Key if set.
+	JWKSURL string
+
+	// JWKSRefresh is how often the JWKS document is refetched (default 1 hour).
+	// Stale keys continue to be used while they are refetched in the background,
+	// and the document is fetched at most once a minute.
+	JWKSRefresh time.Duration
+
+	// HTTPClient is the client used to fetch the JWKS document (default a
+	// client with a 10 second timeout). Clients without a timeout may leave
+	// tokens with unknown key ids waiting for as long as the key server does.
+	HTTPClient *http.Client
+
+	// Issuer, if set, must match the token iss claim.
+	Issuer string
+
+	// Audience, if set, must be present in the token aud claim.
+	Audience string
+
+	// ScopeClaim is the name of the claim containing the ACL scopes (default "scope").
+	// The claim may be a space separated string or an array of strings. Each scope
+	// is a topic filter prefixed with "pub:" for write access or "sub:" for read
+	// access, eg. "pub:sensors/#" or "sub:+/status".
+	ScopeClaim string
+
+	// Leeway is the allowed clock skew when checking the exp and nbf claims.
+	Leeway time.Duration
+}
+
+// Controller is an auth controller which authenticates clients with JWTs.
+type Controller struct {
+	opts Options          // the controller options.
+	jwks *jwks            // the JWKS key cache, if a JWKS url is configured.
+	now  func() time.Time // the current time (for testing).
+}
+
+// New returns a new JWT auth controller.
+func New(o *Options) *Controller {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+
+	if opts.ScopeClaim == "" {
+		opts.ScopeClaim = defaultScopeClaim
+	}
+
+	if opts.JWKSRefresh == 0 {
+		opts.JWKSRefresh = defaultJWKSRefresh
+	}
+
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: defaultJWKSTimeout}
+	}
+
+	c := &Controller{
+		opts: opts,
+		now:  time.Now,
+	}
+
+	if opts.JWKSURL != "" {
+		c.jwks = &jwks{
+			url:     opts.JWKSURL,
+			client:  opts.HTTPClient,
+			refresh: opts.JWKSRefresh,
+			minWait: jwksMinWait,
+		}
+	}
+
+	return c
+}
+
+// Authenticate verifies the token passed in the password field and returns the
+// decoded Claims. The username field is not used.
+func (c *Controller) Authenticate(user, password []byte) (interface{}, error) {
+	claims, err := c.Verify(string(password))
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// Verify parses a token, checks its signature and time claims, and returns
+// the decoded claims.
+func (c *Controller) Verify(raw string) (Claims, error) {
+	t, err := parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch {
+	case c.jwks != nil:
+		key, err = c.jwks.key(t.header.Kid)
+		if err != nil {
+			return nil, err
+		}
+	case c.opts.Key != nil:
+		key = c.opts.Key
+	default:
+		return nil, ErrNoKey
+	}
+
+	if err := t.verify(key); err != nil {
+		return nil, err
+	}
+
+	if err := c.validate(t.claims); err != nil {
+		return nil, err
+	}
+
+	return t.claims, nil
+}
+
+// validate checks the registered claims of a token.
+func (c *Controller) validate(claims Claims) error {
+	now := c.now()
+
+	exp, ok := claims.time("exp")
+	if !ok {
+		return ErrMissingExpiry
+	}
+
+	if now.After(exp.Add(c.opts.Leeway)) {
+		return ErrTokenExpired
+	}
+
+	if nbf, ok := claims.time("nbf"); ok && now.Add(c.opts.Leeway).Before(nbf) {
+		return ErrTokenNotYetValid
+	}
+
+	if claims.Username() == "" {
+		return ErrMissingSubject
+	}
+
+	if c.opts.Issuer != "" && claims.String("iss") != c.opts.Issuer {
+		return ErrInvalidIssuer
+	}
+
+	if c.opts.Audience != "" && !inSlice(claims.Strings("aud"), c.opts.Audience) {
+		return ErrInvalidAudience
+	}
+
+	return nil
+}
+
+// ACL denies all access, as the scopes of a client are only known from the
+// claims of the token it connected with, which the server passes to ACLIdentity.
+func (c *Controller) ACL(user []byte, topic string, write bool) bool {
+	return false
+}
+
+// ACLIdentity returns true if the scopes in the claims of the client's token
+// grant read or write access to a topic. Clients without claims, or whose
+// token has since expired, are denied.
+func (c *Controller) ACLIdentity(identity interface{}, user []byte, topic string, write bool) (bool, error) {
+	claims, ok := identity.(Claims)
+	if !ok {
+		return false, nil
+	}
+
+	if exp, _ := claims.time("exp"); c.now().After(exp.Add(c.opts.Leeway)) {
+		return false, nil
+	}
+
+	prefix := "sub:"
+	if write {
+		prefix = "pub:"
+	}
+
+	for _, scope := range claims.Strings(c.opts.ScopeClaim) {
+		if strings.HasPrefix(scope, prefix) && auth.MatchTopic(scope[len(prefix):], topic) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Claims contains the decoded claims of a token.
+type Claims map[string]interface{}
+
+// Username returns the token subject, satisfying auth.Principal.
+func (c Claims) Username() string {
+	return c.String("sub")
+}
+
+// String returns the value of a string claim, or an empty string if the
+// claim is not present or not a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns the value of a claim which may be either a space separated
+// string or an array of strings.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, s := range v {
+			if str, ok := s.(string); ok {
+				out = append(out, str)
+			}
+		}
+		return out
+	}
+
+	return nil
+}
+
+// time returns the value of a NumericDate claim.
+func (c Claims) time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(v), 0), true
+}
+
+// inSlice returns true if a string is present in a slice.
+func inSlice(sl []string, s string) bool {
+	for _, v := range sl {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check the controller satisfies the auth.IdentityController interface.
+var _ auth.IdentityController = (*Controller)(nil)
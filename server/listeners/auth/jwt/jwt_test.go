@@ -0,0 +1,447 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/csymapp/mqtt/server/listeners/auth"
+)
+
+var (
+	hmacSecret      = []byte("secret")
+	rsaKey, _       = rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _        = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ = ed25519.GenerateKey(rand.Reader)
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign creates a compact token using the given algorithm and private key.
+func sign(t testing.TB, alg, kid string, claims Claims, key interface{}) string {
+	hb, err := json.Marshal(header{Alg: alg, Kid: kid, Typ: "JWT"})
+	require.NoError(t, err)
+	cb, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := b64(hb) + "." + b64(cb)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case "EdDSA":
+		sig = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signed))
+	}
+	require.NoError(t, err)
+
+	return signed + "." + b64(sig)
+}
+
+func validClaims() Claims {
+	return Claims{
+		"sub":   "mochi",
+		"exp":   float64(time.Now().Add(time.Hour).Unix()),
+		"scope": "pub:sensors/# sub:+/status",
+	}
+}
+
+func TestSatisfies(t *testing.T) {
+	var x auth.Controller
+	x = New(&Options{Key: hmacSecret})
+	require.NotNil(t, x)
+
+	var p auth.Principal
+	p = Claims{"sub": "mochi"}
+	require.Equal(t, "mochi", p.Username())
+}
+
+func TestNew(t *testing.T) {
+	c := New(&Options{Key: hmacSecret})
+	require.Equal(t, defaultScopeClaim, c.opts.ScopeClaim)
+	require.Equal(t, defaultJWKSRefresh, c.opts.JWKSRefresh)
+	require.Equal(t, defaultJWKSTimeout, c.opts.HTTPClient.Timeout)
+	require.Nil(t, c.jwks)
+
+	c = New(&Options{JWKSURL: "http://localhost/jwks.json"})
+	require.NotNil(t, c.jwks)
+	require.Equal(t, jwksMinWait, c.jwks.minWait)
+
+	c = New(nil)
+	require.Equal(t, defaultScopeClaim, c.opts.ScopeClaim)
+}
+
+func TestAuthenticateAlgorithms(t *testing.T) {
+	tt := []struct {
+		alg  string
+		sign interface{}
+		key  interface{}
+	}{
+		{"HS256", hmacSecret, hmacSecret},
+		{"RS256", rsaKey, &rsaKey.PublicKey},
+		{"PS256", rsaKey, &rsaKey.PublicKey},
+		{"ES256", ecKey, &ecKey.PublicKey},
+		{"EdDSA", edKey, edPub},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.alg, func(t *testing.T) {
+			c := New(&Options{Key: tx.key})
+			res, err := c.Authenticate([]byte("ignored"), []byte(sign(t, tx.alg, "", validClaims(), tx.sign)))
+			require.NoError(t, err)
+			require.Equal(t, "mochi", res.(auth.Principal).Username())
+		})
+	}
+}
+
+func TestAuthenticateFailures(t *testing.T) {
+	expired := validClaims()
+	expired["exp"] = float64(time.Now().Add(-time.Hour).Unix())
+
+	noExp := validClaims()
+	delete(noExp, "exp")
+
+	noSub := validClaims()
+	delete(noSub, "sub")
+
+	notYet := validClaims()
+	notYet["nbf"] = float64(time.Now().Add(time.Hour).Unix())
+
+	hs := func(c Claims) string { return sign(t, "HS256", "", c, hmacSecret) }
+
+	tt := []struct {
+		desc  string
+		opts  Options
+		token string
+		err   error
+	}{
+		{"malformed", Options{Key: hmacSecret}, "not.a-token", ErrMalformedToken},
+		{"bad base64", Options{Key: hmacSecret}, "!!.!!.!!", ErrMalformedToken},
+		{"no key", Options{}, hs(validClaims()), ErrNoKey},
+		{"bad signature", Options{Key: []byte("other")}, hs(validClaims()), ErrInvalidSignature},
+		{"key mismatch", Options{Key: &rsaKey.PublicKey}, hs(validClaims()), ErrKeyMismatch},
+		{"alg none", Options{Key: hmacSecret}, b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"mochi"}`)) + ".", ErrUnsupportedAlgorithm},
+		{"expired", Options{Key: hmacSecret}, hs(expired), ErrTokenExpired},
+		{"no expiry", Options{Key: hmacSecret}, hs(noExp), ErrMissingExpiry},
+		{"not yet valid", Options{Key: hmacSecret}, hs(notYet), ErrTokenNotYetValid},
+		{"no subject", Options{Key: hmacSecret}, hs(noSub), ErrMissingSubject},
+		{"issuer", Options{Key: hmacSecret, Issuer: "mochi-co"}, hs(validClaims()), ErrInvalidIssuer},
+		{"audience", Options{Key: hmacSecret, Audience: "broker"}, hs(validClaims()), ErrInvalidAudience},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			c := New(&tx.opts)
+			res, err := c.Authenticate(nil, []byte(tx.token))
+			require.ErrorIs(t, err, tx.err)
+			require.Nil(t, res)
+		})
+	}
+}
+
+func TestAuthenticateLeeway(t *testing.T) {
+	claims := validClaims()
+	claims["exp"] = float64(time.Now().Add(-10 * time.Second).Unix())
+	claims["nbf"] = float64(time.Now().Add(10 * time.Second).Unix())
+
+	c := New(&Options{Key: hmacSecret, Leeway: time.Minute})
+	_, err := c.Authenticate(nil, []byte(sign(t, "HS256", "", claims, hmacSecret)))
+	require.NoError(t, err)
+}
+
+func TestAuthenticateIssuerAudience(t *testing.T) {
+	claims := validClaims()
+	claims["iss"] = "mochi-co"
+	claims["aud"] = []interface{}{"broker", "api"}
+
+	c := New(&Options{Key: hmacSecret, Issuer: "mochi-co", Audience: "api"})
+	_, err := c.Authenticate(nil, []byte(sign(t, "HS256", "", claims, hmacSecret)))
+	require.NoError(t, err)
+}
+
+// aclIdentity checks access with the claims returned by Authenticate.
+func aclIdentity(t *testing.T, c *Controller, claims interface{}, topic string, write bool) bool {
+	ok, err := c.ACLIdentity(claims, []byte("mochi"), topic, write)
+	require.NoError(t, err)
+	return ok
+}
+
+func TestACL(t *testing.T) {
+	c := New(&Options{Key: hmacSecret})
+	claims, err := c.Authenticate(nil, []byte(sign(t, "HS256", "", validClaims(), hmacSecret)))
+	require.NoError(t, err)
+
+	require.True(t, aclIdentity(t, c, claims, "sensors/temp", true))
+	require.True(t, aclIdentity(t, c, claims, "sensors", true))
+	require.False(t, aclIdentity(t, c, claims, "sensors/temp", false))
+	require.True(t, aclIdentity(t, c, claims, "device/status", false))
+	require.True(t, aclIdentity(t, c, claims, "+/status", false))
+	require.False(t, aclIdentity(t, c, claims, "#", false))
+	require.False(t, aclIdentity(t, c, claims, "device/status", true))
+	require.False(t, aclIdentity(t, c, claims, "$SYS/status", false))
+	require.False(t, aclIdentity(t, c, nil, "sensors/temp", true))
+	require.False(t, aclIdentity(t, c, "mochi", "sensors/temp", true))
+
+	// without the claims of the client, access is denied.
+	require.False(t, c.ACL([]byte("mochi"), "sensors/temp", true))
+}
+
+func TestACLSameSubject(t *testing.T) {
+	c := New(&Options{Key: hmacSecret})
+	device, err := c.Authenticate(nil, []byte(sign(t, "HS256", "", Claims{
+		"sub":   "mochi",
+		"exp":   float64(time.Now().Add(time.Hour).Unix()),
+		"scope": "pub:devices/mochi",
+	}, hmacSecret)))
+	require.NoError(t, err)
+
+	admin, err := c.Authenticate(nil, []byte(sign(t, "HS256", "", Claims{
+		"sub":   "mochi",
+		"exp":   float64(time.Now().Add(2 * time.Hour).Unix()),
+		"scope": "pub:#",
+	}, hmacSecret)))
+	require.NoError(t, err)
+
+	// each client is limited to the scopes and expiry of its own token.
+	require.False(t, aclIdentity(t, c, device, "commands/reboot", true))
+	require.True(t, aclIdentity(t, c, admin, "commands/reboot", true))
+
+	c.now = func() time.Time { return time.Now().Add(90 * time.Minute) }
+	require.False(t, aclIdentity(t, c, device, "devices/mochi", true))
+	require.True(t, aclIdentity(t, c, admin, "devices/mochi", true))
+}
+
+func TestACLScopeArray(t *testing.T) {
+	claims := validClaims()
+	claims["perms"] = []interface{}{"pub:a/b", "sub:a/#"}
+
+	c := New(&Options{Key: hmacSecret, ScopeClaim: "perms"})
+	res, err := c.Authenticate(nil, []byte(sign(t, "HS256", "", claims, hmacSecret)))
+	require.NoError(t, err)
+
+	require.True(t, aclIdentity(t, c, res, "a/b", true))
+	require.False(t, aclIdentity(t, c, res, "a/c", true))
+	require.True(t, aclIdentity(t, c, res, "a/c", false))
+}
+
+func TestACLExpired(t *testing.T) {
+	c := New(&Options{Key: hmacSecret})
+	claims, err := c.Authenticate(nil, []byte(sign(t, "HS256", "", validClaims(), hmacSecret)))
+	require.NoError(t, err)
+
+	c.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	require.False(t, aclIdentity(t, c, claims, "sensors/temp", true))
+}
+
+func jwksServer(t *testing.T, hits *int32) *httptest.Server {
+	doc := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA", "kid": "rsa", "use": "sig",
+				"n": b64(rsaKey.N.Bytes()),
+				"e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC", "kid": "ec", "crv": "P-256",
+				"x": b64(ecKey.X.Bytes()),
+				"y": b64(ecKey.Y.Bytes()),
+			},
+			{
+				"kty": "OKP", "kid": "ed", "crv": "Ed25519",
+				"x": b64(edPub),
+			},
+			{
+				"kty": "RSA", "kid": "enc", "use": "enc",
+				"n": b64(rsaKey.N.Bytes()),
+				"e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "oct", "kid": "unknown",
+			},
+		},
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		json.NewEncoder(w).Encode(doc)
+	}))
+}
+
+func TestAuthenticateJWKS(t *testing.T) {
+	var hits int32
+	srv := jwksServer(t, &hits)
+	defer srv.Close()
+
+	c := New(&Options{JWKSURL: srv.URL})
+
+	_, err := c.Authenticate(nil, []byte(sign(t, "RS256", "rsa", validClaims(), rsaKey)))
+	require.NoError(t, err)
+	_, err = c.Authenticate(nil, []byte(sign(t, "ES256", "ec", validClaims(), ecKey)))
+	require.NoError(t, err)
+	_, err = c.Authenticate(nil, []byte(sign(t, "EdDSA", "ed", validClaims(), edKey)))
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	require.NotContains(t, c.jwks.keys, "enc")
+	require.NotContains(t, c.jwks.keys, "unknown")
+
+	// Unknown key ids don't trigger a refetch within the minimum wait.
+	_, err = c.Authenticate(nil, []byte(sign(t, "RS256", "missing", validClaims(), rsaKey)))
+	require.ErrorIs(t, err, ErrUnknownKey)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	// Once the minimum wait has passed, unknown key ids trigger a refetch.
+	c.jwks.Lock()
+	c.jwks.attempts = time.Now().Add(-2 * jwksMinWait)
+	c.jwks.Unlock()
+	_, err = c.Authenticate(nil, []byte(sign(t, "RS256", "missing", validClaims(), rsaKey)))
+	require.ErrorIs(t, err, ErrUnknownKey)
+	require.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	// Stale keys are refetched in the background once the minimum wait has passed.
+	c.jwks.Lock()
+	c.jwks.fetched = time.Now().Add(-2 * defaultJWKSRefresh)
+	c.jwks.attempts = time.Now().Add(-2 * jwksMinWait)
+	c.jwks.Unlock()
+	_, err = c.Authenticate(nil, []byte(sign(t, "RS256", "rsa", validClaims(), rsaKey)))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		c.jwks.RLock()
+		defer c.jwks.RUnlock()
+		return time.Since(c.jwks.fetched) < time.Minute
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int32(3), atomic.LoadInt32(&hits))
+}
+
+func TestAuthenticateJWKSSlowRefresh(t *testing.T) {
+	var hits int32
+	ok := jwksServer(t, &hits)
+	defer ok.Close()
+
+	var slow int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			<-release
+		}
+		ok.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := New(&Options{JWKSURL: srv.URL})
+	_, err := c.Authenticate(nil, []byte(sign(t, "RS256", "rsa", validClaims(), rsaKey)))
+	require.NoError(t, err)
+
+	// While the key server hangs, cached keys are served without waiting, and
+	// only one refresh is made.
+	atomic.StoreInt32(&slow, 1)
+	c.jwks.Lock()
+	c.jwks.fetched = time.Now().Add(-2 * defaultJWKSRefresh)
+	c.jwks.attempts = time.Now().Add(-2 * jwksMinWait)
+	c.jwks.Unlock()
+
+	for i := 0; i < 10; i++ {
+		_, err = c.Authenticate(nil, []byte(sign(t, "RS256", "rsa", validClaims(), rsaKey)))
+		require.NoError(t, err)
+	}
+
+	close(release)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&hits) == 2
+	}, time.Second, time.Millisecond)
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestAuthenticateJWKSTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := New(&Options{JWKSURL: srv.URL, HTTPClient: &http.Client{Timeout: 10 * time.Millisecond}})
+	_, err := c.Authenticate(nil, []byte(sign(t, "RS256", "rsa", validClaims(), rsaKey)))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestAuthenticateJWKSFetchFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := New(&Options{JWKSURL: srv.URL})
+	_, err := c.Authenticate(nil, []byte(sign(t, "RS256", "rsa", validClaims(), rsaKey)))
+	require.Error(t, err)
+}
+
+func TestAuthenticateJWKSStaleFallback(t *testing.T) {
+	var fail int32
+	var hits int32
+	ok := jwksServer(t, &hits)
+	defer ok.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ok.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := New(&Options{JWKSURL: srv.URL})
+	_, err := c.Authenticate(nil, []byte(sign(t, "RS256", "rsa", validClaims(), rsaKey)))
+	require.NoError(t, err)
+
+	// Cached keys continue to be used if a refresh fails.
+	atomic.StoreInt32(&fail, 1)
+	c.jwks.Lock()
+	c.jwks.fetched = time.Now().Add(-2 * defaultJWKSRefresh)
+	c.jwks.attempts = time.Now().Add(-2 * jwksMinWait)
+	c.jwks.Unlock()
+	_, err = c.Authenticate(nil, []byte(sign(t, "RS256", "rsa", validClaims(), rsaKey)))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		c.jwks.RLock()
+		defer c.jwks.RUnlock()
+		return c.jwks.err != nil
+	}, time.Second, time.Millisecond)
+	_, err = c.Authenticate(nil, []byte(sign(t, "RS256", "rsa", validClaims(), rsaKey)))
+	require.NoError(t, err)
+}
@@ -0,0 +1,184 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"math/big"
+	"strings"
+)
+
+var (
+	// ErrMalformedToken indicates the token could not be decoded.
+	ErrMalformedToken = errors.New("malformed token")
+
+	// ErrUnsupportedAlgorithm indicates the token was signed with an unsupported algorithm.
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+
+	// ErrKeyMismatch indicates the verification key cannot be used with the token algorithm.
+	ErrKeyMismatch = errors.New("key type does not match signing algorithm")
+
+	// ErrInvalidSignature indicates the token signature did not verify.
+	ErrInvalidSignature = errors.New("invalid token signature")
+)
+
+// header contains the JOSE header values of a token.
+type header struct {
+	Alg string `json:"alg"` // the signing algorithm.
+	Kid string `json:"kid"` // the id of the signing key.
+	Typ string `json:"typ"` // the token type.
+}
+
+// token is a decoded but not yet verified token.
+type token struct {
+	header    header // the decoded header.
+	claims    Claims // the decoded claims.
+	signed    []byte // the signed portion of the token (header.payload).
+	signature []byte // the decoded signature.
+}
+
+// parse decodes a compact serialised JWS token without verifying it.
+func parse(raw string) (*token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	t := &token{
+		signed: []byte(parts[0] + "." + parts[1]),
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	if err := json.Unmarshal(b, &t.header); err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	if err := json.Unmarshal(b, &t.claims); err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	t.signature, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	return t, nil
+}
+
+// hashFor returns the hash function used by an algorithm.
+func hashFor(alg string) (crypto.Hash, func() hash.Hash, bool) {
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, sha256.New, true
+	case "384":
+		return crypto.SHA384, sha512.New384, true
+	case "512":
+		return crypto.SHA512, sha512.New, true
+	}
+
+	return 0, nil, false
+}
+
+// verify checks the token signature against a key. The key type must match the
+// algorithm family, which prevents a public key from being used as an HMAC secret.
+func (t *token) verify(key interface{}) error {
+	alg := t.header.Alg
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return ErrKeyMismatch
+		}
+
+		if !ed25519.Verify(k, t.signed, t.signature) {
+			return ErrInvalidSignature
+		}
+
+		return nil
+	}
+
+	if len(alg) != 5 {
+		return ErrUnsupportedAlgorithm
+	}
+
+	ch, hf, ok := hashFor(alg)
+	if !ok {
+		return ErrUnsupportedAlgorithm
+	}
+
+	switch alg[:2] {
+	case "HS":
+		k, ok := key.([]byte)
+		if !ok {
+			return ErrKeyMismatch
+		}
+
+		mac := hmac.New(hf, k)
+		mac.Write(t.signed)
+		if !hmac.Equal(mac.Sum(nil), t.signature) {
+			return ErrInvalidSignature
+		}
+
+		return nil
+	case "RS", "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrKeyMismatch
+		}
+
+		h := hf()
+		h.Write(t.signed)
+
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(k, ch, h.Sum(nil), t.signature)
+		} else {
+			err = rsa.VerifyPSS(k, ch, h.Sum(nil), t.signature, nil)
+		}
+
+		if err != nil {
+			return ErrInvalidSignature
+		}
+
+		return nil
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrKeyMismatch
+		}
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return ErrInvalidSignature
+		}
+
+		h := hf()
+		h.Write(t.signed)
+
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(k, h.Sum(nil), r, s) {
+			return ErrInvalidSignature
+		}
+
+		return nil
+	}
+
+	return ErrUnsupportedAlgorithm
+}
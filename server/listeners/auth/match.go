@@ -0,0 +1,119 @@
+package auth
+
+import "strings"
+
+// MatchTopic returns true if an ACL pattern matches a topic, for use by the ACL
+// methods of auth controllers. The pattern is a topic filter which may contain
+// the + single-level and # multi-level wildcards. The topic may be either a
+// topic name (when publishing) or a topic filter (when subscribing); a filter
+// is only matched if every topic it could match is also matched by the pattern,
+// so "a/#" matches "a/+/c", but "a/+" does not match "a/#".
+//
+// As with subscriptions, "sport/#" also matches the parent level "sport", and
+// patterns beginning with a wildcard do not match topics beginning with $, such
+// as $SYS topics. Malformed patterns or topics, such as those with # anywhere
+// but the last level, never match.
+func MatchTopic(pattern, topic string) bool {
+	if pattern == "" || topic == "" {
+		return false
+	}
+
+	p := strings.Split(pattern, "/")
+	t := strings.Split(topic, "/")
+
+	if !validFilter(p) || !validFilter(t) {
+		return false
+	}
+
+	// Wildcards must not match topics beginning with $ at the first level.
+	if topic[0] == '$' && (p[0] == "+" || p[0] == "#") {
+		return false
+	}
+
+	for i, level := range p {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(t) {
+			return false
+		}
+
+		if level == "+" {
+			if t[i] == "#" {
+				return false
+			}
+			continue
+		}
+
+		if level != t[i] {
+			return false
+		}
+	}
+
+	return len(p) == len(t)
+}
+
+// OverlapTopic returns true if an ACL pattern and a topic filter have any
+// topic in common, such as "a/b/#" and "a/+", so that a subscription to the
+// filter would receive some of the messages the pattern matches. Unlike
+// MatchTopic, the filter does not need to be wholly covered by the pattern.
+// Malformed patterns or filters never overlap.
+func OverlapTopic(pattern, filter string) bool {
+	if pattern == "" || filter == "" {
+		return false
+	}
+
+	p := strings.Split(pattern, "/")
+	f := strings.Split(filter, "/")
+
+	if !validFilter(p) || !validFilter(f) {
+		return false
+	}
+
+	// Wildcards at the first level do not match topics beginning with $, so a
+	// leading wildcard only overlaps a $ level if both are wildcards.
+	if (p[0] == "+" || p[0] == "#") != (f[0] == "+" || f[0] == "#") {
+		if strings.HasPrefix(p[0], "$") || strings.HasPrefix(f[0], "$") {
+			return false
+		}
+	}
+
+	for i := 0; i < len(p) && i < len(f); i++ {
+		if p[i] == "#" || f[i] == "#" {
+			return true
+		}
+
+		if p[i] != "+" && f[i] != "+" && p[i] != f[i] {
+			return false
+		}
+	}
+
+	// Filters ending in # also match their parent level, so "a/#" overlaps "a".
+	switch {
+	case len(p) == len(f):
+		return true
+	case len(p) == len(f)+1:
+		return p[len(p)-1] == "#"
+	case len(f) == len(p)+1:
+		return f[len(f)-1] == "#"
+	}
+
+	return false
+}
+
+// validFilter returns true if the wildcards in the levels of a topic filter are
+// correctly placed.
+func validFilter(levels []string) bool {
+	for i, level := range levels {
+		if len(level) > 1 && strings.ContainsAny(level, "+#") {
+			return false
+		}
+
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+
+	return true
+}
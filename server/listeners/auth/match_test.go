@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tt := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		// exact matches
+		{"sport/tennis/player1", "sport/tennis/player1", true},
+		{"sport/tennis/player1", "sport/tennis/player2", false},
+		{"sport/tennis", "sport/tennis/player1", false},
+		{"sport/tennis/player1", "sport/tennis", false},
+		{"/finance", "/finance", true},
+		{"/finance", "finance", false},
+
+		// multi-level wildcard
+		{"sport/#", "sport", true},
+		{"sport/#", "sport/tennis/player1", true},
+		{"sport/#", "sport/", true},
+		{"sport/tennis/#", "sport/tennis", true},
+		{"sport/tennis/#", "sport/football", false},
+		{"sport/#", "sports", false},
+		{"#", "sport/tennis", true},
+		{"#", "/", true},
+
+		// single-level wildcard
+		{"sport/+", "sport/tennis", true},
+		{"sport/+", "sport/tennis/player1", false},
+		{"sport/+", "sport", false},
+		{"sport/+", "sport/", true},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"sport/+/player1", "sport/tennis/player1", true},
+		{"+/tennis/#", "sport/tennis/player1/ranking", true},
+
+		// topic filters as the topic
+		{"sport/#", "sport/+", true},
+		{"sport/#", "sport/#", true},
+		{"sport/#", "sport/+/player1", true},
+		{"sport/+", "sport/+", true},
+		{"sport/+", "sport/#", false},
+		{"sport/tennis", "sport/+", false},
+		{"#", "#", true},
+		{"+", "#", false},
+
+		// $ topics
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		{"#", "sport/$SYS", true},
+
+		// malformed
+		{"sport/#/tennis", "sport/a/tennis", false},
+		{"sport/tennis#", "sport/tennis#", false},
+		{"sport+", "sport+", false},
+		{"sport/#", "sport/#/tennis", false},
+		{"", "sport", false},
+		{"#", "", false},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.match, MatchTopic(tx.pattern, tx.topic), "%s %s", tx.pattern, tx.topic)
+	}
+}
+
+func TestOverlapTopic(t *testing.T) {
+	tt := []struct {
+		pattern string
+		filter  string
+		overlap bool
+	}{
+		{"sport/tennis", "sport/tennis", true},
+		{"sport/tennis", "sport/football", false},
+		{"sport/secret/#", "sport/#", true},
+		{"sport/secret/#", "sport/+", true},
+		{"sport/secret/#", "sport/+/player1", true},
+		{"sport/secret/#", "sport/tennis/#", false},
+		{"sport/secret/#", "#", true},
+		{"sport/+/player1", "sport/tennis/+", true},
+		{"sport/+/player1", "sport/tennis/player2", false},
+		{"sport/+", "sport/tennis/player1", false},
+		{"sport/#", "sport", true},
+		{"sport", "sport/#", true},
+		{"sport", "sport/+", false},
+		{"sport/tennis", "+/#", true},
+
+		// $ topics
+		{"$SYS/#", "#", false},
+		{"$SYS/#", "+/broker", false},
+		{"#", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/+", true},
+		{"+/#", "#", true},
+
+		// malformed
+		{"sport/#/tennis", "sport/#", false},
+		{"sport/#", "sport+", false},
+		{"", "#", false},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.overlap, OverlapTopic(tx.pattern, tx.filter), "%s %s", tx.pattern, tx.filter)
+	}
+}
+
+func BenchmarkMatchTopic(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		MatchTopic("sport/+/player1/#", "sport/tennis/player1/ranking")
+	}
+}
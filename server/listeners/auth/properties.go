@@ -0,0 +1,37 @@
+package auth
+
+import "github.com/csymapp/mqtt/server/internal/packets"
+
+// PropertiesController is a Controller which can make access decisions using
+// the MQTT v5 user properties of a publish or subscribe packet, for example to
+// route messages by metadata set by the client.
+type PropertiesController interface {
+	Controller
+
+	// ACLProperties returns true if a user has read or write access to a given
+	// topic. props are the user properties of the packet being checked, in the
+	// order they were sent, and may contain the same key more than once.
+	ACLProperties(user []byte, topic string, write bool, props []packets.UserProperty) bool
+}
+
+// Properties returns a PropertiesController for an auth controller. Controllers
+// which already implement PropertiesController are returned as-is, and
+// controllers which only implement ACL are wrapped so that ACLProperties calls
+// ACL, ignoring the user properties.
+func Properties(ac Controller) PropertiesController {
+	if pc, ok := ac.(PropertiesController); ok {
+		return pc
+	}
+
+	return &propertiesAdapter{ac}
+}
+
+// propertiesAdapter adapts a Controller to the PropertiesController interface.
+type propertiesAdapter struct {
+	Controller
+}
+
+// ACLProperties checks the topic access of the user without the user properties.
+func (a *propertiesAdapter) ACLProperties(user []byte, topic string, write bool, props []packets.UserProperty) bool {
+	return a.ACL(user, topic, write)
+}
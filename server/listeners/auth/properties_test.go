@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/csymapp/mqtt/server/internal/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// routeAuth only allows access to packets carrying a matching route property.
+type routeAuth struct {
+	Allow
+	route string
+}
+
+func (a *routeAuth) ACLProperties(user []byte, topic string, write bool, props []packets.UserProperty) bool {
+	for _, p := range props {
+		if p.Key == "route" && p.Val == a.route {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestPropertiesPassthrough(t *testing.T) {
+	ac := &routeAuth{route: "a"}
+	pc := Properties(ac)
+	require.Equal(t, ac, pc)
+
+	require.True(t, pc.ACLProperties([]byte("user"), "topic", true, []packets.UserProperty{
+		{Key: "route", Val: "b"},
+		{Key: "route", Val: "a"},
+	}))
+	require.False(t, pc.ACLProperties([]byte("user"), "topic", true, []packets.UserProperty{
+		{Key: "route", Val: "b"},
+	}))
+}
+
+func TestPropertiesAdapter(t *testing.T) {
+	pc := Properties(new(Allow))
+	require.True(t, pc.ACLProperties([]byte("user"), "topic", true, nil))
+
+	pc = Properties(new(Disallow))
+	require.False(t, pc.ACLProperties([]byte("user"), "topic", true, []packets.UserProperty{{Key: "k", Val: "v"}}))
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/csymapp/mqtt/server/listeners/auth"
 	"github.com/csymapp/mqtt/server/system"
@@ -24,6 +25,90 @@ type Config struct {
 	// TLSConfig is a tls.Config configuration to be used with the listener.
 	// See examples folder for basic and mutual-tls use.
 	TLSConfig *tls.Config
+
+	// MaxPacketSize overrides the server's maximum packet size for clients
+	// connecting to the listener, if greater than 0.
+	MaxPacketSize uint32
+
+	// MaxTopicLevels and MaxTopicLength override the server's maximum number of
+	// levels and length in bytes of the topics and filters accepted from clients
+	// connecting to the listener, if greater than 0.
+	MaxTopicLevels int
+	MaxTopicLength int
+
+	// MaxKeepalive is the longest keepalive in seconds allowed for MQTT v5 clients
+	// connecting to the listener, if greater than 0. Clients requesting a longer
+	// keepalive, or none at all, are assigned the maximum as a Server Keep Alive.
+	MaxKeepalive uint16
+
+	// ReadTimeout is how long a client connecting to the listener may go
+	// without sending a complete packet before it is disconnected, if greater
+	// than 0. It should be longer than the keepalive of the clients, which
+	// otherwise send nothing between their PINGREQs.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is how long each write to a client connecting to the
+	// listener may take before it is disconnected. If 0, the default of 30
+	// seconds is used, and if less than 0, writes never time out.
+	WriteTimeout time.Duration
+
+	// StreamTimeout is how long a client connecting to a QUIC listener may take
+	// to open its stream after the QUIC handshake, before its connection is
+	// closed. If 0, the default of 10 seconds is used.
+	StreamTimeout time.Duration
+
+	// MaxClientIDLength is the longest client id in bytes accepted from clients
+	// connecting to the listener, if greater than 0. Otherwise client ids may be
+	// up to the 65535 bytes allowed by the spec.
+	MaxClientIDLength int
+
+	// StrictClientID restricts the client ids accepted from clients connecting
+	// to the listener to the 1 to 23 characters of [0-9a-zA-Z] which the MQTT
+	// 3.1.1 spec requires servers to accept. Ids assigned by the server to
+	// clients which connect without one are not restricted.
+	StrictClientID bool
+
+	// MaximumQos is the highest QoS clients connecting to the listener may
+	// publish or subscribe with, if not nil. It is advertised to MQTT v5 clients
+	// in the CONNACK, and publishes from MQTT v3 clients are downgraded to it.
+	MaximumQos *byte
+
+	// DisableRetain prevents clients connecting to the listener from retaining
+	// messages. MQTT v5 clients are told that retain is not available in the CONNACK.
+	DisableRetain bool
+
+	// ConnectRate is the number of new connections per second accepted by the
+	// listener, if greater than 0. Up to ConnectBurst connections may be accepted
+	// at once before the rate applies.
+	ConnectRate  float64
+	ConnectBurst int
+
+	// ConnectWait is how long a connection exceeding the ConnectRate may be
+	// delayed until it is within the rate. Connections which would wait longer
+	// are refused, and if 0, excess connections are refused immediately.
+	ConnectWait time.Duration
+
+	// MaxConnectionsPerIP is the maximum number of concurrent connections the
+	// listener accepts from a single remote IP address, if greater than 0.
+	MaxConnectionsPerIP int
+
+	// PublishRate is the number of messages per second each client connecting
+	// to the listener may publish, if greater than 0. Up to PublishBurst
+	// messages may be published at once before the rate applies.
+	PublishRate  float64
+	PublishBurst int
+
+	// PublishByteRate is the number of payload bytes per second each client
+	// connecting to the listener may publish, if greater than 0. Up to
+	// PublishByteBurst bytes may be published at once before the rate applies.
+	PublishByteRate  float64
+	PublishByteBurst int
+
+	// PublishMaxDelay is how long a publish exceeding the PublishRate or
+	// PublishByteRate of a client may be delayed, during which no further
+	// packets are read from the client. Clients whose publishes would be
+	// delayed longer are disconnected. If 0, clients are never disconnected.
+	PublishMaxDelay time.Duration
 }
 
 // TLS contains the TLS certificates and settings for the listener connection.
@@ -55,6 +140,7 @@ type Listener interface {
 type Listeners struct {
 	wg       sync.WaitGroup      // a waitgroup that waits for all listeners to finish.
 	internal map[string]Listener // a map of active listeners.
+	serving  map[string]bool     // the listeners which are serving connections, keyed on id.
 	system   *system.Info        // pointers to system info.
 	sync.RWMutex
 }
@@ -63,6 +149,7 @@ type Listeners struct {
 func New(s *system.Info) *Listeners {
 	return &Listeners{
 		internal: map[string]Listener{},
+		serving:  map[string]bool{},
 		system:   s,
 	}
 }
@@ -90,6 +177,18 @@ func (l *Listeners) Len() int {
 	return val
 }
 
+// IDs returns the ids of the listeners in the internal map.
+func (l *Listeners) IDs() []string {
+	l.RLock()
+	defer l.RUnlock()
+	ids := make([]string, 0, len(l.internal))
+	for id := range l.internal {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
 // Delete removes a listener from the internal map.
 func (l *Listeners) Delete(id string) {
 	l.Lock()
@@ -106,10 +205,35 @@ func (l *Listeners) Serve(id string, establisher EstablishFunc) {
 	go func(e EstablishFunc) {
 		defer l.wg.Done()
 		l.wg.Add(1)
+		l.setServing(id, true)
+		defer l.setServing(id, false)
 		listener.Serve(e)
 	}(establisher)
 }
 
+// setServing sets whether a listener is serving connections.
+func (l *Listeners) setServing(id string, serving bool) {
+	l.Lock()
+	if serving {
+		l.serving[id] = true
+	} else {
+		delete(l.serving, id)
+	}
+	l.Unlock()
+}
+
+// Serving returns whether each listener is serving connections, keyed on id.
+func (l *Listeners) Serving() map[string]bool {
+	l.RLock()
+	defer l.RUnlock()
+	m := make(map[string]bool, len(l.internal))
+	for id := range l.internal {
+		m[id] = l.serving[id]
+	}
+
+	return m
+}
+
 // ServeAll starts all listeners serving from the internal map.
 func (l *Listeners) ServeAll(establisher EstablishFunc) {
 	l.RLock()
@@ -117,6 +117,14 @@ func BenchmarkLenListener(b *testing.B) {
 	}
 }
 
+func TestIDsListener(t *testing.T) {
+	l := New(nil)
+	require.Empty(t, l.IDs())
+	l.Add(NewMockListener("t1", ":1882"))
+	l.Add(NewMockListener("t2", ":1882"))
+	require.ElementsMatch(t, []string{"t1", "t2"}, l.IDs())
+}
+
 func TestDeleteListener(t *testing.T) {
 	l := New(nil)
 	l.Add(NewMockListener("t1", ":1882"))
@@ -147,6 +155,25 @@ func TestServeListener(t *testing.T) {
 	require.Equal(t, false, l.internal["t1"].(*MockListener).IsServing())
 }
 
+func TestServingListeners(t *testing.T) {
+	l := New(nil)
+	l.Add(NewMockListener("t1", ":1882"))
+	l.Add(NewMockListener("t2", ":1883"))
+	require.Equal(t, map[string]bool{"t1": false, "t2": false}, l.Serving())
+
+	l.Serve("t1", MockEstablisher)
+	require.Eventually(t, func() bool {
+		return l.Serving()["t1"]
+	}, time.Second, time.Millisecond)
+	require.Equal(t, map[string]bool{"t1": true, "t2": false}, l.Serving())
+
+	l.Close("t1", MockCloser)
+	require.Eventually(t, func() bool {
+		return !l.Serving()["t1"]
+	}, time.Second, time.Millisecond)
+	require.Equal(t, map[string]bool{"t1": false, "t2": false}, l.Serving())
+}
+
 func BenchmarkServeListener(b *testing.B) {
 	l := New(nil)
 	l.Add(NewMockListener("t1", ":1882"))
@@ -0,0 +1,245 @@
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/csymapp/mqtt/server/listeners/auth"
+	"github.com/csymapp/mqtt/server/system"
+)
+
+var (
+	// ErrQUICNoTLS indicates that a QUIC listener was started without the TLS
+	// certificates which QUIC requires.
+	ErrQUICNoTLS = errors.New("quic listener requires tls")
+)
+
+// QUICALPN is the application protocol negotiated by MQTT over QUIC clients,
+// which is used when the listener tls.Config does not set any NextProtos.
+const QUICALPN = "mqtt"
+
+// defaultQUICKeepAlive is how often idle QUIC connections are kept alive by
+// default, so that clients with a long MQTT keepalive are not closed by the
+// QUIC idle timeout.
+const defaultQUICKeepAlive = 15 * time.Second
+
+// defaultQUICStreamTimeout is how long a QUIC connection may take to open its
+// stream by default, which is the same as the server's default handshake
+// timeout.
+const defaultQUICStreamTimeout = 10 * time.Second
+
+// QUIC is a listener for establishing client connections over MQTT over QUIC.
+// Each client connection opens a single bidirectional stream, which is
+// handled in the same way as a TCP connection.
+type QUIC struct {
+	sync.RWMutex
+	id         string             // the internal id of the listener.
+	address    string             // the network address to bind to.
+	quicConfig *quic.Config       // the quic-go configuration of the listener.
+	listen     *quic.Listener     // a QUIC listener which will listen for new clients.
+	config     *Config            // configuration values for the listener.
+	ctx        context.Context    // cancelled when the listener is closed.
+	cancel     context.CancelFunc // cancels the listener context.
+	end        uint32             // ensure the close methods are only called once.
+}
+
+// NewQUIC initialises and returns a new QUIC listener, listening on an address.
+func NewQUIC(id, address string) *QUIC {
+	return NewQUICWithConfig(id, address, nil)
+}
+
+// NewQUICWithConfig initialises and returns a new QUIC listener, listening on
+// an address with a quic-go config, such as to change its timeouts. A nil
+// config keeps idle connections alive every 15 seconds.
+func NewQUICWithConfig(id, address string, config *quic.Config) *QUIC {
+	if config == nil {
+		config = &quic.Config{KeepAlivePeriod: defaultQUICKeepAlive}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &QUIC{
+		id:         id,
+		address:    address,
+		quicConfig: config,
+		ctx:        ctx,
+		cancel:     cancel,
+		config: &Config{ // default configuration.
+			Auth: new(auth.Allow),
+			TLS:  new(TLS),
+		},
+	}
+}
+
+// SetConfig sets the configuration values for the listener config.
+func (l *QUIC) SetConfig(config *Config) {
+	l.Lock()
+	if config != nil {
+		l.config = config
+
+		// If a config has been passed without an auth controller,
+		// it may be a mistake, so disallow all traffic.
+		if l.config.Auth == nil {
+			l.config.Auth = new(auth.Disallow)
+		}
+	}
+
+	l.Unlock()
+}
+
+// ID returns the id of the listener.
+func (l *QUIC) ID() string {
+	l.RLock()
+	id := l.id
+	l.RUnlock()
+	return id
+}
+
+// Listen starts listening on the listener's network address. The TLS settings
+// of the listener config are used as for the TCP listener, and are required.
+func (l *QUIC) Listen(s *system.Info) error {
+	var tlsConfig *tls.Config
+	if l.config.TLS != nil && len(l.config.TLS.Certificate) > 0 && len(l.config.TLS.PrivateKey) > 0 {
+		cert, err := tls.X509KeyPair(l.config.TLS.Certificate, l.config.TLS.PrivateKey)
+		if err != nil {
+			return err
+		}
+
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	} else if l.config.TLSConfig != nil {
+		tlsConfig = l.config.TLSConfig.Clone()
+	} else {
+		return ErrQUICNoTLS
+	}
+
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{QUICALPN}
+	}
+
+	var err error
+	l.listen, err = quic.ListenAddr(l.address, tlsConfig, l.quicConfig.Clone())
+	return err
+}
+
+// Serve starts waiting for new QUIC connections, and calls the establish
+// connection callback with the first stream opened by each. Connections which
+// do not open a stream within the StreamTimeout of the config are closed.
+func (l *QUIC) Serve(establish EstablishFunc) {
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		conn, err := l.listen.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&l.end) == 0 {
+			go func() {
+				// Connections are only limited by the server once their stream
+				// is established, so those which never open one are closed.
+				ctx, cancel := context.WithTimeout(l.ctx, l.streamTimeout())
+				stream, err := conn.AcceptStream(ctx)
+				cancel()
+				if err != nil {
+					_ = conn.CloseWithError(0, "")
+					return
+				}
+
+				_ = establish(l.id, &quicConn{conn: conn, stream: stream}, l.config.Auth)
+			}()
+		}
+	}
+}
+
+// streamTimeout returns how long a connection may take to open its stream.
+func (l *QUIC) streamTimeout() time.Duration {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.config.StreamTimeout > 0 {
+		return l.config.StreamTimeout
+	}
+
+	return defaultQUICStreamTimeout
+}
+
+// Close closes the listener and any client connections.
+func (l *QUIC) Close(closeClients CloseFunc) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		closeClients(l.id)
+	}
+
+	l.cancel()
+	if l.listen != nil {
+		err := l.listen.Close()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// quicConn is a net.Conn which reads and writes the stream of a QUIC
+// connection. The addresses are read from the connection each time, so they
+// follow a client which migrates to another network.
+type quicConn struct {
+	conn   *quic.Conn   // the QUIC connection.
+	stream *quic.Stream // the stream carrying the MQTT byte stream.
+}
+
+// Read reads from the stream.
+func (c *quicConn) Read(b []byte) (int, error) {
+	return c.stream.Read(b)
+}
+
+// Write writes to the stream.
+func (c *quicConn) Write(b []byte) (int, error) {
+	return c.stream.Write(b)
+}
+
+// Close closes the stream and the connection.
+func (c *quicConn) Close() error {
+	err := c.stream.Close()
+	if cerr := c.conn.CloseWithError(0, ""); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the current remote address of the connection.
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the stream.
+func (c *quicConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the stream.
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the stream.
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
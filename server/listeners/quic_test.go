@@ -0,0 +1,238 @@
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csymapp/mqtt/server/listeners/auth"
+)
+
+// quicTestAddr binds QUIC listeners to any free port, as UDP ports are not
+// released by a closed listener as quickly as TCP ports.
+const quicTestAddr = "127.0.0.1:0"
+
+// dialQUIC opens a QUIC connection to a listener, as an MQTT over QUIC client.
+func dialQUIC(t *testing.T, l *QUIC) *quic.Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, l.listen.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{QUICALPN},
+	}, nil)
+	require.NoError(t, err)
+	return conn
+}
+
+func TestNewQUIC(t *testing.T) {
+	l := NewQUIC("q1", testPort)
+	require.Equal(t, "q1", l.id)
+	require.Equal(t, testPort, l.address)
+	require.Equal(t, "q1", l.ID())
+	require.Equal(t, defaultQUICKeepAlive, l.quicConfig.KeepAlivePeriod)
+}
+
+func TestNewQUICWithConfig(t *testing.T) {
+	config := &quic.Config{MaxIdleTimeout: time.Minute}
+	l := NewQUICWithConfig("q1", testPort, config)
+	require.Equal(t, config, l.quicConfig)
+}
+
+func TestQUICSetConfig(t *testing.T) {
+	l := NewQUIC("q1", testPort)
+
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+	})
+	require.Equal(t, new(auth.Allow), l.config.Auth)
+
+	l.SetConfig(new(Config))
+	require.Equal(t, new(auth.Disallow), l.config.Auth)
+}
+
+func TestQUICListen(t *testing.T) {
+	l := NewQUIC("q1", quicTestAddr)
+	l.SetConfig(&Config{
+		Auth:      new(auth.Allow),
+		TLSConfig: tlsConfigBasic,
+	})
+
+	require.NoError(t, l.Listen(nil))
+	require.NotNil(t, l.listen)
+	require.Empty(t, tlsConfigBasic.NextProtos)
+
+	conn := dialQUIC(t, l)
+	require.Equal(t, QUICALPN, conn.ConnectionState().TLS.NegotiatedProtocol)
+	conn.CloseWithError(0, "")
+	l.Close(MockCloser)
+}
+
+func TestQUICListenTLS(t *testing.T) {
+	l := NewQUIC("q1", quicTestAddr)
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+		TLS: &TLS{
+			Certificate: testCertificate,
+			PrivateKey:  testPrivateKey,
+		},
+	})
+
+	require.NoError(t, l.Listen(nil))
+	dialQUIC(t, l).CloseWithError(0, "")
+	l.Close(MockCloser)
+}
+
+func TestQUICListenNoTLS(t *testing.T) {
+	l := NewQUIC("q1", quicTestAddr)
+	require.ErrorIs(t, l.Listen(nil), ErrQUICNoTLS)
+}
+
+func TestQUICListenTLSInvalid(t *testing.T) {
+	l := NewQUIC("q1", quicTestAddr)
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+		TLS: &TLS{
+			Certificate: []byte("abcde"),
+			PrivateKey:  testPrivateKey,
+		},
+	})
+	require.Error(t, l.Listen(nil))
+}
+
+func TestQUICListenFailure(t *testing.T) {
+	l := NewQUIC("q1", "bad:address:1")
+	l.SetConfig(&Config{
+		Auth:      new(auth.Allow),
+		TLSConfig: tlsConfigBasic,
+	})
+	require.Error(t, l.Listen(nil))
+}
+
+func TestQUICServeAndClose(t *testing.T) {
+	l := NewQUIC("q1", quicTestAddr)
+	l.SetConfig(&Config{
+		Auth:      new(auth.Allow),
+		TLSConfig: tlsConfigBasic,
+	})
+	require.NoError(t, l.Listen(nil))
+
+	established := make(chan net.Conn)
+	o := make(chan bool)
+	go func() {
+		l.Serve(func(id string, c net.Conn, ac auth.Controller) error {
+			require.Equal(t, "q1", id)
+			established <- c
+			return nil
+		})
+		o <- true
+	}()
+
+	client := dialQUIC(t, l)
+	stream, err := client.OpenStreamSync(context.Background())
+	require.NoError(t, err)
+
+	// the stream is only announced to the listener once it is written to.
+	_, err = stream.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	conn := <-established
+
+	b := make([]byte, 3)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, b)
+
+	_, err = conn.Write([]byte{4, 5})
+	require.NoError(t, err)
+	b = make([]byte, 2)
+	_, err = io.ReadFull(stream, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte{4, 5}, b)
+
+	require.Equal(t, client.LocalAddr().(*net.UDPAddr).Port, conn.RemoteAddr().(*net.UDPAddr).Port)
+	require.Equal(t, l.listen.Addr().String(), conn.LocalAddr().String())
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(time.Second)))
+
+	require.NoError(t, conn.Close())
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("client connection was not closed")
+	}
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+	require.True(t, closed)
+	<-o
+}
+
+func TestQUICServeNoStream(t *testing.T) {
+	l := NewQUIC("q1", quicTestAddr)
+	l.SetConfig(&Config{
+		Auth:      new(auth.Allow),
+		TLSConfig: tlsConfigBasic,
+	})
+	require.NoError(t, l.Listen(nil))
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	// a connection which never opens a stream is closed with the listener.
+	client := dialQUIC(t, l)
+	l.Close(MockCloser)
+	<-o
+
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("client connection was not closed")
+	}
+}
+
+func TestQUICServeStreamTimeout(t *testing.T) {
+	l := NewQUIC("q1", quicTestAddr)
+	l.SetConfig(&Config{
+		Auth:          new(auth.Allow),
+		TLSConfig:     tlsConfigBasic,
+		StreamTimeout: 20 * time.Millisecond,
+	})
+	require.NoError(t, l.Listen(nil))
+	require.Equal(t, 20*time.Millisecond, l.streamTimeout())
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	// a connection which never opens a stream is closed once the timeout
+	// passes, while the listener is still open.
+	client := dialQUIC(t, l)
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("client connection was not closed")
+	}
+
+	l.Close(MockCloser)
+	<-o
+}
+
+func TestQUICStreamTimeoutDefault(t *testing.T) {
+	l := NewQUIC("q1", quicTestAddr)
+	require.Equal(t, defaultQUICStreamTimeout, l.streamTimeout())
+}
@@ -1,7 +1,14 @@
 package listeners
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
+	"math/big"
 	"net"
 	"testing"
 	"time"
@@ -156,6 +163,108 @@ func TestTCPServeTLSAndClose(t *testing.T) {
 	<-o
 }
 
+// genCertificate generates a self-signed certificate for a common name, which
+// may also be used as a certificate authority.
+func genCertificate(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func TestTCPServeTLSSNI(t *testing.T) {
+	certs := map[string]tls.Certificate{
+		"a.mochi.io": genCertificate(t, "a.mochi.io"),
+		"b.mochi.io": genCertificate(t, "b.mochi.io"),
+	}
+	clientCert := genCertificate(t, "client")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+
+	l := NewTCP("t1", testPort)
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+		TLSConfig: &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if cert, ok := certs[hello.ServerName]; ok {
+					return &cert, nil
+				}
+				return nil, errors.New("unknown server name")
+			},
+			ClientCAs:  clientCAs,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		},
+	})
+	err := l.Listen(nil)
+	require.NoError(t, err)
+
+	established := make(chan tls.ConnectionState)
+	o := make(chan bool)
+	go func() {
+		l.Serve(func(id string, c net.Conn, ac auth.Controller) error {
+			tc := c.(*tls.Conn)
+			err := tc.Handshake()
+			require.NoError(t, err)
+			established <- tc.ConnectionState()
+			return tc.Close()
+		})
+		o <- true
+	}()
+
+	dial := func(serverName string, cert *tls.Certificate) (*tls.Conn, error) {
+		cfg := &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		return tls.Dial("tcp", testPort, cfg)
+	}
+
+	for sn := range certs {
+		c, err := dial(sn, nil)
+		require.NoError(t, err)
+		require.Equal(t, sn, c.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+		cs := <-established
+		require.Equal(t, sn, cs.ServerName)
+		require.Empty(t, cs.PeerCertificates)
+		c.Close()
+	}
+
+	c, err := dial("a.mochi.io", &clientCert)
+	require.NoError(t, err)
+	cs := <-established
+	require.Equal(t, "client", cs.PeerCertificates[0].Subject.CommonName)
+	c.Close()
+
+	l.Close(MockCloser)
+	<-o
+}
+
 func TestTCPCloseError(t *testing.T) {
 	l := NewTCP("t1", testPort)
 	err := l.Listen(nil)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -17,50 +18,92 @@ import (
 	"github.com/csymapp/mqtt/server/system"
 )
 
+const (
+	// defaultWebsocketPath is the url path websocket connections are served on.
+	defaultWebsocketPath = "/mqtt"
+
+	// wsCloseTimeout is the time allowed for writing a close frame to a client.
+	wsCloseTimeout = time.Second
+)
+
 var (
 	// ErrInvalidMessage indicates that a message payload was not valid.
 	ErrInvalidMessage = errors.New("message type not binary")
 
-	// wsUpgrader is used to upgrade the incoming http/tcp connection to a
-	// websocket compliant connection.
-	wsUpgrader = &websocket.Upgrader{
-		Subprotocols: []string{"mqtt", "mqttv3.1"},
-		CheckOrigin:  func(r *http.Request) bool { return true },
-	}
+	// defaultWebsocketSubprotocols are the subprotocols negotiated by default.
+	defaultWebsocketSubprotocols = []string{"mqtt", "mqttv3.1"}
 )
 
-// Websocket is a listener for establishing websocket connections.
+// WebsocketOptions contains configurable options for a Websocket listener.
+type WebsocketOptions struct {
+	// Path is the url path to serve websocket connections on (default /mqtt).
+	Path string
+
+	// Subprotocols are the websocket subprotocols which may be negotiated with
+	// clients, in order of preference (default mqtt, mqttv3.1).
+	Subprotocols []string
+
+	// CheckOrigin returns true if the origin of an upgrade request is acceptable.
+	// All origins are accepted if nil.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Websocket is a listener for establishing websocket connections. In addition
+// to serving on its own network address, it implements http.Handler so it can
+// be attached to an existing http.ServeMux.
 type Websocket struct {
 	sync.RWMutex
-	id        string        // the internal id of the listener.
-	address   string        // the network address to bind to.
-	config    *Config       // configuration values for the listener.
-	listen    *http.Server  // an http server for serving websocket connections.
-	establish EstablishFunc // the server's establish connection handler.
-	end       uint32        // ensure the close methods are only called once.
+	id        string               // the internal id of the listener.
+	address   string               // the network address to bind to.
+	path      string               // the url path to serve websocket connections on.
+	config    *Config              // configuration values for the listener.
+	listen    *http.Server         // an http server for serving websocket connections.
+	upgrader  *websocket.Upgrader  // upgrades incoming http connections to websocket connections.
+	establish EstablishFunc        // the server's establish connection handler.
+	conns     map[*wsConn]struct{} // the open websocket connections.
+	done      chan struct{}        // closed when the listener is closed.
+	end       uint32               // ensure the close methods are only called once.
 }
 
 // wsConn is a websocket connection which satisfies the net.Conn interface.
-// Inspired by
 type wsConn struct {
 	net.Conn
-	c *websocket.Conn
+	c         *websocket.Conn // the websocket connection.
+	r         io.Reader       // the reader for the message currently being read.
+	closeOnce sync.Once       // only send one close frame.
 }
 
 // Read reads the next span of bytes from the websocket connection and returns
-// the number of bytes read.
+// the number of bytes read. A single MQTT packet may span several websocket
+// messages and a message may contain several packets, so messages are read
+// as a continuous stream.
 func (ws *wsConn) Read(p []byte) (n int, err error) {
-	op, r, err := ws.c.NextReader()
-	if err != nil {
-		return
-	}
+	for {
+		if ws.r == nil {
+			var op int
+			op, ws.r, err = ws.c.NextReader()
+			if err != nil {
+				return
+			}
+
+			if op != websocket.BinaryMessage {
+				ws.r = nil
+				err = ErrInvalidMessage
+				return
+			}
+		}
+
+		n, err = ws.r.Read(p)
+		if err == io.EOF {
+			ws.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
 
-	if op != websocket.BinaryMessage {
-		err = ErrInvalidMessage
 		return
 	}
-
-	return r.Read(p)
 }
 
 // Write writes bytes to the websocket connection.
@@ -73,20 +116,69 @@ func (ws *wsConn) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-// Close signals the underlying websocket conn to close.
+// Close sends a close frame to the client and closes the underlying connection.
 func (ws *wsConn) Close() error {
+	ws.closeFrame(websocket.CloseNormalClosure, "")
 	return ws.Conn.Close()
 }
 
+// closeFrame sends a close frame to the client, if one has not already been sent.
+func (ws *wsConn) closeFrame(code int, text string) {
+	ws.closeOnce.Do(func() {
+		_ = ws.c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(wsCloseTimeout))
+	})
+}
+
+// ConnectionState returns the state of the underlying tls connection. The
+// handshake is reported as incomplete if the connection does not use tls.
+func (ws *wsConn) ConnectionState() tls.ConnectionState {
+	if c, ok := ws.Conn.(*tls.Conn); ok {
+		return c.ConnectionState()
+	}
+
+	return tls.ConnectionState{}
+}
+
 // NewWebsocket initialises and returns a new Websocket listener, listening on an address.
 func NewWebsocket(id, address string) *Websocket {
+	return NewWebsocketWithOptions(id, address, nil)
+}
+
+// NewWebsocketWithOptions initialises and returns a new Websocket listener,
+// listening on an address with the given options. If the address is empty,
+// the listener does not bind to an address of its own, and should instead be
+// attached to an existing http.ServeMux, eg. mux.Handle(l.Path(), l).
+func NewWebsocketWithOptions(id, address string, o *WebsocketOptions) *Websocket {
+	if o == nil {
+		o = new(WebsocketOptions)
+	}
+
+	if o.Path == "" {
+		o.Path = defaultWebsocketPath
+	}
+
+	if len(o.Subprotocols) == 0 {
+		o.Subprotocols = defaultWebsocketSubprotocols
+	}
+
+	if o.CheckOrigin == nil {
+		o.CheckOrigin = func(r *http.Request) bool { return true }
+	}
+
 	return &Websocket{
 		id:      id,
 		address: address,
+		path:    o.Path,
 		config: &Config{
 			Auth: new(auth.Allow),
 			TLS:  new(TLS),
 		},
+		upgrader: &websocket.Upgrader{
+			Subprotocols: o.Subprotocols,
+			CheckOrigin:  o.CheckOrigin,
+		},
+		conns: map[*wsConn]struct{}{},
+		done:  make(chan struct{}),
 	}
 }
 
@@ -114,14 +206,25 @@ func (l *Websocket) ID() string {
 	return id
 }
 
-// Listen starts listening on the listener's network address.
+// Path returns the url path the listener serves websocket connections on.
+func (l *Websocket) Path() string {
+	return l.path
+}
+
+// Listen starts listening on the listener's network address. If the listener
+// has no address, it is served by attaching it to an existing http.ServeMux.
 func (l *Websocket) Listen(s *system.Info) error {
+	if l.address == "" {
+		return nil
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/mqtt", l.handler)
+	mux.Handle(l.path, l)
 	l.listen = &http.Server{
 		Addr:    l.address,
 		Handler: mux,
 	}
+
 	// The following logic is deprecated in favour of passing through the tls.Config
 	// value directly, however it remains in order to provide backwards compatibility.
 	// It will be removed someday, so use the preferred method (l.config.TLSConfig).
@@ -141,6 +244,7 @@ func (l *Websocket) Listen(s *system.Info) error {
 	return nil
 }
 
+// Subprotocols returns the websocket subprotocols requested by a client.
 func Subprotocols(r *http.Request) []string {
 	h := strings.TrimSpace(r.Header.Get("Sec-Websocket-Protocol"))
 	if h == "" {
@@ -153,46 +257,81 @@ func Subprotocols(r *http.Request) []string {
 	return protocols
 }
 
-func (l *Websocket) handler(w http.ResponseWriter, r *http.Request) {
+// ServeHTTP upgrades an http request to a websocket connection, negotiating
+// one of the listener's subprotocols, and establishes it as a client.
+func (l *Websocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.RLock()
+	establish, ac := l.establish, l.config.Auth
+	l.RUnlock()
 
-	subprotocols := Subprotocols(r)
-	wsUpgrader.Subprotocols = subprotocols // very bad assumption is that all the subprotocols will be supported
-	c, err := wsUpgrader.Upgrade(w, r, nil)
-	if err != nil {
+	if establish == nil || atomic.LoadUint32(&l.end) == 1 {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 		return
 	}
-	defer c.Close()
-	l.establish(l.id, &wsConn{c.UnderlyingConn(), c}, l.config.Auth)
+
+	c, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has already responded with an error.
+	}
+
+	ws := &wsConn{Conn: c.UnderlyingConn(), c: c}
+	l.Lock()
+	l.conns[ws] = struct{}{}
+	l.Unlock()
+
+	defer func() {
+		l.Lock()
+		delete(l.conns, ws)
+		l.Unlock()
+		ws.Close()
+	}()
+
+	establish(l.id, ws, ac)
 }
 
 // Serve starts waiting for new Websocket connections, and calls the connection
 // establishment callback for any received.
 func (l *Websocket) Serve(establish EstablishFunc) {
+	l.Lock()
 	l.establish = establish
+	l.Unlock()
+
+	if l.listen == nil { // attached to an existing http.ServeMux.
+		<-l.done
+		return
+	}
 
 	if l.listen.TLSConfig != nil {
 		l.listen.ListenAndServeTLS("", "")
 	} else {
-		// addr := l.listen.Addr
-		// ln, err := net.Listen("tcp4", addr)
-		// if err != nil {
-		// } else {
-		// 	l.listen.Serve(ln)
-		// }
 		l.listen.ListenAndServe()
 	}
 }
 
-// Close closes the listener and any client connections.
+// Close closes the listener and any client connections. Clients are sent a
+// going away close frame before their connections are closed.
 func (l *Websocket) Close(closeClients CloseFunc) {
 	l.Lock()
 	defer l.Unlock()
 
 	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		l.listen.Shutdown(ctx)
+		if l.listen != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			l.listen.Shutdown(ctx)
+		}
+
+		close(l.done)
+	}
+
+	for ws := range l.conns {
+		ws.closeFrame(websocket.CloseGoingAway, "server shutting down")
 	}
 
 	closeClients(l.id)
+
+	// Close any connections which had not yet been established as clients.
+	for ws := range l.conns {
+		ws.Close()
+	}
 }
@@ -14,17 +14,84 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// wsPair returns a server side wsConn and the client websocket connection
+// which is connected to it.
+func wsPair(t *testing.T) (*wsConn, *websocket.Conn) {
+	srv := make(chan *wsConn)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := new(websocket.Upgrader).Upgrade(w, r, nil)
+		require.NoError(t, err)
+		srv <- &wsConn{Conn: c.UnderlyingConn(), c: c}
+	}))
+	t.Cleanup(s.Close)
+
+	cl, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { cl.Close() })
+
+	return <-srv, cl
+}
+
 func TestWsConnClose(t *testing.T) {
-	r, _ := net.Pipe()
-	ws := &wsConn{r, new(websocket.Conn)}
+	ws, cl := wsPair(t)
 	err := ws.Close()
 	require.NoError(t, err)
+
+	_, _, err = cl.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+}
+
+func TestWsConnRead(t *testing.T) {
+	ws, cl := wsPair(t)
+	require.NoError(t, cl.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+	require.NoError(t, cl.WriteMessage(websocket.BinaryMessage, []byte("mochi")))
+
+	// A message larger than the buffer is read across several calls, and the
+	// next message follows on from it.
+	buf := make([]byte, 3)
+	var out []byte
+	for len(out) < 10 {
+		n, err := ws.Read(buf)
+		require.NoError(t, err)
+		out = append(out, buf[:n]...)
+	}
+	require.Equal(t, "hellomochi", string(out))
+
+	require.NoError(t, cl.WriteMessage(websocket.TextMessage, []byte("text")))
+	_, err := ws.Read(buf)
+	require.ErrorIs(t, err, ErrInvalidMessage)
+}
+
+func TestWsConnWrite(t *testing.T) {
+	ws, cl := wsPair(t)
+	n, err := ws.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+
+	op, b, err := cl.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.BinaryMessage, op)
+	require.Equal(t, []byte("hello"), b)
 }
 
 func TestNewWebsocket(t *testing.T) {
 	l := NewWebsocket("t1", testPort)
 	require.Equal(t, "t1", l.id)
 	require.Equal(t, testPort, l.address)
+	require.Equal(t, defaultWebsocketPath, l.Path())
+	require.Equal(t, defaultWebsocketSubprotocols, l.upgrader.Subprotocols)
+	require.True(t, l.upgrader.CheckOrigin(nil))
+}
+
+func TestNewWebsocketWithOptions(t *testing.T) {
+	l := NewWebsocketWithOptions("t1", testPort, &WebsocketOptions{
+		Path:         "/ws",
+		Subprotocols: []string{"mqtt"},
+		CheckOrigin:  func(r *http.Request) bool { return false },
+	})
+	require.Equal(t, "/ws", l.Path())
+	require.Equal(t, []string{"mqtt"}, l.upgrader.Subprotocols)
+	require.False(t, l.upgrader.CheckOrigin(nil))
 }
 
 func BenchmarkNewWebsocket(b *testing.B) {
@@ -77,6 +144,13 @@ func TestWebsocketListen(t *testing.T) {
 	require.NotNil(t, l.listen)
 }
 
+func TestWebsocketListenNoAddress(t *testing.T) {
+	l := NewWebsocket("t1", "")
+	err := l.Listen(nil)
+	require.NoError(t, err)
+	require.Nil(t, l.listen)
+}
+
 func TestWebsocketListenTLSConfig(t *testing.T) {
 	l := NewWebsocket("t1", testPort)
 	l.SetConfig(&Config{
@@ -169,7 +243,7 @@ func TestWebsocketUpgrade(t *testing.T) {
 		e <- true
 		return nil
 	}
-	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	s := httptest.NewServer(l)
 	u := "ws" + strings.TrimPrefix(s.URL, "http")
 	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
 	require.NoError(t, err)
@@ -179,3 +253,78 @@ func TestWebsocketUpgrade(t *testing.T) {
 	ws.Close()
 
 }
+
+func TestWebsocketSubprotocol(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	l.establish = func(id string, c net.Conn, ac auth.Controller) error {
+		return nil
+	}
+	s := httptest.NewServer(l)
+	defer s.Close()
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	d := &websocket.Dialer{Subprotocols: []string{"other", "mqtt"}}
+	ws, _, err := d.Dial(u, nil)
+	require.NoError(t, err)
+	require.Equal(t, "mqtt", ws.Subprotocol())
+	ws.Close()
+
+	d = &websocket.Dialer{Subprotocols: []string{"other"}}
+	ws, _, err = d.Dial(u, nil)
+	require.NoError(t, err)
+	require.Equal(t, "", ws.Subprotocol())
+	ws.Close()
+}
+
+func TestWebsocketNotServing(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	s := httptest.NewServer(l)
+	defer s.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestWebsocketAttachedToMux(t *testing.T) {
+	l := NewWebsocketWithOptions("t1", "", &WebsocketOptions{Path: "/broker/mqtt"})
+	require.NoError(t, l.Listen(nil))
+
+	mux := http.NewServeMux()
+	mux.Handle(l.Path(), l)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	established := make(chan net.Conn)
+	o := make(chan bool)
+	go func() {
+		l.Serve(func(id string, c net.Conn, ac auth.Controller) error {
+			established <- c
+			_, err := c.Read(make([]byte, 1)) // block until the connection is closed.
+			return err
+		})
+		o <- true
+	}()
+
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/broker/mqtt"
+	var ws *websocket.Conn
+	var err error
+	for i := 0; i < 100; i++ { // wait for the listener to begin serving.
+		ws, _, err = websocket.DefaultDialer.Dial(u, nil)
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, err)
+	defer ws.Close()
+
+	c := <-established
+	l.Close(func(id string) {
+		c.Close()
+	})
+	<-o
+
+	_, _, err = ws.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "want going away, got %v", err)
+}
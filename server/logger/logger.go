@@ -0,0 +1,150 @@
+// Package logger provides a structured logging interface for the server, so
+// that broker logs can be routed into any logging pipeline.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Field keys used by the server, so the same values are always logged with
+// the same keys.
+const (
+	KeyClientID   = "client_id"
+	KeyRemoteAddr = "remote_addr"
+	KeyListener   = "listener"
+	KeyUsername   = "username"
+	KeyTopic      = "topic"
+	KeyFilter     = "filter"
+	KeyError      = "error"
+)
+
+// Logger is a structured logger. Each method takes a message followed by
+// alternating keys and values, for example:
+//
+//	l.Info("client connected", "client_id", id, "remote_addr", addr)
+//
+// This matches the key-value methods of most structured logging libraries,
+// such as zap's SugaredLogger, so they only need a thin adapter.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// Nop is a Logger which discards all logs.
+type Nop struct{}
+
+// Debug does nothing.
+func (Nop) Debug(msg string, kv ...interface{}) {}
+
+// Info does nothing.
+func (Nop) Info(msg string, kv ...interface{}) {}
+
+// Warn does nothing.
+func (Nop) Warn(msg string, kv ...interface{}) {}
+
+// Error does nothing.
+func (Nop) Error(msg string, kv ...interface{}) {}
+
+// Level is the severity of a log.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the name of the level.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+// Std is a Logger which writes to a standard library logger, with the fields
+// formatted as key=value pairs.
+type Std struct {
+	Logger *log.Logger // the logger to write to. If nil, the standard logger is used.
+	Level  Level       // the minimum level of logs to write.
+}
+
+// NewStd returns a Logger which writes logs of at least the given level to a
+// standard library logger. If l is nil, the standard logger is used.
+func NewStd(l *log.Logger, level Level) *Std {
+	return &Std{
+		Logger: l,
+		Level:  level,
+	}
+}
+
+// Debug writes a debug log.
+func (s *Std) Debug(msg string, kv ...interface{}) {
+	s.write(LevelDebug, msg, kv)
+}
+
+// Info writes an info log.
+func (s *Std) Info(msg string, kv ...interface{}) {
+	s.write(LevelInfo, msg, kv)
+}
+
+// Warn writes a warning log.
+func (s *Std) Warn(msg string, kv ...interface{}) {
+	s.write(LevelWarn, msg, kv)
+}
+
+// Error writes an error log.
+func (s *Std) Error(msg string, kv ...interface{}) {
+	s.write(LevelError, msg, kv)
+}
+
+// write formats and writes a log if it meets the minimum level.
+func (s *Std) write(level Level, msg string, kv []interface{}) {
+	if level < s.Level {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		var v interface{} = "(MISSING)"
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		b.WriteString(formatValue(v))
+	}
+
+	if s.Logger == nil {
+		log.Output(3, b.String())
+		return
+	}
+	s.Logger.Output(3, b.String())
+}
+
+// formatValue formats a field value, quoting it if it would be ambiguous.
+func formatValue(v interface{}) string {
+	str := fmt.Sprint(v)
+	if str == "" || strings.ContainsAny(str, " =\"\t\n") {
+		return fmt.Sprintf("%q", str)
+	}
+	return str
+}
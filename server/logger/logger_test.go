@@ -0,0 +1,54 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNop(t *testing.T) {
+	var l Logger = Nop{}
+	l.Debug("debug", KeyClientID, "mochi")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+}
+
+func TestLevelString(t *testing.T) {
+	require.Equal(t, "DEBUG", LevelDebug.String())
+	require.Equal(t, "INFO", LevelInfo.String())
+	require.Equal(t, "WARN", LevelWarn.String())
+	require.Equal(t, "ERROR", LevelError.String())
+	require.Equal(t, "LEVEL(9)", Level(9).String())
+}
+
+func TestStd(t *testing.T) {
+	buf := new(bytes.Buffer)
+	var l Logger = NewStd(log.New(buf, "", 0), LevelDebug)
+
+	l.Debug("debug", KeyClientID, "mochi")
+	l.Info("info", KeyTopic, "a/b/c", "qos", 1)
+	l.Warn("warn", KeyError, errors.New("test error"))
+	l.Error("error", KeyUsername, "", "odd")
+
+	require.Equal(t, `DEBUG debug client_id=mochi
+INFO info topic=a/b/c qos=1
+WARN warn error="test error"
+ERROR error username="" odd=(MISSING)
+`, buf.String())
+}
+
+func TestStdLevel(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := NewStd(log.New(buf, "", 0), LevelWarn)
+
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+
+	require.Equal(t, "WARN warn\nERROR error\n", buf.String())
+}
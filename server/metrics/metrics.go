@@ -0,0 +1,233 @@
+// Package metrics exposes the server statistics as a Prometheus collector, so
+// they can be scraped into a monitoring system.
+//
+// The values are read from the server's system info counters at the time of
+// each scrape, so no additional bookkeeping is performed by the server.
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+
+	mqtt "github.com/csymapp/mqtt/server"
+	"github.com/csymapp/mqtt/server/system"
+)
+
+const (
+	// ContentType is the content type of the Prometheus text exposition format.
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// defaultNamespace is the prefix applied to all metric names.
+	defaultNamespace = "mqtt"
+)
+
+// metric describes a single metric family.
+type metric struct {
+	name  string                            // the name of the metric, without namespace.
+	help  string                            // the help text of the metric.
+	kind  prometheus.ValueType              // counter or gauge.
+	value func(info *system.Info) int64     // returns the value of an unlabelled metric.
+	qos   func(info *system.Info) *[3]int64 // returns the values of a metric labelled by qos.
+}
+
+// metrics are the metrics exported by the collector.
+var metrics = []metric{
+	{name: "clients_connected", kind: prometheus.GaugeValue, help: "The number of currently connected clients.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.ClientsConnected) }},
+	{name: "clients_disconnected", kind: prometheus.GaugeValue, help: "The number of disconnected persistent clients.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.ClientsDisconnected) }},
+	{name: "clients_maximum", kind: prometheus.GaugeValue, help: "The maximum number of concurrently connected clients.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.ClientsMax) }},
+	{name: "clients", kind: prometheus.GaugeValue, help: "The number of connected and disconnected clients.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.ClientsTotal) }},
+	{name: "connections_total", kind: prometheus.CounterValue, help: "The total number of client connections.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.ConnectionsTotal) }},
+	{name: "connections_rejected_total", kind: prometheus.CounterValue, help: "The total number of connections refused by a listener connection limit.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.ConnectionsRejected) }},
+	{name: "bytes_received_total", kind: prometheus.CounterValue, help: "The total number of bytes received from clients.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.BytesRecv) }},
+	{name: "bytes_sent_total", kind: prometheus.CounterValue, help: "The total number of bytes sent to clients.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.BytesSent) }},
+	{name: "packets_received_total", kind: prometheus.CounterValue, help: "The total number of packets received from clients.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.MessagesRecv) }},
+	{name: "packets_sent_total", kind: prometheus.CounterValue, help: "The total number of packets sent to clients.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.MessagesSent) }},
+	{name: "messages_received_total", kind: prometheus.CounterValue, help: "The total number of publish messages received, by qos.",
+		qos: func(i *system.Info) *[3]int64 { return &i.PublishRecvQos }},
+	{name: "messages_sent_total", kind: prometheus.CounterValue, help: "The total number of publish messages sent, by qos.",
+		qos: func(i *system.Info) *[3]int64 { return &i.PublishSentQos }},
+	{name: "messages_dropped_total", kind: prometheus.CounterValue, help: "The total number of publish messages dropped.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.PublishDropped) }},
+	{name: "messages_store_rejected_total", kind: prometheus.CounterValue, help: "The total number of QoS 1 and 2 publish messages rejected because the store was failing or saturated.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.StoreRejected) }},
+	{name: "messages_deduplicated_total", kind: prometheus.CounterValue, help: "The total number of publish messages suppressed as duplicates.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.PublishDeduplicated) }},
+	{name: "retained_messages", kind: prometheus.GaugeValue, help: "The number of retained messages.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.Retained) }},
+	{name: "retained_bytes", kind: prometheus.GaugeValue, help: "The total payload size of the retained messages.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.RetainedBytes) }},
+	{name: "retained_evicted_total", kind: prometheus.CounterValue, help: "The total number of retained messages evicted to stay under the size limit.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.RetainedEvicted) }},
+	{name: "retained_rejected_total", kind: prometheus.CounterValue, help: "The total number of messages not retained because they exceeded the size limit.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.RetainedRejected) }},
+	{name: "inflight_messages", kind: prometheus.GaugeValue, help: "The number of in-flight messages.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.Inflight) }},
+	{name: "subscriptions", kind: prometheus.GaugeValue, help: "The number of filter subscriptions.",
+		value: func(i *system.Info) int64 { return atomic.LoadInt64(&i.Subscriptions) }},
+	{name: "uptime_seconds", kind: prometheus.GaugeValue, help: "The number of seconds the server has been running.",
+		value: func(i *system.Info) int64 { return time.Now().Unix() - atomic.LoadInt64(&i.Started) }},
+}
+
+// The names, help and labels of the metrics which are not in the metrics table.
+var (
+	replayMetric   = metric{name: "retained_replay_duration_seconds", help: "The time taken to send the matching retained messages to new subscriptions."}
+	rateMetric     = metric{name: "ratelimit_dropped_total", help: "The number of publish messages dropped by each topic rate limit."}
+	bufferedMetric = metric{name: "client_write_buffered_bytes", help: "The number of bytes waiting to be written to each connected client."}
+	queueMetric    = metric{name: "store_queue_depth", help: "The number of writes waiting in the write-behind queue of the store."}
+	droppedMetric  = metric{name: "store_writes_dropped_total", help: "The total number of writes dropped because the write-behind queue was full."}
+	latencyMetric  = metric{name: "store_operation_duration_seconds", help: "The time taken by calls to each method of the store."}
+	failingMetric  = metric{name: "store_failing", help: "Whether the last call to any method of the store failed."}
+)
+
+// Collector collects the statistics of a server as metrics. It implements
+// prometheus.Collector, so it can be registered with any Prometheus registry.
+type Collector struct {
+	Namespace string       // the prefix of the metric names (default mqtt), which must be set before the collector is registered.
+	server    *mqtt.Server // the server to collect statistics from.
+}
+
+// New returns a new Collector for a server.
+func New(server *mqtt.Server) *Collector {
+	return &Collector{
+		Namespace: defaultNamespace,
+		server:    server,
+	}
+}
+
+// desc returns the descriptor of a metric, with its name in the namespace of
+// the collector.
+func (c *Collector) desc(m metric, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(c.Namespace, "", m.name), m.help, labels, nil)
+}
+
+// Describe sends the descriptors of all the metrics of the collector to ch.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range metrics {
+		if m.qos != nil {
+			ch <- c.desc(m, "qos")
+			continue
+		}
+
+		ch <- c.desc(m)
+	}
+
+	ch <- c.desc(replayMetric)
+	ch <- c.desc(rateMetric, "filter")
+	ch <- c.desc(bufferedMetric, "client_id")
+	ch <- c.desc(queueMetric)
+	ch <- c.desc(droppedMetric)
+	ch <- c.desc(latencyMetric, "op")
+	ch <- c.desc(failingMetric)
+}
+
+// Collect reads the current statistics of the server and sends them to ch.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	info := c.server.System
+	for _, m := range metrics {
+		if m.qos != nil {
+			d := c.desc(m, "qos")
+			v := m.qos(info)
+			for q, l := range []string{"0", "1", "2"} {
+				ch <- prometheus.MustNewConstMetric(d, m.kind, float64(atomic.LoadInt64(&v[q])), l)
+			}
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.desc(m), m.kind, float64(m.value(info)))
+	}
+
+	ch <- prometheus.MustNewConstSummary(c.desc(replayMetric),
+		uint64(atomic.LoadInt64(&info.RetainedReplays)),
+		float64(atomic.LoadInt64(&info.RetainedReplayTime))/1e6, nil)
+
+	d := c.desc(rateMetric, "filter")
+	for filter, n := range c.server.RateLimitDropped() {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(n), filter)
+	}
+
+	d = c.desc(bufferedMetric, "client_id")
+	for id, n := range c.server.WriteBuffered() {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(n), id)
+	}
+
+	queued, writesDropped := c.server.StoreQueue()
+	ch <- prometheus.MustNewConstMetric(c.desc(queueMetric), prometheus.GaugeValue, float64(queued))
+	ch <- prometheus.MustNewConstMetric(c.desc(droppedMetric), prometheus.CounterValue, float64(writesDropped))
+
+	d = c.desc(latencyMetric, "op")
+	for op, l := range c.server.StoreLatency() {
+		ch <- prometheus.MustNewConstSummary(d, uint64(l.Count), l.Time.Seconds(), nil, op)
+	}
+
+	failing := 0.0
+	if c.server.StoreFailing() {
+		failing = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc(failingMetric), prometheus.GaugeValue, failing)
+}
+
+// registry returns a new registry with only the collector registered.
+func (c *Collector) registry() (*prometheus.Registry, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		return nil, err
+	}
+
+	return reg, nil
+}
+
+// Write writes the current metrics to w in the Prometheus text exposition format.
+func (c *Collector) Write(w io.Writer) error {
+	reg, err := c.registry()
+	if err != nil {
+		return err
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		return err
+	}
+
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler returns an http.Handler which serves the metrics, suitable for
+// mounting on a mux as a Prometheus scrape target. Scrapes which fail to
+// collect the metrics are answered with an internal server error.
+func (c *Collector) Handler() http.Handler {
+	reg, err := c.registry()
+	if err != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		})
+	}
+
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.HTTPErrorOnError,
+	})
+}
+
+// check the collector satisfies the prometheus.Collector interface.
+var _ prometheus.Collector = (*Collector)(nil)
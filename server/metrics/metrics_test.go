@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/csymapp/mqtt/server"
+	"github.com/csymapp/mqtt/server/internal/circ"
+	"github.com/csymapp/mqtt/server/internal/clients"
+	"github.com/csymapp/mqtt/server/internal/packets"
+	"github.com/csymapp/mqtt/server/persistence"
+)
+
+func TestNew(t *testing.T) {
+	s := mqtt.New()
+	c := New(s)
+	require.Equal(t, defaultNamespace, c.Namespace)
+	require.Equal(t, s, c.server)
+}
+
+func TestWrite(t *testing.T) {
+	s := mqtt.New()
+	s.System.Started = time.Now().Unix() - 10
+	s.System.ClientsConnected = 3
+	s.System.BytesRecv = 1024
+	s.System.PublishRecvQos = [3]int64{5, 6, 7}
+	s.System.PublishSentQos = [3]int64{1, 0, 2}
+	s.System.Retained = 4
+	s.System.RetainedBytes = 2048
+	s.System.RetainedEvicted = 3
+	s.System.PublishDeduplicated = 4
+	s.System.Inflight = 2
+	s.System.Subscriptions = 9
+	s.System.ConnectionsRejected = 8
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, New(s).Write(buf))
+	out := buf.String()
+
+	require.Contains(t, out, "# HELP mqtt_clients_connected The number of currently connected clients.\n")
+	require.Contains(t, out, "# TYPE mqtt_clients_connected gauge\nmqtt_clients_connected 3\n")
+	require.Contains(t, out, "# TYPE mqtt_bytes_received_total counter\nmqtt_bytes_received_total 1024\n")
+	require.Contains(t, out, "mqtt_messages_received_total{qos=\"0\"} 5\n")
+	require.Contains(t, out, "mqtt_messages_received_total{qos=\"1\"} 6\n")
+	require.Contains(t, out, "mqtt_messages_received_total{qos=\"2\"} 7\n")
+	require.Contains(t, out, "mqtt_messages_sent_total{qos=\"2\"} 2\n")
+	require.Contains(t, out, "mqtt_retained_messages 4\n")
+	require.Contains(t, out, "mqtt_retained_bytes 2048\n")
+	require.Contains(t, out, "# TYPE mqtt_retained_evicted_total counter\nmqtt_retained_evicted_total 3\n")
+	require.Contains(t, out, "# TYPE mqtt_messages_deduplicated_total counter\nmqtt_messages_deduplicated_total 4\n")
+	require.Contains(t, out, "mqtt_retained_rejected_total 0\n")
+	require.Contains(t, out, "mqtt_inflight_messages 2\n")
+	require.Contains(t, out, "mqtt_subscriptions 9\n")
+	require.Contains(t, out, "# TYPE mqtt_connections_rejected_total counter\nmqtt_connections_rejected_total 8\n")
+	require.Contains(t, out, "mqtt_uptime_seconds 1")
+}
+
+func TestWriteRateLimitDropped(t *testing.T) {
+	s := mqtt.New()
+	s.SetRateLimit("telemetry/#", mqtt.RateLimit{Rate: 1})
+	s.SetRateLimit(`a/"b"`, mqtt.RateLimit{Rate: 1})
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, New(s).Write(buf))
+	require.Contains(t, buf.String(), "# TYPE mqtt_ratelimit_dropped_total counter\n"+
+		`mqtt_ratelimit_dropped_total{filter="a/\"b\""} 0`+"\n"+
+		`mqtt_ratelimit_dropped_total{filter="telemetry/#"} 0`+"\n")
+}
+
+func TestWriteRetainedReplayDuration(t *testing.T) {
+	s := mqtt.New()
+	s.System.RetainedReplays = 4
+	s.System.RetainedReplayTime = 1500000
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, New(s).Write(buf))
+	require.Contains(t, buf.String(), "# TYPE mqtt_retained_replay_duration_seconds summary\n"+
+		"mqtt_retained_replay_duration_seconds_sum 1.5\n"+
+		"mqtt_retained_replay_duration_seconds_count 4\n")
+}
+
+func TestWriteClientWriteBuffered(t *testing.T) {
+	s := mqtt.New()
+	for _, id := range []string{"b", `a"1`} {
+		_, w := net.Pipe()
+		cl := clients.NewClient(w, circ.NewReader(128, 8), circ.NewWriter(128, 8), s.System)
+		cl.ID = id
+		s.Clients.Add(cl)
+	}
+
+	cl, _ := s.Clients.Get("b")
+	_, err := cl.WritePacket(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingresp}})
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, New(s).Write(buf))
+	require.Contains(t, buf.String(), "# TYPE mqtt_client_write_buffered_bytes gauge\n"+
+		`mqtt_client_write_buffered_bytes{client_id="a\"1"} 0`+"\n"+
+		`mqtt_client_write_buffered_bytes{client_id="b"} 2`+"\n")
+}
+
+func TestWriteStoreQueue(t *testing.T) {
+	s := mqtt.New()
+	s.Options.WriteBehind = new(persistence.WriteBehindOptions)
+	require.NoError(t, s.AddStore(new(persistence.MockStore)))
+	defer s.Store.Close()
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, New(s).Write(buf))
+	require.Contains(t, buf.String(), "# TYPE mqtt_store_queue_depth gauge\nmqtt_store_queue_depth 0\n")
+	require.Contains(t, buf.String(), "# TYPE mqtt_store_writes_dropped_total counter\nmqtt_store_writes_dropped_total 0\n")
+	require.Contains(t, buf.String(), "# TYPE mqtt_store_failing gauge\nmqtt_store_failing 0\n")
+}
+
+func TestWriteStoreLatency(t *testing.T) {
+	s := mqtt.NewServer(&mqtt.Options{StoreLatency: true})
+	require.NoError(t, s.AddStore(new(persistence.MockStore)))
+	require.NoError(t, s.Store.WriteInflight(persistence.Message{ID: "a"}))
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, New(s).Write(buf))
+	require.Contains(t, buf.String(), "# TYPE mqtt_store_operation_duration_seconds summary\n")
+	require.Contains(t, buf.String(), `mqtt_store_operation_duration_seconds_count{op="WriteInflight"} 1`+"\n")
+	require.Contains(t, buf.String(), `mqtt_store_operation_duration_seconds_sum{op="WriteInflight"} `)
+}
+
+func TestWriteNamespace(t *testing.T) {
+	c := New(mqtt.New())
+	c.Namespace = "broker"
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, c.Write(buf))
+	require.Contains(t, buf.String(), "broker_clients_connected 0\n")
+
+	c.Namespace = ""
+	buf.Reset()
+	require.NoError(t, c.Write(buf))
+	require.Contains(t, buf.String(), "\nclients_connected 0\n")
+}
+
+type errWriter struct{}
+
+func (w errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("test")
+}
+
+func TestWriteError(t *testing.T) {
+	require.Error(t, New(mqtt.New()).Write(errWriter{}))
+}
+
+func TestHandler(t *testing.T) {
+	s := mqtt.New()
+	s.System.ClientsConnected = 5
+
+	w := httptest.NewRecorder()
+	New(s).Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Header().Get("Content-Type"), ContentType)
+	require.Contains(t, w.Body.String(), "mqtt_clients_connected 5\n")
+}
+
+func TestCollectorRegister(t *testing.T) {
+	s := mqtt.NewServer(&mqtt.Options{StoreLatency: true})
+	require.NoError(t, s.AddStore(new(persistence.MockStore)))
+	require.NoError(t, s.Store.WriteInflight(persistence.Message{ID: "a"}))
+	s.SetRateLimit("telemetry/#", mqtt.RateLimit{Rate: 1})
+	s.System.ClientsConnected = 2
+
+	// the pedantic registry checks that every collected metric was described.
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(New(s)))
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	found := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			if m.GetGauge() != nil {
+				found[mf.GetName()] = m.GetGauge().GetValue()
+			}
+		}
+	}
+
+	require.Equal(t, float64(2), found["mqtt_clients_connected"])
+	require.Contains(t, found, "mqtt_store_failing")
+}
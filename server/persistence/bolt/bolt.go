@@ -1,13 +1,23 @@
 package bolt
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
 	"time"
 
 	sgob "github.com/asdine/storm/codec/gob"
 	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/codec"
+	"github.com/asdine/storm/v3/index"
+	"github.com/asdine/storm/v3/q"
 	"go.etcd.io/bbolt"
 
+	"github.com/csymapp/mqtt/server/logger"
 	"github.com/csymapp/mqtt/server/persistence"
 )
 
@@ -18,60 +28,893 @@ const (
 
 	// defaultTimeout is the default timeout of the file lock.
 	defaultTimeout = 250 * time.Millisecond
+
+	// compactSuffix is appended to the db path to name the temporary file used
+	// during compaction.
+	compactSuffix = ".compact"
+
+	// corruptSuffix is appended to the db path to name the copy of a corrupt db
+	// file which is moved aside by the store.
+	corruptSuffix = ".corrupt"
+
+	// retainedBucket is the bucket which indexes the topics of retained messages,
+	// keyed on message id, so they can be counted and listed without decoding.
+	retainedBucket = "retained_topics"
+
+	// subscriptionBucket and messageBucket are the storm buckets of the
+	// subscriptions and messages, named after their structs.
+	subscriptionBucket = "Subscription"
+	messageBucket      = "Message"
+
+	// clientIndex is the name of the storm index on the Client field of the
+	// subscriptions and messages, used to count the records of a client.
+	clientIndex = "__storm_index_Client"
+
+	// schemaBucket holds the schema version of the records in the db, under
+	// schemaKey, so older records can be migrated when the db is opened.
+	schemaBucket = "schema"
+	schemaKey    = "version"
+
+	// cipherKey holds the key check value of an encrypted db in the schema
+	// bucket, which is used to verify the encryption key when the db is opened.
+	cipherKey = "cipher"
+)
+
+// recordBuckets are the storm buckets of each type of record, with a function
+// returning a value the records of the bucket are decoded into.
+var recordBuckets = []struct {
+	name string
+	new  func() interface{}
+}{
+	{"ServerInfo", func() interface{} { return new(persistence.ServerInfo) }},
+	{subscriptionBucket, func() interface{} { return new(persistence.Subscription) }},
+	{"Client", func() interface{} { return new(persistence.Client) }},
+	{messageBucket, func() interface{} { return new(persistence.Message) }},
+}
+
+var (
+	// ErrDBNotOpen indicates the bolt db file is not open for reading.
+	ErrDBNotOpen = fmt.Errorf("boltdb not opened")
+
+	// ErrDBCorrupt indicates the bolt db file is corrupt and could not be opened.
+	// Recover can be used to salvage the records which are still readable.
+	ErrDBCorrupt = fmt.Errorf("boltdb file is corrupt")
+
+	// ErrSchemaTooNew indicates the bolt db file was written with a newer schema
+	// version than this version of the store can read.
+	ErrSchemaTooNew = fmt.Errorf("boltdb schema version is newer than supported")
 )
 
-var (
-	// ErrDBNotOpen indicates the bolt db file is not open for reading.
-	ErrDBNotOpen = fmt.Errorf("boltdb not opened")
-)
+// Store is a backend for writing and reading to bolt persistent storage.
+type Store struct {
+	mu           sync.Mutex                // serialises opening, closing and replacing the db file.
+	path         string                    // the path on which to store the db file.
+	opts         *bbolt.Options            // options for configuring the boltdb instance.
+	db           *storm.DB                 // the boltdb instance.
+	inflightTTL  persistence.InflightTTL   // the number of seconds an inflight message of each qos should be retained before being dropped.
+	compactSize  int64                     // the file size in bytes above which the db is compacted when opened (0 is never).
+	resetCorrupt bool                      // move a corrupt db file aside and start with an empty db when opened.
+	migrate      persistence.MigrateSchema // a hook called for each schema version step when older records are migrated.
+	log          logger.Logger             // the logger which receives warnings about records which could not be migrated.
+	crypt        *aesCodec                 // the codec which encrypts record values, if the store is encrypted.
+}
+
+// New returns a configured instance of the boltdb store. By default every write
+// is synced to disk before it returns. Setting NoSync in the options skips the
+// fsync, and NoFreelistSync skips writing the freelist (so it is rebuilt by
+// scanning the file when opened); see SetNoSync for the implications.
+func New(path string, opts *bbolt.Options) *Store {
+	if path == "" || path == "." {
+		path = defaultPath
+	}
+
+	o := bbolt.Options{
+		Timeout: defaultTimeout,
+	}
+	if opts != nil {
+		o = *opts
+	}
+
+	return &Store{
+		path: path,
+		opts: &o,
+		log:  logger.Nop{},
+	}
+}
+
+// NewEncrypted returns a configured instance of the boltdb store which encrypts
+// the values of its records with AES-GCM, using a 16, 24 or 32 byte key to
+// select AES-128, AES-192 or AES-256. Record ids and the indexes used to find
+// records by client and topic are not encrypted. Opening a db file which was
+// written without the key returns an error wrapping ErrEncryptionKey.
+func NewEncrypted(path string, opts *bbolt.Options, key []byte) (*Store, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w: empty key", ErrInvalidKey)
+	}
+
+	c, err := newAESCodec(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s := New(path, opts)
+	s.crypt = c
+	return s, nil
+}
+
+// codec returns the storm codec used to encode the record values.
+func (s *Store) codec() codec.MarshalUnmarshaler {
+	if s.crypt == nil {
+		return sgob.Codec
+	}
+
+	return s.crypt
+}
+
+// SetInflightTTL sets the number of seconds an inflight message should be kept
+// before being dropped, in the event it is not delivered. Unless you have a good reason,
+// you should allow this to be called by the server (in AddStore) instead of directly.
+func (s *Store) SetInflightTTL(seconds int64) {
+	s.inflightTTL = persistence.NewInflightTTL(seconds)
+}
+
+// SetInflightTTLForQoS sets the number of seconds an inflight message of a qos
+// should be kept before being dropped, overriding SetInflightTTL.
+func (s *Store) SetInflightTTLForQoS(qos byte, seconds int64) {
+	s.inflightTTL.Set(qos, seconds)
+}
+
+// SetCompactionThreshold sets a file size in bytes above which the db file will
+// be automatically compacted when the store is opened. A value of 0 disables
+// automatic compaction.
+func (s *Store) SetCompactionThreshold(size int64) {
+	s.compactSize = size
+}
+
+// SetNoSync sets whether writes to the db file skip the fsync which otherwise
+// follows every write, which is far faster, particularly for inflight messages.
+// Writes are still safe if the broker process crashes, but any writes made since
+// the last call to Sync may be lost, or the db file corrupted, if the host loses
+// power or crashes. It must be called before the store is opened.
+func (s *Store) SetNoSync(noSync bool) {
+	s.opts.NoSync = noSync
+}
+
+// Sync flushes all writes to the db file to disk. It is only needed when writes
+// are not synced (see SetNoSync), such as at checkpoints or before shutdown.
+func (s *Store) Sync() error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	return s.db.Bolt.Sync()
+}
+
+// SetResetCorrupt sets whether a corrupt db file should be moved aside when the
+// store is opened, so that the store starts empty instead of failing to open.
+// The corrupt file is kept alongside the db file with a .corrupt suffix.
+func (s *Store) SetResetCorrupt(reset bool) {
+	s.resetCorrupt = reset
+}
+
+// SetMigrateSchema sets a hook which is called when the store is opened on a db
+// file written with an earlier schema version, once for each version step. The
+// hook is called after any records which can no longer be decoded have been
+// deleted, and before the remaining records are rewritten with the current
+// version, so it may use the store to read and transform them. It must be
+// called before the store is opened.
+func (s *Store) SetMigrateSchema(fn persistence.MigrateSchema) {
+	s.migrate = fn
+}
+
+// SetLogger sets the logger which receives warnings about records which are
+// deleted because they could not be decoded when the db is migrated.
+func (s *Store) SetLogger(l logger.Logger) {
+	s.log = l
+}
+
+// Open opens the boltdb instance. If a compaction threshold has been set and
+// the db file exceeds it, the db is compacted before Open returns. If the db
+// file is corrupt, an error wrapping ErrDBCorrupt is returned, unless the store
+// was set to reset corrupt files. Opening a store which is already open does
+// nothing, so long as its db is still usable; otherwise the db is closed and
+// opened again. A store may be opened again after it has been closed.
+func (s *Store) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isOpen() {
+		return nil
+	}
+	s.close() // release a db which is no longer usable before reopening the file.
+
+	err := s.open()
+	if errors.Is(err, ErrDBCorrupt) && s.resetCorrupt {
+		err = os.Rename(s.path, s.path+corruptSuffix)
+		if err != nil {
+			return fmt.Errorf("move corrupt db: %w", err)
+		}
+
+		err = s.open()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if s.compactSize > 0 {
+		fi, err := os.Stat(s.path)
+		if err != nil {
+			return err
+		}
+
+		if fi.Size() > s.compactSize {
+			return s.compact()
+		}
+	}
+
+	return nil
+}
+
+// open opens the boltdb file. Some kinds of corruption cause bbolt to panic or
+// fault while opening the file, so these are returned as ErrDBCorrupt.
+func (s *Store) open() (err error) {
+	var db *bbolt.DB
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if db != nil {
+				db.Close()
+			}
+			s.db = nil
+			err = fmt.Errorf("%w: %v", ErrDBCorrupt, r)
+		}
+	}()
+
+	db, err = bbolt.Open(s.path, 0600, s.opts)
+	if errors.Is(err, bbolt.ErrInvalid) || errors.Is(err, bbolt.ErrVersionMismatch) || errors.Is(err, bbolt.ErrChecksum) {
+		return fmt.Errorf("%w: %v", ErrDBCorrupt, err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The key is verified before storm reads its version from the db, which is
+	// encrypted along with the records.
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return initKey(tx, s.crypt)
+	})
+	if err == nil {
+		s.db, err = storm.Open(s.path, storm.UseDB(db), storm.Codec(s.codec()))
+	}
+
+	if err != nil {
+		db.Close()
+		s.db = nil
+		return err
+	}
+
+	err = s.migrateSchema()
+	if err != nil {
+		s.db.Close()
+		s.db = nil
+		return err
+	}
+
+	err = s.indexRetained()
+	if err == nil {
+		err = s.indexClients()
+	}
+
+	if err != nil {
+		s.db.Close()
+		s.db = nil
+		return err
+	}
+
+	return nil
+}
+
+// schemaVersion returns the schema version of the records in the db, and
+// whether the db holds any records. Db files created before the schema was
+// versioned are version 0.
+func (s *Store) schemaVersion() (version int, empty bool, err error) {
+	err = s.db.Bolt.View(func(tx *bbolt.Tx) error {
+		empty = !hasRecords(tx)
+
+		b := tx.Bucket([]byte(schemaBucket))
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get([]byte(schemaKey))
+		if v == nil {
+			return nil
+		}
+
+		version, err = strconv.Atoi(string(v))
+		return err
+	})
+
+	return
+}
+
+// hasRecords returns true if the db has any record buckets.
+func hasRecords(tx *bbolt.Tx) bool {
+	for _, rb := range recordBuckets {
+		if tx.Bucket([]byte(rb.name)) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setSchemaVersion stores the schema version of the records in the db.
+func (s *Store) setSchemaVersion(version int) error {
+	return s.db.Bolt.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(schemaBucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(schemaKey), []byte(strconv.Itoa(version)))
+	})
+}
+
+// migrateSchema upgrades the records of a db written with an earlier schema
+// version. Records which can no longer be decoded are deleted and logged,
+// rather than failing every later read of their type. The migration hook is
+// then called for each version step, and the remaining records are rewritten
+// with the current version.
+func (s *Store) migrateSchema() error {
+	from, empty, err := s.schemaVersion()
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	if from > persistence.SchemaVersion {
+		return fmt.Errorf("%w: %d", ErrSchemaTooNew, from)
+	}
+
+	if from == persistence.SchemaVersion {
+		return nil
+	}
+
+	if empty {
+		return s.setSchemaVersion(persistence.SchemaVersion)
+	}
+
+	err = s.deleteUndecodable()
+	if err != nil {
+		return fmt.Errorf("delete undecodable records: %w", err)
+	}
+
+	for v := from; v < persistence.SchemaVersion && s.migrate != nil; v++ {
+		err = s.migrate(v, v+1)
+		if err != nil {
+			return fmt.Errorf("migrate schema from %d to %d: %w", v, v+1, err)
+		}
+	}
+
+	err = s.restampRecords()
+	if err != nil {
+		return fmt.Errorf("upgrade records: %w", err)
+	}
+
+	return s.setSchemaVersion(persistence.SchemaVersion)
+}
+
+// deleteUndecodable deletes the records which can no longer be decoded into
+// their structs, such as when the type of a field has changed, logging each
+// one. The storm indexes of any bucket which lost records are rebuilt.
+func (s *Store) deleteUndecodable() error {
+	for _, rb := range recordBuckets {
+		var deleted bool
+		err := s.db.Bolt.Update(func(tx *bbolt.Tx) error {
+			b := tx.Bucket([]byte(rb.name))
+			if b == nil {
+				return nil
+			}
+
+			var keys [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				if v == nil { // nested buckets hold storm indexes.
+					return nil
+				}
+
+				if err := s.codec().Unmarshal(v, rb.new()); err != nil {
+					s.log.Warn("deleting undecodable record", "bucket", rb.name, "id", string(k), logger.KeyError, err)
+					keys = append(keys, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, k := range keys {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+
+				if rb.name == messageBucket {
+					if idx := tx.Bucket([]byte(retainedBucket)); idx != nil {
+						if err := idx.Delete(k); err != nil {
+							return err
+						}
+					}
+				}
+			}
+
+			deleted = len(keys) > 0
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if deleted {
+			if err := s.db.ReIndex(rb.new()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// restampRecords rewrites every record with the current schema version.
+func (s *Store) restampRecords() error {
+	info, err := s.ReadServerInfo()
+	if err != nil {
+		return err
+	}
+
+	if info.ID != "" {
+		err = s.WriteServerInfo(info)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.batch(func(tx storm.Node) error {
+		var subs []persistence.Subscription
+		err := tx.All(&subs)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+
+		for i := range subs {
+			subs[i].Schema = persistence.SchemaVersion
+			if err := tx.Save(&subs[i]); err != nil {
+				return err
+			}
+		}
+
+		var clients []persistence.Client
+		err = tx.All(&clients)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+
+		for i := range clients {
+			clients[i].Schema = persistence.SchemaVersion
+			if err := tx.Save(&clients[i]); err != nil {
+				return err
+			}
+		}
+
+		var msgs []persistence.Message
+		err = tx.All(&msgs)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+
+		for i := range msgs {
+			msgs[i].Schema = persistence.SchemaVersion
+			if err := tx.Save(&msgs[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// indexRetained builds the retained topics index from the retained messages,
+// if the index does not yet exist (such as for db files created before it was
+// introduced).
+func (s *Store) indexRetained() error {
+	var exists bool
+	err := s.db.Bolt.View(func(tx *bbolt.Tx) error {
+		exists = tx.Bucket([]byte(retainedBucket)) != nil
+		return nil
+	})
+	if err != nil || exists {
+		return err
+	}
+
+	v, err := s.ReadRetained()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Bolt.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(retainedBucket))
+		if err != nil {
+			return err
+		}
+
+		for _, m := range v {
+			if err := b.Put([]byte(m.ID), []byte(m.TopicName)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// indexClients rebuilds the client indexes of the subscriptions and messages
+// if they do not yet exist (such as for db files created before they were
+// introduced), so records stored before then can be counted by client.
+func (s *Store) indexClients() error {
+	for bucket, v := range map[string]interface{}{
+		subscriptionBucket: &persistence.Subscription{},
+		messageBucket:      &persistence.Message{},
+	} {
+		var missing bool
+		err := s.db.Bolt.View(func(tx *bbolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			missing = b != nil && b.Bucket([]byte(clientIndex)) == nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if missing {
+			if err := s.db.ReIndex(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// IsOpen returns true if the store is open and its db can be read.
+func (s *Store) IsOpen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isOpen()
+}
+
+// isOpen returns true if the db is open and can be read. The store must be locked.
+func (s *Store) isOpen() bool {
+	if s.db == nil {
+		return false
+	}
+
+	return s.db.Bolt.View(func(tx *bbolt.Tx) error { return nil }) == nil
+}
+
+// Close closes the boltdb instance. Closing a store which is not open does nothing.
+func (s *Store) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+}
+
+// close closes the db, if it is open. The store must be locked.
+func (s *Store) close() {
+	if s.db != nil {
+		s.db.Close()
+		s.db = nil
+	}
+}
+
+// Compact reclaims the space held by freed pages in the db file, which bbolt
+// never returns to the filesystem. All live records are copied into a fresh db
+// file, which then atomically replaces the original. The store is unavailable
+// while compaction is in progress.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+// compact compacts the db file. The store must be locked.
+func (s *Store) compact() error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	tmp := s.path + compactSuffix
+	_ = os.Remove(tmp) // clear any remains of a failed compaction.
+
+	dst := New(tmp, s.opts)
+	dst.crypt = s.crypt
+	err := dst.open()
+	if err != nil {
+		return fmt.Errorf("open compaction db: %w", err)
+	}
+
+	err = s.copyTo(dst)
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("copy to compaction db: %w", err)
+	}
+
+	s.close()
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		_ = os.Remove(tmp)
+		_ = s.open()
+		return err
+	}
+
+	return s.open()
+}
+
+// copyTo copies all of the live records into another store.
+func (s *Store) copyTo(dst *Store) error {
+	info, err := s.ReadServerInfo()
+	if err != nil {
+		return err
+	}
+
+	if info.ID != "" {
+		err = dst.WriteServerInfo(info)
+		if err != nil {
+			return err
+		}
+	}
+
+	subs, err := s.ReadSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	err = dst.WriteSubscriptionBatch(subs)
+	if err != nil {
+		return err
+	}
+
+	clients, err := s.ReadClients()
+	if err != nil {
+		return err
+	}
+
+	err = dst.WriteClientBatch(clients)
+	if err != nil {
+		return err
+	}
+
+	inflight, err := s.ReadInflight()
+	if err != nil {
+		return err
+	}
+
+	for _, v := range inflight {
+		err = dst.WriteInflight(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	retained, err := s.ReadRetained()
+	if err != nil {
+		return err
+	}
+
+	return dst.WriteRetainedBatch(retained)
+}
+
+// ReEncrypt rewrites every record value of the db, decrypting it with oldKey
+// and encrypting it again with newKey, so the encryption key can be rotated.
+// A nil oldKey encrypts a db which was not encrypted, and a nil newKey removes
+// the encryption. The records are rewritten in a single transaction, so the
+// db is left unchanged if ReEncrypt fails, and the store is unavailable until
+// it returns. The store must be open, and uses newKey once ReEncrypt returns
+// without error.
+func (s *Store) ReEncrypt(oldKey, newKey []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	from, err := newAESCodec(oldKey)
+	if err != nil {
+		return err
+	}
 
-// Store is a backend for writing and reading to bolt persistent storage.
-type Store struct {
-	path        string         // the path on which to store the db file.
-	opts        *bbolt.Options // options for configuring the boltdb instance.
-	db          *storm.DB      // the boltdb instance.
-	inflightTTL int64          // the number of seconds an inflight message should be retained before being dropped.
+	to, err := newAESCodec(newKey)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Bolt.Update(func(tx *bbolt.Tx) error {
+		if err := verifyKey(tx, from); err != nil {
+			return err
+		}
+
+		if err := reencryptBuckets(tx, from, to); err != nil {
+			return err
+		}
+
+		return putKeyCheck(tx, to)
+	})
+	if err != nil {
+		return fmt.Errorf("re-encrypt records: %w", err)
+	}
+
+	// The storm db keeps the codec it was opened with, so it is reopened.
+	s.crypt = to
+	s.close()
+	return s.open()
 }
 
-// New returns a configured instance of the boltdb store.
-func New(path string, opts *bbolt.Options) *Store {
-	if path == "" || path == "." {
-		path = defaultPath
+// Recover replaces a corrupt db file with a new db file containing all of the
+// records which can still be read from it. A copy of the corrupt file is kept
+// alongside the db file with a .corrupt suffix. The store is open when Recover
+// returns without error.
+func (s *Store) Recover() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+
+	// The corrupt file is copied rather than moved, as a failed open may still
+	// hold a lock on the original.
+	bad := s.path + corruptSuffix
+	err := copyFile(s.path, bad)
+	if err != nil {
+		return fmt.Errorf("copy corrupt db: %w", err)
 	}
 
-	if opts == nil {
-		opts = &bbolt.Options{
-			Timeout: defaultTimeout,
-		}
+	src, err := bbolt.Open(bad, 0600, &bbolt.Options{
+		ReadOnly: true,
+		Timeout:  s.opts.Timeout,
+	})
+	if err != nil {
+		return fmt.Errorf("open corrupt db: %w", err)
 	}
+	defer src.Close()
 
-	return &Store{
-		path: path,
-		opts: opts,
+	tmp := s.path + compactSuffix
+	_ = os.Remove(tmp) // clear any remains of a failed recovery.
+
+	dst := New(tmp, s.opts)
+	dst.crypt = s.crypt
+	err = dst.open()
+	if err != nil {
+		return fmt.Errorf("open recovery db: %w", err)
+	}
+
+	err = salvage(src, dst)
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("copy to recovery db: %w", err)
+	}
+
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
 	}
+
+	return s.open()
 }
 
-// SetInflightTTL sets the number of seconds an inflight message should be kept
-// before being dropped, in the event it is not delivered. Unless you have a good reason,
-// you should allow this to be called by the server (in AddStore) instead of directly.
-func (s *Store) SetInflightTTL(seconds int64) {
-	s.inflightTTL = seconds
+// salvage copies every record which can be read and decoded from the buckets
+// of a corrupt db into another store. Records in damaged pages are skipped.
+func salvage(src *bbolt.DB, dst *Store) error {
+	return src.View(func(tx *bbolt.Tx) error {
+		err := salvageBucket(tx, "ServerInfo", func(b []byte) error {
+			var v persistence.ServerInfo
+			if dst.codec().Unmarshal(b, &v) != nil {
+				return nil
+			}
+			return dst.WriteServerInfo(v)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = salvageBucket(tx, "Subscription", func(b []byte) error {
+			var v persistence.Subscription
+			if dst.codec().Unmarshal(b, &v) != nil {
+				return nil
+			}
+			return dst.WriteSubscription(v)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = salvageBucket(tx, "Client", func(b []byte) error {
+			var v persistence.Client
+			if dst.codec().Unmarshal(b, &v) != nil {
+				return nil
+			}
+			return dst.WriteClient(v)
+		})
+		if err != nil {
+			return err
+		}
+
+		return salvageBucket(tx, "Message", func(b []byte) error {
+			var v persistence.Message
+			if dst.codec().Unmarshal(b, &v) != nil {
+				return nil
+			}
+
+			switch v.T {
+			case persistence.KRetained:
+				return dst.WriteRetained(v)
+			case persistence.KInflight:
+				return dst.WriteInflight(v)
+			}
+			return nil
+		})
+	})
 }
 
-// Open opens the boltdb instance.
-func (s *Store) Open() error {
-	var err error
-	s.db, err = storm.Open(s.path, storm.BoltOptions(0600, s.opts), storm.Codec(sgob.Codec))
+// salvageBucket calls fn with each record value in a storm bucket, until the
+// bucket is exhausted or a damaged page is reached.
+func salvageBucket(tx *bbolt.Tx, name string, fn func(b []byte) error) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = nil // keep the records read before the damage.
+		}
+	}()
+
+	b := tx.Bucket([]byte(name))
+	if b == nil {
+		return nil
+	}
+
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil { // nested buckets hold storm indexes, which are rebuilt.
+			return nil
+		}
+
+		return fn(v)
+	})
+}
+
+// copyFile copies the contents of a file to a new file.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer in.Close()
 
-	return nil
-}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
 
-// Close closes the boltdb instance.
-func (s *Store) Close() {
-	s.db.Close()
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
 }
 
 // WriteServerInfo writes the server info to the boltdb instance.
@@ -80,6 +923,7 @@ func (s *Store) WriteServerInfo(v persistence.ServerInfo) error {
 		return ErrDBNotOpen
 	}
 
+	v.Schema = persistence.SchemaVersion
 	err := s.db.Save(&v)
 	if err != nil {
 		return err
@@ -93,6 +937,7 @@ func (s *Store) WriteSubscription(v persistence.Subscription) error {
 		return ErrDBNotOpen
 	}
 
+	v.Schema = persistence.SchemaVersion
 	err := s.db.Save(&v)
 	if err != nil {
 		return err
@@ -106,6 +951,7 @@ func (s *Store) WriteInflight(v persistence.Message) error {
 		return ErrDBNotOpen
 	}
 
+	v.Schema = persistence.SchemaVersion
 	err := s.db.Save(&v)
 	if err != nil {
 		return err
@@ -115,10 +961,16 @@ func (s *Store) WriteInflight(v persistence.Message) error {
 
 // WriteRetained writes a single retained message to the boltdb instance.
 func (s *Store) WriteRetained(v persistence.Message) error {
+	return s.WriteRetainedBatch([]persistence.Message{v})
+}
+
+// WriteClient writes a single client to the boltdb instance.
+func (s *Store) WriteClient(v persistence.Client) error {
 	if s.db == nil {
 		return ErrDBNotOpen
 	}
 
+	v.Schema = persistence.SchemaVersion
 	err := s.db.Save(&v)
 	if err != nil {
 		return err
@@ -126,17 +978,95 @@ func (s *Store) WriteRetained(v persistence.Message) error {
 	return nil
 }
 
-// WriteClient writes a single client to the boltdb instance.
-func (s *Store) WriteClient(v persistence.Client) error {
+// batch runs fn within a single writable transaction, committing only if fn
+// succeeds. If fn returns an error the entire transaction is rolled back.
+func (s *Store) batch(fn func(tx storm.Node) error) error {
 	if s.db == nil {
 		return ErrDBNotOpen
 	}
 
-	err := s.db.Save(&v)
+	tx, err := s.db.Begin(true)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// WriteSubscriptionBatch writes a set of subscriptions to the boltdb instance
+// in a single transaction. If any subscription fails to save, none are written
+// and the first error is returned.
+func (s *Store) WriteSubscriptionBatch(v []persistence.Subscription) error {
+	return s.batch(func(tx storm.Node) error {
+		for i := range v {
+			r := v[i]
+			r.Schema = persistence.SchemaVersion
+			if err := tx.Save(&r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteRetainedBatch writes a set of retained messages to the boltdb instance
+// in a single transaction. If any message fails to save, none are written
+// and the first error is returned.
+func (s *Store) WriteRetainedBatch(v []persistence.Message) error {
+	return s.retainedTx(func(tx storm.Node, idx *bbolt.Bucket) error {
+		for i := range v {
+			r := v[i]
+			r.Schema = persistence.SchemaVersion
+			if err := tx.Save(&r); err != nil {
+				return err
+			}
+
+			if err := idx.Put([]byte(v[i].ID), []byte(v[i].TopicName)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// retainedTx runs fn within a single writable transaction, providing the
+// retained topics index bucket so it can be updated alongside the messages.
+// The index is kept as a plain bolt bucket, so its key count is exact.
+func (s *Store) retainedTx(fn func(tx storm.Node, idx *bbolt.Bucket) error) error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	return s.db.Bolt.Update(func(tx *bbolt.Tx) error {
+		idx, err := tx.CreateBucketIfNotExists([]byte(retainedBucket))
+		if err != nil {
+			return err
+		}
+
+		return fn(s.db.WithTransaction(tx), idx)
+	})
+}
+
+// WriteClientBatch writes a set of clients to the boltdb instance in a single
+// transaction. If any client fails to save, none are written and the first
+// error is returned.
+func (s *Store) WriteClientBatch(v []persistence.Client) error {
+	return s.batch(func(tx storm.Node) error {
+		for i := range v {
+			r := v[i]
+			r.Schema = persistence.SchemaVersion
+			if err := tx.Save(&r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // DeleteSubscription deletes a subscription from the boltdb instance.
@@ -189,18 +1119,245 @@ func (s *Store) DeleteInflight(id string) error {
 
 // DeleteRetained deletes a retained message from the boltdb instance.
 func (s *Store) DeleteRetained(id string) error {
+	return s.retainedTx(func(tx storm.Node, idx *bbolt.Bucket) error {
+		err := tx.DeleteStruct(&persistence.Message{
+			ID: id,
+		})
+		if err != nil {
+			return err
+		}
+
+		return idx.Delete([]byte(id))
+	})
+}
+
+// ClearExpiredRetained deletes any retained messages with an expiry interval
+// which lapsed before the provided unix timestamp.
+func (s *Store) ClearExpiredRetained(now int64) error {
+	return s.retainedTx(func(tx storm.Node, idx *bbolt.Bucket) error {
+		var v []persistence.Message
+		err := tx.Find("T", persistence.KRetained, &v)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+
+		for _, m := range v {
+			if !m.Expired(now) {
+				continue
+			}
+
+			err := tx.DeleteStruct(&persistence.Message{ID: m.ID})
+			if err != nil {
+				return err
+			}
+
+			err = idx.Delete([]byte(m.ID))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ClearExpiredSessions deletes the clients whose sessions expired before the
+// provided unix timestamp, along with their subscriptions and inflight messages.
+func (s *Store) ClearExpiredSessions(now int64) error {
+	return s.batch(func(tx storm.Node) error {
+		var v []persistence.Client
+		err := tx.Find("T", persistence.KClient, &v)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+
+		for _, c := range v {
+			if !c.Expired(now) {
+				continue
+			}
+
+			var subs []persistence.Subscription
+			err = tx.Find("Client", c.ClientID, &subs)
+			if err != nil && err != storm.ErrNotFound {
+				return err
+			}
+
+			for _, sub := range subs {
+				if err := tx.DeleteStruct(&persistence.Subscription{ID: sub.ID}); err != nil {
+					return err
+				}
+			}
+
+			var msgs []persistence.Message
+			err = tx.Select(q.Eq("T", persistence.KInflight), q.Eq("Client", c.ClientID)).Find(&msgs)
+			if err != nil && err != storm.ErrNotFound {
+				return err
+			}
+
+			for _, m := range msgs {
+				if err := tx.DeleteStruct(&persistence.Message{ID: m.ID}); err != nil {
+					return err
+				}
+			}
+
+			if err := tx.DeleteStruct(&persistence.Client{ID: c.ID}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// DeleteAllRetained deletes all retained messages from the boltdb instance.
+// Retained and inflight messages share a bucket, so the bucket is dropped and
+// recreated with only the inflight messages, and the retained topics index is
+// dropped and recreated empty, all within a single transaction.
+func (s *Store) DeleteAllRetained() error {
+	return s.dropMessages(persistence.KRetained, func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket([]byte(retainedBucket))
+		if err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+
+		_, err = tx.CreateBucket([]byte(retainedBucket))
+		return err
+	})
+}
+
+// DeleteAllInflight deletes all inflight messages from the boltdb instance.
+// The message bucket is dropped and recreated with only the retained messages
+// within a single transaction.
+func (s *Store) DeleteAllInflight() error {
+	return s.dropMessages(persistence.KInflight, nil)
+}
+
+// dropMessages drops and recreates the message bucket within a single
+// transaction, writing back any messages which are not of type t. If fn is
+// not nil, it is run within the same transaction.
+func (s *Store) dropMessages(t string, fn func(tx *bbolt.Tx) error) error {
 	if s.db == nil {
 		return ErrDBNotOpen
 	}
 
-	err := s.db.DeleteStruct(&persistence.Message{
-		ID: id,
+	return s.db.Bolt.Update(func(btx *bbolt.Tx) error {
+		tx := s.db.WithTransaction(btx)
+
+		var v []persistence.Message
+		err := tx.All(&v)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+
+		err = tx.Drop(&persistence.Message{})
+		if err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+
+		err = tx.Init(&persistence.Message{})
+		if err != nil {
+			return err
+		}
+
+		for i := range v {
+			if v[i].T == t {
+				continue
+			}
+
+			if err := tx.Save(&v[i]); err != nil {
+				return err
+			}
+		}
+
+		if fn != nil {
+			return fn(btx)
+		}
+
+		return nil
 	})
-	if err != nil {
+}
+
+// CountSubscriptions returns the number of subscriptions of a client in the
+// boltdb instance, using the client index without loading the subscriptions.
+func (s *Store) CountSubscriptions(clientID string) (n int, err error) {
+	return s.countClient(subscriptionBucket, clientID)
+}
+
+// CountInflight returns the number of inflight messages of a client in the
+// boltdb instance, using the client index without loading the messages.
+// Retained messages share the bucket but are stored without a client, so they
+// are not counted.
+func (s *Store) CountInflight(clientID string) (n int, err error) {
+	return s.countClient(messageBucket, clientID)
+}
+
+// countClient returns the number of records of a client in a bucket, read from
+// the client index of the bucket.
+func (s *Store) countClient(bucket, clientID string) (n int, err error) {
+	if s.db == nil {
+		return 0, ErrDBNotOpen
+	}
+
+	if clientID == "" {
+		return 0, nil
+	}
+
+	err = s.db.Bolt.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil || b.Bucket([]byte(clientIndex)) == nil {
+			return nil
+		}
+
+		idx, err := index.NewListIndex(b, []byte(clientIndex))
+		if err != nil {
+			return err
+		}
+
+		ids, err := idx.All([]byte(clientID), nil)
+		n = len(ids)
 		return err
+	})
+
+	return
+}
+
+// CountRetained returns the number of retained messages in the boltdb instance,
+// using the key count of the retained topics index bucket.
+func (s *Store) CountRetained() (n int, err error) {
+	if s.db == nil {
+		return 0, ErrDBNotOpen
 	}
 
-	return nil
+	err = s.db.Bolt.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(retainedBucket)); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	})
+
+	return
+}
+
+// ListRetainedTopics returns the topics of the retained messages in the boltdb
+// instance, read from the retained topics index without loading the messages.
+func (s *Store) ListRetainedTopics() (v []string, err error) {
+	if s.db == nil {
+		return v, ErrDBNotOpen
+	}
+
+	err = s.db.Bolt.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(retainedBucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, t []byte) error {
+			v = append(v, string(t))
+			return nil
+		})
+	})
+
+	return
 }
 
 // ReadSubscriptions loads all the subscriptions from the boltdb instance.
@@ -217,6 +1374,40 @@ func (s *Store) ReadSubscriptions() (v []persistence.Subscription, err error) {
 	return v, nil
 }
 
+// ReadSubscriptionsForClient loads the subscriptions of a client from the
+// boltdb instance, using the client index.
+func (s *Store) ReadSubscriptionsForClient(clientID string) (v []persistence.Subscription, err error) {
+	if s.db == nil {
+		return v, ErrDBNotOpen
+	}
+
+	if clientID == "" {
+		return v, nil
+	}
+
+	err = s.db.Find("Client", clientID, &v)
+	if err != nil && err != storm.ErrNotFound {
+		return
+	}
+
+	return v, nil
+}
+
+// ReadClient loads a single client by its storage key from the boltdb
+// instance, returning persistence.ErrNotFound if there is no such client.
+func (s *Store) ReadClient(id string) (v persistence.Client, err error) {
+	if s.db == nil {
+		return v, ErrDBNotOpen
+	}
+
+	err = s.db.One("ID", id, &v)
+	if err == storm.ErrNotFound {
+		return v, persistence.ErrNotFound
+	}
+
+	return
+}
+
 // ReadClients loads all the clients from the boltdb instance.
 func (s *Store) ReadClients() (v []persistence.Client, err error) {
 	if s.db == nil {
@@ -231,17 +1422,40 @@ func (s *Store) ReadClients() (v []persistence.Client, err error) {
 	return v, nil
 }
 
-// ReadInflight loads all the inflight messages from the boltdb instance.
+// ReadInflight loads all the inflight messages from the boltdb instance,
+// sorted by client and the order they were stored in.
 func (s *Store) ReadInflight() (v []persistence.Message, err error) {
 	if s.db == nil {
 		return v, ErrDBNotOpen
 	}
 
-	err = s.db.Find("T", persistence.KInflight, &v)
+	err = s.db.Select(q.Eq("T", persistence.KInflight)).OrderBy("Client", "Sequence").Find(&v)
+	if err != nil && err != storm.ErrNotFound {
+		return
+	}
+
+	return v, nil
+}
+
+// ReadInflightForClient loads the inflight messages of a client from the
+// boltdb instance, using the client index, sorted by the order they were
+// stored in. Retained messages are stored without a client, so they are not
+// read.
+func (s *Store) ReadInflightForClient(clientID string) (v []persistence.Message, err error) {
+	if s.db == nil {
+		return v, ErrDBNotOpen
+	}
+
+	if clientID == "" {
+		return v, nil
+	}
+
+	err = s.db.Find("Client", clientID, &v)
 	if err != nil && err != storm.ErrNotFound {
 		return
 	}
 
+	persistence.SortInflight(v)
 	return v, nil
 }
 
@@ -273,8 +1487,9 @@ func (s *Store) ReadServerInfo() (v persistence.ServerInfo, err error) {
 	return v, nil
 }
 
-// ClearExpiredInflight deletes any inflight messages older than the provided unix timestamp.
-func (s *Store) ClearExpiredInflight(expiry int64) error {
+// ClearExpiredInflightAt deletes any inflight messages which have outlived the
+// inflight ttl of their qos by the provided unix timestamp.
+func (s *Store) ClearExpiredInflightAt(now int64) error {
 	if s.db == nil {
 		return ErrDBNotOpen
 	}
@@ -286,7 +1501,7 @@ func (s *Store) ClearExpiredInflight(expiry int64) error {
 	}
 
 	for _, m := range v {
-		if m.Created < expiry || m.Created == 0 {
+		if s.inflightTTL.Expired(m, now) {
 			err := s.db.DeleteStruct(&persistence.Message{ID: m.ID})
 			if err != nil {
 				return err
@@ -1,13 +1,19 @@
 package bolt
 
 import (
+	"bytes"
+	"errors"
+	"log"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
+	sgob "github.com/asdine/storm/codec/gob"
 	"github.com/stretchr/testify/require"
 	"go.etcd.io/bbolt"
 
+	"github.com/csymapp/mqtt/server/logger"
 	"github.com/csymapp/mqtt/server/persistence"
 	"github.com/csymapp/mqtt/server/system"
 )
@@ -49,10 +55,53 @@ func TestNewNoOpts(t *testing.T) {
 	require.Equal(t, defaultTimeout, s.opts.Timeout)
 }
 
+func TestNewDurabilityOpts(t *testing.T) {
+	opts := &bbolt.Options{
+		NoSync:         true,
+		NoFreelistSync: true,
+	}
+	s := New(tmpPath, opts)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	require.True(t, s.db.Bolt.NoSync)
+	require.True(t, s.db.Bolt.NoFreelistSync)
+
+	s.SetNoSync(false)
+	require.True(t, opts.NoSync) // the options passed to New are not modified.
+}
+
+func TestSetNoSync(t *testing.T) {
+	s := New(tmpPath, nil)
+	s.SetNoSync(true)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+	require.True(t, s.db.Bolt.NoSync)
+
+	err = s.WriteInflight(persistence.Message{ID: "if_client1_1", T: persistence.KInflight})
+	require.NoError(t, err)
+	require.NoError(t, s.Sync())
+
+	inflight, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+}
+
+func TestSyncNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Sync()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
 func TestSetInflightTTL(t *testing.T) {
 	s := New("", nil)
 	s.SetInflightTTL(5)
-	require.Equal(t, int64(5), s.inflightTTL)
+	require.Equal(t, persistence.InflightTTL{5, 5, 5}, s.inflightTTL)
+
+	s.SetInflightTTLForQoS(1, 2)
+	require.Equal(t, persistence.InflightTTL{5, 2, 5}, s.inflightTTL)
 }
 
 func TestOpen(t *testing.T) {
@@ -63,6 +112,74 @@ func TestOpen(t *testing.T) {
 	require.NotNil(t, s.db)
 }
 
+func TestOpenIdempotent(t *testing.T) {
+	s := New(tmpPath, nil)
+	require.NoError(t, s.Open())
+	defer teardown(s, t)
+	db := s.db
+
+	// A second open would wait on the file lock held by the first, and fail.
+	require.NoError(t, s.Open())
+	require.Same(t, db, s.db)
+	require.True(t, s.IsOpen())
+}
+
+func TestOpenUnusable(t *testing.T) {
+	s := New(tmpPath, nil)
+	require.NoError(t, s.Open())
+	defer teardown(s, t)
+
+	s.db.Close() // closed beneath the store.
+	require.False(t, s.IsOpen())
+
+	require.NoError(t, s.Open())
+	require.True(t, s.IsOpen())
+	require.NoError(t, s.WriteServerInfo(persistence.ServerInfo{ID: persistence.KServerInfo}))
+}
+
+func TestIsOpen(t *testing.T) {
+	s := New(tmpPath, nil)
+	require.False(t, s.IsOpen())
+
+	require.NoError(t, s.Open())
+	require.True(t, s.IsOpen())
+
+	s.Close()
+	require.False(t, s.IsOpen())
+	require.NoError(t, os.Remove(tmpPath))
+}
+
+func TestCloseReopen(t *testing.T) {
+	s := New(tmpPath, nil)
+	require.NoError(t, s.Open())
+	defer teardown(s, t)
+
+	err := s.WriteSubscription(persistence.Subscription{
+		ID:     "sub_client1:a/b/c",
+		T:      persistence.KSubscription,
+		Client: "client1",
+		Filter: "a/b/c",
+		QoS:    1,
+	})
+	require.NoError(t, err)
+
+	s.Close()
+	s.Close() // closing a closed store does nothing.
+	_, err = s.ReadSubscriptions()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+
+	require.NoError(t, s.Open())
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+}
+
+func TestCloseNotOpen(t *testing.T) {
+	s := New(tmpPath, nil)
+	s.Close()
+	require.False(t, s.IsOpen())
+}
+
 func TestOpenFailure(t *testing.T) {
 	s := New("..", nil)
 	err := s.Open()
@@ -164,6 +281,31 @@ func TestWriteRetrieveDeleteSubscription(t *testing.T) {
 	require.Equal(t, 1, len(subs))
 }
 
+func TestWriteRetrieveSubscriptionIdentifier(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	v := persistence.Subscription{
+		ID:     "test:$share/g1/a/b/c",
+		Client: "test",
+		Filter: "$share/g1/a/b/c",
+		QoS:    1,
+		T:      persistence.KSubscription,
+		Group:  "g1",
+
+		SubscriptionIdentifier: 268435455,
+	}
+	err = s.WriteSubscription(v)
+	require.NoError(t, err)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	v.Schema = persistence.SchemaVersion // records are stamped when written.
+	require.Equal(t, []persistence.Subscription{v}, subs)
+}
+
 func TestWriteSubscriptionNoDB(t *testing.T) {
 	s := New(tmpPath, nil)
 	err := s.WriteSubscription(persistence.Subscription{})
@@ -238,6 +380,31 @@ func TestWriteRetrieveDeleteInflight(t *testing.T) {
 
 }
 
+func TestReadInflightOrder(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	for _, v := range []persistence.Message{
+		{ID: "if_b_1", T: persistence.KInflight, Client: "b", Sequence: 4},
+		{ID: "if_a_1", T: persistence.KInflight, Client: "a", Sequence: 3},
+		{ID: "if_a_2", T: persistence.KInflight, Client: "a", Sequence: 1},
+		{ID: "if_b_2", T: persistence.KInflight, Client: "b", Sequence: 2},
+	} {
+		require.NoError(t, s.WriteInflight(v))
+	}
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+
+	var ids []string
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	require.Equal(t, []string{"if_a_2", "if_a_1", "if_b_2", "if_b_1"}, ids)
+}
+
 func TestWriteInflightNoDB(t *testing.T) {
 	s := New(tmpPath, nil)
 	err := s.WriteInflight(persistence.Message{})
@@ -318,6 +485,90 @@ func TestWriteRetrieveDeleteRetained(t *testing.T) {
 	require.Equal(t, 1, len(msgs))
 }
 
+func TestCountListRetained(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	n, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	err = s.WriteInflight(persistence.Message{ID: "if_1", T: persistence.KInflight, TopicName: "x"})
+	require.NoError(t, err)
+
+	err = s.WriteRetained(persistence.Message{ID: "ret_b", T: persistence.KRetained, TopicName: "b"})
+	require.NoError(t, err)
+	err = s.WriteRetainedBatch([]persistence.Message{
+		{ID: "ret_a/c", T: persistence.KRetained, TopicName: "a/c"},
+		{ID: "ret_b", T: persistence.KRetained, TopicName: "b"},
+	})
+	require.NoError(t, err)
+
+	n, err = s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	topics, err := s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/c", "b"}, topics)
+
+	err = s.DeleteRetained("ret_b")
+	require.NoError(t, err)
+
+	n, err = s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	topics, err = s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/c"}, topics)
+
+	err = s.Compact()
+	require.NoError(t, err)
+
+	topics, err = s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/c"}, topics)
+}
+
+func TestOpenIndexesRetained(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"})
+	require.NoError(t, err)
+
+	// Simulate a db file written before the index existed.
+	err = s.db.Bolt.Update(func(tx *bbolt.Tx) error {
+		return tx.DeleteBucket([]byte(retainedBucket))
+	})
+	require.NoError(t, err)
+
+	topics, err := s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Empty(t, topics)
+
+	s.Close()
+	err = s.Open()
+	require.NoError(t, err)
+
+	topics, err = s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, topics)
+}
+
+func TestCountListRetainedNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	_, err := s.CountRetained()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ListRetainedTopics()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
 func TestWriteRetainedNoDB(t *testing.T) {
 	s := New(tmpPath, nil)
 	err := s.WriteRetained(persistence.Message{})
@@ -368,6 +619,7 @@ func TestWriteRetrieveDeleteClients(t *testing.T) {
 			Message: []byte{'h', 'e', 'l', 'l', 'o'},
 			Qos:     1,
 			Retain:  true,
+			Delay:   30,
 		},
 	}
 	err = s.WriteClient(v)
@@ -378,6 +630,7 @@ func TestWriteRetrieveDeleteClients(t *testing.T) {
 
 	require.Equal(t, []byte{'m', 'o', 'c', 'h', 'i'}, clients[0].Username)
 	require.Equal(t, "a/b/c", clients[0].LWT.Topic)
+	require.Equal(t, uint32(30), clients[0].LWT.Delay)
 
 	v2 := persistence.Client{
 		ID:       "cl_client2",
@@ -491,7 +744,7 @@ func TestDeleteRetainedFail(t *testing.T) {
 	require.Error(t, err)
 }
 
-func TestClearExpiredInflight(t *testing.T) {
+func TestClearExpiredInflightAt(t *testing.T) {
 	n := time.Now().Unix()
 
 	s := New(tmpPath, nil)
@@ -532,9 +785,1151 @@ func TestClearExpiredInflight(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, m, 4)
 
-	s.ClearExpiredInflight(n - 2)
+	s.SetInflightTTL(2)
+	s.ClearExpiredInflightAt(n)
 
 	m, err = s.ReadInflight()
 	require.NoError(t, err)
 	require.Len(t, m, 2)
 }
+
+func TestClearExpiredInflightQos(t *testing.T) {
+	n := time.Now().Unix()
+
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	s.SetInflightTTL(10)
+	s.SetInflightTTLForQoS(1, 2)
+	for _, m := range []persistence.Message{
+		{ID: "q1", T: persistence.KInflight, FixedHeader: persistence.FixedHeader{Qos: 1}, Created: n - 5},
+		{ID: "q2", T: persistence.KInflight, FixedHeader: persistence.FixedHeader{Qos: 2}, Created: n - 5},
+		{ID: "rel", T: persistence.KInflight, FixedHeader: persistence.FixedHeader{Qos: 1}, Phase: persistence.PhaseRelease, Created: n - 5},
+	} {
+		require.NoError(t, s.WriteInflight(m))
+	}
+
+	require.NoError(t, s.ClearExpiredInflightAt(n))
+
+	m, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+	for _, v := range m {
+		require.NotEqual(t, "q1", v.ID)
+	}
+}
+
+func TestClearExpiredRetained(t *testing.T) {
+	n := time.Now().Unix()
+
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteRetainedBatch([]persistence.Message{
+		{ID: "ret_a", T: persistence.KRetained, TopicName: "a", Created: n - 10, ExpiryInterval: 5},
+		{ID: "ret_b", T: persistence.KRetained, TopicName: "b", Created: n - 10, ExpiryInterval: 20},
+		{ID: "ret_c", T: persistence.KRetained, TopicName: "c", Created: n - 10},
+	})
+	require.NoError(t, err)
+
+	err = s.ClearExpiredRetained(n)
+	require.NoError(t, err)
+
+	m, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+	require.Equal(t, "ret_b", m[0].ID)
+	require.Equal(t, "ret_c", m[1].ID)
+
+	c, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 2, c)
+}
+
+func TestClearExpiredRetainedNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	require.ErrorIs(t, s.ClearExpiredRetained(0), ErrDBNotOpen)
+}
+
+func TestCountSubscriptionsInflight(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteSubscriptionBatch([]persistence.Subscription{
+		{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription},
+		{ID: "a:c/d", Client: "a", Filter: "c/d", T: persistence.KSubscription},
+		{ID: "b:a/b", Client: "b", Filter: "a/b", T: persistence.KSubscription},
+	})
+	require.NoError(t, err)
+
+	err = s.WriteInflight(persistence.Message{ID: "ifm_a_1", Client: "a", T: persistence.KInflight})
+	require.NoError(t, err)
+
+	err = s.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"})
+	require.NoError(t, err)
+
+	n, err := s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	n, err = s.CountSubscriptions("b")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = s.CountSubscriptions("c")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = s.CountInflight("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = s.CountInflight("")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	err = s.DeleteSubscription("a:a/b")
+	require.NoError(t, err)
+
+	n, err = s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestReadForClient(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteClient(persistence.Client{ID: "cl_a", ClientID: "a", T: persistence.KClient})
+	require.NoError(t, err)
+
+	err = s.WriteSubscriptionBatch([]persistence.Subscription{
+		{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription},
+		{ID: "a:c/d", Client: "a", Filter: "c/d", T: persistence.KSubscription},
+		{ID: "b:a/b", Client: "b", Filter: "a/b", T: persistence.KSubscription},
+	})
+	require.NoError(t, err)
+
+	for _, v := range []persistence.Message{
+		{ID: "ifm_a_1", T: persistence.KInflight, Client: "a", Sequence: 2},
+		{ID: "ifm_a_2", T: persistence.KInflight, Client: "a", Sequence: 1},
+		{ID: "ifm_b_1", T: persistence.KInflight, Client: "b", Sequence: 3},
+	} {
+		require.NoError(t, s.WriteInflight(v))
+	}
+
+	err = s.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"})
+	require.NoError(t, err)
+
+	cl, err := s.ReadClient("cl_a")
+	require.NoError(t, err)
+	require.Equal(t, "a", cl.ClientID)
+
+	_, err = s.ReadClient("cl_b")
+	require.ErrorIs(t, err, persistence.ErrNotFound)
+
+	subs, err := s.ReadSubscriptionsForClient("a")
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+
+	subs, err = s.ReadSubscriptionsForClient("c")
+	require.NoError(t, err)
+	require.Len(t, subs, 0)
+
+	msgs, err := s.ReadInflightForClient("a")
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "ifm_a_2", msgs[0].ID)
+	require.Equal(t, "ifm_a_1", msgs[1].ID)
+
+	msgs, err = s.ReadInflightForClient("")
+	require.NoError(t, err)
+	require.Len(t, msgs, 0)
+}
+
+func TestReadForClientNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	_, err := s.ReadClient("cl_a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+
+	_, err = s.ReadSubscriptionsForClient("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+
+	_, err = s.ReadInflightForClient("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
+func TestCountSubscriptionsEmpty(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	n, err := s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = s.CountInflight("a")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestCountSubscriptionsNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	_, err := s.CountSubscriptions("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+
+	_, err = s.CountInflight("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
+func TestOpenIndexClients(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription})
+	require.NoError(t, err)
+
+	err = s.WriteInflight(persistence.Message{ID: "ifm_a_1", Client: "a", T: persistence.KInflight})
+	require.NoError(t, err)
+
+	// drop the indexes, as for a db file created before they were introduced.
+	err = s.db.Bolt.Update(func(tx *bbolt.Tx) error {
+		for _, b := range []string{subscriptionBucket, messageBucket} {
+			if err := tx.Bucket([]byte(b)).DeleteBucket([]byte(clientIndex)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	n, err := s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	s.Close()
+	err = s.Open()
+	require.NoError(t, err)
+
+	n, err = s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = s.CountInflight("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+// downgradeSchema rewrites the records of the store as a db file written
+// before the schema was versioned, with an old subscription record which can
+// no longer be decoded.
+func downgradeSchema(t *testing.T, s *Store) {
+	var subs []persistence.Subscription
+	require.NoError(t, s.db.All(&subs))
+	for i := range subs {
+		subs[i].Schema = 0
+		require.NoError(t, s.db.Save(&subs[i]))
+	}
+
+	var msgs []persistence.Message
+	require.NoError(t, s.db.All(&msgs))
+	for i := range msgs {
+		msgs[i].Schema = 0
+		require.NoError(t, s.db.Save(&msgs[i]))
+	}
+
+	// a subscription stored when the filter was a different type.
+	old, err := sgob.Codec.Marshal(&struct {
+		ID     string
+		T      string
+		Filter int
+	}{ID: "old", T: persistence.KSubscription, Filter: 1})
+	require.NoError(t, err)
+
+	err = s.db.Bolt.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(schemaBucket)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(subscriptionBucket)).Put([]byte("old"), old)
+	})
+	require.NoError(t, err)
+}
+
+func TestOpenSchemaVersion(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	v, empty, err := s.schemaVersion()
+	require.NoError(t, err)
+	require.True(t, empty)
+	require.Equal(t, persistence.SchemaVersion, v)
+
+	err = s.WriteClient(persistence.Client{ID: "cl_a", ClientID: "a", T: persistence.KClient})
+	require.NoError(t, err)
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Equal(t, persistence.SchemaVersion, clients[0].Schema)
+}
+
+func TestOpenMigrateSchema(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription})
+	require.NoError(t, err)
+	err = s.WriteInflight(persistence.Message{ID: "ifm_a_1", Client: "a", T: persistence.KInflight})
+	require.NoError(t, err)
+	err = s.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"})
+	require.NoError(t, err)
+
+	downgradeSchema(t, s)
+	_, err = s.ReadSubscriptions()
+	require.Error(t, err)
+
+	var buf bytes.Buffer
+	s.SetLogger(logger.NewStd(log.New(&buf, "", 0), logger.LevelWarn))
+
+	var steps [][2]int
+	s.SetMigrateSchema(func(from, to int) error {
+		steps = append(steps, [2]int{from, to})
+
+		// the hook can read the records which survived.
+		subs, err := s.ReadSubscriptions()
+		require.NoError(t, err)
+		require.Len(t, subs, 1)
+		require.Equal(t, 0, subs[0].Schema)
+		return nil
+	})
+
+	s.Close()
+	err = s.Open()
+	require.NoError(t, err)
+	require.Equal(t, [][2]int{{0, 1}}, steps)
+	require.Contains(t, buf.String(), "deleting undecodable record")
+	require.Contains(t, buf.String(), "id=old")
+
+	v, _, err := s.schemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, persistence.SchemaVersion, v)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "a/b", subs[0].Filter)
+	require.Equal(t, persistence.SchemaVersion, subs[0].Schema)
+
+	inflight, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, persistence.SchemaVersion, inflight[0].Schema)
+
+	retained, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, persistence.SchemaVersion, retained[0].Schema)
+
+	n, err := s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// the db is only migrated once.
+	s.Close()
+	err = s.Open()
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+}
+
+func TestOpenMigrateSchemaFail(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer os.Remove(tmpPath)
+
+	err = s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription})
+	require.NoError(t, err)
+	downgradeSchema(t, s)
+
+	s.SetMigrateSchema(func(from, to int) error {
+		return errors.New("test")
+	})
+
+	s.Close()
+	err = s.Open()
+	require.Error(t, err)
+	require.Nil(t, s.db)
+}
+
+func TestOpenSchemaTooNew(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer os.Remove(tmpPath)
+
+	err = s.setSchemaVersion(persistence.SchemaVersion + 1)
+	require.NoError(t, err)
+
+	s.Close()
+	err = s.Open()
+	require.ErrorIs(t, err, ErrSchemaTooNew)
+}
+
+func TestDeleteAllRetained(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteRetainedBatch([]persistence.Message{
+		{ID: "ret_a", T: persistence.KRetained, TopicName: "a"},
+		{ID: "ret_b", T: persistence.KRetained, TopicName: "b"},
+	})
+	require.NoError(t, err)
+
+	err = s.WriteInflight(persistence.Message{ID: "ifm_a", T: persistence.KInflight})
+	require.NoError(t, err)
+
+	err = s.WriteClient(persistence.Client{ID: "cl_a", ClientID: "a", T: persistence.KClient})
+	require.NoError(t, err)
+
+	err = s.DeleteAllRetained()
+	require.NoError(t, err)
+
+	m, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, m, 0)
+
+	c, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 0, c)
+
+	i, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, i, 1)
+	require.Equal(t, "ifm_a", i[0].ID)
+
+	cl, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, cl, 1)
+
+	// the recreated buckets can be written to again.
+	err = s.WriteRetained(persistence.Message{ID: "ret_c", T: persistence.KRetained, TopicName: "c"})
+	require.NoError(t, err)
+
+	c, err = s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 1, c)
+}
+
+func TestDeleteAllRetainedEmpty(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	require.NoError(t, s.DeleteAllRetained())
+	require.NoError(t, s.DeleteAllInflight())
+}
+
+func TestDeleteAllRetainedNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	require.ErrorIs(t, s.DeleteAllRetained(), ErrDBNotOpen)
+}
+
+func TestDeleteAllInflight(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteInflight(persistence.Message{ID: "ifm_a", T: persistence.KInflight})
+	require.NoError(t, err)
+
+	err = s.WriteInflight(persistence.Message{ID: "ifm_b", T: persistence.KInflight})
+	require.NoError(t, err)
+
+	err = s.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"})
+	require.NoError(t, err)
+
+	err = s.DeleteAllInflight()
+	require.NoError(t, err)
+
+	i, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, i, 0)
+
+	m, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	require.Equal(t, "ret_a", m[0].ID)
+
+	c, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 1, c)
+}
+
+func TestDeleteAllInflightNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	require.ErrorIs(t, s.DeleteAllInflight(), ErrDBNotOpen)
+}
+
+func TestWriteSubscriptionBatch(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteSubscriptionBatch([]persistence.Subscription{
+		{ID: "test:a/b/c", Client: "test", Filter: "a/b/c", QoS: 1, T: persistence.KSubscription},
+		{ID: "test:d/e/f", Client: "test", Filter: "d/e/f", QoS: 2, T: persistence.KSubscription},
+	})
+	require.NoError(t, err)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+}
+
+func TestWriteSubscriptionBatchRollback(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteSubscriptionBatch([]persistence.Subscription{
+		{ID: "test:a/b/c", Client: "test", Filter: "a/b/c", QoS: 1, T: persistence.KSubscription},
+		{Client: "test", Filter: "d/e/f", QoS: 2, T: persistence.KSubscription},
+	})
+	require.Error(t, err)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 0)
+}
+
+func TestWriteSubscriptionBatchNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.WriteSubscriptionBatch([]persistence.Subscription{{}})
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
+func TestWriteRetainedBatch(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteRetainedBatch([]persistence.Message{
+		{ID: "ret_a/b/c", T: persistence.KRetained, TopicName: "a/b/c", Payload: []byte("hello")},
+		{ID: "ret_d/e/f", T: persistence.KRetained, TopicName: "d/e/f", Payload: []byte("yes")},
+	})
+	require.NoError(t, err)
+
+	msgs, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+}
+
+func TestWriteRetainedBatchRollback(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteRetainedBatch([]persistence.Message{
+		{ID: "ret_a/b/c", T: persistence.KRetained, TopicName: "a/b/c"},
+		{T: persistence.KRetained, TopicName: "d/e/f"},
+	})
+	require.Error(t, err)
+
+	msgs, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, msgs, 0)
+}
+
+func TestWriteRetainedBatchNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.WriteRetainedBatch([]persistence.Message{{}})
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
+func TestWriteClientBatch(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteClientBatch([]persistence.Client{
+		{ID: "cl_client1", ClientID: "client1", T: persistence.KClient},
+		{ID: "cl_client2", ClientID: "client2", T: persistence.KClient},
+	})
+	require.NoError(t, err)
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+}
+
+func TestWriteClientBatchRollback(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteClientBatch([]persistence.Client{
+		{ID: "cl_client1", ClientID: "client1", T: persistence.KClient},
+		{ClientID: "client2", T: persistence.KClient},
+	})
+	require.Error(t, err)
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 0)
+}
+
+func TestWriteClientBatchNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.WriteClientBatch([]persistence.Client{{}})
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
+func TestCompact(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	err = s.WriteServerInfo(persistence.ServerInfo{
+		Info: system.Info{Version: "test", Started: 100},
+		ID:   persistence.KServerInfo,
+	})
+	require.NoError(t, err)
+	err = s.WriteSubscription(persistence.Subscription{ID: "test:a/b/c", Client: "test", Filter: "a/b/c", T: persistence.KSubscription})
+	require.NoError(t, err)
+	err = s.WriteClient(persistence.Client{ID: "cl_client1", ClientID: "client1", T: persistence.KClient})
+	require.NoError(t, err)
+	err = s.WriteInflight(persistence.Message{ID: "if_client1_1", T: persistence.KInflight, Created: 10})
+	require.NoError(t, err)
+	err = s.WriteRetained(persistence.Message{ID: "ret_a/b/c", T: persistence.KRetained, TopicName: "a/b/c"})
+	require.NoError(t, err)
+
+	payload := make([]byte, 1024*64)
+	for i := 0; i < 64; i++ {
+		id := "ret_x/" + strconv.Itoa(i)
+		err = s.WriteRetained(persistence.Message{ID: id, T: persistence.KRetained, Payload: payload})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 64; i++ {
+		err = s.DeleteRetained("ret_x/" + strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+
+	before, err := os.Stat(tmpPath)
+	require.NoError(t, err)
+
+	err = s.Compact()
+	require.NoError(t, err)
+
+	after, err := os.Stat(tmpPath)
+	require.NoError(t, err)
+	require.Less(t, after.Size(), before.Size())
+
+	_, err = os.Stat(tmpPath + compactSuffix)
+	require.True(t, os.IsNotExist(err))
+
+	info, err := s.ReadServerInfo()
+	require.NoError(t, err)
+	require.Equal(t, "test", info.Version)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+
+	inflight, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+
+	retained, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, "a/b/c", retained[0].TopicName)
+}
+
+func TestCompactNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Compact()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
+func TestOpenCompactionThreshold(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+
+	payload := make([]byte, 1024*64)
+	for i := 0; i < 32; i++ {
+		err = s.WriteRetained(persistence.Message{ID: "ret_x/" + strconv.Itoa(i), T: persistence.KRetained, Payload: payload})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 32; i++ {
+		err = s.DeleteRetained("ret_x/" + strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	s.Close()
+
+	before, err := os.Stat(tmpPath)
+	require.NoError(t, err)
+
+	s = New(tmpPath, nil)
+	s.SetCompactionThreshold(before.Size() - 1)
+	err = s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	after, err := os.Stat(tmpPath)
+	require.NoError(t, err)
+	require.Less(t, after.Size(), before.Size())
+}
+
+// writeTruncated writes a db file and truncates it to half its size, as if the
+// process had been killed while the file was being written.
+func writeTruncated(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+
+	err = s.WriteClient(persistence.Client{ID: "cl_client1", ClientID: "client1", T: persistence.KClient})
+	require.NoError(t, err)
+	for i := 0; i < 2000; i++ {
+		err = s.WriteSubscription(persistence.Subscription{
+			ID:     "sub_client1:a/b/" + strconv.Itoa(i),
+			T:      persistence.KSubscription,
+			Client: "client1",
+			Filter: "a/b/" + strconv.Itoa(i),
+		})
+		require.NoError(t, err)
+	}
+	s.Close()
+
+	fi, err := os.Stat(tmpPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(tmpPath, fi.Size()/2))
+}
+
+// teardownCorrupt removes the files left by a corrupt db test.
+func teardownCorrupt(s *Store, t *testing.T) {
+	if s.db != nil {
+		s.Close()
+	}
+	_ = os.Remove(tmpPath + corruptSuffix)
+	require.NoError(t, os.Remove(tmpPath))
+}
+
+func TestOpenCorruptTruncated(t *testing.T) {
+	writeTruncated(t)
+
+	s := New(tmpPath, nil)
+	defer teardownCorrupt(s, t)
+	err := s.Open()
+	require.ErrorIs(t, err, ErrDBCorrupt)
+	require.Nil(t, s.db)
+}
+
+func TestOpenCorruptInvalid(t *testing.T) {
+	err := os.WriteFile(tmpPath, []byte("this is not a bolt db file"), 0600)
+	require.NoError(t, err)
+
+	s := New(tmpPath, nil)
+	defer teardownCorrupt(s, t)
+	err = s.Open()
+	require.ErrorIs(t, err, ErrDBCorrupt)
+}
+
+func TestOpenResetCorrupt(t *testing.T) {
+	writeTruncated(t)
+
+	s := New(tmpPath, nil)
+	s.SetResetCorrupt(true)
+	defer teardownCorrupt(s, t)
+	err := s.Open()
+	require.NoError(t, err)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	_, err = os.Stat(tmpPath + corruptSuffix)
+	require.NoError(t, err)
+}
+
+func TestRecover(t *testing.T) {
+	writeTruncated(t)
+
+	s := New(tmpPath, nil)
+	defer teardownCorrupt(s, t)
+	err := s.Open()
+	require.ErrorIs(t, err, ErrDBCorrupt)
+
+	// The records of a truncated file are beyond the end of the file, so the
+	// recovered db is empty, but the store can be used again.
+	err = s.Recover()
+	require.NoError(t, err)
+
+	err = s.WriteClient(persistence.Client{ID: "cl_client2", ClientID: "client2", T: persistence.KClient})
+	require.NoError(t, err)
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+
+	_, err = os.Stat(tmpPath + corruptSuffix)
+	require.NoError(t, err)
+	_, err = os.Stat(tmpPath + compactSuffix)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRecoverHealthy(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardownCorrupt(s, t)
+
+	err = s.WriteServerInfo(persistence.ServerInfo{
+		Info: system.Info{Version: "test", Started: 100},
+		ID:   persistence.KServerInfo,
+	})
+	require.NoError(t, err)
+	err = s.WriteSubscription(persistence.Subscription{ID: "test:a/b/c", Client: "test", Filter: "a/b/c", T: persistence.KSubscription})
+	require.NoError(t, err)
+	err = s.WriteInflight(persistence.Message{ID: "if_client1_1", T: persistence.KInflight, Created: 10})
+	require.NoError(t, err)
+	err = s.WriteRetained(persistence.Message{ID: "ret_a/b/c", T: persistence.KRetained, TopicName: "a/b/c"})
+	require.NoError(t, err)
+
+	err = s.Recover()
+	require.NoError(t, err)
+
+	info, err := s.ReadServerInfo()
+	require.NoError(t, err)
+	require.Equal(t, "test", info.Version)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	inflight, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+
+	n, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestSalvageBucketDamaged(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	for i := 0; i < 10; i++ {
+		err = s.WriteSubscription(persistence.Subscription{ID: "sub_" + strconv.Itoa(i), T: persistence.KSubscription})
+		require.NoError(t, err)
+	}
+
+	var n int
+	err = s.db.Bolt.View(func(tx *bbolt.Tx) error {
+		return salvageBucket(tx, "Subscription", func(b []byte) error {
+			n++
+			if n == 5 {
+				panic("damaged page")
+			}
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+}
+
+func TestClearExpiredSessions(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.Open()
+	require.NoError(t, err)
+	defer teardown(s, t)
+
+	for _, c := range []persistence.Client{
+		{ID: "cl_a", ClientID: "a", T: persistence.KClient, SessionExpiryInterval: 10, Expires: 100},
+		{ID: "cl_b", ClientID: "b", T: persistence.KClient, SessionExpiryInterval: 10, Expires: 300},
+		{ID: "cl_c", ClientID: "c", T: persistence.KClient, SessionExpiryInterval: 10},
+	} {
+		require.NoError(t, s.WriteClient(c))
+		require.NoError(t, s.WriteSubscription(persistence.Subscription{
+			ID:     "sub_" + c.ClientID + ":a/b/c",
+			T:      persistence.KSubscription,
+			Client: c.ClientID,
+			Filter: "a/b/c",
+		}))
+		require.NoError(t, s.WriteInflight(persistence.Message{
+			ID:      "if_" + c.ClientID + "_1",
+			T:       persistence.KInflight,
+			Client:  c.ClientID,
+			Created: 1000,
+		}))
+	}
+
+	require.NoError(t, s.ClearExpiredSessions(200))
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "cl_b", clients[0].ID)
+	require.Equal(t, "cl_c", clients[1].ID)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.Equal(t, "b", subs[0].Client)
+	require.Equal(t, "c", subs[1].Client)
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "b", msgs[0].Client)
+	require.Equal(t, "c", msgs[1].Client)
+}
+
+func TestClearExpiredSessionsNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.ClearExpiredSessions(1)
+	require.Error(t, err)
+}
+
+var (
+	testKey      = bytes.Repeat([]byte{1}, 32)
+	testRotateTo = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestNewEncrypted(t *testing.T) {
+	s, err := NewEncrypted(tmpPath, nil, testKey)
+	require.NoError(t, err)
+	require.NotNil(t, s.crypt)
+	require.Equal(t, tmpPath, s.path)
+}
+
+func TestNewEncryptedInvalidKey(t *testing.T) {
+	_, err := NewEncrypted(tmpPath, nil, []byte("short"))
+	require.ErrorIs(t, err, ErrInvalidKey)
+
+	_, err = NewEncrypted(tmpPath, nil, nil)
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestEncryptedReadWrite(t *testing.T) {
+	s, err := NewEncrypted(tmpPath, nil, testKey)
+	require.NoError(t, err)
+	require.NoError(t, s.Open())
+	defer teardown(s, t)
+
+	err = s.WriteRetained(persistence.Message{
+		ID:        "ret_a/b/c",
+		T:         persistence.KRetained,
+		TopicName: "a/b/c",
+		Payload:   []byte("secret payload"),
+	})
+	require.NoError(t, err)
+
+	err = s.db.Bolt.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket([]byte(messageBucket)).Get([]byte("ret_a/b/c"))
+		require.NotNil(t, v)
+		require.False(t, bytes.Contains(v, []byte("secret payload")))
+		return nil
+	})
+	require.NoError(t, err)
+
+	s.Close()
+	require.NoError(t, s.Open())
+
+	retained, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("secret payload"), retained[0].Payload)
+
+	topics, err := s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/b/c"}, topics)
+}
+
+func TestOpenEncryptedKeyMismatch(t *testing.T) {
+	s, err := NewEncrypted(tmpPath, nil, testKey)
+	require.NoError(t, err)
+	require.NoError(t, s.Open())
+	err = s.WriteClient(persistence.Client{ID: "cl_client1", ClientID: "client1", T: persistence.KClient})
+	require.NoError(t, err)
+	s.Close()
+	defer os.Remove(tmpPath)
+
+	wrong, err := NewEncrypted(tmpPath, nil, testRotateTo)
+	require.NoError(t, err)
+	err = wrong.Open()
+	require.ErrorIs(t, err, ErrEncryptionKey)
+	require.False(t, wrong.IsOpen())
+
+	plain := New(tmpPath, nil)
+	err = plain.Open()
+	require.ErrorIs(t, err, ErrEncryptionKey)
+}
+
+func TestOpenPlainWithKey(t *testing.T) {
+	s := New(tmpPath, nil)
+	require.NoError(t, s.Open())
+	err := s.WriteClient(persistence.Client{ID: "cl_client1", ClientID: "client1", T: persistence.KClient})
+	require.NoError(t, err)
+	s.Close()
+	defer os.Remove(tmpPath)
+
+	enc, err := NewEncrypted(tmpPath, nil, testKey)
+	require.NoError(t, err)
+	err = enc.Open()
+	require.ErrorIs(t, err, ErrEncryptionKey)
+}
+
+func TestReEncrypt(t *testing.T) {
+	s, err := NewEncrypted(tmpPath, nil, testKey)
+	require.NoError(t, err)
+	require.NoError(t, s.Open())
+
+	err = s.WriteSubscription(persistence.Subscription{ID: "test:a/b/c", Client: "test", Filter: "a/b/c", T: persistence.KSubscription})
+	require.NoError(t, err)
+	err = s.WriteInflight(persistence.Message{ID: "if_client1_1", Client: "client1", T: persistence.KInflight, Created: 10})
+	require.NoError(t, err)
+
+	err = s.ReEncrypt(testKey, testRotateTo)
+	require.NoError(t, err)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	s.Close()
+
+	old, err := NewEncrypted(tmpPath, nil, testKey)
+	require.NoError(t, err)
+	require.ErrorIs(t, old.Open(), ErrEncryptionKey)
+
+	s, err = NewEncrypted(tmpPath, nil, testRotateTo)
+	require.NoError(t, err)
+	require.NoError(t, s.Open())
+	defer teardown(s, t)
+
+	n, err := s.CountInflight("client1")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestReEncryptPlain(t *testing.T) {
+	s := New(tmpPath, nil)
+	require.NoError(t, s.Open())
+	defer teardown(s, t)
+
+	err := s.WriteClient(persistence.Client{ID: "cl_client1", ClientID: "client1", T: persistence.KClient})
+	require.NoError(t, err)
+
+	err = s.ReEncrypt(nil, testKey)
+	require.NoError(t, err)
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+
+	err = s.ReEncrypt(testKey, nil)
+	require.NoError(t, err)
+	s.Close()
+
+	s = New(tmpPath, nil)
+	require.NoError(t, s.Open())
+	clients, err = s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+}
+
+func TestReEncryptWrongKey(t *testing.T) {
+	s, err := NewEncrypted(tmpPath, nil, testKey)
+	require.NoError(t, err)
+	require.NoError(t, s.Open())
+	defer teardown(s, t)
+
+	err = s.WriteClient(persistence.Client{ID: "cl_client1", ClientID: "client1", T: persistence.KClient})
+	require.NoError(t, err)
+
+	err = s.ReEncrypt(testRotateTo, testKey)
+	require.ErrorIs(t, err, ErrEncryptionKey)
+
+	err = s.ReEncrypt(testKey, []byte("short"))
+	require.ErrorIs(t, err, ErrInvalidKey)
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+}
+
+func TestReEncryptNoDB(t *testing.T) {
+	s := New(tmpPath, nil)
+	err := s.ReEncrypt(nil, testKey)
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
+func TestCompactEncrypted(t *testing.T) {
+	s, err := NewEncrypted(tmpPath, nil, testKey)
+	require.NoError(t, err)
+	require.NoError(t, s.Open())
+	defer teardown(s, t)
+
+	err = s.WriteClient(persistence.Client{ID: "cl_client1", ClientID: "client1", T: persistence.KClient})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Compact())
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+}
+
+func BenchmarkWriteInflight(b *testing.B) {
+	benchmarkWriteInflight(b, New(tmpPath, &bbolt.Options{NoSync: true}))
+}
+
+func BenchmarkWriteInflightEncrypted(b *testing.B) {
+	s, err := NewEncrypted(tmpPath, &bbolt.Options{NoSync: true}, testKey)
+	require.NoError(b, err)
+	benchmarkWriteInflight(b, s)
+}
+
+func benchmarkWriteInflight(b *testing.B, s *Store) {
+	require.NoError(b, s.Open())
+	defer os.Remove(tmpPath)
+	defer s.Close()
+
+	payload := make([]byte, 256)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		err := s.WriteInflight(persistence.Message{ID: "if_client1_" + strconv.Itoa(n), T: persistence.KInflight, Payload: payload})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package bolt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	sgob "github.com/asdine/storm/codec/gob"
+	"go.etcd.io/bbolt"
+)
+
+// keyCheck is the plaintext sealed under the encryption key of an encrypted db
+// and stored in the schema bucket, so a wrong key is found when the db is opened
+// rather than when its records are first read.
+var keyCheck = []byte("mochi-mqtt")
+
+// stormInfoBucket is the bucket in which storm keeps the version of the db,
+// encoded with the codec of the store, so it is encrypted with the records.
+const stormInfoBucket = "__storm_db"
+
+var (
+	// ErrInvalidKey indicates an encryption key is not a valid AES key, which
+	// must be 16, 24 or 32 bytes long.
+	ErrInvalidKey = fmt.Errorf("invalid encryption key")
+
+	// ErrEncryptionKey indicates the records of the db file were not encrypted
+	// with the key given, or are encrypted when no key was given, or not
+	// encrypted when a key was given.
+	ErrEncryptionKey = fmt.Errorf("boltdb encryption key does not match")
+
+	// ErrDecrypt indicates a record value could not be decrypted.
+	ErrDecrypt = fmt.Errorf("boltdb record could not be decrypted")
+)
+
+// aesCodec is a storm codec which gob encodes record values and encrypts them
+// with AES-GCM. Each value is stored as a random nonce followed by the sealed
+// value. A nil aesCodec leaves values unencrypted.
+type aesCodec struct {
+	aead cipher.AEAD
+}
+
+// newAESCodec returns a codec which encrypts values with key, or nil if the key
+// is empty.
+func newAESCodec(key []byte) (*aesCodec, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	return &aesCodec{aead: aead}, nil
+}
+
+// Marshal gob encodes and encrypts a value.
+func (c *aesCodec) Marshal(v interface{}) ([]byte, error) {
+	b, err := sgob.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.seal(b)
+}
+
+// Unmarshal decrypts and gob decodes a value.
+func (c *aesCodec) Unmarshal(b []byte, v interface{}) error {
+	b, err := c.open(b)
+	if err != nil {
+		return err
+	}
+
+	return sgob.Codec.Unmarshal(b, v)
+}
+
+// Name returns the name of the underlying gob codec, which storm records in the
+// metadata of each bucket, so encrypting a db does not change its buckets.
+func (c *aesCodec) Name() string {
+	return sgob.Codec.Name()
+}
+
+// seal encrypts a plaintext value.
+func (c *aesCodec) seal(b []byte) ([]byte, error) {
+	if c == nil {
+		return b, nil
+	}
+
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(b)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return c.aead.Seal(nonce, nonce, b, nil), nil
+}
+
+// open decrypts a sealed value.
+func (c *aesCodec) open(b []byte) ([]byte, error) {
+	if c == nil {
+		return b, nil
+	}
+
+	n := c.aead.NonceSize()
+	if len(b) < n {
+		return nil, ErrDecrypt
+	}
+
+	p, err := c.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return p, nil
+}
+
+// verifyKey checks that the records of the db are encrypted with the key of c,
+// or are not encrypted if c is nil. A db with no records may be given any key.
+func verifyKey(tx *bbolt.Tx, c *aesCodec) error {
+	check := getKeyCheck(tx)
+	switch {
+	case check == nil && c == nil:
+		return nil
+	case check == nil:
+		if hasRecords(tx) {
+			return fmt.Errorf("%w: db is not encrypted", ErrEncryptionKey)
+		}
+		return nil
+	case c == nil:
+		return fmt.Errorf("%w: db is encrypted", ErrEncryptionKey)
+	}
+
+	p, err := c.open(check)
+	if err != nil || !bytes.Equal(p, keyCheck) {
+		return fmt.Errorf("%w: key does not decrypt db", ErrEncryptionKey)
+	}
+
+	return nil
+}
+
+// initKey verifies the encryption key of the store against the db, and
+// encrypts a db with no records when it is first opened with a key.
+func initKey(tx *bbolt.Tx, c *aesCodec) error {
+	if err := verifyKey(tx, c); err != nil {
+		return err
+	}
+
+	if c == nil || getKeyCheck(tx) != nil {
+		return nil
+	}
+
+	if err := reencryptBuckets(tx, nil, c); err != nil {
+		return err
+	}
+
+	return putKeyCheck(tx, c)
+}
+
+// getKeyCheck returns the key check value of the db, or nil if the db is not
+// encrypted.
+func getKeyCheck(tx *bbolt.Tx) []byte {
+	b := tx.Bucket([]byte(schemaBucket))
+	if b == nil {
+		return nil
+	}
+
+	return b.Get([]byte(cipherKey))
+}
+
+// putKeyCheck stores the key check value sealed with the key of c, or removes
+// it if c is nil.
+func putKeyCheck(tx *bbolt.Tx, c *aesCodec) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(schemaBucket))
+	if err != nil {
+		return err
+	}
+
+	if c == nil {
+		return b.Delete([]byte(cipherKey))
+	}
+
+	v, err := c.seal(keyCheck)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(cipherKey), v)
+}
+
+// reencryptBuckets decrypts the values of every bucket encoded by the store
+// with from, and encrypts them again with to.
+func reencryptBuckets(tx *bbolt.Tx, from, to *aesCodec) error {
+	if err := reencryptBucket(tx, stormInfoBucket, from, to); err != nil {
+		return err
+	}
+
+	for _, rb := range recordBuckets {
+		if err := reencryptBucket(tx, rb.name, from, to); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reencryptBucket decrypts each record value in a storm bucket with from, and
+// encrypts it again with to.
+func reencryptBucket(tx *bbolt.Tx, name string, from, to *aesCodec) error {
+	b := tx.Bucket([]byte(name))
+	if b == nil {
+		return nil
+	}
+
+	// Buckets must not be changed while iterating them, so the values are
+	// collected first.
+	var keys, values [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if v == nil { // nested buckets hold storm indexes and metadata.
+			return nil
+		}
+
+		p, err := from.open(v)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", name, k, err)
+		}
+
+		v, err = to.seal(p)
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, append([]byte(nil), k...))
+		values = append(values, append([]byte(nil), v...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range keys {
+		if err := b.Put(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
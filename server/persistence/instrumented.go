@@ -0,0 +1,225 @@
+package persistence
+
+import (
+	"sync"
+	"time"
+)
+
+// instrumented is a Store which times each operation of another Store and
+// reports it, named after the Store method which was called.
+type instrumented struct {
+	sync.Mutex                                             // serialises calls to the reporter.
+	store      Store                                       // the wrapped store.
+	report     func(op string, d time.Duration, err error) // receives the duration and result of each operation.
+}
+
+// Instrumented returns a Store which wraps another Store, timing each of its
+// operations and passing the name of the method called (eg. "WriteInflight"),
+// the time it took, and any error to reporter. Errors, such as a backend's
+// ErrDBNotOpen, are returned unchanged. The wrapped store must itself be safe
+// for concurrent use, but calls to reporter are serialised, so it need not be.
+// If reporter is nil, the store is returned unwrapped.
+func Instrumented(store Store, reporter func(op string, d time.Duration, err error)) Store {
+	if reporter == nil {
+		return store
+	}
+
+	return &instrumented{
+		store:  store,
+		report: reporter,
+	}
+}
+
+// observe reports an operation which began at start and returned *err.
+func (s *instrumented) observe(op string, start time.Time, err *error) {
+	d := time.Since(start)
+
+	s.Lock()
+	s.report(op, d, *err)
+	s.Unlock()
+}
+
+// Open opens the wrapped store.
+func (s *instrumented) Open() (err error) {
+	defer s.observe("Open", time.Now(), &err)
+	return s.store.Open()
+}
+
+// Close closes the wrapped store.
+func (s *instrumented) Close() {
+	s.store.Close()
+}
+
+// SetInflightTTL sets the inflight ttl of the wrapped store.
+func (s *instrumented) SetInflightTTL(seconds int64) {
+	s.store.SetInflightTTL(seconds)
+}
+
+// SetInflightTTLForQoS sets the inflight ttl of a qos of the wrapped store.
+func (s *instrumented) SetInflightTTLForQoS(qos byte, seconds int64) {
+	s.store.SetInflightTTLForQoS(qos, seconds)
+}
+
+// ReadSubscriptions loads all the subscriptions from the wrapped store.
+func (s *instrumented) ReadSubscriptions() (v []Subscription, err error) {
+	defer s.observe("ReadSubscriptions", time.Now(), &err)
+	return s.store.ReadSubscriptions()
+}
+
+// ReadSubscriptionsForClient loads the subscriptions of a client from the
+// wrapped store.
+func (s *instrumented) ReadSubscriptionsForClient(clientID string) (v []Subscription, err error) {
+	defer s.observe("ReadSubscriptionsForClient", time.Now(), &err)
+	return s.store.ReadSubscriptionsForClient(clientID)
+}
+
+// WriteSubscription writes a single subscription to the wrapped store.
+func (s *instrumented) WriteSubscription(v Subscription) (err error) {
+	defer s.observe("WriteSubscription", time.Now(), &err)
+	return s.store.WriteSubscription(v)
+}
+
+// DeleteSubscription deletes a subscription from the wrapped store.
+func (s *instrumented) DeleteSubscription(id string) (err error) {
+	defer s.observe("DeleteSubscription", time.Now(), &err)
+	return s.store.DeleteSubscription(id)
+}
+
+// CountSubscriptions returns the number of subscriptions of a client in the
+// wrapped store.
+func (s *instrumented) CountSubscriptions(clientID string) (n int, err error) {
+	defer s.observe("CountSubscriptions", time.Now(), &err)
+	return s.store.CountSubscriptions(clientID)
+}
+
+// ReadClients loads all the clients from the wrapped store.
+func (s *instrumented) ReadClients() (v []Client, err error) {
+	defer s.observe("ReadClients", time.Now(), &err)
+	return s.store.ReadClients()
+}
+
+// ReadClient loads a single client from the wrapped store.
+func (s *instrumented) ReadClient(id string) (v Client, err error) {
+	defer s.observe("ReadClient", time.Now(), &err)
+	return s.store.ReadClient(id)
+}
+
+// WriteClient writes a single client to the wrapped store.
+func (s *instrumented) WriteClient(v Client) (err error) {
+	defer s.observe("WriteClient", time.Now(), &err)
+	return s.store.WriteClient(v)
+}
+
+// DeleteClient deletes a client from the wrapped store.
+func (s *instrumented) DeleteClient(id string) (err error) {
+	defer s.observe("DeleteClient", time.Now(), &err)
+	return s.store.DeleteClient(id)
+}
+
+// ReadInflight loads all the inflight messages from the wrapped store.
+func (s *instrumented) ReadInflight() (v []Message, err error) {
+	defer s.observe("ReadInflight", time.Now(), &err)
+	return s.store.ReadInflight()
+}
+
+// ReadInflightForClient loads the inflight messages of a client from the
+// wrapped store.
+func (s *instrumented) ReadInflightForClient(clientID string) (v []Message, err error) {
+	defer s.observe("ReadInflightForClient", time.Now(), &err)
+	return s.store.ReadInflightForClient(clientID)
+}
+
+// WriteInflight writes a single inflight message to the wrapped store.
+func (s *instrumented) WriteInflight(v Message) (err error) {
+	defer s.observe("WriteInflight", time.Now(), &err)
+	return s.store.WriteInflight(v)
+}
+
+// DeleteInflight deletes an inflight message from the wrapped store.
+func (s *instrumented) DeleteInflight(id string) (err error) {
+	defer s.observe("DeleteInflight", time.Now(), &err)
+	return s.store.DeleteInflight(id)
+}
+
+// DeleteAllInflight deletes all inflight messages from the wrapped store.
+func (s *instrumented) DeleteAllInflight() (err error) {
+	defer s.observe("DeleteAllInflight", time.Now(), &err)
+	return s.store.DeleteAllInflight()
+}
+
+// CountInflight returns the number of inflight messages of a client in the
+// wrapped store.
+func (s *instrumented) CountInflight(clientID string) (n int, err error) {
+	defer s.observe("CountInflight", time.Now(), &err)
+	return s.store.CountInflight(clientID)
+}
+
+// ClearExpiredInflightAt deletes any inflight messages which have expired by the
+// provided unix timestamp from the wrapped store.
+func (s *instrumented) ClearExpiredInflightAt(now int64) (err error) {
+	defer s.observe("ClearExpiredInflightAt", time.Now(), &err)
+	return s.store.ClearExpiredInflightAt(now)
+}
+
+// ReadServerInfo loads the server info from the wrapped store.
+func (s *instrumented) ReadServerInfo() (v ServerInfo, err error) {
+	defer s.observe("ReadServerInfo", time.Now(), &err)
+	return s.store.ReadServerInfo()
+}
+
+// WriteServerInfo writes the server info to the wrapped store.
+func (s *instrumented) WriteServerInfo(v ServerInfo) (err error) {
+	defer s.observe("WriteServerInfo", time.Now(), &err)
+	return s.store.WriteServerInfo(v)
+}
+
+// ReadRetained loads all the retained messages from the wrapped store.
+func (s *instrumented) ReadRetained() (v []Message, err error) {
+	defer s.observe("ReadRetained", time.Now(), &err)
+	return s.store.ReadRetained()
+}
+
+// WriteRetained writes a single retained message to the wrapped store.
+func (s *instrumented) WriteRetained(v Message) (err error) {
+	defer s.observe("WriteRetained", time.Now(), &err)
+	return s.store.WriteRetained(v)
+}
+
+// DeleteRetained deletes a retained message from the wrapped store.
+func (s *instrumented) DeleteRetained(id string) (err error) {
+	defer s.observe("DeleteRetained", time.Now(), &err)
+	return s.store.DeleteRetained(id)
+}
+
+// DeleteAllRetained deletes all retained messages from the wrapped store.
+func (s *instrumented) DeleteAllRetained() (err error) {
+	defer s.observe("DeleteAllRetained", time.Now(), &err)
+	return s.store.DeleteAllRetained()
+}
+
+// CountRetained returns the number of retained messages in the wrapped store.
+func (s *instrumented) CountRetained() (n int, err error) {
+	defer s.observe("CountRetained", time.Now(), &err)
+	return s.store.CountRetained()
+}
+
+// ListRetainedTopics returns the topics of the retained messages in the
+// wrapped store.
+func (s *instrumented) ListRetainedTopics() (v []string, err error) {
+	defer s.observe("ListRetainedTopics", time.Now(), &err)
+	return s.store.ListRetainedTopics()
+}
+
+// ClearExpiredRetained deletes any retained messages which expired before the
+// provided unix timestamp from the wrapped store.
+func (s *instrumented) ClearExpiredRetained(now int64) (err error) {
+	defer s.observe("ClearExpiredRetained", time.Now(), &err)
+	return s.store.ClearExpiredRetained(now)
+}
+
+// ClearExpiredSessions deletes the sessions which expired before the provided
+// unix timestamp from the wrapped store.
+func (s *instrumented) ClearExpiredSessions(now int64) (err error) {
+	defer s.observe("ClearExpiredSessions", time.Now(), &err)
+	return s.store.ClearExpiredSessions(now)
+}
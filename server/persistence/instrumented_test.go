@@ -0,0 +1,147 @@
+package persistence
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// errNotOpen stands in for the ErrDBNotOpen of a store backend.
+var errNotOpen = errors.New("db not opened")
+
+// closedStore is a store which has not been opened.
+type closedStore struct {
+	MockStore
+}
+
+func (s *closedStore) WriteInflight(v Message) error {
+	return errNotOpen
+}
+
+// report is an operation passed to an instrumented store's reporter.
+type report struct {
+	op  string
+	d   time.Duration
+	err error
+}
+
+func TestInstrumentedNilReporter(t *testing.T) {
+	s := new(MockStore)
+	require.Same(t, s, Instrumented(s, nil))
+}
+
+func TestInstrumented(t *testing.T) {
+	var reports []report
+	m := &MockStore{Fail: map[string]bool{"read_clients": true}}
+	s := Instrumented(m, func(op string, d time.Duration, err error) {
+		reports = append(reports, report{op, d, err})
+	})
+
+	require.NoError(t, s.Open())
+	require.True(t, m.Opened)
+
+	s.SetInflightTTL(5)
+	s.SetInflightTTLForQoS(1, 2)
+	require.Equal(t, InflightTTL{5, 2, 5}, m.inflightTTL)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	_, err = s.ReadClients()
+	require.Error(t, err)
+
+	info, err := s.ReadServerInfo()
+	require.NoError(t, err)
+	require.Equal(t, KServerInfo, info.ID)
+
+	s.Close()
+	require.True(t, m.Closed)
+
+	require.Len(t, reports, 4) // Close and the inflight ttl setters are not reported.
+	require.Equal(t, "Open", reports[0].op)
+	require.Equal(t, "ReadSubscriptions", reports[1].op)
+	require.NoError(t, reports[1].err)
+	require.Equal(t, "ReadClients", reports[2].op)
+	require.Error(t, reports[2].err)
+	require.Equal(t, "ReadServerInfo", reports[3].op)
+	for _, r := range reports {
+		require.GreaterOrEqual(t, r.d, time.Duration(0))
+	}
+}
+
+func TestInstrumentedOps(t *testing.T) {
+	var ops []string
+	s := Instrumented(new(MockStore), func(op string, d time.Duration, err error) {
+		ops = append(ops, op)
+	})
+
+	s.WriteSubscription(Subscription{})
+	s.DeleteSubscription("a")
+	s.CountSubscriptions("a")
+	s.ReadSubscriptionsForClient("a")
+	s.ReadClient("a")
+	s.WriteClient(Client{})
+	s.DeleteClient("a")
+	s.ReadInflight()
+	s.ReadInflightForClient("a")
+	s.WriteInflight(Message{})
+	s.DeleteInflight("a")
+	s.DeleteAllInflight()
+	s.CountInflight("a")
+	s.ClearExpiredInflightAt(1)
+	s.WriteServerInfo(ServerInfo{})
+	s.ReadRetained()
+	s.WriteRetained(Message{})
+	s.DeleteRetained("a")
+	s.DeleteAllRetained()
+	s.CountRetained()
+	s.ListRetainedTopics()
+	s.ClearExpiredRetained(1)
+	s.ClearExpiredSessions(1)
+
+	require.Equal(t, []string{
+		"WriteSubscription", "DeleteSubscription", "CountSubscriptions",
+		"ReadSubscriptionsForClient", "ReadClient",
+		"WriteClient", "DeleteClient",
+		"ReadInflight", "ReadInflightForClient", "WriteInflight", "DeleteInflight", "DeleteAllInflight",
+		"CountInflight", "ClearExpiredInflightAt",
+		"WriteServerInfo",
+		"ReadRetained", "WriteRetained", "DeleteRetained", "DeleteAllRetained",
+		"CountRetained", "ListRetainedTopics", "ClearExpiredRetained",
+		"ClearExpiredSessions",
+	}, ops)
+}
+
+func TestInstrumentedErrorUnchanged(t *testing.T) {
+	var reported error
+	s := Instrumented(new(closedStore), func(op string, d time.Duration, err error) {
+		reported = err
+	})
+
+	err := s.WriteInflight(Message{})
+	require.True(t, err == errNotOpen)
+	require.True(t, reported == errNotOpen)
+}
+
+func TestInstrumentedConcurrentReporter(t *testing.T) {
+	n := 0 // unguarded, as calls to the reporter are serialised.
+	s := Instrumented(new(MockStore), func(op string, d time.Duration, err error) {
+		n++
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.WriteRetained(Message{})
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 50, n)
+}
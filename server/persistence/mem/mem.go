@@ -0,0 +1,401 @@
+package mem
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/csymapp/mqtt/server/persistence"
+)
+
+// Store is an in-memory storage backend, intended for use in tests and by
+// ephemeral brokers which do not need to maintain state through restarts.
+// All values are copied on write and on read, so callers cannot mutate
+// the stored state.
+type Store struct {
+	sync.RWMutex
+	subscriptions map[string]persistence.Subscription // subscriptions keyed on id.
+	clients       map[string]persistence.Client       // clients keyed on id.
+	inflight      map[string]persistence.Message      // inflight messages keyed on id.
+	retained      map[string]persistence.Message      // retained messages keyed on id.
+	serverInfo    persistence.ServerInfo              // the server info.
+	inflightTTL   persistence.InflightTTL             // the number of seconds an inflight message of each qos should be retained before being dropped.
+}
+
+// New returns a new instance of the in-memory store.
+func New() *Store {
+	return &Store{
+		subscriptions: make(map[string]persistence.Subscription),
+		clients:       make(map[string]persistence.Client),
+		inflight:      make(map[string]persistence.Message),
+		retained:      make(map[string]persistence.Message),
+	}
+}
+
+// SetInflightTTL sets the number of seconds an inflight message should be kept
+// before being dropped, in the event it is not delivered.
+func (s *Store) SetInflightTTL(seconds int64) {
+	s.Lock()
+	s.inflightTTL = persistence.NewInflightTTL(seconds)
+	s.Unlock()
+}
+
+// SetInflightTTLForQoS sets the number of seconds an inflight message of a qos
+// should be kept before being dropped, overriding SetInflightTTL.
+func (s *Store) SetInflightTTLForQoS(qos byte, seconds int64) {
+	s.Lock()
+	s.inflightTTL.Set(qos, seconds)
+	s.Unlock()
+}
+
+// Open opens the store. It is a no-op for the in-memory store.
+func (s *Store) Open() error {
+	return nil
+}
+
+// Close closes the store. It is a no-op for the in-memory store.
+func (s *Store) Close() {}
+
+// copyBytes returns a copy of a byte slice, preserving nil.
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
+
+// copyUserProperties returns a copy of a user properties slice, preserving nil.
+func copyUserProperties(u []persistence.UserProperty) []persistence.UserProperty {
+	if u == nil {
+		return nil
+	}
+
+	return append([]persistence.UserProperty{}, u...)
+}
+
+// copyMessage returns a deep copy of a message.
+func copyMessage(v persistence.Message) persistence.Message {
+	v.Payload = copyBytes(v.Payload)
+	v.CorrelationData = copyBytes(v.CorrelationData)
+	v.User = copyUserProperties(v.User)
+	return v
+}
+
+// copyClient returns a deep copy of a client.
+func copyClient(v persistence.Client) persistence.Client {
+	v.Username = copyBytes(v.Username)
+	v.LWT.Message = copyBytes(v.LWT.Message)
+	v.LWT.CorrelationData = copyBytes(v.LWT.CorrelationData)
+	v.LWT.User = copyUserProperties(v.LWT.User)
+	return v
+}
+
+// WriteServerInfo writes the server info to the store.
+func (s *Store) WriteServerInfo(v persistence.ServerInfo) error {
+	s.Lock()
+	s.serverInfo = v
+	s.Unlock()
+	return nil
+}
+
+// WriteSubscription writes a single subscription to the store.
+func (s *Store) WriteSubscription(v persistence.Subscription) error {
+	s.Lock()
+	s.subscriptions[v.ID] = v
+	s.Unlock()
+	return nil
+}
+
+// WriteInflight writes a single inflight message to the store.
+func (s *Store) WriteInflight(v persistence.Message) error {
+	s.Lock()
+	s.inflight[v.ID] = copyMessage(v)
+	s.Unlock()
+	return nil
+}
+
+// WriteRetained writes a single retained message to the store.
+func (s *Store) WriteRetained(v persistence.Message) error {
+	s.Lock()
+	s.retained[v.ID] = copyMessage(v)
+	s.Unlock()
+	return nil
+}
+
+// WriteClient writes a single client to the store.
+func (s *Store) WriteClient(v persistence.Client) error {
+	s.Lock()
+	s.clients[v.ID] = copyClient(v)
+	s.Unlock()
+	return nil
+}
+
+// DeleteSubscription deletes a subscription from the store.
+func (s *Store) DeleteSubscription(id string) error {
+	s.Lock()
+	delete(s.subscriptions, id)
+	s.Unlock()
+	return nil
+}
+
+// DeleteClient deletes a client from the store.
+func (s *Store) DeleteClient(id string) error {
+	s.Lock()
+	delete(s.clients, id)
+	s.Unlock()
+	return nil
+}
+
+// DeleteInflight deletes an inflight message from the store.
+func (s *Store) DeleteInflight(id string) error {
+	s.Lock()
+	delete(s.inflight, id)
+	s.Unlock()
+	return nil
+}
+
+// DeleteRetained deletes a retained message from the store.
+func (s *Store) DeleteRetained(id string) error {
+	s.Lock()
+	delete(s.retained, id)
+	s.Unlock()
+	return nil
+}
+
+// CountSubscriptions returns the number of subscriptions of a client.
+func (s *Store) CountSubscriptions(clientID string) (n int, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, v := range s.subscriptions {
+		if v.Client == clientID {
+			n++
+		}
+	}
+
+	return
+}
+
+// CountInflight returns the number of inflight messages of a client.
+func (s *Store) CountInflight(clientID string) (n int, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, v := range s.inflight {
+		if v.Client == clientID {
+			n++
+		}
+	}
+
+	return
+}
+
+// DeleteAllInflight deletes all inflight messages from the store.
+func (s *Store) DeleteAllInflight() error {
+	s.Lock()
+	s.inflight = make(map[string]persistence.Message)
+	s.Unlock()
+	return nil
+}
+
+// DeleteAllRetained deletes all retained messages from the store.
+func (s *Store) DeleteAllRetained() error {
+	s.Lock()
+	s.retained = make(map[string]persistence.Message)
+	s.Unlock()
+	return nil
+}
+
+// ReadSubscriptions loads all the subscriptions from the store, sorted by id.
+func (s *Store) ReadSubscriptions() (v []persistence.Subscription, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, sub := range s.subscriptions {
+		v = append(v, sub)
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
+	return v, nil
+}
+
+// ReadSubscriptionsForClient loads the subscriptions of a client from the
+// store, sorted by id.
+func (s *Store) ReadSubscriptionsForClient(clientID string) (v []persistence.Subscription, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, sub := range s.subscriptions {
+		if sub.Client == clientID {
+			v = append(v, sub)
+		}
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
+	return v, nil
+}
+
+// ReadClient loads a single client from the store, returning
+// persistence.ErrNotFound if there is no client with the id.
+func (s *Store) ReadClient(id string) (v persistence.Client, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	cl, ok := s.clients[id]
+	if !ok {
+		return v, persistence.ErrNotFound
+	}
+
+	return copyClient(cl), nil
+}
+
+// ReadClients loads all the clients from the store, sorted by id.
+func (s *Store) ReadClients() (v []persistence.Client, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, cl := range s.clients {
+		v = append(v, copyClient(cl))
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
+	return v, nil
+}
+
+// ReadInflight loads all the inflight messages from the store, sorted by
+// client and the order they were stored in.
+func (s *Store) ReadInflight() (v []persistence.Message, err error) {
+	s.RLock()
+	defer s.RUnlock()
+	v = readMessages(s.inflight)
+	persistence.SortInflight(v)
+	return v, nil
+}
+
+// ReadInflightForClient loads the inflight messages of a client from the
+// store, sorted by the order they were stored in.
+func (s *Store) ReadInflightForClient(clientID string) (v []persistence.Message, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, msg := range s.inflight {
+		if msg.Client == clientID {
+			v = append(v, copyMessage(msg))
+		}
+	}
+
+	persistence.SortInflight(v)
+	return v, nil
+}
+
+// ReadRetained loads all the retained messages from the store, sorted by id.
+func (s *Store) ReadRetained() (v []persistence.Message, err error) {
+	s.RLock()
+	defer s.RUnlock()
+	return readMessages(s.retained), nil
+}
+
+// CountRetained returns the number of retained messages in the store.
+func (s *Store) CountRetained() (n int, err error) {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.retained), nil
+}
+
+// ListRetainedTopics returns the topics of the retained messages in the store,
+// sorted by message id.
+func (s *Store) ListRetainedTopics() (v []string, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	ids := make([]string, 0, len(s.retained))
+	for id := range s.retained {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		v = append(v, s.retained[id].TopicName)
+	}
+
+	return v, nil
+}
+
+// readMessages returns copies of all the messages in a map, sorted by id.
+func readMessages(m map[string]persistence.Message) (v []persistence.Message) {
+	for _, msg := range m {
+		v = append(v, copyMessage(msg))
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
+	return v
+}
+
+// ReadServerInfo loads the server info from the store.
+func (s *Store) ReadServerInfo() (v persistence.ServerInfo, err error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.serverInfo, nil
+}
+
+// ClearExpiredInflightAt deletes any inflight messages which have outlived the
+// inflight ttl of their qos by the provided unix timestamp.
+func (s *Store) ClearExpiredInflightAt(now int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for id, m := range s.inflight {
+		if s.inflightTTL.Expired(m, now) {
+			delete(s.inflight, id)
+		}
+	}
+
+	return nil
+}
+
+// ClearExpiredRetained deletes any retained messages which expired before the provided unix timestamp.
+func (s *Store) ClearExpiredRetained(now int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for id, m := range s.retained {
+		if m.Expired(now) {
+			delete(s.retained, id)
+		}
+	}
+
+	return nil
+}
+
+// ClearExpiredSessions deletes the clients whose sessions expired before the
+// provided unix timestamp, along with their subscriptions and inflight messages.
+func (s *Store) ClearExpiredSessions(now int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	expired := make(map[string]bool)
+	for id, c := range s.clients {
+		if c.Expired(now) {
+			expired[c.ClientID] = true
+			delete(s.clients, id)
+		}
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	for id, sub := range s.subscriptions {
+		if expired[sub.Client] {
+			delete(s.subscriptions, id)
+		}
+	}
+
+	for id, m := range s.inflight {
+		if expired[m.Client] {
+			delete(s.inflight, id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,463 @@
+package mem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/csymapp/mqtt/server/persistence"
+	"github.com/csymapp/mqtt/server/system"
+)
+
+func TestSatsifies(t *testing.T) {
+	var x persistence.Store
+	x = New()
+	require.NotNil(t, x)
+}
+
+func TestNew(t *testing.T) {
+	s := New()
+	require.NotNil(t, s)
+	require.NotNil(t, s.subscriptions)
+	require.NotNil(t, s.clients)
+	require.NotNil(t, s.inflight)
+	require.NotNil(t, s.retained)
+}
+
+func TestOpenClose(t *testing.T) {
+	s := New()
+	require.NoError(t, s.Open())
+	s.Close()
+}
+
+func TestSetInflightTTL(t *testing.T) {
+	s := New()
+	s.SetInflightTTL(5)
+	require.Equal(t, persistence.InflightTTL{5, 5, 5}, s.inflightTTL)
+
+	s.SetInflightTTLForQoS(1, 2)
+	require.Equal(t, persistence.InflightTTL{5, 2, 5}, s.inflightTTL)
+}
+
+func TestWriteAndRetrieveServerInfo(t *testing.T) {
+	s := New()
+	v := system.Info{
+		Version: "test",
+		Started: 100,
+	}
+	err := s.WriteServerInfo(persistence.ServerInfo{
+		Info: v,
+		ID:   persistence.KServerInfo,
+	})
+	require.NoError(t, err)
+
+	r, err := s.ReadServerInfo()
+	require.NoError(t, err)
+	require.Equal(t, v.Version, r.Version)
+	require.Equal(t, v.Started, r.Started)
+}
+
+func TestWriteRetrieveDeleteSubscription(t *testing.T) {
+	s := New()
+	v := persistence.Subscription{
+		ID:     "test:d/e/f",
+		Client: "test",
+		Filter: "d/e/f",
+		QoS:    2,
+		T:      persistence.KSubscription,
+	}
+	err := s.WriteSubscription(v)
+	require.NoError(t, err)
+
+	v2 := persistence.Subscription{
+		ID:     "test:a/b/c",
+		Client: "test",
+		Filter: "a/b/c",
+		QoS:    1,
+		T:      persistence.KSubscription,
+	}
+	err = s.WriteSubscription(v2)
+	require.NoError(t, err)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Subscription{v2, v}, subs)
+
+	err = s.DeleteSubscription("test:d/e/f")
+	require.NoError(t, err)
+
+	subs, err = s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Subscription{v2}, subs)
+}
+
+func TestWriteRetrieveDeleteClient(t *testing.T) {
+	s := New()
+	v := persistence.Client{
+		ID:       "cl_client1",
+		ClientID: "client1",
+		T:        persistence.KClient,
+		Listener: "tcp1",
+		Username: []byte{'m', 'o', 'c', 'h', 'i'},
+		LWT: persistence.LWT{
+			Topic:   "a/b/c",
+			Message: []byte{'h', 'e', 'l', 'l', 'o'},
+		},
+	}
+	err := s.WriteClient(v)
+	require.NoError(t, err)
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Client{v}, clients)
+
+	err = s.DeleteClient("cl_client1")
+	require.NoError(t, err)
+
+	clients, err = s.ReadClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+}
+
+func TestReadClientsCopies(t *testing.T) {
+	s := New()
+	username := []byte("mochi")
+	err := s.WriteClient(persistence.Client{
+		ID:       "cl_client1",
+		Username: username,
+		LWT: persistence.LWT{
+			Message: []byte("hello"),
+		},
+	})
+	require.NoError(t, err)
+	username[0] = 'x'
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Equal(t, []byte("mochi"), clients[0].Username)
+
+	clients[0].Username[0] = 'y'
+	clients[0].LWT.Message[0] = 'y'
+
+	clients, err = s.ReadClients()
+	require.NoError(t, err)
+	require.Equal(t, []byte("mochi"), clients[0].Username)
+	require.Equal(t, []byte("hello"), clients[0].LWT.Message)
+}
+
+func TestWriteRetrieveDeleteInflight(t *testing.T) {
+	s := New()
+	v := persistence.Message{
+		ID:        "client1_if_0",
+		T:         persistence.KInflight,
+		TopicName: "a/b/c",
+		Payload:   []byte{'h', 'e', 'l', 'l', 'o'},
+		Sent:      100,
+	}
+	err := s.WriteInflight(v)
+	require.NoError(t, err)
+
+	v2 := persistence.Message{
+		ID:        "client1_if_100",
+		T:         persistence.KInflight,
+		PacketID:  100,
+		TopicName: "d/e/f",
+		Payload:   []byte{'y', 'e', 's'},
+		Sent:      200,
+		Resends:   1,
+	}
+	err = s.WriteInflight(v2)
+	require.NoError(t, err)
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Message{v, v2}, msgs)
+
+	err = s.DeleteInflight("client1_if_100")
+	require.NoError(t, err)
+
+	msgs, err = s.ReadInflight()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Message{v}, msgs)
+}
+
+func TestWriteRetrieveDeleteRetained(t *testing.T) {
+	s := New()
+	v := persistence.Message{
+		ID: "client1_ret_200",
+		T:  persistence.KRetained,
+		FixedHeader: persistence.FixedHeader{
+			Retain: true,
+		},
+		PacketID:  200,
+		TopicName: "a/b/c",
+		Payload:   []byte{'h', 'e', 'l', 'l', 'o'},
+	}
+	err := s.WriteRetained(v)
+	require.NoError(t, err)
+
+	msgs, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Message{v}, msgs)
+
+	msgs[0].Payload[0] = 'j'
+	msgs, err = s.ReadRetained()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), msgs[0].Payload)
+
+	err = s.DeleteRetained("client1_ret_200")
+	require.NoError(t, err)
+
+	msgs, err = s.ReadRetained()
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestCountSubscriptionsInflight(t *testing.T) {
+	s := New()
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b"}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:c/d", Client: "a", Filter: "c/d"}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "b:a/b", Client: "b", Filter: "a/b"}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "ifm_a", Client: "a", T: persistence.KInflight}))
+
+	n, err := s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	n, err = s.CountSubscriptions("c")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = s.CountInflight("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = s.CountInflight("b")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestReadForClient(t *testing.T) {
+	s := New()
+	require.NoError(t, s.WriteClient(persistence.Client{ID: "cl_a", ClientID: "a", Username: []byte("mochi")}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:c/d", Client: "a", Filter: "c/d"}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b"}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "b:a/b", Client: "b", Filter: "a/b"}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "ifm_a_1", Client: "a", Sequence: 2, Payload: []byte("hi")}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "ifm_a_2", Client: "a", Sequence: 1}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "ifm_b_1", Client: "b", Sequence: 3}))
+
+	cl, err := s.ReadClient("cl_a")
+	require.NoError(t, err)
+	require.Equal(t, "a", cl.ClientID)
+
+	cl.Username[0] = 'x'
+	cl, err = s.ReadClient("cl_a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("mochi"), cl.Username)
+
+	_, err = s.ReadClient("cl_b")
+	require.ErrorIs(t, err, persistence.ErrNotFound)
+
+	subs, err := s.ReadSubscriptionsForClient("a")
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.Equal(t, "a:a/b", subs[0].ID)
+
+	msgs, err := s.ReadInflightForClient("a")
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "ifm_a_2", msgs[0].ID)
+	require.Equal(t, "ifm_a_1", msgs[1].ID)
+
+	msgs[1].Payload[0] = 'x'
+	msgs, err = s.ReadInflightForClient("a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), msgs[1].Payload)
+
+	msgs, err = s.ReadInflightForClient("c")
+	require.NoError(t, err)
+	require.Len(t, msgs, 0)
+}
+
+func TestDeleteAll(t *testing.T) {
+	s := New()
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "ifm_a", T: persistence.KInflight}))
+
+	err := s.DeleteAllRetained()
+	require.NoError(t, err)
+
+	msgs, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+
+	msgs, err = s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	err = s.DeleteAllInflight()
+	require.NoError(t, err)
+
+	msgs, err = s.ReadInflight()
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestCountListRetained(t *testing.T) {
+	s := New()
+	n, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_b", T: persistence.KRetained, TopicName: "b"}))
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_a/c", T: persistence.KRetained, TopicName: "a/c"}))
+
+	n, err = s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	topics, err := s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/c", "b"}, topics)
+}
+
+func TestReadInflightOrder(t *testing.T) {
+	s := New()
+	for _, v := range []persistence.Message{
+		{ID: "if_b_1", T: persistence.KInflight, Client: "b", Sequence: 4},
+		{ID: "if_a_1", T: persistence.KInflight, Client: "a", Sequence: 3},
+		{ID: "if_a_2", T: persistence.KInflight, Client: "a", Sequence: 1},
+		{ID: "if_b_2", T: persistence.KInflight, Client: "b", Sequence: 2},
+	} {
+		require.NoError(t, s.WriteInflight(v))
+	}
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+
+	var ids []string
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	require.Equal(t, []string{"if_a_2", "if_a_1", "if_b_2", "if_b_1"}, ids)
+}
+
+func TestClearExpiredInflightAt(t *testing.T) {
+	n := time.Now().Unix()
+	s := New()
+
+	for _, m := range []persistence.Message{
+		{ID: "i1", T: persistence.KInflight, Created: n - 1},
+		{ID: "i2", T: persistence.KInflight, Created: n - 2},
+		{ID: "i3", T: persistence.KInflight, Created: n - 3},
+		{ID: "i5", T: persistence.KInflight, Created: n - 5},
+		{ID: "i0", T: persistence.KInflight},
+	} {
+		err := s.WriteInflight(m)
+		require.NoError(t, err)
+	}
+
+	s.SetInflightTTL(2)
+	err := s.ClearExpiredInflightAt(n)
+	require.NoError(t, err)
+
+	m, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+	require.Equal(t, "i1", m[0].ID)
+	require.Equal(t, "i2", m[1].ID)
+}
+
+func TestClearExpiredInflightQos(t *testing.T) {
+	n := time.Now().Unix()
+	s := New()
+	s.SetInflightTTL(10)
+	s.SetInflightTTLForQoS(1, 2)
+
+	for _, m := range []persistence.Message{
+		{ID: "q1", T: persistence.KInflight, FixedHeader: persistence.FixedHeader{Qos: 1}, Created: n - 5},
+		{ID: "q2", T: persistence.KInflight, FixedHeader: persistence.FixedHeader{Qos: 2}, Created: n - 5},
+		{ID: "rel", T: persistence.KInflight, FixedHeader: persistence.FixedHeader{Qos: 1}, Phase: persistence.PhaseRelease, Created: n - 5},
+		{ID: "q1new", T: persistence.KInflight, FixedHeader: persistence.FixedHeader{Qos: 1}, Created: n - 1},
+	} {
+		require.NoError(t, s.WriteInflight(m))
+	}
+
+	require.NoError(t, s.ClearExpiredInflightAt(n))
+
+	m, err := s.ReadInflight()
+	require.NoError(t, err)
+	ids := make([]string, len(m))
+	for i, v := range m {
+		ids[i] = v.ID
+	}
+	require.ElementsMatch(t, []string{"q2", "rel", "q1new"}, ids)
+}
+
+func TestClearExpiredRetained(t *testing.T) {
+	n := time.Now().Unix()
+	s := New()
+
+	for _, m := range []persistence.Message{
+		{ID: "ret_a", T: persistence.KRetained, TopicName: "a", Created: n - 10, ExpiryInterval: 5},
+		{ID: "ret_b", T: persistence.KRetained, TopicName: "b", Created: n - 10, ExpiryInterval: 20},
+		{ID: "ret_c", T: persistence.KRetained, TopicName: "c", Created: n - 10},
+	} {
+		err := s.WriteRetained(m)
+		require.NoError(t, err)
+	}
+
+	err := s.ClearExpiredRetained(n)
+	require.NoError(t, err)
+
+	m, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+	require.Equal(t, "ret_b", m[0].ID)
+	require.Equal(t, "ret_c", m[1].ID)
+}
+
+func TestClearExpiredSessions(t *testing.T) {
+	s := New()
+	for _, c := range []persistence.Client{
+		{ID: "cl_a", ClientID: "a", T: persistence.KClient, SessionExpiryInterval: 10, Expires: 100},
+		{ID: "cl_b", ClientID: "b", T: persistence.KClient, SessionExpiryInterval: 10, Expires: 300},
+		{ID: "cl_c", ClientID: "c", T: persistence.KClient, SessionExpiryInterval: 10},
+	} {
+		require.NoError(t, s.WriteClient(c))
+		require.NoError(t, s.WriteSubscription(persistence.Subscription{
+			ID:     "sub_" + c.ClientID + ":a/b/c",
+			T:      persistence.KSubscription,
+			Client: c.ClientID,
+			Filter: "a/b/c",
+		}))
+		require.NoError(t, s.WriteInflight(persistence.Message{
+			ID:      "if_" + c.ClientID + "_1",
+			T:       persistence.KInflight,
+			Client:  c.ClientID,
+			Created: 1000,
+		}))
+	}
+
+	require.NoError(t, s.ClearExpiredSessions(200))
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "cl_b", clients[0].ID)
+	require.Equal(t, "cl_c", clients[1].ID)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.Equal(t, "b", subs[0].Client)
+	require.Equal(t, "c", subs[1].Client)
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "b", msgs[0].Client)
+	require.Equal(t, "c", msgs[1].Client)
+}
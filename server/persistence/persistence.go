@@ -2,6 +2,8 @@ package persistence
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 
 	"github.com/csymapp/mqtt/server/system"
 )
@@ -22,27 +24,126 @@ const (
 
 	// KClient is the key for client data.
 	KClient = "cl"
+
+	// SchemaVersion is the version of the stored record structs. It is
+	// incremented whenever a change to them means records stored by an earlier
+	// version must be migrated.
+	SchemaVersion = 1
+
+	// StateVersion is the version of the State format. It is incremented
+	// whenever a change to State means an earlier export cannot be imported.
+	StateVersion = 1
+)
+
+// The phases of the delivery of an inflight message. Outbound messages begin
+// in PhasePublish, and qos 2 messages move to PhaseRelease once the client has
+// sent a pubrec. Qos 2 messages received from a client are stored in
+// PhaseReceived until the client sends a pubrel.
+const (
+	PhasePublish  byte = iota // the publish was sent, awaiting a puback or pubrec.
+	PhaseRelease              // the pubrel was sent, awaiting a pubcomp.
+	PhaseReceived             // a qos 2 publish was received and a pubrec sent, awaiting a pubrel.
 )
 
+// InflightTTL is the number of seconds inflight messages are kept before being
+// dropped, indexed on the qos of their delivery. Messages of a qos with a ttl
+// of 0 or less are kept until they are delivered.
+type InflightTTL [3]int64
+
+// NewInflightTTL returns an InflightTTL which keeps inflight messages of every
+// qos for the same number of seconds.
+func NewInflightTTL(seconds int64) InflightTTL {
+	return InflightTTL{seconds, seconds, seconds}
+}
+
+// Set sets the number of seconds inflight messages of a qos are kept. Qos
+// above 2 are ignored.
+func (t *InflightTTL) Set(qos byte, seconds int64) {
+	if qos <= 2 {
+		t[qos] = seconds
+	}
+}
+
+// Expiry returns the unix time before which inflight messages of a qos must
+// have been created to have expired by now, or false if they never expire.
+func (t InflightTTL) Expiry(qos byte, now int64) (int64, bool) {
+	if qos > 2 || t[qos] <= 0 {
+		return 0, false
+	}
+
+	return now - t[qos], true
+}
+
+// Latest returns the latest expiry of any qos at now, before which every
+// expired inflight message must have been created, or false if no messages
+// expire.
+func (t InflightTTL) Latest(now int64) (int64, bool) {
+	var latest int64
+	var ok bool
+	for qos := range t {
+		if e, eok := t.Expiry(byte(qos), now); eok && (!ok || e > latest) {
+			latest, ok = e, true
+		}
+	}
+
+	return latest, ok
+}
+
+// Uniform returns true if inflight messages of every qos are kept for the
+// same number of seconds.
+func (t InflightTTL) Uniform() bool {
+	return t[0] == t[1] && t[1] == t[2]
+}
+
+// Expired returns true if an inflight message has outlived the ttl of the qos
+// of its delivery by now. Messages without a created time have expired unless
+// messages of their qos are never dropped.
+func (t InflightTTL) Expired(m Message, now int64) bool {
+	expiry, ok := t.Expiry(m.InflightQos(), now)
+	return ok && (m.Created < expiry || m.Created == 0)
+}
+
+// ErrNotFound indicates a record which was read by its id is not in the store.
+var ErrNotFound = errors.New("record not found")
+
+// ErrStateVersion indicates that a State was exported with a version of the
+// format which cannot be imported.
+var ErrStateVersion = errors.New("unsupported state version")
+
+// MigrateSchema is called by stores which are opened on records stored with
+// an earlier schema version, once for each version step from the stored
+// version to SchemaVersion, so that custom transformations can be made to the
+// records before they are upgraded. Returning an error fails the store open.
+type MigrateSchema func(from, to int) error
+
 // Store is an interface which details a persistent storage connector.
 type Store interface {
 	Open() error
 	Close()
 
 	ReadSubscriptions() (v []Subscription, err error)
+	ReadSubscriptionsForClient(clientID string) (v []Subscription, err error)
 	WriteSubscription(v Subscription) error
 	DeleteSubscription(id string) error
+	CountSubscriptions(clientID string) (n int, err error)
 
 	ReadClients() (v []Client, err error)
+	ReadClient(id string) (v Client, err error)
 	WriteClient(v Client) error
 	DeleteClient(id string) error
 
 	ReadInflight() (v []Message, err error)
+	ReadInflightForClient(clientID string) (v []Message, err error)
 	WriteInflight(v Message) error
 	DeleteInflight(id string) error
+	DeleteAllInflight() error
+	CountInflight(clientID string) (n int, err error)
 
 	SetInflightTTL(seconds int64)
-	ClearExpiredInflight(expiry int64) error
+	SetInflightTTLForQoS(qos byte, seconds int64)
+	// ClearExpiredInflightAt deletes the inflight messages which have
+	// outlived the ttl of their qos at the unix time now.
+	ClearExpiredInflightAt(now int64) error
 
 	ReadServerInfo() (v ServerInfo, err error)
 	WriteServerInfo(v ServerInfo) error
@@ -50,35 +151,219 @@ type Store interface {
 	ReadRetained() (v []Message, err error)
 	WriteRetained(v Message) error
 	DeleteRetained(id string) error
+	DeleteAllRetained() error
+	CountRetained() (n int, err error)
+	ListRetainedTopics() (v []string, err error)
+	ClearExpiredRetained(now int64) error
+	ClearExpiredSessions(now int64) error
+}
+
+// State contains every record held by a store, for exporting the persisted
+// state of a broker and importing it into another store.
+type State struct {
+	Version       int            // the version of the state format, StateVersion.
+	ServerInfo    ServerInfo     // the server info.
+	Clients       []Client       // the clients.
+	Subscriptions []Subscription // the subscriptions.
+	Inflight      []Message      // the inflight messages.
+	Retained      []Message      // the retained messages.
+}
+
+// ReadState reads every record held by a store.
+func ReadState(st Store) (v State, err error) {
+	v.Version = StateVersion
+
+	v.ServerInfo, err = st.ReadServerInfo()
+	if err != nil {
+		return v, fmt.Errorf("read server info; %w", err)
+	}
+
+	v.Clients, err = st.ReadClients()
+	if err != nil {
+		return v, fmt.Errorf("read clients; %w", err)
+	}
+
+	v.Subscriptions, err = st.ReadSubscriptions()
+	if err != nil {
+		return v, fmt.Errorf("read subscriptions; %w", err)
+	}
+
+	v.Inflight, err = st.ReadInflight()
+	if err != nil {
+		return v, fmt.Errorf("read inflight; %w", err)
+	}
+
+	v.Retained, err = st.ReadRetained()
+	if err != nil {
+		return v, fmt.Errorf("read retained; %w", err)
+	}
+
+	return v, nil
+}
+
+// WriteState writes the records of a State to a store. If replace is true,
+// every record already held by the store is deleted first. Otherwise the
+// records are merged with those held by the store, replacing any with the same
+// ids, and the server info is only written if the store holds none.
+func WriteState(st Store, v State, replace bool) error {
+	if v.Version != StateVersion {
+		return fmt.Errorf("%w: %d", ErrStateVersion, v.Version)
+	}
+
+	writeInfo := replace
+	if replace {
+		if err := clearState(st); err != nil {
+			return err
+		}
+	} else {
+		info, err := st.ReadServerInfo()
+		if err != nil {
+			return fmt.Errorf("read server info; %w", err)
+		}
+		writeInfo = info.ID == ""
+	}
+
+	if writeInfo && v.ServerInfo.ID != "" {
+		if err := st.WriteServerInfo(v.ServerInfo); err != nil {
+			return fmt.Errorf("write server info; %w", err)
+		}
+	}
+
+	for _, c := range v.Clients {
+		if err := st.WriteClient(c); err != nil {
+			return fmt.Errorf("write client %s; %w", c.ID, err)
+		}
+	}
+
+	for _, sub := range v.Subscriptions {
+		if err := st.WriteSubscription(sub); err != nil {
+			return fmt.Errorf("write subscription %s; %w", sub.ID, err)
+		}
+	}
+
+	for _, m := range v.Inflight {
+		if err := st.WriteInflight(m); err != nil {
+			return fmt.Errorf("write inflight %s; %w", m.ID, err)
+		}
+	}
+
+	for _, m := range v.Retained {
+		if err := st.WriteRetained(m); err != nil {
+			return fmt.Errorf("write retained %s; %w", m.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// clearState deletes every client, subscription, inflight and retained
+// message held by a store.
+func clearState(st Store) error {
+	clients, err := st.ReadClients()
+	if err != nil {
+		return fmt.Errorf("read clients; %w", err)
+	}
+
+	for _, c := range clients {
+		if err := st.DeleteClient(c.ID); err != nil {
+			return fmt.Errorf("delete client %s; %w", c.ID, err)
+		}
+	}
+
+	subs, err := st.ReadSubscriptions()
+	if err != nil {
+		return fmt.Errorf("read subscriptions; %w", err)
+	}
+
+	for _, sub := range subs {
+		if err := st.DeleteSubscription(sub.ID); err != nil {
+			return fmt.Errorf("delete subscription %s; %w", sub.ID, err)
+		}
+	}
+
+	if err := st.DeleteAllInflight(); err != nil {
+		return fmt.Errorf("delete inflight; %w", err)
+	}
+
+	if err := st.DeleteAllRetained(); err != nil {
+		return fmt.Errorf("delete retained; %w", err)
+	}
+
+	return nil
 }
 
 // ServerInfo contains information and statistics about the server.
 type ServerInfo struct {
 	system.Info        // embed the system info struct.
 	ID          string // the storage key.
+	Schema      int    // the schema version the record was stored with.
 }
 
 // Subscription contains the details of a topic filter subscription.
 type Subscription struct {
 	ID     string // the storage key.
 	T      string // the type of the stored data.
-	Client string // the id of the client who the subscription belongs to.
+	Client string `storm:"index"` // the id of the client who the subscription belongs to.
 	Filter string // the topic filter being subscribed to.
 	QoS    byte   // the desired QoS byte.
+	Group  string // the share group name, if the filter is a shared subscription.
+
+	SubscriptionIdentifier int  // the mqtt v5 subscription identifier, if one was set.
+	RetainAsPublished      bool // the mqtt v5 retain as published subscription option.
+	RetainHandling         byte // the mqtt v5 retain handling subscription option.
+	Schema                 int  // the schema version the record was stored with.
 }
 
 // Message contains the details of a retained or inflight message.
 type Message struct {
-	Payload     []byte      // the message payload (if retained).
-	FixedHeader FixedHeader // the header properties of the message.
-	T           string      // the type of the stored data.
-	ID          string      // the storage key.
-	Client      string      // the id of the client who sent the message (if inflight).
-	TopicName   string      // the topic the message was sent to (if retained).
-	Created     int64       // the time the message was created in unixtime (if inflight).
-	Sent        int64       // the last time the message was sent (for retries) in unixtime (if inflight).
-	Resends     int         // the number of times the message was attempted to be sent (if inflight).
-	PacketID    uint16      // the unique id of the packet (if inflight).
+	Payload        []byte      // the message payload (if retained).
+	FixedHeader    FixedHeader // the header properties of the message.
+	T              string      // the type of the stored data.
+	ID             string      // the storage key.
+	Client         string      `storm:"index"` // the id of the client who sent the message (if inflight).
+	TopicName      string      // the topic the message was sent to (if retained).
+	Created        int64       // the time the message was created in unixtime.
+	Sent           int64       // the last time the message was sent (for retries) in unixtime (if inflight).
+	Resends        int         // the number of times the message was attempted to be sent (if inflight).
+	ExpiryInterval int64       // the number of seconds after creation that the message expires, 0 to never expire (if retained).
+	PacketID       uint16      // the unique id of the packet (if inflight).
+	Sequence       int64       `storm:"index"` // the order the message was first stored in, increasing across all clients (if inflight).
+	Schema         int         // the schema version the record was stored with.
+
+	ResponseTopic   string // the mqtt v5 response topic of the message, if set.
+	CorrelationData []byte // the mqtt v5 correlation data of the message, if set.
+
+	User []UserProperty // the mqtt v5 user properties of the message, in order.
+
+	Phase byte // the phase of the delivery of the message (if inflight).
+}
+
+// InflightQos returns the qos of the delivery an inflight message belongs to.
+// Messages past the publish phase belong to qos 2 deliveries, though the
+// pubrels of the release phase carry qos 1 in their fixed header.
+func (m *Message) InflightQos() byte {
+	if m.Phase != PhasePublish {
+		return 2
+	}
+
+	return m.FixedHeader.Qos
+}
+
+// Expired returns true if the message has an expiry interval which lapsed
+// before the given unix time.
+func (m *Message) Expired(now int64) bool {
+	return m.ExpiryInterval > 0 && m.Created+m.ExpiryInterval < now
+}
+
+// SortInflight sorts inflight messages by client, and then by the order they
+// were first stored in, so they can be resent in their original order.
+func SortInflight(v []Message) {
+	sort.SliceStable(v, func(i, j int) bool {
+		if v[i].Client != v[j].Client {
+			return v[i].Client < v[j].Client
+		}
+		return v[i].Sequence < v[j].Sequence
+	})
 }
 
 // FixedHeader contains the fixed header properties of a message.
@@ -98,6 +383,16 @@ type Client struct {
 	ClientID string // the id of the client.
 	T        string // the type of the stored data.
 	Listener string // the last known listener id for the client
+
+	SessionExpiryInterval uint32 // the number of seconds the session is kept after the client disconnects.
+	Expires               int64  // the unix time the session expires, 0 while connected or if it never expires.
+	Schema                int    // the schema version the record was stored with.
+}
+
+// Expired returns true if the session of a disconnected client expired before
+// the given unix time.
+func (c *Client) Expired(now int64) bool {
+	return c.Expires > 0 && c.Expires < now
 }
 
 // LWT contains details about a clients LWT payload.
@@ -106,6 +401,22 @@ type LWT struct {
 	Topic   string // the topic the will message shall be sent to.
 	Qos     byte   // the quality of service desired.
 	Retain  bool   // indicates whether the will message should be retained
+	Delay   uint32 // the number of seconds to wait before sending the will message (mqtt v5).
+	Due     int64  // the unix time a delayed will message is due to be sent, once the client has disconnected.
+
+	PayloadFormat         byte           // the payload format indicator of the will message (mqtt v5).
+	PayloadFormatFlag     bool           // indicates the payload format indicator was set (mqtt v5).
+	MessageExpiryInterval uint32         // the lifetime of the will message in seconds, 0 to never expire (mqtt v5).
+	ContentType           string         // the content type of the will message (mqtt v5).
+	ResponseTopic         string         // the topic name for a response to the will message (mqtt v5).
+	CorrelationData       []byte         // the correlation data of the will message (mqtt v5).
+	User                  []UserProperty // the user properties of the will message (mqtt v5).
+}
+
+// UserProperty is an mqtt v5 user property key-value pair.
+type UserProperty struct {
+	Key string // the property key.
+	Val string // the property value.
 }
 
 // MockStore is a mock storage backend for testing.
@@ -114,12 +425,17 @@ type MockStore struct {
 	FailOpen    bool            // error on open.
 	Closed      bool            // indicate mock store is closed.
 	Opened      bool            // indicate mock store is open.
-	inflightTTL int64           // inflight expiry duration.
+	inflightTTL InflightTTL     // inflight expiry durations, indexed on qos.
 }
 
-// Close closes the storage instance.
+// SetInflightTTL sets the inflight expiry duration of every qos.
 func (s *MockStore) SetInflightTTL(seconds int64) {
-	s.inflightTTL = seconds
+	s.inflightTTL = NewInflightTTL(seconds)
+}
+
+// SetInflightTTLForQoS sets the inflight expiry duration of a qos.
+func (s *MockStore) SetInflightTTLForQoS(qos byte, seconds int64) {
+	s.inflightTTL.Set(qos, seconds)
 }
 
 // Open opens the storage instance.
@@ -213,6 +529,58 @@ func (s *MockStore) DeleteRetained(id string) error {
 	return nil
 }
 
+// CountSubscriptions returns the number of subscriptions of a client in the
+// persistent store.
+func (s *MockStore) CountSubscriptions(clientID string) (n int, err error) {
+	if _, ok := s.Fail["count_subs"]; ok {
+		return 0, errors.New("test")
+	}
+
+	v, _ := s.ReadSubscriptions()
+	for _, sub := range v {
+		if sub.Client == clientID {
+			n++
+		}
+	}
+
+	return
+}
+
+// CountInflight returns the number of inflight messages of a client in the
+// persistent store.
+func (s *MockStore) CountInflight(clientID string) (n int, err error) {
+	if _, ok := s.Fail["count_inflight"]; ok {
+		return 0, errors.New("test")
+	}
+
+	v, _ := s.ReadInflight()
+	for _, m := range v {
+		if m.Client == clientID {
+			n++
+		}
+	}
+
+	return
+}
+
+// DeleteAllInflight deletes all inflight messages from the persistent store.
+func (s *MockStore) DeleteAllInflight() error {
+	if _, ok := s.Fail["delete_all_inflight"]; ok {
+		return errors.New("test")
+	}
+
+	return nil
+}
+
+// DeleteAllRetained deletes all retained messages from the persistent store.
+func (s *MockStore) DeleteAllRetained() error {
+	if _, ok := s.Fail["delete_all_retained"]; ok {
+		return errors.New("test")
+	}
+
+	return nil
+}
+
 // ReadSubscriptions loads the subscriptions from the storage instance.
 func (s *MockStore) ReadSubscriptions() (v []Subscription, err error) {
 	if _, ok := s.Fail["read_subs"]; ok {
@@ -246,6 +614,56 @@ func (s *MockStore) ReadClients() (v []Client, err error) {
 	}, nil
 }
 
+// ReadClient loads a single client from the storage instance.
+func (s *MockStore) ReadClient(id string) (v Client, err error) {
+	if _, ok := s.Fail["read_client"]; ok {
+		return v, errors.New("test_clients")
+	}
+
+	v2, _ := s.ReadClients()
+	for _, c := range v2 {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+
+	return v, ErrNotFound
+}
+
+// ReadSubscriptionsForClient loads the subscriptions of a client from the
+// storage instance.
+func (s *MockStore) ReadSubscriptionsForClient(clientID string) (v []Subscription, err error) {
+	if _, ok := s.Fail["read_client_subs"]; ok {
+		return v, errors.New("test_subs")
+	}
+
+	v2, _ := s.ReadSubscriptions()
+	for _, sub := range v2 {
+		if sub.Client == clientID {
+			v = append(v, sub)
+		}
+	}
+
+	return
+}
+
+// ReadInflightForClient loads the inflight messages of a client from the
+// storage instance.
+func (s *MockStore) ReadInflightForClient(clientID string) (v []Message, err error) {
+	if _, ok := s.Fail["read_client_inflight"]; ok {
+		return v, errors.New("test_inflight")
+	}
+
+	v2, _ := s.ReadInflight()
+	for _, m := range v2 {
+		if m.Client == clientID {
+			v = append(v, m)
+		}
+	}
+
+	return
+}
+
 // ReadInflight loads the inflight messages from the storage instance.
 func (s *MockStore) ReadInflight() (v []Message, err error) {
 	if _, ok := s.Fail["read_inflight"]; ok {
@@ -288,6 +706,24 @@ func (s *MockStore) ReadRetained() (v []Message, err error) {
 	}, nil
 }
 
+// CountRetained returns the number of retained messages in the storage instance.
+func (s *MockStore) CountRetained() (n int, err error) {
+	if _, ok := s.Fail["count_retained"]; ok {
+		return 0, errors.New("test_retained")
+	}
+
+	return 1, nil
+}
+
+// ListRetainedTopics returns the topics of the retained messages in the storage instance.
+func (s *MockStore) ListRetainedTopics() (v []string, err error) {
+	if _, ok := s.Fail["list_retained"]; ok {
+		return v, errors.New("test_retained")
+	}
+
+	return []string{"a/b/c"}, nil
+}
+
 // ReadServerInfo loads the server info from the storage instance.
 func (s *MockStore) ReadServerInfo() (v ServerInfo, err error) {
 	if _, ok := s.Fail["read_info"]; ok {
@@ -295,15 +731,37 @@ func (s *MockStore) ReadServerInfo() (v ServerInfo, err error) {
 	}
 
 	return ServerInfo{
-		system.Info{
+		Info: system.Info{
 			Version: "test",
 			Started: 100,
 		},
-		KServerInfo,
+		ID: KServerInfo,
 	}, nil
 }
 
-// ReadServerInfo loads the server info from the storage instance.
-func (s *MockStore) ClearExpiredInflight(d int64) error {
+// ClearExpiredInflightAt deletes any expired inflight messages from the storage instance.
+func (s *MockStore) ClearExpiredInflightAt(now int64) error {
+	if _, ok := s.Fail["clear_expired_inflight"]; ok {
+		return errors.New("test_inflight")
+	}
+
+	return nil
+}
+
+// ClearExpiredRetained deletes any expired retained messages from the storage instance.
+func (s *MockStore) ClearExpiredRetained(now int64) error {
+	if _, ok := s.Fail["clear_expired_retained"]; ok {
+		return errors.New("test_retained")
+	}
+
+	return nil
+}
+
+// ClearExpiredSessions deletes any expired sessions from the storage instance.
+func (s *MockStore) ClearExpiredSessions(now int64) error {
+	if _, ok := s.Fail["clear_expired_sessions"]; ok {
+		return errors.New("test_sessions")
+	}
+
 	return nil
 }
@@ -29,7 +29,65 @@ func TestMockStoreClose(t *testing.T) {
 func TestMockStoreSetInflightTTL(t *testing.T) {
 	s := new(MockStore)
 	s.SetInflightTTL(5)
-	require.Equal(t, int64(5), s.inflightTTL)
+	require.Equal(t, InflightTTL{5, 5, 5}, s.inflightTTL)
+
+	s.SetInflightTTLForQoS(1, 2)
+	require.Equal(t, InflightTTL{5, 2, 5}, s.inflightTTL)
+}
+
+func TestInflightTTLSet(t *testing.T) {
+	ttl := NewInflightTTL(10)
+	ttl.Set(1, 5)
+	ttl.Set(3, 1) // ignored.
+	require.Equal(t, InflightTTL{10, 5, 10}, ttl)
+	require.False(t, ttl.Uniform())
+	require.True(t, NewInflightTTL(10).Uniform())
+}
+
+func TestInflightTTLExpiry(t *testing.T) {
+	ttl := InflightTTL{0, 5, 10}
+
+	_, ok := ttl.Expiry(0, 100)
+	require.False(t, ok)
+
+	e, ok := ttl.Expiry(1, 100)
+	require.True(t, ok)
+	require.Equal(t, int64(95), e)
+
+	_, ok = ttl.Expiry(3, 100)
+	require.False(t, ok)
+
+	e, ok = ttl.Latest(100)
+	require.True(t, ok)
+	require.Equal(t, int64(95), e)
+
+	_, ok = InflightTTL{}.Latest(100)
+	require.False(t, ok)
+}
+
+func TestInflightTTLExpired(t *testing.T) {
+	ttl := InflightTTL{0, 5, 10}
+	msg := func(qos, phase byte, created int64) Message {
+		return Message{
+			FixedHeader: FixedHeader{Qos: qos},
+			Phase:       phase,
+			Created:     created,
+		}
+	}
+
+	require.False(t, ttl.Expired(msg(0, PhasePublish, 1), 100)) // qos 0 never expires.
+	require.False(t, ttl.Expired(msg(0, PhasePublish, 0), 100))
+	require.True(t, ttl.Expired(msg(1, PhasePublish, 94), 100))
+	require.False(t, ttl.Expired(msg(1, PhasePublish, 95), 100))
+	require.True(t, ttl.Expired(msg(1, PhasePublish, 0), 100))
+	require.False(t, ttl.Expired(msg(2, PhasePublish, 94), 100))
+	require.True(t, ttl.Expired(msg(2, PhasePublish, 89), 100))
+
+	// pubrels carry qos 1, but belong to qos 2 deliveries.
+	require.False(t, ttl.Expired(msg(1, PhaseRelease, 94), 100))
+	require.True(t, ttl.Expired(msg(1, PhaseRelease, 89), 100))
+	received := msg(0, PhaseReceived, 1)
+	require.Equal(t, byte(2), received.InflightQos())
 }
 
 func TestMockStoreWriteSubscription(t *testing.T) {
@@ -176,6 +234,44 @@ func TestMockStoreDeleteRetainedFail(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestMockStoreCountSubscriptions(t *testing.T) {
+	s := new(MockStore)
+	n, err := s.CountSubscriptions("test")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	s.Fail = map[string]bool{"count_subs": true}
+	_, err = s.CountSubscriptions("test")
+	require.Error(t, err)
+}
+
+func TestMockStoreCountInflight(t *testing.T) {
+	s := new(MockStore)
+	n, err := s.CountInflight("client1")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	s.Fail = map[string]bool{"count_inflight": true}
+	_, err = s.CountInflight("client1")
+	require.Error(t, err)
+}
+
+func TestMockStoreDeleteAllRetained(t *testing.T) {
+	s := new(MockStore)
+	require.NoError(t, s.DeleteAllRetained())
+
+	s.Fail = map[string]bool{"delete_all_retained": true}
+	require.Error(t, s.DeleteAllRetained())
+}
+
+func TestMockStoreDeleteAllInflight(t *testing.T) {
+	s := new(MockStore)
+	require.NoError(t, s.DeleteAllInflight())
+
+	s.Fail = map[string]bool{"delete_all_inflight": true}
+	require.Error(t, s.DeleteAllInflight())
+}
+
 func TestMockStorReadServerInfo(t *testing.T) {
 	s := new(MockStore)
 	_, err := s.ReadServerInfo()
@@ -224,6 +320,50 @@ func TestMockStoreReadClientsFail(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestMockStoreReadClient(t *testing.T) {
+	s := new(MockStore)
+	v, err := s.ReadClient("cl_client1")
+	require.NoError(t, err)
+	require.Equal(t, "client1", v.ClientID)
+
+	_, err = s.ReadClient("cl_missing")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	s.Fail = map[string]bool{"read_client": true}
+	_, err = s.ReadClient("cl_client1")
+	require.Error(t, err)
+}
+
+func TestMockStoreReadSubscriptionsForClient(t *testing.T) {
+	s := new(MockStore)
+	v, err := s.ReadSubscriptionsForClient("test")
+	require.NoError(t, err)
+	require.Len(t, v, 1)
+
+	v, err = s.ReadSubscriptionsForClient("missing")
+	require.NoError(t, err)
+	require.Len(t, v, 0)
+
+	s.Fail = map[string]bool{"read_client_subs": true}
+	_, err = s.ReadSubscriptionsForClient("test")
+	require.Error(t, err)
+}
+
+func TestMockStoreReadInflightForClient(t *testing.T) {
+	s := new(MockStore)
+	v, err := s.ReadInflightForClient("client1")
+	require.NoError(t, err)
+	require.Len(t, v, 1)
+
+	v, err = s.ReadInflightForClient("missing")
+	require.NoError(t, err)
+	require.Len(t, v, 0)
+
+	s.Fail = map[string]bool{"read_client_inflight": true}
+	_, err = s.ReadInflightForClient("client1")
+	require.Error(t, err)
+}
+
 func TestMockStoreReadInflight(t *testing.T) {
 	s := new(MockStore)
 	_, err := s.ReadInflight()
@@ -256,8 +396,153 @@ func TestMockStoreReadRetainedFail(t *testing.T) {
 	require.Error(t, err)
 }
 
-func TestMockStoreClearExpiredInflight(t *testing.T) {
+func TestMockStoreCountRetained(t *testing.T) {
+	s := new(MockStore)
+	n, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestMockStoreCountRetainedFail(t *testing.T) {
+	s := &MockStore{
+		Fail: map[string]bool{
+			"count_retained": true,
+		},
+	}
+	_, err := s.CountRetained()
+	require.Error(t, err)
+}
+
+func TestMockStoreListRetainedTopics(t *testing.T) {
 	s := new(MockStore)
-	err := s.ClearExpiredInflight(2)
+	v, err := s.ListRetainedTopics()
 	require.NoError(t, err)
+	require.Equal(t, []string{"a/b/c"}, v)
+}
+
+func TestMockStoreListRetainedTopicsFail(t *testing.T) {
+	s := &MockStore{
+		Fail: map[string]bool{
+			"list_retained": true,
+		},
+	}
+	_, err := s.ListRetainedTopics()
+	require.Error(t, err)
+}
+
+func TestMockStoreClearExpiredInflightAt(t *testing.T) {
+	s := new(MockStore)
+	require.NoError(t, s.ClearExpiredInflightAt(2))
+
+	s.Fail = map[string]bool{
+		"clear_expired_inflight": true,
+	}
+	require.Error(t, s.ClearExpiredInflightAt(2))
+}
+
+func TestMockStoreClearExpiredRetained(t *testing.T) {
+	s := new(MockStore)
+	require.NoError(t, s.ClearExpiredRetained(2))
+
+	s.Fail = map[string]bool{
+		"clear_expired_retained": true,
+	}
+	require.Error(t, s.ClearExpiredRetained(2))
+}
+
+func TestMockStoreClearExpiredSessions(t *testing.T) {
+	s := new(MockStore)
+	require.NoError(t, s.ClearExpiredSessions(2))
+
+	s.Fail = map[string]bool{
+		"clear_expired_sessions": true,
+	}
+	require.Error(t, s.ClearExpiredSessions(2))
+}
+
+func TestClientExpired(t *testing.T) {
+	c := Client{}
+	require.False(t, c.Expired(1000))
+
+	c.Expires = 110
+	require.False(t, c.Expired(110))
+	require.True(t, c.Expired(111))
+}
+
+func TestMessageExpired(t *testing.T) {
+	m := Message{Created: 100}
+	require.False(t, m.Expired(1000))
+
+	m.ExpiryInterval = 10
+	require.False(t, m.Expired(110))
+	require.True(t, m.Expired(111))
+}
+
+func TestSortInflight(t *testing.T) {
+	v := []Message{
+		{ID: "b_3", Client: "b", Sequence: 3},
+		{ID: "a_5", Client: "a", Sequence: 5},
+		{ID: "b_1", Client: "b", Sequence: 1},
+		{ID: "a_2", Client: "a", Sequence: 2},
+	}
+
+	SortInflight(v)
+
+	var ids []string
+	for _, m := range v {
+		ids = append(ids, m.ID)
+	}
+	require.Equal(t, []string{"a_2", "a_5", "b_1", "b_3"}, ids)
+}
+
+func TestReadState(t *testing.T) {
+	s := new(MockStore)
+	v, err := ReadState(s)
+	require.NoError(t, err)
+	require.Equal(t, StateVersion, v.Version)
+	require.Equal(t, KServerInfo, v.ServerInfo.ID)
+	require.Len(t, v.Clients, 1)
+	require.Len(t, v.Subscriptions, 1)
+	require.Len(t, v.Inflight, 1)
+	require.Len(t, v.Retained, 1)
+}
+
+func TestReadStateFail(t *testing.T) {
+	for _, k := range []string{"read_info", "read_clients", "read_subs", "read_inflight", "read_retained"} {
+		s := new(MockStore)
+		s.Fail = map[string]bool{k: true}
+		_, err := ReadState(s)
+		require.Error(t, err, k)
+	}
+}
+
+func TestWriteState(t *testing.T) {
+	s := new(MockStore)
+	v, err := ReadState(s)
+	require.NoError(t, err)
+	require.NoError(t, WriteState(s, v, false))
+	require.NoError(t, WriteState(s, v, true))
+}
+
+func TestWriteStateVersion(t *testing.T) {
+	s := new(MockStore)
+	err := WriteState(s, State{Version: StateVersion + 1}, false)
+	require.ErrorIs(t, err, ErrStateVersion)
+}
+
+func TestWriteStateFail(t *testing.T) {
+	v, err := ReadState(new(MockStore))
+	require.NoError(t, err)
+
+	for _, k := range []string{"read_info", "write_clients", "write_subs", "write_inflight", "write_retained"} {
+		s := new(MockStore)
+		s.Fail = map[string]bool{k: true}
+		require.Error(t, WriteState(s, v, false), k)
+	}
+
+	for _, k := range []string{"read_clients", "delete_clients", "read_subs", "delete_subs", "delete_all_inflight", "delete_all_retained", "write_info"} {
+		s := new(MockStore)
+		s.Fail = map[string]bool{k: true}
+		require.Error(t, WriteState(s, v, true), k)
+	}
 }
@@ -0,0 +1,645 @@
+// Package postgres provides a PostgreSQL backed persistent store for the server.
+//
+// The store uses the database/sql package, so a PostgreSQL driver must be
+// registered by importing it in the application, for example:
+//
+//	import _ "github.com/lib/pq"
+//
+// or, using pgx, import "github.com/jackc/pgx/v5/stdlib" and set the Driver
+// option to "pgx".
+package postgres
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/csymapp/mqtt/server/persistence"
+)
+
+const (
+
+	// defaultDriver is the default database/sql driver name.
+	defaultDriver = "postgres"
+
+	// defaultPrefix is the default prefix for all table names.
+	defaultPrefix = "mqtt_"
+)
+
+// The names of the tables used for each kind of stored data, which are
+// prefixed with the Prefix option.
+const (
+	tSubscriptions = "subscriptions"
+	tInflight      = "inflight"
+	tRetained      = "retained"
+	tClients       = "clients"
+	tServerInfo    = "server_info"
+)
+
+// The names of the prepared statements used by the store.
+const (
+	qWriteServerInfo = iota
+	qWriteSubscription
+	qWriteInflight
+	qWriteRetained
+	qWriteClient
+	qDeleteSubscription
+	qDeleteInflight
+	qDeleteRetained
+	qDeleteClient
+	qDeleteAllInflight
+	qDeleteAllRetained
+	qReadServerInfo
+	qReadSubscriptions
+	qReadInflight
+	qReadRetained
+	qReadClients
+	qReadClient
+	qReadClientSubscriptions
+	qReadClientInflight
+	qCountRetained
+	qCountSubscriptions
+	qCountInflight
+	qListRetainedTopics
+	qClearExpiredInflight
+	qReadExpiredInflight
+	qClearExpiredRetained
+	qReadExpiredSessions
+	qDeleteSessionSubscriptions
+	qDeleteSessionInflight
+	qDeleteSessionClient
+)
+
+var (
+	// ErrDBNotOpen indicates the database connection has not been opened.
+	ErrDBNotOpen = fmt.Errorf("postgres not opened")
+)
+
+// Options contains configurable options for the database connection pool.
+type Options struct {
+	Driver          string        // the database/sql driver name (default "postgres").
+	Prefix          string        // the prefix for all table names (default "mqtt_").
+	MaxOpenConns    int           // the maximum number of open connections (0 is unlimited).
+	MaxIdleConns    int           // the maximum number of idle connections (0 uses the database/sql default).
+	ConnMaxLifetime time.Duration // the maximum time a connection may be reused (0 is forever).
+}
+
+// Store is a backend for writing and reading to PostgreSQL persistent storage.
+// Records are gob-encoded in the same manner as the bolt store, alongside the
+// columns needed to sort and expire them.
+//
+// The database/sql connection pool and prepared statements are safe for
+// concurrent use, so all methods may be called from multiple goroutines.
+type Store struct {
+	dsn         string                  // the data source name of the database.
+	opts        *Options                // options for configuring the connection pool.
+	db          *sql.DB                 // the database connection pool.
+	stmts       map[int]*sql.Stmt       // the prepared statements, keyed by name.
+	inflightTTL persistence.InflightTTL // the number of seconds an inflight message of each qos should be retained before being dropped.
+}
+
+// New returns a configured instance of the postgres store.
+func New(dsn string, opts *Options) *Store {
+	if opts == nil {
+		opts = new(Options)
+	}
+
+	if opts.Driver == "" {
+		opts.Driver = defaultDriver
+	}
+
+	if opts.Prefix == "" {
+		opts.Prefix = defaultPrefix
+	}
+
+	return &Store{
+		dsn:  dsn,
+		opts: opts,
+	}
+}
+
+// SetInflightTTL sets the number of seconds an inflight message should be kept
+// before being dropped, in the event it is not delivered. Unless you have a good reason,
+// you should allow this to be called by the server (in AddStore) instead of directly.
+func (s *Store) SetInflightTTL(seconds int64) {
+	s.inflightTTL = persistence.NewInflightTTL(seconds)
+}
+
+// SetInflightTTLForQoS sets the number of seconds an inflight message of a qos
+// should be kept before being dropped, overriding SetInflightTTL.
+func (s *Store) SetInflightTTLForQoS(qos byte, seconds int64) {
+	s.inflightTTL.Set(qos, seconds)
+}
+
+// Open connects to the database, creates the tables if they do not exist, and
+// prepares the statements used by the store.
+func (s *Store) Open() error {
+	db, err := sql.Open(s.opts.Driver, s.dsn)
+	if err != nil {
+		return err
+	}
+
+	db.SetMaxOpenConns(s.opts.MaxOpenConns)
+	if s.opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(s.opts.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(s.opts.ConnMaxLifetime)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+
+	if err := s.migrate(db); err != nil {
+		db.Close()
+		return fmt.Errorf("migrate; %w", err)
+	}
+
+	stmts := make(map[int]*sql.Stmt)
+	for name, query := range s.queries() {
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			for _, st := range stmts {
+				st.Close()
+			}
+			db.Close()
+			return fmt.Errorf("prepare; %w", err)
+		}
+		stmts[name] = stmt
+	}
+
+	s.db = db
+	s.stmts = stmts
+	return nil
+}
+
+// Close closes the prepared statements and the database connection pool.
+func (s *Store) Close() {
+	if s.db == nil {
+		return
+	}
+
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+
+	s.db.Close()
+	s.db = nil
+	s.stmts = nil
+}
+
+// table returns the prefixed name of a table.
+func (s *Store) table(t string) string {
+	return s.opts.Prefix + t
+}
+
+// migrate creates the tables and indexes if they do not already exist.
+func (s *Store) migrate(db *sql.DB) error {
+	for _, query := range []string{
+		"CREATE TABLE IF NOT EXISTS " + s.table(tServerInfo) + " (id TEXT PRIMARY KEY, data BYTEA NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + s.table(tSubscriptions) + " (id TEXT PRIMARY KEY, client TEXT NOT NULL, data BYTEA NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS " + s.table(tSubscriptions) + "_client ON " + s.table(tSubscriptions) + " (client)",
+		"CREATE TABLE IF NOT EXISTS " + s.table(tClients) + " (id TEXT PRIMARY KEY, client_id TEXT NOT NULL, expires BIGINT, data BYTEA NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS " + s.table(tClients) + "_expires ON " + s.table(tClients) + " (expires)",
+		"CREATE TABLE IF NOT EXISTS " + s.table(tInflight) + " (id TEXT PRIMARY KEY, client TEXT NOT NULL, sequence BIGINT NOT NULL, created BIGINT NOT NULL, data BYTEA NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS " + s.table(tInflight) + "_created ON " + s.table(tInflight) + " (created)",
+		"CREATE INDEX IF NOT EXISTS " + s.table(tInflight) + "_client_sequence ON " + s.table(tInflight) + " (client, sequence)",
+		"CREATE TABLE IF NOT EXISTS " + s.table(tRetained) + " (id TEXT PRIMARY KEY, topic TEXT NOT NULL, expires BIGINT, data BYTEA NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS " + s.table(tRetained) + "_expires ON " + s.table(tRetained) + " (expires)",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// queries returns the statements to prepare, keyed by name.
+func (s *Store) queries() map[int]string {
+	upsert := func(t string) string {
+		return "INSERT INTO " + s.table(t) + " (id, data) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data"
+	}
+
+	return map[int]string{
+		qWriteServerInfo: upsert(tServerInfo),
+		qWriteSubscription: "INSERT INTO " + s.table(tSubscriptions) + " (id, client, data) VALUES ($1, $2, $3) " +
+			"ON CONFLICT (id) DO UPDATE SET client = EXCLUDED.client, data = EXCLUDED.data",
+		qWriteClient: "INSERT INTO " + s.table(tClients) + " (id, client_id, expires, data) VALUES ($1, $2, $3, $4) " +
+			"ON CONFLICT (id) DO UPDATE SET client_id = EXCLUDED.client_id, expires = EXCLUDED.expires, data = EXCLUDED.data",
+		qWriteInflight: "INSERT INTO " + s.table(tInflight) + " (id, client, sequence, created, data) VALUES ($1, $2, $3, $4, $5) " +
+			"ON CONFLICT (id) DO UPDATE SET client = EXCLUDED.client, sequence = EXCLUDED.sequence, created = EXCLUDED.created, data = EXCLUDED.data",
+		qWriteRetained: "INSERT INTO " + s.table(tRetained) + " (id, topic, expires, data) VALUES ($1, $2, $3, $4) " +
+			"ON CONFLICT (id) DO UPDATE SET topic = EXCLUDED.topic, expires = EXCLUDED.expires, data = EXCLUDED.data",
+
+		qDeleteSubscription: "DELETE FROM " + s.table(tSubscriptions) + " WHERE id = $1",
+		qDeleteInflight:     "DELETE FROM " + s.table(tInflight) + " WHERE id = $1",
+		qDeleteRetained:     "DELETE FROM " + s.table(tRetained) + " WHERE id = $1",
+		qDeleteClient:       "DELETE FROM " + s.table(tClients) + " WHERE id = $1",
+		qDeleteAllInflight:  "DELETE FROM " + s.table(tInflight),
+		qDeleteAllRetained:  "DELETE FROM " + s.table(tRetained),
+
+		qReadServerInfo:    "SELECT data FROM " + s.table(tServerInfo) + " WHERE id = $1",
+		qReadSubscriptions: "SELECT data FROM " + s.table(tSubscriptions) + " ORDER BY id",
+		qReadInflight:      "SELECT data FROM " + s.table(tInflight) + " ORDER BY client, sequence, id",
+		qReadRetained:      "SELECT data FROM " + s.table(tRetained) + " ORDER BY id",
+		qReadClients:       "SELECT data FROM " + s.table(tClients) + " ORDER BY id",
+
+		qReadClient:              "SELECT data FROM " + s.table(tClients) + " WHERE id = $1",
+		qReadClientSubscriptions: "SELECT data FROM " + s.table(tSubscriptions) + " WHERE client = $1 ORDER BY id",
+		qReadClientInflight:      "SELECT data FROM " + s.table(tInflight) + " WHERE client = $1 ORDER BY sequence, id",
+
+		qCountRetained:        "SELECT count(*) FROM " + s.table(tRetained),
+		qCountSubscriptions:   "SELECT count(*) FROM " + s.table(tSubscriptions) + " WHERE client = $1",
+		qCountInflight:        "SELECT count(*) FROM " + s.table(tInflight) + " WHERE client = $1",
+		qListRetainedTopics:   "SELECT topic FROM " + s.table(tRetained) + " ORDER BY id",
+		qClearExpiredInflight: "DELETE FROM " + s.table(tInflight) + " WHERE created < $1",
+		qReadExpiredInflight:  "SELECT data FROM " + s.table(tInflight) + " WHERE created < $1",
+		qClearExpiredRetained: "DELETE FROM " + s.table(tRetained) + " WHERE expires < $1",
+
+		qReadExpiredSessions:        "SELECT client_id FROM " + s.table(tClients) + " WHERE expires < $1",
+		qDeleteSessionSubscriptions: "DELETE FROM " + s.table(tSubscriptions) + " WHERE client = $1",
+		qDeleteSessionInflight:      "DELETE FROM " + s.table(tInflight) + " WHERE client = $1",
+		qDeleteSessionClient:        "DELETE FROM " + s.table(tClients) + " WHERE client_id = $1",
+	}
+}
+
+// encode gob-encodes a value for storage.
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decode gob-decodes a stored value.
+func decode(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// exec executes a prepared statement.
+func (s *Store) exec(name int, args ...interface{}) error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	_, err := s.stmts[name].Exec(args...)
+	return err
+}
+
+// write encodes and upserts a record using a prepared statement.
+func (s *Store) write(name int, id string, v interface{}) error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	b, err := encode(v)
+	if err != nil {
+		return err
+	}
+
+	return s.exec(name, id, b)
+}
+
+// read runs a prepared query, calling fn with the raw value of each row.
+func (s *Store) read(name int, fn func(b []byte) error, args ...interface{}) error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	rows, err := s.stmts[name].Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return err
+		}
+
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// WriteServerInfo writes the server info to the database.
+func (s *Store) WriteServerInfo(v persistence.ServerInfo) error {
+	return s.write(qWriteServerInfo, v.ID, &v)
+}
+
+// WriteSubscription writes a single subscription to the database.
+func (s *Store) WriteSubscription(v persistence.Subscription) error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	b, err := encode(&v)
+	if err != nil {
+		return err
+	}
+
+	return s.exec(qWriteSubscription, v.ID, v.Client, b)
+}
+
+// WriteInflight writes a single inflight message to the database. The Created
+// column is indexed, so that expired messages can be deleted without scanning
+// every message.
+func (s *Store) WriteInflight(v persistence.Message) error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	b, err := encode(&v)
+	if err != nil {
+		return err
+	}
+
+	return s.exec(qWriteInflight, v.ID, v.Client, v.Sequence, v.Created, b)
+}
+
+// WriteRetained writes a single retained message to the database.
+func (s *Store) WriteRetained(v persistence.Message) error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	b, err := encode(&v)
+	if err != nil {
+		return err
+	}
+
+	var expires sql.NullInt64
+	if v.ExpiryInterval > 0 {
+		expires = sql.NullInt64{Int64: v.Created + v.ExpiryInterval, Valid: true}
+	}
+
+	return s.exec(qWriteRetained, v.ID, v.TopicName, expires, b)
+}
+
+// WriteClient writes a single client to the database.
+func (s *Store) WriteClient(v persistence.Client) error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	b, err := encode(&v)
+	if err != nil {
+		return err
+	}
+
+	var expires sql.NullInt64
+	if v.Expires > 0 {
+		expires = sql.NullInt64{Int64: v.Expires, Valid: true}
+	}
+
+	return s.exec(qWriteClient, v.ID, v.ClientID, expires, b)
+}
+
+// DeleteSubscription deletes a subscription from the database.
+func (s *Store) DeleteSubscription(id string) error {
+	return s.exec(qDeleteSubscription, id)
+}
+
+// DeleteClient deletes a client from the database.
+func (s *Store) DeleteClient(id string) error {
+	return s.exec(qDeleteClient, id)
+}
+
+// DeleteInflight deletes an inflight message from the database.
+func (s *Store) DeleteInflight(id string) error {
+	return s.exec(qDeleteInflight, id)
+}
+
+// DeleteRetained deletes a retained message from the database.
+func (s *Store) DeleteRetained(id string) error {
+	return s.exec(qDeleteRetained, id)
+}
+
+// DeleteAllInflight deletes all inflight messages from the database.
+func (s *Store) DeleteAllInflight() error {
+	return s.exec(qDeleteAllInflight)
+}
+
+// DeleteAllRetained deletes all retained messages from the database.
+func (s *Store) DeleteAllRetained() error {
+	return s.exec(qDeleteAllRetained)
+}
+
+// CountRetained returns the number of retained messages in the database.
+func (s *Store) CountRetained() (n int, err error) {
+	return s.count(qCountRetained)
+}
+
+// CountSubscriptions returns the number of subscriptions of a client in the
+// database, using the index on the client column.
+func (s *Store) CountSubscriptions(clientID string) (n int, err error) {
+	return s.count(qCountSubscriptions, clientID)
+}
+
+// CountInflight returns the number of inflight messages of a client in the
+// database, using the index on the client and sequence columns.
+func (s *Store) CountInflight(clientID string) (n int, err error) {
+	return s.count(qCountInflight, clientID)
+}
+
+// count runs a prepared count query and returns the count.
+func (s *Store) count(name int, args ...interface{}) (n int, err error) {
+	if s.db == nil {
+		return 0, ErrDBNotOpen
+	}
+
+	err = s.stmts[name].QueryRow(args...).Scan(&n)
+	return
+}
+
+// ListRetainedTopics returns the topics of the retained messages in the
+// database, sorted by message id, without loading the messages.
+func (s *Store) ListRetainedTopics() (v []string, err error) {
+	err = s.read(qListRetainedTopics, func(b []byte) error {
+		v = append(v, string(b))
+		return nil
+	})
+	return
+}
+
+// ReadSubscriptions loads all the subscriptions from the database.
+func (s *Store) ReadSubscriptions() (v []persistence.Subscription, err error) {
+	return s.readSubscriptions(qReadSubscriptions)
+}
+
+// ReadSubscriptionsForClient loads the subscriptions of a client from the
+// database, using the index on the client column.
+func (s *Store) ReadSubscriptionsForClient(clientID string) (v []persistence.Subscription, err error) {
+	return s.readSubscriptions(qReadClientSubscriptions, clientID)
+}
+
+// readSubscriptions loads and decodes subscriptions using a prepared query.
+func (s *Store) readSubscriptions(name int, args ...interface{}) (v []persistence.Subscription, err error) {
+	err = s.read(name, func(b []byte) error {
+		var d persistence.Subscription
+		if err := decode(b, &d); err != nil {
+			return err
+		}
+		v = append(v, d)
+		return nil
+	}, args...)
+	return
+}
+
+// ReadClient loads a single client by its storage key from the database,
+// returning persistence.ErrNotFound if there is no such client.
+func (s *Store) ReadClient(id string) (v persistence.Client, err error) {
+	found := false
+	err = s.read(qReadClient, func(b []byte) error {
+		found = true
+		return decode(b, &v)
+	}, id)
+	if err == nil && !found {
+		err = persistence.ErrNotFound
+	}
+
+	return
+}
+
+// ReadClients loads all the clients from the database.
+func (s *Store) ReadClients() (v []persistence.Client, err error) {
+	err = s.read(qReadClients, func(b []byte) error {
+		var d persistence.Client
+		if err := decode(b, &d); err != nil {
+			return err
+		}
+		v = append(v, d)
+		return nil
+	})
+	return
+}
+
+// ReadInflight loads all the inflight messages from the database, sorted by
+// client and the order they were stored in.
+func (s *Store) ReadInflight() (v []persistence.Message, err error) {
+	return s.readMessages(qReadInflight)
+}
+
+// ReadInflightForClient loads the inflight messages of a client from the
+// database, sorted by the order they were stored in, using the index on the
+// client and sequence columns.
+func (s *Store) ReadInflightForClient(clientID string) (v []persistence.Message, err error) {
+	return s.readMessages(qReadClientInflight, clientID)
+}
+
+// ReadRetained loads all the retained messages from the database.
+func (s *Store) ReadRetained() (v []persistence.Message, err error) {
+	return s.readMessages(qReadRetained)
+}
+
+// readMessages loads and decodes messages using a prepared query.
+func (s *Store) readMessages(name int, args ...interface{}) (v []persistence.Message, err error) {
+	err = s.read(name, func(b []byte) error {
+		var d persistence.Message
+		if err := decode(b, &d); err != nil {
+			return err
+		}
+		v = append(v, d)
+		return nil
+	}, args...)
+	return
+}
+
+// ReadServerInfo loads the server info from the database.
+func (s *Store) ReadServerInfo() (v persistence.ServerInfo, err error) {
+	err = s.read(qReadServerInfo, func(b []byte) error {
+		return decode(b, &v)
+	}, persistence.KServerInfo)
+	return
+}
+
+// ClearExpiredInflightAt deletes any inflight messages which have outlived the
+// inflight ttl of their qos by the provided unix timestamp. Where every qos has
+// the same ttl, they are deleted with a single DELETE using the index on the
+// created column. Otherwise the messages which may have expired are read using
+// the index, and those which have outlived the ttl of their qos are deleted.
+func (s *Store) ClearExpiredInflightAt(now int64) error {
+	if s.db == nil {
+		return ErrDBNotOpen
+	}
+
+	expiry, ok := s.inflightTTL.Latest(now)
+	if !ok {
+		return nil
+	}
+
+	if s.inflightTTL.Uniform() {
+		return s.exec(qClearExpiredInflight, expiry)
+	}
+
+	msgs, err := s.readMessages(qReadExpiredInflight, expiry)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range msgs {
+		if s.inflightTTL.Expired(m, now) {
+			if err := s.exec(qDeleteInflight, m.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ClearExpiredRetained deletes any retained messages which expired before the
+// provided unix timestamp. Messages without an expiry interval have no expiry
+// time, so they are never deleted.
+func (s *Store) ClearExpiredRetained(now int64) error {
+	return s.exec(qClearExpiredRetained, now)
+}
+
+// ClearExpiredSessions deletes the clients whose sessions expired before the
+// provided unix timestamp, along with their subscriptions and inflight messages.
+// Each session is deleted in a single transaction.
+func (s *Store) ClearExpiredSessions(now int64) error {
+	var ids []string
+	err := s.read(qReadExpiredSessions, func(b []byte) error {
+		ids = append(ids, string(b))
+		return nil
+	}, now)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := s.deleteSession(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteSession deletes a client and its subscriptions and inflight messages.
+func (s *Store) deleteSession(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, name := range []int{qDeleteSessionSubscriptions, qDeleteSessionInflight, qDeleteSessionClient} {
+		if _, err := tx.Stmt(s.stmts[name]).Exec(id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
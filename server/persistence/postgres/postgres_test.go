@@ -0,0 +1,888 @@
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/csymapp/mqtt/server/persistence"
+	"github.com/csymapp/mqtt/server/system"
+)
+
+const fakeDriver = "fakepg"
+
+var (
+	fakeDBs   = map[string]*fakeDB{}
+	fakeDBsMu sync.Mutex
+	fakeNext  int64
+)
+
+func init() {
+	sql.Register(fakeDriver, fakeDriverImpl{})
+}
+
+// fakeDB is a tiny in-memory database implementing the subset of SQL
+// statements used by the Store.
+type fakeDB struct {
+	sync.Mutex
+	tables   map[string]*fakeTable
+	indexes  map[string]bool
+	prepared []string
+	commits  int
+	fail     map[string]bool // fail statements starting with a prefix.
+}
+
+// fakeTable is a table of rows keyed on id.
+type fakeTable struct {
+	cols []string
+	rows map[string][]driver.Value
+}
+
+// openStore opens a store backed by a new fake database.
+func openStore(t *testing.T) (*Store, *fakeDB) {
+	s, f := newStore()
+	require.NoError(t, s.Open())
+	t.Cleanup(s.Close)
+	return s, f
+}
+
+// newStore returns a store backed by a new fake database, without opening it.
+func newStore() (*Store, *fakeDB) {
+	dsn := fmt.Sprintf("db%d", atomic.AddInt64(&fakeNext, 1))
+	f := &fakeDB{
+		tables:  map[string]*fakeTable{},
+		indexes: map[string]bool{},
+		fail:    map[string]bool{},
+	}
+
+	fakeDBsMu.Lock()
+	fakeDBs[dsn] = f
+	fakeDBsMu.Unlock()
+
+	return New(dsn, &Options{Driver: fakeDriver}), f
+}
+
+type fakeDriverImpl struct{}
+
+func (fakeDriverImpl) Open(dsn string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	f, ok := fakeDBs[dsn]
+	if !ok {
+		return nil, errors.New("unknown database")
+	}
+	return &fakeConn{db: f}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	c.db.Lock()
+	defer c.db.Unlock()
+	if err := c.db.failed(query); err != nil {
+		return nil, err
+	}
+
+	c.db.prepared = append(c.db.prepared, query)
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// Begin starts a transaction. Statements are applied immediately, so the
+// transaction is only used to check the store commits its changes.
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.Lock()
+	defer c.db.Unlock()
+	if err := c.db.failed("BEGIN"); err != nil {
+		return nil, err
+	}
+	return &fakeTx{db: c.db}, nil
+}
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.db.Lock()
+	tx.db.commits++
+	tx.db.Unlock()
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	return nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+var (
+	reCreateTable = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) \((.*)\)$`)
+	reCreateIndex = regexp.MustCompile(`^CREATE INDEX IF NOT EXISTS (\w+) ON (\w+) \((.*)\)$`)
+	reInsert      = regexp.MustCompile(`^INSERT INTO (\w+) \(([^)]+)\) VALUES`)
+	reDelete      = regexp.MustCompile(`^DELETE FROM (\w+)(?: WHERE (\w+) (=|<) \$1)?$`)
+	reSelect      = regexp.MustCompile(`^SELECT (.+?) FROM (\w+)(?: WHERE (\w+) (=|<) \$1)?(?: ORDER BY (.+))?$`)
+)
+
+// failed returns an error if statements like the query should fail.
+func (f *fakeDB) failed(query string) error {
+	for prefix := range f.fail {
+		if strings.HasPrefix(query, prefix) {
+			return errors.New("test")
+		}
+	}
+	return nil
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	f := s.db
+	f.Lock()
+	defer f.Unlock()
+	if err := f.failed(s.query); err != nil {
+		return nil, err
+	}
+
+	if m := reCreateTable.FindStringSubmatch(s.query); m != nil {
+		if _, ok := f.tables[m[1]]; !ok {
+			var cols []string
+			for _, def := range strings.Split(m[2], ", ") {
+				cols = append(cols, strings.Fields(def)[0])
+			}
+			f.tables[m[1]] = &fakeTable{cols: cols, rows: map[string][]driver.Value{}}
+		}
+		return driver.RowsAffected(0), nil
+	}
+
+	if m := reCreateIndex.FindStringSubmatch(s.query); m != nil {
+		f.indexes[m[1]] = true
+		return driver.RowsAffected(0), nil
+	}
+
+	if m := reInsert.FindStringSubmatch(s.query); m != nil {
+		tb := f.tables[m[1]]
+		row := make([]driver.Value, len(tb.cols))
+		for i, col := range strings.Split(m[2], ", ") {
+			row[tb.index(col)] = args[i]
+		}
+		tb.rows[args[0].(string)] = row
+		return driver.RowsAffected(1), nil
+	}
+
+	if m := reDelete.FindStringSubmatch(s.query); m != nil {
+		tb := f.tables[m[1]]
+		if m[2] == "" {
+			n := int64(len(tb.rows))
+			tb.rows = map[string][]driver.Value{}
+			return driver.RowsAffected(n), nil
+		}
+
+		i := tb.index(m[2])
+		var n int64
+		for id, row := range tb.rows {
+			if (m[3] == "=" && row[i] == args[0]) ||
+				(m[3] == "<" && row[i] != nil && row[i].(int64) < args[0].(int64)) {
+				delete(tb.rows, id)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	}
+
+	return nil, fmt.Errorf("unsupported exec: %s", s.query)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	f := s.db
+	f.Lock()
+	defer f.Unlock()
+	if err := f.failed(s.query); err != nil {
+		return nil, err
+	}
+
+	m := reSelect.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("unsupported query: %s", s.query)
+	}
+
+	tb := f.tables[m[2]]
+	var rows [][]driver.Value
+	for _, row := range tb.rows {
+		if m[3] != "" {
+			v := row[tb.index(m[3])]
+			if (m[4] == "=" && v != args[0]) ||
+				(m[4] == "<" && (v == nil || v.(int64) >= args[0].(int64))) {
+				continue
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	if m[1] == "count(*)" {
+		return &fakeRows{cols: []string{"count"}, rows: [][]driver.Value{{int64(len(rows))}}}, nil
+	}
+
+	if m[5] != "" {
+		order := strings.Split(m[5], ", ")
+		sort.Slice(rows, func(a, b int) bool {
+			for _, col := range order {
+				i := tb.index(col)
+				switch va := rows[a][i].(type) {
+				case string:
+					if vb := rows[b][i].(string); va != vb {
+						return va < vb
+					}
+				case int64:
+					if vb := rows[b][i].(int64); va != vb {
+						return va < vb
+					}
+				}
+			}
+			return false
+		})
+	}
+
+	i := tb.index(m[1])
+	out := &fakeRows{cols: []string{m[1]}}
+	for _, row := range rows {
+		out.rows = append(out.rows, []driver.Value{row[i]})
+	}
+
+	return out, nil
+}
+
+// index returns the position of a column.
+func (tb *fakeTable) index(col string) int {
+	for i, c := range tb.cols {
+		if c == col {
+			return i
+		}
+	}
+	panic("unknown column " + col)
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.cols
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	s := New("postgres://localhost/mqtt", nil)
+	require.NotNil(t, s)
+	require.Equal(t, "postgres://localhost/mqtt", s.dsn)
+	require.Equal(t, defaultDriver, s.opts.Driver)
+	require.Equal(t, defaultPrefix, s.opts.Prefix)
+}
+
+func TestNewOptions(t *testing.T) {
+	s := New("dsn", &Options{Driver: "pgx", Prefix: "broker_"})
+	require.Equal(t, "pgx", s.opts.Driver)
+	require.Equal(t, "broker_", s.opts.Prefix)
+	require.Equal(t, "broker_inflight", s.table(tInflight))
+}
+
+func TestSetInflightTTL(t *testing.T) {
+	s := New("", nil)
+	s.SetInflightTTL(5)
+	require.Equal(t, persistence.InflightTTL{5, 5, 5}, s.inflightTTL)
+
+	s.SetInflightTTLForQoS(1, 2)
+	require.Equal(t, persistence.InflightTTL{5, 2, 5}, s.inflightTTL)
+}
+
+func TestOpenMigrates(t *testing.T) {
+	s, f := openStore(t)
+	require.NotNil(t, s.db)
+	require.Len(t, s.stmts, len(s.queries()))
+
+	for _, tb := range []string{"subscriptions", "inflight", "retained", "clients", "server_info"} {
+		require.Contains(t, f.tables, "mqtt_"+tb)
+	}
+	require.Equal(t, []string{"id", "client", "sequence", "created", "data"}, f.tables["mqtt_inflight"].cols)
+	require.Equal(t, []string{"id", "client_id", "expires", "data"}, f.tables["mqtt_clients"].cols)
+	require.True(t, f.indexes["mqtt_clients_expires"])
+	require.True(t, f.indexes["mqtt_subscriptions_client"])
+	require.True(t, f.indexes["mqtt_inflight_created"])
+	require.True(t, f.indexes["mqtt_inflight_client_sequence"])
+	require.True(t, f.indexes["mqtt_retained_expires"])
+}
+
+func TestOpenExistingTables(t *testing.T) {
+	s, f := openStore(t)
+	require.NoError(t, s.WriteClient(persistence.Client{ID: "cl_mochi", T: persistence.KClient}))
+	s.Close()
+
+	// Opening again keeps the existing tables and their rows.
+	require.NoError(t, s.Open())
+	defer s.Close()
+	require.Len(t, f.tables["mqtt_clients"].rows, 1)
+}
+
+func TestOpenFailure(t *testing.T) {
+	s := New("unknown", &Options{Driver: fakeDriver})
+	require.Error(t, s.Open())
+	require.Nil(t, s.db)
+}
+
+func TestOpenMigrateFailure(t *testing.T) {
+	s, f := newStore()
+	f.fail["CREATE INDEX"] = true
+	err := s.Open()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "migrate")
+	require.Nil(t, s.db)
+}
+
+func TestOpenPrepareFailure(t *testing.T) {
+	s, f := newStore()
+	f.fail["SELECT count(*)"] = true
+	err := s.Open()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "prepare")
+	require.Nil(t, s.db)
+}
+
+func TestClose(t *testing.T) {
+	s, _ := openStore(t)
+	s.Close()
+	require.Nil(t, s.db)
+	require.Nil(t, s.stmts)
+	s.Close() // closing twice is safe.
+}
+
+func TestNotOpen(t *testing.T) {
+	s := New("", nil)
+	require.ErrorIs(t, s.WriteServerInfo(persistence.ServerInfo{}), ErrDBNotOpen)
+	require.ErrorIs(t, s.WriteSubscription(persistence.Subscription{}), ErrDBNotOpen)
+	require.ErrorIs(t, s.WriteInflight(persistence.Message{}), ErrDBNotOpen)
+	require.ErrorIs(t, s.WriteRetained(persistence.Message{}), ErrDBNotOpen)
+	require.ErrorIs(t, s.WriteClient(persistence.Client{}), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteSubscription("a"), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteInflight("a"), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteRetained("a"), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteClient("a"), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteAllInflight(), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteAllRetained(), ErrDBNotOpen)
+	require.ErrorIs(t, s.ClearExpiredInflightAt(1), ErrDBNotOpen)
+	require.ErrorIs(t, s.ClearExpiredRetained(1), ErrDBNotOpen)
+	require.ErrorIs(t, s.ClearExpiredSessions(1), ErrDBNotOpen)
+
+	_, err := s.ReadSubscriptions()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.CountSubscriptions("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.CountInflight("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadInflight()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadRetained()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadClients()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadClient("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadSubscriptionsForClient("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadInflightForClient("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadServerInfo()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.CountRetained()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ListRetainedTopics()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
+func TestWriteAndRetrieveServerInfo(t *testing.T) {
+	s, _ := openStore(t)
+
+	v := persistence.ServerInfo{
+		Info: system.Info{
+			Version: "test",
+			Started: 100,
+		},
+		ID: persistence.KServerInfo,
+	}
+	require.NoError(t, s.WriteServerInfo(v))
+
+	r, err := s.ReadServerInfo()
+	require.NoError(t, err)
+	require.Equal(t, v, r)
+}
+
+func TestReadServerInfoEmpty(t *testing.T) {
+	s, _ := openStore(t)
+	r, err := s.ReadServerInfo()
+	require.NoError(t, err)
+	require.Equal(t, persistence.ServerInfo{}, r)
+}
+
+func TestWriteRetrieveDeleteSubscription(t *testing.T) {
+	s, _ := openStore(t)
+
+	v := persistence.Subscription{
+		ID:     "sub_b:a/b/c",
+		T:      persistence.KSubscription,
+		Client: "b",
+		Filter: "a/b/c",
+		QoS:    1,
+	}
+	require.NoError(t, s.WriteSubscription(v))
+
+	v2 := persistence.Subscription{
+		ID:     "sub_a:d/e/f",
+		T:      persistence.KSubscription,
+		Client: "a",
+		Filter: "d/e/f",
+		QoS:    2,
+	}
+	require.NoError(t, s.WriteSubscription(v2))
+
+	v2.QoS = 0
+	require.NoError(t, s.WriteSubscription(v2)) // upsert.
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Subscription{v2, v}, subs)
+
+	require.NoError(t, s.DeleteSubscription("sub_a:d/e/f"))
+	subs, err = s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Subscription{v}, subs)
+}
+
+func TestWriteRetrieveDeleteClients(t *testing.T) {
+	s, _ := openStore(t)
+
+	v := persistence.Client{
+		ID:       "cl_client1",
+		ClientID: "client1",
+		T:        persistence.KClient,
+		Listener: "tcp1",
+		Username: []byte{'m', 'o', 'c', 'h', 'i'},
+		LWT: persistence.LWT{
+			Topic:   "a/b/c",
+			Message: []byte{'h', 'e', 'l', 'l', 'o'},
+			Qos:     1,
+			Retain:  true,
+			Delay:   5,
+		},
+	}
+	require.NoError(t, s.WriteClient(v))
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Client{v}, clients)
+
+	require.NoError(t, s.DeleteClient("cl_client1"))
+	clients, err = s.ReadClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+}
+
+func TestWriteRetrieveDeleteInflight(t *testing.T) {
+	s, f := openStore(t)
+
+	v := persistence.Message{
+		ID:        "if_client1_1",
+		T:         persistence.KInflight,
+		Client:    "client1",
+		PacketID:  1,
+		TopicName: "a/b/c",
+		Payload:   []byte{'h', 'e', 'l', 'l', 'o'},
+		Created:   200,
+		Sequence:  2,
+	}
+	require.NoError(t, s.WriteInflight(v))
+	require.Equal(t, int64(200), f.tables["mqtt_inflight"].rows["if_client1_1"][3])
+
+	v2 := persistence.Message{
+		ID:        "if_client1_100",
+		T:         persistence.KInflight,
+		Client:    "client1",
+		PacketID:  100,
+		TopicName: "d/e/f",
+		Payload:   []byte{'y', 'e', 's'},
+		Created:   100,
+		Sent:      200,
+		Resends:   1,
+		Sequence:  1,
+	}
+	require.NoError(t, s.WriteInflight(v2))
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Message{v2, v}, msgs)
+
+	require.NoError(t, s.DeleteInflight("if_client1_100"))
+	msgs, err = s.ReadInflight()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Message{v}, msgs)
+}
+
+func TestReadInflightOrder(t *testing.T) {
+	s, _ := openStore(t)
+	for _, v := range []persistence.Message{
+		{ID: "if_b_1", T: persistence.KInflight, Client: "b", Sequence: 4},
+		{ID: "if_a_1", T: persistence.KInflight, Client: "a", Sequence: 3},
+		{ID: "if_a_2", T: persistence.KInflight, Client: "a", Sequence: 1},
+		{ID: "if_b_2", T: persistence.KInflight, Client: "b", Sequence: 2},
+	} {
+		require.NoError(t, s.WriteInflight(v))
+	}
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+
+	var ids []string
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	require.Equal(t, []string{"if_a_2", "if_a_1", "if_b_2", "if_b_1"}, ids)
+}
+
+func TestWriteRetrieveDeleteRetained(t *testing.T) {
+	s, f := openStore(t)
+
+	v := persistence.Message{
+		ID: "ret_d/e/f",
+		T:  persistence.KRetained,
+		FixedHeader: persistence.FixedHeader{
+			Retain: true,
+		},
+		TopicName:      "d/e/f",
+		Payload:        []byte{'h', 'e', 'l', 'l', 'o'},
+		Created:        100,
+		ExpiryInterval: 10,
+	}
+	require.NoError(t, s.WriteRetained(v))
+	require.Equal(t, int64(110), f.tables["mqtt_retained"].rows["ret_d/e/f"][2])
+
+	v2 := persistence.Message{
+		ID: "ret_a/b/c",
+		T:  persistence.KRetained,
+		FixedHeader: persistence.FixedHeader{
+			Retain: true,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte{'y', 'e', 's'},
+	}
+	require.NoError(t, s.WriteRetained(v2))
+	require.Nil(t, f.tables["mqtt_retained"].rows["ret_a/b/c"][2])
+
+	msgs, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Message{v2, v}, msgs)
+
+	n, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	topics, err := s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/b/c", "d/e/f"}, topics)
+
+	require.NoError(t, s.DeleteRetained("ret_a/b/c"))
+	msgs, err = s.ReadRetained()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Message{v}, msgs)
+}
+
+func TestClearExpiredInflightAt(t *testing.T) {
+	s, f := openStore(t)
+	for i, created := range []int64{100, 200, 300} {
+		require.NoError(t, s.WriteInflight(persistence.Message{
+			ID:      fmt.Sprintf("if_%d", i),
+			T:       persistence.KInflight,
+			Created: created,
+		}))
+	}
+
+	s.SetInflightTTL(50)
+	require.NoError(t, s.ClearExpiredInflightAt(300))
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "if_2", msgs[0].ID)
+	require.Contains(t, f.prepared, "DELETE FROM mqtt_inflight WHERE created < $1")
+
+	// messages are never dropped without a ttl.
+	s.SetInflightTTL(0)
+	require.NoError(t, s.ClearExpiredInflightAt(1000))
+	msgs, err = s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+}
+
+func TestClearExpiredInflightQos(t *testing.T) {
+	s, _ := openStore(t)
+	s.SetInflightTTL(10)
+	s.SetInflightTTLForQoS(1, 2)
+
+	for _, m := range []persistence.Message{
+		{ID: "q1", FixedHeader: persistence.FixedHeader{Qos: 1}, Created: 95},
+		{ID: "q2", FixedHeader: persistence.FixedHeader{Qos: 2}, Created: 95},
+		{ID: "rel", FixedHeader: persistence.FixedHeader{Qos: 1}, Phase: persistence.PhaseRelease, Created: 95},
+		{ID: "q1new", FixedHeader: persistence.FixedHeader{Qos: 1}, Created: 99},
+	} {
+		m.T = persistence.KInflight
+		require.NoError(t, s.WriteInflight(m))
+	}
+
+	require.NoError(t, s.ClearExpiredInflightAt(100))
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	ids := make([]string, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	require.ElementsMatch(t, []string{"q2", "rel", "q1new"}, ids)
+}
+
+func TestClearExpiredRetained(t *testing.T) {
+	s, _ := openStore(t)
+	for i, expiry := range []int64{0, 5, 50} {
+		require.NoError(t, s.WriteRetained(persistence.Message{
+			ID:             fmt.Sprintf("ret_%d", i),
+			T:              persistence.KRetained,
+			TopicName:      fmt.Sprintf("a/%d", i),
+			Created:        100,
+			ExpiryInterval: expiry,
+		}))
+	}
+
+	require.NoError(t, s.ClearExpiredRetained(110))
+
+	topics, err := s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/0", "a/2"}, topics)
+}
+
+func TestCountSubscriptionsInflight(t *testing.T) {
+	s, f := openStore(t)
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:c/d", Client: "a", Filter: "c/d", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "b:a/b", Client: "b", Filter: "a/b", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "if_a", Client: "a", T: persistence.KInflight}))
+
+	n, err := s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Contains(t, f.prepared, "SELECT count(*) FROM mqtt_subscriptions WHERE client = $1")
+
+	n, err = s.CountInflight("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = s.CountInflight("b")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestReadForClient(t *testing.T) {
+	s, f := openStore(t)
+	require.NoError(t, s.WriteClient(persistence.Client{ID: "cl_a", ClientID: "a", T: persistence.KClient}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:c/d", Client: "a", Filter: "c/d", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "b:a/b", Client: "b", Filter: "a/b", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "if_a_1", Client: "a", T: persistence.KInflight, Sequence: 2}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "if_a_2", Client: "a", T: persistence.KInflight, Sequence: 1}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "if_b_1", Client: "b", T: persistence.KInflight, Sequence: 3}))
+
+	cl, err := s.ReadClient("cl_a")
+	require.NoError(t, err)
+	require.Equal(t, "a", cl.ClientID)
+	require.Contains(t, f.prepared, "SELECT data FROM mqtt_clients WHERE id = $1")
+
+	_, err = s.ReadClient("cl_b")
+	require.ErrorIs(t, err, persistence.ErrNotFound)
+
+	subs, err := s.ReadSubscriptionsForClient("a")
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.Equal(t, "a:a/b", subs[0].ID)
+
+	msgs, err := s.ReadInflightForClient("a")
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "if_a_2", msgs[0].ID)
+	require.Equal(t, "if_a_1", msgs[1].ID)
+
+	f.fail["SELECT"] = true
+	_, err = s.ReadClient("cl_a")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, persistence.ErrNotFound)
+}
+
+func TestDeleteAllRetained(t *testing.T) {
+	s, f := openStore(t)
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"}))
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_b", T: persistence.KRetained, TopicName: "b"}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "if_a", T: persistence.KInflight}))
+
+	require.NoError(t, s.DeleteAllRetained())
+	require.Contains(t, f.prepared, "DELETE FROM mqtt_retained")
+
+	n, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+}
+
+func TestDeleteAllInflight(t *testing.T) {
+	s, _ := openStore(t)
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "if_a", T: persistence.KInflight}))
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"}))
+
+	require.NoError(t, s.DeleteAllInflight())
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 0)
+
+	n, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestQueryFailure(t *testing.T) {
+	s, f := openStore(t)
+	f.fail["SELECT"] = true
+	f.fail["INSERT"] = true
+
+	_, err := s.ReadInflight()
+	require.Error(t, err)
+	_, err = s.CountRetained()
+	require.Error(t, err)
+	require.Error(t, s.WriteInflight(persistence.Message{ID: "if_1"}))
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	s, _ := openStore(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, s.WriteInflight(persistence.Message{
+				ID:       fmt.Sprintf("if_%02d", i),
+				T:        persistence.KInflight,
+				Client:   "a",
+				Sequence: int64(i),
+			}))
+		}(i)
+	}
+	wg.Wait()
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 20)
+	for i, m := range msgs {
+		require.Equal(t, int64(i), m.Sequence)
+	}
+}
+
+func TestClearExpiredSessions(t *testing.T) {
+	s, f := openStore(t)
+	for _, c := range []persistence.Client{
+		{ID: "cl_a", ClientID: "a", T: persistence.KClient, SessionExpiryInterval: 10, Expires: 100},
+		{ID: "cl_b", ClientID: "b", T: persistence.KClient, SessionExpiryInterval: 10, Expires: 300},
+		{ID: "cl_c", ClientID: "c", T: persistence.KClient, SessionExpiryInterval: 10},
+	} {
+		require.NoError(t, s.WriteClient(c))
+		require.NoError(t, s.WriteSubscription(persistence.Subscription{
+			ID:     "sub_" + c.ClientID + ":a/b/c",
+			T:      persistence.KSubscription,
+			Client: c.ClientID,
+			Filter: "a/b/c",
+		}))
+		require.NoError(t, s.WriteInflight(persistence.Message{
+			ID:      "if_" + c.ClientID + "_1",
+			T:       persistence.KInflight,
+			Client:  c.ClientID,
+			Created: 1000,
+		}))
+	}
+
+	require.NoError(t, s.ClearExpiredSessions(200))
+	require.Equal(t, 1, f.commits)
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "cl_b", clients[0].ID)
+	require.Equal(t, "cl_c", clients[1].ID)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.Equal(t, "b", subs[0].Client)
+	require.Equal(t, "c", subs[1].Client)
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "b", msgs[0].Client)
+	require.Equal(t, "c", msgs[1].Client)
+}
+
+func TestClearExpiredSessionsFailure(t *testing.T) {
+	s, f := openStore(t)
+	require.NoError(t, s.WriteClient(persistence.Client{ID: "cl_a", ClientID: "a", T: persistence.KClient, Expires: 100}))
+
+	f.fail["BEGIN"] = true
+	require.Error(t, s.ClearExpiredSessions(200))
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+}
@@ -0,0 +1,821 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/csymapp/mqtt/server/persistence"
+)
+
+const (
+
+	// defaultAddr is the default address of the redis server.
+	defaultAddr = "localhost:6379"
+
+	// defaultPrefix is the default namespace prefix for all keys.
+	defaultPrefix = "mqtt"
+)
+
+// The key types used to namespace each kind of stored data. Each record is stored
+// at <prefix>:<type>:<id>, and the ids of each type are indexed at <prefix>:<type>.
+const (
+	kSubscription = "sub"
+	kInflight     = "inflight"
+	kRetained     = "retained"
+	kClient       = "client"
+	kServerInfo   = "srv"
+
+	// kRetainedTopics is a hash of retained message ids to topics, so retained
+	// topics can be listed without loading the messages.
+	kRetainedTopics = "retained_topics"
+
+	// kRetainedExpiry is a sorted set of the ids of retained messages with an
+	// expiry interval, scored by the time they expire.
+	kRetainedExpiry = "retained_expiry"
+
+	// kSubscriptionClient and kInflightClient are sets of the ids of the
+	// subscriptions and inflight messages of each client, stored at
+	// <prefix>:<type>:<client id>, so a session can be counted and read
+	// without loading the records of every client.
+	kSubscriptionClient = "sub_client"
+	kInflightClient     = "inflight_client"
+)
+
+var (
+	// ErrDBNotOpen indicates the redis connection has not been opened.
+	ErrDBNotOpen = fmt.Errorf("redis not opened")
+)
+
+// Store is a backend for writing and reading to redis persistent storage.
+// Records are gob-encoded in the same manner as the bolt store.
+//
+// Read methods return records sorted by their ID, matching the bolt store,
+// which iterates its buckets in key order. ReadInflight is also sorted by ID
+// rather than by Created, even though inflight expiry is indexed by Created.
+type Store struct {
+	sync.RWMutex
+	opts        *redis.Options          // options for configuring the redis client.
+	prefix      string                  // the namespace prefix for all keys.
+	db          *redis.Client           // the redis client, which pools its connections.
+	inflightTTL persistence.InflightTTL // the number of seconds an inflight message of each qos should be retained before being dropped.
+}
+
+// New returns a configured instance of the redis store. The address, if set,
+// takes precedence over the Addr of the options.
+func New(addr string, opts *redis.Options) *Store {
+	o := new(redis.Options)
+	if opts != nil {
+		*o = *opts
+	}
+
+	if addr != "" {
+		o.Addr = addr
+	}
+
+	if o.Addr == "" {
+		o.Addr = defaultAddr
+	}
+
+	return &Store{
+		opts:   o,
+		prefix: defaultPrefix,
+	}
+}
+
+// SetPrefix sets the namespace prefix for all keys (default "mqtt"), so that
+// several brokers may share a redis database without sharing their state.
+func (s *Store) SetPrefix(prefix string) {
+	s.prefix = prefix
+}
+
+// SetInflightTTL sets the number of seconds an inflight message should be kept
+// before being dropped, in the event it is not delivered. Unless you have a good reason,
+// you should allow this to be called by the server (in AddStore) instead of directly.
+func (s *Store) SetInflightTTL(seconds int64) {
+	s.inflightTTL = persistence.NewInflightTTL(seconds)
+}
+
+// SetInflightTTLForQoS sets the number of seconds an inflight message of a qos
+// should be kept before being dropped, overriding SetInflightTTL.
+func (s *Store) SetInflightTTLForQoS(qos byte, seconds int64) {
+	s.inflightTTL.Set(qos, seconds)
+}
+
+// Open connects to the redis server and verifies the connection.
+func (s *Store) Open() error {
+	db := redis.NewClient(s.opts)
+	if err := db.Ping(context.Background()).Err(); err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	s.Lock()
+	s.db = db
+	s.Unlock()
+	return nil
+}
+
+// Close closes the redis connection.
+func (s *Store) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.db == nil {
+		return
+	}
+
+	_ = s.db.Close()
+	s.db = nil
+}
+
+// client returns the redis client, or ErrDBNotOpen if the store is not open.
+// Commands issued on a client which has since been closed fail with
+// redis.ErrClosed.
+func (s *Store) client() (*redis.Client, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.db == nil {
+		return nil, ErrDBNotOpen
+	}
+
+	return s.db, nil
+}
+
+// index returns the key of the index for a type of stored data.
+func (s *Store) index(t string) string {
+	return s.prefix + ":" + t
+}
+
+// key returns the namespaced key for a stored record.
+func (s *Store) key(t, id string) string {
+	return s.prefix + ":" + t + ":" + id
+}
+
+// keys returns the namespaced keys for a set of stored records.
+func (s *Store) keys(t string, ids []string) []string {
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, s.key(t, id))
+	}
+
+	return out
+}
+
+// encode gob-encodes a value for storage.
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decode gob-decodes a stored value.
+func decode(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// members converts a list of ids into the members of a set or sorted set.
+func members(ids []string) []interface{} {
+	out := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, id)
+	}
+
+	return out
+}
+
+// multi applies a set of commands as a MULTI/EXEC transaction, so that they are
+// applied atomically by the redis server. The error of any command which failed
+// within the transaction is returned.
+func (s *Store) multi(fn func(pipe redis.Pipeliner)) error {
+	db, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		fn(pipe)
+		return nil
+	})
+
+	return err
+}
+
+// owner returns the client of a stored subscription or inflight message, or
+// an empty string if the record does not exist.
+func (s *Store) owner(t, id string) (string, error) {
+	var v struct {
+		Client string
+	}
+
+	err := s.get(s.key(t, id), &v)
+	if errors.Is(err, persistence.ErrNotFound) {
+		return "", nil
+	}
+
+	return v.Client, err
+}
+
+// owners returns the clients of a set of stored inflight messages, keyed by
+// the id of each message.
+func (s *Store) owners(ids []string) (map[string]string, error) {
+	msgs, err := s.readMessages(kInflight, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]string, len(msgs))
+	for _, m := range msgs {
+		out[m.ID] = m.Client
+	}
+
+	return out, nil
+}
+
+// write stores a record and adds its id to the index set for its type.
+func (s *Store) write(t, id string, v interface{}) error {
+	b, err := encode(v)
+	if err != nil {
+		return err
+	}
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		pipe.Set(context.Background(), s.key(t, id), b, 0)
+		pipe.SAdd(context.Background(), s.index(t), id)
+	})
+}
+
+// delete removes a record and its id from the index set for its type.
+func (s *Store) delete(t, id string) error {
+	return s.multi(func(pipe redis.Pipeliner) {
+		pipe.Del(context.Background(), s.key(t, id))
+		pipe.SRem(context.Background(), s.index(t), id)
+	})
+}
+
+// read loads the records of a type with the given ids, calling fn with the raw
+// value of each.
+func (s *Store) read(t string, ids []string, fn func(b []byte) error) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	db, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	vals, err := db.MGet(context.Background(), s.keys(t, ids)...).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vals {
+		b, ok := v.(string)
+		if !ok {
+			continue // the record was deleted between reading the index and the values.
+		}
+
+		if err := fn([]byte(b)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// get loads a single record, returning persistence.ErrNotFound if it does not exist.
+func (s *Store) get(key string, v interface{}) error {
+	db, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	b, err := db.Get(context.Background(), key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return persistence.ErrNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return decode(b, v)
+}
+
+// setMembers returns the ids indexed in a set.
+func (s *Store) setMembers(key string) ([]string, error) {
+	db, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	return db.SMembers(context.Background(), key).Result()
+}
+
+// rangeMembers returns the ids indexed in a sorted set, in score order.
+func (s *Store) rangeMembers(key string) ([]string, error) {
+	db, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	return db.ZRange(context.Background(), key, 0, -1).Result()
+}
+
+// expiredMembers returns the ids indexed in a sorted set with a score below max.
+func (s *Store) expiredMembers(key string, max int64) ([]string, error) {
+	db, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	return db.ZRangeByScore(context.Background(), key, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(max, 10),
+	}).Result()
+}
+
+// WriteServerInfo writes the server info to the redis instance.
+func (s *Store) WriteServerInfo(v persistence.ServerInfo) error {
+	db, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	b, err := encode(&v)
+	if err != nil {
+		return err
+	}
+
+	return db.Set(context.Background(), s.key(kServerInfo, v.ID), b, 0).Err()
+}
+
+// WriteSubscription writes a single subscription to the redis instance, and
+// adds it to the subscriptions of its client.
+func (s *Store) WriteSubscription(v persistence.Subscription) error {
+	b, err := encode(&v)
+	if err != nil {
+		return err
+	}
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		ctx := context.Background()
+		pipe.Set(ctx, s.key(kSubscription, v.ID), b, 0)
+		pipe.SAdd(ctx, s.index(kSubscription), v.ID)
+		pipe.SAdd(ctx, s.key(kSubscriptionClient, v.Client), v.ID)
+	})
+}
+
+// WriteInflight writes a single inflight message to the redis instance. Inflight
+// messages are indexed in a sorted set scored by their Created time, so that
+// expired messages can be found without scanning every message, and in the
+// inflight messages of their client.
+func (s *Store) WriteInflight(v persistence.Message) error {
+	b, err := encode(&v)
+	if err != nil {
+		return err
+	}
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		ctx := context.Background()
+		pipe.Set(ctx, s.key(kInflight, v.ID), b, 0)
+		pipe.ZAdd(ctx, s.index(kInflight), redis.Z{Score: float64(v.Created), Member: v.ID})
+		pipe.SAdd(ctx, s.key(kInflightClient, v.Client), v.ID)
+	})
+}
+
+// WriteRetained writes a single retained message to the redis instance.
+func (s *Store) WriteRetained(v persistence.Message) error {
+	b, err := encode(&v)
+	if err != nil {
+		return err
+	}
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		ctx := context.Background()
+		pipe.Set(ctx, s.key(kRetained, v.ID), b, 0)
+		pipe.SAdd(ctx, s.index(kRetained), v.ID)
+		pipe.HSet(ctx, s.index(kRetainedTopics), v.ID, v.TopicName)
+		if v.ExpiryInterval > 0 {
+			pipe.ZAdd(ctx, s.index(kRetainedExpiry), redis.Z{Score: float64(v.Created + v.ExpiryInterval), Member: v.ID})
+		} else {
+			pipe.ZRem(ctx, s.index(kRetainedExpiry), v.ID)
+		}
+	})
+}
+
+// WriteClient writes a single client to the redis instance.
+func (s *Store) WriteClient(v persistence.Client) error {
+	return s.write(kClient, v.ID, &v)
+}
+
+// DeleteSubscription deletes a subscription from the redis instance.
+func (s *Store) DeleteSubscription(id string) error {
+	client, err := s.owner(kSubscription, id)
+	if err != nil {
+		return err
+	}
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		ctx := context.Background()
+		pipe.Del(ctx, s.key(kSubscription, id))
+		pipe.SRem(ctx, s.index(kSubscription), id)
+		pipe.SRem(ctx, s.key(kSubscriptionClient, client), id)
+	})
+}
+
+// DeleteClient deletes a client from the redis instance.
+func (s *Store) DeleteClient(id string) error {
+	return s.delete(kClient, id)
+}
+
+// DeleteInflight deletes an inflight message from the redis instance.
+func (s *Store) DeleteInflight(id string) error {
+	client, err := s.owner(kInflight, id)
+	if err != nil {
+		return err
+	}
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		ctx := context.Background()
+		pipe.Del(ctx, s.key(kInflight, id))
+		pipe.ZRem(ctx, s.index(kInflight), id)
+		pipe.SRem(ctx, s.key(kInflightClient, client), id)
+	})
+}
+
+// DeleteRetained deletes a retained message from the redis instance.
+func (s *Store) DeleteRetained(id string) error {
+	return s.multi(func(pipe redis.Pipeliner) {
+		ctx := context.Background()
+		pipe.Del(ctx, s.key(kRetained, id))
+		pipe.SRem(ctx, s.index(kRetained), id)
+		pipe.HDel(ctx, s.index(kRetainedTopics), id)
+		pipe.ZRem(ctx, s.index(kRetainedExpiry), id)
+	})
+}
+
+// CountSubscriptions returns the number of subscriptions of a client in the
+// redis instance, from the size of the subscriptions index of the client.
+func (s *Store) CountSubscriptions(clientID string) (n int, err error) {
+	return s.count(s.key(kSubscriptionClient, clientID))
+}
+
+// CountInflight returns the number of inflight messages of a client in the
+// redis instance, from the size of the inflight index of the client.
+func (s *Store) CountInflight(clientID string) (n int, err error) {
+	return s.count(s.key(kInflightClient, clientID))
+}
+
+// count returns the number of ids indexed in a set.
+func (s *Store) count(key string) (int, error) {
+	db, err := s.client()
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := db.SCard(context.Background(), key).Result()
+	return int(c), err
+}
+
+// DeleteAllInflight deletes all inflight messages from the redis instance,
+// along with their indexes, in a single transaction. The messages are read to
+// find the clients whose indexes should be deleted.
+func (s *Store) DeleteAllInflight() error {
+	ids, err := s.rangeMembers(s.index(kInflight))
+	if err != nil {
+		return err
+	}
+
+	owners, err := s.owners(ids)
+	if err != nil {
+		return err
+	}
+
+	keys := append(s.keys(kInflight, ids), s.index(kInflight))
+	for _, client := range owners {
+		keys = append(keys, s.key(kInflightClient, client))
+	}
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		pipe.Del(context.Background(), keys...)
+	})
+}
+
+// DeleteAllRetained deletes all retained messages from the redis instance,
+// along with their indexes, in a single transaction.
+func (s *Store) DeleteAllRetained() error {
+	ids, err := s.setMembers(s.index(kRetained))
+	if err != nil {
+		return err
+	}
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		pipe.Del(context.Background(), append(s.keys(kRetained, ids),
+			s.index(kRetained), s.index(kRetainedTopics), s.index(kRetainedExpiry))...)
+	})
+}
+
+// CountRetained returns the number of retained messages in the redis instance.
+func (s *Store) CountRetained() (n int, err error) {
+	return s.count(s.index(kRetained))
+}
+
+// ListRetainedTopics returns the topics of the retained messages in the redis
+// instance, sorted by message id, without loading the messages.
+func (s *Store) ListRetainedTopics() (v []string, err error) {
+	db, err := s.client()
+	if err != nil {
+		return v, err
+	}
+
+	topics, err := db.HGetAll(context.Background(), s.index(kRetainedTopics)).Result()
+	if err != nil {
+		return
+	}
+
+	ids := make([]string, 0, len(topics))
+	for id := range topics {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		v = append(v, topics[id])
+	}
+
+	return v, nil
+}
+
+// ReadSubscriptions loads all the subscriptions from the redis instance.
+func (s *Store) ReadSubscriptions() (v []persistence.Subscription, err error) {
+	return s.readSubscriptions(s.index(kSubscription))
+}
+
+// readSubscriptions loads the subscriptions whose ids are in an index set,
+// sorted by ID.
+func (s *Store) readSubscriptions(index string) (v []persistence.Subscription, err error) {
+	ids, err := s.setMembers(index)
+	if err != nil {
+		return
+	}
+
+	err = s.read(kSubscription, ids, func(b []byte) error {
+		var d persistence.Subscription
+		if err := decode(b, &d); err != nil {
+			return err
+		}
+		v = append(v, d)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
+	return v, nil
+}
+
+// ReadSubscriptionsForClient loads the subscriptions of a client from the
+// redis instance, using the subscriptions index of the client.
+func (s *Store) ReadSubscriptionsForClient(clientID string) (v []persistence.Subscription, err error) {
+	return s.readSubscriptions(s.key(kSubscriptionClient, clientID))
+}
+
+// ReadClient loads a single client by its storage key from the redis
+// instance, returning persistence.ErrNotFound if there is no such client.
+func (s *Store) ReadClient(id string) (v persistence.Client, err error) {
+	err = s.get(s.key(kClient, id), &v)
+	return
+}
+
+// ReadClients loads all the clients from the redis instance.
+func (s *Store) ReadClients() (v []persistence.Client, err error) {
+	ids, err := s.setMembers(s.index(kClient))
+	if err != nil {
+		return
+	}
+
+	err = s.read(kClient, ids, func(b []byte) error {
+		var d persistence.Client
+		if err := decode(b, &d); err != nil {
+			return err
+		}
+		v = append(v, d)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
+	return v, nil
+}
+
+// ReadInflight loads all the inflight messages from the redis instance, sorted
+// by client and the order they were stored in.
+func (s *Store) ReadInflight() (v []persistence.Message, err error) {
+	ids, err := s.rangeMembers(s.index(kInflight))
+	if err != nil {
+		return
+	}
+
+	v, err = s.readMessages(kInflight, ids)
+	if err != nil {
+		return
+	}
+
+	persistence.SortInflight(v)
+	return
+}
+
+// ReadInflightForClient loads the inflight messages of a client from the
+// redis instance, using the inflight index of the client, sorted by the order
+// they were stored in.
+func (s *Store) ReadInflightForClient(clientID string) (v []persistence.Message, err error) {
+	ids, err := s.setMembers(s.key(kInflightClient, clientID))
+	if err != nil {
+		return
+	}
+
+	v, err = s.readMessages(kInflight, ids)
+	if err != nil {
+		return
+	}
+
+	persistence.SortInflight(v)
+	return
+}
+
+// ReadRetained loads all the retained messages from the redis instance.
+func (s *Store) ReadRetained() (v []persistence.Message, err error) {
+	ids, err := s.setMembers(s.index(kRetained))
+	if err != nil {
+		return
+	}
+
+	v, err = s.readMessages(kRetained, ids)
+	return
+}
+
+// readMessages loads and decodes messages of a type, sorted by ID.
+func (s *Store) readMessages(t string, ids []string) (v []persistence.Message, err error) {
+	err = s.read(t, ids, func(b []byte) error {
+		var d persistence.Message
+		if err := decode(b, &d); err != nil {
+			return err
+		}
+		v = append(v, d)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
+	return v, nil
+}
+
+// ReadServerInfo loads the server info from the redis instance.
+func (s *Store) ReadServerInfo() (v persistence.ServerInfo, err error) {
+	err = s.get(s.key(kServerInfo, persistence.KServerInfo), &v)
+	if errors.Is(err, persistence.ErrNotFound) {
+		return v, nil
+	}
+
+	return
+}
+
+// ClearExpiredInflightAt deletes any inflight messages which have outlived the
+// inflight ttl of their qos by the provided unix timestamp. The messages which
+// may have expired are found using the Created sorted set index, rather than
+// scanning every inflight message, and are read to check the ttl of their qos
+// and to find the index of their client.
+func (s *Store) ClearExpiredInflightAt(now int64) error {
+	if _, err := s.client(); err != nil {
+		return err
+	}
+
+	expiry, ok := s.inflightTTL.Latest(now)
+	if !ok {
+		return nil
+	}
+
+	ids, err := s.expiredMembers(s.index(kInflight), expiry)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := s.readMessages(kInflight, ids)
+	if err != nil {
+		return err
+	}
+
+	ids = ids[:0]
+	clients := make(map[string][]string)
+	for _, m := range msgs {
+		if s.inflightTTL.Expired(m, now) {
+			ids = append(ids, m.ID)
+			clients[m.Client] = append(clients[m.Client], m.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		ctx := context.Background()
+		pipe.Del(ctx, s.keys(kInflight, ids)...)
+		pipe.ZRem(ctx, s.index(kInflight), members(ids)...)
+		for client, cids := range clients {
+			pipe.SRem(ctx, s.key(kInflightClient, client), members(cids)...)
+		}
+	})
+}
+
+// ClearExpiredRetained deletes any retained messages which expired before the
+// provided unix timestamp, found using the expiry sorted set index.
+func (s *Store) ClearExpiredRetained(now int64) error {
+	ids, err := s.expiredMembers(s.index(kRetainedExpiry), now)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		ctx := context.Background()
+		pipe.Del(ctx, s.keys(kRetained, ids)...)
+		pipe.SRem(ctx, s.index(kRetained), members(ids)...)
+		pipe.HDel(ctx, s.index(kRetainedTopics), ids...)
+		pipe.ZRem(ctx, s.index(kRetainedExpiry), members(ids)...)
+	})
+}
+
+// ClearExpiredSessions deletes the clients whose sessions expired before the
+// provided unix timestamp, along with their subscriptions and inflight
+// messages, which are found using the indexes of each expired client.
+func (s *Store) ClearExpiredSessions(now int64) error {
+	clients, err := s.ReadClients()
+	if err != nil {
+		return err
+	}
+
+	var clientIDs, subIDs, inflightIDs, keys []string
+	for _, c := range clients {
+		if !c.Expired(now) {
+			continue
+		}
+
+		subs, err := s.setMembers(s.key(kSubscriptionClient, c.ClientID))
+		if err != nil {
+			return err
+		}
+
+		msgs, err := s.setMembers(s.key(kInflightClient, c.ClientID))
+		if err != nil {
+			return err
+		}
+
+		clientIDs = append(clientIDs, c.ID)
+		subIDs = append(subIDs, subs...)
+		inflightIDs = append(inflightIDs, msgs...)
+		keys = append(keys, s.key(kSubscriptionClient, c.ClientID), s.key(kInflightClient, c.ClientID))
+	}
+
+	if len(clientIDs) == 0 {
+		return nil
+	}
+
+	keys = append(keys, s.keys(kClient, clientIDs)...)
+	keys = append(keys, s.keys(kSubscription, subIDs)...)
+	keys = append(keys, s.keys(kInflight, inflightIDs)...)
+
+	return s.multi(func(pipe redis.Pipeliner) {
+		ctx := context.Background()
+		pipe.Del(ctx, keys...)
+		pipe.SRem(ctx, s.index(kClient), members(clientIDs)...)
+		if len(subIDs) > 0 {
+			pipe.SRem(ctx, s.index(kSubscription), members(subIDs)...)
+		}
+		if len(inflightIDs) > 0 {
+			pipe.ZRem(ctx, s.index(kInflight), members(inflightIDs)...)
+		}
+	})
+}
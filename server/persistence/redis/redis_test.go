@@ -0,0 +1,738 @@
+package redis
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csymapp/mqtt/server/persistence"
+	"github.com/csymapp/mqtt/server/system"
+)
+
+func openStore(t *testing.T) (*Store, *miniredis.Miniredis) {
+	m := miniredis.RunT(t)
+	s := New(m.Addr(), nil)
+	err := s.Open()
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+	return s, m
+}
+
+// zscore returns the score of a member of a sorted set, failing the test if
+// it is not a member.
+func zscore(t *testing.T, m *miniredis.Miniredis, key, member string) int64 {
+	v, err := m.ZScore(key, member)
+	require.NoError(t, err)
+	return int64(v)
+}
+
+// smembers returns the members of a set, or nil if it does not exist.
+func smembers(m *miniredis.Miniredis, key string) []string {
+	v, _ := m.SMembers(key)
+	return v
+}
+
+// zmembers returns the members of a sorted set, or nil if it does not exist.
+func zmembers(m *miniredis.Miniredis, key string) []string {
+	v, _ := m.ZMembers(key)
+	return v
+}
+
+func TestSatsifies(t *testing.T) {
+	var x persistence.Store
+	x = New("", nil)
+	require.NotNil(t, x)
+}
+
+func TestNew(t *testing.T) {
+	opts := &redis.Options{
+		Addr: "127.0.0.1:6379",
+		DB:   2,
+	}
+	s := New("127.0.0.1:6380", opts)
+	require.NotNil(t, s)
+	require.Equal(t, "127.0.0.1:6380", s.opts.Addr)
+	require.Equal(t, 2, s.opts.DB)
+	require.Equal(t, "127.0.0.1:6379", opts.Addr)
+
+	s = New("", opts)
+	require.Equal(t, "127.0.0.1:6379", s.opts.Addr)
+}
+
+func TestNewNoOpts(t *testing.T) {
+	s := New("", nil)
+	require.NotNil(t, s)
+	require.Equal(t, defaultAddr, s.opts.Addr)
+	require.Equal(t, defaultPrefix, s.prefix)
+}
+
+func TestKeys(t *testing.T) {
+	s := New("", nil)
+	require.Equal(t, "mqtt:sub:a", s.key(kSubscription, "a"))
+	require.Equal(t, "mqtt:inflight:a", s.key(kInflight, "a"))
+	require.Equal(t, "mqtt:inflight", s.index(kInflight))
+
+	s.SetPrefix("test")
+	require.Equal(t, "test:sub:a", s.key(kSubscription, "a"))
+}
+
+func TestSetInflightTTL(t *testing.T) {
+	s := New("", nil)
+	s.SetInflightTTL(5)
+	require.Equal(t, persistence.InflightTTL{5, 5, 5}, s.inflightTTL)
+
+	s.SetInflightTTLForQoS(1, 2)
+	require.Equal(t, persistence.InflightTTL{5, 2, 5}, s.inflightTTL)
+}
+
+func TestOpen(t *testing.T) {
+	s, _ := openStore(t)
+	require.NotNil(t, s.db)
+}
+
+func TestOpenFailure(t *testing.T) {
+	m := miniredis.RunT(t)
+	addr := m.Addr()
+	m.Close()
+
+	s := New(addr, &redis.Options{MaxRetries: -1})
+	err := s.Open()
+	require.Error(t, err)
+	require.Nil(t, s.db)
+}
+
+func TestOpenAuth(t *testing.T) {
+	m := miniredis.RunT(t)
+	m.RequireAuth("secret")
+
+	s := New(m.Addr(), &redis.Options{Password: "secret", DB: 2})
+	err := s.Open()
+	require.NoError(t, err)
+	s.Close()
+
+	s = New(m.Addr(), &redis.Options{Password: "wrong"})
+	err = s.Open()
+	require.Error(t, err)
+}
+
+func TestCloseNotOpen(t *testing.T) {
+	s := New("", nil)
+	s.Close()
+	require.Nil(t, s.db)
+}
+
+func TestWriteAndRetrieveServerInfo(t *testing.T) {
+	s, _ := openStore(t)
+
+	v := system.Info{
+		Version: "test",
+		Started: 100,
+	}
+	err := s.WriteServerInfo(persistence.ServerInfo{
+		Info: v,
+		ID:   persistence.KServerInfo,
+	})
+	require.NoError(t, err)
+
+	r, err := s.ReadServerInfo()
+	require.NoError(t, err)
+	require.Equal(t, v.Version, r.Version)
+	require.Equal(t, v.Started, r.Started)
+}
+
+func TestReadServerInfoEmpty(t *testing.T) {
+	s, _ := openStore(t)
+	r, err := s.ReadServerInfo()
+	require.NoError(t, err)
+	require.Equal(t, "", r.ID)
+}
+
+func TestWriteRetrieveDeleteSubscription(t *testing.T) {
+	s, m := openStore(t)
+
+	v := persistence.Subscription{
+		ID:     "test:a/b/c",
+		Client: "test",
+		Filter: "a/b/c",
+		QoS:    1,
+		T:      persistence.KSubscription,
+	}
+	err := s.WriteSubscription(v)
+	require.NoError(t, err)
+	require.True(t, m.Exists("mqtt:sub:test:a/b/c"))
+
+	v2 := persistence.Subscription{
+		ID:     "test:d/e/f",
+		Client: "test",
+		Filter: "d/e/f",
+		QoS:    2,
+		T:      persistence.KSubscription,
+	}
+	err = s.WriteSubscription(v2)
+	require.NoError(t, err)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Subscription{v, v2}, subs)
+
+	err = s.DeleteSubscription("test:d/e/f")
+	require.NoError(t, err)
+
+	subs, err = s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Subscription{v}, subs)
+}
+
+func TestWriteRetrieveDeleteClient(t *testing.T) {
+	s, _ := openStore(t)
+
+	v := persistence.Client{
+		ID:       "cl_client1",
+		ClientID: "client1",
+		T:        persistence.KClient,
+		Listener: "tcp1",
+		Username: []byte{'m', 'o', 'c', 'h', 'i'},
+		LWT: persistence.LWT{
+			Topic:   "a/b/c",
+			Message: []byte{'h', 'e', 'l', 'l', 'o'},
+			Qos:     1,
+			Retain:  true,
+		},
+	}
+	err := s.WriteClient(v)
+	require.NoError(t, err)
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Client{v}, clients)
+
+	err = s.DeleteClient("cl_client1")
+	require.NoError(t, err)
+
+	clients, err = s.ReadClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+}
+
+func TestWriteRetrieveDeleteInflight(t *testing.T) {
+	s, m := openStore(t)
+
+	v := persistence.Message{
+		ID:        "client1_if_0",
+		T:         persistence.KInflight,
+		PacketID:  0,
+		TopicName: "a/b/c",
+		Payload:   []byte{'h', 'e', 'l', 'l', 'o'},
+		Created:   200,
+	}
+	err := s.WriteInflight(v)
+	require.NoError(t, err)
+	require.Equal(t, int64(200), zscore(t, m, "mqtt:inflight", "client1_if_0"))
+
+	v2 := persistence.Message{
+		ID:        "client1_if_100",
+		T:         persistence.KInflight,
+		PacketID:  100,
+		TopicName: "d/e/f",
+		Payload:   []byte{'y', 'e', 's'},
+		Created:   100,
+	}
+	err = s.WriteInflight(v2)
+	require.NoError(t, err)
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Message{v, v2}, msgs)
+
+	err = s.DeleteInflight("client1_if_100")
+	require.NoError(t, err)
+	require.NotContains(t, zmembers(m, "mqtt:inflight"), "client1_if_100")
+
+	msgs, err = s.ReadInflight()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Message{v}, msgs)
+}
+
+func TestWriteRetrieveDeleteRetained(t *testing.T) {
+	s, _ := openStore(t)
+
+	v := persistence.Message{
+		ID: "client1_ret_200",
+		T:  persistence.KRetained,
+		FixedHeader: persistence.FixedHeader{
+			Retain: true,
+		},
+		PacketID:  200,
+		TopicName: "a/b/c",
+		Payload:   []byte{'h', 'e', 'l', 'l', 'o'},
+	}
+	err := s.WriteRetained(v)
+	require.NoError(t, err)
+
+	msgs, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Equal(t, []persistence.Message{v}, msgs)
+
+	err = s.DeleteRetained("client1_ret_200")
+	require.NoError(t, err)
+
+	msgs, err = s.ReadRetained()
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestCountListRetained(t *testing.T) {
+	s, _ := openStore(t)
+
+	n, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	topics, err := s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Empty(t, topics)
+
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_b", T: persistence.KRetained, TopicName: "b"}))
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_a/c", T: persistence.KRetained, TopicName: "a/c"}))
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_b", T: persistence.KRetained, TopicName: "b"}))
+
+	n, err = s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	topics, err = s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/c", "b"}, topics)
+
+	require.NoError(t, s.DeleteRetained("ret_b"))
+
+	n, err = s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	topics, err = s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/c"}, topics)
+}
+
+func TestReadInflightOrder(t *testing.T) {
+	s, _ := openStore(t)
+	for _, v := range []persistence.Message{
+		{ID: "if_b_1", T: persistence.KInflight, Client: "b", Sequence: 4},
+		{ID: "if_a_1", T: persistence.KInflight, Client: "a", Sequence: 3},
+		{ID: "if_a_2", T: persistence.KInflight, Client: "a", Sequence: 1},
+		{ID: "if_b_2", T: persistence.KInflight, Client: "b", Sequence: 2},
+	} {
+		require.NoError(t, s.WriteInflight(v))
+	}
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+
+	var ids []string
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	require.Equal(t, []string{"if_a_2", "if_a_1", "if_b_2", "if_b_1"}, ids)
+}
+
+func TestClearExpiredInflightAt(t *testing.T) {
+	s, m := openStore(t)
+
+	n := int64(1000)
+	for i, created := range []int64{n - 10, n - 1, n, n + 1, 0} {
+		err := s.WriteInflight(persistence.Message{
+			ID:      "i" + strconv.Itoa(i),
+			T:       persistence.KInflight,
+			Client:  "a",
+			Created: created,
+		})
+		require.NoError(t, err)
+	}
+
+	s.SetInflightTTL(5)
+	err := s.ClearExpiredInflightAt(n + 5)
+	require.NoError(t, err)
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "i2", msgs[0].ID)
+	require.Equal(t, "i3", msgs[1].ID)
+	require.False(t, m.Exists("mqtt:inflight:i0"))
+	require.Len(t, zmembers(m, "mqtt:inflight"), 2)
+	require.ElementsMatch(t, []string{"i2", "i3"}, smembers(m, "mqtt:inflight_client:a"))
+
+	err = s.ClearExpiredInflightAt(0)
+	require.NoError(t, err)
+
+	// messages are never dropped without a ttl.
+	s.SetInflightTTL(0)
+	require.NoError(t, s.ClearExpiredInflightAt(n+100))
+	require.Len(t, zmembers(m, "mqtt:inflight"), 2)
+}
+
+func TestClearExpiredInflightQos(t *testing.T) {
+	s, m := openStore(t)
+	s.SetInflightTTL(10)
+	s.SetInflightTTLForQoS(1, 2)
+
+	n := int64(1000)
+	for _, m := range []persistence.Message{
+		{ID: "q1", FixedHeader: persistence.FixedHeader{Qos: 1}, Created: n - 5},
+		{ID: "q2", FixedHeader: persistence.FixedHeader{Qos: 2}, Created: n - 5},
+		{ID: "rel", FixedHeader: persistence.FixedHeader{Qos: 1}, Phase: persistence.PhaseRelease, Created: n - 5},
+		{ID: "q1new", FixedHeader: persistence.FixedHeader{Qos: 1}, Created: n - 1},
+	} {
+		m.T = persistence.KInflight
+		require.NoError(t, s.WriteInflight(m))
+	}
+
+	require.NoError(t, s.ClearExpiredInflightAt(n))
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+	require.Equal(t, "q1new", msgs[0].ID)
+	require.Equal(t, "q2", msgs[1].ID)
+	require.Equal(t, "rel", msgs[2].ID)
+	require.False(t, m.Exists("mqtt:inflight:q1"))
+	require.Len(t, zmembers(m, "mqtt:inflight"), 3)
+}
+
+func TestClearExpiredRetained(t *testing.T) {
+	s, m := openStore(t)
+
+	n := int64(1000)
+	for _, m := range []persistence.Message{
+		{ID: "ret_a", TopicName: "a", Created: n - 10, ExpiryInterval: 5},
+		{ID: "ret_b", TopicName: "b", Created: n - 10, ExpiryInterval: 20},
+		{ID: "ret_c", TopicName: "c", Created: n - 10},
+	} {
+		m.T = persistence.KRetained
+		require.NoError(t, s.WriteRetained(m))
+	}
+	require.Len(t, zmembers(m, "mqtt:retained_expiry"), 2)
+
+	// Rewriting a message without an expiry removes it from the expiry index.
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_b", T: persistence.KRetained, TopicName: "b"}))
+	require.Len(t, zmembers(m, "mqtt:retained_expiry"), 1)
+
+	err := s.ClearExpiredRetained(n)
+	require.NoError(t, err)
+
+	msgs, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "ret_b", msgs[0].ID)
+	require.Equal(t, "ret_c", msgs[1].ID)
+	require.False(t, m.Exists("mqtt:retained:ret_a"))
+	require.Empty(t, m.HGet("mqtt:retained_topics", "ret_a"))
+	require.Len(t, zmembers(m, "mqtt:retained_expiry"), 0)
+
+	err = s.ClearExpiredRetained(n)
+	require.NoError(t, err)
+}
+
+func TestCountSubscriptionsInflight(t *testing.T) {
+	s, _ := openStore(t)
+
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:c/d", Client: "a", Filter: "c/d", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "b:a/b", Client: "b", Filter: "a/b", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "i1", Client: "a", T: persistence.KInflight}))
+
+	n, err := s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	n, err = s.CountInflight("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = s.CountInflight("b")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	require.NoError(t, s.DeleteSubscription("a:c/d"))
+	require.NoError(t, s.DeleteInflight("i1"))
+	require.NoError(t, s.DeleteSubscription("missing"))
+	require.NoError(t, s.DeleteInflight("missing"))
+
+	n, err = s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = s.CountInflight("a")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = s.CountSubscriptions("b")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestCountUsesClientIndex(t *testing.T) {
+	s, m := openStore(t)
+
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "i1", Client: "a", T: persistence.KInflight}))
+	require.Equal(t, []string{"a:a/b"}, smembers(m, "mqtt:sub_client:a"))
+	require.Equal(t, []string{"i1"}, smembers(m, "mqtt:inflight_client:a"))
+
+	// the counts are read from the client indexes, without the records.
+	m.Del("mqtt:sub:a:a/b")
+	m.Del("mqtt:inflight:i1")
+
+	n, err := s.CountSubscriptions("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = s.CountInflight("a")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestReadForClient(t *testing.T) {
+	s, _ := openStore(t)
+
+	require.NoError(t, s.WriteClient(persistence.Client{ID: "cl_a", ClientID: "a", T: persistence.KClient}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "b:a/b", Client: "b", Filter: "a/b", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "i1", Client: "a", T: persistence.KInflight, Sequence: 2}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "i2", Client: "a", T: persistence.KInflight, Sequence: 1}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "i3", Client: "b", T: persistence.KInflight, Sequence: 3}))
+
+	cl, err := s.ReadClient("cl_a")
+	require.NoError(t, err)
+	require.Equal(t, "a", cl.ClientID)
+
+	_, err = s.ReadClient("cl_b")
+	require.ErrorIs(t, err, persistence.ErrNotFound)
+
+	subs, err := s.ReadSubscriptionsForClient("a")
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "a:a/b", subs[0].ID)
+
+	msgs, err := s.ReadInflightForClient("a")
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "i2", msgs[0].ID)
+	require.Equal(t, "i1", msgs[1].ID)
+
+	subs, err = s.ReadSubscriptionsForClient("c")
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	msgs, err = s.ReadInflightForClient("c")
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestReadForClientUsesClientIndex(t *testing.T) {
+	s, m := openStore(t)
+
+	require.NoError(t, s.WriteSubscription(persistence.Subscription{ID: "a:a/b", Client: "a", Filter: "a/b", T: persistence.KSubscription}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "i1", Client: "a", T: persistence.KInflight}))
+
+	// the records of the client are found without the indexes of all records.
+	m.Del("mqtt:sub")
+	m.Del("mqtt:inflight")
+
+	subs, err := s.ReadSubscriptionsForClient("a")
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	msgs, err := s.ReadInflightForClient("a")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+}
+
+func TestDeleteAllRetained(t *testing.T) {
+	s, m := openStore(t)
+
+	for _, m := range []persistence.Message{
+		{ID: "ret_a", TopicName: "a", Created: 100, ExpiryInterval: 5},
+		{ID: "ret_b", TopicName: "b"},
+	} {
+		m.T = persistence.KRetained
+		require.NoError(t, s.WriteRetained(m))
+	}
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "i1", T: persistence.KInflight}))
+
+	err := s.DeleteAllRetained()
+	require.NoError(t, err)
+
+	msgs, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, msgs, 0)
+	require.False(t, m.Exists("mqtt:retained:ret_a"))
+	require.False(t, m.Exists("mqtt:retained"))
+	require.False(t, m.Exists("mqtt:retained_topics"))
+	require.False(t, m.Exists("mqtt:retained_expiry"))
+
+	inflight, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+
+	err = s.DeleteAllRetained()
+	require.NoError(t, err)
+}
+
+func TestDeleteAllInflight(t *testing.T) {
+	s, m := openStore(t)
+
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "i1", T: persistence.KInflight, Client: "a", Created: 1}))
+	require.NoError(t, s.WriteInflight(persistence.Message{ID: "i2", T: persistence.KInflight, Client: "b", Created: 2}))
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"}))
+
+	err := s.DeleteAllInflight()
+	require.NoError(t, err)
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 0)
+	require.False(t, m.Exists("mqtt:inflight:i1"))
+	require.False(t, m.Exists("mqtt:inflight"))
+	require.False(t, m.Exists("mqtt:inflight_client:a"))
+	require.False(t, m.Exists("mqtt:inflight_client:b"))
+
+	retained, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+}
+
+func TestNoDB(t *testing.T) {
+	s := New("", nil)
+
+	require.ErrorIs(t, s.WriteServerInfo(persistence.ServerInfo{}), ErrDBNotOpen)
+	require.ErrorIs(t, s.WriteSubscription(persistence.Subscription{}), ErrDBNotOpen)
+	require.ErrorIs(t, s.WriteClient(persistence.Client{}), ErrDBNotOpen)
+	require.ErrorIs(t, s.WriteInflight(persistence.Message{}), ErrDBNotOpen)
+	require.ErrorIs(t, s.WriteRetained(persistence.Message{}), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteSubscription("a"), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteClient("a"), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteInflight("a"), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteRetained("a"), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteAllInflight(), ErrDBNotOpen)
+	require.ErrorIs(t, s.DeleteAllRetained(), ErrDBNotOpen)
+	require.ErrorIs(t, s.ClearExpiredInflightAt(1), ErrDBNotOpen)
+	require.ErrorIs(t, s.ClearExpiredRetained(1), ErrDBNotOpen)
+
+	_, err := s.ReadServerInfo()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.CountSubscriptions("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.CountInflight("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadSubscriptions()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadClients()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadClient("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadSubscriptionsForClient("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadInflight()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadInflightForClient("a")
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ReadRetained()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.CountRetained()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+	_, err = s.ListRetainedTopics()
+	require.ErrorIs(t, err, ErrDBNotOpen)
+}
+
+func TestTransactionError(t *testing.T) {
+	s, m := openStore(t)
+
+	// the HSET of the topic fails within the transaction, as the key holds
+	// the wrong type of value.
+	require.NoError(t, m.Set("mqtt:retained_topics", "a"))
+	err := s.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"})
+	require.Error(t, err)
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	s, _ := openStore(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = s.WriteRetained(persistence.Message{ID: "ret_" + strconv.Itoa(i), T: persistence.KRetained})
+			_, _ = s.ReadRetained()
+		}(i)
+	}
+
+	s.Close()
+	wg.Wait()
+
+	require.ErrorIs(t, s.WriteRetained(persistence.Message{ID: "a", T: persistence.KRetained}), ErrDBNotOpen)
+	require.NoError(t, s.Open())
+	require.NoError(t, s.WriteRetained(persistence.Message{ID: "a", T: persistence.KRetained}))
+}
+
+func TestClearExpiredSessions(t *testing.T) {
+	s, m := openStore(t)
+	for _, c := range []persistence.Client{
+		{ID: "cl_a", ClientID: "a", T: persistence.KClient, SessionExpiryInterval: 10, Expires: 100},
+		{ID: "cl_b", ClientID: "b", T: persistence.KClient, SessionExpiryInterval: 10, Expires: 300},
+		{ID: "cl_c", ClientID: "c", T: persistence.KClient, SessionExpiryInterval: 10},
+	} {
+		require.NoError(t, s.WriteClient(c))
+		require.NoError(t, s.WriteSubscription(persistence.Subscription{
+			ID:     "sub_" + c.ClientID + ":a/b/c",
+			T:      persistence.KSubscription,
+			Client: c.ClientID,
+			Filter: "a/b/c",
+		}))
+		require.NoError(t, s.WriteInflight(persistence.Message{
+			ID:      "if_" + c.ClientID + "_1",
+			T:       persistence.KInflight,
+			Client:  c.ClientID,
+			Created: 1000,
+		}))
+	}
+
+	require.NoError(t, s.ClearExpiredSessions(200))
+	require.False(t, m.Exists("mqtt:client:cl_a"))
+	require.NotContains(t, smembers(m, "mqtt:client"), "cl_a")
+	require.NotContains(t, smembers(m, "mqtt:sub"), "sub_a:a/b/c")
+	require.NotContains(t, zmembers(m, "mqtt:inflight"), "if_a_1")
+	require.False(t, m.Exists("mqtt:sub_client:a"))
+	require.False(t, m.Exists("mqtt:inflight_client:a"))
+	require.True(t, m.Exists("mqtt:sub_client:b"))
+	require.True(t, m.Exists("mqtt:inflight_client:b"))
+
+	clients, err := s.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "cl_b", clients[0].ID)
+	require.Equal(t, "cl_c", clients[1].ID)
+
+	subs, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.Equal(t, "b", subs[0].Client)
+	require.Equal(t, "c", subs[1].Client)
+
+	msgs, err := s.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "b", msgs[0].Client)
+	require.Equal(t, "c", msgs[1].Client)
+}
+
+func TestClearExpiredSessionsNoDB(t *testing.T) {
+	s := New("", nil)
+	require.ErrorIs(t, s.ClearExpiredSessions(1), ErrDBNotOpen)
+}
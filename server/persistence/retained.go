@@ -0,0 +1,98 @@
+package persistence
+
+// RetainedStore is the part of a Store which holds retained messages. It can
+// be used to keep retained messages in a different backend to sessions.
+type RetainedStore interface {
+	Open() error
+	Close()
+
+	ReadRetained() (v []Message, err error)
+	WriteRetained(v Message) error
+	DeleteRetained(id string) error
+	DeleteAllRetained() error
+	CountRetained() (n int, err error)
+	ListRetainedTopics() (v []string, err error)
+	ClearExpiredRetained(now int64) error
+}
+
+// splitRetained is a Store which keeps retained messages in a RetainedStore,
+// and everything else in another Store.
+type splitRetained struct {
+	Store                  // the store holding everything but retained messages.
+	retained RetainedStore // the store holding retained messages.
+}
+
+// SplitRetained returns a Store which routes the retained message methods to
+// retained, and all other methods to store. Opening or closing the returned
+// store opens or closes both. If retained is nil, store is returned unwrapped.
+func SplitRetained(store Store, retained RetainedStore) Store {
+	if retained == nil {
+		return store
+	}
+
+	return &splitRetained{
+		Store:    store,
+		retained: retained,
+	}
+}
+
+// Open opens the session store and then the retained store.
+func (s *splitRetained) Open() error {
+	if err := s.Store.Open(); err != nil {
+		return err
+	}
+
+	return s.retained.Open()
+}
+
+// Close closes both stores.
+func (s *splitRetained) Close() {
+	s.retained.Close()
+	s.Store.Close()
+}
+
+// IsOpen returns false if either store reports that it is not open.
+func (s *splitRetained) IsOpen() bool {
+	for _, st := range []interface{}{s.Store, s.retained} {
+		if o, ok := st.(interface{ IsOpen() bool }); ok && !o.IsOpen() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ReadRetained loads all the retained messages from the retained store.
+func (s *splitRetained) ReadRetained() (v []Message, err error) {
+	return s.retained.ReadRetained()
+}
+
+// WriteRetained writes a single retained message to the retained store.
+func (s *splitRetained) WriteRetained(v Message) error {
+	return s.retained.WriteRetained(v)
+}
+
+// DeleteRetained deletes a retained message from the retained store.
+func (s *splitRetained) DeleteRetained(id string) error {
+	return s.retained.DeleteRetained(id)
+}
+
+// DeleteAllRetained deletes all retained messages from the retained store.
+func (s *splitRetained) DeleteAllRetained() error {
+	return s.retained.DeleteAllRetained()
+}
+
+// CountRetained returns the number of messages in the retained store.
+func (s *splitRetained) CountRetained() (n int, err error) {
+	return s.retained.CountRetained()
+}
+
+// ListRetainedTopics returns the topics of the messages in the retained store.
+func (s *splitRetained) ListRetainedTopics() (v []string, err error) {
+	return s.retained.ListRetainedTopics()
+}
+
+// ClearExpiredRetained deletes the expired messages in the retained store.
+func (s *splitRetained) ClearExpiredRetained(now int64) error {
+	return s.retained.ClearExpiredRetained(now)
+}
@@ -0,0 +1,96 @@
+package persistence
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// openStore is a store which reports whether it is open.
+type openStore struct {
+	MockStore
+	open bool
+}
+
+func (s *openStore) IsOpen() bool {
+	return s.open
+}
+
+func TestSplitRetainedNil(t *testing.T) {
+	s := new(MockStore)
+	require.Same(t, s, SplitRetained(s, nil))
+}
+
+func TestSplitRetained(t *testing.T) {
+	main := &MockStore{Fail: map[string]bool{
+		"read_retained":       true,
+		"write_retained":      true,
+		"delete_retained":     true,
+		"delete_all_retained": true,
+		"count_retained":      true,
+		"list_retained":       true,
+	}}
+	retained := &MockStore{Fail: map[string]bool{
+		"read_clients": true,
+	}}
+	s := SplitRetained(main, retained)
+
+	_, err := s.ReadRetained()
+	require.NoError(t, err)
+	require.NoError(t, s.WriteRetained(Message{}))
+	require.NoError(t, s.DeleteRetained("a"))
+	require.NoError(t, s.DeleteAllRetained())
+	n, err := s.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	topics, err := s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/b/c"}, topics)
+
+	_, err = s.ReadClients()
+	require.NoError(t, err)
+
+	retained.Fail = map[string]bool{"clear_expired_retained": true}
+	require.Error(t, s.ClearExpiredRetained(1))
+}
+
+func TestSplitRetainedOpenClose(t *testing.T) {
+	main := new(MockStore)
+	retained := new(MockStore)
+	s := SplitRetained(main, retained)
+
+	require.NoError(t, s.Open())
+	require.True(t, main.Opened)
+	require.True(t, retained.Opened)
+
+	s.Close()
+	require.True(t, main.Closed)
+	require.True(t, retained.Closed)
+}
+
+func TestSplitRetainedOpenFailure(t *testing.T) {
+	main := &MockStore{FailOpen: true}
+	retained := new(MockStore)
+	require.Error(t, SplitRetained(main, retained).Open())
+	require.False(t, retained.Opened)
+
+	main = new(MockStore)
+	retained = &MockStore{FailOpen: true}
+	require.Error(t, SplitRetained(main, retained).Open())
+}
+
+func TestSplitRetainedIsOpen(t *testing.T) {
+	main := &openStore{open: true}
+	retained := &openStore{open: true}
+	s := SplitRetained(main, retained).(interface{ IsOpen() bool })
+	require.True(t, s.IsOpen())
+
+	retained.open = false
+	require.False(t, s.IsOpen())
+
+	retained.open = true
+	main.open = false
+	require.False(t, s.IsOpen())
+
+	require.True(t, SplitRetained(new(MockStore), new(MockStore)).(interface{ IsOpen() bool }).IsOpen())
+}
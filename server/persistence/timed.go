@@ -0,0 +1,244 @@
+package persistence
+
+import (
+	"sync"
+	"time"
+)
+
+// OpStats is the number of calls made to a Store method, and the total time
+// they took.
+type OpStats struct {
+	Count int64         // the number of calls.
+	Time  time.Duration // the total time taken by the calls.
+}
+
+// Timed is a Store which records how long each call to the methods of the
+// store it wraps takes, so that a slow backend can be seen in metrics.
+type Timed struct {
+	store Store              // the store being timed.
+	stats map[string]OpStats // the calls made to each method, keyed on method name.
+	mu    sync.Mutex         // a mutex for the stats.
+}
+
+// NewTimed returns a Timed store which wraps store.
+func NewTimed(store Store) *Timed {
+	return &Timed{
+		store: store,
+		stats: map[string]OpStats{},
+	}
+}
+
+// Stats returns the calls made to each method of the store which has been
+// called, keyed on method name (eg. "WriteInflight").
+func (s *Timed) Stats() map[string]OpStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make(map[string]OpStats, len(s.stats))
+	for op, st := range s.stats {
+		stats[op] = st
+	}
+
+	return stats
+}
+
+// since notes a call to a method which began at start.
+func (s *Timed) since(op string, start time.Time) {
+	d := time.Since(start)
+	s.mu.Lock()
+	st := s.stats[op]
+	st.Count++
+	st.Time += d
+	s.stats[op] = st
+	s.mu.Unlock()
+}
+
+// Open opens the wrapped store.
+func (s *Timed) Open() error {
+	return s.store.Open()
+}
+
+// Close closes the wrapped store.
+func (s *Timed) Close() {
+	s.store.Close()
+}
+
+// IsOpen returns false if the wrapped store reports that it is not open.
+func (s *Timed) IsOpen() bool {
+	if o, ok := s.store.(interface{ IsOpen() bool }); ok {
+		return o.IsOpen()
+	}
+
+	return true
+}
+
+// SetInflightTTL sets the inflight ttl of the wrapped store.
+func (s *Timed) SetInflightTTL(seconds int64) {
+	s.store.SetInflightTTL(seconds)
+}
+
+// SetInflightTTLForQoS sets the inflight ttl of a qos of the wrapped store.
+func (s *Timed) SetInflightTTLForQoS(qos byte, seconds int64) {
+	s.store.SetInflightTTLForQoS(qos, seconds)
+}
+
+// ReadSubscriptions loads all the subscriptions from the wrapped store.
+func (s *Timed) ReadSubscriptions() (v []Subscription, err error) {
+	defer s.since("ReadSubscriptions", time.Now())
+	return s.store.ReadSubscriptions()
+}
+
+// ReadSubscriptionsForClient loads the subscriptions of a client from the
+// wrapped store.
+func (s *Timed) ReadSubscriptionsForClient(clientID string) (v []Subscription, err error) {
+	defer s.since("ReadSubscriptionsForClient", time.Now())
+	return s.store.ReadSubscriptionsForClient(clientID)
+}
+
+// WriteSubscription writes a single subscription to the wrapped store.
+func (s *Timed) WriteSubscription(v Subscription) error {
+	defer s.since("WriteSubscription", time.Now())
+	return s.store.WriteSubscription(v)
+}
+
+// DeleteSubscription deletes a subscription from the wrapped store.
+func (s *Timed) DeleteSubscription(id string) error {
+	defer s.since("DeleteSubscription", time.Now())
+	return s.store.DeleteSubscription(id)
+}
+
+// CountSubscriptions returns the number of subscriptions of a client in the
+// wrapped store.
+func (s *Timed) CountSubscriptions(clientID string) (n int, err error) {
+	defer s.since("CountSubscriptions", time.Now())
+	return s.store.CountSubscriptions(clientID)
+}
+
+// ReadClients loads all the clients from the wrapped store.
+func (s *Timed) ReadClients() (v []Client, err error) {
+	defer s.since("ReadClients", time.Now())
+	return s.store.ReadClients()
+}
+
+// ReadClient loads a single client from the wrapped store.
+func (s *Timed) ReadClient(id string) (v Client, err error) {
+	defer s.since("ReadClient", time.Now())
+	return s.store.ReadClient(id)
+}
+
+// WriteClient writes a single client to the wrapped store.
+func (s *Timed) WriteClient(v Client) error {
+	defer s.since("WriteClient", time.Now())
+	return s.store.WriteClient(v)
+}
+
+// DeleteClient deletes a client from the wrapped store.
+func (s *Timed) DeleteClient(id string) error {
+	defer s.since("DeleteClient", time.Now())
+	return s.store.DeleteClient(id)
+}
+
+// ReadInflight loads all the inflight messages from the wrapped store.
+func (s *Timed) ReadInflight() (v []Message, err error) {
+	defer s.since("ReadInflight", time.Now())
+	return s.store.ReadInflight()
+}
+
+// ReadInflightForClient loads the inflight messages of a client from the
+// wrapped store.
+func (s *Timed) ReadInflightForClient(clientID string) (v []Message, err error) {
+	defer s.since("ReadInflightForClient", time.Now())
+	return s.store.ReadInflightForClient(clientID)
+}
+
+// WriteInflight writes a single inflight message to the wrapped store.
+func (s *Timed) WriteInflight(v Message) error {
+	defer s.since("WriteInflight", time.Now())
+	return s.store.WriteInflight(v)
+}
+
+// DeleteInflight deletes an inflight message from the wrapped store.
+func (s *Timed) DeleteInflight(id string) error {
+	defer s.since("DeleteInflight", time.Now())
+	return s.store.DeleteInflight(id)
+}
+
+// DeleteAllInflight deletes all inflight messages from the wrapped store.
+func (s *Timed) DeleteAllInflight() error {
+	defer s.since("DeleteAllInflight", time.Now())
+	return s.store.DeleteAllInflight()
+}
+
+// CountInflight returns the number of inflight messages of a client in the
+// wrapped store.
+func (s *Timed) CountInflight(clientID string) (n int, err error) {
+	defer s.since("CountInflight", time.Now())
+	return s.store.CountInflight(clientID)
+}
+
+// ClearExpiredInflightAt deletes the expired inflight messages in the wrapped store.
+func (s *Timed) ClearExpiredInflightAt(now int64) error {
+	defer s.since("ClearExpiredInflightAt", time.Now())
+	return s.store.ClearExpiredInflightAt(now)
+}
+
+// ReadServerInfo loads the server info from the wrapped store.
+func (s *Timed) ReadServerInfo() (v ServerInfo, err error) {
+	defer s.since("ReadServerInfo", time.Now())
+	return s.store.ReadServerInfo()
+}
+
+// WriteServerInfo writes the server info to the wrapped store.
+func (s *Timed) WriteServerInfo(v ServerInfo) error {
+	defer s.since("WriteServerInfo", time.Now())
+	return s.store.WriteServerInfo(v)
+}
+
+// ReadRetained loads all the retained messages from the wrapped store.
+func (s *Timed) ReadRetained() (v []Message, err error) {
+	defer s.since("ReadRetained", time.Now())
+	return s.store.ReadRetained()
+}
+
+// WriteRetained writes a single retained message to the wrapped store.
+func (s *Timed) WriteRetained(v Message) error {
+	defer s.since("WriteRetained", time.Now())
+	return s.store.WriteRetained(v)
+}
+
+// DeleteRetained deletes a retained message from the wrapped store.
+func (s *Timed) DeleteRetained(id string) error {
+	defer s.since("DeleteRetained", time.Now())
+	return s.store.DeleteRetained(id)
+}
+
+// DeleteAllRetained deletes all retained messages from the wrapped store.
+func (s *Timed) DeleteAllRetained() error {
+	defer s.since("DeleteAllRetained", time.Now())
+	return s.store.DeleteAllRetained()
+}
+
+// CountRetained returns the number of retained messages in the wrapped store.
+func (s *Timed) CountRetained() (n int, err error) {
+	defer s.since("CountRetained", time.Now())
+	return s.store.CountRetained()
+}
+
+// ListRetainedTopics returns the topics of the retained messages in the
+// wrapped store.
+func (s *Timed) ListRetainedTopics() (v []string, err error) {
+	defer s.since("ListRetainedTopics", time.Now())
+	return s.store.ListRetainedTopics()
+}
+
+// ClearExpiredRetained deletes the expired retained messages in the wrapped store.
+func (s *Timed) ClearExpiredRetained(now int64) error {
+	defer s.since("ClearExpiredRetained", time.Now())
+	return s.store.ClearExpiredRetained(now)
+}
+
+// ClearExpiredSessions deletes the expired sessions in the wrapped store.
+func (s *Timed) ClearExpiredSessions(now int64) error {
+	defer s.since("ClearExpiredSessions", time.Now())
+	return s.store.ClearExpiredSessions(now)
+}
@@ -0,0 +1,92 @@
+package persistence
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTimed(t *testing.T) {
+	st := new(MockStore)
+	s := NewTimed(st)
+	require.Equal(t, st, s.store)
+	require.Empty(t, s.Stats())
+}
+
+func TestTimedStats(t *testing.T) {
+	s := NewTimed(new(MockStore))
+	require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+	require.NoError(t, s.WriteInflight(Message{ID: "b"}))
+	require.NoError(t, s.DeleteInflight("a"))
+
+	stats := s.Stats()
+	require.Len(t, stats, 2)
+	require.Equal(t, int64(2), stats["WriteInflight"].Count)
+	require.Equal(t, int64(1), stats["DeleteInflight"].Count)
+
+	// the returned stats are a copy.
+	stats["WriteInflight"] = OpStats{}
+	require.Equal(t, int64(2), s.Stats()["WriteInflight"].Count)
+}
+
+func TestTimedFailure(t *testing.T) {
+	s := NewTimed(&MockStore{Fail: map[string]bool{"write_inflight": true}})
+	require.Error(t, s.WriteInflight(Message{ID: "a"}))
+	require.Equal(t, int64(1), s.Stats()["WriteInflight"].Count)
+}
+
+func TestTimedPassthrough(t *testing.T) {
+	st := new(MockStore)
+	s := NewTimed(st)
+	require.NoError(t, s.Open())
+	require.True(t, st.Opened)
+	require.True(t, s.IsOpen())
+
+	s.SetInflightTTL(10)
+	s.SetInflightTTLForQoS(2, 20)
+	require.Equal(t, InflightTTL{10, 10, 20}, st.inflightTTL)
+
+	require.NoError(t, s.WriteSubscription(Subscription{ID: "a"}))
+	require.NoError(t, s.DeleteSubscription("a"))
+	require.NoError(t, s.WriteClient(Client{ID: "a"}))
+	require.NoError(t, s.DeleteClient("a"))
+	require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+	require.NoError(t, s.DeleteInflight("a"))
+	require.NoError(t, s.WriteServerInfo(ServerInfo{}))
+	require.NoError(t, s.WriteRetained(Message{ID: "a"}))
+	require.NoError(t, s.DeleteRetained("a"))
+
+	_, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	_, err = s.ReadSubscriptionsForClient("a")
+	require.NoError(t, err)
+	_, err = s.CountSubscriptions("a")
+	require.NoError(t, err)
+	_, err = s.ReadClients()
+	require.NoError(t, err)
+	_, err = s.ReadClient("cl_client1")
+	require.NoError(t, err)
+	_, err = s.ReadInflight()
+	require.NoError(t, err)
+	_, err = s.ReadInflightForClient("a")
+	require.NoError(t, err)
+	_, err = s.CountInflight("a")
+	require.NoError(t, err)
+	_, err = s.ReadServerInfo()
+	require.NoError(t, err)
+	_, err = s.ReadRetained()
+	require.NoError(t, err)
+	_, err = s.CountRetained()
+	require.NoError(t, err)
+	_, err = s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteAllInflight())
+	require.NoError(t, s.DeleteAllRetained())
+	require.NoError(t, s.ClearExpiredInflightAt(1))
+	require.NoError(t, s.ClearExpiredRetained(1))
+	require.NoError(t, s.ClearExpiredSessions(1))
+	require.Len(t, s.Stats(), 26)
+
+	s.Close()
+	require.True(t, st.Closed)
+}
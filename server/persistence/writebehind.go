@@ -0,0 +1,459 @@
+package persistence
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultWriteBehindSize is the default number of writes which may be
+	// queued by a WriteBehind store.
+	defaultWriteBehindSize = 1024
+
+	// defaultWriteBehindBatch is the default number of queued writes applied
+	// to the store in each batch.
+	defaultWriteBehindBatch = 64
+)
+
+// ErrWriteDropped indicates that a write was dropped because the queue of a
+// WriteBehind store stayed full for longer than its Wait.
+var ErrWriteDropped = errors.New("write-behind queue full, write dropped")
+
+// WriteBehindOptions contains configuration values for a WriteBehind store.
+type WriteBehindOptions struct {
+	// Size is the maximum number of writes which may be queued (default 1024).
+	Size int
+
+	// BatchSize is the maximum number of queued writes applied to the store
+	// at once (default 64). Within a batch, only the last write or delete of
+	// each record is applied.
+	BatchSize int
+
+	// Wait is how long a write to a full queue may block before it is dropped.
+	// If 0, writes block until there is space in the queue, so the store
+	// applies backpressure to the server, and if less than 0, writes to a full
+	// queue are dropped immediately.
+	Wait time.Duration
+
+	// OnError receives the name of the Store method (eg. "WriteInflight") and
+	// the error of each queued write which failed when applied to the store.
+	OnError func(op string, err error)
+}
+
+// writeOp is a write queued by a WriteBehind store.
+type writeOp struct {
+	op      string            // the name of the Store method which queued the write.
+	key     string            // the type and id of the record written.
+	apply   func(Store) error // applies the write to the store.
+	flushed chan struct{}     // closed once the writes before it are applied, if not a write.
+}
+
+// WriteBehind is a Store which queues the writes and deletes of single records
+// and applies them to another Store in the background, so they do not wait on
+// the backend. It trades durability for throughput: any writes still queued
+// if the process exits without closing the store are lost. Reads, and deletes
+// of many records, wait for the queued writes to be applied first, so they
+// always see them.
+type WriteBehind struct {
+	mu        sync.RWMutex               // guards the queue against being closed while writes are sent.
+	store     Store                      // the wrapped store.
+	queue     chan writeOp               // the writes waiting to be applied.
+	done      chan struct{}              // closed when the writer has applied every queued write.
+	size      int                        // the capacity of the queue.
+	batchSize int                        // the maximum number of writes in each batch.
+	wait      time.Duration              // how long a write to a full queue may block.
+	onError   func(op string, err error) // receives the errors of queued writes.
+	dropped   int64                      // the number of writes dropped because the queue was full.
+	failing   map[string]bool            // the store methods whose last queued write failed.
+	failingMu sync.RWMutex               // a mutex for the failing methods.
+}
+
+// NewWriteBehind returns a WriteBehind store which queues the writes to
+// another store. The queue is started when the store is opened, and is
+// applied completely before the wrapped store is closed.
+func NewWriteBehind(store Store, o WriteBehindOptions) *WriteBehind {
+	if o.Size < 1 {
+		o.Size = defaultWriteBehindSize
+	}
+
+	if o.BatchSize < 1 {
+		o.BatchSize = defaultWriteBehindBatch
+	}
+
+	return &WriteBehind{
+		store:     store,
+		size:      o.Size,
+		batchSize: o.BatchSize,
+		wait:      o.Wait,
+		onError:   o.OnError,
+		failing:   map[string]bool{},
+	}
+}
+
+// Queued returns the number of writes waiting to be applied to the store.
+func (s *WriteBehind) Queued() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.queue)
+}
+
+// Failing returns true if the last queued write of any store method failed when
+// it was applied. A method recovers when a later write of it succeeds.
+func (s *WriteBehind) Failing() bool {
+	s.failingMu.RLock()
+	defer s.failingMu.RUnlock()
+	return len(s.failing) > 0
+}
+
+// Full returns true if the queue is full, so that further writes will block
+// or be dropped until the writer catches up.
+func (s *WriteBehind) Full() bool {
+	return s.Queued() >= s.size
+}
+
+// Dropped returns the number of writes dropped because the queue was full.
+func (s *WriteBehind) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Open opens the wrapped store and starts applying queued writes to it.
+func (s *WriteBehind) Open() error {
+	if err := s.store.Open(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue == nil {
+		s.queue = make(chan writeOp, s.size)
+		s.done = make(chan struct{})
+		go s.write(s.queue, s.done)
+	}
+
+	return nil
+}
+
+// Close applies every queued write and then closes the wrapped store.
+func (s *WriteBehind) Close() {
+	s.mu.Lock()
+	queue, done := s.queue, s.done
+	s.queue = nil
+	s.mu.Unlock()
+
+	if queue != nil {
+		close(queue)
+		<-done
+	}
+
+	s.store.Close()
+}
+
+// IsOpen returns false if the wrapped store reports that it is not open.
+func (s *WriteBehind) IsOpen() bool {
+	if o, ok := s.store.(interface{ IsOpen() bool }); ok {
+		return o.IsOpen()
+	}
+
+	return true
+}
+
+// Flush blocks until every write queued before it has been applied.
+func (s *WriteBehind) Flush() {
+	s.mu.RLock()
+	if s.queue == nil {
+		s.mu.RUnlock()
+		return
+	}
+
+	flushed := make(chan struct{})
+	s.queue <- writeOp{flushed: flushed}
+	s.mu.RUnlock()
+	<-flushed
+}
+
+// enqueue queues a write, or applies it at once if the store is not open. If
+// the queue is full, enqueue blocks for up to the Wait of the store before
+// dropping the write.
+func (s *WriteBehind) enqueue(op writeOp) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.queue == nil {
+		return op.apply(s.store)
+	}
+
+	select {
+	case s.queue <- op:
+		return nil
+	default:
+	}
+
+	if s.wait == 0 {
+		s.queue <- op
+		return nil
+	}
+
+	if s.wait > 0 {
+		t := time.NewTimer(s.wait)
+		defer t.Stop()
+		select {
+		case s.queue <- op:
+			return nil
+		case <-t.C:
+		}
+	}
+
+	atomic.AddInt64(&s.dropped, 1)
+	return ErrWriteDropped
+}
+
+// write applies the writes sent to queue in batches until it is closed.
+func (s *WriteBehind) write(queue chan writeOp, done chan struct{}) {
+	defer close(done)
+
+	batch := make([]writeOp, 0, s.batchSize)
+	for op := range queue {
+		batch = append(batch[:0], op)
+
+	drain:
+		for op.flushed == nil && len(batch) < s.batchSize {
+			select {
+			case next, ok := <-queue:
+				if !ok {
+					break drain
+				}
+
+				op = next
+				batch = append(batch, op)
+			default:
+				break drain
+			}
+		}
+
+		s.apply(batch)
+	}
+}
+
+// apply applies a batch of writes to the store. Writes to a record which is
+// written or deleted again later in the batch are skipped. A batch ends at the
+// first flush, so every write before it is applied when it is released.
+func (s *WriteBehind) apply(batch []writeOp) {
+	last := make(map[string]int, len(batch))
+	for i, op := range batch {
+		last[op.key] = i
+	}
+
+	for i, op := range batch {
+		if op.flushed != nil {
+			close(op.flushed)
+			continue
+		}
+
+		if last[op.key] != i {
+			continue
+		}
+
+		err := op.apply(s.store)
+		s.failingMu.Lock()
+		if err != nil {
+			s.failing[op.op] = true
+		} else {
+			delete(s.failing, op.op)
+		}
+		s.failingMu.Unlock()
+
+		if err != nil && s.onError != nil {
+			s.onError(op.op, err)
+		}
+	}
+}
+
+// SetInflightTTL sets the inflight ttl of the wrapped store.
+func (s *WriteBehind) SetInflightTTL(seconds int64) {
+	s.store.SetInflightTTL(seconds)
+}
+
+// SetInflightTTLForQoS sets the inflight ttl of a qos of the wrapped store.
+func (s *WriteBehind) SetInflightTTLForQoS(qos byte, seconds int64) {
+	s.store.SetInflightTTLForQoS(qos, seconds)
+}
+
+// ReadSubscriptions loads all the subscriptions from the wrapped store.
+func (s *WriteBehind) ReadSubscriptions() (v []Subscription, err error) {
+	s.Flush()
+	return s.store.ReadSubscriptions()
+}
+
+// ReadSubscriptionsForClient loads the subscriptions of a client from the
+// wrapped store.
+func (s *WriteBehind) ReadSubscriptionsForClient(clientID string) (v []Subscription, err error) {
+	s.Flush()
+	return s.store.ReadSubscriptionsForClient(clientID)
+}
+
+// WriteSubscription queues a single subscription to be written.
+func (s *WriteBehind) WriteSubscription(v Subscription) error {
+	return s.enqueue(writeOp{op: "WriteSubscription", key: KSubscription + v.ID, apply: func(st Store) error {
+		return st.WriteSubscription(v)
+	}})
+}
+
+// DeleteSubscription queues a subscription to be deleted.
+func (s *WriteBehind) DeleteSubscription(id string) error {
+	return s.enqueue(writeOp{op: "DeleteSubscription", key: KSubscription + id, apply: func(st Store) error {
+		return st.DeleteSubscription(id)
+	}})
+}
+
+// CountSubscriptions returns the number of subscriptions of a client in the
+// wrapped store.
+func (s *WriteBehind) CountSubscriptions(clientID string) (n int, err error) {
+	s.Flush()
+	return s.store.CountSubscriptions(clientID)
+}
+
+// ReadClients loads all the clients from the wrapped store.
+func (s *WriteBehind) ReadClients() (v []Client, err error) {
+	s.Flush()
+	return s.store.ReadClients()
+}
+
+// ReadClient loads a single client from the wrapped store.
+func (s *WriteBehind) ReadClient(id string) (v Client, err error) {
+	s.Flush()
+	return s.store.ReadClient(id)
+}
+
+// WriteClient queues a single client to be written.
+func (s *WriteBehind) WriteClient(v Client) error {
+	return s.enqueue(writeOp{op: "WriteClient", key: KClient + v.ID, apply: func(st Store) error {
+		return st.WriteClient(v)
+	}})
+}
+
+// DeleteClient queues a client to be deleted.
+func (s *WriteBehind) DeleteClient(id string) error {
+	return s.enqueue(writeOp{op: "DeleteClient", key: KClient + id, apply: func(st Store) error {
+		return st.DeleteClient(id)
+	}})
+}
+
+// ReadInflight loads all the inflight messages from the wrapped store.
+func (s *WriteBehind) ReadInflight() (v []Message, err error) {
+	s.Flush()
+	return s.store.ReadInflight()
+}
+
+// ReadInflightForClient loads the inflight messages of a client from the
+// wrapped store.
+func (s *WriteBehind) ReadInflightForClient(clientID string) (v []Message, err error) {
+	s.Flush()
+	return s.store.ReadInflightForClient(clientID)
+}
+
+// WriteInflight queues a single inflight message to be written.
+func (s *WriteBehind) WriteInflight(v Message) error {
+	return s.enqueue(writeOp{op: "WriteInflight", key: KInflight + v.ID, apply: func(st Store) error {
+		return st.WriteInflight(v)
+	}})
+}
+
+// DeleteInflight queues an inflight message to be deleted.
+func (s *WriteBehind) DeleteInflight(id string) error {
+	return s.enqueue(writeOp{op: "DeleteInflight", key: KInflight + id, apply: func(st Store) error {
+		return st.DeleteInflight(id)
+	}})
+}
+
+// DeleteAllInflight deletes all inflight messages from the wrapped store, once
+// the queued writes have been applied.
+func (s *WriteBehind) DeleteAllInflight() error {
+	s.Flush()
+	return s.store.DeleteAllInflight()
+}
+
+// CountInflight returns the number of inflight messages of a client in the
+// wrapped store.
+func (s *WriteBehind) CountInflight(clientID string) (n int, err error) {
+	s.Flush()
+	return s.store.CountInflight(clientID)
+}
+
+// ClearExpiredInflightAt deletes any inflight messages which have expired by the
+// provided unix timestamp from the wrapped store, once the queued writes have
+// been applied.
+func (s *WriteBehind) ClearExpiredInflightAt(now int64) error {
+	s.Flush()
+	return s.store.ClearExpiredInflightAt(now)
+}
+
+// ReadServerInfo loads the server info from the wrapped store.
+func (s *WriteBehind) ReadServerInfo() (v ServerInfo, err error) {
+	s.Flush()
+	return s.store.ReadServerInfo()
+}
+
+// WriteServerInfo queues the server info to be written.
+func (s *WriteBehind) WriteServerInfo(v ServerInfo) error {
+	return s.enqueue(writeOp{op: "WriteServerInfo", key: KServerInfo, apply: func(st Store) error {
+		return st.WriteServerInfo(v)
+	}})
+}
+
+// ReadRetained loads all the retained messages from the wrapped store.
+func (s *WriteBehind) ReadRetained() (v []Message, err error) {
+	s.Flush()
+	return s.store.ReadRetained()
+}
+
+// WriteRetained queues a single retained message to be written.
+func (s *WriteBehind) WriteRetained(v Message) error {
+	return s.enqueue(writeOp{op: "WriteRetained", key: KRetained + v.ID, apply: func(st Store) error {
+		return st.WriteRetained(v)
+	}})
+}
+
+// DeleteRetained queues a retained message to be deleted.
+func (s *WriteBehind) DeleteRetained(id string) error {
+	return s.enqueue(writeOp{op: "DeleteRetained", key: KRetained + id, apply: func(st Store) error {
+		return st.DeleteRetained(id)
+	}})
+}
+
+// DeleteAllRetained deletes all retained messages from the wrapped store, once
+// the queued writes have been applied.
+func (s *WriteBehind) DeleteAllRetained() error {
+	s.Flush()
+	return s.store.DeleteAllRetained()
+}
+
+// CountRetained returns the number of retained messages in the wrapped store.
+func (s *WriteBehind) CountRetained() (n int, err error) {
+	s.Flush()
+	return s.store.CountRetained()
+}
+
+// ListRetainedTopics returns the topics of the retained messages in the
+// wrapped store.
+func (s *WriteBehind) ListRetainedTopics() (v []string, err error) {
+	s.Flush()
+	return s.store.ListRetainedTopics()
+}
+
+// ClearExpiredRetained deletes any retained messages which expired before the
+// provided unix timestamp from the wrapped store, once the queued writes have
+// been applied.
+func (s *WriteBehind) ClearExpiredRetained(now int64) error {
+	s.Flush()
+	return s.store.ClearExpiredRetained(now)
+}
+
+// ClearExpiredSessions deletes the sessions which expired before the provided
+// unix timestamp from the wrapped store, once the queued writes have been
+// applied.
+func (s *WriteBehind) ClearExpiredSessions(now int64) error {
+	s.Flush()
+	return s.store.ClearExpiredSessions(now)
+}
@@ -0,0 +1,284 @@
+package persistence
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordStore is a store which records the writes applied to it, and can hold
+// the first write until it is released.
+type recordStore struct {
+	MockStore
+	sync.Mutex
+	ops  []string
+	gate chan struct{}
+}
+
+func (s *recordStore) record(op string) {
+	if s.gate != nil {
+		<-s.gate
+	}
+
+	s.Lock()
+	s.ops = append(s.ops, op)
+	s.Unlock()
+}
+
+func (s *recordStore) applied() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.ops...)
+}
+
+func (s *recordStore) WriteInflight(v Message) error {
+	s.record("WriteInflight " + v.ID)
+	return s.MockStore.WriteInflight(v)
+}
+
+func (s *recordStore) DeleteInflight(id string) error {
+	s.record("DeleteInflight " + id)
+	return s.MockStore.DeleteInflight(id)
+}
+
+func (s *recordStore) WriteClient(v Client) error {
+	s.record("WriteClient " + v.ID)
+	return s.MockStore.WriteClient(v)
+}
+
+func TestNewWriteBehind(t *testing.T) {
+	s := NewWriteBehind(new(MockStore), WriteBehindOptions{})
+	require.Equal(t, defaultWriteBehindSize, s.size)
+	require.Equal(t, defaultWriteBehindBatch, s.batchSize)
+
+	s = NewWriteBehind(new(MockStore), WriteBehindOptions{Size: 10, BatchSize: 5, Wait: time.Second})
+	require.Equal(t, 10, s.size)
+	require.Equal(t, 5, s.batchSize)
+	require.Equal(t, time.Second, s.wait)
+}
+
+func TestWriteBehindOpenFailure(t *testing.T) {
+	s := NewWriteBehind(&MockStore{FailOpen: true}, WriteBehindOptions{})
+	require.Error(t, s.Open())
+	require.Nil(t, s.queue)
+}
+
+func TestWriteBehindNotOpen(t *testing.T) {
+	st := new(recordStore)
+	s := NewWriteBehind(st, WriteBehindOptions{})
+	require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+	require.Equal(t, []string{"WriteInflight a"}, st.applied())
+	s.Flush()
+}
+
+func TestWriteBehindClose(t *testing.T) {
+	st := new(recordStore)
+	s := NewWriteBehind(st, WriteBehindOptions{})
+	require.NoError(t, s.Open())
+	require.True(t, st.Opened)
+
+	require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+	require.NoError(t, s.WriteClient(Client{ID: "b"}))
+	require.NoError(t, s.DeleteInflight("c"))
+	s.Close()
+
+	require.Equal(t, []string{"WriteInflight a", "WriteClient b", "DeleteInflight c"}, st.applied())
+	require.True(t, st.Closed)
+	require.Equal(t, 0, s.Queued())
+
+	// writes after closing go straight to the store.
+	require.NoError(t, s.WriteInflight(Message{ID: "d"}))
+	require.Len(t, st.applied(), 4)
+}
+
+func TestWriteBehindBatch(t *testing.T) {
+	st := &recordStore{gate: make(chan struct{})}
+	s := NewWriteBehind(st, WriteBehindOptions{})
+	require.NoError(t, s.Open())
+
+	// hold the writer on the first write while the rest are queued.
+	require.NoError(t, s.WriteInflight(Message{ID: "first"}))
+	require.Eventually(t, func() bool { return s.Queued() == 0 }, time.Second, time.Millisecond)
+
+	require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+	require.NoError(t, s.WriteInflight(Message{ID: "b"}))
+	require.NoError(t, s.DeleteInflight("a"))
+	require.NoError(t, s.WriteInflight(Message{ID: "b"}))
+	require.Equal(t, 4, s.Queued())
+
+	close(st.gate)
+	s.Close()
+	require.Equal(t, []string{"WriteInflight first", "DeleteInflight a", "WriteInflight b"}, st.applied())
+}
+
+func TestWriteBehindRead(t *testing.T) {
+	st := &recordStore{gate: make(chan struct{})}
+	s := NewWriteBehind(st, WriteBehindOptions{})
+	require.NoError(t, s.Open())
+	defer s.Close()
+
+	require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+
+	read := make(chan bool)
+	go func() {
+		_, err := s.ReadInflight()
+		require.NoError(t, err)
+		read <- true
+	}()
+
+	select {
+	case <-read:
+		t.Fatal("read before queued writes were applied")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(st.gate)
+	<-read
+	require.Equal(t, []string{"WriteInflight a"}, st.applied())
+}
+
+func TestWriteBehindFull(t *testing.T) {
+	tt := []struct {
+		desc string
+		wait time.Duration
+	}{
+		{desc: "immediate", wait: -1},
+		{desc: "wait", wait: 5 * time.Millisecond},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			st := &recordStore{gate: make(chan struct{})}
+			s := NewWriteBehind(st, WriteBehindOptions{Size: 1, Wait: tx.wait})
+			require.NoError(t, s.Open())
+
+			require.NoError(t, s.WriteInflight(Message{ID: "first"}))
+			require.Eventually(t, func() bool { return s.Queued() == 0 }, time.Second, time.Millisecond)
+			require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+
+			require.True(t, s.Full())
+			require.ErrorIs(t, s.WriteInflight(Message{ID: "b"}), ErrWriteDropped)
+			require.Equal(t, int64(1), s.Dropped())
+
+			close(st.gate)
+			s.Close()
+			require.Equal(t, []string{"WriteInflight first", "WriteInflight a"}, st.applied())
+		})
+	}
+}
+
+func TestWriteBehindFullBlock(t *testing.T) {
+	st := &recordStore{gate: make(chan struct{})}
+	s := NewWriteBehind(st, WriteBehindOptions{Size: 1})
+	require.NoError(t, s.Open())
+
+	require.NoError(t, s.WriteInflight(Message{ID: "first"}))
+	require.Eventually(t, func() bool { return s.Queued() == 0 }, time.Second, time.Millisecond)
+	require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+
+	written := make(chan error)
+	go func() {
+		written <- s.WriteInflight(Message{ID: "b"})
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("write to a full queue did not block")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(st.gate)
+	require.NoError(t, <-written)
+	s.Close()
+	require.Equal(t, []string{"WriteInflight first", "WriteInflight a", "WriteInflight b"}, st.applied())
+	require.Equal(t, int64(0), s.Dropped())
+}
+
+func TestWriteBehindOnError(t *testing.T) {
+	var ops []string
+	var mu sync.Mutex
+	s := NewWriteBehind(&MockStore{Fail: map[string]bool{"write_inflight": true}}, WriteBehindOptions{
+		OnError: func(op string, err error) {
+			mu.Lock()
+			ops = append(ops, op)
+			mu.Unlock()
+			require.Error(t, err)
+		},
+	})
+	require.NoError(t, s.Open())
+
+	require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+	require.NoError(t, s.WriteClient(Client{ID: "b"}))
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"WriteInflight"}, ops)
+}
+
+func TestWriteBehindFailing(t *testing.T) {
+	st := &MockStore{Fail: map[string]bool{"write_inflight": true}}
+	s := NewWriteBehind(st, WriteBehindOptions{})
+	require.NoError(t, s.Open())
+	defer s.Close()
+	require.False(t, s.Failing())
+
+	require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+	require.NoError(t, s.DeleteInflight("b"))
+	s.Flush()
+	require.True(t, s.Failing())
+
+	st.Fail = nil
+	require.NoError(t, s.WriteInflight(Message{ID: "a"}))
+	s.Flush()
+	require.False(t, s.Failing())
+}
+
+func TestWriteBehindPassthrough(t *testing.T) {
+	st := new(MockStore)
+	s := NewWriteBehind(st, WriteBehindOptions{})
+	require.NoError(t, s.Open())
+	defer s.Close()
+
+	s.SetInflightTTL(10)
+	s.SetInflightTTLForQoS(2, 20)
+	require.Equal(t, InflightTTL{10, 10, 20}, st.inflightTTL)
+	require.True(t, s.IsOpen())
+
+	require.NoError(t, s.WriteSubscription(Subscription{ID: "a"}))
+	require.NoError(t, s.DeleteSubscription("a"))
+	require.NoError(t, s.DeleteClient("a"))
+	require.NoError(t, s.WriteServerInfo(ServerInfo{}))
+	require.NoError(t, s.WriteRetained(Message{ID: "a"}))
+	require.NoError(t, s.DeleteRetained("a"))
+
+	_, err := s.ReadSubscriptions()
+	require.NoError(t, err)
+	_, err = s.ReadSubscriptionsForClient("a")
+	require.NoError(t, err)
+	_, err = s.CountSubscriptions("a")
+	require.NoError(t, err)
+	_, err = s.ReadClients()
+	require.NoError(t, err)
+	_, err = s.ReadClient("cl_client1")
+	require.NoError(t, err)
+	_, err = s.ReadInflightForClient("a")
+	require.NoError(t, err)
+	_, err = s.CountInflight("a")
+	require.NoError(t, err)
+	_, err = s.ReadServerInfo()
+	require.NoError(t, err)
+	_, err = s.ReadRetained()
+	require.NoError(t, err)
+	_, err = s.CountRetained()
+	require.NoError(t, err)
+	_, err = s.ListRetainedTopics()
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteAllInflight())
+	require.NoError(t, s.DeleteAllRetained())
+	require.NoError(t, s.ClearExpiredInflightAt(1))
+	require.NoError(t, s.ClearExpiredRetained(1))
+	require.NoError(t, s.ClearExpiredSessions(1))
+}
@@ -2,22 +2,38 @@
 package server
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/csymapp/mqtt/server/events"
+	"github.com/csymapp/mqtt/server/internal/aclcache"
 	"github.com/csymapp/mqtt/server/internal/circ"
 	"github.com/csymapp/mqtt/server/internal/clients"
+	"github.com/csymapp/mqtt/server/internal/dedup"
+	"github.com/csymapp/mqtt/server/internal/lastvalue"
 	"github.com/csymapp/mqtt/server/internal/packets"
+	"github.com/csymapp/mqtt/server/internal/ratelimit"
 	"github.com/csymapp/mqtt/server/internal/topics"
 	"github.com/csymapp/mqtt/server/internal/utils"
 	"github.com/csymapp/mqtt/server/listeners"
 	"github.com/csymapp/mqtt/server/listeners/auth"
+	"github.com/csymapp/mqtt/server/logger"
 	"github.com/csymapp/mqtt/server/persistence"
 	"github.com/csymapp/mqtt/server/system"
 )
@@ -26,25 +42,98 @@ const (
 	// Version indicates the current server version.
 	Version = "1.1.1"
 
+	// OriginalTopicProperty is the user property added to messages whose topic
+	// was changed by a topic rewrite rule, holding the topic they were published to.
+	OriginalTopicProperty = "original-topic"
+
+	// CompressionProperty is the user property MQTT v5 clients set in their
+	// CONNECT to list the payload compression algorithms they support, separated
+	// by commas. The server returns it in the CONNACK with the algorithm chosen.
+	CompressionProperty = "compression"
+
+	// ContentEncodingProperty is the user property marking a publish whose
+	// payload is compressed on the wire, holding the algorithm used.
+	ContentEncodingProperty = "content-encoding"
+
+	// CompressionDeflate is the deflate (RFC 1951) payload compression algorithm.
+	CompressionDeflate = "deflate"
+
+	// contentEncodingSize is the encoded size of the content encoding user
+	// property, which compressed payloads must save more than to be worthwhile.
+	contentEncodingSize = 5 + len(ContentEncodingProperty) + len(CompressionDeflate)
+
+	// maxInflatedPayload is the largest payload a compressed payload may be
+	// inflated to by default, which is the largest packet allowed by the spec.
+	maxInflatedPayload uint32 = 268435455
+
 	// defaultInflightTTL is the number of seconds a pending inflight message should last.
 	defaultInflightTTL int64 = 60 * 60 * 24
+
+	// defaultRetainedSweepInterval is the number of seconds between sweeps for expired retained messages.
+	defaultRetainedSweepInterval int64 = 60
+
+	// defaultSessionSweepInterval is the number of seconds between sweeps for expired sessions.
+	defaultSessionSweepInterval int64 = 60
+
+	// defaultConnectionSweepInterval is the number of seconds between sweeps for idle connections.
+	defaultConnectionSweepInterval int64 = 1
+
+	// defaultHandshakeTimeout is the number of seconds a new connection has to send its CONNECT.
+	defaultHandshakeTimeout int64 = 10
+
+	// defaultWriteTimeout is how long each write to a client may take, when its
+	// listener does not set a write timeout.
+	defaultWriteTimeout = 30 * time.Second
+
+	// defaultInflightResendScan is the number of seconds between scans for inflight
+	// messages to resend, when no resend interval is set.
+	defaultInflightResendScan int64 = 10
+
+	// defaultDeliveryFilterTimeout is how long a delivery filter may take to
+	// decide whether a message is delivered.
+	defaultDeliveryFilterTimeout = 10 * time.Millisecond
+
+	// defaultDeliveryFilterWorkers is the number of delivery filters which may
+	// be running at once.
+	defaultDeliveryFilterWorkers = 64
+
+	// retainedReplayWait is how long a retained replay waits for a client to
+	// acknowledge messages queued beyond its receive maximum, when no batch
+	// delay is set.
+	retainedReplayWait = 10 * time.Millisecond
 )
 
 var (
 	// ErrListenerIDExists indicates that a listener with the same id already exists.
 	ErrListenerIDExists = errors.New("listener id already exists")
 
+	// ErrListenerNotFound indicates that no listener with an id has been added.
+	ErrListenerNotFound = errors.New("listener not found")
+
 	// ErrReadConnectInvalid indicates that the connection packet was invalid.
 	ErrReadConnectInvalid = errors.New("connect packet was not valid")
 
+	// ErrReadAuthInvalid indicates that a packet received during an enhanced
+	// authentication exchange was not a valid auth packet.
+	ErrReadAuthInvalid = errors.New("auth packet was not valid")
+
 	// ErrConnectNotAuthorized indicates that the connection packet had incorrect auth values.
 	ErrConnectNotAuthorized = errors.New("connect packet was not authorized")
 
 	// ErrInvalidTopic indicates that the specified topic was not valid.
 	ErrInvalidTopic = errors.New("cannot publish to $ and $SYS topics")
 
+	// ErrInvalidQos indicates that a message was published with a QoS above 2.
+	ErrInvalidQos = errors.New("qos must be 0, 1 or 2")
+
+	// ErrInvalidTopicName indicates that a topic name did not conform to the MQTT specification.
+	ErrInvalidTopicName = errors.New("invalid topic name")
+
+	// ErrInvalidTopicFilter indicates that a topic filter did not conform to the MQTT specification.
+	ErrInvalidTopicFilter = errors.New("invalid topic filter")
+
 	// ErrRejectPacket indicates that a packet should be dropped instead of processed.
-	ErrRejectPacket = errors.New("packet rejected")
+	ErrRejectPacket = events.ErrRejectPacket
 
 	// ErrClientDisconnect indicates that a client disconnected from the server.
 	ErrClientDisconnect = errors.New("client disconnected")
@@ -55,13 +144,122 @@ var (
 	// ErrServerShutdown is propagated when the server shuts down.
 	ErrServerShutdown = errors.New("server is shutting down")
 
+	// ErrClientNotConnected indicates that there is no connected client with a given id.
+	ErrClientNotConnected = errors.New("client not connected")
+
+	// ErrAdminDisconnect indicates that a client was disconnected by an administrator.
+	ErrAdminDisconnect = errors.New("client disconnected by administrator")
+
 	// ErrSessionReestablished indicates that an existing client was replaced by a newly connected
 	// client. The existing client is disconnected.
 	ErrSessionReestablished = errors.New("client session re-established")
 
+	// ErrClientIDInUse indicates that a connection was refused because a client
+	// with the same client id is already connected, and the ClientIDConflict
+	// option is ClientIDRejectNew.
+	ErrClientIDInUse = errors.New("client id already connected")
+
 	// ErrConnectionFailed indicates that a client connection attempt failed for other reasons.
 	ErrConnectionFailed = errors.New("connection attempt failed")
 
+	// ErrInflightQuotaExceeded indicates that a client was disconnected because it
+	// exceeded the maximum number of inflight messages.
+	ErrInflightQuotaExceeded = errors.New("client exceeded inflight quota")
+
+	// ErrSlowConsumer indicates that a client was disconnected because its write
+	// buffer reached the high-water mark.
+	ErrSlowConsumer = errors.New("client is a slow consumer")
+
+	// ErrServerDraining indicates that a connection was refused because the server is draining.
+	ErrServerDraining = errors.New("server is draining")
+
+	// ErrConnectionRedirected indicates that a connection was refused because the
+	// server is redirecting clients to another server.
+	ErrConnectionRedirected = errors.New("connection redirected to another server")
+
+	// ErrReceiveMaximumExceeded indicates that a client sent more unacknowledged
+	// QoS messages than the server's receive maximum.
+	ErrReceiveMaximumExceeded = errors.New("client exceeded receive maximum")
+
+	// ErrInvalidCompressedPayload indicates that a client sent a publish whose
+	// compressed payload could not be decompressed.
+	ErrInvalidCompressedPayload = errors.New("invalid compressed payload")
+
+	// ErrRateLimitExceeded indicates that a client exceeded a topic publish rate limit.
+	ErrRateLimitExceeded = errors.New("client exceeded topic rate limit")
+
+	// ErrPublishRateExceeded indicates that a client was disconnected because
+	// its publishes exceeded the publish rate of its listener for longer than
+	// they could be delayed.
+	ErrPublishRateExceeded = errors.New("client exceeded publish rate limit")
+
+	// ErrQosNotSupported indicates that a client sent a message with a QoS above
+	// the maximum QoS of its listener.
+	ErrQosNotSupported = errors.New("qos not supported by listener")
+
+	// ErrRetainNotSupported indicates that a client sent a retained message to a
+	// listener which does not allow retained messages.
+	ErrRetainNotSupported = errors.New("retain not supported by listener")
+
+	// ErrReadTimeout indicates that a client was disconnected because it did
+	// not send a complete packet within the read timeout of its listener.
+	ErrReadTimeout = clients.ErrReadTimeout
+
+	// ErrWriteTimeout indicates that a client was disconnected because a write
+	// to it did not complete within the write timeout of its listener.
+	ErrWriteTimeout = clients.ErrWriteTimeout
+
+	// ErrClientIDInvalid indicates that a connection was refused because its
+	// client id was too long or not allowed by the strict client id rules of
+	// the listener.
+	ErrClientIDInvalid = errors.New("client id not valid for listener")
+
+	// ErrClientIDRejected indicates that a connection was refused because its
+	// client id was denied by the client id filter.
+	ErrClientIDRejected = errors.New("client id rejected by filter")
+
+	// ErrInvalidClientIDPattern indicates that a client id filter pattern could not be compiled.
+	ErrInvalidClientIDPattern = errors.New("invalid client id pattern")
+
+	// ErrDrainTimeout indicates that some clients did not drain before the drain timeout.
+	ErrDrainTimeout = errors.New("clients did not drain in time")
+
+	// ErrConnectionLimited indicates that a connection was refused because it
+	// exceeded the connection rate or per-ip limit of its listener.
+	ErrConnectionLimited = errors.New("connection refused by listener limit")
+
+	// ErrHandshakeTimeout indicates that a connection was closed because it did
+	// not complete its CONNECT within the handshake timeout.
+	ErrHandshakeTimeout = errors.New("client did not connect in time")
+
+	// ErrNoStore indicates that the persisted state could not be exported or
+	// imported because the server has no store.
+	ErrNoStore = errors.New("server has no store")
+
+	// ErrServing indicates that a state could not be imported because the
+	// server is already serving, and has loaded the state of its store.
+	ErrServing = errors.New("server is serving")
+
+	// ErrStoreAdded indicates that a retained store could not be added because
+	// the store has already been added and opened.
+	ErrStoreAdded = errors.New("store already added")
+
+	// ErrWillNotAuthorized indicates that a connection was refused because
+	// the client is not allowed to publish to the topic of its will message.
+	ErrWillNotAuthorized = errors.New("will topic not authorized")
+
+	// ErrInvalidTopicRewrite indicates that a topic rewrite rule sets neither
+	// a prefix nor a pattern, or that its pattern is not a valid regular expression.
+	ErrInvalidTopicRewrite = errors.New("invalid topic rewrite")
+
+	// ErrACLCheckFailed indicates that the auth controller could not check the
+	// access of a client to a topic, such as when its backend is unreachable.
+	ErrACLCheckFailed = errors.New("acl check failed")
+
+	// ErrKeepaliveTimeout indicates that a client was disconnected because
+	// nothing was received from it within one and a half times its keepalive.
+	ErrKeepaliveTimeout = errors.New("client keepalive timed out")
+
 	// SysTopicInterval is the number of milliseconds between $SYS topic publishes.
 	SysTopicInterval time.Duration = 30000
 
@@ -69,28 +267,392 @@ var (
 	// interval between inflight resend attempts.
 	inflightResendBackoff = []int64{0, 1, 2, 10, 60, 120, 600, 3600, 21600}
 
-	// inflightMaxResends is the maximum number of times to try resending QoS promises.
+	// inflightMaxResends is the default maximum number of times to try resending QoS promises.
 	inflightMaxResends = 6
+
+	// drainPollInterval is the interval at which draining clients are checked
+	// for unacknowledged inflight messages.
+	drainPollInterval = 50 * time.Millisecond
 )
 
 // Server is an MQTT broker server. It should be created with server.New()
 // in order to ensure all the internal fields are correctly populated.
 type Server struct {
-	inline               inlineMessages       // channels for direct publishing.
-	Events               events.Events        // overrideable event hooks.
-	Store                persistence.Store    // a persistent storage backend if desired.
-	Options              *Options             // configurable server options.
-	Listeners            *listeners.Listeners // listeners are network interfaces which listen for new connections.
-	Clients              *clients.Clients     // clients which are known to the broker.
-	Topics               *topics.Index        // an index of topic filter subscriptions and retained messages.
-	System               *system.Info         // values about the server commonly found in $SYS topics.
-	bytepool             *circ.BytesPool      // a byte pool for incoming and outgoing packets.
-	sysTicker            *time.Ticker         // the interval ticker for sending updating $SYS topics.
-	inflightExpiryTicker *time.Ticker         // the interval ticker for cleaning up expired messages.
-	inflightResendTicker *time.Ticker         // the interval ticker for resending unresolved inflight messages.
-	done                 chan bool            // indicate that the server is ending.
+	inline               inlineMessages                      // channels for direct publishing.
+	Events               events.Events                       // overrideable event hooks.
+	hooks                events.Hooks                        // extension hooks, called in the order they were added.
+	Store                persistence.Store                   // a persistent storage backend if desired.
+	retainedStore        persistence.RetainedStore           // a separate persistent storage backend for retained messages, if desired.
+	writeBehind          *persistence.WriteBehind            // the write-behind queue of the store, if enabled.
+	timedStore           *persistence.Timed                  // the store timing each call to the backend, if enabled.
+	Options              *Options                            // configurable server options.
+	Listeners            *listeners.Listeners                // listeners are network interfaces which listen for new connections.
+	Clients              *clients.Clients                    // clients which are known to the broker.
+	Topics               *topics.Index                       // an index of topic filter subscriptions and retained messages.
+	System               *system.Info                        // values about the server commonly found in $SYS topics.
+	bytepool             *circ.BytesPool                     // a byte pool for incoming and outgoing packets.
+	sysTicker            *time.Ticker                        // the interval ticker for sending updating $SYS topics.
+	inflightExpiryTicker *time.Ticker                        // the interval ticker for cleaning up expired messages.
+	inflightResendTicker *time.Ticker                        // the interval ticker for resending unresolved inflight messages.
+	retainedExpiryTicker *time.Ticker                        // the interval ticker for cleaning up expired retained messages.
+	sessionExpiryTicker  *time.Ticker                        // the interval ticker for cleaning up expired sessions.
+	connSweepTicker      *time.Ticker                        // the interval ticker for closing idle connections.
+	done                 chan bool                           // indicate that the server is ending.
+	started              time.Time                           // the time the server was started.
+	maxInflight          int64                               // the maximum number of inflight messages per client (0 is unlimited).
+	maxSubscriptions     int64                               // the maximum number of subscriptions per client (0 is unlimited).
+	inflightSeq          int64                               // the sequence number of the most recently stored inflight message.
+	draining             uint32                              // indicates that the server is draining and refusing new connections.
+	redirect             string                              // the server reference new clients are redirected to, if any.
+	redirectPermanent    bool                                // indicates the redirect is permanent (server moved) rather than temporary.
+	redirectMu           sync.RWMutex                        // a mutex for the redirect.
+	sharedNext           map[string]int                      // the next round robin position for each shared subscription.
+	sharedMu             sync.Mutex                          // a mutex for the shared subscription round robin positions.
+	rateLimits           map[string]*rateLimiter             // publish rate limiters keyed on topic filter.
+	rateLimitsMu         sync.RWMutex                        // a mutex for the publish rate limiters.
+	transforms           map[string]PayloadTransform         // payload transforms keyed on topic prefix.
+	deliveryFilters      map[string]deliveryFilterSet        // delivery filters keyed on client id.
+	deliveryFiltersMu    sync.RWMutex                        // a mutex for the delivery filters.
+	deliveryFilterSlots  chan struct{}                       // a semaphore bounding the number of delivery filters running at once.
+	dedups               map[string]*dedup.Window            // message deduplication windows keyed on topic prefix.
+	dedupProps           map[string]string                   // the user property holding the message ids of each deduplication window.
+	dedupsMu             sync.RWMutex                        // a mutex for the deduplication windows.
+	lastValues           map[string]*lastvalue.Cache         // last value caches keyed on topic prefix.
+	lastValuesMu         sync.RWMutex                        // a mutex for the last value caches.
+	topicRewrites        []topicRewriter                     // the topic rewrite rules, in the order they are tried.
+	topicRewritesMu      sync.RWMutex                        // a mutex for the topic rewrite rules.
+	transformsMu         sync.RWMutex                        // a mutex for the payload transforms.
+	wills                map[string]*time.Timer              // timers for will messages waiting on a will delay interval, keyed on client id.
+	willsMu              sync.Mutex                          // a mutex for the will timers.
+	settings             map[string]*listenerSettings        // the settings which override the server options, keyed on listener id.
+	settingsMu           sync.RWMutex                        // a mutex for the listener settings.
+	publishers           map[*clients.Client]*publishLimiter // the publish rate limiters and meters of connected clients.
+	publishersMu         sync.RWMutex                        // a mutex for the client publish rate limiters.
+	serving              bool                                // indicates that Serve has been called, so added listeners are served at once.
+	servingMu            sync.Mutex                          // a mutex for serving, held while listeners are added, started, or removed.
+	handshakes           map[*clients.Client]time.Time       // connections yet to complete their CONNECT, and when they were opened.
+	handshakesMu         sync.Mutex                          // a mutex for the pending handshakes.
+	replays              map[*clients.Client]*retainedReplay // retained messages waiting to be sent to clients in batches.
+	replaysMu            sync.Mutex                          // a mutex for the retained replays.
+	clientIDs            *clientIDMatcher                    // the compiled client id filter.
+	clientIDsMu          sync.RWMutex                        // a mutex for the client id filter.
+	aclCache             *aclcache.Cache                     // cached acl results, if enabled.
+	takeoverMu           sync.Mutex                          // serialises new connections replacing existing clients, so each takes over from the last.
+	storeErr             error                               // the error returned when the store was opened, if any.
+	lastStorageErr       error                               // the last error returned by the store.
+	failingOps           map[string]bool                     // the store methods whose last call failed.
+	storeFailing         int32                               // the number of failing store methods, read without the lock.
+	storeErrMu           sync.RWMutex                        // a mutex for the store errors.
+}
+
+// retainedReplay is a queue of retained messages waiting to be sent to a
+// client in batches.
+type retainedReplay struct {
+	pending []packets.Packet // the messages still to be sent.
+}
+
+// InflightOverflow determines what happens when a client exceeds the maximum
+// number of inflight messages.
+type InflightOverflow int
+
+const (
+	// InflightDrop drops any new QoS 1 and 2 messages for the client until
+	// its inflight messages have been acknowledged.
+	InflightDrop InflightOverflow = iota
+
+	// InflightDisconnect disconnects the client.
+	InflightDisconnect
+)
+
+// ClientIDConflict determines what happens when a client connects with the
+// client id of a client which is already connected.
+type ClientIDConflict int
+
+const (
+	// ClientIDTakeover disconnects the existing client, and the new client
+	// takes over its session. MQTT v5 clients are sent a DISCONNECT with the
+	// session taken over reason code.
+	ClientIDTakeover ClientIDConflict = iota
+
+	// ClientIDRejectNew refuses the new connection with the client identifier
+	// not valid reason code, and the existing client stays connected.
+	ClientIDRejectNew
+)
+
+// SlowConsumer determines what happens to messages for a client whose write
+// buffer has reached the high-water mark.
+type SlowConsumer int
+
+const (
+	// SlowConsumerBlock waits for space in the client's write buffer, which
+	// blocks the goroutine publishing the message.
+	SlowConsumerBlock SlowConsumer = iota
+
+	// SlowConsumerDrop drops QoS 0 messages for the client. QoS 1 and 2 messages
+	// are kept inflight without being written, and are resent once they are due.
+	SlowConsumerDrop
+
+	// SlowConsumerDisconnect disconnects the client.
+	SlowConsumerDisconnect
+)
+
+// StoreSaturation determines what happens to QoS 1 and 2 publishes from clients
+// while the write-behind queue of the store is full.
+type StoreSaturation int
+
+const (
+	// StoreSaturationWait accepts the publishes, and their writes wait for space
+	// in the queue for up to the Wait of the write-behind options.
+	StoreSaturationWait StoreSaturation = iota
+
+	// StoreSaturationReject rejects the publishes until the queue has space.
+	// MQTT v5 clients are sent the quota exceeded reason code, and MQTT v3
+	// clients are not acknowledged, so that they resend the message.
+	StoreSaturationReject
+)
+
+// RateLimitAction determines what happens to a publish which exceeds a topic rate limit.
+type RateLimitAction int
+
+const (
+	// RateLimitDrop drops publishes which exceed the rate limit.
+	RateLimitDrop RateLimitAction = iota
+
+	// RateLimitThrottle delays processing further packets from the client
+	// until the publish is within the rate limit.
+	RateLimitThrottle
+
+	// RateLimitDisconnect drops the publish and disconnects the client.
+	RateLimitDisconnect
+)
+
+// RateLimit is a publish rate limit for a topic filter, applied with a token bucket.
+type RateLimit struct {
+	Rate   float64         // the sustained number of messages per second.
+	Burst  int             // the number of messages which may exceed the rate at once (minimum 1).
+	Action RateLimitAction // what to do with publishes which exceed the limit.
+}
+
+// DedupWindow suppresses messages which are published again with a message id
+// already seen within the window, such as by a publisher which resends its
+// messages when it reconnects.
+type DedupWindow struct {
+	Property string        // the user property holding the message id. If empty, the correlation data is used.
+	TTL      time.Duration // how long a message id is remembered. If 0, ids are remembered for a minute.
+	Size     int           // the maximum number of ids remembered, forgetting the oldest first. If 0, 10000 are remembered.
+}
+
+// LastValueCache remembers the last message published to each topic without the
+// retain flag, and replays it to clients which subscribe to the topic soon after,
+// as though it had been retained.
+type LastValueCache struct {
+	TTL  time.Duration // how long the last message of a topic is remembered. If 0, messages are remembered for a minute.
+	Size int           // the maximum number of topics remembered, forgetting the least recently published first. If 0, 10000 are remembered.
+}
+
+// TopicRewrite is a rule which rewrites the topics of messages published by
+// clients before they are routed, and optionally the filters which clients
+// subscribe and unsubscribe with.
+type TopicRewrite struct {
+	Prefix    string // rewrites topics beginning with the prefix, replacing it with Replace.
+	Pattern   string // rewrites topics matching the regular expression, replacing the leftmost match with Replace. Used instead of Prefix if set.
+	Replace   string // the replacement, which may refer to the submatches of a Pattern as $1 or ${name}.
+	Subscribe bool   // also rewrite the filters of subscriptions and unsubscriptions.
+}
+
+// topicRewriter is a compiled topic rewrite rule.
+type topicRewriter struct {
+	rule TopicRewrite   // the rule being applied.
+	re   *regexp.Regexp // the compiled pattern of the rule, if it has one.
+}
+
+// rewrite returns a topic rewritten by the rule, or false if the rule does not
+// match the topic.
+func (r topicRewriter) rewrite(topic string) (string, bool) {
+	if r.re == nil {
+		if !strings.HasPrefix(topic, r.rule.Prefix) {
+			return topic, false
+		}
+
+		return r.rule.Replace + topic[len(r.rule.Prefix):], true
+	}
+
+	m := r.re.FindStringSubmatchIndex(topic)
+	if m == nil {
+		return topic, false
+	}
+
+	return topic[:m[0]] + string(r.re.ExpandString(nil, r.rule.Replace, topic, m)) + topic[m[1]:], true
+}
+
+// rateLimiter applies a rate limit to publishes matching a topic filter.
+type rateLimiter struct {
+	dropped int64             // the number of publishes dropped by the limiter (access atomically).
+	limit   RateLimit         // the rate limit being applied.
+	bucket  *ratelimit.Bucket // the token bucket shared by all matching publishes.
 }
 
+// listenerSettings are the settings of a listener which override or extend the
+// server options. They are not changed once the listener has been added.
+type listenerSettings struct {
+	packetSize     uint32       // the maximum packet size (0 is the server option).
+	topicLimit     topicLimit   // the maximum topic levels and length (0 is the server option).
+	timeouts       ioTimeouts   // the connection read and write timeouts (zero is the defaults).
+	keepalive      uint16       // the maximum client keepalive (0 is unlimited).
+	clientIDRule   clientIDRule // the client id restrictions.
+	maxQos         byte         // the maximum qos for publishes and subscriptions.
+	retainDisabled bool         // indicates that clients may not retain messages.
+	connLimit      *connLimiter // the connection limits, if any.
+	publishLimit   publishLimit // the publish rate limit of each connection.
+}
+
+// ioTimeouts are the read and write timeouts of the connections to a listener.
+type ioTimeouts struct {
+	read  time.Duration // how long a client may go without sending a complete packet (0 is none).
+	write time.Duration // how long each write to a client may take (0 is none).
+}
+
+// clientIDRule restricts the client ids accepted by a listener.
+type clientIDRule struct {
+	maxLength int  // the longest client id in bytes (0 is the spec limit).
+	strict    bool // only accept the client ids the MQTT 3.1.1 spec requires.
+}
+
+// connLimiter applies the connection limits of a listener.
+type connLimiter struct {
+	sync.Mutex
+	bucket *ratelimit.Bucket // the token bucket for new connections, if rate limited.
+	wait   time.Duration     // the longest a connection may be delayed by the rate limit.
+	perIP  int               // the maximum concurrent connections from a single ip (0 is unlimited).
+	ips    map[string]int    // the number of open connections from each ip.
+}
+
+// publishLimit is the rate at which each client connecting to a listener may
+// publish, where a rate of 0 is unlimited.
+type publishLimit struct {
+	rate      float64       // the messages per second.
+	burst     int           // the messages which may be published at once.
+	byteRate  float64       // the payload bytes per second.
+	byteBurst int           // the payload bytes which may be published at once.
+	maxDelay  time.Duration // the longest a publish may be delayed (0 is unlimited).
+}
+
+// publishLimiter limits and measures the rate at which a client publishes.
+type publishLimiter struct {
+	messages    *ratelimit.Bucket // the token bucket for messages, if limited.
+	bytes       *ratelimit.Bucket // the token bucket for payload bytes, if limited.
+	maxDelay    time.Duration     // the longest a publish may be delayed (0 is unlimited).
+	messageRate ratelimit.Meter   // the messages published per second.
+	byteRate    ratelimit.Meter   // the payload bytes published per second.
+}
+
+// PayloadTransform rewrites the messages published to topics beginning with a
+// registered prefix, such as to compress payloads. The methods receive a copy
+// of the packet, including its QoS and MQTT v5 content type and payload format
+// properties, and return the packet to use in its place. The payload and
+// properties of the received packet are shared, so they must be replaced
+// rather than modified in place.
+type PayloadTransform interface {
+	// Encode is called with each message received from a publisher, before it
+	// is retained, stored or forwarded.
+	Encode(cl events.Client, pk events.Packet) (events.Packet, error)
+
+	// Decode is called with each message before it is sent to a subscriber,
+	// including retained messages. It may return the packet unchanged, such as
+	// for subscribers which accept encoded payloads.
+	Decode(cl events.Client, pk events.Packet) (events.Packet, error)
+}
+
+// DeliveryFilter decides whether a message published to a topic matching a
+// subscription is delivered to the subscribing client, returning false to skip
+// the message for that client only. Filters are run on a bounded pool of
+// goroutines, so they may be called concurrently for different messages, and
+// must not modify the packet. If a filter has not returned once the
+// DeliveryFilterTimeout has elapsed, the message is delivered and the context
+// is done; filters which block should return when it is, to free their worker.
+type DeliveryFilter func(ctx context.Context, cl events.Client, pk events.Packet) bool
+
+// deliveryFilterSet is the delivery filters of a client, keyed on subscription filter.
+type deliveryFilterSet map[string]DeliveryFilter
+
+// JSONPathFilter returns a DeliveryFilter which decodes the payload of each
+// message as JSON, and delivers the message if the value at a dotted path, such
+// as "sensor.readings.0.temp", satisfies match. Array elements are selected by
+// index. Messages which are not JSON or lack the path are not delivered.
+// Values are passed to match as decoded by encoding/json, so numbers are float64.
+func JSONPathFilter(path string, match func(v interface{}) bool) DeliveryFilter {
+	keys := strings.Split(path, ".")
+	return func(ctx context.Context, cl events.Client, pk events.Packet) bool {
+		var v interface{}
+		if err := json.Unmarshal(pk.Payload, &v); err != nil {
+			return false
+		}
+
+		for _, k := range keys {
+			switch t := v.(type) {
+			case map[string]interface{}:
+				var ok bool
+				if v, ok = t[k]; !ok {
+					return false
+				}
+			case []interface{}:
+				i, err := strconv.Atoi(k)
+				if err != nil || i < 0 || i >= len(t) {
+					return false
+				}
+				v = t[i]
+			default:
+				return false
+			}
+		}
+
+		return match(v)
+	}
+}
+
+// ClientIDFilter contains patterns which the client ids of connecting clients
+// are checked against, before they are authenticated. Patterns are globs, where
+// * matches any run of characters and ? matches any single character, unless
+// they are enclosed in slashes, such as /^sensor-[0-9]+$/, in which case they
+// are regular expressions.
+type ClientIDFilter struct {
+	Allow []string // if not empty, only client ids matching one of the patterns may connect.
+	Deny  []string // client ids matching any of the patterns may not connect, even if allowed.
+}
+
+// clientIDMatcher is a compiled client id filter.
+type clientIDMatcher struct {
+	allow   []*regexp.Regexp // the compiled allow patterns.
+	deny    []*regexp.Regexp // the compiled deny patterns.
+	denyAll bool             // deny all client ids, if the configured filter was invalid.
+}
+
+// SharedStrategy determines how a share group member is selected to receive
+// a message published to a shared subscription.
+type SharedStrategy int
+
+const (
+	// SharedRoundRobin delivers messages to each member of a share group in turn.
+	SharedRoundRobin SharedStrategy = iota
+
+	// SharedRandom delivers messages to a randomly selected member of a share group.
+	SharedRandom
+)
+
+// StateImport determines how the records of an imported state are combined
+// with those already held by the store.
+type StateImport int
+
+const (
+	// StateMerge adds the imported records to those held by the store,
+	// replacing any with the same ids.
+	StateMerge StateImport = iota
+
+	// StateReplace deletes the records held by the store before the imported
+	// records are written.
+	StateReplace
+)
+
 // Options contains configurable options for the server.
 type Options struct {
 	// BufferSize overrides the default buffer size (circ.DefaultBufferSize) for the client buffers.
@@ -101,6 +663,236 @@ type Options struct {
 
 	// InflightTTL specifies the duration that a queued inflight message should exist before being purged.
 	InflightTTL int64
+
+	// InflightTTLForQoS overrides InflightTTL for the inflight messages of a qos,
+	// keyed on qos. Values less than 1 are ignored.
+	InflightTTLForQoS map[byte]int64
+
+	// MaxInflight is the maximum number of unacknowledged QoS 1 and 2 messages which
+	// may be inflight to a single client. 0 is unlimited.
+	MaxInflight int
+
+	// InflightOverflow determines how clients which exceed MaxInflight are handled.
+	InflightOverflow InflightOverflow
+
+	// WriteHighWater is the number of bytes waiting in a client's write buffer
+	// at which it is treated as a slow consumer. It should be less than the
+	// size of the buffer. 0 disables the check, so writes wait for space.
+	WriteHighWater int
+
+	// SlowConsumer determines how messages for clients which have reached the
+	// WriteHighWater mark are handled.
+	SlowConsumer SlowConsumer
+
+	// MaxSubscriptions is the maximum number of subscription filters a single
+	// client may hold, including those restored with its session. 0 is unlimited.
+	MaxSubscriptions int
+
+	// InflightResendInterval is the number of seconds an unacknowledged QoS 1 or 2
+	// message waits before it is resent with the DUP flag set, and how often inflight
+	// messages are checked. If 0, messages are resent on an increasing backoff.
+	InflightResendInterval int64
+
+	// InflightMaxResends is the number of times an unacknowledged message is resent
+	// before it is dropped. If 0, the default of 6 is used.
+	InflightMaxResends int
+
+	// RetainedSweepInterval specifies the number of seconds between sweeps which delete
+	// retained messages whose message expiry interval has lapsed.
+	RetainedSweepInterval int64
+
+	// SysTopicInterval specifies the number of seconds between publishes of the
+	// $SYS topics. If 0, the package SysTopicInterval is used.
+	SysTopicInterval int64
+
+	// SysTopics limits the $SYS topics which are published to those matching any
+	// of the given topic filters, such as "$SYS/broker/clients/#". If empty, all
+	// $SYS topics are published.
+	SysTopics []string
+
+	// SessionSweepInterval specifies the number of seconds between sweeps which
+	// delete the sessions of disconnected clients whose session expiry interval
+	// has lapsed.
+	SessionSweepInterval int64
+
+	// HandshakeTimeout is the number of seconds a new connection has to complete
+	// its CONNECT, including any enhanced authentication, before it is closed.
+	// If 0, the default of 10 seconds is used.
+	HandshakeTimeout int64
+
+	// ConnectionSweepInterval specifies the number of seconds between sweeps which
+	// close connections that have exceeded the handshake timeout, or sent nothing
+	// for one and a half times their keepalive. If 0, connections are swept every second.
+	ConnectionSweepInterval int64
+
+	// RetainedBatchSize is the number of retained messages sent to a client in
+	// each batch when it subscribes. If 0, all the matching retained messages are
+	// sent at once, before the subscription is processed.
+	RetainedBatchSize int
+
+	// RetainedBatchDelay is how long to wait between batches of retained messages.
+	RetainedBatchDelay time.Duration
+
+	// ClientIDFilter rejects connections by client id, using glob or regular
+	// expression patterns. It may be changed at runtime with SetClientIDFilter.
+	ClientIDFilter ClientIDFilter
+
+	// ClientIDConflict determines whether a client connecting with the client
+	// id of a connected client takes over its session, or is refused.
+	ClientIDConflict ClientIDConflict
+
+	// ClientIDGenerator returns the client id assigned to clients which connect
+	// with an empty client id. The id is returned to MQTT v5 clients in the
+	// CONNACK as their assigned client identifier. Generated ids must be unique,
+	// or the client will take over the session of the existing client. If nil,
+	// a random UUID is used.
+	ClientIDGenerator func() string
+
+	// Auth is the default auth controller, used by listeners which are added
+	// without one of their own in their listeners.Config.
+	Auth auth.Controller
+
+	// AllowAnonymous admits clients which connect without a username without
+	// authenticating them with the auth controller, whose ACL checks still
+	// apply to them. Clients which send a username are always authenticated.
+	AllowAnonymous bool
+
+	// CheckWillACL refuses connections which set a will message on a topic the
+	// auth controller does not allow the client to publish to. When false, will
+	// messages are only checked against the ACL when they are published.
+	CheckWillACL bool
+
+	// ACLCacheSize is the maximum number of ACL results cached, keyed on the
+	// listener, username, topic and direction of each check. 0 disables caching.
+	ACLCacheSize int
+
+	// ACLCacheTTL is how long a cached ACL result is used before the auth
+	// controller is asked again. If 0, results are cached for a minute.
+	ACLCacheTTL time.Duration
+
+	// SharedStrategy determines how members of a share group are selected to
+	// receive messages published to a shared subscription.
+	SharedStrategy SharedStrategy
+
+	// RateLimits are publish rate limits keyed on topic filter. Limits apply to
+	// the total rate of publishes by all clients to topics matching the filter.
+	RateLimits map[string]RateLimit
+
+	// Transforms are payload transforms keyed on topic prefix. Messages published
+	// to topics without a matching prefix are not transformed.
+	Transforms map[string]PayloadTransform
+
+	// DeliveryFilterTimeout is how long a delivery filter may take to decide
+	// whether a message is delivered, after which the message is delivered
+	// without waiting for the filter, and the context passed to the filter is
+	// done. Default 10ms.
+	DeliveryFilterTimeout time.Duration
+
+	// DeliveryFilterWorkers is the number of delivery filters which may be
+	// running at once, including filters which have timed out but not yet
+	// returned. Default 64.
+	DeliveryFilterWorkers int
+
+	// Dedup are message deduplication windows keyed on topic prefix. Messages
+	// published to topics without a matching prefix are not deduplicated.
+	Dedup map[string]DedupWindow
+
+	// LastValues are last value caches keyed on topic prefix. The last messages
+	// published to topics without a matching prefix are not replayed.
+	LastValues map[string]LastValueCache
+
+	// TopicRewrites are rules which rewrite the topics of messages published by
+	// clients, tried in order until one matches. They may be replaced at
+	// runtime with SetTopicRewrites.
+	TopicRewrites []TopicRewrite
+
+	// SharedRedeliver redelivers the unacknowledged QoS messages of a share group
+	// member to the other members of the group when it unsubscribes or disconnects.
+	SharedRedeliver bool
+
+	// MaxRetainedBytes is the maximum total payload size in bytes of the retained
+	// messages. When it is exceeded, the oldest retained messages are evicted
+	// until the total is under the limit. 0 is unlimited.
+	MaxRetainedBytes int64
+
+	// MaxRetainedMessageBytes is the maximum payload size in bytes of a single
+	// retained message. Larger messages are delivered but not retained, and clear
+	// any message already retained on the topic. 0 is unlimited.
+	MaxRetainedMessageBytes int
+
+	// MaxPacketSize is the maximum size in bytes of packets accepted from clients,
+	// and is advertised to MQTT v5 clients in the CONNACK. 0 is unlimited. The
+	// limit may be overridden for each listener with listeners.Config.
+	MaxPacketSize uint32
+
+	// MaxTopicLevels is the maximum number of levels in the topics clients may
+	// publish to and the filters they may subscribe to, which bounds the depth
+	// of the subscription trie. 0 is unlimited. The limit may be overridden for
+	// each listener with listeners.Config.
+	MaxTopicLevels int
+
+	// MaxTopicLength is the maximum length in bytes of the topics clients may
+	// publish to and the filters they may subscribe to. 0 is unlimited, other
+	// than the 65535 bytes allowed by the spec. The limit may be overridden for
+	// each listener with listeners.Config.
+	MaxTopicLength int
+
+	// TopicAliasMaximum is the highest topic alias MQTT v5 clients may use when
+	// publishing, and is advertised to them in the CONNACK. 0 disables inbound
+	// topic aliases. Outbound aliases are used for any client which accepts them.
+	TopicAliasMaximum uint16
+
+	// ReceiveMaximum is the maximum number of unacknowledged QoS 2 messages an
+	// MQTT v5 client may send at once, and is advertised to them in the CONNACK.
+	// Clients which exceed it are disconnected. 0 is unlimited.
+	ReceiveMaximum uint16
+
+	// ResponseInformation is the base topic of the Response Information sent
+	// in the CONNACK to MQTT v5 clients which request it, to which the client
+	// id is appended, such as "responses" for "responses/client1". If empty,
+	// no Response Information is sent.
+	ResponseInformation string
+
+	// Compression enables the deflate compression of publish payloads sent to
+	// and from MQTT v5 clients which list it in the compression user property
+	// of their CONNECT. Payloads which would not be made smaller are sent as-is.
+	Compression bool
+
+	// MaxInflatedPayload is the maximum size in bytes that compressed payloads
+	// received from clients may be inflated to, when it is lower than the
+	// maximum packet size of the listener. Default 268435455, the largest
+	// packet allowed by the spec.
+	MaxInflatedPayload uint32
+
+	// Logger receives structured logs of server events, such as client
+	// connections, authentication failures, and persistence errors. If not
+	// set, nothing is logged.
+	Logger logger.Logger
+
+	// StateImport determines whether ImportState merges the imported records
+	// with those held by the store, or replaces them.
+	StateImport StateImport
+
+	// WriteBehind enables the write-behind mode of the store, if not nil. The
+	// writes and deletes of single records are queued and applied to the store
+	// in batches by a background writer, rather than on the path of each
+	// packet. Queued writes are applied before the store is closed, but are
+	// lost if the process exits without closing the server.
+	WriteBehind *persistence.WriteBehindOptions
+
+	// StoreFailClosed rejects QoS 1 and 2 publishes from clients while the
+	// store is failing, rather than accepting messages which may not be
+	// persisted. MQTT v5 clients are sent the quota exceeded reason code, and
+	// MQTT v3 clients are not acknowledged, so that they resend the message.
+	StoreFailClosed bool
+
+	// StoreSaturation determines what happens to QoS 1 and 2 publishes from
+	// clients while the write-behind queue of the store is full.
+	StoreSaturation StoreSaturation
+
+	// StoreLatency records the number of calls to each method of the store and
+	// the time they take, returned by server.StoreLatency.
+	StoreLatency bool
 }
 
 // inlineMessages contains channels for handling inline (direct) publishing.
@@ -126,24 +918,138 @@ func NewServer(opts *Options) *Server {
 		opts.InflightTTL = defaultInflightTTL
 	}
 
+	if opts.RetainedSweepInterval < 1 {
+		opts.RetainedSweepInterval = defaultRetainedSweepInterval
+	}
+
+	if opts.SessionSweepInterval < 1 {
+		opts.SessionSweepInterval = defaultSessionSweepInterval
+	}
+
+	if opts.HandshakeTimeout < 1 {
+		opts.HandshakeTimeout = defaultHandshakeTimeout
+	}
+
+	if opts.ConnectionSweepInterval < 1 {
+		opts.ConnectionSweepInterval = defaultConnectionSweepInterval
+	}
+
+	if opts.InflightMaxResends < 1 {
+		opts.InflightMaxResends = inflightMaxResends
+	}
+
+	if opts.DeliveryFilterTimeout <= 0 {
+		opts.DeliveryFilterTimeout = defaultDeliveryFilterTimeout
+	}
+
+	if opts.DeliveryFilterWorkers < 1 {
+		opts.DeliveryFilterWorkers = defaultDeliveryFilterWorkers
+	}
+
+	if opts.MaxInflatedPayload == 0 {
+		opts.MaxInflatedPayload = maxInflatedPayload
+	}
+
+	inflightScan := opts.InflightTTL
+	for _, ttl := range opts.InflightTTLForQoS {
+		if ttl > 0 && ttl < inflightScan {
+			inflightScan = ttl
+		}
+	}
+
+	resendScan := defaultInflightResendScan
+	if opts.InflightResendInterval > 0 {
+		resendScan = opts.InflightResendInterval
+	}
+
+	sysInterval := SysTopicInterval * time.Millisecond
+	if opts.SysTopicInterval > 0 {
+		sysInterval = time.Duration(opts.SysTopicInterval) * time.Second
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = logger.Nop{}
+	}
+
+	if opts.ClientIDGenerator == nil {
+		opts.ClientIDGenerator = utils.NewUUID
+	}
+
+	started := time.Now()
 	s := &Server{
 		done:     make(chan bool),
 		bytepool: circ.NewBytesPool(opts.BufferSize),
 		Clients:  clients.New(),
 		Topics:   topics.New(),
 		System: &system.Info{
-			Version: Version,
-			Started: time.Now().Unix(),
+			Version:      Version,
+			Started:      started.Unix(),
+			FirstStarted: started.Unix(),
 		},
-		sysTicker:            time.NewTicker(SysTopicInterval * time.Millisecond),
-		inflightExpiryTicker: time.NewTicker(time.Duration(opts.InflightTTL) * time.Second),
-		inflightResendTicker: time.NewTicker(time.Duration(10) * time.Second),
+		started:              started,
+		sysTicker:            time.NewTicker(sysInterval),
+		inflightExpiryTicker: time.NewTicker(time.Duration(inflightScan) * time.Second),
+		inflightResendTicker: time.NewTicker(time.Duration(resendScan) * time.Second),
+		retainedExpiryTicker: time.NewTicker(time.Duration(opts.RetainedSweepInterval) * time.Second),
+		sessionExpiryTicker:  time.NewTicker(time.Duration(opts.SessionSweepInterval) * time.Second),
+		connSweepTicker:      time.NewTicker(time.Duration(opts.ConnectionSweepInterval) * time.Second),
 		inline: inlineMessages{
 			done: make(chan bool),
 			pub:  make(chan packets.Packet, 4096),
 		},
-		Events:  events.Events{},
-		Options: opts,
+		Events:              events.Events{},
+		Options:             opts,
+		maxInflight:         int64(opts.MaxInflight),
+		maxSubscriptions:    int64(opts.MaxSubscriptions),
+		sharedNext:          map[string]int{},
+		rateLimits:          map[string]*rateLimiter{},
+		transforms:          map[string]PayloadTransform{},
+		deliveryFilters:     map[string]deliveryFilterSet{},
+		deliveryFilterSlots: make(chan struct{}, opts.DeliveryFilterWorkers),
+		failingOps:          map[string]bool{},
+		dedups:              map[string]*dedup.Window{},
+		dedupProps:          map[string]string{},
+		lastValues:          map[string]*lastvalue.Cache{},
+		wills:               map[string]*time.Timer{},
+		publishers:          map[*clients.Client]*publishLimiter{},
+		settings:            map[string]*listenerSettings{},
+		handshakes:          map[*clients.Client]time.Time{},
+		replays:             map[*clients.Client]*retainedReplay{},
+	}
+
+	if opts.ACLCacheSize > 0 {
+		ttl := opts.ACLCacheTTL
+		if ttl <= 0 {
+			ttl = time.Minute
+		}
+		s.aclCache = aclcache.New(opts.ACLCacheSize, ttl)
+	}
+
+	for filter, limit := range opts.RateLimits {
+		s.SetRateLimit(filter, limit)
+	}
+
+	for prefix, t := range opts.Transforms {
+		s.SetTransform(prefix, t)
+	}
+
+	for prefix, w := range opts.Dedup {
+		s.SetDedup(prefix, w)
+	}
+
+	for prefix, c := range opts.LastValues {
+		s.SetLastValues(prefix, c)
+	}
+
+	if err := s.SetTopicRewrites(opts.TopicRewrites); err != nil {
+		opts.Logger.Error("invalid topic rewrite, topics will not be rewritten", logger.KeyError, err)
+	}
+
+	// An invalid filter may have been intended to deny some clients, so
+	// rather than allow everyone, nobody is allowed until it is corrected.
+	if err := s.SetClientIDFilter(opts.ClientIDFilter); err != nil {
+		opts.Logger.Error("invalid client id filter, denying all clients", logger.KeyError, err)
+		s.clientIDs = &clientIDMatcher{denyAll: true}
 	}
 
 	// Expose server stats using the system listener so it can be used in the
@@ -153,111 +1059,1296 @@ func NewServer(opts *Options) *Server {
 	return s
 }
 
-// AddStore assigns a persistent storage backend to the server. This must be
-// called before calling server.Server().
-func (s *Server) AddStore(p persistence.Store) error {
-	s.Store = p
-	s.Store.SetInflightTTL(s.Options.InflightTTL)
+// MaxInflight returns the maximum number of inflight messages per client.
+func (s *Server) MaxInflight() int {
+	return int(atomic.LoadInt64(&s.maxInflight))
+}
 
-	err := s.Store.Open()
-	if err != nil {
-		return err
+// SetMaxInflight sets the maximum number of inflight messages per client. A value
+// of 0 or less removes the limit. Messages already inflight are not affected.
+func (s *Server) SetMaxInflight(n int) {
+	if n < 0 {
+		n = 0
 	}
+	atomic.StoreInt64(&s.maxInflight, int64(n))
+}
 
-	return nil
+// MaxSubscriptions returns the maximum number of subscriptions per client.
+func (s *Server) MaxSubscriptions() int {
+	return int(atomic.LoadInt64(&s.maxSubscriptions))
 }
 
-// AddListener adds a new network listener to the server.
-func (s *Server) AddListener(listener listeners.Listener, config *listeners.Config) error {
-	if _, ok := s.Listeners.Get(listener.ID()); ok {
-		return ErrListenerIDExists
+// SetMaxSubscriptions sets the maximum number of subscriptions per client. A
+// value of 0 or less removes the limit. Existing subscriptions are not affected,
+// but clients over the new limit cannot add more.
+func (s *Server) SetMaxSubscriptions(n int) {
+	if n < 0 {
+		n = 0
 	}
+	atomic.StoreInt64(&s.maxSubscriptions, int64(n))
+}
 
-	if config != nil {
-		listener.SetConfig(config)
+// SetRateLimit sets the publish rate limit for topics matching a filter,
+// replacing any existing limit for the filter. A limit with a rate of 0 or
+// less clears the limit.
+func (s *Server) SetRateLimit(filter string, limit RateLimit) {
+	if limit.Rate <= 0 {
+		s.ClearRateLimit(filter)
+		return
 	}
 
-	s.Listeners.Add(listener)
-	err := listener.Listen(s.System)
-	if err != nil {
-		return err
+	s.rateLimitsMu.Lock()
+	s.rateLimits[filter] = &rateLimiter{
+		limit:  limit,
+		bucket: ratelimit.NewBucket(limit.Rate, limit.Burst),
 	}
+	s.rateLimitsMu.Unlock()
+}
 
-	return nil
+// ClearRateLimit removes the publish rate limit for a filter.
+func (s *Server) ClearRateLimit(filter string) {
+	s.rateLimitsMu.Lock()
+	delete(s.rateLimits, filter)
+	s.rateLimitsMu.Unlock()
 }
 
-// Serve starts the event loops responsible for establishing client connections
-// on all attached listeners, and publishing the system topics.
-func (s *Server) Serve() error {
-	if s.Store != nil {
-		err := s.readStore()
-		if err != nil {
-			return err
-		}
+// InvalidateACL removes the cached ACL results of a user, so that their next
+// publishes and subscriptions are checked by the auth controller. It should be
+// called when the permissions of a user change, if ACL caching is enabled.
+func (s *Server) InvalidateACL(user string) {
+	if s.aclCache != nil {
+		s.aclCache.Invalidate(user)
 	}
+}
 
-	go s.eventLoop()                            // spin up event loop for issuing $SYS values and closing server.
-	go s.inlineClient()                         // spin up inline client for direct message publishing.
-	s.Listeners.ServeAll(s.EstablishConnection) // start listening on all listeners.
-	s.publishSysTopics()                        // begin publishing $SYS system values.
+// aclAllowed returns true if a client may publish or subscribe to a topic,
+// using a cached result where one is available. Controllers which make their
+// decisions using the user properties of the packet, or the identity the client
+// authenticated with, are never cached. If the
+// controller implements auth.ErrorController and the check fails, access is
+// denied and the failure is logged and returned, wrapping ErrACLCheckFailed,
+// so that the caller can report it to the client as a transient failure.
+// Failed checks are never cached.
+func (s *Server) aclAllowed(cl *clients.Client, topic string, write bool, props []packets.UserProperty) (bool, error) {
+	if pc, ok := cl.AC.(auth.PropertiesController); ok {
+		return pc.ACLProperties(cl.Username, topic, write, props), nil
+	}
 
-	return nil
-}
+	// Results which depend on the identity may differ between clients with
+	// the same username, so they are not cached.
+	cache := s.aclCache
+	if _, ok := cl.AC.(auth.IdentityController); ok {
+		cache = nil
+	}
 
-// eventLoop loops forever, running various server processes at different intervals.
-func (s *Server) eventLoop() {
-	for {
-		select {
-		case <-s.done:
-			s.sysTicker.Stop()
-			close(s.inline.done)
-			return
-		case <-s.sysTicker.C:
-			s.publishSysTopics()
-		case <-s.inflightExpiryTicker.C:
-			s.clearExpiredInflights(time.Now().Unix())
-		case <-s.inflightResendTicker.C:
-			s.resendPendingInflights()
-		}
+	key := aclcache.Key{
+		Listener: cl.Listener,
+		User:     string(cl.Username),
+		Topic:    topic,
+		Write:    write,
 	}
-}
 
-// inlineClient loops forever, sending directly-published messages
-// from the Publish method to subscribers.
-func (s *Server) inlineClient() {
-	for {
-		select {
-		case <-s.inline.done:
-			close(s.inline.pub)
-			return
-		case pk := <-s.inline.pub:
-			s.publishToSubscribers(pk)
+	now := time.Now()
+	if cache != nil {
+		if allowed, ok := cache.Get(key, now); ok {
+			return allowed, nil
 		}
 	}
-}
 
-// readConnectionPacket reads the first incoming header for a connection, and if
-// acceptable, returns the valid connection packet.
-func (s *Server) readConnectionPacket(cl *clients.Client) (pk packets.Packet, err error) {
-	fh := new(packets.FixedHeader)
-	err = cl.ReadFixedHeader(fh)
+	allowed, err := auth.WithIdentity(cl.AC).ACLIdentity(cl.Identity, cl.Username, topic, write)
 	if err != nil {
-		return
+		err = fmt.Errorf("%w: %v", ErrACLCheckFailed, err)
+		s.Options.Logger.Error("acl check failed", logFields(cl.Info(), logger.KeyTopic, topic, logger.KeyError, err)...)
+		return false, err
 	}
 
-	pk, err = cl.ReadPacket(fh)
-	if err != nil {
-		return
+	if cache != nil {
+		cache.Set(key, allowed, now)
 	}
 
-	if pk.FixedHeader.Type != packets.Connect {
-		return pk, ErrReadConnectInvalid
+	return allowed, nil
+}
+
+// SetTransform sets the payload transform for messages published to topics
+// beginning with prefix, replacing any existing transform for the prefix. Where
+// several prefixes match a topic, only the transform of the longest is applied.
+func (s *Server) SetTransform(prefix string, t PayloadTransform) {
+	if t == nil {
+		s.ClearTransform(prefix)
+		return
 	}
 
-	return
+	s.transformsMu.Lock()
+	s.transforms[prefix] = t
+	s.transformsMu.Unlock()
 }
 
-// onError is a pass-through method which triggers the OnError
+// ClearTransform removes the payload transform for a topic prefix.
+func (s *Server) ClearTransform(prefix string) {
+	s.transformsMu.Lock()
+	delete(s.transforms, prefix)
+	s.transformsMu.Unlock()
+}
+
+// SetDedup sets the message deduplication window for messages published to
+// topics beginning with prefix, replacing any existing window for the prefix
+// and forgetting the ids it had seen. Where several prefixes match a topic,
+// only the window of the longest is used.
+func (s *Server) SetDedup(prefix string, w DedupWindow) {
+	if w.TTL <= 0 {
+		w.TTL = time.Minute
+	}
+
+	if w.Size <= 0 {
+		w.Size = 10000
+	}
+
+	s.dedupsMu.Lock()
+	s.dedups[prefix] = dedup.New(w.Size, w.TTL)
+	s.dedupProps[prefix] = w.Property
+	s.dedupsMu.Unlock()
+}
+
+// ClearDedup removes the message deduplication window for a topic prefix.
+func (s *Server) ClearDedup(prefix string) {
+	s.dedupsMu.Lock()
+	delete(s.dedups, prefix)
+	delete(s.dedupProps, prefix)
+	s.dedupsMu.Unlock()
+}
+
+// duplicate returns true if a message carries a message id which has already
+// been seen by the deduplication window with the longest prefix matching its
+// topic. Messages without a message id are never duplicates.
+func (s *Server) duplicate(pk packets.Packet) bool {
+	s.dedupsMu.RLock()
+	var match string
+	var w *dedup.Window
+	for prefix, pw := range s.dedups {
+		if strings.HasPrefix(pk.TopicName, prefix) && (w == nil || len(prefix) > len(match)) {
+			match, w = prefix, pw
+		}
+	}
+	prop := s.dedupProps[match]
+	s.dedupsMu.RUnlock()
+
+	if w == nil {
+		return false
+	}
+
+	var id string
+	if prop == "" {
+		id = string(pk.Properties.CorrelationData)
+	} else {
+		for _, p := range pk.Properties.User {
+			if p.Key == prop {
+				id = p.Val
+				break
+			}
+		}
+	}
+
+	if id == "" || !w.Seen(id, time.Now()) {
+		return false
+	}
+
+	atomic.AddInt64(&s.System.PublishDeduplicated, 1)
+	return true
+}
+
+// SetLastValues sets the last value cache for messages published to topics
+// beginning with prefix, replacing any existing cache for the prefix and
+// forgetting the messages it held. Where several prefixes match a topic, only
+// the cache of the longest is used.
+func (s *Server) SetLastValues(prefix string, c LastValueCache) {
+	if c.TTL <= 0 {
+		c.TTL = time.Minute
+	}
+
+	if c.Size <= 0 {
+		c.Size = 10000
+	}
+
+	s.lastValuesMu.Lock()
+	s.lastValues[prefix] = lastvalue.New(c.Size, c.TTL)
+	s.lastValuesMu.Unlock()
+}
+
+// ClearLastValues removes the last value cache for a topic prefix.
+func (s *Server) ClearLastValues(prefix string) {
+	s.lastValuesMu.Lock()
+	delete(s.lastValues, prefix)
+	s.lastValuesMu.Unlock()
+}
+
+// noteLastValue remembers a message in the last value cache with the longest
+// prefix matching its topic. A retained message replaces the last value of its
+// topic, so the cache only ever holds messages newer than the retained message.
+func (s *Server) noteLastValue(pk packets.Packet) {
+	s.lastValuesMu.RLock()
+	var match string
+	var c *lastvalue.Cache
+	for prefix, pc := range s.lastValues {
+		if strings.HasPrefix(pk.TopicName, prefix) && (c == nil || len(prefix) > len(match)) {
+			match, c = prefix, pc
+		}
+	}
+	s.lastValuesMu.RUnlock()
+
+	if c == nil {
+		return
+	}
+
+	if pk.FixedHeader.Retain {
+		c.Delete(pk.TopicName)
+		return
+	}
+
+	out := pk.PublishCopy()
+	out.FixedHeader.Qos = pk.FixedHeader.Qos
+	if out.Created == 0 {
+		out.Created = time.Now().Unix()
+	}
+
+	c.Set(out, time.Now())
+}
+
+// lastValueMessages returns the messages in the last value caches with topics
+// matching a subscription filter.
+func (s *Server) lastValueMessages(filter string) []packets.Packet {
+	s.lastValuesMu.RLock()
+	caches := make([]*lastvalue.Cache, 0, len(s.lastValues))
+	for _, c := range s.lastValues {
+		caches = append(caches, c)
+	}
+	s.lastValuesMu.RUnlock()
+
+	var pks []packets.Packet
+	now := time.Now()
+	for _, c := range caches {
+		for _, pk := range c.Messages(now) {
+			if auth.MatchTopic(filter, pk.TopicName) {
+				pks = append(pks, pk)
+			}
+		}
+	}
+
+	return pks
+}
+
+// payloadTransform returns the transform with the longest prefix matching a topic.
+func (s *Server) payloadTransform(topic string) (PayloadTransform, bool) {
+	s.transformsMu.RLock()
+	defer s.transformsMu.RUnlock()
+
+	var match string
+	var t PayloadTransform
+	for prefix, pt := range s.transforms {
+		if strings.HasPrefix(topic, prefix) && (t == nil || len(prefix) > len(match)) {
+			match, t = prefix, pt
+		}
+	}
+
+	return t, t != nil
+}
+
+// encodePayload applies any transform registered for the topic of a message
+// received from a publisher. The error is returned if the message could not be
+// encoded, in which case it should be dropped.
+func (s *Server) encodePayload(cl events.Client, pk packets.Packet) (packets.Packet, error) {
+	t, ok := s.payloadTransform(pk.TopicName)
+	if !ok {
+		return pk, nil
+	}
+
+	pkx, err := t.Encode(cl, events.Packet(pk))
+	if err != nil {
+		return pk, fmt.Errorf("encode payload: %w", err)
+	}
+
+	return packets.Packet(pkx), nil
+}
+
+// decodePayload applies any transform registered for the topic of a message
+// being sent to a client. Messages which could not be decoded are not sent to
+// the client, and the error is passed to OnError.
+func (s *Server) decodePayload(cl *clients.Client, pk packets.Packet) (packets.Packet, bool) {
+	t, ok := s.payloadTransform(pk.TopicName)
+	if !ok {
+		return pk, true
+	}
+
+	pkx, err := t.Decode(cl.Info(), events.Packet(pk))
+	if err != nil {
+		s.onError(cl.Info(), fmt.Errorf("decode payload: %w", err))
+		return pk, false
+	}
+
+	return packets.Packet(pkx), true
+}
+
+// SetDeliveryFilter sets the delivery filter for a client's subscription to a
+// topic filter, replacing any existing delivery filter. Messages matching the
+// subscription are only delivered to the client if the filter returns true,
+// or if another of the client's subscriptions also matches the topic and has
+// no filter or one which returns true. Shared subscriptions are filtered on
+// the member chosen to receive a message. The filter is removed when the client
+// unsubscribes or its session ends.
+func (s *Server) SetDeliveryFilter(clientID, filter string, f DeliveryFilter) {
+	s.deliveryFiltersMu.Lock()
+	defer s.deliveryFiltersMu.Unlock()
+
+	if s.deliveryFilters[clientID] == nil {
+		s.deliveryFilters[clientID] = deliveryFilterSet{}
+	}
+	s.deliveryFilters[clientID][filter] = f
+}
+
+// ClearDeliveryFilter removes the delivery filter for a client's subscription
+// to a topic filter, so that all messages matching it are delivered.
+func (s *Server) ClearDeliveryFilter(clientID, filter string) {
+	s.deliveryFiltersMu.Lock()
+	defer s.deliveryFiltersMu.Unlock()
+
+	delete(s.deliveryFilters[clientID], filter)
+	if len(s.deliveryFilters[clientID]) == 0 {
+		delete(s.deliveryFilters, clientID)
+	}
+}
+
+// clearDeliveryFilters removes all the delivery filters for a client.
+func (s *Server) clearDeliveryFilters(clientID string) {
+	s.deliveryFiltersMu.Lock()
+	delete(s.deliveryFilters, clientID)
+	s.deliveryFiltersMu.Unlock()
+}
+
+// deliveryAllowed returns true if a message may be delivered to a client,
+// which is when any of the client's subscriptions matching the topic, or the
+// shared subscription filter if set, has no delivery filter or a delivery
+// filter which returns true.
+func (s *Server) deliveryAllowed(cl *clients.Client, pk packets.Packet, shared string) bool {
+	s.deliveryFiltersMu.RLock()
+	n := len(s.deliveryFilters[cl.ID])
+	s.deliveryFiltersMu.RUnlock()
+	if n == 0 {
+		return true
+	}
+
+	// The client's subscriptions are read before taking the lock, as the
+	// filters are cleared while the client is locked.
+	subs := []string{shared}
+	if shared == "" {
+		subs = cl.MatchingSubscriptions(pk.TopicName)
+	}
+
+	fs := make([]DeliveryFilter, 0, len(subs))
+	s.deliveryFiltersMu.RLock()
+	for _, sub := range subs {
+		f, ok := s.deliveryFilters[cl.ID][sub]
+		if !ok {
+			s.deliveryFiltersMu.RUnlock()
+			return true
+		}
+		fs = append(fs, f)
+	}
+	s.deliveryFiltersMu.RUnlock()
+
+	for _, f := range fs {
+		if s.runDeliveryFilter(cl, pk, f) {
+			return true
+		}
+	}
+
+	return len(fs) == 0
+}
+
+// runDeliveryFilter calls a delivery filter for a message, returning true if
+// the message should be delivered. The filter is run on a worker of the bounded
+// delivery filter pool, and the caller waits at most the DeliveryFilterTimeout
+// for a free worker and the result, so that a filter which ignores its context
+// cannot stall delivery to other subscribers. Filters which panic or which do
+// not return in time deliver the message, so that a faulty or slow filter
+// cannot lose deliveries, and the result of a filter which returns late is
+// discarded.
+func (s *Server) runDeliveryFilter(cl *clients.Client, pk packets.Packet, f DeliveryFilter) bool {
+	info := cl.Info()
+	ctx, cancel := context.WithTimeout(context.Background(), s.Options.DeliveryFilterTimeout)
+
+	select {
+	case s.deliveryFilterSlots <- struct{}{}:
+	case <-ctx.Done():
+		cancel()
+		s.Options.Logger.Warn("delivery filter timed out", logFields(info, logger.KeyTopic, pk.TopicName)...)
+		return true
+	}
+
+	res := make(chan bool, 1)
+	go func() {
+		defer func() {
+			<-s.deliveryFilterSlots
+			cancel()
+		}()
+
+		defer func() {
+			if r := recover(); r != nil {
+				s.Options.Logger.Error("delivery filter panicked", logFields(info, logger.KeyTopic, pk.TopicName, logger.KeyError, r)...)
+				res <- true
+			}
+		}()
+
+		res <- f(ctx, info, events.Packet(pk))
+	}()
+
+	select {
+	case ok := <-res:
+		return ok
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return <-res // the filter returned before the deadline, releasing its context.
+		}
+
+		s.Options.Logger.Warn("delivery filter timed out", logFields(info, logger.KeyTopic, pk.TopicName)...)
+		return true
+	}
+}
+
+// SetTopicRewrites replaces the topic rewrite rules, which are tried in order
+// until one matches the topic of a message. If any rule is invalid, an error
+// wrapping ErrInvalidTopicRewrite is returned and the existing rules are kept.
+// Subscriptions already made with a rewritten filter are not affected.
+func (s *Server) SetTopicRewrites(rules []TopicRewrite) error {
+	rw := make([]topicRewriter, 0, len(rules))
+	for i, rule := range rules {
+		r := topicRewriter{rule: rule}
+		switch {
+		case rule.Pattern != "":
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("%w: rule %d: %v", ErrInvalidTopicRewrite, i, err)
+			}
+			r.re = re
+		case rule.Prefix == "":
+			return fmt.Errorf("%w: rule %d: no prefix or pattern", ErrInvalidTopicRewrite, i)
+		}
+
+		rw = append(rw, r)
+	}
+
+	s.topicRewritesMu.Lock()
+	s.topicRewrites = rw
+	s.topicRewritesMu.Unlock()
+	return nil
+}
+
+// rewriteTopic returns a topic rewritten by the first topic rewrite rule which
+// matches it, or false if no rule matches. If subscribe is true, only the rules
+// which apply to subscriptions are tried.
+func (s *Server) rewriteTopic(topic string, subscribe bool) (string, bool) {
+	s.topicRewritesMu.RLock()
+	defer s.topicRewritesMu.RUnlock()
+
+	for _, r := range s.topicRewrites {
+		if subscribe && !r.rule.Subscribe {
+			continue
+		}
+
+		if t, ok := r.rewrite(topic); ok {
+			return t, true
+		}
+	}
+
+	return topic, false
+}
+
+// rewriteFilter returns a subscription filter rewritten by the topic rewrite
+// rules which apply to subscriptions, keeping the share group of a shared
+// subscription. Filters which would be invalid once rewritten are unchanged.
+func (s *Server) rewriteFilter(cl *clients.Client, filter string) string {
+	prefix, f := "", filter
+	if group, sf, ok := topics.ParseShared(filter); ok {
+		prefix, f = topics.SharePrefix+group+"/", sf
+	}
+
+	rf, ok := s.rewriteTopic(f, true)
+	if !ok {
+		return filter
+	}
+
+	if err := ValidateTopicFilter(rf); err != nil {
+		s.Options.Logger.Warn("invalid rewritten filter", logFields(cl.Info(), logger.KeyFilter, filter, logger.KeyError, err)...)
+		return filter
+	}
+
+	return prefix + rf
+}
+
+// SetClientIDFilter replaces the patterns which the client ids of connecting
+// clients are checked against. If any pattern is invalid, an error is returned
+// and the existing filter is kept. Clients already connected are not affected.
+func (s *Server) SetClientIDFilter(f ClientIDFilter) error {
+	m := new(clientIDMatcher)
+	var err error
+	if m.allow, err = compileClientIDPatterns(f.Allow); err != nil {
+		return err
+	}
+
+	if m.deny, err = compileClientIDPatterns(f.Deny); err != nil {
+		return err
+	}
+
+	s.clientIDsMu.Lock()
+	s.clientIDs = m
+	s.clientIDsMu.Unlock()
+	return nil
+}
+
+// clientIDAllowed returns true if a client id is allowed by the client id filter.
+func (s *Server) clientIDAllowed(id string) bool {
+	s.clientIDsMu.RLock()
+	m := s.clientIDs
+	s.clientIDsMu.RUnlock()
+
+	if m.denyAll {
+		return false
+	}
+
+	for _, re := range m.deny {
+		if re.MatchString(id) {
+			return false
+		}
+	}
+
+	if len(m.allow) == 0 {
+		return true
+	}
+
+	for _, re := range m.allow {
+		if re.MatchString(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compileClientIDPatterns compiles glob or regular expression client id patterns.
+func compileClientIDPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		expr := globToRegexp(p)
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			expr = p[1 : len(p)-1]
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %s", ErrInvalidClientIDPattern, p, err)
+		}
+
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+// globToRegexp returns a regular expression matching the whole of any string
+// matched by a glob pattern.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// StoreQueue returns the number of writes waiting in the write-behind queue
+// of the store, and the number dropped because the queue was full. Both are 0
+// if the WriteBehind option is not set.
+func (s *Server) StoreQueue() (queued int, dropped int64) {
+	if s.writeBehind == nil {
+		return 0, 0
+	}
+
+	return s.writeBehind.Queued(), s.writeBehind.Dropped()
+}
+
+// StoreLatency returns the number of calls made to each method of the store
+// and the total time they took, keyed on method name. It returns nil if the
+// StoreLatency option is not set. Calls are timed as they are made to the
+// backend, so with the WriteBehind option, queued writes are timed when they
+// are applied.
+func (s *Server) StoreLatency() map[string]persistence.OpStats {
+	if s.timedStore == nil {
+		return nil
+	}
+
+	return s.timedStore.Stats()
+}
+
+// storeUnavailable returns a reason if qos 1 and 2 publishes should be
+// rejected because the store is failing and StoreFailClosed is set, or its
+// write-behind queue is full and StoreSaturation is StoreSaturationReject.
+func (s *Server) storeUnavailable() (string, bool) {
+	if s.Options.StoreFailClosed && s.Store != nil && s.StoreFailing() {
+		return "publish rejected while store is failing", true
+	}
+
+	if s.Options.StoreSaturation == StoreSaturationReject && s.writeBehind != nil && s.writeBehind.Full() {
+		return "publish rejected while store queue is full", true
+	}
+
+	return "", false
+}
+
+// StoreFailing returns true if the last call to any method of the store
+// failed. A method recovers when it next succeeds. If the WriteBehind option
+// is set, writes recover when a later queued write is applied successfully.
+func (s *Server) StoreFailing() bool {
+	if atomic.LoadInt32(&s.storeFailing) > 0 {
+		return true
+	}
+
+	return s.writeBehind != nil && s.writeBehind.Failing()
+}
+
+// RateLimitDropped returns the number of publishes dropped by each rate limit,
+// keyed on topic filter.
+func (s *Server) RateLimitDropped() map[string]int64 {
+	s.rateLimitsMu.RLock()
+	defer s.rateLimitsMu.RUnlock()
+
+	m := make(map[string]int64, len(s.rateLimits))
+	for filter, rl := range s.rateLimits {
+		m[filter] = atomic.LoadInt64(&rl.dropped)
+	}
+
+	return m
+}
+
+// rateLimited applies any rate limits matching the topic of a publish, and
+// returns the action to take if the publish exceeded a limit. Throttled
+// publishes are delayed until they are within the limit, and are not reported.
+func (s *Server) rateLimited(topic string) (RateLimitAction, bool) {
+	now := time.Now()
+	var wait time.Duration
+
+	s.rateLimitsMu.RLock()
+	for filter, rl := range s.rateLimits {
+		if !auth.MatchTopic(filter, topic) {
+			continue
+		}
+
+		if rl.limit.Action == RateLimitThrottle {
+			if d := rl.bucket.Reserve(now); d > wait {
+				wait = d
+			}
+			continue
+		}
+
+		if !rl.bucket.Allow(now) {
+			atomic.AddInt64(&rl.dropped, 1)
+			s.rateLimitsMu.RUnlock()
+			return rl.limit.Action, true
+		}
+	}
+	s.rateLimitsMu.RUnlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	return 0, false
+}
+
+// Stats is a snapshot of the current state of the broker.
+type Stats struct {
+	ClientsConnected int64 `json:"clients_connected"` // the number of currently connected clients.
+	Subscriptions    int64 `json:"subscriptions"`     // the total number of filter subscriptions.
+	Retained         int64 `json:"retained"`          // the number of messages currently retained.
+	Inflight         int64 `json:"inflight"`          // the number of messages currently in-flight.
+	MessagesRecv     int64 `json:"messages_recv"`     // the total number of packets received.
+	MessagesSent     int64 `json:"messages_sent"`     // the total number of packets sent.
+	PublishRecv      int64 `json:"publish_recv"`      // the total number of received publish packets.
+	PublishSent      int64 `json:"publish_sent"`      // the total number of sent publish packets.
+	BytesRecv        int64 `json:"bytes_recv"`        // the total number of bytes received.
+	BytesSent        int64 `json:"bytes_sent"`        // the total number of bytes sent.
+	Uptime           int64 `json:"uptime"`            // the number of seconds the server has been online.
+}
+
+// Stats returns a snapshot of the current state of the broker, which is much
+// cheaper to take than the $SYS topics or metrics are to publish or scrape.
+// Each value is read atomically, but the values are read one after another
+// while the broker is running, so they are not guaranteed to be consistent
+// with each other, such as the messages sent including a publish which is not
+// yet counted in the publishes sent.
+func (s *Server) Stats() Stats {
+	return Stats{
+		ClientsConnected: atomic.LoadInt64(&s.System.ClientsConnected),
+		Subscriptions:    atomic.LoadInt64(&s.System.Subscriptions),
+		Retained:         atomic.LoadInt64(&s.System.Retained),
+		Inflight:         atomic.LoadInt64(&s.System.Inflight),
+		MessagesRecv:     atomic.LoadInt64(&s.System.MessagesRecv),
+		MessagesSent:     atomic.LoadInt64(&s.System.MessagesSent),
+		PublishRecv:      atomic.LoadInt64(&s.System.PublishRecv),
+		PublishSent:      atomic.LoadInt64(&s.System.PublishSent),
+		BytesRecv:        atomic.LoadInt64(&s.System.BytesRecv),
+		BytesSent:        atomic.LoadInt64(&s.System.BytesSent),
+		Uptime:           time.Now().Unix() - atomic.LoadInt64(&s.System.Started),
+	}
+}
+
+// StartTime returns the time the server was started.
+func (s *Server) StartTime() time.Time {
+	return s.started
+}
+
+// Uptime returns how long the server has been running.
+func (s *Server) Uptime() time.Duration {
+	return time.Since(s.started)
+}
+
+// FirstStartTime returns the time the server was first started with its store,
+// which is kept in the stored server info across restarts. Without a store, it
+// is the time the server was started.
+func (s *Server) FirstStartTime() time.Time {
+	return time.Unix(atomic.LoadInt64(&s.System.FirstStarted), 0)
+}
+
+// ClientSummary describes a connected client.
+type ClientSummary struct {
+	ID              string `json:"id"`               // the client id.
+	Remote          string `json:"remote_addr"`      // the remote address of the client.
+	Listener        string `json:"listener"`         // the id of the listener the client connected to.
+	Username        string `json:"username"`         // the username the client authenticated with.
+	ConnectedAt     int64  `json:"connected_at"`     // the time the client connected in unix seconds.
+	Subscriptions   int    `json:"subscriptions"`    // the number of subscription filters the client has.
+	CleanSession    bool   `json:"clean_session"`    // indicates if the client connected with a clean session.
+	ProtocolVersion byte   `json:"protocol_version"` // the mqtt protocol version the client connected with.
+	PacketIDs       int    `json:"packet_ids"`       // the number of packet ids held by messages inflight to the client.
+
+	PublishRate     float64 `json:"publish_rate"`      // the messages the client published in the last second.
+	PublishByteRate float64 `json:"publish_byte_rate"` // the payload bytes the client published in the last second.
+}
+
+// ConnectedClients returns a summary of each connected client, sorted by client id.
+func (s *Server) ConnectedClients() []ClientSummary {
+	all := s.Clients.GetAll()
+	summaries := make([]ClientSummary, 0, len(all))
+	for _, cl := range all {
+		if atomic.LoadUint32(&cl.State.Done) == 1 {
+			continue
+		}
+
+		info := cl.Info()
+		cl.RLock()
+		subs := len(cl.Subscriptions)
+		cl.RUnlock()
+		rate, byteRate := s.publishRate(cl)
+
+		summaries = append(summaries, ClientSummary{
+			ID:              info.ID,
+			Remote:          info.Remote,
+			Listener:        info.Listener,
+			Username:        string(info.Username),
+			ConnectedAt:     cl.ConnectedAt,
+			Subscriptions:   subs,
+			CleanSession:    info.CleanSession,
+			ProtocolVersion: cl.ProtocolVersion,
+			PacketIDs:       cl.Inflight.Len(),
+			PublishRate:     rate,
+			PublishByteRate: byteRate,
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].ID < summaries[j].ID
+	})
+
+	return summaries
+}
+
+// SubscriptionSummary describes a subscription of a connected client.
+type SubscriptionSummary struct {
+	Filter            string `json:"filter"`              // the subscription filter, including any share group prefix.
+	Qos               byte   `json:"qos"`                 // the qos granted to the subscription.
+	RetainAsPublished bool   `json:"retain_as_published"` // indicates if forwarded messages keep their retain flag.
+	RetainHandling    byte   `json:"retain_handling"`     // whether retained messages are sent when the subscription is made.
+}
+
+// ClientSubscriptions returns the subscriptions a connected client currently
+// holds, sorted by filter, including those restored with a resumed session.
+func (s *Server) ClientSubscriptions(id string) ([]SubscriptionSummary, error) {
+	cl, ok := s.Clients.Get(id)
+	if !ok || atomic.LoadUint32(&cl.State.Done) == 1 {
+		return nil, ErrClientNotConnected
+	}
+
+	cl.RLock()
+	subs := make([]SubscriptionSummary, 0, len(cl.Subscriptions))
+	for filter, qos := range cl.Subscriptions {
+		opts := cl.SubOptions[filter]
+		subs = append(subs, SubscriptionSummary{
+			Filter:            filter,
+			Qos:               qos,
+			RetainAsPublished: opts.RetainAsPublished,
+			RetainHandling:    opts.RetainHandling,
+		})
+	}
+	cl.RUnlock()
+
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Filter < subs[j].Filter
+	})
+
+	return subs, nil
+}
+
+// Health returns true if the server is ready to accept clients, which is when
+// its store (if any) is open and at least one listener is serving connections,
+// along with the status of each component. The status of the store is keyed
+// on "store", any error last returned by the store on "store_error", and the
+// status of each listener on "listener:" followed by its id.
+func (s *Server) Health() (bool, map[string]string) {
+	status := map[string]string{}
+	healthy := true
+
+	s.storeErrMu.RLock()
+	openErr, lastErr := s.storeErr, s.lastStorageErr
+	s.storeErrMu.RUnlock()
+
+	switch {
+	case s.Store == nil:
+		status["store"] = "none"
+	case openErr != nil:
+		status["store"] = "failed: " + openErr.Error()
+		healthy = false
+	default:
+		status["store"] = "open"
+		if st, ok := s.Store.(interface{ IsOpen() bool }); ok && !st.IsOpen() {
+			status["store"] = "closed"
+			healthy = false
+		}
+	}
+
+	if lastErr != nil {
+		status["store_error"] = lastErr.Error()
+	}
+
+	var serving int
+	for id, ok := range s.Listeners.Serving() {
+		if ok {
+			status["listener:"+id] = "serving"
+			serving++
+		} else {
+			status["listener:"+id] = "not serving"
+		}
+	}
+
+	if serving == 0 {
+		healthy = false
+	}
+
+	return healthy, status
+}
+
+// DisconnectClient forcibly disconnects a connected client. MQTT v5 clients are
+// first sent a DISCONNECT with the administrative action reason code. The will
+// message and session of the client are then handled as for any other dropped
+// connection, so the session is kept or discarded according to its clean
+// session flag.
+func (s *Server) DisconnectClient(id string) error {
+	cl, ok := s.Clients.Get(id)
+	if !ok || atomic.LoadUint32(&cl.State.Done) == 1 {
+		return ErrClientNotConnected
+	}
+
+	s.Options.Logger.Info("disconnecting client", logFields(cl.Info())...)
+
+	s.sendDisconnect(cl, packets.CodeAdministrativeAction, "disconnected by administrator")
+	cl.Stop(ErrAdminDisconnect)
+	return nil
+}
+
+// ClientInflight returns the number of inflight messages for a client, and
+// false if the client is not known to the server.
+func (s *Server) ClientInflight(id string) (int, bool) {
+	cl, ok := s.Clients.Get(id)
+	if !ok {
+		return 0, false
+	}
+
+	return cl.Inflight.Len(), true
+}
+
+// DeleteAllRetained deletes all retained messages from the topic index and the
+// persistent store, such as before a migration of the topic schema. The $SYS
+// topics are kept, as they are never stored and are republished by the server.
+func (s *Server) DeleteAllRetained() error {
+	for _, pk := range s.Topics.Messages("#") {
+		s.Topics.RetainMessage(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Retain: true,
+			},
+			TopicName: pk.TopicName,
+		})
+	}
+	s.updateRetainedStats()
+
+	if s.Store != nil {
+		return s.Store.DeleteAllRetained()
+	}
+
+	return nil
+}
+
+// inflightQuotaExceeded returns true if the client cannot accept any more inflight messages.
+func (s *Server) inflightQuotaExceeded(cl *clients.Client) bool {
+	max := atomic.LoadInt64(&s.maxInflight)
+	return max > 0 && int64(cl.Inflight.Len()+cl.Inflight.QueueLen()) >= max
+}
+
+// AddHook adds an extension hook to the server. Hooks are called in the order
+// they were added, after the corresponding Events callbacks.
+func (s *Server) AddHook(hook events.Hook) {
+	s.hooks.Add(hook)
+}
+
+// AddStore assigns a persistent storage backend to the server. This must be
+// called before calling server.Server(). If a retained store has been added,
+// the retained messages are kept in it rather than in p. If the WriteBehind
+// option is set, the writes to the store are queued, and if the StoreLatency
+// option is set, the calls to the store are timed.
+func (s *Server) AddStore(p persistence.Store) error {
+	s.Store = persistence.SplitRetained(p, s.retainedStore)
+	if s.Options.StoreLatency {
+		s.timedStore = persistence.NewTimed(s.Store)
+		s.Store = s.timedStore
+	}
+
+	if s.Options.WriteBehind != nil {
+		o := *s.Options.WriteBehind
+		if o.OnError == nil {
+			o.OnError = func(op string, err error) {
+				s.onStorage(&s.inline, op, err)
+			}
+		}
+
+		s.writeBehind = persistence.NewWriteBehind(s.Store, o)
+		s.Store = s.writeBehind
+	}
+
+	s.Store.SetInflightTTL(s.Options.InflightTTL)
+	for qos, ttl := range s.Options.InflightTTLForQoS {
+		if ttl > 0 {
+			s.Store.SetInflightTTLForQoS(qos, ttl)
+		}
+	}
+
+	err := s.Store.Open()
+	s.storeErrMu.Lock()
+	s.storeErr = err
+	s.storeErrMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddRetainedStore assigns a separate persistent storage backend for retained
+// messages, such as a fast key-value store, while the store added with
+// AddStore keeps everything else. It must be called before AddStore, which
+// opens it along with the store, so that retained messages pass through the
+// same write-behind queue and latency timing as everything else. Without a
+// retained store, retained messages are kept in the store added with AddStore.
+func (s *Server) AddRetainedStore(p persistence.RetainedStore) error {
+	if s.Store != nil {
+		return ErrStoreAdded
+	}
+
+	s.retainedStore = p
+	return nil
+}
+
+// AddListener adds a new network listener to the server. If the server is
+// already serving, the listener starts serving connections at once, so that
+// listeners can be added at runtime, such as to bind a TLS port once its
+// certificates have been provisioned. If the listener cannot open its network
+// address, it is not added, and the error is returned.
+func (s *Server) AddListener(listener listeners.Listener, config *listeners.Config) error {
+	s.servingMu.Lock()
+	defer s.servingMu.Unlock()
+
+	if _, ok := s.Listeners.Get(listener.ID()); ok {
+		return ErrListenerIDExists
+	}
+
+	if config == nil && s.Options.Auth != nil {
+		config = new(listeners.Config)
+	}
+
+	if config != nil {
+		if config.Auth == nil {
+			config.Auth = s.Options.Auth
+		}
+
+		listener.SetConfig(config)
+
+		ls := &listenerSettings{
+			packetSize: config.MaxPacketSize,
+			topicLimit: topicLimit{
+				levels: config.MaxTopicLevels,
+				length: config.MaxTopicLength,
+			},
+			keepalive: config.MaxKeepalive,
+			clientIDRule: clientIDRule{
+				maxLength: config.MaxClientIDLength,
+				strict:    config.StrictClientID,
+			},
+			maxQos:         2,
+			retainDisabled: config.DisableRetain,
+		}
+
+		if config.ReadTimeout != 0 || config.WriteTimeout != 0 {
+			ls.timeouts = ioTimeouts{
+				read:  config.ReadTimeout,
+				write: config.WriteTimeout,
+			}
+			if ls.timeouts.write == 0 {
+				ls.timeouts.write = defaultWriteTimeout
+			}
+		}
+
+		if config.MaximumQos != nil && *config.MaximumQos < 2 {
+			ls.maxQos = *config.MaximumQos
+		}
+
+		if config.ConnectRate > 0 || config.MaxConnectionsPerIP > 0 {
+			ls.connLimit = &connLimiter{
+				wait:  config.ConnectWait,
+				perIP: config.MaxConnectionsPerIP,
+				ips:   map[string]int{},
+			}
+			if config.ConnectRate > 0 {
+				ls.connLimit.bucket = ratelimit.NewBucket(config.ConnectRate, config.ConnectBurst)
+			}
+		}
+
+		if config.PublishRate > 0 || config.PublishByteRate > 0 {
+			ls.publishLimit = publishLimit{
+				rate:      config.PublishRate,
+				burst:     config.PublishBurst,
+				byteRate:  config.PublishByteRate,
+				byteBurst: config.PublishByteBurst,
+				maxDelay:  config.PublishMaxDelay,
+			}
+		}
+
+		s.settingsMu.Lock()
+		s.settings[listener.ID()] = ls
+		s.settingsMu.Unlock()
+	}
+
+	s.Listeners.Add(listener)
+	err := listener.Listen(s.System)
+	if err != nil {
+		s.Listeners.Delete(listener.ID())
+		s.clearListenerConfig(listener.ID())
+		s.Options.Logger.Warn("listener bind failed", logger.KeyListener, listener.ID(), logger.KeyError, err)
+		s.hooks.OnListenerBindFailed(listener.ID(), err)
+		return err
+	}
+
+	if s.serving {
+		s.serveListener(listener.ID())
+	}
+
+	return nil
+}
+
+// RemoveListener stops a listener from accepting new connections and removes
+// it from the server. The clients connected to the listener are drained, with
+// their sessions flushed to the store and MQTT v5 clients sent a DISCONNECT
+// with the server shutting down reason code, before they are disconnected.
+// Other listeners and their clients are not affected.
+func (s *Server) RemoveListener(id string) error {
+	s.servingMu.Lock()
+	defer s.servingMu.Unlock()
+
+	if _, ok := s.Listeners.Get(id); !ok {
+		return ErrListenerNotFound
+	}
+
+	s.Listeners.Close(id, s.drainListenerClients)
+	s.Listeners.Delete(id)
+	s.clearListenerConfig(id)
+
+	s.Options.Logger.Info("listener removed", logger.KeyListener, id)
+	s.hooks.OnListenerStopped(id)
+	return nil
+}
+
+// serveListener starts a listener serving connections.
+func (s *Server) serveListener(id string) {
+	s.Listeners.Serve(id, s.EstablishConnection)
+	s.hooks.OnListenerStarted(id)
+}
+
+// clearListenerConfig removes the settings of a listener which override the
+// server options.
+func (s *Server) clearListenerConfig(id string) {
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	delete(s.settings, id)
+}
+
+// listenerSettings returns the settings of a listener, or nil if it was added
+// without a config.
+func (s *Server) listenerSettings(lid string) *listenerSettings {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return s.settings[lid]
+}
+
+// Serve starts the event loops responsible for establishing client connections
+// on all attached listeners, and publishing the system topics.
+func (s *Server) Serve() error {
+	if s.Store != nil {
+		err := s.readStore()
+		if err != nil {
+			return err
+		}
+	}
+
+	go s.eventLoop()    // spin up event loop for issuing $SYS values and closing server.
+	go s.inlineClient() // spin up inline client for direct message publishing.
+
+	// start listening on all listeners.
+	s.servingMu.Lock()
+	s.serving = true
+	for _, id := range s.Listeners.IDs() {
+		s.serveListener(id)
+	}
+	s.servingMu.Unlock()
+
+	s.publishSysTopics() // begin publishing $SYS system values.
+
+	s.Options.Logger.Info("server started", "version", Version, "listeners", s.Listeners.Len())
+	return nil
+}
+
+// eventLoop loops forever, running various server processes at different intervals.
+func (s *Server) eventLoop() {
+	for {
+		select {
+		case <-s.done:
+			s.sysTicker.Stop()
+			close(s.inline.done)
+			return
+		case <-s.sysTicker.C:
+			s.publishSysTopics()
+		case <-s.inflightExpiryTicker.C:
+			s.clearExpiredInflights(time.Now().Unix())
+		case <-s.inflightResendTicker.C:
+			s.resendPendingInflights()
+		case <-s.retainedExpiryTicker.C:
+			s.clearExpiredRetained(time.Now().Unix())
+		case <-s.sessionExpiryTicker.C:
+			s.clearExpiredSessions(time.Now().Unix())
+		case <-s.connSweepTicker.C:
+			s.clearIdleConnections(time.Now())
+		}
+	}
+}
+
+// inlineClient loops forever, sending directly-published messages
+// from the Publish method to subscribers.
+func (s *Server) inlineClient() {
+	for {
+		select {
+		case <-s.inline.done:
+			close(s.inline.pub)
+			return
+		case pk := <-s.inline.pub:
+			s.publishToSubscribers(pk)
+		}
+	}
+}
+
+// endHandshake stops tracking the handshake of a connection, once it has been
+// accepted or has closed.
+func (s *Server) endHandshake(cl *clients.Client) {
+	s.handshakesMu.Lock()
+	defer s.handshakesMu.Unlock()
+	delete(s.handshakes, cl)
+}
+
+// clearIdleConnections closes connections which have not completed their CONNECT
+// within the handshake timeout, and clients which have sent nothing for one and
+// a half times their keepalive [MQTT-3.1.2-24]. A single sweep of the activity
+// times is used instead of a read deadline timer for every connection.
+func (s *Server) clearIdleConnections(now time.Time) {
+	timeout := time.Duration(s.Options.HandshakeTimeout) * time.Second
+
+	var expired []*clients.Client
+	s.handshakesMu.Lock()
+	for cl, opened := range s.handshakes {
+		if now.Sub(opened) > timeout {
+			expired = append(expired, cl)
+			delete(s.handshakes, cl)
+		}
+	}
+	s.handshakesMu.Unlock()
+
+	for _, cl := range expired {
+		s.Options.Logger.Debug("closing connection which did not connect in time", logFields(cl.Info())...)
+		cl.Stop(ErrHandshakeTimeout)
+	}
+
+	for _, cl := range s.Clients.GetAll() {
+		if atomic.LoadUint32(&cl.State.Done) == 1 || !cl.KeepaliveExpired(now) {
+			continue
+		}
+
+		s.Options.Logger.Info("client keepalive timed out", logFields(cl.Info())...)
+		s.sendDisconnect(cl, packets.CodeKeepAliveTimeout, "keepalive timeout")
+		cl.Stop(ErrKeepaliveTimeout)
+	}
+}
+
+// readConnectionPacket reads the first incoming header for a connection, and if
+// acceptable, returns the valid connection packet.
+func (s *Server) readConnectionPacket(cl *clients.Client) (pk packets.Packet, err error) {
+	fh := new(packets.FixedHeader)
+	err = cl.ReadFixedHeader(fh)
+	if err != nil {
+		return
+	}
+
+	pk, err = cl.ReadPacket(fh)
+	if err != nil {
+		return
+	}
+
+	if pk.FixedHeader.Type != packets.Connect {
+		return pk, ErrReadConnectInvalid
+	}
+
+	return
+}
+
+// onError is a pass-through method which triggers the OnError
 // event hook (if applicable), and returns the provided error.
 func (s *Server) onError(cl events.Client, err error) error {
 	if err == nil {
@@ -268,27 +2359,87 @@ func (s *Server) onError(cl events.Client, err error) error {
 	// below are ordinary consequences of closing the connection.
 	// If one of these ordinary conditions stops the connection,
 	// then the client closed or broke the connection.
-	if s.Events.OnError != nil &&
-		!errors.Is(err, io.EOF) {
+	if errors.Is(err, io.EOF) {
+		return err
+	}
+
+	s.Options.Logger.Debug("client error", logFields(cl, logger.KeyError, err)...)
+	if s.Events.OnError != nil {
 		s.Events.OnError(cl, err)
 	}
 
 	return err
 }
 
-// onStorage is a pass-through method which delegates errors from
-// the persistent storage adapter to the onError event hook.
-func (s *Server) onStorage(cl events.Clientlike, err error) {
+// onStorage is a pass-through method which delegates errors from the named
+// method of the persistent storage adapter to the OnStorageError hooks and the
+// onError event hook. The method is marked as failing until it next succeeds.
+func (s *Server) onStorage(cl events.Clientlike, op string, err error) {
 	if err == nil {
+		if atomic.LoadInt32(&s.storeFailing) > 0 {
+			s.storeErrMu.Lock()
+			delete(s.failingOps, op)
+			atomic.StoreInt32(&s.storeFailing, int32(len(s.failingOps)))
+			s.storeErrMu.Unlock()
+		}
 		return
 	}
 
-	_ = s.onError(cl.Info(), fmt.Errorf("storage: %w", err))
+	s.storeErrMu.Lock()
+	s.lastStorageErr = err
+	s.failingOps[op] = true
+	atomic.StoreInt32(&s.storeFailing, int32(len(s.failingOps)))
+	s.storeErrMu.Unlock()
+
+	info := cl.Info()
+	s.Options.Logger.Error("persistence error", logFields(info, "op", op, logger.KeyError, err)...)
+	s.hooks.OnStorageError(info, op, err)
+	if s.Events.OnError != nil {
+		s.Events.OnError(info, fmt.Errorf("storage: %w", err))
+	}
+}
+
+// logFields returns the standard log fields for a client, followed by kv.
+func logFields(cl events.Client, kv ...interface{}) []interface{} {
+	return append([]interface{}{
+		logger.KeyClientID, cl.ID,
+		logger.KeyRemoteAddr, cl.Remote,
+		logger.KeyListener, cl.Listener,
+	}, kv...)
+}
+
+// authController returns the default auth controller for connections from
+// listeners without their own, disallowing all if none has been set.
+func (s *Server) authController() auth.Controller {
+	if s.Options.Auth == nil {
+		return new(auth.Disallow)
+	}
+
+	return s.Options.Auth
 }
 
 // EstablishConnection establishes a new client when a listener
-// accepts a new connection.
+// accepts a new connection. The connection is authenticated, and the client's
+// ACL checks made, with the auth controller of the listener, or the default
+// auth controller if ac is nil.
 func (s *Server) EstablishConnection(lid string, c net.Conn, ac auth.Controller) error {
+	if atomic.LoadUint32(&s.draining) == 1 {
+		c.Close()
+		return ErrServerDraining
+	}
+
+	if ac == nil {
+		ac = s.authController()
+	}
+
+	// Connections over the listener's limits are still read so that they can
+	// be refused with a CONNACK, rather than being closed without a reason.
+	release, admitted := s.admitConnection(lid, c.RemoteAddr())
+	defer release()
+	if !admitted {
+		atomic.AddInt64(&s.System.ConnectionsRejected, 1)
+	}
+
 	xbr := s.bytepool.Get() // Get byte buffer from pools for receiving packet data.
 	xbw := s.bytepool.Get() // and for sending.
 	defer s.bytepool.Put(xbr)
@@ -299,11 +2450,20 @@ func (s *Server) EstablishConnection(lid string, c net.Conn, ac auth.Controller)
 		circ.NewWriterFromSlice(s.Options.BufferBlockSize, xbw),
 		s.System,
 	)
+	cl.MaxPacketSize = s.maxPacketSize(lid)
+	cl.TopicAliases.InboundMaximum = s.Options.TopicAliasMaximum
+	t := s.ioTimeouts(lid)
+	cl.SetTimeouts(t.read, t.write)
 
 	cl.Start()
 	defer cl.ClearBuffers()
 	defer cl.Stop(nil)
 
+	s.handshakesMu.Lock()
+	s.handshakes[cl] = time.Now()
+	s.handshakesMu.Unlock()
+	defer s.endHandshake(cl)
+
 	pk, err := s.readConnectionPacket(cl)
 	if err != nil {
 		return s.onError(cl.Info(), fmt.Errorf("read connection: %w", err))
@@ -311,13 +2471,79 @@ func (s *Server) EstablishConnection(lid string, c net.Conn, ac auth.Controller)
 
 	ackCode, err := pk.ConnectValidate()
 	if err != nil {
+		s.Options.Logger.Warn("invalid connect packet", logFields(cl.Info(), logger.KeyError, err)...)
 		if err := s.ackConnection(cl, ackCode, false); err != nil {
 			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
 		}
 		return s.onError(cl.Info(), fmt.Errorf("validate connection packet: %w", err))
 	}
 
+	// Clients which connect without a client id are assigned one, which is
+	// used for their session and returned to MQTT v5 clients in the CONNACK.
+	if pk.ClientIdentifier == "" {
+		pk.ClientIdentifier = s.Options.ClientIDGenerator()
+		cl.AssignedID = true
+	}
+
 	cl.Identify(lid, pk, ac) // Set client identity values from the connection packet.
+	cl.Compression = s.negotiateCompression(cl, pk)
+
+	if ref, permanent := s.Redirect(); ref != "" {
+		s.Options.Logger.Info("connection redirected", logFields(cl.Info(), "server_reference", ref)...)
+		if err := s.writeClient(cl, s.redirectConnack(cl, ref, permanent)); err != nil {
+			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+		}
+		return s.onError(cl.Info(), ErrConnectionRedirected)
+	}
+
+	if !admitted {
+		s.Options.Logger.Warn("connection refused by listener limit", logFields(cl.Info())...)
+		code := packets.CodeConnectServerUnavailable
+		if cl.ProtocolVersion == 5 {
+			code = packets.CodeServerBusy
+		}
+
+		if err := s.ackConnection(cl, code, false); err != nil {
+			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+		}
+		return s.onError(cl.Info(), ErrConnectionLimited)
+	}
+
+	if !cl.AssignedID && !s.clientIDValid(lid, cl.ID) {
+		s.Options.Logger.Warn("client id not valid for listener", logFields(cl.Info())...)
+		code := packets.CodeConnectBadClientID
+		if cl.ProtocolVersion == 5 {
+			code = packets.CodeClientIDNotValid
+		}
+
+		if err := s.ackConnection(cl, code, false); err != nil {
+			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+		}
+		return s.onError(cl.Info(), ErrClientIDInvalid)
+	}
+
+	if !s.clientIDAllowed(cl.ID) {
+		s.Options.Logger.Warn("client id rejected by filter", logFields(cl.Info())...)
+		code := packets.CodeConnectBadClientID
+		if cl.ProtocolVersion == 5 {
+			code = packets.CodeClientIDNotValid
+		}
+
+		if err := s.ackConnection(cl, code, false); err != nil {
+			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+		}
+		return s.onError(cl.Info(), ErrClientIDRejected)
+	}
+
+	if pk.WillFlag && cl.ProtocolVersion == 5 {
+		if code, err := s.exceedsCapabilities(lid, pk.WillQos, pk.WillRetain); err != nil {
+			s.Options.Logger.Warn("will message not supported by listener", logFields(cl.Info(), logger.KeyError, err)...)
+			if err := s.ackConnection(cl, code, false); err != nil {
+				return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+			}
+			return s.onError(cl.Info(), err)
+		}
+	}
 
 	// if !ac.Authenticate(pk.Username, pk.Password) {
 	// 	if err := s.ackConnection(cl, packets.CodeConnectBadAuthValues, false); err != nil {
@@ -325,16 +2551,105 @@ func (s *Server) EstablishConnection(lid string, c net.Conn, ac auth.Controller)
 	// 	}
 	// 	return s.onError(cl.Info(), ErrConnectionFailed)
 	// }
-	username, err := ac.Authenticate(pk.Username, pk.Password)
+	info := auth.ConnInfo{
+		Listener:   lid,
+		RemoteAddr: cl.Info().Remote,
+		ClientID:   cl.ID,
+		Username:   pk.Username,
+		Password:   pk.Password,
+
+		UserProperties: pk.Properties.User,
+	}
+	if cs, ok := cl.TLSState(); ok {
+		info.SetTLS(cs)
+	}
+
+	var identity interface{}
+	var authData []byte
+	failCode := packets.CodeConnectBadAuthValues
+
+	// MQTT v5 clients which set an authentication method use enhanced
+	// authentication, exchanging AUTH packets with the controller. Anonymous
+	// clients may be admitted without being authenticated.
+	if pk.ProtocolVersion == 5 && pk.Properties.AuthenticationMethod != "" {
+		authData, failCode, err = s.enhancedAuth(cl, ac, info, pk.Properties)
+	} else if !s.Options.AllowAnonymous || len(pk.Username) > 0 {
+		identity, err = auth.Conn(ac).AuthenticateConn(info)
+	}
+
 	if err != nil {
-		if err := s.ackConnection(cl, packets.CodeConnectBadAuthValues, false); err != nil {
+		s.Options.Logger.Warn("client authentication failed", logFields(cl.Info(),
+			logger.KeyUsername, string(pk.Username),
+			logger.KeyError, err,
+		)...)
+		if err := s.ackConnection(cl, failCode, false); err != nil {
 			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
 		}
 		return s.onError(cl.Info(), ErrConnectionFailed)
 	}
-	if username != nil {
-		pk.Username = []byte(username.(string))
+
+	// The auth controller may choose the username the client will be known by,
+	// which is then passed to the controller for every ACL check, along with
+	// the identity itself for controllers which implement IdentityController.
+	cl.Identity = identity
+	switch v := identity.(type) {
+	case string:
+		pk.Username = []byte(v)
 		cl.Identify(lid, pk, ac)
+	case auth.Principal:
+		pk.Username = []byte(v.Username())
+		cl.Identify(lid, pk, ac)
+	}
+
+	if pk.WillFlag && s.Options.CheckWillACL {
+		if ok, aclErr := s.aclAllowed(cl, cl.LWT.Topic, true, cl.LWT.User); aclErr != nil {
+			code := packets.CodeConnectServerUnavailable
+			if cl.ProtocolVersion == 5 {
+				code = packets.CodeServerUnavailable
+			}
+
+			if err := s.ackConnection(cl, code, false); err != nil {
+				return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+			}
+			return s.onError(cl.Info(), aclErr)
+		} else if !ok {
+			s.Options.Logger.Warn("will topic denied by acl", logFields(cl.Info(), logger.KeyTopic, cl.LWT.Topic)...)
+			code := packets.CodeConnectNotAuthorised
+			if cl.ProtocolVersion == 5 {
+				code = packets.CodeNotAuthorized
+			}
+
+			if err := s.ackConnection(cl, code, false); err != nil {
+				return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+			}
+			return s.onError(cl.Info(), ErrWillNotAuthorized)
+		}
+	}
+
+	s.assignKeepalive(cl)
+
+	// Connections with the same client id replace the existing client one at a
+	// time, so simultaneous connections can't both take over the same session.
+	s.takeoverMu.Lock()
+	if existing, ok := s.Clients.Get(cl.ID); ok && s.Options.ClientIDConflict == ClientIDRejectNew && atomic.LoadUint32(&existing.State.Done) == 0 {
+		s.takeoverMu.Unlock()
+		s.Options.Logger.Warn("client id already connected", logFields(cl.Info())...)
+		code := packets.CodeConnectBadClientID
+		if cl.ProtocolVersion == 5 {
+			code = packets.CodeClientIDNotValid
+		}
+
+		if err := s.ackConnection(cl, code, false); err != nil {
+			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+		}
+		return s.onError(cl.Info(), ErrClientIDInUse)
+	}
+
+	// A delayed will is not sent if the client reconnects to its session in time,
+	// but is sent straight away if the new connection ends the session.
+	willCancelled := s.cancelLWT(cl.ID)
+	if existing, ok := s.Clients.Get(cl.ID); ok && willCancelled && !sessionResumable(pk, existing) {
+		s.publishLWT(existing)
 	}
 
 	atomic.AddInt64(&s.System.ConnectionsTotal, 1)
@@ -344,61 +2659,440 @@ func (s *Server) EstablishConnection(lid string, c net.Conn, ac auth.Controller)
 
 	sessionPresent := s.inheritClientSession(pk, cl)
 	s.Clients.Add(cl)
+	s.takeoverMu.Unlock()
+	if willCancelled && sessionPresent {
+		s.storeLWT(cl) // Replace the cancelled will in the store.
+	}
 
-	err = s.ackConnection(cl, ackCode, sessionPresent)
+	ack := s.connack(cl, ackCode, sessionPresent)
+	ack.Properties.AuthenticationMethod = pk.Properties.AuthenticationMethod
+	ack.Properties.AuthenticationData = authData
+	err = s.writeClient(cl, ack)
 	if err != nil {
 		return s.onError(cl.Info(), fmt.Errorf("ack connection packet: %w", err))
 	}
+	s.endHandshake(cl)
 
 	if sessionPresent {
 		err = s.ResendClientInflight(cl, true)
 		if err != nil {
 			s.onError(cl.Info(), fmt.Errorf("resend in flight: %w", err)) // pass-through, no return.
 		}
+		s.releaseQueued(cl)
 	}
 
 	if s.Store != nil {
-		s.onStorage(cl, s.Store.WriteClient(persistence.Client{
-			ID:       "cl_" + cl.ID,
-			ClientID: cl.ID,
-			T:        persistence.KClient,
-			Listener: cl.Listener,
-			Username: cl.Username,
-			LWT:      persistence.LWT(cl.LWT),
-		}))
+		s.storeClient(cl)
 	}
 
+	s.Options.Logger.Info("client connected", logFields(cl.Info(),
+		logger.KeyUsername, string(cl.Username),
+		"protocol_version", cl.ProtocolVersion,
+		"clean_session", cl.CleanSession,
+		"session_present", sessionPresent,
+	)...)
+
 	if s.Events.OnConnect != nil {
 		s.Events.OnConnect(cl.Info(), events.Packet(pk))
 	}
+	s.hooks.OnConnect(cl.Info(), events.Packet(pk))
+
+	s.addPublisher(cl)
+	defer s.removePublisher(cl)
 
 	if err := cl.Read(s.processPacket); err != nil {
+		if errors.Is(err, packets.ErrPacketTooLarge) {
+			s.Options.Logger.Warn("client sent packet too large", logFields(cl.Info(), "max_packet_size", cl.MaxPacketSize)...)
+		}
+
+		if code, reason, ok := readErrorCode(err); ok {
+			s.sendDisconnect(cl, code, reason)
+		}
+
 		s.sendLWT(cl)
 		cl.Stop(err)
 	}
 
 	err = cl.StopCause() // Determine true cause of stop.
+	if errors.Is(err, ErrReadTimeout) || errors.Is(err, ErrWriteTimeout) {
+		s.Options.Logger.Warn("client connection timed out", logFields(cl.Info(), logger.KeyError, err)...)
+	}
+
+	if s.Options.SharedRedeliver && !errors.Is(err, ErrSessionReestablished) {
+		s.redeliverShared(cl, "")
+	}
 
-	if cl.CleanSession {
-		s.clearAbandonedInflights(cl)
+	if !errors.Is(err, ErrSessionReestablished) {
+		s.endSession(cl)
 	}
 
+	s.Options.Logger.Info("client disconnected", logFields(cl.Info(), logger.KeyError, err)...)
+
 	if s.Events.OnDisconnect != nil {
 		s.Events.OnDisconnect(cl.Info(), err)
 	}
+	s.hooks.OnDisconnect(cl.Info(), err)
 
 	return err
 }
 
+// readErrorCode returns the reason code sent to MQTT v5 clients in a DISCONNECT
+// when they are disconnected for an error reading a packet, and false if the
+// client is disconnected without one.
+func readErrorCode(err error) (byte, string, bool) {
+	switch {
+	case errors.Is(err, packets.ErrPacketTooLarge):
+		return packets.CodePacketTooLarge, "packet too large", true
+	case errors.Is(err, packets.ErrMalformedQoS):
+		return packets.CodeProtocolError, "invalid subscription qos", true
+	case errors.Is(err, packets.ErrMalformedSubOptions):
+		return packets.CodeProtocolError, "invalid subscription options", true
+	}
+
+	return 0, "", false
+}
+
 // ackConnection returns a Connack packet to a client.
 func (s *Server) ackConnection(cl *clients.Client, ack byte, present bool) error {
-	return s.writeClient(cl, packets.Packet{
+	return s.writeClient(cl, s.connack(cl, ack, present))
+}
+
+// connack returns a Connack packet for a client, with the properties which
+// describe the server's limits to MQTT v5 clients.
+func (s *Server) connack(cl *clients.Client, ack byte, present bool) packets.Packet {
+	pk := packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type: packets.Connack,
 		},
 		SessionPresent: present,
 		ReturnCode:     ack,
-	})
+		Properties: packets.Properties{
+			MaximumPacketSize: cl.MaxPacketSize,
+			TopicAliasMaximum: cl.TopicAliases.InboundMaximum,
+			ReceiveMaximum:    s.Options.ReceiveMaximum,
+		},
+	}
+
+	if cl.ProtocolVersion == 5 && s.maxKeepalive(cl.Listener) > 0 {
+		pk.Properties.ServerKeepAlive = cl.Keepalive()
+		pk.Properties.ServerKeepAliveFlag = true
+	}
+
+	if cl.ProtocolVersion == 5 {
+		if cl.AssignedID {
+			pk.Properties.AssignedClientID = cl.ID
+		}
+
+		if cl.ResponseInfo && s.Options.ResponseInformation != "" && ack == packets.Accepted {
+			pk.Properties.ResponseInfo = s.Options.ResponseInformation + "/" + cl.ID
+		}
+
+		if cl.Compression != "" && ack == packets.Accepted {
+			pk.Properties.User = append(pk.Properties.User, packets.UserProperty{Key: CompressionProperty, Val: cl.Compression})
+		}
+
+		if max := s.maxQos(cl.Listener); max < 2 {
+			pk.Properties.MaximumQos = max
+			pk.Properties.MaximumQosFlag = true
+		}
+
+		if !s.retainAvailable(cl.Listener) {
+			pk.Properties.RetainAvailable = 0
+			pk.Properties.RetainAvailableFlag = true
+		}
+	}
+
+	return pk
+}
+
+// redirectConnack returns a Connack packet refusing a client because the server
+// is redirecting clients to another server. MQTT v5 clients are sent the server
+// reference, with the server moved reason code if the redirect is permanent, or
+// use another server if not. MQTT v3 clients cannot be redirected, so are told
+// the server is unavailable.
+func (s *Server) redirectConnack(cl *clients.Client, ref string, permanent bool) packets.Packet {
+	if cl.ProtocolVersion < 5 {
+		return s.connack(cl, packets.CodeConnectServerUnavailable, false)
+	}
+
+	code := packets.CodeUseAnotherServer
+	if permanent {
+		code = packets.CodeServerMoved
+	}
+
+	pk := s.connack(cl, code, false)
+	pk.Properties.ServerReference = ref
+	return pk
+}
+
+// enhancedAuth carries out the MQTT v5 enhanced authentication exchange of a
+// connecting client. It returns the authentication data to send to the client
+// in the CONNACK, or an error and the reason code to refuse the connection with.
+func (s *Server) enhancedAuth(cl *clients.Client, ac auth.Controller, info auth.ConnInfo, props packets.Properties) ([]byte, byte, error) {
+	ec, ok := ac.(auth.EnhancedController)
+	if !ok {
+		return nil, packets.CodeBadAuthenticationMethod, auth.ErrBadAuthMethod
+	}
+
+	ch := ec.NewChallenger(info)
+	method, data := props.AuthenticationMethod, props.AuthenticationData
+	for {
+		res, done, err := ch.Challenge(method, data)
+		if errors.Is(err, auth.ErrBadAuthMethod) {
+			return nil, packets.CodeBadAuthenticationMethod, err
+		} else if err != nil {
+			return nil, packets.CodeNotAuthorized, err
+		}
+
+		if done {
+			return res, packets.Accepted, nil
+		}
+
+		err = s.writeClient(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Auth,
+			},
+			ReturnCode: packets.CodeContinueAuthentication,
+			Properties: packets.Properties{
+				AuthenticationMethod: method,
+				AuthenticationData:   res,
+			},
+		})
+		if err != nil {
+			return nil, packets.CodeNotAuthorized, err
+		}
+
+		pk, err := s.readAuthPacket(cl, method)
+		if err != nil {
+			return nil, packets.CodeProtocolError, err
+		}
+
+		data = pk.Properties.AuthenticationData
+	}
+}
+
+// readAuthPacket reads the reply of a client during an enhanced authentication
+// exchange, which must be an AUTH packet continuing the exchange with the same
+// authentication method [MQTT-4.12.0-5].
+func (s *Server) readAuthPacket(cl *clients.Client, method string) (pk packets.Packet, err error) {
+	fh := new(packets.FixedHeader)
+	err = cl.ReadFixedHeader(fh)
+	if err != nil {
+		return
+	}
+
+	pk, err = cl.ReadPacket(fh)
+	if err != nil {
+		return
+	}
+
+	if pk.FixedHeader.Type != packets.Auth ||
+		pk.ReturnCode != packets.CodeContinueAuthentication ||
+		pk.Properties.AuthenticationMethod != method {
+		return pk, ErrReadAuthInvalid
+	}
+
+	return
+}
+
+// maxPacketSize returns the maximum packet size for clients connecting to a
+// listener, which is the listener's override if one was set.
+func (s *Server) maxPacketSize(lid string) uint32 {
+	if ls := s.listenerSettings(lid); ls != nil && ls.packetSize > 0 {
+		return ls.packetSize
+	}
+
+	return s.Options.MaxPacketSize
+}
+
+// topicLimit is the maximum number of levels and length in bytes of the topics
+// and filters accepted from clients, where 0 is unlimited.
+type topicLimit struct {
+	levels int
+	length int
+}
+
+// checkTopicLimits returns an error if a topic name or filter exceeds the
+// maximum levels or length for clients connecting to a listener, which are the
+// listener's overrides if set.
+func (s *Server) checkTopicLimits(lid, topic string) error {
+	lim := topicLimit{
+		levels: s.Options.MaxTopicLevels,
+		length: s.Options.MaxTopicLength,
+	}
+
+	if ls := s.listenerSettings(lid); ls != nil {
+		if ls.topicLimit.levels > 0 {
+			lim.levels = ls.topicLimit.levels
+		}
+		if ls.topicLimit.length > 0 {
+			lim.length = ls.topicLimit.length
+		}
+	}
+
+	if lim.length > 0 && len(topic) > lim.length {
+		return fmt.Errorf("longer than %d bytes", lim.length)
+	}
+
+	if lim.levels > 0 && strings.Count(topic, "/")+1 > lim.levels {
+		return fmt.Errorf("more than %d levels", lim.levels)
+	}
+
+	return nil
+}
+
+// admitConnection applies the connection limits of a listener to a new
+// connection from addr, delaying it if it must wait for the connection rate.
+// It returns false if the connection should be refused, and a function which
+// must be called when the connection closes.
+func (s *Server) admitConnection(lid string, addr net.Addr) (func(), bool) {
+	ls := s.listenerSettings(lid)
+	if ls == nil || ls.connLimit == nil {
+		return func() {}, true
+	}
+
+	lim := ls.connLimit
+
+	release := func() {}
+	if lim.perIP > 0 {
+		ip := remoteIP(addr)
+		lim.Lock()
+		if lim.ips[ip] >= lim.perIP {
+			lim.Unlock()
+			return release, false
+		}
+		lim.ips[ip]++
+		lim.Unlock()
+
+		release = func() {
+			lim.Lock()
+			defer lim.Unlock()
+			if lim.ips[ip]--; lim.ips[ip] <= 0 {
+				delete(lim.ips, ip)
+			}
+		}
+	}
+
+	if lim.bucket != nil {
+		wait, ok := lim.bucket.ReserveWithin(time.Now(), lim.wait)
+		if !ok {
+			release()
+			return func() {}, false
+		}
+
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	return release, true
+}
+
+// remoteIP returns the ip address of a remote address, without the port.
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// ioTimeouts returns the read and write timeouts for clients connecting to a
+// listener, which are the defaults if the listener did not set them.
+func (s *Server) ioTimeouts(lid string) ioTimeouts {
+	if ls := s.listenerSettings(lid); ls != nil && ls.timeouts != (ioTimeouts{}) {
+		return ls.timeouts
+	}
+
+	return ioTimeouts{write: defaultWriteTimeout}
+}
+
+// maxKeepalive returns the maximum keepalive for clients connecting to a
+// listener, or 0 if the listener does not limit keepalives.
+func (s *Server) maxKeepalive(lid string) uint16 {
+	if ls := s.listenerSettings(lid); ls != nil {
+		return ls.keepalive
+	}
+
+	return 0
+}
+
+// clientIDValid returns true if a client id is within the restrictions of the
+// listener a client connected to.
+func (s *Server) clientIDValid(lid, id string) bool {
+	ls := s.listenerSettings(lid)
+	if ls == nil {
+		return true
+	}
+
+	rule := ls.clientIDRule
+	if rule.maxLength > 0 && len(id) > rule.maxLength {
+		return false
+	}
+
+	if rule.strict {
+		if len(id) < 1 || len(id) > 23 {
+			return false
+		}
+
+		for i := 0; i < len(id); i++ {
+			c := id[i]
+			if (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// maxQos returns the maximum qos for clients connecting to a listener.
+func (s *Server) maxQos(lid string) byte {
+	if ls := s.listenerSettings(lid); ls != nil {
+		return ls.maxQos
+	}
+
+	return 2
+}
+
+// retainAvailable returns true if clients connecting to a listener may retain messages.
+func (s *Server) retainAvailable(lid string) bool {
+	ls := s.listenerSettings(lid)
+	return ls == nil || !ls.retainDisabled
+}
+
+// exceedsCapabilities returns the reason code and error for a message with the
+// given qos and retain flag which exceeds the maximum qos or retain availability
+// of a listener, or a nil error if it does not.
+func (s *Server) exceedsCapabilities(lid string, qos byte, retain bool) (byte, error) {
+	if qos > s.maxQos(lid) {
+		return packets.CodeQosNotSupported, ErrQosNotSupported
+	}
+
+	if retain && !s.retainAvailable(lid) {
+		return packets.CodeRetainNotSupported, ErrRetainNotSupported
+	}
+
+	return packets.Accepted, nil
+}
+
+// assignKeepalive limits the keepalive of an MQTT v5 client to the maximum of
+// its listener. MQTT v3 clients cannot be told of a server keepalive, so they
+// keep the keepalive they requested.
+func (s *Server) assignKeepalive(cl *clients.Client) {
+	max := s.maxKeepalive(cl.Listener)
+	if max == 0 || cl.ProtocolVersion < 5 {
+		return
+	}
+
+	if cl.Keepalive() == 0 || cl.Keepalive() > max {
+		cl.SetKeepalive(max)
+	}
 }
 
 // inheritClientSession inherits the state of an existing client sharing the same
@@ -409,19 +3103,26 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *clients.Client) boo
 		existing.Lock()
 		defer existing.Unlock()
 
+		// Per [MQTT-3.1.4-3], the existing connection is closed, and MQTT v5
+		// clients are first told that their session was taken over.
+		if atomic.LoadUint32(&existing.State.Done) == 0 {
+			s.sendDisconnect(existing, packets.CodeSessionTakenOver, "session taken over by another connection")
+		}
+
 		existing.Stop(ErrSessionReestablished) // Issue a stop on the old client.
 
-		// Per [MQTT-3.1.2-6]:
-		// If CleanSession is set to 1, the Client and Server MUST discard any previous Session and start a new one.
-		// The state associated with a CleanSession MUST NOT be reused in any subsequent session.
-		if pk.CleanSession || existing.CleanSession {
+		if !sessionResumable(pk, existing) {
+			s.deleteStoredSession(existing)
 			s.unsubscribeClient(existing)
 			s.clearAbandonedInflights(existing)
 			return false
 		}
 
 		cl.Inflight = existing.Inflight // Take address of existing session.
+		cl.InheritInboundQos2(existing)
 		cl.Subscriptions = existing.Subscriptions
+		cl.SubscriptionIDs = existing.SubscriptionIDs
+		cl.SubOptions = existing.SubOptions
 		return true
 
 	} else {
@@ -433,14 +3134,29 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *clients.Client) boo
 	}
 }
 
+// sessionResumable returns true if the session of an existing client may be
+// resumed by a new connection.
+func sessionResumable(pk packets.Packet, existing *clients.Client) bool {
+	// Per [MQTT-3.1.2-6]:
+	// If CleanSession is set to 1, the Client and Server MUST discard any previous Session and start a new one.
+	// The state associated with a CleanSession MUST NOT be reused in any subsequent session.
+	// A session which ends when its connection closes, or which has already
+	// expired, is likewise never resumed.
+	return !pk.CleanSession && existing.SessionExpiryInterval != 0 && !existing.SessionExpired(time.Now().Unix())
+}
+
 // unsubscribeClient unsubscribes a client from all of their subscriptions.
 func (s *Server) unsubscribeClient(cl *clients.Client) {
+	s.clearDeliveryFilters(cl.ID)
 	for k := range cl.Subscriptions {
 		delete(cl.Subscriptions, k)
+		delete(cl.SubscriptionIDs, k)
+		delete(cl.SubOptions, k)
 		if s.Topics.Unsubscribe(k, cl.ID) {
 			if s.Events.OnUnsubscribe != nil {
 				s.Events.OnUnsubscribe(k, cl.Info())
 			}
+			s.hooks.OnUnsubscribe(k, cl.Info())
 			atomic.AddInt64(&s.System.Subscriptions, -1)
 		}
 	}
@@ -448,6 +3164,17 @@ func (s *Server) unsubscribeClient(cl *clients.Client) {
 
 // writeClient writes packets to a client connection.
 func (s *Server) writeClient(cl *clients.Client, pk packets.Packet) error {
+	// [MQTT-3.1.2-29] Clients which set Request Problem Information to 0 are
+	// only sent reason strings and user properties in publishes.
+	if cl.NoProblemInfo && pk.FixedHeader.Type != packets.Publish {
+		pk.Properties.ReasonString = ""
+		pk.Properties.User = nil
+	}
+
+	if pk.FixedHeader.Type == packets.Publish && cl.Compression != "" {
+		pk = compressPublish(pk)
+	}
+
 	_, err := cl.WritePacket(pk)
 	if err != nil {
 		return fmt.Errorf("write: %w", err)
@@ -456,6 +3183,26 @@ func (s *Server) writeClient(cl *clients.Client, pk packets.Packet) error {
 	return nil
 }
 
+// sendDisconnect sends a DISCONNECT packet to an MQTT v5 client which the server
+// is about to disconnect, with the reason code and a human readable reason
+// string, which hooks may replace. MQTT v3 clients are sent nothing, as the
+// server may not send them a DISCONNECT.
+func (s *Server) sendDisconnect(cl *clients.Client, code byte, reason string) {
+	if cl.ProtocolVersion != 5 {
+		return
+	}
+
+	s.onError(cl.Info(), s.writeClient(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Disconnect,
+		},
+		ReturnCode: code,
+		Properties: packets.Properties{
+			ReasonString: s.hooks.OnDisconnectReason(cl.Info(), code, reason),
+		},
+	}))
+}
+
 // processPacket processes an inbound packet for a client. Since the method is
 // typically called as a goroutine, errors are primarily for test checking purposes.
 func (s *Server) processPacket(cl *clients.Client, pk packets.Packet) error {
@@ -467,10 +3214,31 @@ func (s *Server) processPacket(cl *clients.Client, pk packets.Packet) error {
 	case packets.Pingreq:
 		return s.processPingreq(cl, pk)
 	case packets.Publish:
+		if err := s.limitPublish(cl, pk); err != nil {
+			return err
+		}
+		if err := s.resolveTopicAlias(cl, &pk); err != nil {
+			return err
+		}
+		if err := s.validatePublishTopic(cl, pk); err != nil {
+			return err
+		}
 		r, err := pk.PublishValidate()
 		if r != packets.Accepted {
 			return err
 		}
+		if err := s.decompressPublish(cl, &pk); err != nil {
+			return err
+		}
+		if err := s.checkCapabilities(cl, pk); err != nil {
+			return err
+		}
+		if pk.FixedHeader.Qos == 2 && cl.InboundQos2Pending(pk.PacketID) {
+			return s.processDuplicateQos2(cl, pk)
+		}
+		if err := s.checkReceiveMaximum(cl, pk); err != nil {
+			return err
+		}
 		return s.processPublish(cl, pk)
 	case packets.Puback:
 		return s.processPuback(cl, pk)
@@ -501,13 +3269,28 @@ func (s *Server) processPacket(cl *clients.Client, pk packets.Packet) error {
 // establish a new connection on an existing connection. See EstablishConnection
 // instead.
 func (s *Server) processConnect(cl *clients.Client, pk packets.Packet) error {
+	s.sendDisconnect(cl, packets.CodeProtocolError, "connect packet received on an established connection")
 	s.sendLWT(cl)
 	cl.Stop(ErrClientReconnect)
 	return nil
 }
 
-// processDisconnect processes a Disconnect packet.
+// processDisconnect processes a Disconnect packet. The will message of the client
+// is discarded, unless an MQTT v5 client requested that it be sent.
 func (s *Server) processDisconnect(cl *clients.Client, pk packets.Packet) error {
+	if pk.ProtocolVersion == 5 && pk.ReturnCode == packets.CodeDisconnectWillMessage {
+		s.sendLWT(cl)
+	} else {
+		cl.LWT = clients.LWT{}
+		s.storeLWT(cl)
+	}
+
+	// A client may change its session expiry interval when disconnecting, unless
+	// it was connected without a session to keep.
+	if pk.ProtocolVersion == 5 && pk.Properties.SessionExpiryIntervalFlag && cl.SessionExpiryInterval > 0 {
+		cl.SessionExpiryInterval = pk.Properties.SessionExpiryInterval
+	}
+
 	cl.Stop(ErrClientDisconnect)
 	return nil
 }
@@ -528,20 +3311,33 @@ func (s *Server) processPingreq(cl *clients.Client, pk packets.Packet) error {
 
 // Publish creates a publish packet from a payload and sends it to the inline.pub
 // channel, where it is written directly to the outgoing byte buffers of any
-// clients subscribed to the given topic. Because the message is written directly
-// within the server, QoS is inherently 2 (exactly once).
-func (s *Server) Publish(topic string, payload []byte, retain bool) error {
+// clients subscribed to the given topic. Subscribers receive the message as if
+// it had been published by a client with the given QoS, so QoS 1 and 2 messages
+// are tracked as inflight (and persisted) until they are acknowledged.
+func (s *Server) Publish(topic string, payload []byte, qos byte, retain bool) error {
 	if len(topic) >= 4 && topic[0:4] == "$SYS" {
 		return ErrInvalidTopic
 	}
 
-	pk := packets.Packet{
+	if qos > 2 {
+		return ErrInvalidQos
+	}
+
+	if err := ValidateTopicName(topic); err != nil {
+		return err
+	}
+
+	pk, err := s.encodePayload(s.inline.Info(), packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type:   packets.Publish,
+			Qos:    qos,
 			Retain: retain,
 		},
 		TopicName: topic,
 		Payload:   payload,
+	})
+	if err != nil {
+		return err
 	}
 
 	if retain {
@@ -555,6 +3351,71 @@ func (s *Server) Publish(topic string, payload []byte, retain bool) error {
 	return nil
 }
 
+// ValidateTopicName returns an error wrapping ErrInvalidTopicName if a topic name,
+// such as that of a publish, is empty, longer than 65535 bytes, not valid UTF-8,
+// or contains the null character or a wildcard.
+func ValidateTopicName(topic string) error {
+	if err := validateTopic(topic); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidTopicName, err)
+	}
+
+	// [MQTT-3.3.2-2] The Topic Name in the PUBLISH packet MUST NOT contain wildcard characters.
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("%w: contains wildcard", ErrInvalidTopicName)
+	}
+
+	return nil
+}
+
+// ValidateTopicFilter returns an error wrapping ErrInvalidTopicFilter if a topic
+// filter, such as that of a subscription, is empty, longer than 65535 bytes, not
+// valid UTF-8, contains the null character, or has misplaced wildcards.
+func ValidateTopicFilter(filter string) error {
+	if err := validateTopic(filter); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidTopicFilter, err)
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		// [MQTT-4.7.1-3] The single-level wildcard MUST occupy an entire level of the filter,
+		// as must the multi-level wildcard, which MUST also be the last level [MQTT-4.7.1-2].
+		if len(level) > 1 && strings.ContainsAny(level, "+#") {
+			return fmt.Errorf("%w: wildcard must occupy an entire level", ErrInvalidTopicFilter)
+		}
+
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("%w: multi-level wildcard must be the last level", ErrInvalidTopicFilter)
+		}
+	}
+
+	return nil
+}
+
+// validateTopic checks the requirements common to topic names and filters.
+func validateTopic(topic string) error {
+	// [MQTT-4.7.3-1] All Topic Names and Topic Filters MUST be at least one character long.
+	if topic == "" {
+		return errors.New("empty")
+	}
+
+	// [MQTT-4.7.3-3] Topic Names and Topic Filters MUST NOT encode to more than 65535 bytes.
+	if len(topic) > 65535 {
+		return errors.New("too long")
+	}
+
+	// [MQTT-1.5.4-1] The character data in a UTF-8 Encoded String MUST be well-formed UTF-8.
+	if !utf8.ValidString(topic) {
+		return errors.New("invalid utf-8")
+	}
+
+	// [MQTT-4.7.3-2] Topic Names and Topic Filters MUST NOT include the null character (U+0000).
+	if strings.IndexByte(topic, 0) >= 0 {
+		return errors.New("contains null character")
+	}
+
+	return nil
+}
+
 // Info provides pseudo-client information for the inline messages processor.
 // It provides a 'client' to which inline retained messages can be assigned.
 func (*inlineMessages) Info() events.Client {
@@ -571,10 +3432,63 @@ func (s *Server) processPublish(cl *clients.Client, pk packets.Packet) error {
 		return nil // Clients can't publish to $SYS topics, so fail silently as per spec.
 	}
 
-	if !cl.AC.ACL(cl.Username, pk.TopicName, true) {
+	// Clients restored from the store have no auth controller, and only
+	// publish the will messages which were accepted when they connected.
+	if cl.AC != nil {
+		if ok, err := s.aclAllowed(cl, pk.TopicName, true, pk.Properties.User); err != nil {
+			// The check failed rather than denying access, so MQTT v5
+			// publishers are sent Quota exceeded (0x97), a transient
+			// condition which may be retried later, rather than Not
+			// authorized. MQTT v3 publishers are sent nothing, leaving
+			// qos 1 and 2 messages unacknowledged to be resent.
+			s.onError(cl.Info(), err)
+			s.forgetReceived(cl, pk)
+			if cl.ProtocolVersion == 5 {
+				s.rejectPublish(cl, pk, packets.CodeQuotaExceeded)
+			}
+			return nil
+		} else if !ok {
+			s.Options.Logger.Debug("publish denied by acl", logFields(cl.Info(), logger.KeyTopic, pk.TopicName)...)
+			return nil
+		}
+	}
+
+	// The original topic is kept in a user property so the message can be
+	// traced back to its publisher's convention.
+	if topic, ok := s.rewriteTopic(pk.TopicName, false); ok {
+		if err := ValidateTopicName(topic); err != nil || strings.HasPrefix(topic, "$") {
+			s.Options.Logger.Warn("invalid rewritten topic", logFields(cl.Info(), logger.KeyTopic, pk.TopicName, "rewritten", topic)...)
+		} else {
+			user := pk.Properties.User
+			pk.Properties.User = append(user[:len(user):len(user)], packets.UserProperty{Key: OriginalTopicProperty, Val: pk.TopicName})
+			pk.TopicName = topic
+		}
+	}
+
+	// Duplicates are acknowledged so the publisher stops resending them, but
+	// are neither retained nor forwarded.
+	if s.duplicate(pk) {
+		s.Options.Logger.Debug("duplicate publish suppressed", logFields(cl.Info(), logger.KeyTopic, pk.TopicName)...)
+		s.ackPublish(cl, pk.FixedHeader.Qos, pk.PacketID)
 		return nil
 	}
 
+	if action, ok := s.rateLimited(pk.TopicName); ok {
+		return s.rejectRateLimited(cl, pk, action)
+	}
+
+	if reason, ok := s.storeUnavailable(); ok && pk.FixedHeader.Qos > 0 {
+		s.Options.Logger.Warn(reason, logFields(cl.Info(), logger.KeyTopic, pk.TopicName)...)
+		atomic.AddInt64(&s.System.StoreRejected, 1)
+		s.forgetReceived(cl, pk)
+		if cl.ProtocolVersion == 5 {
+			s.rejectPublish(cl, pk, packets.CodeQuotaExceeded)
+		}
+		return nil
+	}
+
+	s.storeReceived(cl, pk)
+
 	// if an OnProcessMessage hook exists, potentially modify the packet.
 	if s.Events.OnProcessMessage != nil {
 		pkx, err := s.Events.OnProcessMessage(cl.Info(), events.Packet(pk))
@@ -592,65 +3506,527 @@ func (s *Server) processPublish(cl *clients.Client, pk packets.Packet) error {
 		}
 	}
 
-	if pk.FixedHeader.Retain {
-		s.retainMessage(cl, pk)
+	// Allow any hooks to modify or drop the packet before it is routed.
+	if pkx, err := s.hooks.OnPublish(cl.Info(), events.Packet(pk), s.Events.OnError); err == nil {
+		pk = packets.Packet(pkx)
+	} else {
+		return nil
+	}
+
+	pk, err := s.encodePayload(cl.Info(), pk)
+	if err != nil {
+		s.onError(cl.Info(), err)
+		return nil
+	}
+
+	// Publishes exceeding the capabilities of the listener are acknowledged with
+	// the qos they were sent with, but are routed no higher than the maximum qos,
+	// and are not retained if retain is not available.
+	qos := pk.FixedHeader.Qos
+	if max := s.maxQos(cl.Listener); pk.FixedHeader.Qos > max {
+		pk.FixedHeader.Qos = max
+	}
+
+	if pk.FixedHeader.Retain && !s.retainAvailable(cl.Listener) {
+		pk.FixedHeader.Retain = false
+	}
+
+	if pk.FixedHeader.Retain {
+		s.retainMessage(cl, pk)
+	}
+
+	s.ackPublish(cl, qos, pk.PacketID)
+
+	// if an OnMessage hook exists, potentially modify the packet.
+	if s.Events.OnMessage != nil {
+		if pkx, err := s.Events.OnMessage(cl.Info(), events.Packet(pk)); err == nil {
+			pk = packets.Packet(pkx)
+		}
+	}
+
+	s.noteLastValue(pk)
+
+	// write packet to the byte buffers of any clients with matching topic filters.
+	s.publishToSubscribers(pk)
+
+	return nil
+}
+
+// ackPublish acknowledges a publish received with the given qos and packet id.
+func (s *Server) ackPublish(cl *clients.Client, qos byte, id uint16) {
+	if qos == 0 {
+		return
+	}
+
+	ack := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Puback,
+		},
+		PacketID: id,
+	}
+
+	if qos == 2 {
+		ack.FixedHeader.Type = packets.Pubrec
+	}
+
+	// omit errors in case of broken connection / LWT publish. ack send failures
+	// will be handled by in-flight resending on next reconnect.
+	s.onError(cl.Info(), s.writeClient(cl, ack))
+}
+
+// validatePublishTopic checks the topic name of a publish received from a client.
+// Clients which publish to an invalid topic are disconnected, with MQTT v5
+// clients first sent a disconnect packet with the topic name invalid reason code.
+func (s *Server) validatePublishTopic(cl *clients.Client, pk packets.Packet) error {
+	err := ValidateTopicName(pk.TopicName)
+	if err == nil {
+		if lerr := s.checkTopicLimits(cl.Listener, pk.TopicName); lerr != nil {
+			err = fmt.Errorf("%w: %s", ErrInvalidTopicName, lerr)
+		}
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	s.Options.Logger.Warn("client published to invalid topic", logFields(cl.Info(),
+		logger.KeyTopic, pk.TopicName,
+		logger.KeyError, err,
+	)...)
+
+	s.sendDisconnect(cl, packets.CodeTopicNameInvalid, err.Error())
+	return err
+}
+
+// resolveTopicAlias sets the topic of a publish packet which uses an MQTT v5
+// topic alias. Clients which use an invalid or unknown alias are sent a
+// disconnect packet with the matching reason code.
+func (s *Server) resolveTopicAlias(cl *clients.Client, pk *packets.Packet) error {
+	err := cl.TopicAliases.ResolveInbound(pk)
+	if err == nil {
+		return nil
+	}
+
+	s.Options.Logger.Warn("client sent invalid topic alias", logFields(cl.Info(),
+		"topic_alias", pk.Properties.TopicAlias,
+		logger.KeyError, err,
+	)...)
+
+	code := packets.CodeProtocolError
+	if errors.Is(err, packets.ErrTopicAliasInvalid) {
+		code = packets.CodeTopicAliasInvalid
+	}
+
+	s.sendDisconnect(cl, code, err.Error())
+	return err
+}
+
+// negotiateCompression returns the payload compression algorithm to use with a
+// client, which is deflate if compression is enabled and the client listed it in
+// the compression user property of its CONNECT, or empty if it is not.
+func (s *Server) negotiateCompression(cl *clients.Client, pk packets.Packet) string {
+	if !s.Options.Compression || cl.ProtocolVersion != 5 {
+		return ""
+	}
+
+	for _, p := range pk.Properties.User {
+		if p.Key != CompressionProperty {
+			continue
+		}
+
+		for _, alg := range strings.Split(p.Val, ",") {
+			if strings.TrimSpace(alg) == CompressionDeflate {
+				return CompressionDeflate
+			}
+		}
+	}
+
+	return ""
+}
+
+// decompressPublish inflates the payload of a publish marked as compressed by
+// a client which negotiated compression, and removes the content encoding user
+// property. Payloads are not inflated beyond the maximum packet size of the
+// listener, or the MaxInflatedPayload if it is lower. Clients which send an invalid compressed payload are sent a
+// disconnect packet with the payload format invalid reason code.
+func (s *Server) decompressPublish(cl *clients.Client, pk *packets.Packet) error {
+	if cl.Compression == "" {
+		return nil
+	}
+
+	i := -1
+	for j, p := range pk.Properties.User {
+		if p.Key == ContentEncodingProperty {
+			i = j
+			break
+		}
+	}
+
+	if i < 0 {
+		return nil
+	}
+
+	max := s.Options.MaxInflatedPayload
+	if n := s.maxPacketSize(cl.Listener); n > 0 && n < max {
+		max = n
+	}
+
+	payload, err := inflatePayload(pk.Properties.User[i].Val, pk.Payload, max)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrInvalidCompressedPayload, err)
+		s.Options.Logger.Warn("client sent invalid compressed payload", logFields(cl.Info(),
+			logger.KeyTopic, pk.TopicName,
+			logger.KeyError, err,
+		)...)
+		s.sendDisconnect(cl, packets.CodePayloadFormatInvalid, err.Error())
+		return err
+	}
+
+	user := make([]packets.UserProperty, 0, len(pk.Properties.User)-1)
+	user = append(user, pk.Properties.User[:i]...)
+	user = append(user, pk.Properties.User[i+1:]...)
+	if len(user) == 0 {
+		user = nil
+	}
+
+	pk.Properties.User = user
+	pk.Payload = payload
+	return nil
+}
+
+// inflatePayload decompresses a payload compressed with an algorithm, returning
+// an error if the algorithm is unsupported, the payload is invalid, or it would
+// inflate to more than max bytes.
+func inflatePayload(alg string, payload []byte, max uint32) ([]byte, error) {
+	if alg != CompressionDeflate {
+		return nil, fmt.Errorf("unsupported content encoding %q", alg)
+	}
+
+	r := io.LimitReader(flate.NewReader(bytes.NewReader(payload)), int64(max)+1)
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) > int(max) {
+		return nil, fmt.Errorf("payload exceeds maximum inflated size %d", max)
+	}
+
+	return out, nil
+}
+
+// deflateWriters is a pool of deflate writers, which are expensive to allocate.
+var deflateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// compressPublish returns a copy of a publish being sent to a client which
+// negotiated compression, with a deflated payload and the content encoding user
+// property. The publish is returned unchanged if compression would not make it
+// smaller.
+func compressPublish(pk packets.Packet) packets.Packet {
+	if len(pk.Payload) <= contentEncodingSize {
+		return pk
+	}
+
+	var buf bytes.Buffer
+	w := deflateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	_, err := w.Write(pk.Payload)
+	if err == nil {
+		err = w.Close()
+	}
+	deflateWriters.Put(w)
+
+	if err != nil || buf.Len()+contentEncodingSize >= len(pk.Payload) {
+		return pk
+	}
+
+	user := pk.Properties.User
+	pk.Properties.User = append(user[:len(user):len(user)], packets.UserProperty{Key: ContentEncodingProperty, Val: CompressionDeflate})
+	pk.Payload = buf.Bytes()
+	return pk
+}
+
+// checkReceiveMaximum notes a QoS 2 message received from a client, and disconnects
+// the client if it has more unreleased QoS 2 messages than the server's receive
+// maximum. QoS 1 messages are acknowledged as soon as they are processed, so they
+// never exceed the receive maximum.
+func (s *Server) checkReceiveMaximum(cl *clients.Client, pk packets.Packet) error {
+	if pk.FixedHeader.Qos < 2 {
+		return nil
+	}
+
+	n := cl.NoteInboundQos2(pk.PacketID)
+	if s.Options.ReceiveMaximum == 0 || n <= int(s.Options.ReceiveMaximum) {
+		return nil
+	}
+
+	s.Options.Logger.Warn("client exceeded receive maximum", logFields(cl.Info(), "receive_maximum", s.Options.ReceiveMaximum)...)
+	s.sendDisconnect(cl, packets.CodeReceiveMaximumExceeded, "receive maximum exceeded")
+	return ErrReceiveMaximumExceeded
+}
+
+// processDuplicateQos2 acknowledges a qos 2 publish which was already received
+// from a client and is awaiting a pubrel. Per [MQTT-4.3.3-9], the message is
+// acknowledged with another pubrec, but is not delivered again.
+func (s *Server) processDuplicateQos2(cl *clients.Client, pk packets.Packet) error {
+	s.onError(cl.Info(), s.writeClient(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pubrec,
+		},
+		PacketID: pk.PacketID,
+	}))
+
+	return nil
+}
+
+// storeReceived adds a qos 2 message received from a client to the persistent
+// store, if one is provided, before it is delivered, so that the message is
+// not delivered again if the client resends it after a restart. Will messages
+// have no packet id, and are not stored.
+func (s *Server) storeReceived(cl *clients.Client, pk packets.Packet) {
+	if s.Store == nil || pk.FixedHeader.Qos < 2 || pk.PacketID == 0 {
+		return
+	}
+
+	s.onStorage(cl, "WriteInflight", s.Store.WriteInflight(persistence.Message{
+		ID:          receivedID(cl, pk),
+		T:           persistence.KInflight,
+		Client:      cl.ID,
+		FixedHeader: persistence.FixedHeader(pk.FixedHeader),
+		PacketID:    pk.PacketID,
+		TopicName:   pk.TopicName,
+		Created:     time.Now().Unix(),
+		Phase:       persistence.PhaseReceived,
+	}))
+}
+
+// forgetReceived forgets a qos 2 publish which was dropped before it was
+// acknowledged, so that the client's resend is processed as a new message
+// rather than acknowledged as a duplicate of one which was never delivered.
+// Publishes are dropped before they are added to the store, so there is no
+// record to delete.
+func (s *Server) forgetReceived(cl *clients.Client, pk packets.Packet) {
+	if pk.FixedHeader.Qos < 2 {
+		return
+	}
+
+	cl.ForgetInboundQos2(pk.PacketID)
+}
+
+// checkCapabilities disconnects MQTT v5 clients which send a publish exceeding
+// the maximum qos or retain availability advertised in their CONNACK. MQTT v3
+// clients cannot be told of the limits, so their publishes are downgraded by
+// processPublish instead.
+func (s *Server) checkCapabilities(cl *clients.Client, pk packets.Packet) error {
+	if cl.ProtocolVersion < 5 {
+		return nil
+	}
+
+	code, err := s.exceedsCapabilities(cl.Listener, pk.FixedHeader.Qos, pk.FixedHeader.Retain)
+	if err == nil {
+		return nil
+	}
+
+	s.Options.Logger.Warn("publish not supported by listener", logFields(cl.Info(),
+		logger.KeyTopic, pk.TopicName,
+		logger.KeyError, err,
+	)...)
+
+	s.sendDisconnect(cl, code, err.Error())
+	return err
+}
+
+// addPublisher starts limiting and measuring the rate at which a connected
+// client publishes, according to the publish rate limit of its listener.
+func (s *Server) addPublisher(cl *clients.Client) {
+	var limit publishLimit
+	if ls := s.listenerSettings(cl.Listener); ls != nil {
+		limit = ls.publishLimit
+	}
+
+	p := &publishLimiter{
+		maxDelay: limit.maxDelay,
+	}
+	if limit.rate > 0 {
+		p.messages = ratelimit.NewBucket(limit.rate, limit.burst)
+	}
+	if limit.byteRate > 0 {
+		p.bytes = ratelimit.NewBucket(limit.byteRate, limit.byteBurst)
+	}
+
+	s.publishersMu.Lock()
+	s.publishers[cl] = p
+	s.publishersMu.Unlock()
+}
+
+// removePublisher stops limiting and measuring the publishes of a client once
+// it has disconnected.
+func (s *Server) removePublisher(cl *clients.Client) {
+	s.publishersMu.Lock()
+	delete(s.publishers, cl)
+	s.publishersMu.Unlock()
+}
+
+// publishRate returns the messages and payload bytes a client published in the
+// last second.
+func (s *Server) publishRate(cl *clients.Client) (float64, float64) {
+	s.publishersMu.RLock()
+	p, ok := s.publishers[cl]
+	s.publishersMu.RUnlock()
+	if !ok {
+		return 0, 0
+	}
+
+	now := time.Now()
+	return p.messageRate.Rate(now), p.byteRate.Rate(now)
+}
+
+// limitPublish applies the publish rate limit of the listener of a client to
+// a publish, delaying it until it is within the limit. As the client's packets
+// are read in turn, no further packets are read from it in the meantime. If
+// the publish would be delayed for longer than the listener allows, the client
+// is disconnected with the message rate too high reason code.
+func (s *Server) limitPublish(cl *clients.Client, pk packets.Packet) error {
+	s.publishersMu.RLock()
+	p, ok := s.publishers[cl]
+	s.publishersMu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	max := p.maxDelay
+	if max <= 0 {
+		max = time.Duration(math.MaxInt64)
+	}
+
+	var wait time.Duration
+	for _, r := range []struct {
+		bucket *ratelimit.Bucket
+		n      float64
+	}{
+		{p.messages, 1},
+		{p.bytes, float64(len(pk.Payload))},
+	} {
+		if r.bucket == nil {
+			continue
+		}
+
+		d, ok := r.bucket.ReserveNWithin(now, r.n, max)
+		if !ok {
+			s.Options.Logger.Warn("client exceeded publish rate", logFields(cl.Info(), logger.KeyTopic, pk.TopicName)...)
+			s.sendDisconnect(cl, packets.CodeMessageRateTooHigh, "message rate too high")
+			return ErrPublishRateExceeded
+		}
+
+		if d > wait {
+			wait = d
+		}
+	}
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	now = time.Now()
+	p.messageRate.Mark(now, 1)
+	p.byteRate.Mark(now, float64(len(pk.Payload)))
+	return nil
+}
+
+// rejectRateLimited drops a publish which exceeded a rate limit, acknowledging
+// it with the message rate too high reason code for MQTT v5 clients, or
+// disconnects the client if the rate limit action requires it.
+func (s *Server) rejectRateLimited(cl *clients.Client, pk packets.Packet, action RateLimitAction) error {
+	s.Options.Logger.Debug("publish rate limited", logFields(cl.Info(), logger.KeyTopic, pk.TopicName)...)
+
+	if action == RateLimitDisconnect {
+		s.sendDisconnect(cl, packets.CodeMessageRateTooHigh, "message rate too high")
+		return ErrRateLimitExceeded
 	}
 
-	if pk.FixedHeader.Qos > 0 {
-		ack := packets.Packet{
-			FixedHeader: packets.FixedHeader{
-				Type: packets.Puback,
-			},
-			PacketID: pk.PacketID,
-		}
-
-		if pk.FixedHeader.Qos == 2 {
-			ack.FixedHeader.Type = packets.Pubrec
-		}
+	s.rejectPublish(cl, pk, packets.CodeMessageRateTooHigh)
+	return nil
+}
 
-		// omit errors in case of broken connection / LWT publish. ack send failures
-		// will be handled by in-flight resending on next reconnect.
-		s.onError(cl.Info(), s.writeClient(cl, ack))
+// rejectPublish acknowledges a qos 1 or 2 publish which will not be delivered
+// with a reason code, in a PUBACK or PUBREC.
+func (s *Server) rejectPublish(cl *clients.Client, pk packets.Packet, code byte) {
+	if pk.FixedHeader.Qos == 0 {
+		return
 	}
 
-	// if an OnMessage hook exists, potentially modify the packet.
-	if s.Events.OnMessage != nil {
-		if pkx, err := s.Events.OnMessage(cl.Info(), events.Packet(pk)); err == nil {
-			pk = packets.Packet(pkx)
-		}
+	ack := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Puback,
+		},
+		PacketID:   pk.PacketID,
+		ReturnCode: code,
 	}
 
-	// write packet to the byte buffers of any clients with matching topic filters.
-	s.publishToSubscribers(pk)
+	if pk.FixedHeader.Qos == 2 {
+		ack.FixedHeader.Type = packets.Pubrec
+	}
 
-	return nil
+	s.onError(cl.Info(), s.writeClient(cl, ack))
 }
 
 // retainMessage adds a message to a topic, and if a persistent store is provided,
 // adds the message to the store so it can be reloaded if necessary.
 func (s *Server) retainMessage(cl events.Clientlike, pk packets.Packet) {
+	// A message too large to retain still replaces any message already retained
+	// on the topic, so that new subscribers are not sent a stale value.
+	if max := s.Options.MaxRetainedMessageBytes; max > 0 && len(pk.Payload) > max {
+		atomic.AddInt64(&s.System.RetainedRejected, 1)
+		s.deleteRetained(pk)
+		return
+	}
+
+	// The qos the message was published with is kept, so that it can be replayed
+	// at the lower of it and the qos of each new subscription.
 	out := pk.PublishCopy()
+	out.FixedHeader.Qos = pk.FixedHeader.Qos
+	if out.Created == 0 {
+		out.Created = time.Now().Unix()
+	}
+
 	r := s.Topics.RetainMessage(out)
-	atomic.AddInt64(&s.System.Retained, r)
+	s.updateRetainedStats()
 
 	if s.Store != nil {
 		id := "ret_" + out.TopicName
 		if r == 1 {
-			s.onStorage(cl, s.Store.WriteRetained(persistence.Message{
-				ID:          id,
-				T:           persistence.KRetained,
-				FixedHeader: persistence.FixedHeader(out.FixedHeader),
-				TopicName:   out.TopicName,
-				Payload:     out.Payload,
+			s.onStorage(cl, "WriteRetained", s.Store.WriteRetained(persistence.Message{
+				ID:             id,
+				T:              persistence.KRetained,
+				FixedHeader:    persistence.FixedHeader(out.FixedHeader),
+				TopicName:      out.TopicName,
+				Payload:        out.Payload,
+				Created:        out.Created,
+				ExpiryInterval: int64(out.Properties.MessageExpiryInterval),
+
+				ResponseTopic:   out.Properties.ResponseTopic,
+				CorrelationData: out.Properties.CorrelationData,
+				User:            storedUserProperties(out.Properties.User),
 			}))
 		} else {
-			s.onStorage(cl, s.Store.DeleteRetained(id))
+			s.onStorage(cl, "DeleteRetained", s.Store.DeleteRetained(id))
 		}
 	}
+
+	s.evictRetained()
 }
 
 // publishToSubscribers publishes a publish packet to all subscribers with
-// matching topic filters.
+// matching topic filters, and to one member of each matching share group.
+// Per [MQTT-3.3.4-2], a client with overlapping subscriptions is sent a single
+// copy at the highest QoS of the matching subscriptions, carrying all of their
+// subscription identifiers.
 func (s *Server) publishToSubscribers(pk packets.Packet) {
 	for id, qos := range s.Topics.Subscribers(pk.TopicName) {
 		if client, ok := s.Clients.Get(id); ok {
@@ -662,44 +4038,261 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 				continue
 			}
 
-			out := pk.PublishCopy()
-			if qos > out.FixedHeader.Qos { // Inherit higher desired qos values.
-				out.FixedHeader.Qos = qos
+			if !s.deliveryAllowed(client, pk, "") {
+				continue
 			}
 
-			if out.FixedHeader.Qos > 0 { // If QoS required, save to inflight index.
-				if out.PacketID == 0 {
-					out.PacketID = uint16(client.NextPacketID())
-				}
+			if out, ok := s.decodePayload(client, pk); ok {
+				s.publishToClient(client, out, qos, "")
+			}
+		}
+	}
 
-				// If a message has a QoS, we need to ensure it is delivered to
-				// the client at some point, one way or another. Store the publish
-				// packet in the client's inflight queue and attempt to redeliver
-				// if an appropriate ack is not received (or if the client is offline).
-				sent := time.Now().Unix()
-				q := client.Inflight.Set(out.PacketID, clients.InflightMessage{
-					Packet:  out,
-					Created: time.Now().Unix(),
-					Sent:    sent,
-				})
-				if q {
-					atomic.AddInt64(&s.System.Inflight, 1)
-				}
+	for filter, members := range s.Topics.SharedSubscribers(pk.TopicName) {
+		if client, qos, ok := s.selectSharedMember(filter, members, pk.AllowClients, ""); ok && s.deliveryAllowed(client, pk, filter) {
+			if out, ok := s.decodePayload(client, pk); ok {
+				s.publishToClient(client, out, qos, filter)
+			}
+		}
+	}
+}
 
-				if s.Store != nil {
-					s.onStorage(client, s.Store.WriteInflight(persistence.Message{
-						ID:          persistentID(client, out),
-						T:           persistence.KInflight,
-						FixedHeader: persistence.FixedHeader(out.FixedHeader),
-						TopicName:   out.TopicName,
-						Payload:     out.Payload,
-						Sent:        sent,
-					}))
-				}
+// publishToClient publishes a copy of a publish packet to a single client. If
+// the message was delivered through a shared subscription, the shared filter
+// is noted against any resulting inflight message.
+func (s *Server) publishToClient(client *clients.Client, pk packets.Packet, qos byte, shared string) {
+	// Per [MQTT-3.8.4-8], messages are delivered at the lower of the QoS
+	// they were published with and the QoS granted to the subscription.
+	out := pk.PublishCopy()
+	out.FixedHeader.Qos = qos
+	if pk.FixedHeader.Qos < qos {
+		out.FixedHeader.Qos = pk.FixedHeader.Qos
+	}
+
+	out.Properties.SubscriptionIdentifier = client.MatchingSubscriptionIDs(out.TopicName, shared)
+
+	// MQTT v5 clients receive messages for established subscriptions with the
+	// retain flag cleared, unless a subscription asked to retain as published.
+	if out.FixedHeader.Retain && client.ProtocolVersion == 5 && !client.RetainAsPublished(out.TopicName, shared) {
+		out.FixedHeader.Retain = false
+	}
+
+	s.deliver(client, out, shared)
+}
+
+// deliver sends a message to a client. Messages with a QoS are added to the
+// client's inflight messages, or queued if its receive maximum is used up.
+func (s *Server) deliver(client *clients.Client, out packets.Packet, shared string) {
+	slow := s.slowConsumer(client)
+	if slow && s.Options.SlowConsumer == SlowConsumerDisconnect {
+		s.Options.Logger.Warn("slow consumer disconnected", logFields(client.Info(), "write_buffered", client.WriteBuffered())...)
+		client.Stop(ErrSlowConsumer)
+		return
+	}
+
+	if out.FixedHeader.Qos == 0 && slow && s.Options.SlowConsumer == SlowConsumerDrop {
+		atomic.AddInt64(&s.System.PublishDropped, 1)
+		return
+	}
+
+	if out.FixedHeader.Qos > 0 { // If QoS required, save to inflight index.
+		if s.inflightQuotaExceeded(client) {
+			if s.Options.InflightOverflow == InflightDisconnect {
+				s.Options.Logger.Warn("client exceeded inflight quota", logFields(client.Info())...)
+				s.sendDisconnect(client, packets.CodeQuotaExceeded, "inflight quota exceeded")
+				client.Stop(ErrInflightQuotaExceeded)
+				return
+			}
+
+			atomic.AddInt64(&s.System.PublishDropped, 1)
+			return
+		}
+
+		// If a message has a QoS, we need to ensure it is delivered to
+		// the client at some point, one way or another. Store the publish
+		// packet in the client's inflight queue and attempt to redeliver
+		// if an appropriate ack is not received (or if the client is offline).
+		// MQTT v5 clients may set a receive maximum, in which case messages
+		// beyond their quota are queued until earlier messages are acknowledged.
+		now := time.Now().Unix()
+		in, ok := client.Inflight.SetOrQueue(clients.InflightMessage{
+			Packet:   out,
+			Created:  now,
+			Sent:     now,
+			Shared:   shared,
+			Sequence: atomic.AddInt64(&s.inflightSeq, 1),
+		}, int(client.ReceiveMaximum))
+		if !ok {
+			return
+		}
+
+		s.storeInflight(client, in)
+		out = in.Packet
+
+		// The inflight message is resent once it is due, by which time the
+		// client may have caught up.
+		if slow && s.Options.SlowConsumer == SlowConsumerDrop {
+			return
+		}
+	}
+
+	s.onError(client.Info(), s.writeClient(client, out))
+}
+
+// slowConsumer returns true if a client's write buffer has reached the
+// WriteHighWater mark.
+func (s *Server) slowConsumer(cl *clients.Client) bool {
+	return s.Options.WriteHighWater > 0 && cl.WriteBuffered() >= s.Options.WriteHighWater
+}
+
+// WriteBuffered returns the number of bytes waiting in the write buffer of
+// each connected client, keyed on client id.
+func (s *Server) WriteBuffered() map[string]int {
+	all := s.Clients.GetAll()
+	m := make(map[string]int, len(all))
+	for id, cl := range all {
+		if atomic.LoadUint32(&cl.State.Done) == 0 {
+			m[id] = cl.WriteBuffered()
+		}
+	}
+
+	return m
+}
+
+// storeInflight counts a new inflight message, and if a persistent store is
+// provided, adds the message to the store so it can be resent if necessary.
+func (s *Server) storeInflight(cl *clients.Client, in clients.InflightMessage) {
+	atomic.AddInt64(&s.System.Inflight, 1)
+
+	if s.Store != nil {
+		s.writeInflight(cl, in)
+	}
+}
+
+// writeInflight writes an inflight message of a client to the persistent store.
+// Qos 2 messages for which a pubrel has been sent are stored in the release
+// phase, so that the pubrel is resent rather than the publish.
+func (s *Server) writeInflight(cl *clients.Client, in clients.InflightMessage) {
+	phase := persistence.PhasePublish
+	if in.Packet.FixedHeader.Type == packets.Pubrel {
+		phase = persistence.PhaseRelease
+	}
+
+	s.onStorage(cl, "WriteInflight", s.Store.WriteInflight(persistence.Message{
+		ID:          persistentID(cl, in.Packet),
+		T:           persistence.KInflight,
+		Client:      cl.ID,
+		FixedHeader: persistence.FixedHeader(in.Packet.FixedHeader),
+		PacketID:    in.Packet.PacketID,
+		TopicName:   in.Packet.TopicName,
+		Payload:     in.Packet.Payload,
+		Created:     in.Created,
+		Sent:        in.Sent,
+		Resends:     in.Resends,
+		Sequence:    in.Sequence,
+
+		ResponseTopic:   in.Packet.Properties.ResponseTopic,
+		CorrelationData: in.Packet.Properties.CorrelationData,
+		User:            storedUserProperties(in.Packet.Properties.User),
+		Phase:           phase,
+	}))
+}
+
+// releaseQueued sends the queued QoS messages of a client, in the order they
+// were queued, until the client's receive maximum quota is used up.
+func (s *Server) releaseQueued(cl *clients.Client) {
+	for {
+		in, ok := cl.Inflight.Dequeue(int(cl.ReceiveMaximum))
+		if !ok {
+			return
+		}
+
+		s.storeInflight(cl, in)
+		s.onError(cl.Info(), s.writeClient(cl, in.Packet))
+	}
+}
+
+// selectSharedMember selects the member of a share group which should receive
+// a message, according to the shared subscription strategy. Connected members
+// are preferred over those which are offline. If allow is not nil, only the
+// members it contains may be selected, and the exclude member is never selected.
+func (s *Server) selectSharedMember(filter string, members topics.Subscriptions, allow []string, exclude string) (*clients.Client, byte, bool) {
+	var online, offline []string
+	for id := range members {
+		if id == exclude || (allow != nil && !utils.InSliceString(allow, id)) {
+			continue
+		}
+
+		if cl, ok := s.Clients.Get(id); ok {
+			if atomic.LoadUint32(&cl.State.Done) == 0 {
+				online = append(online, id)
+			} else {
+				offline = append(offline, id)
 			}
+		}
+	}
+
+	candidates := online
+	if len(candidates) == 0 {
+		candidates = offline
+	}
+
+	if len(candidates) == 0 {
+		return nil, 0, false
+	}
+
+	sort.Strings(candidates) // map order is random, so sort to make round robin fair.
+
+	var i int
+	if s.Options.SharedStrategy == SharedRandom {
+		i = rand.Intn(len(candidates))
+	} else {
+		s.sharedMu.Lock()
+		i = s.sharedNext[filter] % len(candidates)
+		s.sharedNext[filter] = i + 1
+		s.sharedMu.Unlock()
+	}
+
+	cl, ok := s.Clients.Get(candidates[i])
+	return cl, members[candidates[i]], ok
+}
+
+// redeliverShared delivers the unacknowledged messages a client received
+// through a shared subscription to other members of the share group. If filter
+// is empty, messages from all of the client's shared subscriptions are redelivered.
+func (s *Server) redeliverShared(cl *clients.Client, filter string) {
+	for _, tk := range cl.Inflight.GetAll() {
+		if tk.Shared == "" || (filter != "" && tk.Shared != filter) {
+			continue
+		}
+
+		client, qos, ok := s.selectSharedMember(tk.Shared, s.Topics.SharedMembers(tk.Shared), nil, cl.ID)
+		if !ok {
+			continue // there's nobody else to take the message, so leave it with the client.
+		}
+
+		if cl.Inflight.Delete(tk.Packet.PacketID) {
+			atomic.AddInt64(&s.System.Inflight, -1)
+		}
+
+		if s.Store != nil {
+			s.onStorage(cl, "DeleteInflight", s.Store.DeleteInflight(persistentID(cl, tk.Packet)))
+		}
+
+		s.publishToClient(client, tk.Packet, qos, tk.Shared)
+	}
 
-			s.onError(client.Info(), s.writeClient(client, out))
+	// Queued messages have not been sent yet, so they are handed over in order.
+	queued := cl.Inflight.TakeQueued(func(in clients.InflightMessage) bool {
+		return in.Shared != "" && (filter == "" || in.Shared == filter)
+	})
+	for _, in := range queued {
+		client, qos, ok := s.selectSharedMember(in.Shared, s.Topics.SharedMembers(in.Shared), nil, cl.ID)
+		if !ok {
+			client, qos = cl, in.Packet.FixedHeader.Qos // requeue the message with the client.
 		}
+
+		s.publishToClient(client, in.Packet, qos, in.Shared)
 	}
 }
 
@@ -710,12 +4303,15 @@ func (s *Server) processPuback(cl *clients.Client, pk packets.Packet) error {
 		atomic.AddInt64(&s.System.Inflight, -1)
 	}
 	if s.Store != nil {
-		s.onStorage(cl, s.Store.DeleteInflight(persistentID(cl, pk)))
+		s.onStorage(cl, "DeleteInflight", s.Store.DeleteInflight(persistentID(cl, pk)))
 	}
+	s.releaseQueued(cl)
 	return nil
 }
 
-// processPubrec processes a Pubrec packet.
+// processPubrec processes a Pubrec packet. The inflight publish is replaced
+// by the pubrel, which is resent in its place until the client sends a
+// pubcomp, as the publish must not be sent again once it was received.
 func (s *Server) processPubrec(cl *clients.Client, pk packets.Packet) error {
 	out := packets.Packet{
 		FixedHeader: packets.FixedHeader{
@@ -725,6 +4321,15 @@ func (s *Server) processPubrec(cl *clients.Client, pk packets.Packet) error {
 		PacketID: pk.PacketID,
 	}
 
+	if tk, ok := cl.Inflight.Get(pk.PacketID); ok && tk.Packet.FixedHeader.Type == packets.Publish {
+		tk.Packet = out
+		tk.Sent = time.Now().Unix()
+		cl.Inflight.Set(pk.PacketID, tk)
+		if s.Store != nil {
+			s.writeInflight(cl, tk)
+		}
+	}
+
 	err := s.writeClient(cl, out)
 	if err != nil {
 		return err
@@ -735,6 +4340,8 @@ func (s *Server) processPubrec(cl *clients.Client, pk packets.Packet) error {
 
 // processPubrel processes a Pubrel packet.
 func (s *Server) processPubrel(cl *clients.Client, pk packets.Packet) error {
+	cl.ForgetInboundQos2(pk.PacketID)
+
 	out := packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type: packets.Pubcomp,
@@ -752,7 +4359,8 @@ func (s *Server) processPubrel(cl *clients.Client, pk packets.Packet) error {
 	}
 
 	if s.Store != nil {
-		s.onStorage(cl, s.Store.DeleteInflight(persistentID(cl, pk)))
+		s.onStorage(cl, "DeleteInflight", s.Store.DeleteInflight(persistentID(cl, pk)))
+		s.onStorage(cl, "DeleteInflight", s.Store.DeleteInflight(receivedID(cl, pk)))
 	}
 
 	return nil
@@ -765,38 +4373,146 @@ func (s *Server) processPubcomp(cl *clients.Client, pk packets.Packet) error {
 		atomic.AddInt64(&s.System.Inflight, -1)
 	}
 	if s.Store != nil {
-		s.onStorage(cl, s.Store.DeleteInflight(persistentID(cl, pk)))
+		s.onStorage(cl, "DeleteInflight", s.Store.DeleteInflight(persistentID(cl, pk)))
 	}
+	s.releaseQueued(cl)
 	return nil
 }
 
 // processSubscribe processes a Subscribe packet.
 func (s *Server) processSubscribe(cl *clients.Client, pk packets.Packet) error {
+	var subID int // an mqtt v5 subscription identifier applies to every filter in the packet.
+	if len(pk.Properties.SubscriptionIdentifier) > 0 {
+		subID = pk.Properties.SubscriptionIdentifier[0]
+	}
+
+	max, count := s.subscriptionQuota(cl)
+	qosLimit := s.maxQos(cl.Listener)
 	retCodes := make([]byte, len(pk.Topics))
+	sendRetained := make([]bool, len(pk.Topics))
 	for i := 0; i < len(pk.Topics); i++ {
-		if !cl.AC.ACL(cl.Username, pk.Topics[i], false) {
+		// Only MQTT v3 packets reach here with an invalid qos, as it makes an
+		// MQTT v5 packet malformed.
+		if pk.Qoss[i] > 2 {
+			s.Options.Logger.Debug("invalid subscription qos", logFields(cl.Info(), logger.KeyFilter, pk.Topics[i], "qos", pk.Qoss[i])...)
 			retCodes[i] = packets.ErrSubAckNetworkError
-		} else {
-			r := s.Topics.Subscribe(pk.Topics[i], cl.ID, pk.Qoss[i])
-			if r {
-				if s.Events.OnSubscribe != nil {
-					s.Events.OnSubscribe(pk.Topics[i], cl.Info(), pk.Qoss[i])
+			continue
+		}
+
+		if pk.Qoss[i] > qosLimit {
+			pk.Qoss[i] = qosLimit // the granted qos is no higher than the listener allows.
+		}
+
+		filter, group := pk.Topics[i], ""
+		if err := ValidateTopicFilter(filter); err != nil {
+			s.Options.Logger.Debug("invalid subscription filter", logFields(cl.Info(), logger.KeyFilter, filter, logger.KeyError, err)...)
+			retCodes[i] = packets.ErrSubAckNetworkError
+			if cl.ProtocolVersion == 5 {
+				retCodes[i] = packets.CodeTopicFilterInvalid
+			}
+			continue
+		}
+
+		if strings.HasPrefix(filter, topics.SharePrefix) {
+			var ok bool
+			if group, filter, ok = topics.ParseShared(filter); !ok {
+				retCodes[i] = packets.ErrSubAckNetworkError
+				if cl.ProtocolVersion == 5 {
+					retCodes[i] = packets.CodeTopicFilterInvalid
 				}
-				atomic.AddInt64(&s.System.Subscriptions, 1)
+				continue
 			}
-			cl.NoteSubscription(pk.Topics[i], pk.Qoss[i])
-			retCodes[i] = pk.Qoss[i]
+		}
 
-			if s.Store != nil {
-				s.onStorage(cl, s.Store.WriteSubscription(persistence.Subscription{
-					ID:     "sub_" + cl.ID + ":" + pk.Topics[i],
-					T:      persistence.KSubscription,
-					Filter: pk.Topics[i],
-					Client: cl.ID,
-					QoS:    pk.Qoss[i],
-				}))
+		if err := s.checkTopicLimits(cl.Listener, filter); err != nil {
+			s.Options.Logger.Debug("subscription filter exceeds limits", logFields(cl.Info(), logger.KeyFilter, pk.Topics[i], logger.KeyError, err)...)
+			retCodes[i] = packets.ErrSubAckNetworkError
+			if cl.ProtocolVersion == 5 {
+				retCodes[i] = packets.CodeTopicFilterInvalid
+			}
+			continue
+		}
+
+		if ok, err := s.aclAllowed(cl, filter, false, pk.Properties.User); err != nil {
+			// As for publishes, a failed check is reported to MQTT v5
+			// clients with the transient Quota exceeded (0x97).
+			s.onError(cl.Info(), err)
+			retCodes[i] = packets.ErrSubAckNetworkError
+			if cl.ProtocolVersion == 5 {
+				retCodes[i] = packets.CodeQuotaExceeded
+			}
+			continue
+		} else if !ok {
+			s.Options.Logger.Debug("subscription denied by acl", logFields(cl.Info(), logger.KeyFilter, pk.Topics[i])...)
+			retCodes[i] = packets.ErrSubAckNetworkError
+			if cl.ProtocolVersion == 5 {
+				retCodes[i] = packets.CodeNotAuthorized
+			}
+			continue
+		}
+
+		// Access is checked for the filter the client sent, but the
+		// subscription is made with the rewritten filter.
+		pk.Topics[i] = s.rewriteFilter(cl, pk.Topics[i])
+
+		existed := cl.Subscribed(pk.Topics[i])
+		if max > 0 && count >= max && !existed {
+			s.Options.Logger.Debug("subscription quota exceeded", logFields(cl.Info(), logger.KeyFilter, pk.Topics[i])...)
+			retCodes[i] = packets.ErrSubAckNetworkError
+			if cl.ProtocolVersion == 5 {
+				retCodes[i] = packets.CodeQuotaExceeded
+			}
+			continue
+		}
+
+		var opts packets.SubOptions
+		if i < len(pk.SubOptions) {
+			opts = pk.SubOptions[i]
+		}
+
+		// The subscription is stored before it is made, so that a filter which
+		// could not be stored is refused rather than being lost on a restart.
+		if s.Store != nil {
+			err := s.Store.WriteSubscription(persistence.Subscription{
+				ID:     "sub_" + cl.ID + ":" + pk.Topics[i],
+				T:      persistence.KSubscription,
+				Filter: pk.Topics[i],
+				Client: cl.ID,
+				QoS:    pk.Qoss[i],
+				Group:  group,
+
+				SubscriptionIdentifier: subID,
+				RetainAsPublished:      opts.RetainAsPublished,
+				RetainHandling:         opts.RetainHandling,
+			})
+			s.onStorage(cl, "WriteSubscription", err)
+			if err != nil {
+				retCodes[i] = packets.ErrSubAckNetworkError
+				continue
 			}
 		}
+
+		if !existed {
+			count++
+		}
+
+		// Per [MQTT-3.3.1-9] and [MQTT-3.3.1-10], retained messages are sent
+		// unless the retain handling option says otherwise.
+		sendRetained[i] = group == "" && (opts.RetainHandling == packets.RetainSendOnSubscribe ||
+			opts.RetainHandling == packets.RetainSendIfNew && !existed)
+
+		r := s.Topics.Subscribe(pk.Topics[i], cl.ID, pk.Qoss[i])
+		if r {
+			if s.Events.OnSubscribe != nil {
+				s.Events.OnSubscribe(pk.Topics[i], cl.Info(), pk.Qoss[i])
+			}
+			s.hooks.OnSubscribe(pk.Topics[i], cl.Info(), pk.Qoss[i])
+			atomic.AddInt64(&s.System.Subscriptions, 1)
+		}
+		cl.NoteSubscription(pk.Topics[i], pk.Qoss[i])
+		cl.NoteSubscriptionID(pk.Topics[i], subID)
+		cl.NoteSubscriptionOptions(pk.Topics[i], opts)
+		retCodes[i] = pk.Qoss[i]
 	}
 
 	err := s.writeClient(cl, packets.Packet{
@@ -811,38 +4527,206 @@ func (s *Server) processSubscribe(cl *clients.Client, pk packets.Packet) error {
 	}
 
 	// Publish out any retained messages matching the subscription filter and the user has
-	// been allowed to subscribe to.
+	// been allowed to subscribe to, followed by any newer messages held in the last value
+	// caches. Retained messages are not sent for shared subscriptions.
+	var retained []packets.Packet
 	for i := 0; i < len(pk.Topics); i++ {
-		if retCodes[i] == packets.ErrSubAckNetworkError {
+		if !sendRetained[i] {
 			continue
 		}
 
-		for _, pkv := range s.Topics.Messages(pk.Topics[i]) {
-			s.onError(cl.Info(), s.writeClient(cl, pkv))
+		now := time.Now().Unix()
+		pkvs := s.Topics.Messages(pk.Topics[i])
+		n := len(pkvs)
+		pkvs = append(pkvs, s.lastValueMessages(pk.Topics[i])...)
+		for j, pkv := range pkvs {
+			if pkv.Expired(now) {
+				if j < n {
+					s.deleteRetained(pkv)
+				}
+				continue
+			}
+
+			// Per [MQTT-3.8.4-8], messages are delivered at the lower of the QoS
+			// they were published with and the QoS granted to the subscription.
+			if pkv.FixedHeader.Qos > pk.Qoss[i] {
+				pkv.FixedHeader.Qos = pk.Qoss[i]
+			}
+
+			// Forward the remaining lifetime of the message, rather than the original interval.
+			if pkv.Properties.MessageExpiryInterval > 0 {
+				pkv.Properties.MessageExpiryInterval = uint32(pkv.Created + int64(pkv.Properties.MessageExpiryInterval) - now)
+			}
+
+			if subID > 0 {
+				pkv.Properties.SubscriptionIdentifier = []int{subID}
+			}
+
+			if out, ok := s.decodePayload(cl, pkv); ok {
+				retained = append(retained, out)
+			}
 		}
 	}
 
+	s.replayRetained(cl, retained)
+
 	return nil
 }
 
-// processUnsubscribe processes an unsubscribe packet.
+// replayRetained sends the retained messages matching a new subscription to a
+// client. If RetainedBatchSize is set, the messages are added to the client's
+// replay queue and sent in batches by a goroutine, so that subscribing to a
+// filter which matches many retained messages does not stall the connection.
+// Otherwise they are all sent before returning.
+func (s *Server) replayRetained(cl *clients.Client, pks []packets.Packet) {
+	if len(pks) == 0 {
+		return
+	}
+
+	if s.Options.RetainedBatchSize <= 0 {
+		start := time.Now()
+		for _, pk := range pks {
+			s.deliver(cl, pk, "")
+		}
+		s.noteRetainedReplay(time.Since(start))
+		return
+	}
+
+	s.replaysMu.Lock()
+	r, ok := s.replays[cl]
+	if !ok {
+		r = new(retainedReplay)
+		s.replays[cl] = r
+	}
+	r.pending = append(r.pending, pks...)
+	s.replaysMu.Unlock()
+
+	if !ok {
+		go s.runReplay(cl, r)
+	}
+}
+
+// runReplay sends the messages in a client's retained replay queue in batches,
+// until the queue is empty or the client disconnects. While messages are queued
+// beyond the client's receive maximum, the next batch waits for them to be
+// acknowledged.
+func (s *Server) runReplay(cl *clients.Client, r *retainedReplay) {
+	start := time.Now()
+	wait := s.Options.RetainedBatchDelay
+	if wait <= 0 {
+		wait = retainedReplayWait
+	}
+
+	for {
+		if atomic.LoadUint32(&cl.State.Done) == 1 {
+			s.replaysMu.Lock()
+			delete(s.replays, cl)
+			s.replaysMu.Unlock()
+			return
+		}
+
+		if cl.Inflight.QueueLen() > 0 {
+			time.Sleep(wait)
+			continue
+		}
+
+		s.replaysMu.Lock()
+		n := len(r.pending)
+		if n == 0 {
+			delete(s.replays, cl)
+			s.replaysMu.Unlock()
+			s.noteRetainedReplay(time.Since(start))
+			return
+		}
+
+		if n > s.Options.RetainedBatchSize {
+			n = s.Options.RetainedBatchSize
+		}
+		batch := r.pending[:n]
+		r.pending = r.pending[n:]
+		more := len(r.pending) > 0
+		s.replaysMu.Unlock()
+
+		for _, pk := range batch {
+			s.deliver(cl, pk, "")
+		}
+
+		if more && s.Options.RetainedBatchDelay > 0 {
+			time.Sleep(s.Options.RetainedBatchDelay)
+		}
+	}
+}
+
+// noteRetainedReplay counts a completed replay of retained messages and the
+// time it took.
+func (s *Server) noteRetainedReplay(d time.Duration) {
+	atomic.AddInt64(&s.System.RetainedReplays, 1)
+	atomic.AddInt64(&s.System.RetainedReplayTime, d.Microseconds())
+}
+
+// subscriptionQuota returns the maximum number of subscriptions per client, and
+// the number of subscriptions the client already holds. When a store is set,
+// the subscriptions persisted for the client are counted as well, so that a
+// session which has not yet been fully restored still counts towards the limit.
+func (s *Server) subscriptionQuota(cl *clients.Client) (max, count int) {
+	max = s.MaxSubscriptions()
+	if max == 0 {
+		return
+	}
+
+	count = cl.CountSubscriptions()
+	if s.Store != nil {
+		n, err := s.Store.CountSubscriptions(cl.ID)
+		s.onStorage(cl, "CountSubscriptions", err)
+		if n > count {
+			count = n
+		}
+	}
+
+	return
+}
+
+// processUnsubscribe processes an unsubscribe packet. MQTT v5 clients are sent
+// a reason code for each filter in the UNSUBACK, in the order of the packet.
 func (s *Server) processUnsubscribe(cl *clients.Client, pk packets.Packet) error {
+	codes := make([]byte, len(pk.Topics)) // MQTT v5 reason codes.
 	for i := 0; i < len(pk.Topics); i++ {
+		if err := ValidateTopicFilter(pk.Topics[i]); err != nil {
+			codes[i] = packets.CodeTopicFilterInvalid
+			continue
+		}
+
+		pk.Topics[i] = s.rewriteFilter(cl, pk.Topics[i])
+		if !cl.Subscribed(pk.Topics[i]) {
+			codes[i] = packets.CodeNoSubscriptionExisted
+		}
+
 		q := s.Topics.Unsubscribe(pk.Topics[i], cl.ID)
 		if q {
 			if s.Events.OnUnsubscribe != nil {
 				s.Events.OnUnsubscribe(pk.Topics[i], cl.Info())
 			}
+			s.hooks.OnUnsubscribe(pk.Topics[i], cl.Info())
 			atomic.AddInt64(&s.System.Subscriptions, -1)
 		}
 		cl.ForgetSubscription(pk.Topics[i])
+		s.ClearDeliveryFilter(cl.ID, pk.Topics[i])
+
+		if s.Store != nil && codes[i] == packets.Accepted {
+			s.onStorage(cl, "DeleteSubscription", s.Store.DeleteSubscription("sub_"+cl.ID+":"+pk.Topics[i]))
+		}
+
+		if s.Options.SharedRedeliver && strings.HasPrefix(pk.Topics[i], topics.SharePrefix) {
+			s.redeliverShared(cl, pk.Topics[i])
+		}
 	}
 
 	err := s.writeClient(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type: packets.Unsuback,
 		},
-		PacketID: pk.PacketID,
+		PacketID:    pk.PacketID,
+		ReturnCodes: codes,
 	})
 	if err != nil {
 		return err
@@ -862,6 +4746,14 @@ func persistentID(client *clients.Client, pk packets.Packet) string {
 	return "if_" + client.ID + "_" + pk.FormatID()
 }
 
+// receivedID returns a string combining the client and packet identifiers of
+// a qos 2 message received from the client, for use with the persistence layer.
+// Packet ids are chosen separately by the client and server, so the messages
+// are stored apart from the inflight messages sent to the client.
+func receivedID(client *clients.Client, pk packets.Packet) string {
+	return "in_" + client.ID + "_" + pk.FormatID()
+}
+
 // publishSysTopics publishes the current values to the server $SYS topics.
 // Due to the int to string conversions this method is not as cheap as
 // some of the others so the publishing interval should be set appropriately.
@@ -875,41 +4767,71 @@ func (s *Server) publishSysTopics() {
 
 	uptime := time.Now().Unix() - atomic.LoadInt64(&s.System.Started)
 	atomic.StoreInt64(&s.System.Uptime, uptime)
+	queued, dropped := s.StoreQueue()
+	atomic.StoreInt64(&s.System.StoreQueued, int64(queued))
+	atomic.StoreInt64(&s.System.StoreDropped, dropped)
 	topics := map[string]string{
-		"$SYS/broker/version":                   s.System.Version,
-		"$SYS/broker/uptime":                    atomicItoa(&s.System.Uptime),
-		"$SYS/broker/timestamp":                 atomicItoa(&s.System.Started),
-		"$SYS/broker/load/bytes/received":       atomicItoa(&s.System.BytesRecv),
-		"$SYS/broker/load/bytes/sent":           atomicItoa(&s.System.BytesSent),
-		"$SYS/broker/clients/connected":         atomicItoa(&s.System.ClientsConnected),
-		"$SYS/broker/clients/disconnected":      atomicItoa(&s.System.ClientsDisconnected),
-		"$SYS/broker/clients/maximum":           atomicItoa(&s.System.ClientsMax),
-		"$SYS/broker/clients/total":             atomicItoa(&s.System.ClientsTotal),
-		"$SYS/broker/connections/total":         atomicItoa(&s.System.ConnectionsTotal),
-		"$SYS/broker/messages/received":         atomicItoa(&s.System.MessagesRecv),
-		"$SYS/broker/messages/sent":             atomicItoa(&s.System.MessagesSent),
-		"$SYS/broker/messages/publish/dropped":  atomicItoa(&s.System.PublishDropped),
-		"$SYS/broker/messages/publish/received": atomicItoa(&s.System.PublishRecv),
-		"$SYS/broker/messages/publish/sent":     atomicItoa(&s.System.PublishSent),
-		"$SYS/broker/messages/retained/count":   atomicItoa(&s.System.Retained),
-		"$SYS/broker/messages/inflight":         atomicItoa(&s.System.Inflight),
-		"$SYS/broker/subscriptions/count":       atomicItoa(&s.System.Subscriptions),
+		"$SYS/broker/version":                       s.System.Version,
+		"$SYS/broker/uptime":                        atomicItoa(&s.System.Uptime),
+		"$SYS/broker/timestamp":                     atomicItoa(&s.System.Started),
+		"$SYS/broker/load/bytes/received":           atomicItoa(&s.System.BytesRecv),
+		"$SYS/broker/load/bytes/sent":               atomicItoa(&s.System.BytesSent),
+		"$SYS/broker/clients/connected":             atomicItoa(&s.System.ClientsConnected),
+		"$SYS/broker/clients/disconnected":          atomicItoa(&s.System.ClientsDisconnected),
+		"$SYS/broker/clients/maximum":               atomicItoa(&s.System.ClientsMax),
+		"$SYS/broker/clients/total":                 atomicItoa(&s.System.ClientsTotal),
+		"$SYS/broker/connections/total":             atomicItoa(&s.System.ConnectionsTotal),
+		"$SYS/broker/connections/rejected":          atomicItoa(&s.System.ConnectionsRejected),
+		"$SYS/broker/messages/received":             atomicItoa(&s.System.MessagesRecv),
+		"$SYS/broker/messages/sent":                 atomicItoa(&s.System.MessagesSent),
+		"$SYS/broker/messages/publish/dropped":      atomicItoa(&s.System.PublishDropped),
+		"$SYS/broker/messages/publish/deduplicated": atomicItoa(&s.System.PublishDeduplicated),
+		"$SYS/broker/messages/publish/received":     atomicItoa(&s.System.PublishRecv),
+		"$SYS/broker/messages/publish/sent":         atomicItoa(&s.System.PublishSent),
+		"$SYS/broker/messages/retained/count":       atomicItoa(&s.System.Retained),
+		"$SYS/broker/messages/retained/bytes":       atomicItoa(&s.System.RetainedBytes),
+		"$SYS/broker/messages/retained/evicted":     atomicItoa(&s.System.RetainedEvicted),
+		"$SYS/broker/messages/inflight":             atomicItoa(&s.System.Inflight),
+		"$SYS/broker/subscriptions/count":           atomicItoa(&s.System.Subscriptions),
+		"$SYS/broker/store/queued":                  atomicItoa(&s.System.StoreQueued),
+		"$SYS/broker/store/dropped":                 atomicItoa(&s.System.StoreDropped),
+		"$SYS/broker/store/rejected":                atomicItoa(&s.System.StoreRejected),
 	}
 
 	for topic, payload := range topics {
+		if !s.sysTopicEnabled(topic) {
+			continue
+		}
+
 		pk.TopicName = topic
 		pk.Payload = []byte(payload)
-		q := s.Topics.RetainMessage(pk.PublishCopy())
-		atomic.AddInt64(&s.System.Retained, q)
+		s.Topics.RetainMessage(pk.PublishCopy())
 		s.publishToSubscribers(pk)
 	}
+	s.updateRetainedStats()
+
+	if s.Store != nil {
+		s.onStorage(&s.inline, "WriteServerInfo", s.Store.WriteServerInfo(persistence.ServerInfo{
+			Info: *s.System,
+			ID:   persistence.KServerInfo,
+		}))
+	}
+}
+
+// sysTopicEnabled returns true if a $SYS topic matches any of the filters in
+// the SysTopics option, or if no filters were set.
+func (s *Server) sysTopicEnabled(topic string) bool {
+	if len(s.Options.SysTopics) == 0 {
+		return true
+	}
 
-	if s.Store != nil {
-		s.onStorage(&s.inline, s.Store.WriteServerInfo(persistence.ServerInfo{
-			Info: *s.System,
-			ID:   persistence.KServerInfo,
-		}))
+	for _, filter := range s.Options.SysTopics {
+		if auth.MatchTopic(filter, topic) {
+			return true
+		}
 	}
+
+	return false
 }
 
 // ResendClientInflight attempts to resend all undelivered inflight messages
@@ -920,22 +4842,28 @@ func (s *Server) ResendClientInflight(cl *clients.Client, force bool) error {
 	}
 
 	nt := time.Now().Unix()
-	for _, tk := range cl.Inflight.GetAll() {
-		if tk.Resends >= inflightMaxResends { // After a reasonable time, drop inflight packets.
-			cl.Inflight.Delete(tk.Packet.PacketID)
+	var dropped bool
+	for _, tk := range cl.Inflight.GetOrdered() { // Resend in the original publish order.
+		if tk.Resends >= s.Options.InflightMaxResends { // After a reasonable time, drop inflight packets.
+			if cl.Inflight.Delete(tk.Packet.PacketID) {
+				atomic.AddInt64(&s.System.Inflight, -1)
+				dropped = true
+			}
+
 			if tk.Packet.FixedHeader.Type == packets.Publish {
 				atomic.AddInt64(&s.System.PublishDropped, 1)
 			}
 
 			if s.Store != nil {
-				s.onStorage(cl, s.Store.DeleteInflight(persistentID(cl, tk.Packet)))
+				s.onStorage(cl, "DeleteInflight", s.Store.DeleteInflight(persistentID(cl, tk.Packet)))
 			}
 
+			s.Options.Logger.Warn("dropped unacknowledged inflight message", logFields(cl.Info(),
+				logger.KeyTopic, tk.Packet.TopicName, "packet_id", tk.Packet.PacketID, "resends", tk.Resends)...)
 			continue
 		}
 
-		// Only continue if the resend backoff time has passed and there's a backoff time.
-		if !force && (nt-tk.Sent < inflightResendBackoff[tk.Resends] || len(inflightResendBackoff) < tk.Resends) {
+		if !force && !s.resendDue(tk, nt) {
 			continue
 		}
 
@@ -946,31 +4874,59 @@ func (s *Server) ResendClientInflight(cl *clients.Client, force bool) error {
 		tk.Resends++
 		tk.Sent = nt
 		cl.Inflight.Set(tk.Packet.PacketID, tk)
-		_, err := cl.WritePacket(tk.Packet)
+		err := s.writeClient(cl, tk.Packet)
 		if err != nil {
 			return err
 		}
 
 		if s.Store != nil {
-			s.onStorage(cl, s.Store.WriteInflight(persistence.Message{
-				ID:          persistentID(cl, tk.Packet),
-				T:           persistence.KInflight,
-				FixedHeader: persistence.FixedHeader(tk.Packet.FixedHeader),
-				TopicName:   tk.Packet.TopicName,
-				Payload:     tk.Packet.Payload,
-				Sent:        tk.Sent,
-				Resends:     tk.Resends,
-			}))
+			s.writeInflight(cl, tk)
 		}
 	}
 
+	if dropped {
+		s.releaseQueued(cl)
+	}
+
 	return nil
 }
 
+// resendDue returns true if an inflight message has waited long enough since
+// it was last sent to be resent, either for the resend interval or for the
+// backoff time of its next attempt.
+func (s *Server) resendDue(tk clients.InflightMessage, now int64) bool {
+	if s.Options.InflightResendInterval > 0 {
+		return now-tk.Sent >= s.Options.InflightResendInterval
+	}
+
+	i := tk.Resends
+	if i >= len(inflightResendBackoff) {
+		i = len(inflightResendBackoff) - 1
+	}
+
+	return now-tk.Sent >= inflightResendBackoff[i]
+}
+
 // Close attempts to gracefully shutdown the server, all listeners, clients, and stores.
 func (s *Server) Close() error {
+	s.Options.Logger.Info("server closing")
 	close(s.done)
+
+	s.servingMu.Lock()
+	ids := s.Listeners.IDs()
 	s.Listeners.CloseAll(s.closeListenerClients)
+	s.servingMu.Unlock()
+	for _, id := range ids {
+		s.hooks.OnListenerStopped(id)
+	}
+
+	// Delayed wills remain in the store, to be sent when the server is restarted.
+	s.willsMu.Lock()
+	for id, t := range s.wills {
+		t.Stop()
+		delete(s.wills, id)
+	}
+	s.willsMu.Unlock()
 
 	if s.Store != nil {
 		s.Store.Close()
@@ -979,6 +4935,127 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// SetRedirect puts the server into redirect mode, in which new connections are
+// refused with a CONNACK referring MQTT v5 clients to another server, such as a
+// standby broker during maintenance. The server reference is typically a host
+// or host:port, and is sent to clients as given. If permanent is true, clients
+// are told the server has moved (0x9D), and otherwise to use another server
+// (0x9C) for now. MQTT v3 clients, which cannot be redirected, are refused as
+// server unavailable. Clients which are already connected are not affected.
+// An empty server reference leaves redirect mode.
+func (s *Server) SetRedirect(ref string, permanent bool) {
+	s.redirectMu.Lock()
+	s.redirect = ref
+	s.redirectPermanent = permanent
+	s.redirectMu.Unlock()
+}
+
+// Redirect returns the server reference new clients are being redirected to,
+// and whether the redirect is permanent. The reference is empty if the server
+// is not in redirect mode.
+func (s *Server) Redirect() (string, bool) {
+	s.redirectMu.RLock()
+	defer s.redirectMu.RUnlock()
+	return s.redirect, s.redirectPermanent
+}
+
+// Drain gracefully disconnects all clients ahead of shutting down the server.
+// New connections are refused, and each client is disconnected once all of its
+// inflight messages have been acknowledged, or when the timeout has elapsed.
+// MQTT 5 clients are sent a DISCONNECT with the server shutting down reason code.
+// The sessions of persistent clients are flushed to the store before they are
+// disconnected. If any clients did not drain before the timeout, an error
+// wrapping ErrDrainTimeout and listing their ids is returned. Close should
+// still be called once the server has drained.
+func (s *Server) Drain(timeout time.Duration) error {
+	atomic.StoreUint32(&s.draining, 1)
+
+	deadline := time.Now().Add(timeout)
+	pending := s.Clients.GetAll()
+	for {
+		for id, cl := range pending {
+			if cl.Inflight.Len() == 0 || atomic.LoadUint32(&cl.State.Done) == 1 {
+				s.drainClient(cl)
+				delete(pending, id)
+			}
+		}
+
+		if len(pending) == 0 || !time.Now().Before(deadline) {
+			break
+		}
+
+		time.Sleep(drainPollInterval)
+	}
+
+	ids := make([]string, 0, len(pending))
+	for id, cl := range pending {
+		s.drainClient(cl)
+		ids = append(ids, id)
+	}
+
+	if s.Store != nil {
+		s.onStorage(&s.inline, "WriteServerInfo", s.Store.WriteServerInfo(persistence.ServerInfo{
+			Info: *s.System,
+			ID:   persistence.KServerInfo,
+		}))
+	}
+
+	if len(ids) > 0 {
+		sort.Strings(ids)
+		return fmt.Errorf("%w: %s", ErrDrainTimeout, strings.Join(ids, ", "))
+	}
+
+	return nil
+}
+
+// drainClient flushes the session of a client to the store and disconnects it.
+func (s *Server) drainClient(cl *clients.Client) {
+	if s.Store != nil && cl.SessionExpiryInterval > 0 {
+		s.flushClient(cl)
+	}
+
+	if atomic.LoadUint32(&cl.State.Done) == 1 {
+		return
+	}
+
+	s.sendDisconnect(cl, packets.CodeServerShuttingDown, "server shutting down")
+	cl.Stop(ErrServerShutdown)
+}
+
+// flushClient writes the session state of a client to the store.
+func (s *Server) flushClient(cl *clients.Client) {
+	s.storeClient(cl)
+
+	cl.RLock()
+	for filter, qos := range cl.Subscriptions {
+		group, _, _ := topics.ParseShared(filter)
+		s.onStorage(cl, "WriteSubscription", s.Store.WriteSubscription(persistence.Subscription{
+			ID:     "sub_" + cl.ID + ":" + filter,
+			T:      persistence.KSubscription,
+			Filter: filter,
+			Client: cl.ID,
+			QoS:    qos,
+			Group:  group,
+
+			SubscriptionIdentifier: cl.SubscriptionIDs[filter],
+			RetainAsPublished:      cl.SubOptions[filter].RetainAsPublished,
+			RetainHandling:         cl.SubOptions[filter].RetainHandling,
+		}))
+	}
+	cl.RUnlock()
+
+	for _, tk := range cl.Inflight.GetOrdered() {
+		s.writeInflight(cl, tk)
+	}
+}
+
+// drainListenerClients drains all clients on the specified listener.
+func (s *Server) drainListenerClients(listener string) {
+	for _, cl := range s.Clients.GetByListener(listener) {
+		s.drainClient(cl)
+	}
+}
+
 // closeListenerClients closes all clients on the specified listener.
 func (s *Server) closeListenerClients(listener string) {
 	clients := s.Clients.GetByListener(listener)
@@ -987,26 +5064,249 @@ func (s *Server) closeListenerClients(listener string) {
 	}
 }
 
-// sendLWT issues an LWT message to a topic when a client disconnects.
+// sendLWT issues an LWT message to a topic when a client disconnects. If the
+// will has a delay interval, it is sent once the delay has elapsed, unless the
+// client reconnects first.
 func (s *Server) sendLWT(cl *clients.Client) error {
-	if cl.LWT.Topic != "" {
-		err := s.processPublish(cl, packets.Packet{
-			FixedHeader: packets.FixedHeader{
-				Type:   packets.Publish,
-				Retain: cl.LWT.Retain,
-				Qos:    cl.LWT.Qos,
-			},
-			TopicName: cl.LWT.Topic,
-			Payload:   cl.LWT.Message,
-		})
-		if err != nil {
-			return s.onError(cl.Info(), fmt.Errorf("send lwt: %s %w; %+v", cl.ID, err, cl.LWT))
-		}
+	if cl.LWT.Topic == "" {
+		return nil
+	}
+
+	if cl.LWT.Delay > 0 {
+		s.delayLWT(cl)
+		return nil
+	}
+
+	return s.publishLWT(cl)
+}
+
+// publishLWT publishes the will message of a client, and removes it from the store.
+func (s *Server) publishLWT(cl *clients.Client) error {
+	lwt := cl.LWT
+	cl.LWT = clients.LWT{}
+
+	s.Options.Logger.Debug("publishing will message", logFields(cl.Info(), logger.KeyTopic, lwt.Topic)...)
+	err := s.processPublish(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: lwt.Retain,
+			Qos:    lwt.Qos,
+		},
+		Properties: packets.Properties{
+			PayloadFormat:         lwt.PayloadFormat,
+			PayloadFormatFlag:     lwt.PayloadFormatFlag,
+			MessageExpiryInterval: lwt.MessageExpiryInterval,
+			ContentType:           lwt.ContentType,
+			ResponseTopic:         lwt.ResponseTopic,
+			CorrelationData:       lwt.CorrelationData,
+			User:                  lwt.User,
+		},
+		TopicName: lwt.Topic,
+		Payload:   lwt.Message,
+	})
+	if err != nil {
+		return s.onError(cl.Info(), fmt.Errorf("send lwt: %s %w; %+v", cl.ID, err, lwt))
 	}
 
+	s.storeLWT(cl)
 	return nil
 }
 
+// delayLWT schedules the will message of a client to be published after its
+// will delay interval. The time the will is due is kept in the store, so a will
+// restored after a restart is sent when it was originally due. Wills are not
+// scheduled once the server is closing, so that they remain in the store and
+// are sent when the server is restarted.
+func (s *Server) delayLWT(cl *clients.Client) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	now := time.Now().Unix()
+	if cl.LWT.Due == 0 {
+		cl.LWT.Due = now + int64(cl.LWT.Delay)
+		s.storeLWT(cl)
+	}
+
+	wait := time.Duration(cl.LWT.Due-now) * time.Second
+	if wait < 0 {
+		wait = 0
+	}
+
+	s.willsMu.Lock()
+	defer s.willsMu.Unlock()
+
+	if t, ok := s.wills[cl.ID]; ok {
+		t.Stop()
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(wait, func() {
+		s.willsMu.Lock()
+		if s.wills[cl.ID] != t {
+			s.willsMu.Unlock()
+			return
+		}
+		delete(s.wills, cl.ID)
+		s.willsMu.Unlock()
+
+		s.publishLWT(cl)
+	})
+	s.wills[cl.ID] = t
+}
+
+// cancelLWT cancels the delayed will message of a client, returning true if
+// a will message was waiting to be sent.
+func (s *Server) cancelLWT(id string) bool {
+	s.willsMu.Lock()
+	defer s.willsMu.Unlock()
+
+	t, ok := s.wills[id]
+	if ok {
+		t.Stop()
+		delete(s.wills, id)
+	}
+
+	return ok
+}
+
+// storeLWT writes the current will message of a client to the store, unless
+// the client has since been replaced by a new connection with the same id.
+func (s *Server) storeLWT(cl *clients.Client) {
+	if s.Store == nil {
+		return
+	}
+
+	if existing, ok := s.Clients.Get(cl.ID); !ok || existing != cl {
+		return
+	}
+
+	s.storeClient(cl)
+}
+
+// storeClient writes the details of a client, including its will message and
+// session expiry, to the store.
+func (s *Server) storeClient(cl *clients.Client) {
+	s.onStorage(cl, "WriteClient", s.Store.WriteClient(persistence.Client{
+		ID:       "cl_" + cl.ID,
+		ClientID: cl.ID,
+		T:        persistence.KClient,
+		Listener: cl.Listener,
+		Username: cl.Username,
+		LWT:      storedLWT(cl.LWT),
+
+		SessionExpiryInterval: cl.SessionExpiryInterval,
+		Expires:               cl.SessionExpires(),
+	}))
+}
+
+// storedLWT converts the will message of a client to its stored form.
+func storedLWT(l clients.LWT) persistence.LWT {
+	return persistence.LWT{
+		Message:               l.Message,
+		Topic:                 l.Topic,
+		Qos:                   l.Qos,
+		Retain:                l.Retain,
+		Delay:                 l.Delay,
+		Due:                   l.Due,
+		PayloadFormat:         l.PayloadFormat,
+		PayloadFormatFlag:     l.PayloadFormatFlag,
+		MessageExpiryInterval: l.MessageExpiryInterval,
+		ContentType:           l.ContentType,
+		ResponseTopic:         l.ResponseTopic,
+		CorrelationData:       l.CorrelationData,
+		User:                  storedUserProperties(l.User),
+	}
+}
+
+// restoredLWT converts a stored will message back to the will of a client.
+func restoredLWT(l persistence.LWT) clients.LWT {
+	return clients.LWT{
+		Message:               l.Message,
+		Topic:                 l.Topic,
+		Qos:                   l.Qos,
+		Retain:                l.Retain,
+		Delay:                 l.Delay,
+		Due:                   l.Due,
+		PayloadFormat:         l.PayloadFormat,
+		PayloadFormatFlag:     l.PayloadFormatFlag,
+		MessageExpiryInterval: l.MessageExpiryInterval,
+		ContentType:           l.ContentType,
+		ResponseTopic:         l.ResponseTopic,
+		CorrelationData:       l.CorrelationData,
+		User:                  restoredUserProperties(l.User),
+	}
+}
+
+// storedUserProperties converts packet user properties to their stored form.
+func storedUserProperties(u []packets.UserProperty) []persistence.UserProperty {
+	if u == nil {
+		return nil
+	}
+
+	v := make([]persistence.UserProperty, len(u))
+	for i, p := range u {
+		v[i] = persistence.UserProperty{Key: p.Key, Val: p.Val}
+	}
+
+	return v
+}
+
+// restoredUserProperties converts stored user properties back to packet user
+// properties.
+func restoredUserProperties(u []persistence.UserProperty) []packets.UserProperty {
+	if u == nil {
+		return nil
+	}
+
+	v := make([]packets.UserProperty, len(u))
+	for i, p := range u {
+		v[i] = packets.UserProperty{Key: p.Key, Val: p.Val}
+	}
+
+	return v
+}
+
+// ExportState writes every record held by the store to w as JSON, in a
+// versioned format which can be restored to any store with ImportState.
+func (s *Server) ExportState(w io.Writer) error {
+	if s.Store == nil {
+		return ErrNoStore
+	}
+
+	v, err := persistence.ReadState(s.Store)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(v)
+}
+
+// ImportState reads a state written by ExportState from r and writes its
+// records to the store, merging them with or replacing the records held by
+// the store according to the StateImport option. It must be called after
+// AddStore and before Serve, which loads the records from the store.
+func (s *Server) ImportState(r io.Reader) error {
+	if s.Store == nil {
+		return ErrNoStore
+	}
+
+	s.servingMu.Lock()
+	defer s.servingMu.Unlock()
+	if s.serving {
+		return ErrServing
+	}
+
+	var v persistence.State
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return fmt.Errorf("decode state; %w", err)
+	}
+
+	return persistence.WriteState(s.Store, v, s.Options.StateImport == StateReplace)
+}
+
 // readStore reads in any data from the persistent datastore (if applicable).
 func (s *Server) readStore() error {
 	info, err := s.Store.ReadServerInfo()
@@ -1039,14 +5339,36 @@ func (s *Server) readStore() error {
 	}
 	s.loadRetained(retained)
 
+	// Wills which remain in the store belong to clients which were connected
+	// when the server stopped, so they are sent as if the clients had
+	// disconnected abnormally.
+	for _, cl := range s.Clients.GetAll() {
+		s.sendLWT(cl)
+	}
+
 	return nil
 }
 
-// loadServerInfo restores server info from the datastore.
+// loadServerInfo restores server info from the datastore, keeping the start time
+// of the running server.
 func (s *Server) loadServerInfo(v persistence.ServerInfo) {
 	version := s.System.Version
+	started := s.System.Started
+
+	// Server info stored before the first start was recorded began when the
+	// server which stored it was started.
+	first := v.FirstStarted
+	if first == 0 {
+		first = v.Started
+	}
+	if first == 0 || first > started {
+		first = started
+	}
+
 	s.System = &v.Info
 	s.System.Version = version
+	s.System.Started = started
+	s.System.FirstStarted = first
 }
 
 // loadSubscriptions restores subscriptions from the datastore.
@@ -1055,9 +5377,15 @@ func (s *Server) loadSubscriptions(v []persistence.Subscription) {
 		if s.Topics.Subscribe(sub.Filter, sub.Client, sub.QoS) {
 			if cl, ok := s.Clients.Get(sub.Client); ok {
 				cl.NoteSubscription(sub.Filter, sub.QoS)
+				cl.NoteSubscriptionID(sub.Filter, sub.SubscriptionIdentifier)
+				cl.NoteSubscriptionOptions(sub.Filter, packets.SubOptions{
+					RetainAsPublished: sub.RetainAsPublished,
+					RetainHandling:    sub.RetainHandling,
+				})
 				if s.Events.OnSubscribe != nil {
 					s.Events.OnSubscribe(sub.Filter, cl.Info(), sub.QoS)
 				}
+				s.hooks.OnSubscribe(sub.Filter, cl.Info(), sub.QoS)
 			}
 		}
 	}
@@ -1070,52 +5398,273 @@ func (s *Server) loadClients(v []persistence.Client) {
 		cl.ID = c.ClientID
 		cl.Listener = c.Listener
 		cl.Username = c.Username
-		cl.LWT = clients.LWT(c.LWT)
+		cl.LWT = restoredLWT(c.LWT)
+		cl.SessionExpiryInterval = c.SessionExpiryInterval
+		cl.SetSessionExpires(c.Expires)
+
+		// Sessions without an expiry time belonged to clients which were connected
+		// when the server stopped, so their interval starts from now.
+		if c.Expires == 0 && c.SessionExpiryInterval != clients.SessionExpiryNever {
+			cl.SetSessionExpires(time.Now().Unix() + int64(c.SessionExpiryInterval))
+		}
+
 		s.Clients.Add(cl)
 	}
 }
 
-// loadInflight restores inflight messages from the datastore.
+// loadInflight restores inflight messages from the datastore. New inflight
+// messages are sequenced after the restored messages, so the original order
+// is kept across restarts. Qos 2 messages are restored in the phase they were
+// stored in, so a pubrel is resent for messages the client has received, and
+// messages received from the client are not delivered again if resent.
 func (s *Server) loadInflight(v []persistence.Message) {
 	for _, msg := range v {
+		if msg.Sequence > atomic.LoadInt64(&s.inflightSeq) {
+			atomic.StoreInt64(&s.inflightSeq, msg.Sequence)
+		}
+
 		if client, ok := s.Clients.Get(msg.Client); ok {
-			client.Inflight.Set(msg.PacketID, clients.InflightMessage{
-				Packet: packets.Packet{
-					FixedHeader: packets.FixedHeader(msg.FixedHeader),
-					PacketID:    msg.PacketID,
-					TopicName:   msg.TopicName,
-					Payload:     msg.Payload,
+			if msg.Phase == persistence.PhaseReceived {
+				client.NoteInboundQos2(msg.PacketID)
+				continue
+			}
+
+			if s.inflightQuotaExceeded(client) { // Discard any inflights over the quota.
+				if s.Store != nil {
+					s.onStorage(client, "DeleteInflight", s.Store.DeleteInflight(msg.ID))
+				}
+				continue
+			}
+
+			pk := packets.Packet{
+				FixedHeader: packets.FixedHeader(msg.FixedHeader),
+				Properties: packets.Properties{
+					ResponseTopic:   msg.ResponseTopic,
+					CorrelationData: msg.CorrelationData,
+					User:            restoredUserProperties(msg.User),
 				},
-				Created: msg.Created,
-				Sent:    msg.Sent,
-				Resends: msg.Resends,
+				PacketID:  msg.PacketID,
+				TopicName: msg.TopicName,
+				Payload:   msg.Payload,
+			}
+
+			if msg.Phase == persistence.PhaseRelease {
+				pk = packets.Packet{
+					FixedHeader: packets.FixedHeader{
+						Type: packets.Pubrel,
+						Qos:  1,
+					},
+					PacketID: msg.PacketID,
+				}
+			}
+
+			client.Inflight.Set(msg.PacketID, clients.InflightMessage{
+				Packet:   pk,
+				Created:  msg.Created,
+				Sent:     msg.Sent,
+				Resends:  msg.Resends,
+				Sequence: msg.Sequence,
 			})
 		}
 	}
 }
 
-// loadRetained restores retained messages from the datastore.
+// loadRetained restores retained messages from the datastore. Messages which
+// have already expired are skipped, and are removed from the datastore by the
+// next sweep for expired retained messages.
 func (s *Server) loadRetained(v []persistence.Message) {
+	now := time.Now().Unix()
 	for _, msg := range v {
+		if msg.Expired(now) {
+			continue
+		}
+
 		s.Topics.RetainMessage(packets.Packet{
 			FixedHeader: packets.FixedHeader(msg.FixedHeader),
-			TopicName:   msg.TopicName,
-			Payload:     msg.Payload,
+			Properties: packets.Properties{
+				MessageExpiryInterval: uint32(msg.ExpiryInterval),
+				ResponseTopic:         msg.ResponseTopic,
+				CorrelationData:       msg.CorrelationData,
+				User:                  restoredUserProperties(msg.User),
+			},
+			TopicName: msg.TopicName,
+			Payload:   msg.Payload,
+			Created:   msg.Created,
 		})
 	}
+
+	s.updateRetainedStats()
+	s.evictRetained()
+}
+
+// updateRetainedStats sets the retained message count and size of the system
+// info from the topic index, which counts a replaced retained message once.
+func (s *Server) updateRetainedStats() {
+	atomic.StoreInt64(&s.System.Retained, s.Topics.RetainedCount())
+	atomic.StoreInt64(&s.System.RetainedBytes, s.Topics.RetainedBytes())
+}
+
+// deleteRetained deletes a retained message from the topic index and the
+// persistent store, returning true if the message was retained.
+func (s *Server) deleteRetained(pk packets.Packet) bool {
+	q := s.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: pk.TopicName,
+	})
+	s.updateRetainedStats()
+
+	if s.Store != nil {
+		s.onStorage(&s.inline, "DeleteRetained", s.Store.DeleteRetained("ret_"+pk.TopicName))
+	}
+
+	return q == -1
+}
+
+// evictRetained deletes the oldest retained messages until their total payload
+// size is within the MaxRetainedBytes limit.
+func (s *Server) evictRetained() {
+	max := s.Options.MaxRetainedBytes
+	if max <= 0 || s.Topics.RetainedBytes() <= max {
+		return
+	}
+
+	msgs := s.Topics.Messages("#")
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].Created == msgs[j].Created {
+			return msgs[i].TopicName < msgs[j].TopicName
+		}
+		return msgs[i].Created < msgs[j].Created
+	})
+
+	for _, pk := range msgs {
+		if s.Topics.RetainedBytes() <= max {
+			return
+		}
+
+		if s.deleteRetained(pk) {
+			atomic.AddInt64(&s.System.RetainedEvicted, 1)
+		}
+	}
+}
+
+// clearExpiredRetained deletes all retained messages whose message expiry
+// interval lapsed before the given unix time.
+func (s *Server) clearExpiredRetained(now int64) {
+	for _, pk := range s.Topics.Messages("#") {
+		if pk.Expired(now) {
+			s.deleteRetained(pk)
+		}
+	}
+
+	if s.Store != nil {
+		s.onStorage(&s.inline, "ClearExpiredRetained", s.Store.ClearExpiredRetained(now))
+	}
+}
+
+// endSession applies the session expiry interval of a client which has
+// disconnected. A session with an interval of 0 is discarded immediately, and
+// any other session is kept until the interval elapses, unless it never expires.
+func (s *Server) endSession(cl *clients.Client) {
+	switch cl.SessionExpiryInterval {
+	case 0:
+		s.purgeSession(cl)
+	case clients.SessionExpiryNever:
+	default:
+		cl.SetSessionExpires(time.Now().Unix() + int64(cl.SessionExpiryInterval))
+		if s.Store == nil {
+			return
+		}
+
+		if existing, ok := s.Clients.Get(cl.ID); ok && existing == cl {
+			s.storeClient(cl)
+		}
+	}
+}
+
+// purgeSession discards the session of a disconnected client, including its
+// subscriptions, inflight and queued messages, and persisted state. A delayed
+// will message is sent when the session ends, even if its delay has not elapsed.
+func (s *Server) purgeSession(cl *clients.Client) {
+	if !s.Clients.Remove(cl) { // The session was taken over by a new connection.
+		return
+	}
+
+	cl.Lock()
+	s.deleteStoredSession(cl)
+	s.unsubscribeClient(cl)
+	cl.Unlock()
+	s.clearAbandonedInflights(cl)
+
+	if s.cancelLWT(cl.ID) {
+		s.publishLWT(cl)
+	}
+}
+
+// deleteStoredSession deletes the persisted client, subscriptions and inflight
+// messages of a session from the store. The client must be locked by the caller.
+func (s *Server) deleteStoredSession(cl *clients.Client) {
+	if s.Store == nil {
+		return
+	}
+
+	s.onStorage(cl, "DeleteClient", s.Store.DeleteClient("cl_"+cl.ID))
+	for filter := range cl.Subscriptions {
+		s.onStorage(cl, "DeleteSubscription", s.Store.DeleteSubscription("sub_"+cl.ID+":"+filter))
+	}
+
+	for _, tk := range cl.Inflight.GetAll() {
+		s.onStorage(cl, "DeleteInflight", s.Store.DeleteInflight(persistentID(cl, tk.Packet)))
+	}
+
+	for _, id := range cl.InboundQos2() {
+		s.onStorage(cl, "DeleteInflight", s.Store.DeleteInflight(receivedID(cl, packets.Packet{PacketID: id})))
+	}
+}
+
+// clearExpiredSessions discards the sessions of disconnected clients which
+// expired before the given unix time.
+func (s *Server) clearExpiredSessions(now int64) {
+	for _, cl := range s.Clients.GetAll() {
+		if cl.SessionExpired(now) && atomic.LoadUint32(&cl.State.Done) == 1 {
+			s.Options.Logger.Debug("session expired", logFields(cl.Info())...)
+			s.purgeSession(cl)
+		}
+	}
+
+	if s.Store != nil {
+		s.onStorage(&s.inline, "ClearExpiredSessions", s.Store.ClearExpiredSessions(now))
+	}
+}
+
+// inflightTTL returns the inflight TTL of each qos, applying any per-qos
+// overrides to the server inflight TTL.
+func (s *Server) inflightTTL() persistence.InflightTTL {
+	ttl := persistence.NewInflightTTL(s.Options.InflightTTL)
+	for qos, seconds := range s.Options.InflightTTLForQoS {
+		if seconds > 0 {
+			ttl.Set(qos, seconds)
+		}
+	}
+
+	return ttl
 }
 
-// clearExpiredInflights deletes all inflight messages older than server inflight TTL.
+// clearExpiredInflights deletes all inflight messages older than the server
+// inflight TTL of the qos of their delivery.
 func (s *Server) clearExpiredInflights(dt int64) {
-	expiry := dt - s.Options.InflightTTL
+	ttl := s.inflightTTL()
+	expiry := [3]int64{dt - ttl[0], dt - ttl[1], dt - ttl[2]}
 
 	for _, client := range s.Clients.GetAll() {
-		deleted := client.Inflight.ClearExpired(expiry)
+		deleted := client.Inflight.ClearExpiredQos(expiry)
 		atomic.AddInt64(&s.System.Inflight, deleted*-1)
 	}
 
 	if s.Store != nil {
-		s.Store.ClearExpiredInflight(expiry)
+		s.onStorage(&s.inline, "ClearExpiredInflightAt", s.Store.ClearExpiredInflightAt(dt))
 	}
 }
 
@@ -1125,6 +5674,8 @@ func (s *Server) clearAbandonedInflights(cl *clients.Client) {
 		cl.Inflight.Delete(i)
 		atomic.AddInt64(&s.System.Inflight, -1)
 	}
+
+	cl.Inflight.TakeQueued(func(clients.InflightMessage) bool { return true })
 }
 
 // resendPendingInflights attempts resends of any pending and due inflight messages.
@@ -1132,7 +5683,7 @@ func (s *Server) resendPendingInflights() {
 	for _, client := range s.Clients.GetAll() {
 		err := s.ResendClientInflight(client, false)
 		if err != nil {
-			// TODO add log-level debugging.
+			s.Options.Logger.Debug("resending inflight messages failed", logFields(client.Info(), logger.KeyError, err)...)
 			continue
 		}
 	}
@@ -1,16 +1,26 @@
 package server
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/require"
 
@@ -18,10 +28,13 @@ import (
 	"github.com/csymapp/mqtt/server/internal/circ"
 	"github.com/csymapp/mqtt/server/internal/clients"
 	"github.com/csymapp/mqtt/server/internal/packets"
+	"github.com/csymapp/mqtt/server/internal/ratelimit"
 	"github.com/csymapp/mqtt/server/internal/topics"
 	"github.com/csymapp/mqtt/server/listeners"
 	"github.com/csymapp/mqtt/server/listeners/auth"
+	"github.com/csymapp/mqtt/server/logger"
 	"github.com/csymapp/mqtt/server/persistence"
+	"github.com/csymapp/mqtt/server/persistence/mem"
 	"github.com/csymapp/mqtt/server/system"
 )
 
@@ -73,6 +86,17 @@ func setupClient() (s *Server, cl *clients.Client, r net.Conn, w net.Conn) {
 	return
 }
 
+// disconnectPacket returns the MQTT v5 DISCONNECT packet sent by the server with
+// a reason code and reason string.
+func disconnectPacket(code byte, reason string) []byte {
+	n := len(reason)
+	return append([]byte{
+		byte(packets.Disconnect << 4), byte(n + 5), // Fixed header
+		code,                                                         // Reason Code
+		byte(n + 3), packets.PropReasonString, byte(n >> 8), byte(n), // Properties
+	}, reason...)
+}
+
 func setupServerClient(s *Server) (cl *clients.Client, r net.Conn, w net.Conn) {
 	r, w = net.Pipe()
 	cl = clients.NewClient(w, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
@@ -93,6 +117,56 @@ func TestNew(t *testing.T) {
 	require.Equal(t, true, s.System.Started > 0)
 }
 
+// testLogger records the logs it is called with.
+type testLogger struct {
+	sync.Mutex
+	logs []testLog
+}
+
+// testLog is a log recorded by testLogger.
+type testLog struct {
+	level string
+	msg   string
+	kv    map[string]interface{}
+}
+
+func (l *testLogger) Debug(msg string, kv ...interface{}) { l.add("debug", msg, kv) }
+func (l *testLogger) Info(msg string, kv ...interface{})  { l.add("info", msg, kv) }
+func (l *testLogger) Warn(msg string, kv ...interface{})  { l.add("warn", msg, kv) }
+func (l *testLogger) Error(msg string, kv ...interface{}) { l.add("error", msg, kv) }
+
+func (l *testLogger) add(level, msg string, kv []interface{}) {
+	m := make(map[string]interface{})
+	for i := 0; i+1 < len(kv); i += 2 {
+		m[kv[i].(string)] = kv[i+1]
+	}
+
+	l.Lock()
+	l.logs = append(l.logs, testLog{level: level, msg: msg, kv: m})
+	l.Unlock()
+}
+
+// find returns the first log with a message.
+func (l *testLogger) find(msg string) (testLog, bool) {
+	l.Lock()
+	defer l.Unlock()
+	for _, lg := range l.logs {
+		if lg.msg == msg {
+			return lg, true
+		}
+	}
+	return testLog{}, false
+}
+
+func TestNewServerLogger(t *testing.T) {
+	s := NewServer(nil)
+	require.Equal(t, logger.Nop{}, s.Options.Logger)
+
+	l := new(testLogger)
+	s = NewServer(&Options{Logger: l})
+	require.Equal(t, l, s.Options.Logger)
+}
+
 func BenchmarkNew(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		New()
@@ -114,6 +188,21 @@ func TestNewServer(t *testing.T) {
 	require.Equal(t, true, s.System.Started > 0)
 	require.Equal(t, 1000, s.Options.BufferSize)
 	require.Equal(t, 100, s.Options.BufferBlockSize)
+	require.Equal(t, defaultRetainedSweepInterval, s.Options.RetainedSweepInterval)
+	require.Equal(t, defaultSessionSweepInterval, s.Options.SessionSweepInterval)
+	require.Equal(t, defaultHandshakeTimeout, s.Options.HandshakeTimeout)
+	require.Equal(t, defaultConnectionSweepInterval, s.Options.ConnectionSweepInterval)
+	require.Equal(t, inflightMaxResends, s.Options.InflightMaxResends)
+	require.Equal(t, int64(0), s.Options.InflightResendInterval)
+}
+
+func TestNewServerInflightResend(t *testing.T) {
+	s := NewServer(&Options{
+		InflightResendInterval: 5,
+		InflightMaxResends:     12,
+	})
+	require.Equal(t, int64(5), s.Options.InflightResendInterval)
+	require.Equal(t, 12, s.Options.InflightMaxResends)
 }
 
 func BenchmarkNewServer(b *testing.B) {
@@ -146,6 +235,106 @@ func TestServerAddStoreFailure(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestServerAddStoreWriteBehind(t *testing.T) {
+	s := New()
+	s.Options.WriteBehind = &persistence.WriteBehindOptions{Size: 10}
+	queued, dropped := s.StoreQueue()
+	require.Equal(t, 0, queued)
+	require.Equal(t, int64(0), dropped)
+
+	p := mem.New()
+	require.NoError(t, s.AddStore(p))
+	require.IsType(t, new(persistence.WriteBehind), s.Store)
+	require.Same(t, s.writeBehind, s.Store)
+
+	require.NoError(t, s.Store.WriteClient(persistence.Client{ID: "cl_a", ClientID: "a", T: persistence.KClient}))
+	clients, err := s.Store.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+
+	queued, dropped = s.StoreQueue()
+	require.Equal(t, 0, queued)
+	require.Equal(t, int64(0), dropped)
+	s.Store.Close()
+}
+
+func TestServerAddStoreWriteBehindError(t *testing.T) {
+	s := New()
+	s.Options.WriteBehind = new(persistence.WriteBehindOptions)
+	require.NoError(t, s.AddStore(&persistence.MockStore{Fail: map[string]bool{"write_clients": true}}))
+	require.NoError(t, s.Store.WriteClient(persistence.Client{ID: "cl_a"}))
+	s.writeBehind.Flush()
+
+	s.storeErrMu.RLock()
+	defer s.storeErrMu.RUnlock()
+	require.Error(t, s.lastStorageErr)
+	require.True(t, s.failingOps["WriteClient"])
+	s.Store.Close()
+}
+
+func TestServerAddRetainedStore(t *testing.T) {
+	s := New()
+	retained := mem.New()
+	require.NoError(t, s.AddRetainedStore(retained))
+	require.Nil(t, s.Store)
+
+	p := mem.New()
+	require.NoError(t, s.AddStore(p))
+	require.NoError(t, s.Store.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"}))
+	require.NoError(t, s.Store.WriteClient(persistence.Client{ID: "cl_a", ClientID: "a", T: persistence.KClient}))
+
+	n, err := retained.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	n, err = p.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	clients, err := p.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	clients, err = retained.ReadClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+}
+
+func TestServerAddRetainedStoreAfterStore(t *testing.T) {
+	s := New()
+	p := new(persistence.MockStore)
+	require.NoError(t, s.AddStore(p))
+
+	retained := new(persistence.MockStore)
+	require.ErrorIs(t, s.AddRetainedStore(retained), ErrStoreAdded)
+	require.False(t, retained.Opened)
+	require.Equal(t, p, s.Store)
+	require.Nil(t, s.retainedStore)
+}
+
+func TestServerAddRetainedStoreWrapped(t *testing.T) {
+	s := NewServer(&Options{
+		StoreLatency: true,
+		WriteBehind:  &persistence.WriteBehindOptions{},
+	})
+	retained := mem.New()
+	require.NoError(t, s.AddRetainedStore(retained))
+	require.NoError(t, s.AddStore(mem.New()))
+	require.IsType(t, new(persistence.WriteBehind), s.Store)
+
+	require.NoError(t, s.Store.WriteRetained(persistence.Message{ID: "ret_a", T: persistence.KRetained, TopicName: "a"}))
+	s.writeBehind.Flush()
+	n, err := retained.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, int64(1), s.StoreLatency()["WriteRetained"].Count)
+	s.Store.Close()
+}
+
+func TestServerAddRetainedStoreFailure(t *testing.T) {
+	s := New()
+	require.NoError(t, s.AddRetainedStore(&persistence.MockStore{FailOpen: true}))
+	require.Error(t, s.AddStore(new(persistence.MockStore)))
+}
+
 func BenchmarkServerAddStore(b *testing.B) {
 	s := New()
 	p := new(persistence.MockStore)
@@ -185,13 +374,121 @@ func TestServerAddListener(t *testing.T) {
 	require.Equal(t, ErrListenerIDExists, err)
 }
 
+func TestServerAddListenerDefaultAuth(t *testing.T) {
+	ac := new(auth.Disallow)
+	s := NewServer(&Options{
+		Auth: ac,
+	})
+
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), nil))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883"), &listeners.Config{
+		MaxPacketSize: 1024,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t3", ":1884"), &listeners.Config{
+		Auth: new(auth.Allow),
+	}))
+
+	l, ok := s.Listeners.Get("t1")
+	require.True(t, ok)
+	require.Same(t, ac, l.(*listeners.MockListener).Config.Auth)
+
+	l, ok = s.Listeners.Get("t2")
+	require.True(t, ok)
+	require.Same(t, ac, l.(*listeners.MockListener).Config.Auth)
+
+	l, ok = s.Listeners.Get("t3")
+	require.True(t, ok)
+	require.Equal(t, new(auth.Allow), l.(*listeners.MockListener).Config.Auth)
+}
+
+func TestServerAuthController(t *testing.T) {
+	s := New()
+	require.Equal(t, new(auth.Disallow), s.authController())
+
+	ac := new(auth.Allow)
+	s.Options.Auth = ac
+	require.Same(t, ac, s.authController())
+}
+
 func TestServerAddListenerFailure(t *testing.T) {
 	s := New()
 	require.NotNil(t, s)
+	h := new(testHook)
+	s.AddHook(h)
+
 	m := listeners.NewMockListener("t1", ":1882")
 	m.ErrListen = true
-	err := s.AddListener(m, nil)
+	err := s.AddListener(m, &listeners.Config{MaxPacketSize: 1024})
 	require.Error(t, err)
+
+	// the listener is not kept, so it can be added again.
+	_, ok := s.Listeners.Get("t1")
+	require.False(t, ok)
+	require.NotContains(t, s.settings, "t1")
+	require.Equal(t, []string{"bind failed:t1"}, h.notes())
+}
+
+func TestServerAddListenerServing(t *testing.T) {
+	s := New()
+	h := new(testHook)
+	s.AddHook(h)
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), nil))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	m := listeners.NewMockListener("t2", ":1883")
+	require.NoError(t, s.AddListener(m, nil))
+	require.Eventually(t, m.IsServing, time.Second, time.Millisecond)
+	require.Equal(t, []string{"started:t1", "started:t2"}, h.notes())
+}
+
+func TestServerRemoveListener(t *testing.T) {
+	s := New()
+	h := new(testHook)
+	s.AddHook(h)
+
+	m1 := listeners.NewMockListener("t1", ":1882")
+	m2 := listeners.NewMockListener("t2", ":1883")
+	require.NoError(t, s.AddListener(m1, &listeners.Config{MaxPacketSize: 1024}))
+	require.NoError(t, s.AddListener(m2, &listeners.Config{MaxPacketSize: 1024}))
+	require.NoError(t, s.Serve())
+	require.Eventually(t, func() bool {
+		return m1.IsServing() && m2.IsServing()
+	}, time.Second, time.Millisecond)
+
+	cl1, r1, _ := setupServerClient(s)
+	cl1.ID = "mochi1"
+	cl1.Listener = "t1"
+	s.Clients.Add(cl1)
+	go ioutil.ReadAll(r1)
+
+	cl2, r2, _ := setupServerClient(s)
+	cl2.ID = "mochi2"
+	cl2.Listener = "t2"
+	s.Clients.Add(cl2)
+	go ioutil.ReadAll(r2)
+
+	require.NoError(t, s.RemoveListener("t1"))
+	require.False(t, m1.IsServing())
+	require.Equal(t, uint32(1), atomic.LoadUint32(&cl1.State.Done))
+	_, ok := s.Listeners.Get("t1")
+	require.False(t, ok)
+	require.NotContains(t, s.settings, "t1")
+
+	// the other listener and its clients are not disturbed.
+	require.True(t, m2.IsServing())
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl2.State.Done))
+	require.Contains(t, s.settings, "t2")
+	require.Equal(t, map[string]bool{"t2": true}, s.Listeners.Serving())
+
+	require.ErrorIs(t, s.RemoveListener("t1"), ErrListenerNotFound)
+	require.Contains(t, h.notes(), "stopped:t1")
+	require.NotContains(t, h.notes(), "stopped:t2")
+
+	// a listener may be added again with a removed id.
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), nil))
+	s.Close()
+	require.Contains(t, h.notes(), "stopped:t2")
 }
 
 func BenchmarkServerAddListener(b *testing.B) {
@@ -254,285 +551,752 @@ func TestServerInlineInfo(t *testing.T) {
 	}, s.inline.Info())
 }
 
-func TestServerEstablishConnectionOKCleanSession(t *testing.T) {
+func TestServerAddListenerMaxPacketSize(t *testing.T) {
+	s := NewServer(&Options{
+		MaxPacketSize: 1024,
+	})
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), &listeners.Config{
+		Auth:          new(auth.Allow),
+		MaxPacketSize: 65536,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883"), &listeners.Config{
+		Auth: new(auth.Allow),
+	}))
+
+	require.Equal(t, uint32(65536), s.maxPacketSize("t1"))
+	require.Equal(t, uint32(1024), s.maxPacketSize("t2"))
+	require.Equal(t, uint32(1024), s.maxPacketSize("t3"))
+}
+
+func TestServerAddListenerTopicLimits(t *testing.T) {
+	s := NewServer(&Options{
+		MaxTopicLevels: 4,
+		MaxTopicLength: 16,
+	})
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), &listeners.Config{
+		Auth:           new(auth.Allow),
+		MaxTopicLevels: 2,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883"), &listeners.Config{
+		Auth: new(auth.Allow),
+	}))
+
+	require.NoError(t, s.checkTopicLimits("t1", "a/b"))
+	require.Error(t, s.checkTopicLimits("t1", "a/b/c"))
+	require.Error(t, s.checkTopicLimits("t1", "abcdefghijklmnopq"))
+	require.NoError(t, s.checkTopicLimits("t2", "a/b/c/d"))
+	require.Error(t, s.checkTopicLimits("t2", "a/b/c/d/e"))
+	require.NoError(t, s.checkTopicLimits("t3", "abcdefghijklmnop"))
+	require.Error(t, s.checkTopicLimits("t3", "abcdefghijklmnopq"))
+
+	require.NoError(t, New().checkTopicLimits("t1", strings.Repeat("a/", 1000)))
+}
+
+func TestServerAddListenerMaxKeepalive(t *testing.T) {
+	s := New()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), &listeners.Config{
+		Auth:         new(auth.Allow),
+		MaxKeepalive: 30,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883"), &listeners.Config{
+		Auth: new(auth.Allow),
+	}))
+
+	require.Equal(t, uint16(30), s.maxKeepalive("t1"))
+	require.Equal(t, uint16(0), s.maxKeepalive("t2"))
+}
+
+func TestServerAddListenerClientIDRules(t *testing.T) {
 	s := New()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), &listeners.Config{
+		Auth:              new(auth.Allow),
+		MaxClientIDLength: 8,
+		StrictClientID:    true,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883"), &listeners.Config{
+		Auth: new(auth.Allow),
+	}))
+
+	require.Equal(t, clientIDRule{maxLength: 8, strict: true}, s.settings["t1"].clientIDRule)
+	require.Equal(t, clientIDRule{}, s.settings["t2"].clientIDRule)
+}
 
-	// Existing connection with subscription.
-	c, _ := net.Pipe()
-	cl := clients.NewClient(c, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
-	cl.ID = "mochi"
-	cl.Subscriptions = map[string]byte{
-		"a/b/c": 1,
+func TestServerClientIDValid(t *testing.T) {
+	s := New()
+	s.settings["max"] = &listenerSettings{maxQos: 2, clientIDRule: clientIDRule{maxLength: 10}}
+	s.settings["strict"] = &listenerSettings{maxQos: 2, clientIDRule: clientIDRule{strict: true}}
+	s.settings["both"] = &listenerSettings{maxQos: 2, clientIDRule: clientIDRule{maxLength: 5, strict: true}}
+
+	tt := []struct {
+		lid  string
+		id   string
+		want bool
+	}{
+		{lid: "none", id: strings.Repeat("a", 65535), want: true},
+		{lid: "max", id: strings.Repeat("a", 9), want: true},
+		{lid: "max", id: strings.Repeat("a", 10), want: true},
+		{lid: "max", id: strings.Repeat("a", 11), want: false},
+		{lid: "max", id: "mochi-é/#", want: true},
+		{lid: "max", id: "mochi-ééé", want: false}, // 9 characters, but 12 bytes.
+		{lid: "strict", id: "", want: false},
+		{lid: "strict", id: "a", want: true},
+		{lid: "strict", id: strings.Repeat("a", 22), want: true},
+		{lid: "strict", id: strings.Repeat("a", 23), want: true},
+		{lid: "strict", id: strings.Repeat("a", 24), want: false},
+		{lid: "strict", id: "azAZ09", want: true},
+		{lid: "strict", id: "mochi-1", want: false},
+		{lid: "strict", id: "mochi_1", want: false},
+		{lid: "strict", id: "mochié", want: false},
+		{lid: "both", id: "abcde", want: true},
+		{lid: "both", id: "abcdef", want: false},
+		{lid: "both", id: "ab-d", want: false},
 	}
-	s.Clients.Add(cl)
-	s.Topics.Subscribe("a/b/c", cl.ID, 0)
-
-	r, w := net.Pipe()
-	o := make(chan error)
-	go func() {
-		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
-	}()
 
-	go func() {
-		w.Write([]byte{
-			byte(packets.Connect << 4), 17, // Fixed header
-			0, 4, // Protocol Name - MSB+LSB
-			'M', 'Q', 'T', 'T', // Protocol Name
-			4,     // Protocol Version
-			2,     // Packet Flags - clean session
-			0, 45, // Keepalive
-			0, 5, // Client ID - MSB+LSB
-			'm', 'o', 'c', 'h', 'i', // Client ID
-		})
-		w.Write([]byte{byte(packets.Disconnect << 4), 0})
-	}()
+	for i, tx := range tt {
+		require.Equal(t, tx.want, s.clientIDValid(tx.lid, tx.id), "case %d: %s %q", i, tx.lid, tx.id)
+	}
+}
 
-	// Receive the Connack
-	recv := make(chan []byte)
-	go func() {
-		buf, err := ioutil.ReadAll(w)
-		if err != nil {
-			panic(err)
-		}
-		recv <- buf
-	}()
+func TestServerAddListenerTimeouts(t *testing.T) {
+	s := New()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), &listeners.Config{
+		Auth:        new(auth.Allow),
+		ReadTimeout: time.Minute,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883"), &listeners.Config{
+		Auth:         new(auth.Allow),
+		WriteTimeout: -1,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t3", ":1884"), &listeners.Config{
+		Auth: new(auth.Allow),
+	}))
+
+	require.Equal(t, ioTimeouts{read: time.Minute, write: defaultWriteTimeout}, s.ioTimeouts("t1"))
+	require.Equal(t, ioTimeouts{write: -1}, s.ioTimeouts("t2"))
+	require.Equal(t, ioTimeouts{write: defaultWriteTimeout}, s.ioTimeouts("t3"))
+}
 
-	errx := <-o
-	require.ErrorIs(t, errx, ErrClientDisconnect)
+func TestServerAddListenerCapabilities(t *testing.T) {
+	s := New()
+	qos := byte(1)
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), &listeners.Config{
+		Auth:          new(auth.Allow),
+		MaximumQos:    &qos,
+		DisableRetain: true,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883"), &listeners.Config{
+		Auth: new(auth.Allow),
+	}))
+
+	require.Equal(t, byte(1), s.maxQos("t1"))
+	require.False(t, s.retainAvailable("t1"))
+	require.Equal(t, byte(2), s.maxQos("t2"))
+	require.True(t, s.retainAvailable("t2"))
+}
 
-	require.Equal(t, []byte{
-		byte(packets.Connack << 4), 2,
-		0, packets.Accepted,
-	}, <-recv)
+func TestServerConnackCapabilities(t *testing.T) {
+	s := New()
+	s.settings["t1"] = &listenerSettings{maxQos: 1, retainDisabled: true}
 
-	w.Close()
+	_, cl, _, _ := setupClient()
+	cl.Listener = "t1"
+	cl.ProtocolVersion = 5
+	pk := s.connack(cl, packets.Accepted, false)
+	require.True(t, pk.Properties.MaximumQosFlag)
+	require.Equal(t, byte(1), pk.Properties.MaximumQos)
+	require.True(t, pk.Properties.RetainAvailableFlag)
+	require.Equal(t, byte(0), pk.Properties.RetainAvailable)
+
+	cl.ProtocolVersion = 4
+	pk = s.connack(cl, packets.Accepted, false)
+	require.False(t, pk.Properties.MaximumQosFlag)
+	require.False(t, pk.Properties.RetainAvailableFlag)
+
+	cl.Listener = "t2"
+	cl.ProtocolVersion = 5
+	pk = s.connack(cl, packets.Accepted, false)
+	require.False(t, pk.Properties.MaximumQosFlag)
+	require.False(t, pk.Properties.RetainAvailableFlag)
+}
 
-	cl.Stop(nil)
-	cl.ClearBuffers()
+func TestServerConnackResponseInformation(t *testing.T) {
+	s := NewServer(&Options{ResponseInformation: "responses"})
+	_, cl, _, _ := setupClient()
+	cl.ProtocolVersion = 5
+	cl.ResponseInfo = true
 
-	clw, ok := s.Clients.Get("mochi")
-	require.True(t, ok)
-	require.Empty(t, clw.Subscriptions)
-	require.Equal(t, int64(0), s.bytepool.InUse())
-	require.Nil(t, clw.R)
-	require.Nil(t, clw.W)
+	pk := s.connack(cl, packets.Accepted, false)
+	require.Equal(t, "responses/mochi", pk.Properties.ResponseInfo)
 
-}
+	pk = s.connack(cl, packets.CodeNotAuthorized, false)
+	require.Empty(t, pk.Properties.ResponseInfo)
 
-func TestServerEventOnConnect(t *testing.T) {
-	r, w := net.Pipe()
-	s, cl, _, _ := setupClient()
-	s.Clients.Add(cl)
+	cl.ResponseInfo = false
+	pk = s.connack(cl, packets.Accepted, false)
+	require.Empty(t, pk.Properties.ResponseInfo)
 
-	var hook packetHook
-	s.Events.OnConnect = hook.onConnect
+	cl.ResponseInfo = true
+	cl.ProtocolVersion = 4
+	pk = s.connack(cl, packets.Accepted, false)
+	require.Empty(t, pk.Properties.ResponseInfo)
 
-	o := make(chan error)
-	go func() {
-		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
-	}()
+	s = New()
+	cl.ProtocolVersion = 5
+	pk = s.connack(cl, packets.Accepted, false)
+	require.Empty(t, pk.Properties.ResponseInfo)
+}
 
-	go func() {
-		w.Write([]byte{
-			byte(packets.Connect << 4), 17, // Fixed header
-			0, 4, // Protocol Name - MSB+LSB
-			'M', 'Q', 'T', 'T', // Protocol Name
-			4,     // Protocol Version
-			2,     // Packet Flags - clean session
-			0, 45, // Keepalive
-			0, 5, // Client ID - MSB+LSB
-			'm', 'o', 'c', 'h', 'i', // Client ID
-		})
-		w.Write([]byte{byte(packets.Disconnect << 4), 0})
-	}()
+func TestServerWriteClientNoProblemInfo(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	cl.NoProblemInfo = true
 
-	// Receive the Connack
 	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(w)
-		if err != nil {
-			panic(err)
-		}
+		buf, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
 		recv <- buf
 	}()
 
-	errx := <-o
-	require.ErrorIs(t, errx, ErrClientDisconnect)
+	s.sendDisconnect(cl, packets.CodeQuotaExceeded, "inflight quota exceeded")
+	require.NoError(t, s.writeClient(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connack,
+		},
+		ReturnCode: packets.Accepted,
+		Properties: packets.Properties{
+			User: []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	}))
+	require.NoError(t, s.writeClient(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Puback,
+		},
+		PacketID:   1,
+		ReturnCode: packets.CodeQuotaExceeded,
+		Properties: packets.Properties{
+			ReasonString: "quota exceeded",
+			User:         []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	}))
+	require.NoError(t, s.writeClient(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a",
+		Properties: packets.Properties{
+			User: []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	}))
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
 	require.Equal(t, []byte{
-		byte(packets.Connack << 4), 2,
+		byte(packets.Disconnect << 4), 2,
+		packets.CodeQuotaExceeded,
+		0, // no properties.
+
+		byte(packets.Connack << 4), 3,
 		0, packets.Accepted,
+		0, // no properties.
+
+		byte(packets.Puback << 4), 4,
+		0, 1,
+		packets.CodeQuotaExceeded,
+		0, // no properties.
+
+		byte(packets.Publish << 4), 11,
+		0, 1, 'a',
+		7, packets.PropUser, 0, 1, 'k', 0, 1, 'v', // user properties are still sent in publishes.
 	}, <-recv)
+}
 
-	w.Close()
+func TestServerNegotiateCompression(t *testing.T) {
+	tt := []struct {
+		desc    string
+		enabled bool
+		version byte
+		user    []packets.UserProperty
+		expect  string
+	}{
+		{desc: "disabled", version: 5, user: []packets.UserProperty{{Key: CompressionProperty, Val: CompressionDeflate}}},
+		{desc: "v3", enabled: true, version: 4, user: []packets.UserProperty{{Key: CompressionProperty, Val: CompressionDeflate}}},
+		{desc: "not advertised", enabled: true, version: 5},
+		{desc: "unsupported", enabled: true, version: 5, user: []packets.UserProperty{{Key: CompressionProperty, Val: "zstd"}}},
+		{desc: "deflate", enabled: true, version: 5, user: []packets.UserProperty{{Key: CompressionProperty, Val: CompressionDeflate}}, expect: CompressionDeflate},
+		{desc: "list", enabled: true, version: 5, user: []packets.UserProperty{{Key: "a", Val: "b"}, {Key: CompressionProperty, Val: "zstd, deflate"}}, expect: CompressionDeflate},
+	}
 
-	time.Sleep(10 * time.Millisecond)
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := NewServer(&Options{Compression: tx.enabled})
+			cl, _, _ := setupServerClient(s)
+			cl.ProtocolVersion = tx.version
+			pk := packets.Packet{Properties: packets.Properties{User: tx.user}}
+			require.Equal(t, tx.expect, s.negotiateCompression(cl, pk))
+		})
+	}
+}
 
-	require.Equal(t, events.Client{
-		ID:           "mochi",
-		Remote:       "pipe",
-		Listener:     "tcp",
-		CleanSession: true,
-	}, hook.client)
+func TestServerConnackCompression(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.ProtocolVersion = 5
+	cl.Compression = CompressionDeflate
 
-	require.Equal(t, events.Packet(packets.Packet{
+	pk := s.connack(cl, packets.Accepted, false)
+	require.Equal(t, []packets.UserProperty{{Key: CompressionProperty, Val: CompressionDeflate}}, pk.Properties.User)
+
+	pk = s.connack(cl, packets.CodeNotAuthorized, false)
+	require.Empty(t, pk.Properties.User)
+
+	cl.Compression = ""
+	pk = s.connack(cl, packets.Accepted, false)
+	require.Empty(t, pk.Properties.User)
+}
+
+func TestServerCompressPublish(t *testing.T) {
+	user := []packets.UserProperty{{Key: "a", Val: "b"}}
+	pk := packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type:      packets.Connect,
-			Remaining: 17,
+			Type: packets.Publish,
 		},
-		ProtocolName:     []byte{'M', 'Q', 'T', 'T'},
-		ProtocolVersion:  4,
-		CleanSession:     true,
-		Keepalive:        45,
-		ClientIdentifier: "mochi",
-	}), hook.packet)
+		TopicName: "a/b",
+		Payload:   bytes.Repeat([]byte("hello mochi "), 64),
+		Properties: packets.Properties{
+			User: user[:1:1],
+		},
+	}
 
-	clw, ok := s.Clients.Get("mochi")
-	require.True(t, ok)
-	require.Empty(t, clw.Subscriptions)
+	out := compressPublish(pk)
+	require.Less(t, len(out.Payload), len(pk.Payload))
+	require.Equal(t, []packets.UserProperty{{Key: "a", Val: "b"}, {Key: ContentEncodingProperty, Val: CompressionDeflate}}, out.Properties.User)
+	require.Len(t, pk.Properties.User, 1)
+
+	s := NewServer(&Options{Compression: true})
+	cl, _, _ := setupServerClient(s)
+	cl.Compression = CompressionDeflate
+	require.NoError(t, s.decompressPublish(cl, &out))
+	require.Equal(t, pk.Payload, out.Payload)
+	require.Equal(t, user, out.Properties.User)
+}
 
-	require.Equal(t, int64(0), s.bytepool.InUse())
-	require.Nil(t, clw.R)
-	require.Nil(t, clw.W)
+func TestServerMaxInflatedPayloadDefault(t *testing.T) {
+	s := NewServer(nil)
+	require.Equal(t, uint32(268435455), s.Options.MaxInflatedPayload)
 
+	s = NewServer(&Options{MaxInflatedPayload: 1024})
+	require.Equal(t, uint32(1024), s.Options.MaxInflatedPayload)
 }
 
-func TestServerEventOnDisconnect(t *testing.T) {
-	r, w := net.Pipe()
-	s, cl, _, _ := setupClient()
-	s.Clients.Add(cl)
+func TestServerCompressPublishNotSmaller(t *testing.T) {
+	small := packets.Packet{Payload: []byte("hello")}
+	require.Equal(t, small, compressPublish(small))
 
-	var hook errorHook
-	s.Events.OnDisconnect = hook.onError
+	random := make([]byte, 256)
+	rand.Read(random)
+	incompressible := packets.Packet{Payload: random}
+	require.Equal(t, incompressible, compressPublish(incompressible))
+}
 
-	o := make(chan error)
-	go func() {
-		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
-	}()
+func TestServerDecompressPublishNotNegotiated(t *testing.T) {
+	s := NewServer(&Options{Compression: true})
+	cl, _, _ := setupServerClient(s)
 
-	go func() {
-		w.Write([]byte{
-			byte(packets.Connect << 4), 17, // Fixed header
-			0, 4, // Protocol Name - MSB+LSB
-			'M', 'Q', 'T', 'T', // Protocol Name
-			4,     // Protocol Version
-			2,     // Packet Flags - clean session
-			0, 45, // Keepalive
-			0, 5, // Client ID - MSB+LSB
-			'm', 'o', 'c', 'h', 'i', // Client ID
+	pk := packets.Packet{
+		Payload: []byte("not compressed"),
+		Properties: packets.Properties{
+			User: []packets.UserProperty{{Key: ContentEncodingProperty, Val: CompressionDeflate}},
+		},
+	}
+	require.NoError(t, s.decompressPublish(cl, &pk))
+	require.Equal(t, []byte("not compressed"), pk.Payload)
+	require.Len(t, pk.Properties.User, 1)
+
+	cl.Compression = CompressionDeflate
+	pk = packets.Packet{Payload: []byte("not marked")}
+	require.NoError(t, s.decompressPublish(cl, &pk))
+	require.Equal(t, []byte("not marked"), pk.Payload)
+}
+
+func TestServerDecompressPublishInvalid(t *testing.T) {
+	compressed := compressPublish(packets.Packet{Payload: bytes.Repeat([]byte("a"), 256)})
+
+	// a bomb of 64MB of zeros, which deflates to around 64KB.
+	var bomb bytes.Buffer
+	fw, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	zeros := make([]byte, 1<<20)
+	for i := 0; i < 64; i++ {
+		fw.Write(zeros)
+	}
+	fw.Close()
+
+	tt := []struct {
+		desc string
+		opts *Options
+		pk   packets.Packet
+	}{
+		{
+			desc: "invalid payload",
+			opts: &Options{Compression: true},
+			pk: packets.Packet{
+				Payload:    []byte("not compressed"),
+				Properties: packets.Properties{User: []packets.UserProperty{{Key: ContentEncodingProperty, Val: CompressionDeflate}}},
+			},
+		},
+		{
+			desc: "unsupported encoding",
+			opts: &Options{Compression: true},
+			pk: packets.Packet{
+				Payload:    compressed.Payload,
+				Properties: packets.Properties{User: []packets.UserProperty{{Key: ContentEncodingProperty, Val: "zstd"}}},
+			},
+		},
+		{
+			desc: "exceeds maximum packet size",
+			opts: &Options{Compression: true, MaxPacketSize: 128},
+			pk:   compressed,
+		},
+		{
+			desc: "decompression bomb",
+			opts: &Options{Compression: true, MaxInflatedPayload: 1 << 20},
+			pk: packets.Packet{
+				Payload:    bomb.Bytes(),
+				Properties: packets.Properties{User: []packets.UserProperty{{Key: ContentEncodingProperty, Val: CompressionDeflate}}},
+			},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := NewServer(tx.opts)
+			cl, r, w := setupServerClient(s)
+			cl.ProtocolVersion = 5
+			cl.Compression = CompressionDeflate
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(r)
+				require.NoError(t, err)
+				recv <- buf
+			}()
+
+			pk := tx.pk
+			err := s.decompressPublish(cl, &pk)
+			require.ErrorIs(t, err, ErrInvalidCompressedPayload)
+			time.Sleep(10 * time.Millisecond)
+			w.Close()
+
+			require.Equal(t, disconnectPacket(packets.CodePayloadFormatInvalid, err.Error()), <-recv)
 		})
-		w.Write([]byte{byte(packets.Disconnect << 4), 0})
-	}()
+	}
+}
+
+func TestServerWriteClientCompression(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	cl.Compression = CompressionDeflate
 
-	// Receive the Connack
 	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(w)
-		if err != nil {
-			panic(err)
-		}
+		buf, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
 		recv <- buf
 	}()
 
-	errx := <-o
-	require.ErrorIs(t, errx, ErrClientDisconnect)
+	payload := bytes.Repeat([]byte("a"), 512)
+	require.NoError(t, s.writeClient(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a",
+		Payload:   payload,
+	}))
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
 
-	require.Equal(t, []byte{
-		byte(packets.Connack << 4), 2,
-		0, packets.Accepted,
-	}, <-recv)
+	buf := <-recv
+	require.Less(t, len(buf), len(payload))
+	require.True(t, bytes.Contains(buf, []byte(ContentEncodingProperty)))
+}
 
-	w.Close()
+func TestServerAddListenerConnectionLimits(t *testing.T) {
+	s := New()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), &listeners.Config{
+		Auth:                new(auth.Allow),
+		ConnectRate:         10,
+		ConnectBurst:        5,
+		ConnectWait:         time.Second,
+		MaxConnectionsPerIP: 3,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883"), &listeners.Config{
+		Auth:                new(auth.Allow),
+		MaxConnectionsPerIP: 3,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t3", ":1884"), &listeners.Config{
+		Auth: new(auth.Allow),
+	}))
+
+	require.NotNil(t, s.settings["t1"].connLimit)
+	require.NotNil(t, s.settings["t1"].connLimit.bucket)
+	require.Equal(t, time.Second, s.settings["t1"].connLimit.wait)
+	require.Equal(t, 3, s.settings["t1"].connLimit.perIP)
+	require.NotNil(t, s.settings["t2"].connLimit)
+	require.Nil(t, s.settings["t2"].connLimit.bucket)
+	require.Nil(t, s.settings["t3"].connLimit)
+}
 
-	require.Equal(t, events.Client{
-		ID:           "mochi",
-		Remote:       "pipe",
-		Listener:     "tcp",
-		CleanSession: true,
-	}, hook.client)
+func TestServerAddListenerPublishLimits(t *testing.T) {
+	s := New()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), &listeners.Config{
+		Auth:             new(auth.Allow),
+		PublishRate:      10,
+		PublishBurst:     5,
+		PublishByteRate:  1000,
+		PublishByteBurst: 500,
+		PublishMaxDelay:  time.Second,
+	}))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883"), &listeners.Config{
+		Auth: new(auth.Allow),
+	}))
+
+	require.Equal(t, publishLimit{
+		rate:      10,
+		burst:     5,
+		byteRate:  1000,
+		byteBurst: 500,
+		maxDelay:  time.Second,
+	}, s.settings["t1"].publishLimit)
+	require.Equal(t, publishLimit{}, s.settings["t2"].publishLimit)
+
+	require.NoError(t, s.RemoveListener("t1"))
+	require.NotContains(t, s.settings, "t1")
+}
 
-	require.ErrorIs(t, ErrClientDisconnect, hook.err)
+func TestServerLimitPublish(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Listener = "t1"
+	s.settings["t1"] = &listenerSettings{
+		maxQos:       2,
+		publishLimit: publishLimit{rate: 50, burst: 1, byteRate: 1000, byteBurst: 100},
+	}
+	s.addPublisher(cl)
+	require.NotNil(t, s.publishers[cl].messages)
+	require.NotNil(t, s.publishers[cl].bytes)
 
-	clw, ok := s.Clients.Get("mochi")
-	require.True(t, ok)
-	require.Empty(t, clw.Subscriptions)
+	pk := packets.Packet{TopicName: "a/b", Payload: []byte("hello")}
+	require.NoError(t, s.limitPublish(cl, pk))
 
-	require.Equal(t, int64(0), s.bytepool.InUse())
-	require.Nil(t, clw.R)
-	require.Nil(t, clw.W)
+	start := time.Now()
+	require.NoError(t, s.limitPublish(cl, pk))
+	require.GreaterOrEqual(t, time.Since(start), 15*time.Millisecond)
+
+	// payloads larger than the byte burst wait for the bytes beyond it.
+	start = time.Now()
+	require.NoError(t, s.limitPublish(cl, packets.Packet{TopicName: "a/b", Payload: make([]byte, 130)}))
+	require.GreaterOrEqual(t, time.Since(start), 25*time.Millisecond)
+
+	s.removePublisher(cl)
+	require.NotContains(t, s.publishers, cl)
+	require.NoError(t, s.limitPublish(cl, pk))
 }
 
-func TestServerEventOnDisconnectOnError(t *testing.T) {
-	r, w := net.Pipe()
+func TestServerLimitPublishUnlimited(t *testing.T) {
 	s, cl, _, _ := setupClient()
-	s.Clients.Add(cl)
+	s.addPublisher(cl)
+	require.Nil(t, s.publishers[cl].messages)
+	require.Nil(t, s.publishers[cl].bytes)
 
-	s.Events.OnError = func(cl events.Client, err error) {
-		// Do not allow
-		panic(fmt.Errorf("unreachable error"))
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.limitPublish(cl, packets.Packet{TopicName: "a/b"}))
 	}
+}
 
-	var hook errorHook
-	s.Events.OnDisconnect = hook.onError
+func TestServerLimitPublishDisconnect(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.Listener = "t1"
+	cl.ProtocolVersion = 5
+	s.settings["t1"] = &listenerSettings{
+		maxQos:       2,
+		publishLimit: publishLimit{rate: 1, burst: 1, maxDelay: 100 * time.Millisecond},
+	}
+	s.addPublisher(cl)
 
-	o := make(chan error)
+	pk := packets.Packet{TopicName: "a/b"}
+	require.NoError(t, s.limitPublish(cl, pk))
+
+	recv := make(chan []byte)
 	go func() {
-		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+		buf, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		recv <- buf
 	}()
 
-	go func() {
-		w.Write([]byte{
-			byte(packets.Connect << 4), 17, // Fixed header
-			0, 4, // Protocol Name - MSB+LSB
-			'M', 'Q', 'T', 'T', // Protocol Name
-			4,     // Protocol Version
-			2,     // Packet Flags - clean session
-			0, 45, // Keepalive
-			0, 5, // Client ID - MSB+LSB
-			'm', 'o', 'c', 'h', 'i', // Client ID
-		})
+	err := s.limitPublish(cl, pk)
+	require.ErrorIs(t, err, ErrPublishRateExceeded)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
 
-		w.Write([]byte{0, 0})
-	}()
+	require.Equal(t, disconnectPacket(packets.CodeMessageRateTooHigh, "message rate too high"), <-recv)
+}
 
-	// Receive the Connack
-	go func() {
-		_, err := ioutil.ReadAll(w)
-		if err != nil {
-			panic(err)
-		}
-	}()
+func TestServerPublishRate(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	rate, byteRate := s.publishRate(cl)
+	require.Equal(t, float64(0), rate)
+	require.Equal(t, float64(0), byteRate)
 
-	errx := <-o
-	require.Error(t, errx)
-	require.Equal(t, "No valid packet available; 0", errx.Error())
-	require.Equal(t, errx, hook.err)
+	s.addPublisher(cl)
+	last := time.Now().Add(-time.Second)
+	s.publishers[cl].messageRate.Mark(last, 3)
+	s.publishers[cl].byteRate.Mark(last, 30)
 
-	require.Equal(t, events.Client{
-		ID:           "mochi",
-		Remote:       "pipe",
-		Listener:     "tcp",
-		CleanSession: true,
-	}, hook.client)
+	rate, byteRate = s.publishRate(cl)
+	require.Equal(t, float64(3), rate)
+	require.Equal(t, float64(30), byteRate)
 
-	clw, ok := s.Clients.Get("mochi")
+	s.Clients.Add(cl)
+	summaries := s.ConnectedClients()
+	require.Len(t, summaries, 1)
+	require.Equal(t, float64(3), summaries[0].PublishRate)
+	require.Equal(t, float64(30), summaries[0].PublishByteRate)
+}
+
+func TestServerAdmitConnectionRate(t *testing.T) {
+	s := New()
+	s.settings["tcp"] = &listenerSettings{
+		maxQos: 2,
+		connLimit: &connLimiter{
+			bucket: ratelimit.NewBucket(1, 2),
+			ips:    map[string]int{},
+		},
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	for i := 0; i < 2; i++ {
+		_, ok := s.admitConnection("tcp", addr)
+		require.True(t, ok, "burst %d", i)
+	}
+
+	_, ok := s.admitConnection("tcp", addr)
+	require.False(t, ok)
+
+	_, ok = s.admitConnection("udp", addr) // unlimited listener.
 	require.True(t, ok)
-	require.Empty(t, clw.Subscriptions)
+}
 
-	require.Equal(t, int64(0), s.bytepool.InUse())
-	require.Nil(t, clw.R)
-	require.Nil(t, clw.W)
+func TestServerAdmitConnectionRateWait(t *testing.T) {
+	s := New()
+	s.settings["tcp"] = &listenerSettings{
+		maxQos: 2,
+		connLimit: &connLimiter{
+			bucket: ratelimit.NewBucket(50, 1),
+			wait:   time.Second,
+			ips:    map[string]int{},
+		},
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	_, ok := s.admitConnection("tcp", addr)
+	require.True(t, ok)
+
+	start := time.Now()
+	_, ok = s.admitConnection("tcp", addr)
+	require.True(t, ok)
+	require.GreaterOrEqual(t, time.Since(start), 15*time.Millisecond)
 }
 
-func TestServerEstablishConnectionInheritSession(t *testing.T) {
+func TestServerAdmitConnectionPerIP(t *testing.T) {
 	s := New()
+	s.settings["tcp"] = &listenerSettings{
+		maxQos: 2,
+		connLimit: &connLimiter{
+			perIP: 2,
+			ips:   map[string]int{},
+		},
+	}
 
-	c, _ := net.Pipe()
-	cl := clients.NewClient(c, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
-	cl.ID = "mochi"
-	cl.Subscriptions = map[string]byte{
-		"a/b/c": 1,
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	b := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+
+	release1, ok := s.admitConnection("tcp", a)
+	require.True(t, ok)
+	_, ok = s.admitConnection("tcp", &net.TCPAddr{IP: a.IP, Port: 1001})
+	require.True(t, ok)
+	_, ok = s.admitConnection("tcp", a)
+	require.False(t, ok)
+	require.Equal(t, 2, s.settings["tcp"].connLimit.ips["10.0.0.1"])
+
+	_, ok = s.admitConnection("tcp", b)
+	require.True(t, ok)
+
+	release1()
+	_, ok = s.admitConnection("tcp", a)
+	require.True(t, ok)
+}
+
+func TestServerAdmitConnectionPerIPRateRefused(t *testing.T) {
+	s := New()
+	s.settings["tcp"] = &listenerSettings{
+		maxQos: 2,
+		connLimit: &connLimiter{
+			bucket: ratelimit.NewBucket(1, 1),
+			perIP:  5,
+			ips:    map[string]int{},
+		},
 	}
-	s.Clients.Add(cl)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	release, ok := s.admitConnection("tcp", addr)
+	require.True(t, ok)
+	_, ok = s.admitConnection("tcp", addr)
+	require.False(t, ok)
+	require.Equal(t, 1, s.settings["tcp"].connLimit.ips["10.0.0.1"]) // refused connections release their ip.
+
+	release()
+	require.NotContains(t, s.settings["tcp"].connLimit.ips, "10.0.0.1")
+}
+
+func TestRemoteIP(t *testing.T) {
+	require.Equal(t, "10.0.0.1", remoteIP(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}))
+	require.Equal(t, "::1", remoteIP(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1000}))
+	require.Equal(t, "pipe", remoteIP(&net.UnixAddr{Name: "pipe", Net: "unix"}))
+	require.Equal(t, "", remoteIP(nil))
+}
+
+func TestServerAssignKeepalive(t *testing.T) {
+	s := New()
+	s.settings["t1"] = &listenerSettings{maxQos: 2, keepalive: 30}
+
+	tt := []struct {
+		desc     string
+		listener string
+		version  byte
+		request  uint16
+		expect   uint16
+	}{
+		{desc: "below max", listener: "t1", version: 5, request: 20, expect: 20},
+		{desc: "above max", listener: "t1", version: 5, request: 45, expect: 30},
+		{desc: "no keepalive", listener: "t1", version: 5, request: 0, expect: 30},
+		{desc: "mqtt v3", listener: "t1", version: 4, request: 45, expect: 45},
+		{desc: "no max", listener: "t2", version: 5, request: 45, expect: 45},
+	}
+
+	for _, wanted := range tt {
+		t.Run(wanted.desc, func(t *testing.T) {
+			_, cl, _, _ := setupClient()
+			cl.Listener = wanted.listener
+			cl.ProtocolVersion = wanted.version
+			cl.SetKeepalive(wanted.request)
+
+			s.assignKeepalive(cl)
+			require.Equal(t, wanted.expect, cl.Keepalive())
+		})
+	}
+}
+
+func TestServerEstablishConnectionServerKeepalive(t *testing.T) {
+	s := New()
+	s.settings["tcp"] = &listenerSettings{maxQos: 2, keepalive: 30}
 
 	r, w := net.Pipe()
 	o := make(chan error)
@@ -542,19 +1306,19 @@ func TestServerEstablishConnectionInheritSession(t *testing.T) {
 
 	go func() {
 		w.Write([]byte{
-			byte(packets.Connect << 4), 17, // Fixed header
+			byte(packets.Connect << 4), 18, // Fixed header
 			0, 4, // Protocol Name - MSB+LSB
 			'M', 'Q', 'T', 'T', // Protocol Name
-			4,     // Protocol Version
-			0,     // Packet Flags
+			5,     // Protocol Version
+			2,     // Packet Flags - clean session
 			0, 45, // Keepalive
+			0,    // Properties Length
 			0, 5, // Client ID - MSB+LSB
 			'm', 'o', 'c', 'h', 'i', // Client ID
 		})
 		w.Write([]byte{byte(packets.Disconnect << 4), 0})
 	}()
 
-	// Receive the Connack
 	recv := make(chan []byte)
 	go func() {
 		buf, err := ioutil.ReadAll(w)
@@ -564,36 +1328,19 @@ func TestServerEstablishConnectionInheritSession(t *testing.T) {
 		recv <- buf
 	}()
 
-	errx := <-o
-	require.ErrorIs(t, errx, ErrClientDisconnect)
-	require.Equal(t, []byte{
-		byte(packets.Connack << 4), 2,
-		1, packets.Accepted,
-	}, <-recv)
-
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
 	w.Close()
 
-	clw, ok := s.Clients.Get("mochi")
-	require.True(t, ok)
-	require.NotEmpty(t, clw.Subscriptions)
-
-	require.Equal(t, int64(0), s.bytepool.InUse())
-	require.Nil(t, clw.R)
-	require.Nil(t, clw.W)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 6,
+		0, packets.Accepted,
+		3, packets.PropServerKeepAlive, 0, 30, // Properties
+	}, <-recv)
 }
 
-func TestServerEstablishConnectionInheritExistingCleanSession(t *testing.T) {
+func TestServerEstablishConnectionKeepaliveTimeout(t *testing.T) {
 	s := New()
 
-	c, _ := net.Pipe()
-	cl := clients.NewClient(c, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
-	cl.ID = "mochi"
-	cl.CleanSession = true
-	cl.Subscriptions = map[string]byte{
-		"a/b/c": 1,
-	}
-	s.Clients.Add(cl)
-
 	r, w := net.Pipe()
 	o := make(chan error)
 	go func() {
@@ -605,167 +1352,327 @@ func TestServerEstablishConnectionInheritExistingCleanSession(t *testing.T) {
 			byte(packets.Connect << 4), 17, // Fixed header
 			0, 4, // Protocol Name - MSB+LSB
 			'M', 'Q', 'T', 'T', // Protocol Name
-			4,     // Protocol Version
-			0,     // Packet Flags
-			0, 45, // Keepalive
+			4,    // Protocol Version
+			2,    // Packet Flags - clean session
+			0, 1, // Keepalive
 			0, 5, // Client ID - MSB+LSB
 			'm', 'o', 'c', 'h', 'i', // Client ID
 		})
-		w.Write([]byte{byte(packets.Disconnect << 4), 0})
 	}()
 
-	// Receive the Connack
-	recv := make(chan []byte)
+	ack := make([]byte, 4)
+	_, err := io.ReadFull(w, ack)
+	require.NoError(t, err)
 	go func() {
-		buf, err := ioutil.ReadAll(w)
-		if err != nil {
-			panic(err)
-		}
-		recv <- buf
+		ioutil.ReadAll(w)
 	}()
 
-	errx := <-o
-	require.ErrorIs(t, errx, ErrClientDisconnect)
-	require.Equal(t, []byte{
-		byte(packets.Connack << 4),
-		2,
-		0, // no session present
-		packets.Accepted,
-	}, <-recv)
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	start := cl.LastActivity()
 
-	w.Close()
+	s.clearIdleConnections(start.Add(1400 * time.Millisecond))
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl.State.Done))
 
-	clw, ok := s.Clients.Get("mochi")
-	require.True(t, ok)
-	require.Empty(t, clw.Subscriptions)
-
-	require.Equal(t, int64(0), s.bytepool.InUse())
-	require.Nil(t, clw.R)
-	require.Nil(t, clw.W)
+	s.clearIdleConnections(start.Add(1600 * time.Millisecond))
+	err = <-o
+	require.ErrorIs(t, err, ErrKeepaliveTimeout)
+	w.Close()
 }
 
-func TestServerEstablishConnectionBadFixedHeader(t *testing.T) {
+func TestServerEstablishConnectionKeepaliveTimeoutV5(t *testing.T) {
 	s := New()
 
-	var hookE, hookD errorHook
-	s.Events.OnError = hookE.onError
-	s.Events.OnDisconnect = hookD.onError
-
 	r, w := net.Pipe()
+	o := make(chan error)
 	go func() {
-		w.Write([]byte{packets.Connect<<4 | 1<<1, 0x00, 0x00})
-		w.Close()
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
 	}()
 
-	err := s.EstablishConnection("tcp", r, new(auth.Allow))
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 18, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			5,    // Protocol Version
+			2,    // Packet Flags - clean session
+			0, 1, // Keepalive
+			0,    // Properties Length
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+	}()
 
-	r.Close()
-	require.Error(t, err)
-	require.ErrorIs(t, err, packets.ErrInvalidFlags)
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
 
-	require.Equal(t, err, hookE.err)
+	var cl *clients.Client
+	require.Eventually(t, func() bool {
+		var ok bool
+		cl, ok = s.Clients.Get("mochi")
+		return ok
+	}, time.Second, time.Millisecond)
 
-	// There was no disconnect error b/c connection failed.
-	require.Nil(t, hookD.err)
+	s.clearIdleConnections(cl.LastActivity().Add(1600 * time.Millisecond))
+	require.ErrorIs(t, <-o, ErrKeepaliveTimeout)
+	w.Close()
 
-	_, ok := s.Clients.Get("mochi")
-	require.False(t, ok)
-	require.Equal(t, int64(0), s.bytepool.InUse())
+	buf := <-recv
+	want := disconnectPacket(packets.CodeKeepAliveTimeout, "keepalive timeout")
+	require.Equal(t, want, buf[len(buf)-len(want):])
 }
 
-func TestServerEstablishConnectionInvalidPacket(t *testing.T) {
-	s := New()
+func TestServerEstablishConnectionHandshakeTimeout(t *testing.T) {
+	s := NewServer(&Options{
+		HandshakeTimeout: 5,
+	})
 
 	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
 
 	go func() {
-		w.Write([]byte{0, 0})
-		w.Close()
+		ioutil.ReadAll(w)
 	}()
 
-	err := s.EstablishConnection("tcp", r, new(auth.Allow))
-	r.Close()
+	var opened time.Time
+	require.Eventually(t, func() bool {
+		s.handshakesMu.Lock()
+		defer s.handshakesMu.Unlock()
+		for _, at := range s.handshakes {
+			opened = at
+		}
+		return len(s.handshakes) == 1
+	}, time.Second, time.Millisecond)
 
-	require.Error(t, err)
+	s.clearIdleConnections(opened.Add(4 * time.Second))
+	require.Len(t, s.handshakes, 1)
+
+	s.clearIdleConnections(opened.Add(6 * time.Second))
+	require.Error(t, <-o)
+	require.Empty(t, s.handshakes)
+	w.Close()
 }
 
-func TestServerEstablishConnectionNotConnectPacket(t *testing.T) {
+func TestServerEstablishConnectionHandshakeComplete(t *testing.T) {
 	s := New()
 
 	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
 
 	go func() {
-		w.Write([]byte{byte(packets.Connack << 4), 2, 0, packets.Accepted})
-		w.Close()
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,    // Protocol Version
+			2,    // Packet Flags - clean session
+			0, 0, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
 	}()
 
-	err := s.EstablishConnection("tcp", r, new(auth.Allow))
+	ack := make([]byte, 4)
+	_, err := io.ReadFull(w, ack)
+	require.NoError(t, err)
+	go func() {
+		ioutil.ReadAll(w)
+	}()
 
-	r.Close()
-	require.Error(t, err)
-	require.ErrorIs(t, err, ErrReadConnectInvalid)
+	require.Eventually(t, func() bool {
+		s.handshakesMu.Lock()
+		defer s.handshakesMu.Unlock()
+		return len(s.handshakes) == 0
+	}, time.Second, time.Millisecond)
 
-	_, ok := s.Clients.Get("mochi")
-	require.False(t, ok)
-	require.Equal(t, int64(0), s.bytepool.InUse())
+	// Neither the handshake timeout nor a keepalive of 0 close the connection.
+	s.clearIdleConnections(time.Now().Add(time.Hour))
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl.State.Done))
+
+	w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
 }
 
-func TestServerEstablishConnectionInvalidProtocols(t *testing.T) {
-	s := New()
+func TestServerEstablishConnectionPacketTooLarge(t *testing.T) {
+	s := NewServer(&Options{
+		MaxPacketSize: 32,
+	})
 
 	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
 
 	go func() {
 		w.Write([]byte{
-			byte(packets.Connect << 4), 17, // Fixed header
+			byte(packets.Connect << 4), 18, // Fixed header
 			0, 4, // Protocol Name - MSB+LSB
-			'M', 'Q', 'T', 'Y', // BAD Protocol Name
-			4,     // Protocol Version
-			0,     // Packet Flags
+			'M', 'Q', 'T', 'T', // Protocol Name
+			5,     // Protocol Version
+			2,     // Packet Flags - clean session
 			0, 45, // Keepalive
+			0,    // Properties Length
 			0, 5, // Client ID - MSB+LSB
 			'm', 'o', 'c', 'h', 'i', // Client ID
 		})
-		w.Close()
+		w.Write([]byte{byte(packets.Publish << 4), 40}) // 42 bytes in total.
 	}()
 
-	err := s.EstablishConnection("tcp", r, new(auth.Allow))
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
 
-	r.Close()
-	require.Error(t, err)
+	require.ErrorIs(t, <-o, packets.ErrPacketTooLarge)
+	w.Close()
 
-	_, ok := s.Clients.Get("mochi")
-	require.False(t, ok)
-	require.Equal(t, int64(0), s.bytepool.InUse())
+	require.Equal(t, append([]byte{
+		byte(packets.Connack << 4), 8,
+		0, packets.Accepted,
+		5, packets.PropMaximumPacketSize, 0, 0, 0, 32, // Properties
+	}, disconnectPacket(packets.CodePacketTooLarge, "packet too large")...), <-recv)
 }
 
-func TestServerEstablishConnectionBadAuth(t *testing.T) {
-	s := New()
+func TestServerEstablishConnectionSubscribeInvalidQos(t *testing.T) {
+	tt := []struct {
+		desc      string
+		connect   []byte
+		subscribe []byte
+		err       error
+		want      []byte
+	}{
+		{
+			desc: "v3",
+			connect: []byte{
+				byte(packets.Connect << 4), 17, // Fixed header
+				0, 4, // Protocol Name - MSB+LSB
+				'M', 'Q', 'T', 'T', // Protocol Name
+				4,     // Protocol Version
+				2,     // Packet Flags - clean session
+				0, 45, // Keepalive
+				0, 5, // Client ID - MSB+LSB
+				'm', 'o', 'c', 'h', 'i', // Client ID
+			},
+			subscribe: []byte{
+				byte(packets.Subscribe<<4) | 2, 20, // Fixed header
+				0, 10, // Packet ID - MSB+LSB
+				0, 3, 'a', '/', 'b', 1, // Filter and QoS 1
+				0, 3, 'c', '/', 'd', 3, // Filter and QoS 3
+				0, 3, 'e', '/', 'f', 0, // Filter and QoS 0
+			},
+			err: ErrClientDisconnect,
+			want: []byte{
+				byte(packets.Connack << 4), 2, 0, packets.Accepted,
+				byte(packets.Suback << 4), 5,
+				0, 10, // Packet ID
+				1, packets.ErrSubAckNetworkError, 0, // Return Codes
+			},
+		},
+		{
+			desc: "v5",
+			connect: []byte{
+				byte(packets.Connect << 4), 18, // Fixed header
+				0, 4, // Protocol Name - MSB+LSB
+				'M', 'Q', 'T', 'T', // Protocol Name
+				5,     // Protocol Version
+				2,     // Packet Flags - clean session
+				0, 45, // Keepalive
+				0,    // Properties Length
+				0, 5, // Client ID - MSB+LSB
+				'm', 'o', 'c', 'h', 'i', // Client ID
+			},
+			subscribe: []byte{
+				byte(packets.Subscribe<<4) | 2, 15, // Fixed header
+				0, 10, // Packet ID - MSB+LSB
+				0,                      // Properties Length
+				0, 3, 'a', '/', 'b', 1, // Filter and QoS 1
+				0, 3, 'c', '/', 'd', 3, // Filter and QoS 3
+			},
+			err: packets.ErrMalformedQoS,
+			want: append([]byte{
+				byte(packets.Connack << 4), 3, 0, packets.Accepted, 0,
+			}, disconnectPacket(packets.CodeProtocolError, "invalid subscription qos")...),
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := New()
+			r, w := net.Pipe()
+			o := make(chan error)
+			go func() {
+				o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+			}()
+
+			go func() {
+				w.Write(tx.connect)
+				w.Write(tx.subscribe)
+				time.Sleep(10 * time.Millisecond)
+				w.Write([]byte{byte(packets.Disconnect << 4), 0})
+			}()
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(w)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			require.ErrorIs(t, <-o, tx.err)
+			w.Close()
+			require.Equal(t, tx.want, <-recv)
+		})
+	}
+}
+
+func TestServerEstablishConnectionTopicAliasMaximum(t *testing.T) {
+	s := NewServer(&Options{
+		TopicAliasMaximum: 10,
+	})
 
 	r, w := net.Pipe()
 	o := make(chan error)
 	go func() {
-		o <- s.EstablishConnection("tcp", r, new(auth.Disallow))
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
 	}()
 
 	go func() {
 		w.Write([]byte{
-			byte(packets.Connect << 4), 30, // Fixed header
+			byte(packets.Connect << 4), 21, // Fixed header
 			0, 4, // Protocol Name - MSB+LSB
 			'M', 'Q', 'T', 'T', // Protocol Name
-			4,     // Protocol Version
-			194,   // Packet Flags
-			0, 20, // Keepalive
+			5,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			3, packets.PropTopicAliasMaximum, 0, 4, // Properties
 			0, 5, // Client ID - MSB+LSB
 			'm', 'o', 'c', 'h', 'i', // Client ID
-			0, 5, // Username MSB+LSB
-			'm', 'o', 'c', 'h', 'i',
-			0, 4, // Password MSB+LSB
-			'a', 'b', 'c', 'd',
 		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
 	}()
 
-	// Receive the Connack
 	recv := make(chan []byte)
 	go func() {
 		buf, err := ioutil.ReadAll(w)
@@ -775,22 +1682,24 @@ func TestServerEstablishConnectionBadAuth(t *testing.T) {
 		recv <- buf
 	}()
 
-	errx := <-o
-	time.Sleep(time.Millisecond)
-	r.Close()
-	require.ErrorIs(t, errx, ErrConnectionFailed)
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+
 	require.Equal(t, []byte{
-		byte(packets.Connack << 4), 2,
-		0, packets.CodeConnectBadAuthValues,
+		byte(packets.Connack << 4), 6,
+		0, packets.Accepted,
+		3, packets.PropTopicAliasMaximum, 0, 10, // Properties
 	}, <-recv)
-
-	_, ok := s.Clients.Get("mochi")
-	require.False(t, ok)
-	require.Equal(t, int64(0), s.bytepool.InUse())
 }
 
-func TestServerEstablishConnectionPromptSendLWT(t *testing.T) {
-	s := New()
+func TestServerEstablishConnectionAssignedClientID(t *testing.T) {
+	s := NewServer(&Options{
+		ClientIDGenerator: func() string {
+			return "gen-1"
+		},
+	})
+	store := mem.New()
+	s.Store = store
 
 	r, w := net.Pipe()
 	o := make(chan error)
@@ -800,38 +1709,54 @@ func TestServerEstablishConnectionPromptSendLWT(t *testing.T) {
 
 	go func() {
 		w.Write([]byte{
-			byte(packets.Connect << 4), 17, // Fixed header
+			byte(packets.Connect << 4), 18, // Fixed header
 			0, 4, // Protocol Name - MSB+LSB
 			'M', 'Q', 'T', 'T', // Protocol Name
-			4,     // Protocol Version
+			5,     // Protocol Version
 			2,     // Packet Flags - clean session
 			0, 45, // Keepalive
-			0, 5, // Client ID - MSB+LSB
-			'm', 'o', 'c', 'h', 'i', // Client ID,
+			5, packets.PropSessionExpiryInterval, 0, 0, 0, 60, // Properties
+			0, 0, // Client ID - MSB+LSB
 		})
-		w.Write([]byte{0, 0}) // invalid packet
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
 	}()
 
-	// Receive the Connack
+	recv := make(chan []byte)
 	go func() {
-		_, err := ioutil.ReadAll(w)
+		buf, err := ioutil.ReadAll(w)
 		if err != nil {
 			panic(err)
 		}
+		recv <- buf
 	}()
 
-	require.Error(t, <-o)
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
 
-	clw, ok := s.Clients.Get("mochi")
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 11,
+		0, packets.Accepted,
+		8, packets.PropAssignedClientID, 0, 5, 'g', 'e', 'n', '-', '1', // Properties
+	}, <-recv)
+
+	_, ok := s.Clients.Get("gen-1")
 	require.True(t, ok)
-	require.Equal(t, int64(0), s.bytepool.InUse())
-	require.Nil(t, clw.R)
-	require.Nil(t, clw.W)
+
+	stored, err := store.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	require.Equal(t, "gen-1", stored[0].ClientID)
+	require.Equal(t, "cl_gen-1", stored[0].ID)
 }
 
-func TestServerEstablishConnectionReadConnectionPacketErr(t *testing.T) {
+func TestServerEstablishConnectionAssignedClientIDV3(t *testing.T) {
 	s := New()
 
+	var id string
+	s.Events.OnConnect = func(cl events.Client, pk events.Packet) {
+		id = cl.ID
+	}
+
 	r, w := net.Pipe()
 	o := make(chan error)
 	go func() {
@@ -840,35 +1765,41 @@ func TestServerEstablishConnectionReadConnectionPacketErr(t *testing.T) {
 
 	go func() {
 		w.Write([]byte{
-			byte(packets.Connect << 4), 17, // Fixed header
+			byte(packets.Connect << 4), 12, // Fixed header
 			0, 4, // Protocol Name - MSB+LSB
 			'M', 'Q', 'T', 'T', // Protocol Name
 			4,     // Protocol Version
-			194,   // Packet Flags
-			0, 20, // Keepalive
-			0, 5, // Client ID - MSB+LSB
-			'm', 'o', 'c', 'h', 'i', // Client ID
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 0, // Client ID - MSB+LSB
 		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
 	}()
 
-	errx := <-o
-	time.Sleep(time.Millisecond)
-	r.Close()
-	require.Error(t, errx)
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
 
-	_, ok := s.Clients.Get("mochi")
-	require.False(t, ok)
-	require.Equal(t, int64(0), s.bytepool.InUse())
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+
+	// MQTT v3 clients are not told their assigned client id.
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.Accepted,
+	}, <-recv)
+
+	require.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", id)
 }
 
-// TestServerEstablishConnectionClearBuffersAfterUse ensures that the r/w buffers
-// for a client have been set to nil when the client disconnects so that they dont
-// leak (otherwise the reference to the buffers remains). We only need to check if
-// they are de-allocated if a connection is properly established - a client which
-// fails to connect isn't added to the server clients list at all and is abandoned,
-// so it can't leak buffers.
-func TestServerEstablishConnectionClearBuffersAfterUse(t *testing.T) {
-	s := New()
+func TestServerEstablishConnectionLogs(t *testing.T) {
+	l := new(testLogger)
+	s := NewServer(&Options{Logger: l})
 
 	r, w := net.Pipe()
 	o := make(chan error)
@@ -882,7 +1813,7 @@ func TestServerEstablishConnectionClearBuffersAfterUse(t *testing.T) {
 			0, 4, // Protocol Name - MSB+LSB
 			'M', 'Q', 'T', 'T', // Protocol Name
 			4,     // Protocol Version
-			0,     // Packet Flags
+			2,     // Packet Flags - clean session
 			0, 45, // Keepalive
 			0, 5, // Client ID - MSB+LSB
 			'm', 'o', 'c', 'h', 'i', // Client ID
@@ -890,97 +1821,6901 @@ func TestServerEstablishConnectionClearBuffersAfterUse(t *testing.T) {
 		w.Write([]byte{byte(packets.Disconnect << 4), 0})
 	}()
 
-	// Receive the Connack
-	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(w)
-		if err != nil {
-			panic(err)
-		}
-		recv <- buf
+		_, _ = ioutil.ReadAll(w)
 	}()
 
-	errx := <-o
-	require.Equal(t, int64(0), s.bytepool.InUse()) // ensure the buffers have been returned to pool.
-	require.ErrorIs(t, errx, ErrClientDisconnect)
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
 	w.Close()
 
-	time.Sleep(time.Millisecond * 100)
+	lg, ok := l.find("client connected")
+	require.True(t, ok)
+	require.Equal(t, "info", lg.level)
+	require.Equal(t, "mochi", lg.kv[logger.KeyClientID])
+	require.Equal(t, "tcp", lg.kv[logger.KeyListener])
+	require.Contains(t, lg.kv, logger.KeyRemoteAddr)
 
-	clw, ok := s.Clients.Get("mochi")
+	lg, ok = l.find("client disconnected")
 	require.True(t, ok)
-	require.NotNil(t, clw)
-	require.Equal(t, int64(0), s.bytepool.InUse())
-	require.Nil(t, clw.R)
-	require.Nil(t, clw.W)
+	require.Equal(t, "mochi", lg.kv[logger.KeyClientID])
+	require.ErrorIs(t, lg.kv[logger.KeyError].(error), ErrClientDisconnect)
 }
 
-func TestServerWriteClient(t *testing.T) {
-	s, cl, r, w := setupClient()
-	cl.ID = "mochi"
+func TestServerEstablishConnectionPacketTooLargeV4(t *testing.T) {
+	s := NewServer(&Options{
+		MaxPacketSize: 32,
+	})
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Publish << 4), 40})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	require.ErrorIs(t, <-o, packets.ErrPacketTooLarge)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.Accepted,
+	}, <-recv)
+}
+
+func TestServerEstablishConnectionOKCleanSession(t *testing.T) {
+	s := New()
+
+	// Existing connection with subscription.
+	c, _ := net.Pipe()
+	cl := clients.NewClient(c, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
+	cl.ID = "mochi"
+	cl.Subscriptions = map[string]byte{
+		"a/b/c": 1,
+	}
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 0)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	// Receive the Connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.Accepted,
+	}, <-recv)
+
+	w.Close()
+
+	cl.Stop(nil)
+	cl.ClearBuffers()
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+	require.Empty(t, s.Topics.Subscribers("a/b/c"))
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+func TestServerEventOnConnect(t *testing.T) {
+	r, w := net.Pipe()
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+
+	var hook packetHook
+	s.Events.OnConnect = hook.onConnect
+
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	// Receive the Connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.Accepted,
+	}, <-recv)
+
+	w.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	require.Equal(t, events.Client{
+		ID:           "mochi",
+		Remote:       "pipe",
+		Listener:     "tcp",
+		CleanSession: true,
+	}, hook.client)
+
+	require.Equal(t, events.Packet(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:      packets.Connect,
+			Remaining: 17,
+		},
+		ProtocolName:     []byte{'M', 'Q', 'T', 'T'},
+		ProtocolVersion:  4,
+		CleanSession:     true,
+		Keepalive:        45,
+		ClientIdentifier: "mochi",
+	}), hook.packet)
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+
+	require.Equal(t, int64(0), s.bytepool.InUse())
+
+}
+
+func TestServerEventOnDisconnect(t *testing.T) {
+	r, w := net.Pipe()
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+
+	var hook errorHook
+	s.Events.OnDisconnect = hook.onError
+
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	// Receive the Connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.Accepted,
+	}, <-recv)
+
+	w.Close()
+
+	require.Equal(t, events.Client{
+		ID:           "mochi",
+		Remote:       "pipe",
+		Listener:     "tcp",
+		CleanSession: true,
+	}, hook.client)
+
+	require.ErrorIs(t, ErrClientDisconnect, hook.err)
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+func TestServerEventOnDisconnectOnError(t *testing.T) {
+	r, w := net.Pipe()
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+
+	s.Events.OnError = func(cl events.Client, err error) {
+		// Do not allow
+		panic(fmt.Errorf("unreachable error"))
+	}
+
+	var hook errorHook
+	s.Events.OnDisconnect = hook.onError
+
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+
+		w.Write([]byte{0, 0})
+	}()
+
+	// Receive the Connack
+	go func() {
+		_, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	errx := <-o
+	require.Error(t, errx)
+	require.Equal(t, "No valid packet available; 0", errx.Error())
+	require.Equal(t, errx, hook.err)
+
+	require.Equal(t, events.Client{
+		ID:           "mochi",
+		Remote:       "pipe",
+		Listener:     "tcp",
+		CleanSession: true,
+	}, hook.client)
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+func TestServerEstablishConnectionInheritSession(t *testing.T) {
+	s := New()
+
+	c, _ := net.Pipe()
+	cl := clients.NewClient(c, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
+	cl.ID = "mochi"
+	cl.SessionExpiryInterval = clients.SessionExpiryNever
+	cl.Subscriptions = map[string]byte{
+		"a/b/c": 1,
+	}
+	s.Clients.Add(cl)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			0,     // Packet Flags
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	// Receive the Connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		1, packets.Accepted,
+	}, <-recv)
+
+	w.Close()
+
+	clw, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.NotEmpty(t, clw.Subscriptions)
+
+	require.Equal(t, int64(0), s.bytepool.InUse())
+	require.Nil(t, clw.R)
+	require.Nil(t, clw.W)
+}
+
+// connectMochi writes a clean session connect for the client mochi to w, and
+// returns a channel which receives everything the server sends to it.
+func connectMochi(w net.Conn) chan []byte {
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+	}()
+
+	recv := make(chan []byte, 1)
+	go func() {
+		buf, _ := ioutil.ReadAll(w)
+		recv <- buf
+	}()
+
+	return recv
+}
+
+func TestServerEstablishConnectionTakeover(t *testing.T) {
+	s := New()
+	existing, r1, w1 := setupServerClient(s)
+	existing.ProtocolVersion = 5
+	s.Clients.Add(existing)
+
+	recv1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		recv1 <- buf
+	}()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+	recv := connectMochi(w)
+
+	require.Eventually(t, func() bool {
+		cl, ok := s.Clients.Get("mochi")
+		return ok && cl != existing
+	}, time.Second, time.Millisecond)
+	require.ErrorIs(t, existing.StopCause(), ErrSessionReestablished)
+	w1.Close()
+
+	require.Equal(t, disconnectPacket(packets.CodeSessionTakenOver, "session taken over by another connection"), <-recv1)
+
+	w.Close()
+	require.Error(t, <-o)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.Accepted,
+	}, <-recv)
+}
+
+func TestServerEstablishConnectionRejectNew(t *testing.T) {
+	s := NewServer(&Options{
+		ClientIDConflict: ClientIDRejectNew,
+	})
+	existing, _, _ := setupServerClient(s)
+	s.Clients.Add(existing)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+	recv := connectMochi(w)
+
+	require.ErrorIs(t, <-o, ErrClientIDInUse)
+	w.Close()
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.CodeConnectBadClientID,
+	}, <-recv)
+
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Equal(t, existing, cl)
+	require.Equal(t, uint32(0), atomic.LoadUint32(&existing.State.Done))
+}
+
+func TestServerEstablishConnectionRejectNewDisconnected(t *testing.T) {
+	s := NewServer(&Options{
+		ClientIDConflict: ClientIDRejectNew,
+	})
+	existing := clients.NewClientStub(s.System)
+	existing.ID = "mochi"
+	s.Clients.Add(existing)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+	recv := connectMochi(w)
+
+	require.Eventually(t, func() bool {
+		cl, ok := s.Clients.Get("mochi")
+		return ok && cl != existing
+	}, time.Second, time.Millisecond)
+
+	w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.Accepted,
+	}, <-recv)
+}
+
+func TestServerEstablishConnectionTakeoverRace(t *testing.T) {
+	s := New()
+
+	const n = 16
+	conns := make([]net.Conn, n)
+	o := make(chan error, n)
+	for i := 0; i < n; i++ {
+		r, w := net.Pipe()
+		conns[i] = w
+		go func() {
+			o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+		}()
+		connectMochi(w)
+	}
+
+	// Every connection but the last to take over is disconnected, and the last
+	// is the client known to the server.
+	for i := 0; i < n-1; i++ {
+		select {
+		case err := <-o:
+			require.ErrorIs(t, err, ErrSessionReestablished)
+		case <-time.After(time.Second):
+			t.Fatal("connection was not taken over")
+		}
+	}
+
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl.State.Done))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.ClientsConnected))
+
+	for _, w := range conns {
+		w.Close()
+	}
+	require.Error(t, <-o)
+}
+
+func TestServerEstablishConnectionInheritExistingCleanSession(t *testing.T) {
+	s := New()
+
+	c, _ := net.Pipe()
+	cl := clients.NewClient(c, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
+	cl.ID = "mochi"
+	cl.CleanSession = true
+	cl.Subscriptions = map[string]byte{
+		"a/b/c": 1,
+	}
+	s.Clients.Add(cl)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			0,     // Packet Flags
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	// Receive the Connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4),
+		2,
+		0, // no session present
+		packets.Accepted,
+	}, <-recv)
+
+	w.Close()
+
+	clw, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Empty(t, clw.Subscriptions)
+
+	require.Equal(t, int64(0), s.bytepool.InUse())
+	require.Nil(t, clw.R)
+	require.Nil(t, clw.W)
+}
+
+// storedSession writes a persistent session for the client mochi, with one
+// subscription and one unacknowledged inflight message, to a store.
+func storedSession(t *testing.T) *mem.Store {
+	store := mem.New()
+	require.NoError(t, store.WriteClient(persistence.Client{
+		ID:                    "cl_mochi",
+		ClientID:              "mochi",
+		T:                     persistence.KClient,
+		Listener:              "tcp",
+		SessionExpiryInterval: clients.SessionExpiryNever,
+	}))
+	require.NoError(t, store.WriteSubscription(persistence.Subscription{
+		ID:     "sub_mochi:a/b/c",
+		T:      persistence.KSubscription,
+		Client: "mochi",
+		Filter: "a/b/c",
+		QoS:    1,
+	}))
+	require.NoError(t, store.WriteInflight(persistence.Message{
+		ID:     "if_mochi_1",
+		T:      persistence.KInflight,
+		Client: "mochi",
+		FixedHeader: persistence.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		PacketID:  1,
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+		Sent:      time.Now().Unix(),
+	}))
+	return store
+}
+
+// connectStored connects the client mochi to a server with the given connect
+// flags, disconnects it, and returns everything the server sent to it.
+func connectStored(t *testing.T, s *Server, flags byte) []byte {
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			flags, // Packet Flags
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+	return <-recv
+}
+
+func TestServerEstablishConnectionCleanStartDeletesStoredSession(t *testing.T) {
+	s := New()
+	store := storedSession(t)
+	s.Store = store
+	require.NoError(t, s.readStore())
+
+	buf := connectStored(t, s, 2) // clean session
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, // no session present
+		packets.Accepted,
+	}, buf)
+	require.Empty(t, s.Topics.Subscribers("a/b/c"))
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+
+	cls, err := store.ReadClients()
+	require.NoError(t, err)
+	require.Empty(t, cls)
+
+	subs, err := store.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	msgs, err := store.ReadInflight()
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestServerEstablishConnectionResumeStoredSession(t *testing.T) {
+	s := New()
+	store := storedSession(t)
+	s.Store = store
+	require.NoError(t, s.readStore())
+
+	buf := connectStored(t, s, 0)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		1, // session present
+		packets.Accepted,
+		byte(packets.Publish<<4 | 1<<3 | 1<<1), 14, // resent inflight, dup qos 1
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		0, 1,
+		'h', 'e', 'l', 'l', 'o',
+	}, buf)
+
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Contains(t, cl.Subscriptions, "a/b/c")
+	require.NotEmpty(t, s.Topics.Subscribers("a/b/c"))
+
+	subs, err := store.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	msgs, err := store.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+}
+
+func TestServerResumeStoredResponseProperties(t *testing.T) {
+	s, cl1, _, _ := setupClient()
+	store := mem.New()
+	s.Store = store
+	cl1.ProtocolVersion = 5
+	cl1.Listener = "tcp"
+	cl1.SessionExpiryInterval = clients.SessionExpiryNever
+	s.Clients.Add(cl1)
+	s.storeClient(cl1)
+	s.Topics.Subscribe("a/b/c", cl1.ID, 1)
+	cl1.NoteSubscription("a/b/c", 1)
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "zen"
+	cl2.ProtocolVersion = 5
+
+	err := s.processPublish(cl2, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    1,
+			Retain: true,
+		},
+		Properties: packets.Properties{
+			ResponseTopic:   "reply/zen",
+			CorrelationData: []byte("req-1"),
+		},
+		PacketID:  7,
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+	require.NoError(t, err)
+
+	// The retained message and the inflight message are restored with their
+	// response topic and correlation data after a restart.
+	s = New()
+	s.Store = store
+	require.NoError(t, s.readStore())
+
+	retained := s.Topics.Messages("a/b/c")
+	require.Len(t, retained, 1)
+	require.Equal(t, "reply/zen", retained[0].Properties.ResponseTopic)
+	require.Equal(t, []byte("req-1"), retained[0].Properties.CorrelationData)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 18, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			5,     // Protocol Version
+			0,     // Packet Flags
+			0, 45, // Keepalive
+			0,    // Properties length
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+
+	// The resent inflight message carries the original properties.
+	buf := <-recv
+	require.True(t, bytes.Contains(buf, append([]byte{packets.PropResponseTopic, 0, 9}, "reply/zen"...)))
+	require.True(t, bytes.Contains(buf, append([]byte{packets.PropCorrelationData, 0, 5}, "req-1"...)))
+}
+
+// setupQos2Session returns a server with an in-memory store and a stored
+// session for mochi, which is subscribed to a/b/c at qos 2.
+func setupQos2Session() (*Server, *mem.Store, *clients.Client, net.Conn) {
+	s := New()
+	store := mem.New()
+	s.Store = store
+	cl, r, _ := setupServerClient(s)
+	cl.Listener = "tcp"
+	cl.SessionExpiryInterval = clients.SessionExpiryNever
+	s.Clients.Add(cl)
+	s.storeClient(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 2)
+	cl.NoteSubscription("a/b/c", 2)
+	return s, store, cl, r
+}
+
+// restartStore returns a new server which has loaded the state of a store, as
+// if the server had crashed and been restarted.
+func restartStore(t *testing.T, store persistence.Store) *Server {
+	s := New()
+	s.Store = store
+	require.NoError(t, s.readStore())
+	return s
+}
+
+func TestServerRestoredPacketIDs(t *testing.T) {
+	s := New()
+	s.Store = storedSession(t)
+	require.NoError(t, s.readStore())
+
+	// The packet id of the restored inflight message is not reused.
+	s.publishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("again"),
+	})
+
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	in, ok := cl.Inflight.Get(1)
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), in.Packet.Payload)
+	in, ok = cl.Inflight.Get(2)
+	require.True(t, ok)
+	require.Equal(t, []byte("again"), in.Packet.Payload)
+}
+
+func TestServerQos2RestartOutbound(t *testing.T) {
+	publish := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  2,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+
+	tt := []struct {
+		desc   string
+		acks   []byte
+		phase  byte
+		stored bool
+		resend []byte
+	}{
+		{
+			desc:   "crash before pubrec",
+			stored: true,
+			phase:  persistence.PhasePublish,
+			resend: []byte{byte(packets.Publish<<4) | 2<<1 | 8, 14, 0, 5, 'a', '/', 'b', '/', 'c', 0, 1, 'h', 'e', 'l', 'l', 'o'},
+		},
+		{
+			desc:   "crash after pubrec",
+			acks:   []byte{packets.Pubrec},
+			stored: true,
+			phase:  persistence.PhaseRelease,
+			resend: []byte{byte(packets.Pubrel<<4) | 2, 2, 0, 1},
+		},
+		{
+			desc: "crash after pubcomp",
+			acks: []byte{packets.Pubrec, packets.Pubcomp},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s, store, cl, _ := setupQos2Session()
+			s.publishToSubscribers(publish)
+			for _, ack := range tx.acks {
+				require.NoError(t, s.processPacket(cl, packets.Packet{
+					FixedHeader: packets.FixedHeader{Type: ack},
+					PacketID:    1,
+				}))
+			}
+
+			msgs, err := store.ReadInflightForClient("mochi")
+			require.NoError(t, err)
+			if !tx.stored {
+				require.Len(t, msgs, 0)
+			} else {
+				require.Len(t, msgs, 1)
+				require.Equal(t, tx.phase, msgs[0].Phase)
+			}
+
+			s = restartStore(t, store)
+			buf := connectStored(t, s, 0)
+			connack := []byte{byte(packets.Connack << 4), 2, 1, packets.Accepted}
+			require.Equal(t, append(connack, tx.resend...), buf)
+		})
+	}
+}
+
+func TestServerQos2RestartInbound(t *testing.T) {
+	publish := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  2,
+		},
+		PacketID:  7,
+		TopicName: "x/y",
+		Payload:   []byte("hello"),
+	}
+
+	s, store, cl, _ := setupQos2Session()
+	require.NoError(t, s.processPacket(cl, publish))
+
+	msgs, err := store.ReadInflightForClient("mochi")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "in_mochi_7", msgs[0].ID)
+	require.Equal(t, persistence.PhaseReceived, msgs[0].Phase)
+
+	// After a crash before the pubrel, the client resends the publish to the
+	// restarted server, which acknowledges it without delivering it again.
+	s = restartStore(t, store)
+	var delivered int
+	s.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		delivered++
+		return pk, nil
+	}
+
+	cl, r, w := setupServerClient(s)
+	require.True(t, s.inheritClientSession(packets.Packet{ClientIdentifier: "mochi"}, cl))
+	s.Clients.Add(cl)
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	publish.FixedHeader.Dup = true
+	require.NoError(t, s.processPacket(cl, publish))
+	require.Equal(t, 0, delivered)
+
+	require.NoError(t, s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1},
+		PacketID:    7,
+	}))
+	require.False(t, cl.InboundQos2Pending(7))
+
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	require.Equal(t, []byte{
+		byte(packets.Pubrec << 4), 2, 0, 7,
+		byte(packets.Pubcomp << 4), 2, 0, 7,
+	}, <-recv)
+
+	// After a crash following the pubrel, the packet id may be used for a
+	// new message, which is delivered.
+	msgs, err = store.ReadInflightForClient("mochi")
+	require.NoError(t, err)
+	require.Len(t, msgs, 0)
+
+	s = restartStore(t, store)
+	s.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		delivered++
+		return pk, nil
+	}
+	cl, _, _ = setupServerClient(s)
+	require.True(t, s.inheritClientSession(packets.Packet{ClientIdentifier: "mochi"}, cl))
+	publish.FixedHeader.Dup = false
+	require.NoError(t, s.processPacket(cl, publish))
+	require.Equal(t, 1, delivered)
+}
+
+func TestServerEstablishConnectionNoStoredSession(t *testing.T) {
+	s := New()
+	s.Store = mem.New()
+
+	buf := connectStored(t, s, 0)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, // no session present
+		packets.Accepted,
+	}, buf)
+}
+
+func TestServerEstablishConnectionBadFixedHeader(t *testing.T) {
+	s := New()
+
+	var hookE, hookD errorHook
+	s.Events.OnError = hookE.onError
+	s.Events.OnDisconnect = hookD.onError
+
+	r, w := net.Pipe()
+	go func() {
+		w.Write([]byte{packets.Connect<<4 | 1<<1, 0x00, 0x00})
+		w.Close()
+	}()
+
+	err := s.EstablishConnection("tcp", r, new(auth.Allow))
+
+	r.Close()
+	require.Error(t, err)
+	require.ErrorIs(t, err, packets.ErrInvalidFlags)
+
+	require.Equal(t, err, hookE.err)
+
+	// There was no disconnect error b/c connection failed.
+	require.Nil(t, hookD.err)
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+func TestServerEstablishConnectionInvalidPacket(t *testing.T) {
+	s := New()
+
+	r, w := net.Pipe()
+
+	go func() {
+		w.Write([]byte{0, 0})
+		w.Close()
+	}()
+
+	err := s.EstablishConnection("tcp", r, new(auth.Allow))
+	r.Close()
+
+	require.Error(t, err)
+}
+
+func TestServerEstablishConnectionNotConnectPacket(t *testing.T) {
+	s := New()
+
+	r, w := net.Pipe()
+
+	go func() {
+		w.Write([]byte{byte(packets.Connack << 4), 2, 0, packets.Accepted})
+		w.Close()
+	}()
+
+	err := s.EstablishConnection("tcp", r, new(auth.Allow))
+
+	r.Close()
+	require.Error(t, err)
+	require.ErrorIs(t, err, ErrReadConnectInvalid)
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+func TestServerEstablishConnectionInvalidProtocols(t *testing.T) {
+	s := New()
+
+	r, w := net.Pipe()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'Y', // BAD Protocol Name
+			4,     // Protocol Version
+			0,     // Packet Flags
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Close()
+	}()
+
+	err := s.EstablishConnection("tcp", r, new(auth.Allow))
+
+	r.Close()
+	require.Error(t, err)
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+func TestServerEstablishConnectionBadAuth(t *testing.T) {
+	s := New()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Disallow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 30, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			194,   // Packet Flags
+			0, 20, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+			0, 5, // Username MSB+LSB
+			'm', 'o', 'c', 'h', 'i',
+			0, 4, // Password MSB+LSB
+			'a', 'b', 'c', 'd',
+		})
+	}()
+
+	// Receive the Connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	time.Sleep(time.Millisecond)
+	r.Close()
+	require.ErrorIs(t, errx, ErrConnectionFailed)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.CodeConnectBadAuthValues,
+	}, <-recv)
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+func TestServerEstablishConnectionDefaultAuth(t *testing.T) {
+	s := NewServer(&Options{
+		Auth: new(auth.Disallow),
+	})
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, nil)
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	time.Sleep(time.Millisecond)
+	r.Close()
+	require.ErrorIs(t, errx, ErrConnectionFailed)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.CodeConnectBadAuthValues,
+	}, <-recv)
+}
+
+func TestServerEstablishConnectionAllowAnonymous(t *testing.T) {
+	s := NewServer(&Options{
+		AllowAnonymous: true,
+	})
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Disallow))
+	}()
+	recv := connectMochi(w)
+
+	var cl *clients.Client
+	require.Eventually(t, func() bool {
+		var ok bool
+		cl, ok = s.Clients.Get("mochi")
+		return ok
+	}, time.Second, time.Millisecond)
+
+	// The anonymous client is still subject to the controller's ACL checks.
+	require.False(t, cl.AC.ACL(cl.Username, "a/b/c", true))
+
+	w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.Accepted,
+	}, <-recv)
+}
+
+func TestServerEstablishConnectionAllowAnonymousUsername(t *testing.T) {
+	s := NewServer(&Options{
+		AllowAnonymous: true,
+	})
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, nil) // no auth controller disallows all.
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 30, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			194,   // Packet Flags
+			0, 20, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+			0, 5, // Username MSB+LSB
+			'm', 'o', 'c', 'h', 'i',
+			0, 4, // Password MSB+LSB
+			'a', 'b', 'c', 'd',
+		})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	time.Sleep(time.Millisecond)
+	r.Close()
+	require.ErrorIs(t, errx, ErrConnectionFailed)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.CodeConnectBadAuthValues,
+	}, <-recv)
+}
+
+func TestServerSetClientIDFilter(t *testing.T) {
+	s := New()
+	require.True(t, s.clientIDAllowed("mochi"))
+
+	require.NoError(t, s.SetClientIDFilter(ClientIDFilter{
+		Allow: []string{"sensor-*", "/^dev-[0-9]+$/", "a?c"},
+		Deny:  []string{"sensor-old-*", "dev-13"},
+	}))
+
+	tt := []struct {
+		id    string
+		allow bool
+	}{
+		{"sensor-1", true},
+		{"sensor-a/b", true},
+		{"sensor-old-1", false},
+		{"xsensor-1", false},
+		{"dev-12", true},
+		{"dev-13", false},
+		{"dev-1a", false},
+		{"abc", true},
+		{"abbc", false},
+		{"a.c", true},
+		{"mochi", false},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.allow, s.clientIDAllowed(tx.id), tx.id)
+	}
+
+	err := s.SetClientIDFilter(ClientIDFilter{Deny: []string{"/[/"}})
+	require.ErrorIs(t, err, ErrInvalidClientIDPattern)
+	require.True(t, s.clientIDAllowed("sensor-1"), "existing filter is kept")
+
+	require.NoError(t, s.SetClientIDFilter(ClientIDFilter{}))
+	require.True(t, s.clientIDAllowed("mochi"))
+}
+
+func TestServerClientIDFilterGlobMeta(t *testing.T) {
+	s := New()
+	require.NoError(t, s.SetClientIDFilter(ClientIDFilter{Deny: []string{"a.b+*"}}))
+	require.False(t, s.clientIDAllowed("a.b+c"))
+	require.True(t, s.clientIDAllowed("axbbc"))
+}
+
+func TestServerClientIDFilterInvalidOption(t *testing.T) {
+	l := new(testLogger)
+	s := NewServer(&Options{
+		Logger: l,
+		ClientIDFilter: ClientIDFilter{
+			Deny: []string{"/(/"},
+		},
+	})
+
+	require.False(t, s.clientIDAllowed("mochi"))
+	_, ok := l.find("invalid client id filter, denying all clients")
+	require.True(t, ok)
+
+	require.NoError(t, s.SetClientIDFilter(ClientIDFilter{}))
+	require.True(t, s.clientIDAllowed("mochi"))
+}
+
+func TestServerEstablishConnectionClientIDRejected(t *testing.T) {
+	tt := []struct {
+		desc    string
+		connect []byte
+		want    []byte
+	}{
+		{
+			desc: "v3",
+			connect: []byte{
+				byte(packets.Connect << 4), 17, // Fixed header
+				0, 4, // Protocol Name - MSB+LSB
+				'M', 'Q', 'T', 'T', // Protocol Name
+				4,     // Protocol Version
+				2,     // Packet Flags - clean session
+				0, 45, // Keepalive
+				0, 5, // Client ID - MSB+LSB
+				'm', 'o', 'c', 'h', 'i', // Client ID
+			},
+			want: []byte{byte(packets.Connack << 4), 2, 0, packets.CodeConnectBadClientID},
+		},
+		{
+			desc: "v5",
+			connect: []byte{
+				byte(packets.Connect << 4), 18, // Fixed header
+				0, 4, // Protocol Name - MSB+LSB
+				'M', 'Q', 'T', 'T', // Protocol Name
+				5,     // Protocol Version
+				2,     // Packet Flags - clean session
+				0, 45, // Keepalive
+				0,    // Properties Length
+				0, 5, // Client ID - MSB+LSB
+				'm', 'o', 'c', 'h', 'i', // Client ID
+			},
+			want: []byte{byte(packets.Connack << 4), 3, 0, packets.CodeClientIDNotValid, 0},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := NewServer(&Options{
+				ClientIDFilter: ClientIDFilter{Deny: []string{"mo*"}},
+			})
+
+			r, w := net.Pipe()
+			o := make(chan error)
+			go func() {
+				o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+			}()
+
+			go func() {
+				w.Write(tx.connect)
+			}()
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(w)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			errx := <-o
+			time.Sleep(time.Millisecond)
+			r.Close()
+			require.ErrorIs(t, errx, ErrClientIDRejected)
+			require.Equal(t, tx.want, <-recv)
+		})
+	}
+}
+
+func TestServerEstablishConnectionClientIDInvalid(t *testing.T) {
+	tt := []struct {
+		desc    string
+		connect []byte
+		want    []byte
+	}{
+		{
+			desc: "v3",
+			connect: []byte{
+				byte(packets.Connect << 4), 17, // Fixed header
+				0, 4, // Protocol Name - MSB+LSB
+				'M', 'Q', 'T', 'T', // Protocol Name
+				4,     // Protocol Version
+				2,     // Packet Flags - clean session
+				0, 45, // Keepalive
+				0, 5, // Client ID - MSB+LSB
+				'm', 'o', 'c', 'h', 'i', // Client ID
+			},
+			want: []byte{byte(packets.Connack << 4), 2, 0, packets.CodeConnectBadClientID},
+		},
+		{
+			desc: "v5",
+			connect: []byte{
+				byte(packets.Connect << 4), 18, // Fixed header
+				0, 4, // Protocol Name - MSB+LSB
+				'M', 'Q', 'T', 'T', // Protocol Name
+				5,     // Protocol Version
+				2,     // Packet Flags - clean session
+				0, 45, // Keepalive
+				0,    // Properties Length
+				0, 5, // Client ID - MSB+LSB
+				'm', 'o', 'c', 'h', 'i', // Client ID
+			},
+			want: []byte{byte(packets.Connack << 4), 3, 0, packets.CodeClientIDNotValid, 0},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := New()
+			require.NoError(t, s.AddListener(listeners.NewMockListener("tcp", ":1882"), &listeners.Config{
+				Auth:              new(auth.Allow),
+				MaxClientIDLength: 4,
+			}))
+
+			r, w := net.Pipe()
+			o := make(chan error)
+			go func() {
+				o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+			}()
+
+			go func() {
+				w.Write(tx.connect)
+			}()
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(w)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			errx := <-o
+			time.Sleep(time.Millisecond)
+			r.Close()
+			require.ErrorIs(t, errx, ErrClientIDInvalid)
+			require.Equal(t, tx.want, <-recv)
+			require.Equal(t, 0, s.Clients.Len())
+		})
+	}
+}
+
+func TestServerEstablishConnectionStrictClientIDAssigned(t *testing.T) {
+	s := New()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("tcp", ":1882"), &listeners.Config{
+		Auth:           new(auth.Allow),
+		StrictClientID: true,
+	}))
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 12, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 0, // Client ID - MSB+LSB
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+	w.Close()
+	require.Equal(t, []byte{byte(packets.Connack << 4), 2, 0, packets.Accepted}, <-recv)
+}
+
+func TestServerEstablishConnectionReadTimeout(t *testing.T) {
+	log := new(testLogger)
+	s := NewServer(&Options{Logger: log})
+	require.NoError(t, s.AddListener(listeners.NewMockListener("tcp", ":1882"), &listeners.Config{
+		Auth:        new(auth.Allow),
+		ReadTimeout: 20 * time.Millisecond,
+	}))
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrReadTimeout)
+	w.Close()
+	require.Equal(t, []byte{byte(packets.Connack << 4), 2, 0, packets.Accepted}, <-recv)
+
+	lg, ok := log.find("client connection timed out")
+	require.True(t, ok)
+	require.Equal(t, "warn", lg.level)
+	require.Equal(t, "mochi", lg.kv[logger.KeyClientID])
+}
+
+// willConnect returns a CONNECT packet for the client id mochi with a will
+// message on a topic.
+func willConnect(version byte, topic string) []byte {
+	b := []byte{
+		0, 4, // Protocol Name - MSB+LSB
+		'M', 'Q', 'T', 'T', // Protocol Name
+		version,     // Protocol Version
+		0x02 | 0x04, // Packet Flags - clean session, will flag
+		0, 45,       // Keepalive
+	}
+	if version == 5 {
+		b = append(b, 0) // Properties Length
+	}
+	b = append(b, 0, 5, 'm', 'o', 'c', 'h', 'i') // Client ID
+	if version == 5 {
+		b = append(b, 0) // Will Properties Length
+	}
+	b = append(b, 0, byte(len(topic)))
+	b = append(b, topic...)
+	b = append(b, 0, 2, 'h', 'i') // Will Message
+
+	return append([]byte{byte(packets.Connect << 4), byte(len(b))}, b...)
+}
+
+func TestServerEstablishConnectionWillACL(t *testing.T) {
+	tt := []struct {
+		desc    string
+		version byte
+		topic   string
+		check   bool
+		err     error
+		want    []byte
+	}{
+		{
+			desc:    "forbidden v3",
+			version: 4,
+			topic:   "secret",
+			check:   true,
+			err:     ErrWillNotAuthorized,
+			want:    []byte{byte(packets.Connack << 4), 2, 0, packets.CodeConnectNotAuthorised},
+		},
+		{
+			desc:    "forbidden v5",
+			version: 5,
+			topic:   "secret",
+			check:   true,
+			err:     ErrWillNotAuthorized,
+			want:    []byte{byte(packets.Connack << 4), 3, 0, packets.CodeNotAuthorized, 0},
+		},
+		{
+			desc:    "check failed v3",
+			version: 4,
+			topic:   "down",
+			check:   true,
+			err:     ErrACLCheckFailed,
+			want:    []byte{byte(packets.Connack << 4), 2, 0, packets.CodeConnectServerUnavailable},
+		},
+		{
+			desc:    "check failed v5",
+			version: 5,
+			topic:   "down",
+			check:   true,
+			err:     ErrACLCheckFailed,
+			want:    []byte{byte(packets.Connack << 4), 3, 0, packets.CodeServerUnavailable, 0},
+		},
+		{
+			desc:    "allowed",
+			version: 4,
+			topic:   "a/b",
+			check:   true,
+			want:    []byte{byte(packets.Connack << 4), 2, 0, packets.Accepted},
+		},
+		{
+			desc:    "not checked",
+			version: 4,
+			topic:   "secret",
+			want:    []byte{byte(packets.Connack << 4), 2, 0, packets.Accepted},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := NewServer(&Options{CheckWillACL: tx.check})
+			var reported error
+			s.Events.OnError = func(cl events.Client, err error) {
+				reported = err
+			}
+
+			r, w := net.Pipe()
+			o := make(chan error)
+			go func() {
+				o <- s.EstablishConnection("tcp", r, &denyAuth{topic: "secret"})
+			}()
+
+			go func() {
+				w.Write(willConnect(tx.version, tx.topic))
+			}()
+
+			recv := make(chan []byte)
+			go func() {
+				buf := make([]byte, len(tx.want))
+				_, err := io.ReadFull(w, buf)
+				require.NoError(t, err)
+				recv <- buf
+			}()
+
+			require.Equal(t, tx.want, <-recv)
+			if tx.err == nil {
+				w.Close()
+				<-o
+				return
+			}
+
+			require.ErrorIs(t, <-o, tx.err)
+			require.ErrorIs(t, reported, tx.err)
+			_, ok := s.Clients.Get("mochi")
+			require.False(t, ok)
+		})
+	}
+}
+
+func TestServerEstablishConnectionWillNotSupported(t *testing.T) {
+	tt := []struct {
+		desc  string
+		flags byte
+		err   error
+		want  []byte
+	}{
+		{
+			desc:  "qos",
+			flags: 0x02 | 0x04 | 0x08, // clean session, will flag, will qos 1
+			err:   ErrQosNotSupported,
+			want:  []byte{byte(packets.Connack << 4), 5, 0, packets.CodeQosNotSupported, 2, packets.PropMaximumQos, 0},
+		},
+		{
+			desc:  "retain",
+			flags: 0x02 | 0x04 | 0x20, // clean session, will flag, will retain
+			err:   ErrRetainNotSupported,
+			want:  []byte{byte(packets.Connack << 4), 7, 0, packets.CodeRetainNotSupported, 4, packets.PropMaximumQos, 0, packets.PropRetainAvailable, 0},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := New()
+			s.settings["tcp"] = &listenerSettings{
+				retainDisabled: tx.err == ErrRetainNotSupported,
+			}
+
+			r, w := net.Pipe()
+			o := make(chan error)
+			go func() {
+				o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+			}()
+
+			go func() {
+				w.Write([]byte{
+					byte(packets.Connect << 4), 28, // Fixed header
+					0, 4, // Protocol Name - MSB+LSB
+					'M', 'Q', 'T', 'T', // Protocol Name
+					5,        // Protocol Version
+					tx.flags, // Packet Flags
+					0, 45,    // Keepalive
+					0,    // Properties Length
+					0, 5, // Client ID - MSB+LSB
+					'm', 'o', 'c', 'h', 'i', // Client ID
+					0,    // Will Properties Length
+					0, 3, // Will Topic - MSB+LSB
+					'a', '/', 'b', // Will Topic
+					0, 2, // Will Message - MSB+LSB
+					'h', 'i', // Will Message
+				})
+			}()
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(w)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			errx := <-o
+			time.Sleep(time.Millisecond)
+			r.Close()
+			require.ErrorIs(t, errx, tx.err)
+			require.Equal(t, tx.want, <-recv)
+		})
+	}
+}
+
+func TestServerEstablishConnectionLimited(t *testing.T) {
+	tt := []struct {
+		desc    string
+		connect []byte
+		want    []byte
+	}{
+		{
+			desc: "v3",
+			connect: []byte{
+				byte(packets.Connect << 4), 17, // Fixed header
+				0, 4, // Protocol Name - MSB+LSB
+				'M', 'Q', 'T', 'T', // Protocol Name
+				4,     // Protocol Version
+				2,     // Packet Flags - clean session
+				0, 45, // Keepalive
+				0, 5, // Client ID - MSB+LSB
+				'm', 'o', 'c', 'h', 'i', // Client ID
+			},
+			want: []byte{byte(packets.Connack << 4), 2, 0, packets.CodeConnectServerUnavailable},
+		},
+		{
+			desc: "v5",
+			connect: []byte{
+				byte(packets.Connect << 4), 18, // Fixed header
+				0, 4, // Protocol Name - MSB+LSB
+				'M', 'Q', 'T', 'T', // Protocol Name
+				5,     // Protocol Version
+				2,     // Packet Flags - clean session
+				0, 45, // Keepalive
+				0,    // Properties Length
+				0, 5, // Client ID - MSB+LSB
+				'm', 'o', 'c', 'h', 'i', // Client ID
+			},
+			want: []byte{byte(packets.Connack << 4), 3, 0, packets.CodeServerBusy, 0},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := New()
+			s.settings["tcp"] = &listenerSettings{
+				maxQos: 2,
+				connLimit: &connLimiter{
+					bucket: ratelimit.NewBucket(1, 1),
+					ips:    map[string]int{},
+				},
+			}
+			s.settings["tcp"].connLimit.bucket.Allow(time.Now()) // take the only token.
+
+			r, w := net.Pipe()
+			o := make(chan error)
+			go func() {
+				o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+			}()
+
+			go func() {
+				w.Write(tx.connect)
+			}()
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(w)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			errx := <-o
+			time.Sleep(time.Millisecond)
+			r.Close()
+			require.ErrorIs(t, errx, ErrConnectionLimited)
+			require.Equal(t, tx.want, <-recv)
+			require.Equal(t, int64(1), atomic.LoadInt64(&s.System.ConnectionsRejected))
+			require.Equal(t, int64(0), atomic.LoadInt64(&s.System.ClientsConnected))
+		})
+	}
+}
+
+func TestServerSetRedirect(t *testing.T) {
+	s := New()
+	ref, permanent := s.Redirect()
+	require.Equal(t, "", ref)
+	require.False(t, permanent)
+
+	s.SetRedirect("b:1883", true)
+	ref, permanent = s.Redirect()
+	require.Equal(t, "b:1883", ref)
+	require.True(t, permanent)
+
+	s.SetRedirect("", false)
+	ref, _ = s.Redirect()
+	require.Equal(t, "", ref)
+}
+
+func TestServerEstablishConnectionRedirected(t *testing.T) {
+	v3 := []byte{
+		byte(packets.Connect << 4), 17, // Fixed header
+		0, 4, // Protocol Name - MSB+LSB
+		'M', 'Q', 'T', 'T', // Protocol Name
+		4,     // Protocol Version
+		2,     // Packet Flags - clean session
+		0, 45, // Keepalive
+		0, 5, // Client ID - MSB+LSB
+		'm', 'o', 'c', 'h', 'i', // Client ID
+	}
+
+	v5 := []byte{
+		byte(packets.Connect << 4), 18, // Fixed header
+		0, 4, // Protocol Name - MSB+LSB
+		'M', 'Q', 'T', 'T', // Protocol Name
+		5,     // Protocol Version
+		2,     // Packet Flags - clean session
+		0, 45, // Keepalive
+		0,    // Properties Length
+		0, 5, // Client ID - MSB+LSB
+		'm', 'o', 'c', 'h', 'i', // Client ID
+	}
+
+	tt := []struct {
+		desc      string
+		permanent bool
+		connect   []byte
+		want      []byte
+	}{
+		{
+			desc:    "v3",
+			connect: v3,
+			want:    []byte{byte(packets.Connack << 4), 2, 0, packets.CodeConnectServerUnavailable},
+		},
+		{
+			desc:    "v5 temporary",
+			connect: v5,
+			want: []byte{
+				byte(packets.Connack << 4), 12, // Fixed header
+				0,                            // Session present
+				packets.CodeUseAnotherServer, // Reason code
+				9,                            // Properties Length
+				packets.PropServerReference, 0, 6, 'b', ':', '1', '8', '8', '3',
+			},
+		},
+		{
+			desc:      "v5 permanent",
+			permanent: true,
+			connect:   v5,
+			want: []byte{
+				byte(packets.Connack << 4), 12, // Fixed header
+				0,                       // Session present
+				packets.CodeServerMoved, // Reason code
+				9,                       // Properties Length
+				packets.PropServerReference, 0, 6, 'b', ':', '1', '8', '8', '3',
+			},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := New()
+			s.SetRedirect("b:1883", tx.permanent)
+
+			r, w := net.Pipe()
+			o := make(chan error)
+			go func() {
+				o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+			}()
+
+			go func() {
+				w.Write(tx.connect)
+			}()
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(w)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			errx := <-o
+			time.Sleep(time.Millisecond)
+			r.Close()
+			require.ErrorIs(t, errx, ErrConnectionRedirected)
+			require.Equal(t, tx.want, <-recv)
+			require.Equal(t, int64(0), atomic.LoadInt64(&s.System.ClientsConnected))
+		})
+	}
+}
+
+// testEnhancedAuth is an auth controller which authenticates clients using
+// the TEST enhanced authentication method, in two rounds.
+type testEnhancedAuth struct {
+	auth.Allow
+}
+
+func (a *testEnhancedAuth) NewChallenger(info auth.ConnInfo) auth.Challenger {
+	return new(testChallenger)
+}
+
+// testChallenger expects the data a then c, responding with b and then d.
+type testChallenger struct {
+	round int
+}
+
+func (c *testChallenger) Challenge(method string, data []byte) ([]byte, bool, error) {
+	if method != "TEST" {
+		return nil, false, auth.ErrBadAuthMethod
+	}
+
+	c.round++
+	switch {
+	case c.round == 1 && string(data) == "a":
+		return []byte("b"), false, nil
+	case c.round == 2 && string(data) == "c":
+		return []byte("d"), true, nil
+	}
+
+	return nil, false, errors.New("bad data")
+}
+
+// enhancedConnect connects the client mochi to a server using enhanced
+// authentication with the given method, replies to any auth challenge with
+// the reply packets, and returns everything the server sent to it.
+func enhancedConnect(t *testing.T, ac auth.Controller, method string, reply ...[]byte) ([]byte, error) {
+	s := New()
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, ac)
+	}()
+
+	go func() {
+		w.Write(append([]byte{
+			byte(packets.Connect << 4), byte(25 + len(method)), // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			5,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			byte(7 + len(method)), // Properties Length
+			packets.PropAuthenticationMethod, 0, byte(len(method)),
+		}, append([]byte(method),
+			packets.PropAuthenticationData, 0, 1, 'a',
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		)...))
+		for _, b := range reply {
+			w.Write(b)
+		}
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	time.Sleep(time.Millisecond)
+	r.Close()
+	return <-recv, errx
+}
+
+// testAuthPacket returns an auth packet continuing the TEST method with data.
+func testAuthPacket(data byte) []byte {
+	return []byte{
+		byte(packets.Auth << 4), 13,
+		packets.CodeContinueAuthentication,
+		11, // Properties Length
+		packets.PropAuthenticationMethod, 0, 4, 'T', 'E', 'S', 'T',
+		packets.PropAuthenticationData, 0, 1, data,
+	}
+}
+
+func TestServerEstablishConnectionEnhancedAuth(t *testing.T) {
+	buf, err := enhancedConnect(t, new(testEnhancedAuth), "TEST", testAuthPacket('c'))
+	require.ErrorIs(t, err, ErrClientDisconnect)
+	require.Equal(t, append(testAuthPacket('b'), []byte{
+		byte(packets.Connack << 4), 14,
+		0, packets.Accepted,
+		11, // Properties Length
+		packets.PropAuthenticationMethod, 0, 4, 'T', 'E', 'S', 'T',
+		packets.PropAuthenticationData, 0, 1, 'd',
+	}...), buf)
+}
+
+func TestServerEstablishConnectionEnhancedAuthFailures(t *testing.T) {
+	tt := []struct {
+		desc   string
+		ac     auth.Controller
+		method string
+		reply  []byte
+		code   byte
+	}{
+		{"not supported", new(auth.Allow), "TEST", nil, packets.CodeBadAuthenticationMethod},
+		{"bad method", new(testEnhancedAuth), "NOPE", nil, packets.CodeBadAuthenticationMethod},
+		{"bad data", new(testEnhancedAuth), "TEST", testAuthPacket('x'), packets.CodeNotAuthorized},
+		{"not auth packet", new(testEnhancedAuth), "TEST", []byte{byte(packets.Pingreq << 4), 0}, packets.CodeProtocolError},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			buf, err := enhancedConnect(t, tx.ac, tx.method, tx.reply)
+			require.ErrorIs(t, err, ErrConnectionFailed)
+			require.Equal(t, []byte{byte(packets.Connack << 4), 3, 0, tx.code, 0}, buf[len(buf)-5:])
+		})
+	}
+}
+
+func TestServerEstablishConnectionBadAuthLogs(t *testing.T) {
+	l := new(testLogger)
+	s := NewServer(&Options{Logger: l})
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Disallow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 24, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			130,   // Packet Flags - username, clean session
+			0, 20, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+			0, 5, // Username MSB+LSB
+			'm', 'o', 'c', 'h', 'i',
+		})
+	}()
+
+	go func() {
+		_, _ = ioutil.ReadAll(w)
+	}()
+
+	require.ErrorIs(t, <-o, ErrConnectionFailed)
+	r.Close()
+
+	lg, ok := l.find("client authentication failed")
+	require.True(t, ok)
+	require.Equal(t, "warn", lg.level)
+	require.Equal(t, "mochi", lg.kv[logger.KeyClientID])
+	require.Equal(t, "mochi", lg.kv[logger.KeyUsername])
+
+	_, ok = s.Clients.Get("mochi")
+	require.False(t, ok)
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+type principal string
+
+func (p principal) Username() string {
+	return string(p)
+}
+
+type principalAuth struct {
+	auth.Allow
+}
+
+func (a *principalAuth) Authenticate(user, password []byte) (interface{}, error) {
+	return principal("sub-" + string(user)), nil
+}
+
+func TestServerEstablishConnectionPrincipalUsername(t *testing.T) {
+	s := New()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(principalAuth))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 30, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			192,   // Packet Flags
+			0, 20, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+			0, 5, // Username MSB+LSB
+			'm', 'o', 'c', 'h', 'i',
+			0, 4, // Password MSB+LSB
+			'a', 'b', 'c', 'd',
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.Accepted,
+	}, <-recv)
+	w.Close()
+
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Equal(t, []byte("sub-mochi"), cl.Username)
+	require.Equal(t, principal("sub-mochi"), cl.Identity)
+}
+
+type connAuth struct {
+	auth.Allow
+	info auth.ConnInfo
+}
+
+func (a *connAuth) AuthenticateConn(info auth.ConnInfo) (interface{}, error) {
+	a.info = info
+	return nil, nil
+}
+
+func TestServerEstablishConnectionConnInfo(t *testing.T) {
+	s := New()
+	ac := new(connAuth)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, ac)
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 30, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			194,   // Packet Flags
+			0, 20, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+			0, 5, // Username MSB+LSB
+			'm', 'o', 'c', 'h', 'i',
+			0, 4, // Password MSB+LSB
+			'a', 'b', 'c', 'd',
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	go func() {
+		ioutil.ReadAll(w)
+	}()
+
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+
+	require.Equal(t, auth.ConnInfo{
+		Listener:   "tcp",
+		RemoteAddr: "pipe",
+		ClientID:   "mochi",
+		Username:   []byte("mochi"),
+		Password:   []byte("abcd"),
+	}, ac.info)
+}
+
+// tlsPipe is a net.Conn with a fixed tls connection state.
+type tlsPipe struct {
+	net.Conn
+	cs tls.ConnectionState
+}
+
+func (c *tlsPipe) ConnectionState() tls.ConnectionState {
+	return c.cs
+}
+
+func TestServerEstablishConnectionConnInfoTLS(t *testing.T) {
+	s := New()
+	ac := new(connAuth)
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "mochi"},
+		DNSNames: []string{"mochi.io"},
+	}
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tls", &tlsPipe{r, tls.ConnectionState{
+			HandshakeComplete: true,
+			ServerName:        "tenant.mochi.io",
+			PeerCertificates:  []*x509.Certificate{cert},
+		}}, ac)
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags
+			0, 20, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	go func() {
+		ioutil.ReadAll(w)
+	}()
+
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+
+	require.Equal(t, "tenant.mochi.io", ac.info.ServerName)
+	require.Equal(t, cert, ac.info.Certificate)
+	require.Equal(t, "mochi", ac.info.CommonName)
+	require.Equal(t, []string{"mochi.io"}, ac.info.SANs)
+}
+
+func TestServerEstablishConnectionPromptSendLWT(t *testing.T) {
+	s := New()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			0,     // Packet Flags
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID,
+		})
+		w.Write([]byte{0, 0}) // invalid packet
+	}()
+
+	// Receive the Connack
+	go func() {
+		_, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	require.Error(t, <-o)
+
+	clw, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Equal(t, int64(0), s.bytepool.InUse())
+	require.Nil(t, clw.R)
+	require.Nil(t, clw.W)
+}
+
+func TestServerEstablishConnectionReadConnectionPacketErr(t *testing.T) {
+	s := New()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			194,   // Packet Flags
+			0, 20, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+	}()
+
+	errx := <-o
+	time.Sleep(time.Millisecond)
+	r.Close()
+	require.Error(t, errx)
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+// TestServerEstablishConnectionClearBuffersAfterUse ensures that the r/w buffers
+// for a client have been set to nil when the client disconnects so that they dont
+// leak (otherwise the reference to the buffers remains). We only need to check if
+// they are de-allocated if a connection is properly established - a client which
+// fails to connect isn't added to the server clients list at all and is abandoned,
+// so it can't leak buffers.
+func TestServerEstablishConnectionClearBuffersAfterUse(t *testing.T) {
+	s := New()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			0,     // Packet Flags
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	// Receive the Connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.Equal(t, int64(0), s.bytepool.InUse()) // ensure the buffers have been returned to pool.
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+	w.Close()
+
+	time.Sleep(time.Millisecond * 100)
+
+	clw, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.NotNil(t, clw)
+	require.Equal(t, int64(0), s.bytepool.InUse())
+	require.Nil(t, clw.R)
+	require.Nil(t, clw.W)
+}
+
+func TestServerWriteClient(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ID = "mochi"
 
 	err := s.writeClient(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type:      packets.Pubcomp,
 			Remaining: 2,
 		},
-		PacketID: 14,
+		PacketID: 14,
+	})
+	require.NoError(t, err)
+
+	// Expecting 4 bytes
+	buf := make([]byte, 4)
+	nread, err := r.Read(buf)
+	if nread < 4 || err != nil {
+		panic(err)
+	}
+
+	require.Equal(t, []byte{
+		byte(packets.Pubcomp << 4), 2,
+		0, 14,
+	}, buf)
+
+	w.Close()
+}
+
+func TestServerWriteClientError(t *testing.T) {
+	s := New()
+	w, _ := net.Pipe()
+	cl := clients.NewClient(w, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
+	cl.ID = "mochi"
+
+	err := s.writeClient(cl, packets.Packet{})
+	require.Error(t, err)
+}
+
+func TestServerOnStorageLogs(t *testing.T) {
+	l := new(testLogger)
+	s, cl, _, _ := setupClient()
+	s.Options.Logger = l
+
+	var hookErr error
+	s.Events.OnError = func(cl events.Client, err error) {
+		hookErr = err
+	}
+
+	s.onStorage(cl, "WriteInflight", nil)
+	require.Empty(t, l.logs)
+
+	s.onStorage(cl, "WriteInflight", errors.New("test"))
+	lg, ok := l.find("persistence error")
+	require.True(t, ok)
+	require.Equal(t, "error", lg.level)
+	require.Equal(t, "mochi", lg.kv[logger.KeyClientID])
+	require.Equal(t, "WriteInflight", lg.kv["op"])
+	require.EqualError(t, hookErr, "storage: test")
+}
+
+func TestServerOnStorageHook(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	h := new(testHook)
+	s.AddHook(h)
+
+	s.onStorage(cl, "WriteInflight", nil)
+	s.onStorage(cl, "WriteInflight", errors.New("disk full"))
+	s.onStorage(&s.inline, "DeleteRetained", errors.New("disk full"))
+	require.Equal(t, []string{"storage:WriteInflight", "storage:DeleteRetained"}, h.notes())
+}
+
+func TestServerStoreFailing(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	require.False(t, s.StoreFailing())
+
+	s.onStorage(cl, "WriteInflight", errors.New("disk full"))
+	require.True(t, s.StoreFailing())
+
+	// another method succeeding does not recover the failing method.
+	s.onStorage(cl, "DeleteInflight", nil)
+	require.True(t, s.StoreFailing())
+
+	s.onStorage(cl, "WriteInflight", nil)
+	require.False(t, s.StoreFailing())
+}
+
+func TestServerStoreFailingWriteBehind(t *testing.T) {
+	s := NewServer(&Options{WriteBehind: &persistence.WriteBehindOptions{}})
+	st := &persistence.MockStore{Fail: map[string]bool{"write_inflight": true}}
+	require.NoError(t, s.AddStore(st))
+	defer s.Store.Close()
+
+	s.onStorage(&s.inline, "WriteInflight", s.Store.WriteInflight(persistence.Message{ID: "a"}))
+	s.writeBehind.Flush()
+	require.True(t, s.StoreFailing())
+
+	st.Fail = nil
+	s.onStorage(&s.inline, "WriteInflight", s.Store.WriteInflight(persistence.Message{ID: "a"}))
+	s.writeBehind.Flush()
+	require.False(t, s.StoreFailing())
+}
+
+func TestServerProcessPublishStoreFailClosed(t *testing.T) {
+	tt := []struct {
+		desc    string
+		version byte
+		expect  []byte
+	}{
+		{
+			desc:    "v5",
+			version: 5,
+			expect: []byte{
+				byte(packets.Puback << 4), 2,
+				0, 1,
+
+				byte(packets.Puback << 4), 4,
+				0, 2,
+				packets.CodeQuotaExceeded,
+				0, // Properties Length
+			},
+		},
+		{
+			desc:    "v3",
+			version: 4,
+			expect: []byte{
+				byte(packets.Puback << 4), 2,
+				0, 1,
+			},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s, cl1, r1, w1 := setupClient()
+			s.Options.StoreFailClosed = true
+			cl1.ID = "mochi1"
+			cl1.ProtocolVersion = tx.version
+			s.Clients.Add(cl1)
+
+			cl2, _, _ := setupServerClient(s)
+			cl2.ID = "mochi2"
+			s.Clients.Add(cl2)
+			s.Topics.Subscribe("a/#", cl2.ID, 1)
+
+			ack1 := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(r1)
+				require.NoError(t, err)
+				ack1 <- buf
+			}()
+
+			publish := func(qos byte, id uint16) {
+				require.NoError(t, s.processPacket(cl1, packets.Packet{
+					FixedHeader: packets.FixedHeader{
+						Type: packets.Publish,
+						Qos:  qos,
+					},
+					TopicName: "a/b",
+					Payload:   []byte("hello"),
+					PacketID:  id,
+				}))
+			}
+
+			publish(1, 1)
+			s.onStorage(cl1, "WriteInflight", errors.New("disk full"))
+			publish(1, 2)
+			publish(0, 0)
+
+			time.Sleep(10 * time.Millisecond)
+			w1.Close()
+
+			require.Equal(t, tx.expect, <-ack1)
+			require.Equal(t, 1, cl2.Inflight.Len())
+			require.Equal(t, int64(1), atomic.LoadInt64(&s.System.StoreRejected))
+		})
+	}
+}
+
+func TestServerProcessPublishStoreFailClosedResend(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Options.StoreFailClosed = true
+	require.NoError(t, s.AddStore(mem.New()))
+	cl1.ID = "mochi1"
+	cl1.ProtocolVersion = 4
+	s.Clients.Add(cl1)
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+	s.Topics.Subscribe("a/#", cl2.ID, 1)
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		require.NoError(t, err)
+		ack1 <- buf
+	}()
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  2,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("hello"),
+		PacketID:  3,
+	}
+
+	s.onStorage(cl1, "WriteRetained", errors.New("disk full"))
+	require.NoError(t, s.processPacket(cl1, pk))
+	require.False(t, cl1.InboundQos2Pending(3))
+	n, err := s.Store.CountInflight(cl1.ID)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	// the resend is delivered once the store recovers.
+	s.onStorage(cl1, "WriteRetained", nil)
+	pk.FixedHeader.Dup = true
+	require.NoError(t, s.processPacket(cl1, pk))
+
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Equal(t, []byte{byte(packets.Pubrec << 4), 2, 0, 3}, <-ack1)
+	require.Equal(t, 1, cl2.Inflight.Len())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.StoreRejected))
+}
+
+// blockingStore is a store whose inflight writes block until released.
+type blockingStore struct {
+	persistence.MockStore
+	release chan struct{}
+}
+
+func (s *blockingStore) WriteInflight(v persistence.Message) error {
+	<-s.release
+	return s.MockStore.WriteInflight(v)
+}
+
+func TestServerProcessPublishStoreSaturated(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Options.StoreSaturation = StoreSaturationReject
+	s.Options.WriteBehind = &persistence.WriteBehindOptions{Size: 1}
+	st := &blockingStore{release: make(chan struct{})}
+	require.NoError(t, s.AddStore(st))
+	cl.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	// hold the writer on one write, and fill the queue with another.
+	require.NoError(t, s.Store.WriteInflight(persistence.Message{ID: "a"}))
+	require.Eventually(t, func() bool {
+		queued, _ := s.StoreQueue()
+		return queued == 0
+	}, time.Second, time.Millisecond)
+	require.NoError(t, s.Store.WriteInflight(persistence.Message{ID: "b"}))
+	reason, ok := s.storeUnavailable()
+	require.True(t, ok)
+	require.Equal(t, "publish rejected while store queue is full", reason)
+
+	ack := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		ack <- buf
+	}()
+
+	for _, qos := range []byte{1, 0} {
+		require.NoError(t, s.processPacket(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  qos,
+			},
+			TopicName: "a/b",
+			Payload:   []byte("hello"),
+			PacketID:  uint16(qos),
+		}))
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	require.Equal(t, []byte{
+		byte(packets.Puback << 4), 4,
+		0, 1,
+		packets.CodeQuotaExceeded,
+		0, // Properties Length
+	}, <-ack)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.StoreRejected))
+
+	close(st.release)
+	s.writeBehind.Flush()
+	_, ok = s.storeUnavailable()
+	require.False(t, ok)
+	s.Store.Close()
+}
+
+func TestServerProcessPublishStoreSaturatedResend(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Options.StoreSaturation = StoreSaturationReject
+	s.Options.WriteBehind = &persistence.WriteBehindOptions{Size: 1}
+	st := &blockingStore{release: make(chan struct{})}
+	require.NoError(t, s.AddStore(st))
+	cl.ID = "mochi1"
+	cl.ProtocolVersion = 4
+	s.Clients.Add(cl)
+
+	cl2, r2, w2 := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+	s.Topics.Subscribe("a/#", cl2.ID, 0)
+
+	require.NoError(t, s.Store.WriteInflight(persistence.Message{ID: "a"}))
+	require.Eventually(t, func() bool {
+		queued, _ := s.StoreQueue()
+		return queued == 0
+	}, time.Second, time.Millisecond)
+	require.NoError(t, s.Store.WriteInflight(persistence.Message{ID: "b"}))
+
+	ack := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		ack <- buf
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r2)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  2,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("hello"),
+		PacketID:  3,
+	}
+
+	// the rejected publish neither waits on the full queue nor stays pending.
+	require.NoError(t, s.processPacket(cl, pk))
+	require.False(t, cl.InboundQos2Pending(3))
+
+	// the resend is delivered once the queue has space.
+	close(st.release)
+	s.writeBehind.Flush()
+	pk.FixedHeader.Dup = true
+	require.NoError(t, s.processPacket(cl, pk))
+	require.True(t, cl.InboundQos2Pending(3))
+
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	w2.Close()
+	require.Equal(t, []byte{byte(packets.Pubrec << 4), 2, 0, 3}, <-ack)
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 10,
+		0, 3, 'a', '/', 'b',
+		'h', 'e', 'l', 'l', 'o',
+	}, <-recv)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.StoreRejected))
+	s.Store.Close()
+}
+
+func TestServerStoreLatency(t *testing.T) {
+	s := New()
+	require.Nil(t, s.StoreLatency())
+	require.NoError(t, s.AddStore(new(persistence.MockStore)))
+	require.Nil(t, s.StoreLatency())
+
+	s = NewServer(&Options{StoreLatency: true})
+	require.NoError(t, s.AddStore(new(persistence.MockStore)))
+	require.IsType(t, new(persistence.Timed), s.Store)
+	require.NoError(t, s.Store.WriteRetained(persistence.Message{ID: "ret_a"}))
+	require.Equal(t, int64(1), s.StoreLatency()["WriteRetained"].Count)
+}
+
+func TestServerProcessFailure(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	err := s.processPacket(cl, packets.Packet{})
+	require.Error(t, err)
+}
+
+func TestServerProcessConnect(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+	})
+	require.NoError(t, err)
+}
+
+func TestServerProcessConnectV5(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+	})
+	require.NoError(t, err)
+	require.ErrorIs(t, cl.StopCause(), ErrClientReconnect)
+	w.Close()
+
+	require.Equal(t, disconnectPacket(packets.CodeProtocolError, "connect packet received on an established connection"), <-recv)
+}
+
+func TestServerProcessDisconnect(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Disconnect,
+		},
+	})
+	require.NoError(t, err)
+}
+
+func TestServerProcessPingreq(t *testing.T) {
+	s, cl, r, w := setupClient()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pingreq,
+		},
+	})
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Pingresp << 4), 0,
+	}, <-recv)
+}
+
+func TestServerProcessPingreqError(t *testing.T) {
+	s, cl, _, _ := setupClient()
+
+	cl.Stop(errTestStop)
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pingreq,
+		},
+	})
+	require.Error(t, err)
+	require.Equal(t, errTestStop, cl.StopCause())
+}
+
+func TestServerProcessPublishInvalid(t *testing.T) {
+	s, cl, _, _ := setupClient()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		PacketID: 0,
+	})
+
+	require.Error(t, err)
+}
+
+func TestServerSetRateLimit(t *testing.T) {
+	s := NewServer(&Options{
+		RateLimits: map[string]RateLimit{
+			"a/#": {Rate: 10, Burst: 5},
+		},
+	})
+	require.Contains(t, s.rateLimits, "a/#")
+	require.Equal(t, RateLimit{Rate: 10, Burst: 5}, s.rateLimits["a/#"].limit)
+
+	s.SetRateLimit("b/#", RateLimit{Rate: 1, Action: RateLimitDisconnect})
+	require.Equal(t, map[string]int64{"a/#": 0, "b/#": 0}, s.RateLimitDropped())
+
+	s.ClearRateLimit("a/#")
+	require.NotContains(t, s.rateLimits, "a/#")
+
+	s.SetRateLimit("b/#", RateLimit{Rate: 0})
+	require.Empty(t, s.rateLimits)
+}
+
+// testTransform is a payload transform which wraps payloads in brackets, and
+// unwraps them for subscribers other than those which accept wrapped payloads.
+type testTransform struct {
+	accepts    map[string]bool // the ids of clients which accept wrapped payloads.
+	failEncode bool            // fail to encode payloads.
+	failDecode bool            // fail to decode payloads.
+	encoded    []events.Packet // the packets passed to Encode.
+}
+
+func (tr *testTransform) Encode(cl events.Client, pk events.Packet) (events.Packet, error) {
+	if tr.failEncode {
+		return pk, errors.New("encode failed")
+	}
+
+	tr.encoded = append(tr.encoded, pk)
+	pk.Payload = append(append([]byte{'['}, pk.Payload...), ']')
+	pk.Properties.ContentType = "application/x-wrapped"
+	return pk, nil
+}
+
+func (tr *testTransform) Decode(cl events.Client, pk events.Packet) (events.Packet, error) {
+	if tr.accepts[cl.ID] {
+		return pk, nil
+	}
+
+	if tr.failDecode || len(pk.Payload) < 2 {
+		return pk, errors.New("decode failed")
+	}
+
+	pk.Payload = pk.Payload[1 : len(pk.Payload)-1]
+	pk.Properties.ContentType = ""
+	return pk, nil
+}
+
+func TestServerSetTransform(t *testing.T) {
+	tr1 := new(testTransform)
+	s := NewServer(&Options{
+		Transforms: map[string]PayloadTransform{"a/": tr1},
+	})
+	require.Contains(t, s.transforms, "a/")
+
+	tr2 := new(testTransform)
+	s.SetTransform("a/b/", tr2)
+
+	tr, ok := s.payloadTransform("a/b/c")
+	require.True(t, ok)
+	require.Same(t, tr2, tr) // the longest prefix is used.
+
+	tr, ok = s.payloadTransform("a/c")
+	require.True(t, ok)
+	require.Same(t, tr1, tr)
+
+	_, ok = s.payloadTransform("b/c")
+	require.False(t, ok)
+
+	s.ClearTransform("a/b/")
+	tr, ok = s.payloadTransform("a/b/c")
+	require.True(t, ok)
+	require.Same(t, tr1, tr)
+
+	s.SetTransform("a/", nil)
+	require.Empty(t, s.transforms)
+}
+
+func TestServerProcessPublishTransform(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "mochi1"
+	s.Clients.Add(cl1)
+
+	cl2, r2, w2 := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+
+	cl3, r3, w3 := setupServerClient(s)
+	cl3.ID = "mochi3"
+	s.Clients.Add(cl3)
+
+	tr := &testTransform{accepts: map[string]bool{"mochi3": true}}
+	s.SetTransform("z/", tr)
+	s.Topics.Subscribe("z/+", cl2.ID, 0)
+	s.Topics.Subscribe("z/+", cl3.ID, 0)
+	s.Topics.Subscribe("a/+", cl2.ID, 0)
+
+	recv := make([]chan []byte, 3)
+	for i, r := range []net.Conn{r1, r2, r3} {
+		recv[i] = make(chan []byte)
+		go func(r net.Conn, ch chan []byte) {
+			buf, err := ioutil.ReadAll(r)
+			if err != nil {
+				panic(err)
+			}
+			ch <- buf
+		}(r, recv[i])
+	}
+
+	err := s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "z/a",
+		Payload:   []byte("hi"),
+	})
+	require.NoError(t, err)
+
+	err = s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/a",
+		Payload:   []byte("hi"),
+	})
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+	w2.Close()
+	w3.Close()
+
+	require.Len(t, tr.encoded, 1)
+	require.Equal(t, "z/a", tr.encoded[0].TopicName)
+	require.Equal(t, []byte("hi"), tr.encoded[0].Payload)
+
+	require.Empty(t, <-recv[0])
+	require.Equal(t, []byte{
+		byte(packets.Publish<<4 | 1), 7,
+		0, 3,
+		'z', '/', 'a',
+		'h', 'i',
+
+		byte(packets.Publish << 4), 7,
+		0, 3,
+		'a', '/', 'a',
+		'h', 'i',
+	}, <-recv[1])
+	require.Equal(t, []byte{
+		byte(packets.Publish<<4 | 1), 9,
+		0, 3,
+		'z', '/', 'a',
+		'[', 'h', 'i', ']',
+	}, <-recv[2])
+
+	retained := s.Topics.Messages("z/a")
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("[hi]"), retained[0].Payload)
+	require.Equal(t, "application/x-wrapped", retained[0].Properties.ContentType)
+}
+
+func TestServerProcessPublishTransformEncodeError(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "mochi1"
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("z/+", cl1.ID, 0)
+	s.SetTransform("z/", &testTransform{failEncode: true})
+
+	var errs []error
+	s.Events.OnError = func(cl events.Client, err error) {
+		errs = append(errs, err)
+	}
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "z/a",
+		Payload:   []byte("hi"),
+	})
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Empty(t, <-recv)
+	require.Len(t, errs, 1)
+	require.Empty(t, s.Topics.Messages("z/a"))
+}
+
+func TestServerProcessPublishTransformDecodeError(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "mochi1"
+	s.Clients.Add(cl1)
+
+	cl2, r2, w2 := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+
+	s.SetTransform("z/", &testTransform{
+		accepts:    map[string]bool{"mochi2": true},
+		failDecode: true,
+	})
+	s.Topics.Subscribe("z/+", cl1.ID, 0)
+	s.Topics.Subscribe("z/+", cl2.ID, 0)
+
+	var errs []error
+	s.Events.OnError = func(cl events.Client, err error) {
+		errs = append(errs, err)
+	}
+
+	recv1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		recv1 <- buf
+	}()
+
+	recv2 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r2)
+		if err != nil {
+			panic(err)
+		}
+		recv2 <- buf
+	}()
+
+	err := s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "z/a",
+		Payload:   []byte("hi"),
+	})
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+	w2.Close()
+
+	require.Empty(t, <-recv1) // the message could not be decoded for the publisher.
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 9,
+		0, 3,
+		'z', '/', 'a',
+		'[', 'h', 'i', ']',
+	}, <-recv2)
+	require.Len(t, errs, 1)
+}
+
+func TestServerProcessSubscribeRetainedTransform(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.SetTransform("z/", new(testTransform))
+	s.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "z/a",
+		Payload:   []byte("[hi]"),
+	})
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"z/#"},
+		Qoss:     []byte{0},
+	})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Suback << 4), 3, // Fixed header
+		0, 10, // Packet ID - LSB+MSB
+		0, // Return Code QoS 0
+
+		byte(packets.Publish<<4 | 1), 7, // Fixed header
+		0, 3, // Topic Name - LSB+MSB
+		'z', '/', 'a', // Topic Name
+		'h', 'i', // Payload
+	}, <-recv)
+}
+
+// retainTestMessages retains n messages with single character payloads on the
+// topics a/0, a/1, and so on.
+func retainTestMessages(s *Server, n int) {
+	for i := 0; i < n; i++ {
+		s.Topics.RetainMessage(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Retain: true,
+			},
+			TopicName: "a/" + strconv.Itoa(i),
+			Payload:   []byte("x"),
+		})
+	}
+}
+
+// pendingReplay returns the number of retained messages waiting to be sent to
+// a client, and whether the client has a replay in progress.
+func pendingReplay(s *Server, cl *clients.Client) (int, bool) {
+	s.replaysMu.Lock()
+	defer s.replaysMu.Unlock()
+	r, ok := s.replays[cl]
+	if !ok {
+		return 0, false
+	}
+	return len(r.pending), true
+}
+
+func TestServerProcessSubscribeRetainedBatches(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Options.RetainedBatchSize = 2
+	retainTestMessages(s, 5)
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/#"},
+		Qoss:     []byte{0},
+	})
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	w.Close()
+
+	buf := <-recv
+	require.Equal(t, []byte{byte(packets.Suback << 4), 3, 0, 10, 0}, buf[:5])
+	require.Len(t, buf, 5+5*8) // each message is 8 bytes.
+
+	_, ok := pendingReplay(s, cl)
+	require.False(t, ok)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.RetainedReplays))
+}
+
+func TestServerProcessSubscribeRetainedBatchDelay(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Options.RetainedBatchSize = 1
+	s.Options.RetainedBatchDelay = 50 * time.Millisecond
+	retainTestMessages(s, 3)
+
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer w.Close()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/#"},
+		Qoss:     []byte{0},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+	n, ok := pendingReplay(s, cl)
+	require.True(t, ok)
+	require.Equal(t, 2, n)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.RetainedReplays))
+
+	time.Sleep(150 * time.Millisecond)
+	_, ok = pendingReplay(s, cl)
+	require.False(t, ok)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.RetainedReplays))
+}
+
+func TestServerProcessSubscribeRetainedReceiveMaximum(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Options.RetainedBatchSize = 1
+	retainTestMessages(s, 2)
+
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer w.Close()
+
+	// a message is queued beyond the client's receive maximum.
+	cl.ReceiveMaximum = 1
+	for i := 0; i < 2; i++ {
+		cl.Inflight.SetOrQueue(clients.InflightMessage{
+			Packet: packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+				TopicName:   "b",
+			},
+		}, int(cl.ReceiveMaximum))
+	}
+	require.Equal(t, 1, cl.Inflight.QueueLen())
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/#"},
+		Qoss:     []byte{0},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(30 * time.Millisecond)
+	n, ok := pendingReplay(s, cl)
+	require.True(t, ok)
+	require.Equal(t, 2, n) // nothing is sent while messages are queued.
+
+	cl.Inflight.TakeQueued(func(in clients.InflightMessage) bool {
+		return true
+	})
+
+	time.Sleep(30 * time.Millisecond)
+	_, ok = pendingReplay(s, cl)
+	require.False(t, ok)
+}
+
+func TestServerProcessSubscribeRetainedReplayStopped(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Options.RetainedBatchSize = 1
+	s.Options.RetainedBatchDelay = 20 * time.Millisecond
+	retainTestMessages(s, 3)
+
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer w.Close()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/#"},
+		Qoss:     []byte{0},
+	})
+	require.NoError(t, err)
+
+	cl.Stop(errTestStop)
+	time.Sleep(50 * time.Millisecond)
+	_, ok := pendingReplay(s, cl)
+	require.False(t, ok)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.RetainedReplays))
+}
+
+func TestServerSetLastValues(t *testing.T) {
+	s := NewServer(&Options{
+		LastValues: map[string]LastValueCache{"a/": {}},
+	})
+	require.Contains(t, s.lastValues, "a/")
+
+	s.SetLastValues("a/b/", LastValueCache{TTL: time.Second, Size: 10})
+	require.Len(t, s.lastValues, 2)
+
+	s.ClearLastValues("a/b/")
+	require.Len(t, s.lastValues, 1)
+	require.NotContains(t, s.lastValues, "a/b/")
+}
+
+func TestServerNoteLastValue(t *testing.T) {
+	s := New()
+	s.SetLastValues("a/", LastValueCache{})
+	s.SetLastValues("a/b/", LastValueCache{})
+
+	pub := func(topic string, qos byte, retain bool) packets.Packet {
+		return packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Qos:    qos,
+				Retain: retain,
+			},
+			TopicName: topic,
+			Payload:   []byte("x"),
+			PacketID:  1,
+		}
+	}
+
+	s.noteLastValue(pub("a/c", 2, false))
+	s.noteLastValue(pub("a/b/c", 1, false))
+	s.noteLastValue(pub("b/c", 0, false)) // no cache for the topic.
+	require.Equal(t, 1, s.lastValues["a/"].Len())
+	require.Equal(t, 1, s.lastValues["a/b/"].Len()) // only the longest prefix is used.
+
+	pks := s.lastValueMessages("a/#")
+	require.Len(t, pks, 2)
+	require.Empty(t, s.lastValueMessages("b/c"))
+
+	pk := s.lastValueMessages("a/c")[0]
+	require.Equal(t, byte(2), pk.FixedHeader.Qos)
+	require.Equal(t, uint16(0), pk.PacketID)
+	require.NotZero(t, pk.Created)
+
+	// a retained message replaces the last value of its topic.
+	s.noteLastValue(pub("a/c", 0, true))
+	require.Empty(t, s.lastValueMessages("a/c"))
+}
+
+func TestServerProcessSubscribeLastValues(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.SetLastValues("a/", LastValueCache{})
+	s.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "a/c",
+		Payload:   []byte("y"),
+	})
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+	err := s.processPacket(cl2, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  2,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("x"),
+		PacketID:  5,
+	})
+	require.NoError(t, err)
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err = s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/+"},
+		Qoss:     []byte{1},
+	})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Suback << 4), 3, // Fixed header
+		0, 10, // Packet ID - LSB+MSB
+		1, // Return Code QoS 1
+
+		byte(packets.Publish<<4 | 1), 6, // Fixed header, retained
+		0, 3, // Topic Name - LSB+MSB
+		'a', '/', 'c', // Topic Name
+		'y', // Payload
+
+		byte(packets.Publish<<4 | 1<<1), 8, // Fixed header, QoS 1, not retained
+		0, 3, // Topic Name - LSB+MSB
+		'a', '/', 'b', // Topic Name
+		0, 1, // Packet ID - LSB+MSB
+		'x', // Payload
+	}, <-recv)
+}
+
+// deliveredPublish returns the publish packet for a message with the payload x
+// on topic a/b, as sent by the server with a qos and retain flag. Messages with
+// a qos carry the first packet id.
+func deliveredPublish(qos byte, retain bool) []byte {
+	flags := qos << 1
+	if retain {
+		flags |= 1
+	}
+
+	if qos == 0 {
+		return []byte{byte(packets.Publish<<4) | flags, 6, 0, 3, 'a', '/', 'b', 'x'}
+	}
+
+	return []byte{byte(packets.Publish<<4) | flags, 8, 0, 3, 'a', '/', 'b', 0, 1, 'x'}
+}
+
+func TestServerDeliveryQosMatrix(t *testing.T) {
+	for pubQos := byte(0); pubQos <= 2; pubQos++ {
+		for subQos := byte(0); subQos <= 2; subQos++ {
+			want := pubQos
+			if subQos < want {
+				want = subQos
+			}
+
+			publish := packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Publish,
+					Qos:  pubQos,
+				},
+				TopicName: "a/b",
+				Payload:   []byte("x"),
+			}
+			if pubQos > 0 {
+				publish.PacketID = 7
+			}
+
+			t.Run(fmt.Sprintf("publish %d subscribe %d live", pubQos, subQos), func(t *testing.T) {
+				s, cl, r, w := setupClient()
+				s.Clients.Add(cl)
+				s.Topics.Subscribe("a/b", cl.ID, subQos)
+				cl.NoteSubscription("a/b", subQos)
+
+				pub, _, _ := setupServerClient(s)
+				pub.ID = "pub"
+				s.Clients.Add(pub)
+
+				recv := make(chan []byte)
+				go func() {
+					buf, err := ioutil.ReadAll(r)
+					if err != nil {
+						panic(err)
+					}
+					recv <- buf
+				}()
+
+				require.NoError(t, s.processPacket(pub, publish))
+				time.Sleep(10 * time.Millisecond)
+				w.Close()
+
+				require.Equal(t, deliveredPublish(want, false), <-recv)
+				if want == 0 {
+					require.Equal(t, 0, cl.Inflight.Len())
+				} else {
+					in, ok := cl.Inflight.Get(1)
+					require.True(t, ok)
+					require.Equal(t, want, in.Packet.FixedHeader.Qos)
+				}
+			})
+
+			t.Run(fmt.Sprintf("publish %d subscribe %d retained", pubQos, subQos), func(t *testing.T) {
+				s, cl, r, w := setupClient()
+				s.Clients.Add(cl)
+
+				pub, _, _ := setupServerClient(s)
+				pub.ID = "pub"
+				s.Clients.Add(pub)
+
+				retained := publish
+				retained.FixedHeader.Retain = true
+				require.NoError(t, s.processPacket(pub, retained))
+
+				recv := make(chan []byte)
+				go func() {
+					buf, err := ioutil.ReadAll(r)
+					if err != nil {
+						panic(err)
+					}
+					recv <- buf
+				}()
+
+				err := s.processPacket(cl, packets.Packet{
+					FixedHeader: packets.FixedHeader{
+						Type: packets.Subscribe,
+					},
+					PacketID: 10,
+					Topics:   []string{"a/b"},
+					Qoss:     []byte{subQos},
+				})
+				require.NoError(t, err)
+				time.Sleep(10 * time.Millisecond)
+				w.Close()
+
+				require.Equal(t, append([]byte{
+					byte(packets.Suback << 4), 3, // Fixed header
+					0, 10, // Packet ID - LSB+MSB
+					subQos, // Return Code
+				}, deliveredPublish(want, true)...), <-recv)
+			})
+
+			t.Run(fmt.Sprintf("publish %d subscribe %d offline", pubQos, subQos), func(t *testing.T) {
+				s := New()
+				cl := clients.NewClientStub(s.System)
+				cl.ID = "mochi"
+				s.Clients.Add(cl)
+				s.Topics.Subscribe("a/b", cl.ID, subQos)
+				cl.NoteSubscription("a/b", subQos)
+
+				pub, _, _ := setupServerClient(s)
+				pub.ID = "pub"
+				s.Clients.Add(pub)
+
+				// messages for a disconnected session are held as inflight
+				// messages, which are resent at the same qos when it resumes.
+				require.NoError(t, s.processPacket(pub, publish))
+				if want == 0 {
+					require.Equal(t, 0, cl.Inflight.Len())
+					return
+				}
+
+				in, ok := cl.Inflight.Get(1)
+				require.True(t, ok)
+				require.Equal(t, want, in.Packet.FixedHeader.Qos)
+			})
+		}
+	}
+}
+
+func TestServerProcessSubscribeRetainedQos(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+			Qos:    2,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("x"),
+	})
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/b"},
+		Qoss:     []byte{1},
+	})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Suback << 4), 3, // Fixed header
+		0, 10, // Packet ID - LSB+MSB
+		1, // Return Code QoS 1
+
+		byte(packets.Publish<<4 | 1<<1 | 1), 8, // Fixed header, QoS 1
+		0, 3, // Topic Name - LSB+MSB
+		'a', '/', 'b', // Topic Name
+		0, 1, // Packet ID - LSB+MSB
+		'x', // Payload
+	}, <-recv)
+	require.Equal(t, 1, cl.Inflight.Len())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.RetainedReplays))
+}
+
+func TestServerPublishInlineTransform(t *testing.T) {
+	s, _, _, _ := setupClient()
+	tr := new(testTransform)
+	s.SetTransform("z/", tr)
+
+	err := s.Publish("z/a", []byte("hi"), 0, true)
+	require.NoError(t, err)
+
+	require.Len(t, tr.encoded, 1)
+	retained := s.Topics.Messages("z/a")
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("[hi]"), retained[0].Payload)
+
+	s.SetTransform("z/", &testTransform{failEncode: true})
+	err = s.Publish("z/a", []byte("hi"), 0, true)
+	require.Error(t, err)
+}
+
+func TestServerProcessPublishRateLimitDrop(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "mochi1"
+	cl1.ProtocolVersion = 5
+	s.Clients.Add(cl1)
+	s.SetRateLimit("telemetry/#", RateLimit{Rate: 0.001, Burst: 1})
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+	s.Topics.Subscribe("telemetry/#", cl2.ID, 1)
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	for i := 1; i <= 2; i++ {
+		err := s.processPacket(cl1, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: "telemetry/sensor",
+			Payload:   []byte("hello"),
+			PacketID:  uint16(i),
+		})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Puback << 4), 2,
+		0, 1,
+
+		byte(packets.Puback << 4), 4,
+		0, 2,
+		packets.CodeMessageRateTooHigh,
+		0, // Properties Length
+	}, <-ack1)
+
+	require.Equal(t, 1, cl2.Inflight.Len())
+	require.Equal(t, map[string]int64{"telemetry/#": 1}, s.RateLimitDropped())
+}
+
+func TestServerSetDedup(t *testing.T) {
+	s := NewServer(&Options{
+		Dedup: map[string]DedupWindow{"a/": {Property: "message-id"}},
+	})
+	require.Contains(t, s.dedups, "a/")
+	require.Equal(t, "message-id", s.dedupProps["a/"])
+
+	s.SetDedup("a/b/", DedupWindow{})
+	require.Len(t, s.dedups, 2)
+
+	s.ClearDedup("a/b/")
+	require.Len(t, s.dedups, 1)
+	require.NotContains(t, s.dedupProps, "a/b/")
+}
+
+func TestServerDuplicate(t *testing.T) {
+	s := New()
+	s.SetDedup("a/", DedupWindow{Property: "message-id"})
+	s.SetDedup("a/b/", DedupWindow{})
+
+	prop := func(topic, key, id string) packets.Packet {
+		return packets.Packet{
+			TopicName: topic,
+			Properties: packets.Properties{
+				User: []packets.UserProperty{{Key: key, Val: id}},
+			},
+		}
+	}
+
+	require.False(t, s.duplicate(prop("a/c", "message-id", "1")))
+	require.True(t, s.duplicate(prop("a/c", "message-id", "1")))
+	require.True(t, s.duplicate(prop("a/d", "message-id", "1")))
+	require.False(t, s.duplicate(prop("a/c", "other", "2")))
+	require.False(t, s.duplicate(prop("a/c", "other", "2"))) // messages without an id are never duplicates.
+	require.False(t, s.duplicate(prop("b/c", "message-id", "3")))
+	require.False(t, s.duplicate(prop("b/c", "message-id", "3"))) // no window for the topic.
+
+	// the window with the longest prefix uses the correlation data.
+	corr := packets.Packet{
+		TopicName:  "a/b/c",
+		Properties: packets.Properties{CorrelationData: []byte("1")},
+	}
+	require.False(t, s.duplicate(corr))
+	require.True(t, s.duplicate(corr))
+	require.False(t, s.duplicate(prop("a/b/c", "message-id", "4")))
+
+	require.Equal(t, int64(3), atomic.LoadInt64(&s.System.PublishDeduplicated))
+}
+
+func TestServerProcessPublishDedup(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "mochi1"
+	s.Clients.Add(cl1)
+	s.SetDedup("gateway/", DedupWindow{Property: "message-id", TTL: time.Minute, Size: 100})
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+	s.Topics.Subscribe("gateway/#", cl2.ID, 1)
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	for i := 1; i <= 2; i++ {
+		err := s.processPacket(cl1, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Qos:    1,
+				Retain: true,
+				Dup:    i > 1,
+			},
+			Properties: packets.Properties{
+				User: []packets.UserProperty{{Key: "message-id", Val: "m1"}},
+			},
+			TopicName: "gateway/sensor",
+			Payload:   []byte("hello"),
+			PacketID:  uint16(i),
+		})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Puback << 4), 2,
+		0, 1,
+
+		byte(packets.Puback << 4), 2,
+		0, 2,
+	}, <-ack1)
+
+	require.Equal(t, 1, cl2.Inflight.Len())
+	require.Len(t, s.Topics.Messages("gateway/sensor"), 1)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.PublishDeduplicated))
+}
+
+func TestServerProcessPublishRateLimitDisconnect(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	s.SetRateLimit("a/b/c", RateLimit{Rate: 0.001, Burst: 1, Action: RateLimitDisconnect})
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+
+	err := s.processPacket(cl, pk)
+	require.NoError(t, err)
+
+	err = s.processPacket(cl, pk)
+	require.ErrorIs(t, err, ErrRateLimitExceeded)
+
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, disconnectPacket(packets.CodeMessageRateTooHigh, "message rate too high"), <-recv)
+	require.Equal(t, map[string]int64{"a/b/c": 1}, s.RateLimitDropped())
+}
+
+func TestServerProcessPublishNotSupported(t *testing.T) {
+	tt := []struct {
+		desc   string
+		qos    byte
+		retain bool
+		err    error
+		code   byte
+	}{
+		{desc: "qos", qos: 2, err: ErrQosNotSupported, code: packets.CodeQosNotSupported},
+		{desc: "retain", qos: 1, retain: true, err: ErrRetainNotSupported, code: packets.CodeRetainNotSupported},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s, cl, r, w := setupClient()
+			cl.ProtocolVersion = 5
+			cl.Listener = "t1"
+			s.settings["t1"] = &listenerSettings{maxQos: 1, retainDisabled: true}
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(r)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			err := s.processPacket(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type:   packets.Publish,
+					Qos:    tx.qos,
+					Retain: tx.retain,
+				},
+				TopicName: "a/b/c",
+				Payload:   []byte("hello"),
+				PacketID:  12,
+			})
+			require.ErrorIs(t, err, tx.err)
+
+			time.Sleep(10 * time.Millisecond)
+			w.Close()
+
+			require.Equal(t, disconnectPacket(tx.code, err.Error()), <-recv)
+			require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Retained))
+		})
+	}
+}
+
+func TestServerProcessPublishInvalidTopic(t *testing.T) {
+	tt := []struct {
+		desc    string
+		version byte
+		topic   string
+		want    []byte
+	}{
+		{desc: "v3 wildcard", version: 4, topic: "a/+/c", want: []byte{}},
+		{desc: "v3 null", version: 4, topic: "a/\x00/c", want: []byte{}},
+		{desc: "v5 wildcard", version: 5, topic: "a/b/#", want: disconnectPacket(
+			packets.CodeTopicNameInvalid, "invalid topic name: contains wildcard",
+		)},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s, cl, r, w := setupClient()
+			cl.ProtocolVersion = tx.version
+			s.Clients.Add(cl)
+			s.Topics.Subscribe("#", cl.ID, 0)
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(r)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			err := s.processPacket(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Publish,
+				},
+				TopicName: tx.topic,
+				Payload:   []byte("hello"),
+			})
+			require.ErrorIs(t, err, ErrInvalidTopicName)
+
+			time.Sleep(10 * time.Millisecond)
+			w.Close()
+			require.Equal(t, tx.want, <-recv)
+		})
+	}
+}
+
+func TestServerProcessPublishTopicLimits(t *testing.T) {
+	tt := []struct {
+		desc    string
+		version byte
+		topic   string
+		want    []byte
+	}{
+		{desc: "v3 levels", version: 4, topic: "a/b/c/d", want: []byte{}},
+		{desc: "v3 length", version: 4, topic: "abcdefghijk", want: []byte{}},
+		{desc: "v5 levels", version: 5, topic: "a/b/c/d", want: disconnectPacket(
+			packets.CodeTopicNameInvalid, "invalid topic name: more than 3 levels",
+		)},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s, cl, r, w := setupClient()
+			s.Options.MaxTopicLevels = 3
+			s.Options.MaxTopicLength = 10
+			cl.ProtocolVersion = tx.version
+			s.Clients.Add(cl)
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(r)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			err := s.processPacket(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Publish,
+				},
+				TopicName: tx.topic,
+				Payload:   []byte("hello"),
+			})
+			require.ErrorIs(t, err, ErrInvalidTopicName)
+
+			time.Sleep(10 * time.Millisecond)
+			w.Close()
+			require.Equal(t, tx.want, <-recv)
+		})
+	}
+}
+
+func TestServerProcessPublishDowngradeV3(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "mochi1"
+	cl1.Listener = "t1"
+	s.settings["t1"] = &listenerSettings{maxQos: 1, retainDisabled: true}
+	s.Clients.Add(cl1)
+
+	cl2, r2, w2 := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+	s.Topics.Subscribe("a/b/c", cl2.ID, 2)
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	ack2 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r2)
+		if err != nil {
+			panic(err)
+		}
+		ack2 <- buf
+	}()
+
+	err := s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    2,
+			Retain: true,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+		PacketID:  12,
+	})
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+	w2.Close()
+
+	// The publish is acknowledged at the qos it was sent with...
+	require.Equal(t, []byte{
+		byte(packets.Pubrec << 4), 2,
+		0, 12,
+	}, <-ack1)
+
+	// ...but delivered at the listener's maximum qos, without being retained.
+	require.Equal(t, []byte{
+		byte(packets.Publish<<4 | 1<<1), 14,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		0, 1,
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack2)
+
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Retained))
+	require.Empty(t, s.Topics.Messages("a/b/c"))
+}
+
+func TestServerProcessPublishReceiveMaximum(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Options.ReceiveMaximum = 2
+	cl.ProtocolVersion = 5
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	publish := func(id uint16) packets.Packet {
+		return packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  2,
+			},
+			TopicName: "a/b/c",
+			Payload:   []byte("hello"),
+			PacketID:  id,
+		}
+	}
+
+	require.NoError(t, s.processPacket(cl, publish(1)))
+	require.NoError(t, s.processPacket(cl, publish(2)))
+	require.NoError(t, s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pubrel,
+			Qos:  1,
+		},
+		PacketID: 1,
+	}))
+	require.NoError(t, s.processPacket(cl, publish(3)))
+	require.ErrorIs(t, s.processPacket(cl, publish(4)), ErrReceiveMaximumExceeded)
+
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	buf := <-recv
+	want := disconnectPacket(packets.CodeReceiveMaximumExceeded, "receive maximum exceeded")
+	require.Equal(t, want, buf[len(buf)-len(want):])
+}
+
+func TestServerProcessPublishTopicAlias(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.ProtocolVersion = 5
+	cl.TopicAliases.InboundMaximum = 2
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "a/b/c",
+		Properties: packets.Properties{
+			TopicAlias: 2,
+		},
+		Payload: []byte("hello"),
+	}
+
+	err := s.processPacket(cl, pk)
+	require.NoError(t, err)
+
+	pk.TopicName = ""
+	pk.Payload = []byte("world")
+	err = s.processPacket(cl, pk)
+	require.NoError(t, err)
+
+	msgs := s.Topics.Messages("a/b/c")
+	require.Len(t, msgs, 1)
+	require.Equal(t, []byte("world"), msgs[0].Payload)
+	require.Equal(t, uint16(0), msgs[0].Properties.TopicAlias)
+}
+
+func TestServerProcessPublishTopicAliasInvalid(t *testing.T) {
+	tt := []struct {
+		desc  string
+		topic string
+		alias uint16
+		err   error
+		code  byte
+	}{
+		{desc: "above maximum", topic: "a/b/c", alias: 3, err: packets.ErrTopicAliasInvalid, code: packets.CodeTopicAliasInvalid},
+		{desc: "unknown alias", alias: 1, err: packets.ErrTopicAliasUnknown, code: packets.CodeProtocolError},
+	}
+
+	for _, wanted := range tt {
+		t.Run(wanted.desc, func(t *testing.T) {
+			s, cl, r, w := setupClient()
+			cl.ProtocolVersion = 5
+			cl.TopicAliases.InboundMaximum = 2
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(r)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			err := s.processPacket(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Publish,
+				},
+				TopicName: wanted.topic,
+				Properties: packets.Properties{
+					TopicAlias: wanted.alias,
+				},
+				Payload: []byte("hello"),
+			})
+			require.ErrorIs(t, err, wanted.err)
+
+			time.Sleep(10 * time.Millisecond)
+			w.Close()
+
+			require.Equal(t, disconnectPacket(wanted.code, err.Error()), <-recv)
+		})
+	}
+}
+
+func TestServerProcessPublishRateLimitThrottle(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.SetRateLimit("a/b/c", RateLimit{Rate: 20, Burst: 1, Action: RateLimitThrottle})
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := s.processPacket(cl, pk)
+		require.NoError(t, err)
+	}
+
+	require.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	require.Equal(t, map[string]int64{"a/b/c": 0}, s.RateLimitDropped())
+}
+
+func TestServerProcessPublishQoS1Retain(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "mochi1"
+	s.Clients.Add(cl1)
+
+	cl2, r2, w2 := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+
+	s.Topics.Subscribe("a/b/+", cl2.ID, 0)
+	s.Topics.Subscribe("a/+/c", cl2.ID, 1)
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	ack2 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r2)
+		if err != nil {
+			panic(err)
+		}
+		ack2 <- buf
+	}()
+
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.PublishRecv))
+
+	err := s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    1,
+			Retain: true,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+		PacketID:  12,
+	})
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+	w2.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Puback << 4), 2,
+		0, 12,
+	}, <-ack1)
+
+	require.Equal(t, []byte{
+		byte(packets.Publish<<4 | 2 | 3), 14,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		0, 1,
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack2)
+
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.Retained))
+}
+
+func TestServerProcessPublishQoS2(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Clients.Add(cl1)
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	err := s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  2,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+		PacketID:  12,
+	})
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Pubrec << 4), 2, // Fixed header
+		0, 12, // Packet ID - LSB+MSB
+	}, <-ack1)
+
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Retained))
+}
+
+func TestServerProcessPublishUnretainByEmptyPayload(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Clients.Add(cl1)
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	err := s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte{},
+	})
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Retained))
+}
+
+func TestServerProcessPublishOfflineQueuing(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "mochi1"
+	s.Clients.Add(cl1)
+
+	// Start and stop the receiver client
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "mochi2"
+	cl2.SessionExpiryInterval = clients.SessionExpiryNever
+	s.Clients.Add(cl2)
+	s.Topics.Subscribe("qos0", cl2.ID, 0)
+	s.Topics.Subscribe("qos1", cl2.ID, 1)
+	s.Topics.Subscribe("qos2", cl2.ID, 2)
+	cl2.Stop(errTestStop)
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	for i := 0; i < 3; i++ {
+		err := s.processPacket(cl1, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  byte(i),
+			},
+			TopicName: "qos" + strconv.Itoa(i),
+			Payload:   []byte("hello"),
+			PacketID:  uint16(i),
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.System.Inflight))
+
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Puback << 4), 2, // Qos1 Ack
+		0, 1,
+		byte(packets.Pubrec << 4), 2, // Qos2 Ack
+		0, 2,
+	}, <-ack1)
+
+	queued := cl2.Inflight.GetAll()
+	require.Equal(t, 2, len(queued))
+	require.Equal(t, "qos1", queued[1].Packet.TopicName)
+	require.Equal(t, "qos2", queued[2].Packet.TopicName)
+
+	// Reconnect the receiving client and get queued messages.
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 18, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			0,     // Packet Flags
+			0, 45, // Keepalive
+			0, 6, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', '2', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	clw, ok := s.Clients.Get("mochi2")
+	require.Equal(t, true, ok)
+	clw.Stop(errTestStop)
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+	ret := <-recv
+
+	wanted := []byte{
+		byte(packets.Connack << 4), 2,
+		1, packets.Accepted,
+		byte(packets.Publish<<4 | 1<<1 | 1<<3), 13,
+		0, 4,
+		'q', 'o', 's', '1',
+		0, 1,
+		'h', 'e', 'l', 'l', 'o',
+		byte(packets.Publish<<4 | 2<<1 | 1<<3), 13,
+		0, 4,
+		'q', 'o', 's', '2',
+		0, 2,
+		'h', 'e', 'l', 'l', 'o',
+	}
+
+	require.Equal(t, len(wanted), len(ret))
+	require.Equal(t, true, (ret[4] == byte(packets.Publish<<4|1<<1|1<<3) || ret[4] == byte(packets.Publish<<4|2<<1|1<<3)))
+
+	w.Close()
+}
+
+func TestServerProcessPublishSystemPrefix(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "$SYS/stuff",
+		Payload:   []byte("hello"),
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.BytesSent))
+}
+
+func TestServerProcessPublishBadACL(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.AC = new(auth.Disallow)
+	s.Clients.Add(cl)
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+
+	require.NoError(t, err)
+}
+
+// routeAuth only allows access to packets with a matching route user property.
+type routeAuth struct {
+	auth.Allow
+	route string
+}
+
+func (a *routeAuth) ACLProperties(user []byte, topic string, write bool, props []packets.UserProperty) bool {
+	for _, p := range props {
+		if p.Key == "route" && p.Val == a.route {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestServerProcessPublishACLProperties(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.AC = &routeAuth{route: "a"}
+	s.Clients.Add(cl)
+
+	for _, route := range []string{"b", "a"} {
+		err := s.processPacket(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Retain: true,
+			},
+			Properties: packets.Properties{
+				User: []packets.UserProperty{{Key: "route", Val: route}},
+			},
+			TopicName: "a/b/c/" + route,
+			Payload:   []byte("hello"),
+		})
+		require.NoError(t, err)
+	}
+
+	require.Empty(t, s.Topics.Messages("a/b/c/b"))
+	require.Len(t, s.Topics.Messages("a/b/c/a"), 1)
+}
+
+func TestServerProcessSubscribeACLProperties(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.AC = &routeAuth{route: "a"}
+	s.Clients.Add(cl)
+
+	for _, route := range []string{"b", "a"} {
+		err := s.processPacket(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Subscribe,
+			},
+			Properties: packets.Properties{
+				User: []packets.UserProperty{{Key: "route", Val: route}},
+			},
+			PacketID: 10,
+			Topics:   []string{"a/b/c/" + route},
+			Qoss:     []byte{0},
+		})
+		require.NoError(t, err)
+	}
+
+	require.Empty(t, s.Topics.Subscribers("a/b/c/b"))
+	require.Contains(t, s.Topics.Subscribers("a/b/c/a"), cl.ID)
+}
+
+// countingAuth counts the ACL checks it makes, allowing them while allow is set.
+type countingAuth struct {
+	auth.Allow
+	allow bool
+	calls int
+}
+
+func (a *countingAuth) ACL(user []byte, topic string, write bool) bool {
+	a.calls++
+	return a.allow
+}
+
+// aclOK checks the access of a client to a topic, requiring the check to succeed.
+func aclOK(t *testing.T, s *Server, cl *clients.Client, topic string, write bool, props []packets.UserProperty) bool {
+	ok, err := s.aclAllowed(cl, topic, write, props)
+	require.NoError(t, err)
+	return ok
+}
+
+func TestServerACLCache(t *testing.T) {
+	s := NewServer(&Options{ACLCacheSize: 10})
+	cl, _, _ := setupServerClient(s)
+	ac := &countingAuth{allow: true}
+	cl.AC = ac
+	cl.Listener = "t1"
+	cl.Username = []byte("mochi")
+
+	require.True(t, aclOK(t, s, cl, "a/b", true, nil))
+	require.True(t, aclOK(t, s, cl, "a/b", true, nil))
+	require.Equal(t, 1, ac.calls)
+
+	require.True(t, aclOK(t, s, cl, "a/b", false, nil))
+	require.Equal(t, 2, ac.calls)
+
+	ac.allow = false
+	require.True(t, aclOK(t, s, cl, "a/b", true, nil))
+	require.Equal(t, 2, ac.calls)
+
+	s.InvalidateACL("other")
+	require.True(t, aclOK(t, s, cl, "a/b", true, nil))
+
+	s.InvalidateACL("mochi")
+	require.False(t, aclOK(t, s, cl, "a/b", true, nil))
+	require.False(t, aclOK(t, s, cl, "a/b", false, nil))
+	require.Equal(t, 4, ac.calls)
+}
+
+// identityAuth allows access to the topic named by the identity of the client.
+type identityAuth struct {
+	auth.Disallow
+	calls int
+}
+
+func (a *identityAuth) ACLIdentity(identity interface{}, user []byte, topic string, write bool) (bool, error) {
+	a.calls++
+	if topic == "down" {
+		return false, errors.New("backend unavailable")
+	}
+	return identity == topic, nil
+}
+
+func TestServerACLIdentity(t *testing.T) {
+	s := NewServer(&Options{ACLCacheSize: 10})
+	ac := new(identityAuth)
+	cl1, _, _ := setupServerClient(s)
+	cl1.AC = ac
+	cl1.Username = []byte("mochi")
+	cl1.Identity = "a/b"
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.AC = ac
+	cl2.Username = []byte("mochi")
+	cl2.Identity = "c/d"
+
+	// clients with the same username are checked with their own identity,
+	// and the results are not cached.
+	require.True(t, aclOK(t, s, cl1, "a/b", true, nil))
+	require.False(t, aclOK(t, s, cl2, "a/b", true, nil))
+	require.True(t, aclOK(t, s, cl2, "c/d", true, nil))
+	require.True(t, aclOK(t, s, cl1, "a/b", true, nil))
+	require.Equal(t, 4, ac.calls)
+
+	ok, err := s.aclAllowed(cl1, "down", true, nil)
+	require.ErrorIs(t, err, ErrACLCheckFailed)
+	require.False(t, ok)
+}
+
+func TestServerACLCacheListeners(t *testing.T) {
+	s := NewServer(&Options{ACLCacheSize: 10})
+	cl, _, _ := setupServerClient(s)
+	cl.AC = new(auth.Allow)
+	cl.Listener = "t1"
+	require.True(t, aclOK(t, s, cl, "a/b", true, nil))
+
+	cl.AC = new(auth.Disallow)
+	cl.Listener = "t2"
+	require.False(t, aclOK(t, s, cl, "a/b", true, nil))
+}
+
+func TestServerACLCacheTTL(t *testing.T) {
+	s := NewServer(&Options{ACLCacheSize: 10, ACLCacheTTL: time.Millisecond})
+	cl, _, _ := setupServerClient(s)
+	ac := &countingAuth{allow: true}
+	cl.AC = ac
+
+	require.True(t, aclOK(t, s, cl, "a/b", true, nil))
+	time.Sleep(5 * time.Millisecond)
+	require.True(t, aclOK(t, s, cl, "a/b", true, nil))
+	require.Equal(t, 2, ac.calls)
+}
+
+func TestServerACLCacheDisabled(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	require.Nil(t, s.aclCache)
+	ac := &countingAuth{allow: true}
+	cl.AC = ac
+
+	require.True(t, aclOK(t, s, cl, "a/b", true, nil))
+	require.True(t, aclOK(t, s, cl, "a/b", true, nil))
+	require.Equal(t, 2, ac.calls)
+	s.InvalidateACL("mochi")
+}
+
+func TestServerACLCacheProperties(t *testing.T) {
+	s := NewServer(&Options{ACLCacheSize: 10})
+	cl, _, _ := setupServerClient(s)
+	cl.AC = &routeAuth{route: "a"}
+
+	a := []packets.UserProperty{{Key: "route", Val: "a"}}
+	b := []packets.UserProperty{{Key: "route", Val: "b"}}
+	require.True(t, aclOK(t, s, cl, "a/b", true, a))
+	require.False(t, aclOK(t, s, cl, "a/b", true, b))
+	require.Equal(t, 0, s.aclCache.Len())
+}
+
+func TestServerProcessPublishACLCache(t *testing.T) {
+	s := NewServer(&Options{ACLCacheSize: 10})
+	s.Store = new(persistence.MockStore)
+	cl, _, _ := setupServerClient(s)
+	ac := &countingAuth{allow: true}
+	cl.AC = ac
+	s.Clients.Add(cl)
+
+	for i := 0; i < 2; i++ {
+		err := s.processPacket(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Retain: true,
+			},
+			TopicName: "a/b/c",
+			Payload:   []byte("hello"),
+		})
+		require.NoError(t, err)
+	}
+
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
+	require.Equal(t, 1, ac.calls)
+}
+
+func TestServerStoreUserProperties(t *testing.T) {
+	s, cl1, _, _ := setupClient()
+	store := mem.New()
+	s.Store = store
+	cl1.ProtocolVersion = 5
+	cl1.SessionExpiryInterval = clients.SessionExpiryNever
+	s.Clients.Add(cl1)
+	s.storeClient(cl1)
+	s.Topics.Subscribe("a/b/c", cl1.ID, 1)
+	cl1.NoteSubscription("a/b/c", 1)
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "zen"
+	cl2.ProtocolVersion = 5
+
+	user := []packets.UserProperty{
+		{Key: "route", Val: "b"},
+		{Key: "tenant", Val: "mochi"},
+		{Key: "route", Val: "a"},
+	}
+	err := s.processPublish(cl2, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    1,
+			Retain: true,
+		},
+		Properties: packets.Properties{
+			User: user,
+		},
+		PacketID:  7,
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+	require.NoError(t, err)
+
+	in, ok := cl1.Inflight.Get(1)
+	require.True(t, ok)
+	require.Equal(t, user, in.Packet.Properties.User)
+
+	s = New()
+	s.Store = store
+	require.NoError(t, s.readStore())
+
+	retained := s.Topics.Messages("a/b/c")
+	require.Len(t, retained, 1)
+	require.Equal(t, user, retained[0].Properties.User)
+
+	restored, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	in, ok = restored.Inflight.Get(1)
+	require.True(t, ok)
+	require.Equal(t, user, in.Packet.Properties.User)
+}
+
+func TestServerProcessPublishWriteAckError(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Stop(errTestStop)
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+
+	require.Error(t, err)
+	require.Equal(t, errTestStop, cl.StopCause())
+}
+
+func TestServerMaxInflight(t *testing.T) {
+	s := NewServer(&Options{MaxInflight: 5})
+	require.Equal(t, 5, s.MaxInflight())
+
+	s.SetMaxInflight(10)
+	require.Equal(t, 10, s.MaxInflight())
+
+	s.SetMaxInflight(-1)
+	require.Equal(t, 0, s.MaxInflight())
+}
+
+func TestServerStats(t *testing.T) {
+	s := New()
+	s.System.Started = time.Now().Unix() - 60
+	s.System.ClientsConnected = 2
+	s.System.Subscriptions = 3
+	s.System.Retained = 4
+	s.System.Inflight = 5
+	s.System.MessagesRecv = 6
+	s.System.MessagesSent = 7
+	s.System.PublishRecv = 8
+	s.System.PublishSent = 9
+	s.System.BytesRecv = 10
+	s.System.BytesSent = 11
+
+	stats := s.Stats()
+	require.GreaterOrEqual(t, stats.Uptime, int64(60))
+	stats.Uptime = 0
+	require.Equal(t, Stats{
+		ClientsConnected: 2,
+		Subscriptions:    3,
+		Retained:         4,
+		Inflight:         5,
+		MessagesRecv:     6,
+		MessagesSent:     7,
+		PublishRecv:      8,
+		PublishSent:      9,
+		BytesRecv:        10,
+		BytesSent:        11,
+	}, stats)
+}
+
+func BenchmarkServerStats(b *testing.B) {
+	s := New()
+	for n := 0; n < b.N; n++ {
+		s.Stats()
+	}
+}
+
+func TestServerConnectedClients(t *testing.T) {
+	s := New()
+	cl1, _, _ := setupServerClient(s)
+	cl1.ID = "b"
+	cl1.Username = []byte("user")
+	cl1.Listener = "tcp1"
+	cl1.ProtocolVersion = 5
+	cl1.NoteSubscription("a/b/c", 1)
+	cl1.NoteSubscription("d/e/f", 0)
+	cl1.Inflight.Set(1, clients.InflightMessage{})
+	s.Clients.Add(cl1)
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "a"
+	cl2.CleanSession = true
+	s.Clients.Add(cl2)
+
+	cl3, _, _ := setupServerClient(s)
+	cl3.ID = "c"
+	cl3.Stop(nil)
+	s.Clients.Add(cl3)
+
+	summaries := s.ConnectedClients()
+	require.Len(t, summaries, 2)
+	require.Equal(t, "a", summaries[0].ID)
+	require.True(t, summaries[0].CleanSession)
+	require.Equal(t, ClientSummary{
+		ID:              "b",
+		Remote:          "pipe",
+		Listener:        "tcp1",
+		Username:        "user",
+		ConnectedAt:     cl1.ConnectedAt,
+		Subscriptions:   2,
+		ProtocolVersion: 5,
+		PacketIDs:       1,
+	}, summaries[1])
+}
+
+func TestServerHealth(t *testing.T) {
+	s := New()
+	ok, status := s.Health()
+	require.False(t, ok)
+	require.Equal(t, map[string]string{"store": "none"}, status)
+
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"), nil)
+	require.NoError(t, err)
+	ok, status = s.Health()
+	require.False(t, ok)
+	require.Equal(t, "not serving", status["listener:t1"])
+
+	s.Listeners.Serve("t1", s.EstablishConnection)
+	require.Eventually(t, func() bool {
+		ok, _ := s.Health()
+		return ok
+	}, time.Second, time.Millisecond)
+	_, status = s.Health()
+	require.Equal(t, "serving", status["listener:t1"])
+
+	err = s.AddStore(new(persistence.MockStore))
+	require.NoError(t, err)
+	s.onStorage(&s.inline, "WriteInflight", errors.New("test"))
+	ok, status = s.Health()
+	require.True(t, ok)
+	require.Equal(t, "open", status["store"])
+	require.Equal(t, "test", status["store_error"])
+
+	s.Listeners.Close("t1", listeners.MockCloser)
+	require.Eventually(t, func() bool {
+		ok, _ := s.Health()
+		return !ok
+	}, time.Second, time.Millisecond)
+	_, status = s.Health()
+	require.Equal(t, "not serving", status["listener:t1"])
+}
+
+func TestServerHealthStoreFailed(t *testing.T) {
+	s := New()
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"), nil)
+	require.NoError(t, err)
+	s.Listeners.Serve("t1", s.EstablishConnection)
+	require.Eventually(t, func() bool {
+		return s.Listeners.Serving()["t1"]
+	}, time.Second, time.Millisecond)
+	defer s.Listeners.Close("t1", listeners.MockCloser)
+
+	err = s.AddStore(&persistence.MockStore{FailOpen: true})
+	require.Error(t, err)
+
+	ok, status := s.Health()
+	require.False(t, ok)
+	require.Equal(t, "failed: test", status["store"])
+}
+
+// closedStore is a store which reports that it is not open.
+type closedStore struct {
+	persistence.MockStore
+}
+
+// IsOpen returns false.
+func (s *closedStore) IsOpen() bool {
+	return false
+}
+
+func TestServerHealthStoreClosed(t *testing.T) {
+	s := New()
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"), nil)
+	require.NoError(t, err)
+	s.Listeners.Serve("t1", s.EstablishConnection)
+	require.Eventually(t, func() bool {
+		return s.Listeners.Serving()["t1"]
+	}, time.Second, time.Millisecond)
+	defer s.Listeners.Close("t1", listeners.MockCloser)
+
+	err = s.AddStore(new(closedStore))
+	require.NoError(t, err)
+
+	ok, status := s.Health()
+	require.False(t, ok)
+	require.Equal(t, "closed", status["store"])
+}
+
+func TestServerClientSubscriptions(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID:   10,
+		Topics:     []string{"d/e/f", "$share/g/a/b", "a/b/c"},
+		Qoss:       []byte{2, 0, 1},
+		SubOptions: []packets.SubOptions{{}, {}, {RetainAsPublished: true, RetainHandling: 1}},
+	})
+	require.NoError(t, err)
+
+	subs, err := s.ClientSubscriptions("mochi")
+	require.NoError(t, err)
+	require.Equal(t, []SubscriptionSummary{
+		{Filter: "$share/g/a/b", Qos: 0},
+		{Filter: "a/b/c", Qos: 1, RetainAsPublished: true, RetainHandling: 1},
+		{Filter: "d/e/f", Qos: 2},
+	}, subs)
+
+	offline, _, _ := setupServerClient(s)
+	offline.ID = "offline"
+	offline.NoteSubscription("a/b/c", 1)
+	offline.Stop(nil)
+	s.Clients.Add(offline)
+	_, err = s.ClientSubscriptions("offline")
+	require.ErrorIs(t, err, ErrClientNotConnected)
+
+	_, err = s.ClientSubscriptions("unknown")
+	require.ErrorIs(t, err, ErrClientNotConnected)
+}
+
+func TestServerDisconnectClient(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.DisconnectClient("mochi")
+	require.NoError(t, err)
+	require.ErrorIs(t, cl.StopCause(), ErrAdminDisconnect)
+	w.Close()
+
+	buf := <-recv
+	require.Equal(t, []byte{
+		byte(packets.Disconnect << 4), 34,
+		packets.CodeAdministrativeAction,
+		32, packets.PropReasonString, 0, 29,
+	}, buf[:7])
+	require.Equal(t, "disconnected by administrator", string(buf[7:]))
+
+	err = s.DisconnectClient("mochi")
+	require.ErrorIs(t, err, ErrClientNotConnected)
+}
+
+func TestServerDisconnectClientUnknown(t *testing.T) {
+	s := New()
+	err := s.DisconnectClient("mochi")
+	require.ErrorIs(t, err, ErrClientNotConnected)
+}
+
+func TestServerClientInflight(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+
+	_, ok := s.ClientInflight("unknown")
+	require.False(t, ok)
+
+	cl.Inflight.Set(1, clients.InflightMessage{})
+	n, ok := s.ClientInflight(cl.ID)
+	require.True(t, ok)
+	require.Equal(t, 1, n)
+}
+
+func TestServerPublishInflightSequence(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+	s.inflightSeq = 10
+
+	for i := 0; i < 2; i++ {
+		s.publishToSubscribers(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: "a/b/c",
+			Payload:   []byte("hello"),
+		})
+	}
+
+	msgs := cl.Inflight.GetOrdered()
+	require.Len(t, msgs, 2)
+	require.Equal(t, int64(11), msgs[0].Sequence)
+	require.Equal(t, int64(12), msgs[1].Sequence)
+	require.Less(t, msgs[0].Packet.PacketID, msgs[1].Packet.PacketID)
+}
+
+func TestServerPublishInflightQuotaDrop(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+	s.SetMaxInflight(1)
+	cl.Inflight.Set(1, clients.InflightMessage{})
+
+	s.publishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+
+	require.Equal(t, 1, cl.Inflight.Len())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.PublishDropped))
+	require.Nil(t, cl.StopCause())
+}
+
+func TestServerPublishInflightQuotaDisconnect(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Options.InflightOverflow = InflightDisconnect
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+	s.SetMaxInflight(1)
+	cl.Inflight.Set(1, clients.InflightMessage{})
+
+	s.publishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+
+	require.Equal(t, 1, cl.Inflight.Len())
+	require.ErrorIs(t, cl.StopCause(), ErrInflightQuotaExceeded)
+}
+
+// filterPublish publishes a qos 1 message with a payload to subscribers of a/b/c.
+func filterPublish(s *Server, payload string) {
+	s.publishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte(payload),
+	})
+}
+
+func TestServerDeliveryFilter(t *testing.T) {
+	s, cl1, _, _ := setupClient()
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/c", cl1.ID, 1)
+	cl1.NoteSubscription("a/b/c", 1)
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+	s.Topics.Subscribe("a/b/c", cl2.ID, 1)
+	cl2.NoteSubscription("a/b/c", 1)
+
+	s.SetDeliveryFilter(cl1.ID, "a/b/c", func(ctx context.Context, cl events.Client, pk events.Packet) bool {
+		return string(pk.Payload) == "yes"
+	})
+
+	filterPublish(s, "no")
+	filterPublish(s, "yes")
+	require.Equal(t, 1, cl1.Inflight.Len())
+	require.Equal(t, 2, cl2.Inflight.Len())
+
+	s.ClearDeliveryFilter(cl1.ID, "a/b/c")
+	require.Empty(t, s.deliveryFilters)
+	filterPublish(s, "no")
+	require.Equal(t, 2, cl1.Inflight.Len())
+}
+
+func TestServerDeliveryFilterOverlapping(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+	s.Topics.Subscribe("a/#", cl.ID, 1)
+	cl.NoteSubscription("a/b/c", 1)
+	cl.NoteSubscription("a/#", 1)
+
+	deny := func(ctx context.Context, cl events.Client, pk events.Packet) bool { return false }
+	s.SetDeliveryFilter(cl.ID, "a/b/c", deny)
+	filterPublish(s, "hello")
+	require.Equal(t, 1, cl.Inflight.Len())
+
+	s.SetDeliveryFilter(cl.ID, "a/#", deny)
+	filterPublish(s, "hello")
+	require.Equal(t, 1, cl.Inflight.Len())
+}
+
+func TestServerDeliveryFilterShared(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("$share/g1/a/b/c", cl.ID, 1)
+	cl.NoteSubscription("$share/g1/a/b/c", 1)
+
+	s.SetDeliveryFilter(cl.ID, "$share/g1/a/b/c", func(ctx context.Context, cl events.Client, pk events.Packet) bool {
+		return string(pk.Payload) == "yes"
+	})
+
+	filterPublish(s, "no")
+	require.Equal(t, 0, cl.Inflight.Len())
+	filterPublish(s, "yes")
+	require.Equal(t, 1, cl.Inflight.Len())
+}
+
+func TestServerDeliveryFilterFaulty(t *testing.T) {
+	tt := []struct {
+		desc   string
+		filter DeliveryFilter
+		log    string
+	}{
+		{
+			desc: "timeout",
+			filter: func(ctx context.Context, cl events.Client, pk events.Packet) bool {
+				<-ctx.Done()
+				return false
+			},
+			log: "delivery filter timed out",
+		},
+		{
+			desc: "panic",
+			filter: func(ctx context.Context, cl events.Client, pk events.Packet) bool {
+				panic("test")
+			},
+			log: "delivery filter panicked",
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			l := new(testLogger)
+			s, cl, _, _ := setupClient()
+			s.Options.Logger = l
+			s.Options.DeliveryFilterTimeout = 5 * time.Millisecond
+			s.Clients.Add(cl)
+			s.Topics.Subscribe("a/b/c", cl.ID, 1)
+			cl.NoteSubscription("a/b/c", 1)
+			s.SetDeliveryFilter(cl.ID, "a/b/c", tx.filter)
+
+			filterPublish(s, "hello")
+			require.Equal(t, 1, cl.Inflight.Len())
+			_, ok := l.find(tx.log)
+			require.True(t, ok)
+		})
+	}
+}
+
+func TestServerDeliveryFilterIgnoresContext(t *testing.T) {
+	s, cl, r, _ := setupClient()
+	go io.Copy(io.Discard, r)
+	s.Options.Logger = new(testLogger)
+	s.Options.DeliveryFilterTimeout = 5 * time.Millisecond
+	s.deliveryFilterSlots = make(chan struct{}, 2)
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+	cl.NoteSubscription("a/b/c", 1)
+
+	block := make(chan struct{})
+	var returned int64
+	s.SetDeliveryFilter(cl.ID, "a/b/c", func(ctx context.Context, cl events.Client, pk events.Packet) bool {
+		<-block // ignores the context.
+		atomic.AddInt64(&returned, 1)
+		return false
+	})
+
+	n := runtime.NumGoroutine()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		filterPublish(s, "hello")
+	}
+
+	// every message is delivered at the deadline, without waiting for the
+	// filter, and no more than the pool size of filters are left running.
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, 10, cl.Inflight.Len())
+	require.LessOrEqual(t, runtime.NumGoroutine(), n+2)
+
+	// the late rejections are discarded, and free the workers.
+	close(block)
+	require.Eventually(t, func() bool {
+		return len(s.deliveryFilterSlots) == 0
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int64(2), atomic.LoadInt64(&returned))
+	require.Equal(t, 10, cl.Inflight.Len())
+}
+
+func TestServerDeliveryFilterWorkersDefault(t *testing.T) {
+	s := New()
+	require.Equal(t, defaultDeliveryFilterWorkers, s.Options.DeliveryFilterWorkers)
+	require.Equal(t, defaultDeliveryFilterWorkers, cap(s.deliveryFilterSlots))
+}
+
+func TestServerDeliveryFilterRemoved(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	allow := func(ctx context.Context, cl events.Client, pk events.Packet) bool { return true }
+
+	s.SetDeliveryFilter(cl.ID, "a/b/c", allow)
+	s.SetDeliveryFilter(cl.ID, "d/e/f", allow)
+	err := s.processUnsubscribe(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Unsubscribe,
+		},
+		PacketID: 1,
+		Topics:   []string{"a/b/c"},
+	})
+	require.NoError(t, err)
+	require.Len(t, s.deliveryFilters[cl.ID], 1)
+
+	s.unsubscribeClient(cl)
+	require.Empty(t, s.deliveryFilters)
+}
+
+func TestJSONPathFilter(t *testing.T) {
+	hot := JSONPathFilter("sensor.readings.1.temp", func(v interface{}) bool {
+		f, ok := v.(float64)
+		return ok && f > 30
+	})
+
+	tt := []struct {
+		payload string
+		expect  bool
+	}{
+		{payload: `{"sensor":{"readings":[{"temp":20},{"temp":35}]}}`, expect: true},
+		{payload: `{"sensor":{"readings":[{"temp":20},{"temp":25}]}}`},
+		{payload: `{"sensor":{"readings":[{"temp":20}]}}`},
+		{payload: `{"sensor":{"readings":{"1":{"temp":35}}}}`, expect: true},
+		{payload: `{"sensor":{"readings":"none"}}`},
+		{payload: `{"sensor":{}}`},
+		{payload: `not json`},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.payload, func(t *testing.T) {
+			require.Equal(t, tx.expect, hot(context.Background(), events.Client{}, events.Packet{Payload: []byte(tx.payload)}))
+		})
+	}
+}
+
+// setupSlowConsumer returns a server with a subscriber whose connection is not
+// being written to, so packets sent to it stay in its write buffer.
+func setupSlowConsumer(policy SlowConsumer, qos byte) (*Server, *clients.Client) {
+	s := New()
+	s.Options.WriteHighWater = 10
+	s.Options.SlowConsumer = policy
+
+	_, w := net.Pipe()
+	cl := clients.NewClient(w, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
+	cl.ID = "mochi"
+	cl.AC = new(auth.Allow)
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, qos)
+
+	for i := 0; i < 2; i++ {
+		s.publishToSubscribers(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  qos,
+			},
+			TopicName: "a/b/c",
+			Payload:   []byte("hello"),
+		})
+	}
+
+	return s, cl
+}
+
+func TestServerPublishSlowConsumerBlock(t *testing.T) {
+	s, cl := setupSlowConsumer(SlowConsumerBlock, 0)
+	require.Equal(t, 2*14, cl.WriteBuffered()) // both messages are written.
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.PublishDropped))
+	require.Equal(t, map[string]int{"mochi": 2 * 14}, s.WriteBuffered())
+}
+
+func TestServerPublishSlowConsumerDrop(t *testing.T) {
+	s, cl := setupSlowConsumer(SlowConsumerDrop, 0)
+	require.Equal(t, 14, cl.WriteBuffered())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.PublishDropped))
+	require.Nil(t, cl.StopCause())
+}
+
+func TestServerPublishSlowConsumerDropQos(t *testing.T) {
+	s, cl := setupSlowConsumer(SlowConsumerDrop, 1)
+	require.Equal(t, 16, cl.WriteBuffered())
+	require.Equal(t, 2, cl.Inflight.Len()) // the second message is resent later.
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.PublishDropped))
+}
+
+func TestServerPublishSlowConsumerDisconnect(t *testing.T) {
+	s, cl := setupSlowConsumer(SlowConsumerDisconnect, 1)
+	require.Equal(t, 1, cl.Inflight.Len())
+	require.ErrorIs(t, cl.StopCause(), ErrSlowConsumer)
+	require.Empty(t, s.WriteBuffered())
+}
+
+func TestServerPublishReceiveMaximum(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ReceiveMaximum = 2
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	for _, payload := range []string{"a", "b", "c", "d"} {
+		s.publishToSubscribers(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: "a/b/c",
+			Payload:   []byte(payload),
+		})
+	}
+
+	require.Equal(t, 2, cl.Inflight.Len())
+	require.Equal(t, 2, cl.Inflight.QueueLen())
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.System.Inflight))
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Puback,
+		},
+		PacketID: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, cl.Inflight.Len())
+	require.Equal(t, 1, cl.Inflight.QueueLen())
+
+	err = s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pubcomp,
+		},
+		PacketID: 2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, cl.Inflight.Len())
+	require.Equal(t, 0, cl.Inflight.QueueLen())
+
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	publish := func(id byte, payload byte) []byte {
+		return []byte{
+			byte(packets.Publish<<4 | 1<<1), 10,
+			0, 5, 'a', '/', 'b', '/', 'c',
+			0, id,
+			payload,
+		}
+	}
+
+	want := append(publish(1, 'a'), publish(2, 'b')...)
+	want = append(want, publish(3, 'c')...)
+	want = append(want, publish(4, 'd')...)
+	require.Equal(t, want, <-recv)
+}
+
+func TestServerPublishReceiveMaximumQuota(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.ReceiveMaximum = 1
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+	s.SetMaxInflight(2)
+
+	for i := 0; i < 3; i++ {
+		s.publishToSubscribers(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: "a/b/c",
+			Payload:   []byte("hello"),
+		})
+	}
+
+	require.Equal(t, 1, cl.Inflight.Len())
+	require.Equal(t, 1, cl.Inflight.QueueLen())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.PublishDropped))
+}
+
+func TestServerPublishInline(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "inline"
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+	go s.inlineClient()
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	err := s.Publish("a/b/c", []byte("hello"), 0, false)
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 12,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack1)
+
+	require.Equal(t, int64(14), atomic.LoadInt64(&s.System.BytesSent))
+
+	close(s.inline.done)
+}
+
+func TestServerPublishInlineRetain(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "inline"
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	err := s.Publish("a/b/c", []byte("hello"), 0, true)
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+	go s.inlineClient()
+
+	time.Sleep(10 * time.Millisecond)
+
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish<<4 | 1), 12,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack1)
+
+	require.Equal(t, int64(14), atomic.LoadInt64(&s.System.BytesSent))
+
+	close(s.inline.done)
+}
+
+func TestServerPublishSysTopics(t *testing.T) {
+	s := New()
+	s.Topics.Subscribe("$SYS/#", "sys", 0)
+	s.Topics.Subscribe("#", "all", 0)
+	atomic.StoreInt64(&s.System.ClientsConnected, 3)
+
+	s.publishSysTopics()
+	msgs := s.Topics.Messages("$SYS/broker/clients/connected")
+	require.Len(t, msgs, 1)
+	require.Equal(t, []byte("3"), msgs[0].Payload)
+	require.True(t, msgs[0].FixedHeader.Retain)
+	require.NotEmpty(t, s.Topics.Messages("$SYS/broker/uptime"))
+	require.NotEmpty(t, s.Topics.Messages("$SYS/broker/messages/received"))
+
+	// Per [MQTT-4.7.2-1], $ topics are not matched by filters starting with a wildcard.
+	require.Empty(t, s.Topics.Messages("#"))
+	subs := s.Topics.Subscribers("$SYS/broker/uptime")
+	require.Contains(t, subs, "sys")
+	require.NotContains(t, subs, "all")
+}
+
+func TestServerPublishSysTopicsRetainedCount(t *testing.T) {
+	s := New()
+	s.publishSysTopics()
+	n := s.Stats().Retained
+	require.Equal(t, int64(len(s.Topics.Messages("$SYS/#"))), n)
+
+	// republishing the $SYS topics replaces their retained messages, rather
+	// than adding to the count.
+	s.publishSysTopics()
+	s.publishSysTopics()
+	require.Equal(t, n, s.Stats().Retained)
+	require.Equal(t, n, s.Topics.RetainedCount())
+}
+
+func TestServerPublishSysTopicsFiltered(t *testing.T) {
+	s := NewServer(&Options{
+		SysTopics: []string{"$SYS/broker/clients/#", "$SYS/broker/uptime"},
+	})
+
+	s.publishSysTopics()
+	require.Len(t, s.Topics.Messages("$SYS/broker/clients/+"), 4)
+	require.Len(t, s.Topics.Messages("$SYS/broker/uptime"), 1)
+	require.Empty(t, s.Topics.Messages("$SYS/broker/messages/#"))
+	require.Empty(t, s.Topics.Messages("$SYS/broker/version"))
+}
+
+func TestServerSysTopicEnabled(t *testing.T) {
+	s := New()
+	require.True(t, s.sysTopicEnabled("$SYS/broker/uptime"))
+
+	s.Options.SysTopics = []string{"$SYS/broker/load/#"}
+	require.True(t, s.sysTopicEnabled("$SYS/broker/load/bytes/sent"))
+	require.False(t, s.sysTopicEnabled("$SYS/broker/uptime"))
+}
+
+func TestServerPublishInlineSysTopicError(t *testing.T) {
+	s, _, _, _ := setupClient()
+
+	err := s.Publish("$SYS/stuff", []byte("hello"), 0, false)
+	require.Error(t, err)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.BytesSent))
+}
+
+func TestServerPublishInlineInvalidTopic(t *testing.T) {
+	s, _, _, _ := setupClient()
+
+	err := s.Publish("a/+/c", []byte("hello"), 0, false)
+	require.ErrorIs(t, err, ErrInvalidTopicName)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.BytesSent))
+}
+
+func TestValidateTopicName(t *testing.T) {
+	tt := []struct {
+		topic string
+		valid bool
+	}{
+		{topic: "a/b/c", valid: true},
+		{topic: "/", valid: true},
+		{topic: "a//c", valid: true},
+		{topic: "$SYS/broker", valid: true},
+		{topic: "sport/tennis/ü", valid: true},
+		{topic: ""},
+		{topic: "a/+/c"},
+		{topic: "a/b/#"},
+		{topic: "a/b+"},
+		{topic: "a/\x00/c"},
+		{topic: "a/\xc3\x28/c"},
+		{topic: strings.Repeat("a", 65536)},
+	}
+
+	for i, tx := range tt {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			err := ValidateTopicName(tx.topic)
+			if tx.valid {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrInvalidTopicName)
+		})
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	tt := []struct {
+		filter string
+		valid  bool
+	}{
+		{filter: "a/b/c", valid: true},
+		{filter: "#", valid: true},
+		{filter: "+", valid: true},
+		{filter: "a/+/c", valid: true},
+		{filter: "a/b/#", valid: true},
+		{filter: "+/+/#", valid: true},
+		{filter: "/#", valid: true},
+		{filter: "$share/group/a/+", valid: true},
+		{filter: ""},
+		{filter: "a/#/c"},
+		{filter: "a/b#"},
+		{filter: "a/b+/c"},
+		{filter: "#/"},
+		{filter: "a/\x00"},
+		{filter: "a/\xff"},
+		{filter: strings.Repeat("a", 65536)},
+	}
+
+	for i, tx := range tt {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			err := ValidateTopicFilter(tx.filter)
+			if tx.valid {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrInvalidTopicFilter)
+		})
+	}
+}
+
+// TestValidateTopicRandom validates random byte sequences, drawn mostly from the
+// bytes which are significant to topics, and checks the results are consistent
+// with the rules of the specification.
+func TestValidateTopicRandom(t *testing.T) {
+	alphabet := []byte{'a', 'b', '/', '/', '+', '#', '$', 0, 0xc3, 0xa9, 0x28, 0xff, 0xe2, 0x82, 0xac}
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20000; i++ {
+		b := make([]byte, rnd.Intn(12))
+		for j := range b {
+			if rnd.Intn(8) == 0 {
+				b[j] = byte(rnd.Intn(256))
+			} else {
+				b[j] = alphabet[rnd.Intn(len(alphabet))]
+			}
+		}
+		topic := string(b)
+
+		nameErr := ValidateTopicName(topic)
+		filterErr := ValidateTopicFilter(topic)
+
+		if filterErr == nil {
+			require.NotEmpty(t, topic)
+			require.True(t, utf8.ValidString(topic), "%q", topic)
+			require.NotContains(t, topic, "\x00")
+
+			levels := strings.Split(topic, "/")
+			for j, level := range levels {
+				if strings.ContainsAny(level, "+#") {
+					require.True(t, level == "+" || level == "#" && j == len(levels)-1, "%q", topic)
+				}
+			}
+		}
+
+		if nameErr == nil {
+			require.NoError(t, filterErr, "valid topic name %q is not a valid filter", topic)
+			require.False(t, strings.ContainsAny(topic, "+#"), "%q", topic)
+		} else if filterErr == nil {
+			require.True(t, strings.ContainsAny(topic, "+#"), "%q", topic)
+		}
+	}
+}
+
+func TestServerPublishInlineQos(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Store = mem.New()
+	cl1.ID = "inline"
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 2)
+	go s.inlineClient()
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	err := s.Publish("a/b/c", []byte("hello"), 1, false)
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish<<4 | 1<<1), 14,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		0, 1,
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack1)
+
+	require.Equal(t, 1, cl1.Inflight.Len())
+	msgs, err := s.Store.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	close(s.inline.done)
+}
+
+func TestServerPublishToClientQos(t *testing.T) {
+	tt := []struct {
+		desc   string
+		pubQos byte
+		subQos byte
+		expect byte
+	}{
+		{desc: "lower publish qos", pubQos: 0, subQos: 1, expect: 0},
+		{desc: "lower subscription qos", pubQos: 2, subQos: 1, expect: 1},
+		{desc: "equal qos", pubQos: 2, subQos: 2, expect: 2},
+	}
+
+	for _, wanted := range tt {
+		t.Run(wanted.desc, func(t *testing.T) {
+			s, cl, _, _ := setupClient()
+			s.Clients.Add(cl)
+
+			s.publishToClient(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Publish,
+					Qos:  wanted.pubQos,
+				},
+				TopicName: "a/b/c",
+				Payload:   []byte("hello"),
+			}, wanted.subQos, "")
+
+			if wanted.expect == 0 {
+				require.Equal(t, 0, cl.Inflight.Len())
+				return
+			}
+
+			in, ok := cl.Inflight.Get(1)
+			require.True(t, ok)
+			require.Equal(t, wanted.expect, in.Packet.FixedHeader.Qos)
+		})
+	}
+}
+
+func TestServerPublishInlineRetainStore(t *testing.T) {
+	s := New()
+	s.Store = mem.New()
+
+	err := s.Publish("a/b/c", []byte("hello"), 1, true)
+	require.NoError(t, err)
+
+	msgs, err := s.Store.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "a/b/c", msgs[0].TopicName)
+	require.Equal(t, []byte("hello"), msgs[0].Payload)
+}
+
+func TestServerPublishInlineInvalidQos(t *testing.T) {
+	s, _, _, _ := setupClient()
+
+	err := s.Publish("a/b/c", []byte("hello"), 3, false)
+	require.ErrorIs(t, err, ErrInvalidQos)
+	require.Empty(t, s.inline.pub)
+}
+
+func TestServerEventOnMessage(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+
+	var hook packetHook
+	s.Events.OnMessage = hook.onPacket
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	pk1 := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+	err := s.processPacket(cl1, pk1)
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	require.Equal(t, events.Client{
+		ID:       "mochi",
+		Remote:   "pipe",
+		Listener: "",
+	}, hook.client)
+
+	require.Equal(t, events.Packet(pk1), hook.packet)
+
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 12,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack1)
+
+	require.Equal(t, int64(14), atomic.LoadInt64(&s.System.BytesSent))
+}
+
+func TestServerProcessPublishHookOnMessageModify(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+
+	var hookedClient events.Client
+	s.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		pkx := pk
+		pkx.Payload = []byte("world")
+		hookedClient = cl
+		return pkx, nil
+	}
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	pk1 := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+	err := s.processPacket(cl1, pk1)
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	require.Equal(t, events.Client{
+		ID:       "mochi",
+		Remote:   "pipe",
+		Listener: "",
+	}, hookedClient)
+
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 12,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'w', 'o', 'r', 'l', 'd',
+	}, <-ack1)
+
+	require.Equal(t, int64(14), atomic.LoadInt64(&s.System.BytesSent))
+}
+
+func TestServerProcessPublishHookOnMessageModifyError(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+
+	s.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		pkx := pk
+		pkx.Payload = []byte("world")
+		return pkx, fmt.Errorf("error")
+	}
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	pk1 := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+	err := s.processPacket(cl1, pk1)
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 12,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack1)
+
+	require.Equal(t, int64(14), atomic.LoadInt64(&s.System.BytesSent))
+}
+
+func TestServerProcessPublishHookOnMessageAllowClients(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.ID = "allowed"
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/c", cl1.ID, 0)
+
+	cl2, r2, w2 := setupServerClient(s)
+	cl2.ID = "not_allowed"
+	s.Clients.Add(cl2)
+	s.Topics.Subscribe("a/b/c", cl2.ID, 0)
+	s.Topics.Subscribe("d/e/f", cl2.ID, 0)
+
+	s.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		if pk.TopicName == "a/b/c" {
+			pk.AllowClients = []string{"allowed"}
+		}
+		return pk, nil
+	}
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	ack2 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r2)
+		if err != nil {
+			panic(err)
+		}
+		ack2 <- buf
+	}()
+
+	pk1 := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+	err := s.processPacket(cl1, pk1)
+	require.NoError(t, err)
+
+	pk2 := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "d/e/f",
+		Payload:   []byte("a"),
+	}
+	err = s.processPacket(cl1, pk2)
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+
+	w1.Close()
+	w2.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 12,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack1)
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 8,
+		0, 5,
+		'd', '/', 'e', '/', 'f',
+		'a',
+	}, <-ack2)
+
+	require.Equal(t, int64(24), atomic.LoadInt64(&s.System.BytesSent))
+}
+
+func TestServerEventOnProcessMessage(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+
+	var hookedPacket events.Packet
+	var hookedClient events.Client
+	s.Events.OnProcessMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		hookedClient = cl
+		hookedPacket = pk
+		return pk, nil
+	}
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	pk1 := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+	err := s.processPacket(cl1, pk1)
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	require.Equal(t, events.Client{
+		ID:       "mochi",
+		Remote:   "pipe",
+		Listener: "",
+	}, hookedClient)
+
+	require.Equal(t, events.Packet(pk1), hookedPacket)
+
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 12,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack1)
+
+	require.Equal(t, int64(14), s.System.BytesSent)
+}
+
+// testHook records the events it receives, and modifies or rejects publishes.
+type testHook struct {
+	events.HookBase
+	sync.Mutex
+	calls  []string
+	reject bool
+}
+
+func (h *testHook) note(call string) {
+	h.Lock()
+	h.calls = append(h.calls, call)
+	h.Unlock()
+}
+
+func (h *testHook) OnConnect(cl events.Client, pk events.Packet) {
+	h.note("connect:" + cl.ID)
+}
+
+func (h *testHook) OnDisconnect(cl events.Client, err error) {
+	h.note("disconnect:" + cl.ID)
+}
+
+func (h *testHook) OnPublish(cl events.Client, pk events.Packet) (events.Packet, error) {
+	h.note("publish:" + pk.TopicName)
+	if h.reject {
+		return pk, ErrRejectPacket
+	}
+
+	pk.Payload = []byte("hooked")
+	return pk, nil
+}
+
+func (h *testHook) OnSubscribe(filter string, cl events.Client, qos byte) {
+	h.note("subscribe:" + filter)
+}
+
+func (h *testHook) OnUnsubscribe(filter string, cl events.Client) {
+	h.note("unsubscribe:" + filter)
+}
+
+func (h *testHook) OnListenerStarted(id string) {
+	h.note("started:" + id)
+}
+
+func (h *testHook) OnListenerStopped(id string) {
+	h.note("stopped:" + id)
+}
+
+func (h *testHook) OnListenerBindFailed(id string, err error) {
+	h.note("bind failed:" + id)
+}
+
+func (h *testHook) OnStorageError(cl events.Client, op string, err error) {
+	h.note("storage:" + op)
+}
+
+// notes returns a copy of the calls the hook has recorded.
+func (h *testHook) notes() []string {
+	h.Lock()
+	defer h.Unlock()
+	return append([]string(nil), h.calls...)
+}
+
+// reasonHook replaces the reason strings of disconnects.
+type reasonHook struct {
+	events.HookBase
+}
+
+func (h *reasonHook) OnDisconnectReason(cl events.Client, code byte, reason string) string {
+	return fmt.Sprintf("%s: %s, see https://example.com", cl.ID, reason)
+}
+
+func TestServerHookOnDisconnectReason(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	s.AddHook(new(reasonHook))
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	s.sendDisconnect(cl, packets.CodeQuotaExceeded, "inflight quota exceeded")
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, disconnectPacket(packets.CodeQuotaExceeded, "mochi: inflight quota exceeded, see https://example.com"), <-recv)
+}
+
+func TestServerSendDisconnectV3(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 4
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	s.sendDisconnect(cl, packets.CodeQuotaExceeded, "inflight quota exceeded")
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, []byte{}, <-recv)
+}
+
+func TestServerAddHook(t *testing.T) {
+	s := New()
+	s.AddHook(new(testHook))
+	s.AddHook(new(testHook))
+	require.Equal(t, 2, s.hooks.Len())
+}
+
+func TestServerHookOnPublishModify(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+	hook := new(testHook)
+	s.AddHook(hook)
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	err := s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 13,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'h', 'o', 'o', 'k', 'e', 'd',
+	}, <-ack1)
+	require.Equal(t, []string{"publish:a/b/c"}, hook.calls)
+}
+
+func TestServerHookOnPublishReject(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+	s.AddHook(&testHook{reject: true})
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	err := s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	require.Empty(t, <-ack1)
+	require.Empty(t, s.Topics.Messages("a/b/c"))
+}
+
+func TestServerHookSubscribeUnsubscribe(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	hook := new(testHook)
+	s.AddHook(hook)
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/b/c"},
+		Qoss:     []byte{0},
+	})
+	require.NoError(t, err)
+
+	err = s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Unsubscribe,
+		},
+		PacketID: 11,
+		Topics:   []string{"a/b/c"},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"subscribe:a/b/c", "unsubscribe:a/b/c"}, hook.calls)
+}
+
+func TestServerHookConnectDisconnect(t *testing.T) {
+	s := New()
+	hook := new(testHook)
+	s.AddHook(hook)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	go func() {
+		ioutil.ReadAll(w)
+	}()
+
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+
+	require.Equal(t, []string{"connect:mochi", "disconnect:mochi"}, hook.calls)
+}
+
+func TestServerProcessPublishHookOnProcessMessageModify(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+
+	var hookedPacket events.Packet
+	var hookedClient events.Client
+	s.Events.OnProcessMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		hookedPacket = pk
+		hookedPacket.FixedHeader.Retain = true
+		hookedPacket.Payload = []byte("world")
+		hookedClient = cl
+		return hookedPacket, nil
+	}
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	pk1 := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+	err := s.processPacket(cl1, pk1)
+
+	retained := s.Topics.Messages("a/b/c")
+	require.Equal(t, 1, len(retained))
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	require.Equal(t, events.Client{
+		ID:       "mochi",
+		Remote:   "pipe",
+		Listener: "",
+	}, hookedClient)
+
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish<<4 | 1), 12,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'w', 'o', 'r', 'l', 'd',
+	}, <-ack1)
+
+	require.Equal(t, int64(14), s.System.BytesSent)
+}
+
+func TestServerProcessPublishHookOnProcessMessageModifyError(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	s.Clients.Add(cl1)
+	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+
+	var hook errorHook
+	s.Events.OnError = hook.onError
+
+	s.Events.OnProcessMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		pkx := pk
+		pkx.Payload = []byte("world")
+
+		if string(pk.Payload) == "dropme" {
+			return pk, ErrRejectPacket
+		}
+
+		return pkx, fmt.Errorf("error")
+	}
+
+	ack1 := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r1)
+		if err != nil {
+			panic(err)
+		}
+		ack1 <- buf
+	}()
+
+	err := s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("dropme"),
+	})
+
+	err = s.processPacket(cl1, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	w1.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 12,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack1)
+
+	require.Equal(t, int64(14), s.System.BytesSent)
+
+	require.Equal(t, 1, hook.cnt)
+	require.Equal(t, fmt.Errorf("error"), hook.err)
+}
+
+func TestServerProcessPuback(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Inflight.Set(11, clients.InflightMessage{Packet: packets.Packet{PacketID: 11}, Sent: 0})
+	atomic.AddInt64(&s.System.Inflight, 1)
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:      packets.Puback,
+			Remaining: 2,
+		},
+		PacketID: 11,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Inflight))
+
+	_, ok := cl.Inflight.Get(11)
+	require.Equal(t, false, ok)
+}
+
+func TestServerProcessPubrec(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.Inflight.Set(12, clients.InflightMessage{Packet: packets.Packet{PacketID: 12}, Sent: 0})
+	atomic.AddInt64(&s.System.Inflight, 1)
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pubrec,
+		},
+		PacketID: 12,
+	})
+
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.Inflight))
+
+	require.Equal(t, []byte{
+		byte(packets.Pubrel<<4) | 2, 2,
+		0, 12,
+	}, <-recv)
+
+}
+
+func TestServerProcessPubrecError(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Stop(errTestStop)
+	cl.Inflight.Set(12, clients.InflightMessage{Packet: packets.Packet{PacketID: 12}, Sent: 0})
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pubrec,
+		},
+		PacketID: 12,
+	})
+	require.Error(t, err)
+	require.Equal(t, errTestStop, cl.StopCause())
+}
+
+func TestServerProcessPubrel(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.Inflight.Set(10, clients.InflightMessage{Packet: packets.Packet{PacketID: 10}, Sent: 0})
+	atomic.AddInt64(&s.System.Inflight, 1)
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pubrel,
+		},
+		PacketID: 10,
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Inflight))
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Pubcomp << 4), 2,
+		0, 10,
+	}, <-recv)
+}
+
+func TestServerProcessPubrelError(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Stop(errTestStop)
+	cl.Inflight.Set(12, clients.InflightMessage{Packet: packets.Packet{PacketID: 12}, Sent: 0})
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pubrel,
+		},
+		PacketID: 12,
+	})
+	require.Error(t, err)
+	require.Equal(t, errTestStop, cl.StopCause())
+}
+
+func TestServerProcessPubcomp(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Inflight.Set(11, clients.InflightMessage{Packet: packets.Packet{PacketID: 11}, Sent: 0})
+	atomic.AddInt64(&s.System.Inflight, 1)
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:      packets.Pubcomp,
+			Remaining: 2,
+		},
+		PacketID: 11,
 	})
 	require.NoError(t, err)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Inflight))
 
-	// Expecting 4 bytes
-	buf := make([]byte, 4)
-	nread, err := r.Read(buf)
-	if nread < 4 || err != nil {
-		panic(err)
+	_, ok := cl.Inflight.Get(11)
+	require.Equal(t, false, ok)
+}
+
+func TestServerProcessSubscribeInvalid(t *testing.T) {
+	s, cl, _, _ := setupClient()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+			Qos:  1,
+		},
+		PacketID: 0,
+	})
+
+	require.Error(t, err)
+}
+
+func TestServerProcessSubscribe(t *testing.T) {
+	s, cl, r, w := setupClient()
+
+	subscribeEvent := ""
+	subscribeClient := ""
+	s.Events.OnSubscribe = func(filter string, cl events.Client, qos byte) {
+		if filter == "a/b/c" {
+			subscribeEvent = "a/b/c"
+			subscribeClient = cl.ID
+		}
+	}
+
+	s.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+	require.Equal(t, 1, len(s.Topics.Messages("a/b/c")))
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/b/c", "d/e/f"},
+		Qoss:     []byte{0, 1},
+	})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Suback << 4), 4, // Fixed header
+		0, 10, // Packet ID - LSB+MSB
+		0, // Return Code QoS 0
+		1, // Return Code QoS 1
+
+		byte(packets.Publish<<4 | 1), 12, // Fixed header
+		0, 5, // Topic Name - LSB+MSB
+		'a', '/', 'b', '/', 'c', // Topic Name
+		'h', 'e', 'l', 'l', 'o', // Payload
+	}, <-recv)
+
+	require.Contains(t, cl.Subscriptions, "a/b/c")
+	require.Contains(t, cl.Subscriptions, "d/e/f")
+	require.Equal(t, byte(0), cl.Subscriptions["a/b/c"])
+	require.Equal(t, byte(1), cl.Subscriptions["d/e/f"])
+	require.Equal(t, topics.Subscriptions{cl.ID: 0}, s.Topics.Subscribers("a/b/c"))
+	require.Equal(t, topics.Subscriptions{cl.ID: 1}, s.Topics.Subscribers("d/e/f"))
+	require.Equal(t, "a/b/c", subscribeEvent)
+	require.Equal(t, cl.ID, subscribeClient)
+}
+
+func TestServerProcessSubscribeInvalidFilter(t *testing.T) {
+	tt := []struct {
+		desc    string
+		version byte
+		want    []byte
+	}{
+		{
+			desc:    "v3",
+			version: 4,
+			want: []byte{
+				byte(packets.Suback << 4), 4, // Fixed header
+				0, 10, // Packet ID - LSB+MSB
+				packets.ErrSubAckNetworkError, // Return Code Failure
+				1,                             // Return Code QoS 1
+			},
+		},
+		{
+			desc:    "v5",
+			version: 5,
+			want: []byte{
+				byte(packets.Suback << 4), 5, // Fixed header
+				0, 10, // Packet ID - LSB+MSB
+				0,                              // Properties Length
+				packets.CodeTopicFilterInvalid, // Return Code Topic Filter invalid
+				1,                              // Return Code QoS 1
+			},
+		},
 	}
 
-	require.Equal(t, []byte{
-		byte(packets.Pubcomp << 4), 2,
-		0, 14,
-	}, buf)
-
-	w.Close()
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s, cl, r, w := setupClient()
+			cl.ProtocolVersion = tx.version
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(r)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			err := s.processPacket(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Subscribe,
+				},
+				PacketID: 10,
+				Topics:   []string{"a/b#", "d/e/f"},
+				Qoss:     []byte{1, 1},
+			})
+			require.NoError(t, err)
+			time.Sleep(10 * time.Millisecond)
+			w.Close()
+
+			require.Equal(t, tx.want, <-recv)
+			require.NotContains(t, cl.Subscriptions, "a/b#")
+			require.Contains(t, cl.Subscriptions, "d/e/f")
+		})
+	}
 }
 
-func TestServerWriteClientError(t *testing.T) {
-	s := New()
-	w, _ := net.Pipe()
-	cl := clients.NewClient(w, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
-	cl.ID = "mochi"
+func TestServerProcessSubscribeTopicLimits(t *testing.T) {
+	tt := []struct {
+		desc    string
+		version byte
+		want    []byte
+	}{
+		{
+			desc:    "v3",
+			version: 4,
+			want: []byte{
+				byte(packets.Suback << 4), 5, // Fixed header
+				0, 10, // Packet ID - LSB+MSB
+				packets.ErrSubAckNetworkError, // Return Code Failure
+				1,                             // Return Code QoS 1
+				1,                             // Return Code QoS 1
+			},
+		},
+		{
+			desc:    "v5",
+			version: 5,
+			want: []byte{
+				byte(packets.Suback << 4), 6, // Fixed header
+				0, 10, // Packet ID - LSB+MSB
+				0,                              // Properties Length
+				packets.CodeTopicFilterInvalid, // Return Code Topic Filter invalid
+				1,                              // Return Code QoS 1
+				1,                              // Return Code QoS 1
+			},
+		},
+	}
 
-	err := s.writeClient(cl, packets.Packet{})
-	require.Error(t, err)
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s, cl, r, w := setupClient()
+			cl.Listener = "t1"
+			s.settings["t1"] = &listenerSettings{maxQos: 2, topicLimit: topicLimit{levels: 3}}
+			cl.ProtocolVersion = tx.version
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(r)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			err := s.processPacket(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Subscribe,
+				},
+				PacketID: 10,
+				Topics:   []string{"a/b/c/#", "d/e/f", "$share/g/d/e/+"},
+				Qoss:     []byte{1, 1, 1},
+			})
+			require.NoError(t, err)
+			time.Sleep(10 * time.Millisecond)
+			w.Close()
+
+			require.Equal(t, tx.want, <-recv)
+			require.NotContains(t, cl.Subscriptions, "a/b/c/#")
+			require.Contains(t, cl.Subscriptions, "d/e/f")
+		})
+	}
 }
 
-func TestServerProcessFailure(t *testing.T) {
-	s, cl, _, _ := setupClient()
-	err := s.processPacket(cl, packets.Packet{})
-	require.Error(t, err)
-}
+func TestServerProcessSubscribeMaxQos(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.Listener = "t1"
+	s.settings["t1"] = &listenerSettings{maxQos: 1}
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
 
-func TestServerProcessConnect(t *testing.T) {
-	s, cl, _, _ := setupClient()
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Connect,
+			Type: packets.Subscribe,
 		},
+		PacketID: 10,
+		Topics:   []string{"a/b/c", "d/e/f"},
+		Qoss:     []byte{2, 0},
 	})
 	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Suback << 4), 4, // Fixed header
+		0, 10, // Packet ID - LSB+MSB
+		1, // Return Code QoS 1
+		0, // Return Code QoS 0
+	}, <-recv)
+
+	require.Equal(t, byte(1), cl.Subscriptions["a/b/c"])
+	require.Equal(t, topics.Subscriptions{cl.ID: 1}, s.Topics.Subscribers("a/b/c"))
 }
 
-func TestServerProcessDisconnect(t *testing.T) {
-	s, cl, _, _ := setupClient()
-	err := s.processPacket(cl, packets.Packet{
+func TestServerProcessSubscribeShared(t *testing.T) {
+	s, cl, r, w := setupClient()
+	store := mem.New()
+	s.Store = store
+
+	s.Topics.RetainMessage(packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Disconnect,
+			Type:   packets.Publish,
+			Retain: true,
 		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
 	})
-	require.NoError(t, err)
-}
-
-func TestServerProcessPingreq(t *testing.T) {
-	s, cl, r, w := setupClient()
 
 	recv := make(chan []byte)
 	go func() {
@@ -993,835 +8728,1283 @@ func TestServerProcessPingreq(t *testing.T) {
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Pingreq,
+			Type: packets.Subscribe,
 		},
+		PacketID: 10,
+		Topics:   []string{"$share/g1/a/b/c", "$share/g1"},
+		Qoss:     []byte{1, 1},
 	})
-
 	require.NoError(t, err)
 	time.Sleep(10 * time.Millisecond)
 	w.Close()
 
 	require.Equal(t, []byte{
-		byte(packets.Pingresp << 4), 0,
-	}, <-recv)
+		byte(packets.Suback << 4), 4, // Fixed header
+		0, 10, // Packet ID - LSB+MSB
+		1,    // Return Code QoS 1
+		0x80, // Return Code Failure
+	}, <-recv) // no retained messages are sent for shared subscriptions.
+
+	require.Contains(t, cl.Subscriptions, "$share/g1/a/b/c")
+	require.Empty(t, s.Topics.Subscribers("a/b/c"))
+	require.Equal(t, topics.Subscriptions{cl.ID: 1}, s.Topics.SharedMembers("$share/g1/a/b/c"))
+
+	subs, err := store.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "$share/g1/a/b/c", subs[0].Filter)
+	require.Equal(t, "g1", subs[0].Group)
 }
 
-func TestServerProcessPingreqError(t *testing.T) {
-	s, cl, _, _ := setupClient()
+func TestServerProcessSubscribeIdentifier(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	store := mem.New()
+	s.Store = store
+
+	s.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
 
-	cl.Stop(errTestStop)
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Pingreq,
+			Type: packets.Subscribe,
 		},
+		PacketID:   10,
+		Topics:     []string{"a/b/c"},
+		Qoss:       []byte{0},
+		Properties: packets.Properties{SubscriptionIdentifier: []int{9}},
 	})
-	require.Error(t, err)
-	require.Equal(t, errTestStop, cl.StopCause())
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Suback << 4), 4, // Fixed header
+		0, 10, // Packet ID - LSB+MSB
+		0, // Properties Length
+		0, // Return Code QoS 0
+
+		byte(packets.Publish<<4 | 1), 15, // Fixed header
+		0, 5, // Topic Name - LSB+MSB
+		'a', '/', 'b', '/', 'c', // Topic Name
+		2, packets.PropSubscriptionIdentifier, 9, // Properties
+		'h', 'e', 'l', 'l', 'o', // Payload
+	}, <-recv)
+
+	require.Equal(t, 9, cl.SubscriptionIDs["a/b/c"])
+	subs, err := store.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, 9, subs[0].SubscriptionIdentifier)
 }
 
-func TestServerProcessPublishInvalid(t *testing.T) {
+func TestServerPublishSubscriptionIdentifiers(t *testing.T) {
 	s, cl, _, _ := setupClient()
-
-	err := s.processPacket(cl, packets.Packet{
+	cl.ProtocolVersion = 5
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+	s.Topics.Subscribe("a/#", cl.ID, 1)
+	s.Topics.Subscribe("$share/g1/a/b/c", cl.ID, 1)
+	cl.NoteSubscriptionID("a/b/c", 2)
+	cl.NoteSubscriptionID("a/#", 1)
+	cl.NoteSubscriptionID("$share/g1/a/b/c", 3)
+
+	s.publishToSubscribers(packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type: packets.Publish,
 			Qos:  1,
 		},
-		PacketID: 0,
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
 	})
 
-	require.Error(t, err)
+	// One copy for the normal subscriptions, and another for the shared subscription.
+	var ids [][]int
+	for _, tk := range cl.Inflight.GetAll() {
+		ids = append(ids, tk.Packet.Properties.SubscriptionIdentifier)
+	}
+	require.ElementsMatch(t, [][]int{{1, 2}, {3}}, ids)
 }
 
-func TestServerProcessPublishQoS1Retain(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	cl1.ID = "mochi1"
-	s.Clients.Add(cl1)
-
-	cl2, r2, w2 := setupServerClient(s)
-	cl2.ID = "mochi2"
-	s.Clients.Add(cl2)
+func TestServerPublishRetainAsPublished(t *testing.T) {
+	tt := []struct {
+		desc    string
+		version byte
+		rap     bool
+		retain  bool
+	}{
+		{desc: "v3 keeps retain", version: 4, retain: true},
+		{desc: "v5 clears retain", version: 5},
+		{desc: "v5 retain as published", version: 5, rap: true, retain: true},
+	}
 
-	s.Topics.Subscribe("a/b/+", cl2.ID, 0)
-	s.Topics.Subscribe("a/+/c", cl2.ID, 1)
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s, cl, _, _ := setupClient()
+			cl.ProtocolVersion = tx.version
+			s.Clients.Add(cl)
+			s.Topics.Subscribe("a/#", cl.ID, 1)
+			cl.NoteSubscription("a/#", 1)
+			cl.NoteSubscriptionOptions("a/#", packets.SubOptions{RetainAsPublished: tx.rap})
+
+			s.publishToSubscribers(packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type:   packets.Publish,
+					Qos:    1,
+					Retain: true,
+				},
+				TopicName: "a/b/c",
+				Payload:   []byte("hello"),
+			})
+
+			tk, ok := cl.Inflight.Get(1)
+			require.True(t, ok)
+			require.Equal(t, tx.retain, tk.Packet.FixedHeader.Retain)
+		})
+	}
+}
 
-	ack1 := make(chan []byte)
-	go func() {
-		buf, err := ioutil.ReadAll(r1)
-		if err != nil {
-			panic(err)
-		}
-		ack1 <- buf
-	}()
+func TestServerPublishOverlappingSubscriptions(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	s.Clients.Add(cl)
+	for filter, qos := range map[string]byte{"a/#": 0, "a/+/c": 1, "+/b/#": 0} {
+		s.Topics.Subscribe(filter, cl.ID, qos)
+		cl.NoteSubscription(filter, qos)
+	}
+	cl.NoteSubscriptionID("a/#", 4)
+	cl.NoteSubscriptionID("+/b/#", 2)
 
-	ack2 := make(chan []byte)
+	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r2)
+		buf, err := ioutil.ReadAll(r)
 		if err != nil {
 			panic(err)
 		}
-		ack2 <- buf
+		recv <- buf
 	}()
 
-	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.PublishRecv))
-
-	err := s.processPacket(cl1, packets.Packet{
+	s.publishToSubscribers(packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type:   packets.Publish,
-			Qos:    1,
-			Retain: true,
+			Type: packets.Publish,
+			Qos:  2,
 		},
 		TopicName: "a/b/c",
 		Payload:   []byte("hello"),
-		PacketID:  12,
 	})
-
-	require.NoError(t, err)
 	time.Sleep(10 * time.Millisecond)
-	w1.Close()
-	w2.Close()
-
-	require.Equal(t, []byte{
-		byte(packets.Puback << 4), 2,
-		0, 12,
-	}, <-ack1)
+	w.Close()
 
-	require.Equal(t, []byte{
-		byte(packets.Publish<<4 | 2 | 3), 14,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		0, 1,
-		'h', 'e', 'l', 'l', 'o',
-	}, <-ack2)
+	// a single copy at the highest qos of the matching subscriptions.
+	require.Equal(t, 1, cl.Inflight.Len())
+	tk := cl.Inflight.GetAll()[1]
+	require.Equal(t, byte(1), tk.Packet.FixedHeader.Qos)
+	require.Equal(t, []int{2, 4}, tk.Packet.Properties.SubscriptionIdentifier)
+
+	buf := <-recv
+	require.Equal(t, byte(packets.Publish<<4|1<<1), buf[0])
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, ProtocolVersion: 5}
+	require.Len(t, buf, 2+int(buf[1])) // no second packet follows.
+	require.NoError(t, pk.PublishDecode(buf[2:]))
+	require.Equal(t, []int{2, 4}, pk.Properties.SubscriptionIdentifier)
+}
 
-	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.Retained))
+// setupSharedGroup subscribes n clients to a share group, returning the clients.
+func setupSharedGroup(s *Server, n int) []*clients.Client {
+	cls := make([]*clients.Client, n)
+	for i := 0; i < n; i++ {
+		cl, _, _ := setupServerClient(s)
+		cl.ID = "mochi" + strconv.Itoa(i)
+		s.Clients.Add(cl)
+		s.Topics.Subscribe("$share/g1/a/b/c", cl.ID, 1)
+		cls[i] = cl
+	}
+	return cls
 }
 
-func TestServerProcessPublishQoS2(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	s.Clients.Add(cl1)
+func TestServerPublishSharedRoundRobin(t *testing.T) {
+	s := New()
+	cls := setupSharedGroup(s, 3)
 
-	ack1 := make(chan []byte)
-	go func() {
-		buf, err := ioutil.ReadAll(r1)
-		if err != nil {
-			panic(err)
+	for i := 0; i < 6; i++ {
+		s.publishToSubscribers(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: "a/b/c",
+			Payload:   []byte("hello"),
+		})
+	}
+
+	for _, cl := range cls {
+		require.Equal(t, 2, cl.Inflight.Len(), cl.ID)
+		for _, tk := range cl.Inflight.GetAll() {
+			require.Equal(t, "$share/g1/a/b/c", tk.Shared)
 		}
-		ack1 <- buf
-	}()
+	}
+}
+
+func TestServerPublishSharedRandom(t *testing.T) {
+	s := New()
+	s.Options.SharedStrategy = SharedRandom
+	cls := setupSharedGroup(s, 3)
+
+	for i := 0; i < 6; i++ {
+		s.publishToSubscribers(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: "a/b/c",
+			Payload:   []byte("hello"),
+		})
+	}
+
+	var total int
+	for _, cl := range cls {
+		total += cl.Inflight.Len()
+	}
+	require.Equal(t, 6, total)
+}
+
+func TestServerPublishSharedPrefersOnline(t *testing.T) {
+	s := New()
+	cls := setupSharedGroup(s, 2)
+	cls[0].Stop(ErrClientDisconnect)
+
+	for i := 0; i < 4; i++ {
+		s.publishToSubscribers(packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: "a/b/c",
+			Payload:   []byte("hello"),
+		})
+	}
+
+	require.Equal(t, 0, cls[0].Inflight.Len())
+	require.Equal(t, 4, cls[1].Inflight.Len())
+}
+
+func TestServerProcessUnsubscribeShared(t *testing.T) {
+	s := New()
+	cls := setupSharedGroup(s, 2)
+	s.publishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+	require.Equal(t, 1, cls[0].Inflight.Len())
+
+	err := s.processPacket(cls[0], packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Unsubscribe,
+		},
+		PacketID: 12,
+		Topics:   []string{"$share/g1/a/b/c"},
+	})
+	require.NoError(t, err)
 
-	err := s.processPacket(cl1, packets.Packet{
+	require.Equal(t, topics.Subscriptions{"mochi1": 1}, s.Topics.SharedMembers("$share/g1/a/b/c"))
+	require.Equal(t, 1, cls[0].Inflight.Len()) // not redelivered unless configured.
+	require.Equal(t, 0, cls[1].Inflight.Len())
+}
+
+func TestServerProcessUnsubscribeSharedRedeliver(t *testing.T) {
+	s := New()
+	s.Options.SharedRedeliver = true
+	cls := setupSharedGroup(s, 2)
+	s.publishToSubscribers(packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type: packets.Publish,
-			Qos:  2,
+			Qos:  1,
 		},
 		TopicName: "a/b/c",
 		Payload:   []byte("hello"),
-		PacketID:  12,
 	})
+	require.Equal(t, 1, cls[0].Inflight.Len())
 
+	err := s.processPacket(cls[0], packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Unsubscribe,
+		},
+		PacketID: 12,
+		Topics:   []string{"$share/g1/a/b/c"},
+	})
 	require.NoError(t, err)
-	time.Sleep(10 * time.Millisecond)
-	w1.Close()
-
-	require.Equal(t, []byte{
-		byte(packets.Pubrec << 4), 2, // Fixed header
-		0, 12, // Packet ID - LSB+MSB
-	}, <-ack1)
 
-	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Retained))
+	require.Equal(t, 0, cls[0].Inflight.Len())
+	require.Equal(t, 1, cls[1].Inflight.Len())
+	for _, tk := range cls[1].Inflight.GetAll() {
+		require.Equal(t, []byte("hello"), tk.Packet.Payload)
+		require.Equal(t, "$share/g1/a/b/c", tk.Shared)
+	}
+	require.Equal(t, int64(1), s.System.Inflight)
 }
 
-func TestServerProcessPublishUnretainByEmptyPayload(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	s.Clients.Add(cl1)
-
-	ack1 := make(chan []byte)
-	go func() {
-		buf, err := ioutil.ReadAll(r1)
-		if err != nil {
-			panic(err)
-		}
-		ack1 <- buf
-	}()
+func TestServerRedeliverSharedQueued(t *testing.T) {
+	s := New()
+	cls := setupSharedGroup(s, 2)
+	cls[0].ReceiveMaximum = 1
+	cls[0].Inflight.Set(100, clients.InflightMessage{}) // use up the quota.
 
-	err := s.processPacket(cl1, packets.Packet{
+	s.publishToSubscribers(packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type:   packets.Publish,
-			Retain: true,
+			Type: packets.Publish,
+			Qos:  1,
 		},
 		TopicName: "a/b/c",
-		Payload:   []byte{},
+		Payload:   []byte("hello"),
 	})
+	require.Equal(t, 1, cls[0].Inflight.QueueLen())
+
+	s.redeliverShared(cls[0], "")
+	require.Equal(t, 0, cls[0].Inflight.QueueLen())
+	require.Equal(t, 1, cls[1].Inflight.Len())
+	for _, tk := range cls[1].Inflight.GetAll() {
+		require.Equal(t, []byte("hello"), tk.Packet.Payload)
+		require.Equal(t, "$share/g1/a/b/c", tk.Shared)
+	}
+}
 
-	require.NoError(t, err)
-	time.Sleep(10 * time.Millisecond)
-	w1.Close()
+func TestServerRedeliverSharedNoMembers(t *testing.T) {
+	s := New()
+	cls := setupSharedGroup(s, 1)
+	s.publishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  1,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
 
-	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Retained))
+	s.redeliverShared(cls[0], "")
+	require.Equal(t, 1, cls[0].Inflight.Len())
 }
 
-func TestServerProcessPublishOfflineQueuing(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	cl1.ID = "mochi1"
-	s.Clients.Add(cl1)
+func TestServerProcessSubscribeRetainedExpiry(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	now := time.Now().Unix()
 
-	// Start and stop the receiver client
-	cl2, _, _ := setupServerClient(s)
-	cl2.ID = "mochi2"
-	s.Clients.Add(cl2)
-	s.Topics.Subscribe("qos0", cl2.ID, 0)
-	s.Topics.Subscribe("qos1", cl2.ID, 1)
-	s.Topics.Subscribe("qos2", cl2.ID, 2)
-	cl2.Stop(errTestStop)
+	s.retainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		Properties: packets.Properties{
+			MessageExpiryInterval: 10,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("old"),
+		Created:   now - 20,
+	})
 
-	ack1 := make(chan []byte)
+	s.retainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		Properties: packets.Properties{
+			MessageExpiryInterval: 30,
+		},
+		TopicName: "a/b/d",
+		Payload:   []byte("new"),
+		Created:   now - 20,
+	})
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.System.Retained))
+
+	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r1)
+		buf, err := ioutil.ReadAll(r)
 		if err != nil {
 			panic(err)
 		}
-		ack1 <- buf
+		recv <- buf
 	}()
 
-	for i := 0; i < 3; i++ {
-		err := s.processPacket(cl1, packets.Packet{
-			FixedHeader: packets.FixedHeader{
-				Type: packets.Publish,
-				Qos:  byte(i),
-			},
-			TopicName: "qos" + strconv.Itoa(i),
-			Payload:   []byte("hello"),
-			PacketID:  uint16(i),
-		})
-		require.NoError(t, err)
-	}
-
-	require.Equal(t, int64(2), atomic.LoadInt64(&s.System.Inflight))
-
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/b/+"},
+		Qoss:     []byte{0},
+	})
+	require.NoError(t, err)
 	time.Sleep(10 * time.Millisecond)
-	w1.Close()
+	w.Close()
+
+	buf := <-recv
+	require.Len(t, buf, 24)
+	require.Contains(t, []byte{9, 10}, buf[20], "remaining expiry interval") // allow for a second boundary.
+	buf[20] = 10
 
 	require.Equal(t, []byte{
-		byte(packets.Puback << 4), 2, // Qos1 Ack
-		0, 1,
-		byte(packets.Pubrec << 4), 2, // Qos2 Ack
-		0, 2,
-	}, <-ack1)
+		byte(packets.Suback << 4), 4, // Fixed header
+		0, 10, // Packet ID - LSB+MSB
+		0, // Properties length
+		0, // Return Code QoS 0
 
-	queued := cl2.Inflight.GetAll()
-	require.Equal(t, 2, len(queued))
-	require.Equal(t, "qos1", queued[1].Packet.TopicName)
-	require.Equal(t, "qos2", queued[2].Packet.TopicName)
+		byte(packets.Publish<<4 | 1), 16, // Fixed header
+		0, 5, // Topic Name - LSB+MSB
+		'a', '/', 'b', '/', 'd', // Topic Name
+		5, packets.PropMessageExpiryInterval, 0, 0, 0, 10, // Remaining expiry interval
+		'n', 'e', 'w', // Payload
+	}, buf)
 
-	// Reconnect the receiving client and get queued messages.
-	r, w := net.Pipe()
-	o := make(chan error)
-	go func() {
-		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
-	}()
+	require.Len(t, s.Topics.Messages("a/b/c"), 0)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.Retained))
+}
 
-	go func() {
-		w.Write([]byte{
-			byte(packets.Connect << 4), 18, // Fixed header
-			0, 4, // Protocol Name - MSB+LSB
-			'M', 'Q', 'T', 'T', // Protocol Name
-			4,     // Protocol Version
-			0,     // Packet Flags
-			0, 45, // Keepalive
-			0, 6, // Client ID - MSB+LSB
-			'm', 'o', 'c', 'h', 'i', '2', // Client ID
-		})
-		w.Write([]byte{byte(packets.Disconnect << 4), 0})
-	}()
+func TestServerProcessSubscribeFailACL(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.AC = new(auth.Disallow)
 
 	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(w)
+		buf, err := ioutil.ReadAll(r)
 		if err != nil {
 			panic(err)
 		}
 		recv <- buf
 	}()
 
-	clw, ok := s.Clients.Get("mochi2")
-	require.Equal(t, true, ok)
-	clw.Stop(errTestStop)
-
-	errx := <-o
-	require.ErrorIs(t, errx, ErrClientDisconnect)
-	ret := <-recv
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/b/c", "d/e/f"},
+		Qoss:     []byte{0, 1},
+	})
 
-	wanted := []byte{
-		byte(packets.Connack << 4), 2,
-		1, packets.Accepted,
-		byte(packets.Publish<<4 | 1<<1 | 1<<3), 13,
-		0, 4,
-		'q', 'o', 's', '1',
-		0, 1,
-		'h', 'e', 'l', 'l', 'o',
-		byte(packets.Publish<<4 | 2<<1 | 1<<3), 13,
-		0, 4,
-		'q', 'o', 's', '2',
-		0, 2,
-		'h', 'e', 'l', 'l', 'o',
-	}
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
 
-	require.Equal(t, len(wanted), len(ret))
-	require.Equal(t, true, (ret[4] == byte(packets.Publish<<4|1<<1|1<<3) || ret[4] == byte(packets.Publish<<4|2<<1|1<<3)))
+	require.Equal(t, []byte{
+		byte(packets.Suback << 4), 4,
+		0, 10,
+		packets.ErrSubAckNetworkError,
+		packets.ErrSubAckNetworkError,
+	}, <-recv)
 
-	w.Close()
+	require.Empty(t, s.Topics.Subscribers("a/b/c"))
+	require.Empty(t, s.Topics.Subscribers("d/e/f"))
 }
 
-func TestServerProcessPublishSystemPrefix(t *testing.T) {
-	s, cl, _, _ := setupClient()
-	s.Clients.Add(cl)
+func TestServerProcessSubscribeFailACLNoRetainedReturned(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.AC = new(auth.Disallow)
 
-	err := s.processPacket(cl, packets.Packet{
+	s.Topics.RetainMessage(packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
+			Type:   packets.Publish,
+			Retain: true,
 		},
-		TopicName: "$SYS/stuff",
+		TopicName: "a/b/c",
 		Payload:   []byte("hello"),
 	})
+	require.Equal(t, 1, len(s.Topics.Messages("a/b/c")))
 
-	require.NoError(t, err)
-	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.BytesSent))
-}
-
-func TestServerProcessPublishBadACL(t *testing.T) {
-	s, cl, _, _ := setupClient()
-	cl.AC = new(auth.Disallow)
-	s.Clients.Add(cl)
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
+			Type: packets.Subscribe,
 		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
+		PacketID: 10,
+		Topics:   []string{"a/b/c", "d/e/f"},
+		Qoss:     []byte{0, 1},
 	})
 
 	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Suback << 4), 4,
+		0, 10,
+		packets.ErrSubAckNetworkError,
+		packets.ErrSubAckNetworkError,
+	}, <-recv)
+
+	require.Empty(t, s.Topics.Subscribers("a/b/c"))
+	require.Empty(t, s.Topics.Subscribers("d/e/f"))
 }
 
-func TestServerProcessPublishWriteAckError(t *testing.T) {
+func TestServerProcessSubscribeRetainHandling(t *testing.T) {
+	tt := []struct {
+		desc     string
+		handling byte
+		existing bool
+		sent     bool
+	}{
+		{desc: "send on subscribe", handling: packets.RetainSendOnSubscribe, sent: true},
+		{desc: "send on resubscribe", handling: packets.RetainSendOnSubscribe, existing: true, sent: true},
+		{desc: "send if new", handling: packets.RetainSendIfNew, sent: true},
+		{desc: "not sent if existing", handling: packets.RetainSendIfNew, existing: true},
+		{desc: "never sent", handling: packets.RetainDoNotSend},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s, cl, r, w := setupClient()
+			cl.ProtocolVersion = 5
+			s.Topics.RetainMessage(packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type:   packets.Publish,
+					Retain: true,
+				},
+				TopicName: "a/b/c",
+				Payload:   []byte("hello"),
+			})
+
+			if tx.existing {
+				s.Topics.Subscribe("a/#", cl.ID, 0)
+				cl.NoteSubscription("a/#", 0)
+			}
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(r)
+				if err != nil {
+					panic(err)
+				}
+				recv <- buf
+			}()
+
+			err := s.processPacket(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Subscribe,
+				},
+				ProtocolVersion: 5,
+				PacketID:        10,
+				Topics:          []string{"a/#"},
+				Qoss:            []byte{0},
+				SubOptions:      []packets.SubOptions{{RetainHandling: tx.handling}},
+			})
+			require.NoError(t, err)
+			time.Sleep(10 * time.Millisecond)
+			w.Close()
+
+			suback := []byte{byte(packets.Suback << 4), 4, 0, 10, 0, 0}
+			buf := <-recv
+			require.Equal(t, suback, buf[:len(suback)])
+			if tx.sent {
+				require.Greater(t, len(buf), len(suback))
+				require.Equal(t, byte(packets.Publish<<4|1), buf[len(suback)])
+			} else {
+				require.Len(t, buf, len(suback))
+			}
+			require.Equal(t, tx.handling, cl.SubOptions["a/#"].RetainHandling)
+		})
+	}
+}
+
+func TestServerProcessSubscribeOptionsStored(t *testing.T) {
 	s, cl, _, _ := setupClient()
-	cl.Stop(errTestStop)
+	cl.ProtocolVersion = 5
+	store := mem.New()
+	s.Store = store
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
-			Qos:  1,
+			Type: packets.Subscribe,
 		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
+		ProtocolVersion: 5,
+		PacketID:        10,
+		Topics:          []string{"a/b/c"},
+		Qoss:            []byte{1},
+		SubOptions:      []packets.SubOptions{{RetainAsPublished: true, RetainHandling: packets.RetainSendIfNew}},
 	})
+	require.NoError(t, err)
 
-	require.Error(t, err)
-	require.Equal(t, errTestStop, cl.StopCause())
+	subs, err := store.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.True(t, subs[0].RetainAsPublished)
+	require.Equal(t, packets.RetainSendIfNew, subs[0].RetainHandling)
 }
 
-func TestServerPublishInline(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	cl1.ID = "inline"
-	s.Clients.Add(cl1)
-	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
-	go s.inlineClient()
+func TestServerProcessSubscribeQuota(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.SetMaxSubscriptions(2)
+	cl.NoteSubscription("a/b/c", 0)
+	s.Topics.Subscribe("a/b/c", cl.ID, 0)
 
-	ack1 := make(chan []byte)
+	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r1)
+		buf, err := ioutil.ReadAll(r)
 		if err != nil {
 			panic(err)
 		}
-		ack1 <- buf
+		recv <- buf
 	}()
 
-	err := s.Publish("a/b/c", []byte("hello"), false)
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"d/e/f", "g/h/i", "a/b/c"},
+		Qoss:     []byte{1, 1, 1},
+	})
 	require.NoError(t, err)
-
 	time.Sleep(10 * time.Millisecond)
-	w1.Close()
+	w.Close()
 
 	require.Equal(t, []byte{
-		byte(packets.Publish << 4), 12,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		'h', 'e', 'l', 'l', 'o',
-	}, <-ack1)
-
-	require.Equal(t, int64(14), atomic.LoadInt64(&s.System.BytesSent))
+		byte(packets.Suback << 4), 5,
+		0, 10,
+		1,
+		packets.ErrSubAckNetworkError,
+		1, // an existing subscription may be replaced.
+	}, <-recv)
 
-	close(s.inline.done)
+	require.Equal(t, 2, cl.CountSubscriptions())
+	require.Equal(t, byte(1), cl.Subscriptions["a/b/c"])
+	require.Contains(t, cl.Subscriptions, "d/e/f")
+	require.Empty(t, s.Topics.Subscribers("g/h/i"))
 }
 
-func TestServerPublishInlineRetain(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	cl1.ID = "inline"
+func TestServerProcessSubscribeQuotaV5(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	s.SetMaxSubscriptions(1)
 
-	ack1 := make(chan []byte)
+	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r1)
+		buf, err := ioutil.ReadAll(r)
 		if err != nil {
 			panic(err)
 		}
-		ack1 <- buf
+		recv <- buf
 	}()
 
-	err := s.Publish("a/b/c", []byte("hello"), true)
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/b/c", "d/e/f"},
+		Qoss:     []byte{0, 1},
+	})
 	require.NoError(t, err)
-
-	time.Sleep(10 * time.Millisecond)
-
-	s.Clients.Add(cl1)
-	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
-	go s.inlineClient()
-
 	time.Sleep(10 * time.Millisecond)
-
-	w1.Close()
+	w.Close()
 
 	require.Equal(t, []byte{
-		byte(packets.Publish<<4 | 1), 12,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		'h', 'e', 'l', 'l', 'o',
-	}, <-ack1)
-
-	require.Equal(t, int64(14), atomic.LoadInt64(&s.System.BytesSent))
-
-	close(s.inline.done)
-}
-
-func TestServerPublishInlineSysTopicError(t *testing.T) {
-	s, _, _, _ := setupClient()
+		byte(packets.Suback << 4), 5,
+		0, 10,
+		0, // no properties.
+		0,
+		packets.CodeQuotaExceeded,
+	}, <-recv)
 
-	err := s.Publish("$SYS/stuff", []byte("hello"), false)
-	require.Error(t, err)
-	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.BytesSent))
+	require.Empty(t, s.Topics.Subscribers("d/e/f"))
 }
 
-func TestServerEventOnMessage(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	s.Clients.Add(cl1)
-	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
-
-	var hook packetHook
-	s.Events.OnMessage = hook.onPacket
+func TestServerProcessSubscribeQuotaStored(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.SetMaxSubscriptions(1)
+	s.Store = &persistence.MockStore{}
+	cl.ID = "test" // the mock store holds one subscription for this client.
 
-	ack1 := make(chan []byte)
+	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r1)
+		buf, err := ioutil.ReadAll(r)
 		if err != nil {
 			panic(err)
 		}
-		ack1 <- buf
+		recv <- buf
 	}()
 
-	pk1 := packets.Packet{
+	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
+			Type: packets.Subscribe,
 		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
-	}
-	err := s.processPacket(cl1, pk1)
-
+		PacketID: 10,
+		Topics:   []string{"d/e/f"},
+		Qoss:     []byte{1},
+	})
 	require.NoError(t, err)
 	time.Sleep(10 * time.Millisecond)
+	w.Close()
 
-	require.Equal(t, events.Client{
-		ID:       "mochi",
-		Remote:   "pipe",
-		Listener: "",
-	}, hook.client)
+	require.Equal(t, []byte{
+		byte(packets.Suback << 4), 3,
+		0, 10,
+		packets.ErrSubAckNetworkError,
+	}, <-recv)
+}
 
-	require.Equal(t, events.Packet(pk1), hook.packet)
+func TestServerMaxSubscriptions(t *testing.T) {
+	s := New()
+	require.Equal(t, 0, s.MaxSubscriptions())
 
-	w1.Close()
+	s.SetMaxSubscriptions(10)
+	require.Equal(t, 10, s.MaxSubscriptions())
 
-	require.Equal(t, []byte{
-		byte(packets.Publish << 4), 12,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		'h', 'e', 'l', 'l', 'o',
-	}, <-ack1)
+	s.SetMaxSubscriptions(-1)
+	require.Equal(t, 0, s.MaxSubscriptions())
 
-	require.Equal(t, int64(14), atomic.LoadInt64(&s.System.BytesSent))
+	s = NewServer(&Options{MaxSubscriptions: 5})
+	require.Equal(t, 5, s.MaxSubscriptions())
 }
 
-func TestServerProcessPublishHookOnMessageModify(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	s.Clients.Add(cl1)
-	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
-
-	var hookedClient events.Client
-	s.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
-		pkx := pk
-		pkx.Payload = []byte("world")
-		hookedClient = cl
-		return pkx, nil
-	}
-
-	ack1 := make(chan []byte)
-	go func() {
-		buf, err := ioutil.ReadAll(r1)
-		if err != nil {
-			panic(err)
-		}
-		ack1 <- buf
-	}()
+func TestServerProcessSubscribeWriteError(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Stop(errTestStop)
 
-	pk1 := packets.Packet{
+	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
+			Type: packets.Subscribe,
 		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
-	}
-	err := s.processPacket(cl1, pk1)
+		PacketID: 10,
+		Topics:   []string{"a/b/c", "d/e/f"},
+		Qoss:     []byte{0, 1},
+	})
 
-	require.NoError(t, err)
-	time.Sleep(10 * time.Millisecond)
+	require.Error(t, err)
+	require.Equal(t, errTestStop, cl.StopCause())
+}
 
-	require.Equal(t, events.Client{
-		ID:       "mochi",
-		Remote:   "pipe",
-		Listener: "",
-	}, hookedClient)
+// subFailStore is a store which fails to write the subscriptions to a filter.
+type subFailStore struct {
+	*mem.Store
+	filter string
+}
 
-	w1.Close()
+func (s *subFailStore) WriteSubscription(v persistence.Subscription) error {
+	if v.Filter == s.filter {
+		return errors.New("test")
+	}
 
-	require.Equal(t, []byte{
-		byte(packets.Publish << 4), 12,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		'w', 'o', 'r', 'l', 'd',
-	}, <-ack1)
+	return s.Store.WriteSubscription(v)
+}
 
-	require.Equal(t, int64(14), atomic.LoadInt64(&s.System.BytesSent))
+// denyAuth is an auth controller which denies access to a single topic.
+type denyAuth struct {
+	auth.Allow
+	topic string
+	calls int
 }
 
-func TestServerProcessPublishHookOnMessageModifyError(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	s.Clients.Add(cl1)
-	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+func (a *denyAuth) ACL(user []byte, topic string, write bool) bool {
+	return topic != a.topic
+}
 
-	s.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
-		pkx := pk
-		pkx.Payload = []byte("world")
-		return pkx, fmt.Errorf("error")
+// ACLWithError fails the checks of the topic "down", as if the backend of the
+// controller were unreachable.
+func (a *denyAuth) ACLWithError(user []byte, topic string, write bool) (bool, error) {
+	if topic == "down" {
+		a.calls++
+		return false, errors.New("backend unavailable")
 	}
 
-	ack1 := make(chan []byte)
-	go func() {
-		buf, err := ioutil.ReadAll(r1)
-		if err != nil {
-			panic(err)
-		}
-		ack1 <- buf
-	}()
-
-	pk1 := packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
-		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
-	}
-	err := s.processPacket(cl1, pk1)
+	return a.ACL(user, topic, write), nil
+}
 
-	require.NoError(t, err)
-	time.Sleep(10 * time.Millisecond)
+func TestServerSetTopicRewrites(t *testing.T) {
+	s := New()
+	require.NoError(t, s.SetTopicRewrites([]TopicRewrite{{Prefix: "a/", Replace: "b/"}}))
+	require.Len(t, s.topicRewrites, 1)
 
-	w1.Close()
+	err := s.SetTopicRewrites([]TopicRewrite{{Pattern: "(", Replace: "b/"}})
+	require.ErrorIs(t, err, ErrInvalidTopicRewrite)
+	err = s.SetTopicRewrites([]TopicRewrite{{Replace: "b/"}})
+	require.ErrorIs(t, err, ErrInvalidTopicRewrite)
+	require.Len(t, s.topicRewrites, 1)
 
-	require.Equal(t, []byte{
-		byte(packets.Publish << 4), 12,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		'h', 'e', 'l', 'l', 'o',
-	}, <-ack1)
+	require.NoError(t, s.SetTopicRewrites(nil))
+	require.Empty(t, s.topicRewrites)
 
-	require.Equal(t, int64(14), atomic.LoadInt64(&s.System.BytesSent))
+	s = NewServer(&Options{TopicRewrites: []TopicRewrite{{Pattern: "["}}})
+	require.Empty(t, s.topicRewrites)
 }
 
-func TestServerProcessPublishHookOnMessageAllowClients(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	cl1.ID = "allowed"
-	s.Clients.Add(cl1)
-	s.Topics.Subscribe("a/b/c", cl1.ID, 0)
+func TestServerRewriteTopic(t *testing.T) {
+	s := NewServer(&Options{
+		TopicRewrites: []TopicRewrite{
+			{Prefix: "fleetA/", Replace: "devices/", Subscribe: true},
+			{Pattern: `^fleetB/([^/]+)/data/(.+)$`, Replace: "devices/$1/$2"},
+			{Prefix: "fleet", Replace: "other/"},
+		},
+	})
 
-	cl2, r2, w2 := setupServerClient(s)
-	cl2.ID = "not_allowed"
-	s.Clients.Add(cl2)
-	s.Topics.Subscribe("a/b/c", cl2.ID, 0)
-	s.Topics.Subscribe("d/e/f", cl2.ID, 0)
+	tt := []struct {
+		topic     string
+		subscribe bool
+		want      string
+		ok        bool
+	}{
+		{topic: "fleetA/d1/temp", want: "devices/d1/temp", ok: true},
+		{topic: "fleetA/d1/temp", subscribe: true, want: "devices/d1/temp", ok: true},
+		{topic: "fleetB/d2/data/temp/c", want: "devices/d2/temp/c", ok: true},
+		{topic: "fleetB/d2/data/temp/c", subscribe: true, want: "fleetB/d2/data/temp/c"},
+		{topic: "fleetB/d2/status", want: "other/B/d2/status", ok: true},
+		{topic: "a/fleetA/b", want: "a/fleetA/b"},
+	}
 
-	s.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
-		if pk.TopicName == "a/b/c" {
-			pk.AllowClients = []string{"allowed"}
-		}
-		return pk, nil
+	for _, tx := range tt {
+		got, ok := s.rewriteTopic(tx.topic, tx.subscribe)
+		require.Equal(t, tx.want, got, tx.topic)
+		require.Equal(t, tx.ok, ok, tx.topic)
 	}
+}
+
+func TestServerProcessPublishTopicRewrite(t *testing.T) {
+	s, cl1, r1, w1 := setupClient()
+	cl1.AC = new(auth.Allow)
+	require.NoError(t, s.SetTopicRewrites([]TopicRewrite{
+		{Prefix: "fleetA/", Replace: "devices/"},
+		{Prefix: "bad/", Replace: "devices/+/"},
+		{Prefix: "sys/", Replace: "$SYS/"},
+	}))
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+	s.Topics.Subscribe("devices/#", cl2.ID, 1)
+	s.Topics.Subscribe("bad/#", cl2.ID, 1)
 
-	ack1 := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r1)
-		if err != nil {
-			panic(err)
-		}
-		ack1 <- buf
+		_, _ = ioutil.ReadAll(r1)
 	}()
 
-	ack2 := make(chan []byte)
+	for i, topic := range []string{"fleetA/d1/temp", "bad/d1"} {
+		err := s.processPacket(cl1, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: topic,
+			Payload:   []byte("hello"),
+			PacketID:  uint16(i + 1),
+			Properties: packets.Properties{
+				User: []packets.UserProperty{{Key: "k", Val: "v"}},
+			},
+		})
+		require.NoError(t, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	w1.Close()
+
+	queued := cl2.Inflight.GetOrdered()
+	require.Len(t, queued, 2)
+	require.Equal(t, "devices/d1/temp", queued[0].Packet.TopicName)
+	require.Equal(t, []packets.UserProperty{
+		{Key: "k", Val: "v"},
+		{Key: OriginalTopicProperty, Val: "fleetA/d1/temp"},
+	}, queued[0].Packet.Properties.User)
+
+	// topics which would be invalid once rewritten are left alone.
+	require.Equal(t, "bad/d1", queued[1].Packet.TopicName)
+	require.Equal(t, []packets.UserProperty{{Key: "k", Val: "v"}}, queued[1].Packet.Properties.User)
+}
+
+func TestServerProcessSubscribeTopicRewrite(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.AC = &denyAuth{topic: "devices/#"}
+	st := mem.New()
+	s.Store = st
+	require.NoError(t, s.SetTopicRewrites([]TopicRewrite{
+		{Prefix: "fleetA/", Replace: "devices/", Subscribe: true},
+		{Prefix: "fleetB/", Replace: "devices/"},
+	}))
+
+	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r2)
-		if err != nil {
-			panic(err)
-		}
-		ack2 <- buf
+		buf, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		recv <- buf
 	}()
 
-	pk1 := packets.Packet{
+	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
+			Type: packets.Subscribe,
 		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
-	}
-	err := s.processPacket(cl1, pk1)
+		PacketID: 10,
+		Topics:   []string{"fleetA/+/temp", "$share/g/fleetA/#", "fleetB/#"},
+		Qoss:     []byte{1, 1, 1},
+	})
 	require.NoError(t, err)
 
-	pk2 := packets.Packet{
+	require.Contains(t, s.Topics.Subscribers("devices/d1/temp"), cl.ID)
+	require.Contains(t, s.Topics.Subscribers("fleetB/d1"), cl.ID)
+	require.True(t, cl.Subscribed("devices/+/temp"))
+	require.True(t, cl.Subscribed("$share/g/devices/#"))
+	require.False(t, cl.Subscribed("fleetA/+/temp"))
+
+	subs, err := st.ReadSubscriptionsForClient(cl.ID)
+	require.NoError(t, err)
+	require.Len(t, subs, 3)
+
+	err = s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
+			Type: packets.Unsubscribe,
 		},
-		TopicName: "d/e/f",
-		Payload:   []byte("a"),
-	}
-	err = s.processPacket(cl1, pk2)
+		PacketID: 11,
+		Topics:   []string{"fleetA/+/temp"},
+	})
 	require.NoError(t, err)
-
 	time.Sleep(10 * time.Millisecond)
-
-	w1.Close()
-	w2.Close()
-
-	require.Equal(t, []byte{
-		byte(packets.Publish << 4), 12,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		'h', 'e', 'l', 'l', 'o',
-	}, <-ack1)
+	w.Close()
 
 	require.Equal(t, []byte{
-		byte(packets.Publish << 4), 8,
-		0, 5,
-		'd', '/', 'e', '/', 'f',
-		'a',
-	}, <-ack2)
+		byte(packets.Suback << 4), 5,
+		0, 10,
+		1, 1, 1,
+		byte(packets.Unsuback << 4), 2,
+		0, 11,
+	}, <-recv)
+	require.False(t, cl.Subscribed("devices/+/temp"))
+	require.Empty(t, s.Topics.Subscribers("devices/d1/temp"))
+}
 
-	require.Equal(t, int64(24), atomic.LoadInt64(&s.System.BytesSent))
+func TestServerACLCheckFailed(t *testing.T) {
+	s := NewServer(&Options{ACLCacheSize: 10})
+	cl, _, _ := setupServerClient(s)
+	ac := new(denyAuth)
+	cl.AC = ac
+
+	for i := 1; i <= 2; i++ {
+		ok, err := s.aclAllowed(cl, "down", true, nil)
+		require.ErrorIs(t, err, ErrACLCheckFailed)
+		require.False(t, ok)
+		require.Equal(t, i, ac.calls) // failed checks are not cached.
+	}
+	require.True(t, aclOK(t, s, cl, "a/b", true, nil))
 }
 
-func TestServerEventOnProcessMessage(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	s.Clients.Add(cl1)
-	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+func TestServerProcessPublishACLCheckFailed(t *testing.T) {
+	tt := []struct {
+		desc    string
+		version byte
+		qos     byte
+		want    []byte
+	}{
+		{
+			desc:    "v5 qos 1",
+			version: 5,
+			qos:     1,
+			want:    []byte{byte(packets.Puback << 4), 4, 0, 7, packets.CodeQuotaExceeded, 0},
+		},
+		{
+			desc:    "v5 qos 2",
+			version: 5,
+			qos:     2,
+			want:    []byte{byte(packets.Pubrec << 4), 4, 0, 7, packets.CodeQuotaExceeded, 0},
+		},
+		{
+			desc:    "v5 qos 0",
+			version: 5,
+			want:    []byte{},
+		},
+		{
+			desc:    "v3",
+			version: 4,
+			qos:     1,
+			want:    []byte{},
+		},
+	}
 
-	var hookedPacket events.Packet
-	var hookedClient events.Client
-	s.Events.OnProcessMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
-		hookedClient = cl
-		hookedPacket = pk
-		return pk, nil
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s, cl, r, w := setupClient()
+			cl.ProtocolVersion = tx.version
+			cl.AC = new(denyAuth)
+			var reported error
+			s.Events.OnError = func(cl events.Client, err error) {
+				reported = err
+			}
+
+			cl2, _, _ := setupServerClient(s)
+			cl2.ID = "mochi2"
+			s.Clients.Add(cl2)
+			s.Topics.Subscribe("down", cl2.ID, 1)
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := ioutil.ReadAll(r)
+				require.NoError(t, err)
+				recv <- buf
+			}()
+
+			pk := packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Publish,
+					Qos:  tx.qos,
+				},
+				TopicName: "down",
+				Payload:   []byte("hello"),
+			}
+			if tx.qos > 0 {
+				pk.PacketID = 7
+			}
+
+			require.NoError(t, s.processPacket(cl, pk))
+			time.Sleep(10 * time.Millisecond)
+			w.Close()
+
+			require.Equal(t, tx.want, <-recv)
+			require.Equal(t, 0, cl2.Inflight.Len())
+			require.ErrorIs(t, reported, ErrACLCheckFailed)
+		})
 	}
+}
 
-	ack1 := make(chan []byte)
+func TestServerProcessPublishACLCheckFailedResend(t *testing.T) {
+	s, cl, r, w := setupClient()
+	st := mem.New()
+	require.NoError(t, s.AddStore(st))
+	cl.ID = "mochi1"
+	cl.ProtocolVersion = 4
+	cl.AC = new(denyAuth)
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+	s.Topics.Subscribe("down", cl2.ID, 1)
+
+	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r1)
-		if err != nil {
-			panic(err)
-		}
-		ack1 <- buf
+		buf, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		recv <- buf
 	}()
 
-	pk1 := packets.Packet{
+	pk := packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type: packets.Publish,
+			Qos:  2,
 		},
-		TopicName: "a/b/c",
+		TopicName: "down",
 		Payload:   []byte("hello"),
+		PacketID:  7,
 	}
-	err := s.processPacket(cl1, pk1)
 
+	require.NoError(t, s.processPacket(cl, pk))
+	require.False(t, cl.InboundQos2Pending(7))
+	n, err := st.CountInflight(cl.ID)
 	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, 0, cl2.Inflight.Len())
+
+	// the resend is delivered once the check succeeds again.
+	cl.AC = new(auth.Allow)
+	pk.FixedHeader.Dup = true
+	require.NoError(t, s.processPacket(cl, pk))
 	time.Sleep(10 * time.Millisecond)
+	w.Close()
 
-	require.Equal(t, events.Client{
-		ID:       "mochi",
-		Remote:   "pipe",
-		Listener: "",
-	}, hookedClient)
+	require.Equal(t, []byte{byte(packets.Pubrec << 4), 2, 0, 7}, <-recv)
+	require.Equal(t, 1, cl2.Inflight.Len())
+}
 
-	require.Equal(t, events.Packet(pk1), hookedPacket)
+func TestServerProcessSubscribeACLCheckFailed(t *testing.T) {
+	for _, version := range []byte{4, 5} {
+		s, cl, r, w := setupClient()
+		cl.ProtocolVersion = version
+		cl.AC = new(denyAuth)
+		var reported error
+		s.Events.OnError = func(cl events.Client, err error) {
+			reported = err
+		}
 
-	w1.Close()
+		recv := make(chan []byte)
+		go func() {
+			buf, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			recv <- buf
+		}()
 
-	require.Equal(t, []byte{
-		byte(packets.Publish << 4), 12,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		'h', 'e', 'l', 'l', 'o',
-	}, <-ack1)
+		err := s.processPacket(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Subscribe,
+			},
+			PacketID: 10,
+			Topics:   []string{"a/b", "down"},
+			Qoss:     []byte{1, 1},
+		})
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+		w.Close()
 
-	require.Equal(t, int64(14), s.System.BytesSent)
+		want := []byte{byte(packets.Suback << 4), 4, 0, 10, 1, packets.ErrSubAckNetworkError}
+		if version == 5 {
+			want = []byte{byte(packets.Suback << 4), 5, 0, 10, 0, 1, packets.CodeQuotaExceeded}
+		}
+		require.Equal(t, want, <-recv)
+		require.Empty(t, s.Topics.Subscribers("down"))
+		require.ErrorIs(t, reported, ErrACLCheckFailed)
+	}
 }
 
-func TestServerProcessPublishHookOnProcessMessageModify(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	s.Clients.Add(cl1)
-	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
-
-	var hookedPacket events.Packet
-	var hookedClient events.Client
-	s.Events.OnProcessMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
-		hookedPacket = pk
-		hookedPacket.FixedHeader.Retain = true
-		hookedPacket.Payload = []byte("world")
-		hookedClient = cl
-		return hookedPacket, nil
-	}
+func TestServerProcessSubscribePartial(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	cl.AC = &denyAuth{topic: "secret"}
+	st := &subFailStore{Store: mem.New(), filter: "x/y"}
+	s.Store = st
 
-	ack1 := make(chan []byte)
+	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r1)
-		if err != nil {
-			panic(err)
-		}
-		ack1 <- buf
+		buf, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		recv <- buf
 	}()
 
-	pk1 := packets.Packet{
+	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
+			Type: packets.Subscribe,
 		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
-	}
-	err := s.processPacket(cl1, pk1)
-
-	retained := s.Topics.Messages("a/b/c")
-	require.Equal(t, 1, len(retained))
-
+		PacketID: 10,
+		Topics:   []string{"a/b", "a/#/c", "x/y", "secret", "$share//d", "d/e"},
+		Qoss:     []byte{1, 0, 2, 0, 0, 2},
+	})
 	require.NoError(t, err)
 	time.Sleep(10 * time.Millisecond)
-
-	require.Equal(t, events.Client{
-		ID:       "mochi",
-		Remote:   "pipe",
-		Listener: "",
-	}, hookedClient)
-
-	w1.Close()
+	w.Close()
 
 	require.Equal(t, []byte{
-		byte(packets.Publish<<4 | 1), 12,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		'w', 'o', 'r', 'l', 'd',
-	}, <-ack1)
-
-	require.Equal(t, int64(14), s.System.BytesSent)
-}
-
-func TestServerProcessPublishHookOnProcessMessageModifyError(t *testing.T) {
-	s, cl1, r1, w1 := setupClient()
-	s.Clients.Add(cl1)
-	s.Topics.Subscribe("a/b/+", cl1.ID, 0)
+		byte(packets.Suback << 4), 9,
+		0, 10,
+		0, // no properties.
+		1,
+		packets.CodeTopicFilterInvalid,
+		packets.ErrSubAckNetworkError,
+		packets.CodeNotAuthorized,
+		packets.CodeTopicFilterInvalid,
+		2,
+	}, <-recv)
 
-	var hook errorHook
-	s.Events.OnError = hook.onError
+	require.Equal(t, topics.Subscriptions{"a/b": 1, "d/e": 2}, cl.Subscriptions)
+	require.Empty(t, s.Topics.Subscribers("x/y"))
+	require.Empty(t, s.Topics.Subscribers("secret"))
+	require.Equal(t, int64(2), s.System.Subscriptions)
 
-	s.Events.OnProcessMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
-		pkx := pk
-		pkx.Payload = []byte("world")
+	subs, err := st.ReadSubscriptionsForClient(cl.ID)
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+}
 
-		if string(pk.Payload) == "dropme" {
-			return pk, ErrRejectPacket
-		}
+func TestServerProcessUnsubscribePartial(t *testing.T) {
+	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	st := mem.New()
+	s.Store = st
+	s.Clients.Add(cl)
 
-		return pkx, fmt.Errorf("error")
+	for _, filter := range []string{"a/b", "c/d"} {
+		s.Topics.Subscribe(filter, cl.ID, 1)
+		cl.NoteSubscription(filter, 1)
+		require.NoError(t, st.WriteSubscription(persistence.Subscription{
+			ID:     "sub_" + cl.ID + ":" + filter,
+			T:      persistence.KSubscription,
+			Client: cl.ID,
+			Filter: filter,
+			QoS:    1,
+		}))
 	}
 
-	ack1 := make(chan []byte)
+	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r1)
-		if err != nil {
-			panic(err)
-		}
-		ack1 <- buf
+		buf, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		recv <- buf
 	}()
 
-	err := s.processPacket(cl1, packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
-		},
-		TopicName: "a/b/c",
-		Payload:   []byte("dropme"),
-	})
-
-	err = s.processPacket(cl1, packets.Packet{
+	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
+			Type: packets.Unsubscribe,
 		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
+		PacketID: 12,
+		Topics:   []string{"a/b", "e/f", "a/#/c"},
 	})
-
 	require.NoError(t, err)
 	time.Sleep(10 * time.Millisecond)
-
-	w1.Close()
+	w.Close()
 
 	require.Equal(t, []byte{
-		byte(packets.Publish << 4), 12,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		'h', 'e', 'l', 'l', 'o',
-	}, <-ack1)
-
-	require.Equal(t, int64(14), s.System.BytesSent)
+		byte(packets.Unsuback << 4), 6,
+		0, 12,
+		0, // no properties.
+		packets.Accepted,
+		packets.CodeNoSubscriptionExisted,
+		packets.CodeTopicFilterInvalid,
+	}, <-recv)
 
-	require.Equal(t, 1, hook.cnt)
-	require.Equal(t, fmt.Errorf("error"), hook.err)
+	require.Equal(t, topics.Subscriptions{"c/d": 1}, cl.Subscriptions)
+	subs, err := st.ReadSubscriptionsForClient(cl.ID)
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "c/d", subs[0].Filter)
 }
 
-func TestServerProcessPuback(t *testing.T) {
+func TestServerProcessUnsubscribeInvalid(t *testing.T) {
 	s, cl, _, _ := setupClient()
-	cl.Inflight.Set(11, clients.InflightMessage{Packet: packets.Packet{PacketID: 11}, Sent: 0})
-	atomic.AddInt64(&s.System.Inflight, 1)
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type:      packets.Puback,
-			Remaining: 2,
+			Type: packets.Unsubscribe,
+			Qos:  1,
 		},
-		PacketID: 11,
+		PacketID: 0,
 	})
-	require.NoError(t, err)
-	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Inflight))
 
-	_, ok := cl.Inflight.Get(11)
-	require.Equal(t, false, ok)
+	require.Error(t, err)
 }
 
-func TestServerProcessPubrec(t *testing.T) {
+func TestServerProcessUnsubscribe(t *testing.T) {
 	s, cl, r, w := setupClient()
-	cl.Inflight.Set(12, clients.InflightMessage{Packet: packets.Packet{PacketID: 12}, Sent: 0})
-	atomic.AddInt64(&s.System.Inflight, 1)
+
+	unsubscribeEvent := ""
+	unsubscribeClient := ""
+	s.Events.OnUnsubscribe = func(filter string, cl events.Client) {
+		if filter == "a/b/c" {
+			unsubscribeEvent = "a/b/c"
+			unsubscribeClient = cl.ID
+		}
+	}
+
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 0)
+	s.Topics.Subscribe("d/e/f", cl.ID, 1)
+	s.Topics.Subscribe("a/b/+", cl.ID, 2)
+	cl.NoteSubscription("a/b/c", 0)
+	cl.NoteSubscription("d/e/f", 1)
+	cl.NoteSubscription("a/b/+", 2)
 
 	recv := make(chan []byte)
 	go func() {
@@ -1834,42 +10017,39 @@ func TestServerProcessPubrec(t *testing.T) {
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Pubrec,
+			Type: packets.Unsubscribe,
 		},
 		PacketID: 12,
+		Topics:   []string{"a/b/c", "d/e/f"},
 	})
 
 	require.NoError(t, err)
 	time.Sleep(10 * time.Millisecond)
 	w.Close()
-	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.Inflight))
 
 	require.Equal(t, []byte{
-		byte(packets.Pubrel<<4) | 2, 2,
+		byte(packets.Unsuback << 4), 2,
 		0, 12,
 	}, <-recv)
 
-}
+	require.NotEmpty(t, s.Topics.Subscribers("a/b/c"))
+	require.Empty(t, s.Topics.Subscribers("d/e/f"))
+	require.NotContains(t, cl.Subscriptions, "a/b/c")
+	require.NotContains(t, cl.Subscriptions, "d/e/f")
 
-func TestServerProcessPubrecError(t *testing.T) {
-	s, cl, _, _ := setupClient()
-	cl.Stop(errTestStop)
-	cl.Inflight.Set(12, clients.InflightMessage{Packet: packets.Packet{PacketID: 12}, Sent: 0})
+	require.NotEmpty(t, s.Topics.Subscribers("a/b/+"))
+	require.Contains(t, cl.Subscriptions, "a/b/+")
 
-	err := s.processPacket(cl, packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type: packets.Pubrec,
-		},
-		PacketID: 12,
-	})
-	require.Error(t, err)
-	require.Equal(t, errTestStop, cl.StopCause())
+	require.Equal(t, "a/b/c", unsubscribeEvent)
+	require.Equal(t, cl.ID, unsubscribeClient)
 }
 
-func TestServerProcessPubrel(t *testing.T) {
+func TestServerProcessUnsubscribeInvalidFilter(t *testing.T) {
 	s, cl, r, w := setupClient()
-	cl.Inflight.Set(10, clients.InflightMessage{Packet: packets.Packet{PacketID: 10}, Sent: 0})
-	atomic.AddInt64(&s.System.Inflight, 1)
+	cl.ProtocolVersion = 5
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 0)
+	cl.NoteSubscription("a/b/c", 0)
 
 	recv := make(chan []byte)
 	go func() {
@@ -1882,91 +10062,119 @@ func TestServerProcessPubrel(t *testing.T) {
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Pubrel,
+			Type: packets.Unsubscribe,
 		},
-		PacketID: 10,
+		PacketID: 12,
+		Topics:   []string{"a/b/c", "a/#/c"},
 	})
 
 	require.NoError(t, err)
-	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Inflight))
 	time.Sleep(10 * time.Millisecond)
 	w.Close()
 
 	require.Equal(t, []byte{
-		byte(packets.Pubcomp << 4), 2,
-		0, 10,
+		byte(packets.Unsuback << 4), 5,
+		0, 12,
+		0, // Properties Length
+		packets.Accepted, packets.CodeTopicFilterInvalid,
 	}, <-recv)
+	require.Empty(t, s.Topics.Subscribers("a/b/c"))
 }
 
-func TestServerProcessPubrelError(t *testing.T) {
+func TestServerProcessUnsubscribeWriteError(t *testing.T) {
 	s, cl, _, _ := setupClient()
 	cl.Stop(errTestStop)
-	cl.Inflight.Set(12, clients.InflightMessage{Packet: packets.Packet{PacketID: 12}, Sent: 0})
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Pubrel,
+			Type: packets.Unsubscribe,
 		},
 		PacketID: 12,
+		Topics:   []string{"a/b/c", "d/e/f"},
 	})
+
 	require.Error(t, err)
 	require.Equal(t, errTestStop, cl.StopCause())
 }
 
-func TestServerProcessPubcomp(t *testing.T) {
+func TestEventLoop(t *testing.T) {
+	s := New()
+	s.sysTicker = time.NewTicker(2 * time.Millisecond)
+
+	go func() {
+		s.eventLoop()
+	}()
+	time.Sleep(time.Millisecond * 3)
+	close(s.done)
+}
+
+func TestServerClose(t *testing.T) {
 	s, cl, _, _ := setupClient()
-	cl.Inflight.Set(11, clients.InflightMessage{Packet: packets.Packet{PacketID: 11}, Sent: 0})
-	atomic.AddInt64(&s.System.Inflight, 1)
+	cl.Listener = "t1"
+	s.Clients.Add(cl)
 
-	err := s.processPacket(cl, packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type:      packets.Pubcomp,
-			Remaining: 2,
-		},
-		PacketID: 11,
-	})
+	p := new(persistence.MockStore)
+	err := s.AddStore(p)
 	require.NoError(t, err)
-	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Inflight))
 
-	_, ok := cl.Inflight.Get(11)
-	require.Equal(t, false, ok)
+	err = s.AddListener(listeners.NewMockListener("t1", ":1882"), nil)
+	require.NoError(t, err)
+	s.Serve()
+	time.Sleep(time.Millisecond)
+	require.Equal(t, 1, s.Listeners.Len())
+
+	listener, ok := s.Listeners.Get("t1")
+	require.Equal(t, true, ok)
+	require.Equal(t, true, listener.(*listeners.MockListener).IsServing())
+
+	s.Close()
+	time.Sleep(time.Millisecond)
+	require.Equal(t, false, listener.(*listeners.MockListener).IsServing())
+	require.Equal(t, true, p.Closed)
 }
 
-func TestServerProcessSubscribeInvalid(t *testing.T) {
-	s, cl, _, _ := setupClient()
+func TestServerDrainRefusesConnections(t *testing.T) {
+	s := New()
+	err := s.Drain(0)
+	require.NoError(t, err)
 
-	err := s.processPacket(cl, packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type: packets.Subscribe,
-			Qos:  1,
-		},
-		PacketID: 0,
-	})
+	r, w := net.Pipe()
+	defer w.Close()
+	err = s.EstablishConnection("tcp", r, new(auth.Allow))
+	require.ErrorIs(t, err, ErrServerDraining)
 
-	require.Error(t, err)
+	_, err = w.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
 }
 
-func TestServerProcessSubscribe(t *testing.T) {
+func TestServerDrain(t *testing.T) {
 	s, cl, r, w := setupClient()
+	cl.ProtocolVersion = 5
+	s.Clients.Add(cl)
 
-	subscribeEvent := ""
-	subscribeClient := ""
-	s.Events.OnSubscribe = func(filter string, cl events.Client, qos byte) {
-		if filter == "a/b/c" {
-			subscribeEvent = "a/b/c"
-			subscribeClient = cl.ID
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
 		}
-	}
+		recv <- buf
+	}()
 
-	s.Topics.RetainMessage(packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type:   packets.Publish,
-			Retain: true,
-		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
-	})
-	require.Equal(t, 1, len(s.Topics.Messages("a/b/c")))
+	err := s.Drain(time.Second)
+	require.NoError(t, err)
+	require.ErrorIs(t, cl.StopCause(), ErrServerShutdown)
+	w.Close()
+
+	buf := <-recv
+	require.Equal(t, byte(packets.Disconnect<<4), buf[0])
+	require.Equal(t, packets.CodeServerShuttingDown, buf[2])
+	require.Contains(t, string(buf), "server shutting down")
+}
+
+func TestServerDrainV4(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Clients.Add(cl)
 
 	recv := make(chan []byte)
 	go func() {
@@ -1977,329 +10185,605 @@ func TestServerProcessSubscribe(t *testing.T) {
 		recv <- buf
 	}()
 
-	err := s.processPacket(cl, packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type: packets.Subscribe,
+	err := s.Drain(time.Second)
+	require.NoError(t, err)
+	require.ErrorIs(t, cl.StopCause(), ErrServerShutdown)
+	w.Close()
+	require.Empty(t, <-recv)
+}
+
+func TestServerDrainAcknowledged(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	cl.Inflight.Set(1, clients.InflightMessage{})
+
+	go func() {
+		time.Sleep(drainPollInterval)
+		cl.Inflight.Delete(1)
+	}()
+
+	err := s.Drain(time.Second)
+	require.NoError(t, err)
+	require.ErrorIs(t, cl.StopCause(), ErrServerShutdown)
+}
+
+func TestServerDrainTimeout(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	cl.Inflight.Set(1, clients.InflightMessage{})
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
+
+	err := s.Drain(time.Millisecond)
+	require.ErrorIs(t, err, ErrDrainTimeout)
+	require.Contains(t, err.Error(), "mochi")
+	require.NotContains(t, err.Error(), "mochi2")
+	require.ErrorIs(t, cl.StopCause(), ErrServerShutdown)
+	require.ErrorIs(t, cl2.StopCause(), ErrServerShutdown)
+}
+
+func TestServerDrainFlushStore(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	store := mem.New()
+	s.Store = store
+	cl.SessionExpiryInterval = clients.SessionExpiryNever
+	s.Clients.Add(cl)
+	cl.NoteSubscription("a/b/c", 1)
+	cl.Inflight.Set(1, clients.InflightMessage{
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			PacketID:  1,
+			TopicName: "a/b/c",
+			Payload:   []byte("hello"),
 		},
-		PacketID: 10,
-		Topics:   []string{"a/b/c", "d/e/f"},
-		Qoss:     []byte{0, 1},
 	})
+
+	clean, _, _ := setupServerClient(s)
+	clean.ID = "clean"
+	clean.CleanSession = true
+	s.Clients.Add(clean)
+
+	err := s.Drain(0)
+	require.ErrorIs(t, err, ErrDrainTimeout)
+
+	cls, err := store.ReadClients()
 	require.NoError(t, err)
-	time.Sleep(10 * time.Millisecond)
-	w.Close()
+	require.Len(t, cls, 1)
+	require.Equal(t, "mochi", cls[0].ClientID)
 
-	require.Equal(t, []byte{
-		byte(packets.Suback << 4), 4, // Fixed header
-		0, 10, // Packet ID - LSB+MSB
-		0, // Return Code QoS 0
-		1, // Return Code QoS 1
+	subs, err := store.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "a/b/c", subs[0].Filter)
 
-		byte(packets.Publish<<4 | 1), 12, // Fixed header
-		0, 5, // Topic Name - LSB+MSB
-		'a', '/', 'b', '/', 'c', // Topic Name
-		'h', 'e', 'l', 'l', 'o', // Payload
-	}, <-recv)
+	msgs, err := store.ReadInflight()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, []byte("hello"), msgs[0].Payload)
 
-	require.Contains(t, cl.Subscriptions, "a/b/c")
-	require.Contains(t, cl.Subscriptions, "d/e/f")
-	require.Equal(t, byte(0), cl.Subscriptions["a/b/c"])
-	require.Equal(t, byte(1), cl.Subscriptions["d/e/f"])
-	require.Equal(t, topics.Subscriptions{cl.ID: 0}, s.Topics.Subscribers("a/b/c"))
-	require.Equal(t, topics.Subscriptions{cl.ID: 1}, s.Topics.Subscribers("d/e/f"))
-	require.Equal(t, "a/b/c", subscribeEvent)
-	require.Equal(t, cl.ID, subscribeClient)
+	info, err := store.ReadServerInfo()
+	require.NoError(t, err)
+	require.Equal(t, persistence.KServerInfo, info.ID)
 }
 
-func TestServerProcessSubscribeFailACL(t *testing.T) {
-	s, cl, r, w := setupClient()
-	cl.AC = new(auth.Disallow)
+func TestServerCloseClientLWT(t *testing.T) {
+	s, cl1, _, _ := setupClient()
+	cl1.Listener = "t1"
+	cl1.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte{'h', 'e', 'l', 'l', 'o'},
+	}
+	s.Clients.Add(cl1)
+
+	cl2, r2, w2 := setupServerClient(s)
+	cl2.ID = "mochi2"
+	s.Clients.Add(cl2)
 
-	recv := make(chan []byte)
+	s.Topics.Subscribe("a/b/c", cl2.ID, 0)
+
+	ack2 := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(r)
+		buf, err := ioutil.ReadAll(r2)
 		if err != nil {
 			panic(err)
 		}
-		recv <- buf
+		ack2 <- buf
 	}()
 
-	err := s.processPacket(cl, packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type: packets.Subscribe,
-		},
-		PacketID: 10,
-		Topics:   []string{"a/b/c", "d/e/f"},
-		Qoss:     []byte{0, 1},
-	})
+	s.sendLWT(cl1)
+	cl1.Stop(fmt.Errorf("goodbye"))
 
-	require.NoError(t, err)
-	time.Sleep(10 * time.Millisecond)
-	w.Close()
+	time.Sleep(time.Millisecond)
+	w2.Close()
 
 	require.Equal(t, []byte{
-		byte(packets.Suback << 4), 4,
-		0, 10,
-		packets.ErrSubAckNetworkError,
-		packets.ErrSubAckNetworkError,
-	}, <-recv)
+		byte(packets.Publish << 4), 12,
+		0, 5,
+		'a', '/', 'b', '/', 'c',
+		'h', 'e', 'l', 'l', 'o',
+	}, <-ack2)
+}
 
-	require.Empty(t, s.Topics.Subscribers("a/b/c"))
-	require.Empty(t, s.Topics.Subscribers("d/e/f"))
+func TestServerCloseClientClosed(t *testing.T) {
+	s, cl, _, _ := setupClient()
+
+	var hook errorHook
+	s.Events.OnError = hook.onError
+
+	cl.Listener = "t1"
+	cl.LWT = clients.LWT{
+		Qos:     1,
+		Topic:   "a/b/c",
+		Message: []byte{'h', 'e', 'l', 'l', 'o'},
+	}
+	// Close the client connection abruptly, e.g., as if the
+	// seession were taken over or a protocol error had occurred.
+	cl.Stop(errTestStop)
+
+	s.sendLWT(cl)
+	cl.Stop(clients.ErrConnectionClosed)
+
+	// We see the original error that caused the connection to stop.
+	err := cl.StopCause()
+	require.Equal(t, true, errors.Is(err, errTestStop) || errors.Is(err, io.EOF))
+
+	// Errors were generated in the closeClient() code path.
+	require.Equal(t, 1, hook.cnt)
+	require.ErrorIs(t, hook.err, clients.ErrConnectionClosed)
 }
 
-func TestServerProcessSubscribeFailACLNoRetainedReturned(t *testing.T) {
-	s, cl, r, w := setupClient()
-	cl.AC = new(auth.Disallow)
+func TestServerSendLWTClearsStore(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	store := mem.New()
+	s.Store = store
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("hello"),
+		Retain:  true,
+	}
+	s.Clients.Add(cl)
+	s.flushClient(cl)
 
-	s.Topics.RetainMessage(packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type:   packets.Publish,
-			Retain: true,
-		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
-	})
-	require.Equal(t, 1, len(s.Topics.Messages("a/b/c")))
+	s.sendLWT(cl)
+	require.Equal(t, clients.LWT{}, cl.LWT)
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
 
-	recv := make(chan []byte)
-	go func() {
-		buf, err := ioutil.ReadAll(r)
-		if err != nil {
-			panic(err)
-		}
-		recv <- buf
-	}()
+	stored, err := store.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	require.Equal(t, persistence.LWT{}, stored[0].LWT)
+}
 
-	err := s.processPacket(cl, packets.Packet{
+func TestServerSendLWTProperties(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	store := mem.New()
+	s.Store = store
+
+	cl.Identify("tcp1", packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Subscribe,
+			Type: packets.Connect,
 		},
-		PacketID: 10,
-		Topics:   []string{"a/b/c", "d/e/f"},
-		Qoss:     []byte{0, 1},
-	})
+		ProtocolName:     []byte{'M', 'Q', 'T', 'T'},
+		ProtocolVersion:  5,
+		ClientIdentifier: "mochi",
+		WillFlag:         true,
+		WillTopic:        "a/b/c",
+		WillMessage:      []byte{0xde, 0xad, 0xbe, 0xef},
+		WillRetain:       true,
+		WillProperties: packets.Properties{
+			PayloadFormat:         1,
+			PayloadFormatFlag:     true,
+			MessageExpiryInterval: 120,
+			ContentType:           "application/octet-stream",
+			ResponseTopic:         "reply/mochi",
+			CorrelationData:       []byte("corr"),
+			User: []packets.UserProperty{
+				{Key: "k1", Val: "v1"},
+				{Key: "k2", Val: "v2"},
+			},
+		},
+	}, new(auth.Allow))
+	s.Clients.Add(cl)
+	s.storeClient(cl)
 
+	stored, err := store.ReadClients()
 	require.NoError(t, err)
-	time.Sleep(10 * time.Millisecond)
-	w.Close()
+	require.Len(t, stored, 1)
+	require.Equal(t, storedLWT(cl.LWT), stored[0].LWT)
+	require.Equal(t, cl.LWT, restoredLWT(stored[0].LWT))
 
-	require.Equal(t, []byte{
-		byte(packets.Suback << 4), 4,
-		0, 10,
-		packets.ErrSubAckNetworkError,
-		packets.ErrSubAckNetworkError,
-	}, <-recv)
+	s.sendLWT(cl)
+	msgs := s.Topics.Messages("a/b/c")
+	require.Len(t, msgs, 1)
+	require.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, msgs[0].Payload)
+	require.Equal(t, byte(1), msgs[0].Properties.PayloadFormat)
+	require.True(t, msgs[0].Properties.PayloadFormatFlag)
+	require.Equal(t, uint32(120), msgs[0].Properties.MessageExpiryInterval)
+	require.Equal(t, "application/octet-stream", msgs[0].Properties.ContentType)
+	require.Equal(t, "reply/mochi", msgs[0].Properties.ResponseTopic)
+	require.Equal(t, []byte("corr"), msgs[0].Properties.CorrelationData)
+	require.Equal(t, []packets.UserProperty{
+		{Key: "k1", Val: "v1"},
+		{Key: "k2", Val: "v2"},
+	}, msgs[0].Properties.User)
+}
 
-	require.Empty(t, s.Topics.Subscribers("a/b/c"))
-	require.Empty(t, s.Topics.Subscribers("d/e/f"))
+func TestServerSendLWTDelay(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("hello"),
+		Retain:  true,
+		Delay:   1,
+	}
+	s.Clients.Add(cl)
+
+	s.sendLWT(cl)
+	require.Empty(t, s.Topics.Messages("a/b/c"))
+	require.Contains(t, s.wills, cl.ID)
+
+	require.Eventually(t, func() bool {
+		return len(s.Topics.Messages("a/b/c")) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	s.willsMu.Lock()
+	require.NotContains(t, s.wills, cl.ID)
+	s.willsMu.Unlock()
 }
 
-func TestServerProcessSubscribeWriteError(t *testing.T) {
+func TestServerCancelLWT(t *testing.T) {
 	s, cl, _, _ := setupClient()
-	cl.Stop(errTestStop)
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("hello"),
+		Retain:  true,
+		Delay:   1,
+	}
+	s.Clients.Add(cl)
 
-	err := s.processPacket(cl, packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type: packets.Subscribe,
-		},
-		PacketID: 10,
-		Topics:   []string{"a/b/c", "d/e/f"},
-		Qoss:     []byte{0, 1},
-	})
+	require.False(t, s.cancelLWT(cl.ID))
+	s.sendLWT(cl)
+	require.True(t, s.cancelLWT(cl.ID))
+	require.Empty(t, s.wills)
 
-	require.Error(t, err)
-	require.Equal(t, errTestStop, cl.StopCause())
+	time.Sleep(1100 * time.Millisecond)
+	require.Empty(t, s.Topics.Messages("a/b/c"))
 }
 
-func TestServerProcessUnsubscribeInvalid(t *testing.T) {
+func TestServerSendLWTDelayStoresDue(t *testing.T) {
 	s, cl, _, _ := setupClient()
+	store := mem.New()
+	s.Store = store
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("hello"),
+		Delay:   60,
+	}
+	s.Clients.Add(cl)
 
-	err := s.processPacket(cl, packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type: packets.Unsubscribe,
-			Qos:  1,
-		},
-		PacketID: 0,
-	})
+	now := time.Now().Unix()
+	s.sendLWT(cl)
+	require.InDelta(t, now+60, cl.LWT.Due, 1)
 
-	require.Error(t, err)
+	stored, err := store.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	require.Equal(t, cl.LWT.Due, stored[0].LWT.Due)
+	require.True(t, s.cancelLWT(cl.ID))
 }
 
-func TestServerProcessUnsubscribe(t *testing.T) {
-	s, cl, r, w := setupClient()
+func TestServerSendLWTDelayDuePassed(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("hello"),
+		Retain:  true,
+		Delay:   60,
+		Due:     time.Now().Unix() - 1,
+	}
+	s.Clients.Add(cl)
 
-	unsubscribeEvent := ""
-	unsubscribeClient := ""
-	s.Events.OnUnsubscribe = func(filter string, cl events.Client) {
-		if filter == "a/b/c" {
-			unsubscribeEvent = "a/b/c"
-			unsubscribeClient = cl.ID
-		}
+	s.sendLWT(cl)
+	require.Eventually(t, func() bool {
+		return len(s.Topics.Messages("a/b/c")) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+// delayedWillSession adds the disconnected client mochi to a server, with a
+// retained will message waiting on a will delay interval.
+func delayedWillSession(s *Server) {
+	cl := clients.NewClientStub(s.System)
+	cl.ID = "mochi"
+	cl.SessionExpiryInterval = clients.SessionExpiryNever
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("hello"),
+		Retain:  true,
+		Delay:   60,
 	}
+	s.Clients.Add(cl)
+	s.sendLWT(cl)
+}
+
+func TestServerEstablishConnectionResumeCancelsDelayedLWT(t *testing.T) {
+	s := New()
+	delayedWillSession(s)
+	require.Contains(t, s.wills, "mochi")
 
+	connectStored(t, s, 0)
+	require.Empty(t, s.wills)
+	require.Empty(t, s.Topics.Messages("a/b/c"))
+}
+
+func TestServerEstablishConnectionCleanStartSendsDelayedLWT(t *testing.T) {
+	s := New()
+	delayedWillSession(s)
+	require.Contains(t, s.wills, "mochi")
+
+	connectStored(t, s, 2) // clean session
+	require.Empty(t, s.wills)
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
+}
+
+func TestServerCloseKeepsDelayedLWT(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	store := mem.New()
+	s.Store = store
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("hello"),
+		Delay:   60,
+	}
 	s.Clients.Add(cl)
-	s.Topics.Subscribe("a/b/c", cl.ID, 0)
-	s.Topics.Subscribe("d/e/f", cl.ID, 1)
-	s.Topics.Subscribe("a/b/+", cl.ID, 2)
-	cl.NoteSubscription("a/b/c", 0)
-	cl.NoteSubscription("d/e/f", 1)
-	cl.NoteSubscription("a/b/+", 2)
+	s.flushClient(cl)
 
-	recv := make(chan []byte)
-	go func() {
-		buf, err := ioutil.ReadAll(r)
-		if err != nil {
-			panic(err)
-		}
-		recv <- buf
-	}()
+	s.sendLWT(cl)
+	require.Len(t, s.wills, 1)
+
+	s.Close()
+	require.Empty(t, s.wills)
+
+	s.sendLWT(cl) // wills are not scheduled once the server is closing.
+	require.Empty(t, s.wills)
+
+	stored, err := store.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	require.Equal(t, "a/b/c", stored[0].LWT.Topic)
+}
+
+func TestServerProcessDisconnectClearsLWT(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	store := mem.New()
+	s.Store = store
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("hello"),
+		Retain:  true,
+	}
+	s.Clients.Add(cl)
+	s.flushClient(cl)
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Unsubscribe,
+			Type: packets.Disconnect,
 		},
-		PacketID: 12,
-		Topics:   []string{"a/b/c", "d/e/f"},
 	})
-
 	require.NoError(t, err)
-	time.Sleep(10 * time.Millisecond)
-	w.Close()
-
-	require.Equal(t, []byte{
-		byte(packets.Unsuback << 4), 2,
-		0, 12,
-	}, <-recv)
-
-	require.NotEmpty(t, s.Topics.Subscribers("a/b/c"))
-	require.Empty(t, s.Topics.Subscribers("d/e/f"))
-	require.NotContains(t, cl.Subscriptions, "a/b/c")
-	require.NotContains(t, cl.Subscriptions, "d/e/f")
-
-	require.NotEmpty(t, s.Topics.Subscribers("a/b/+"))
-	require.Contains(t, cl.Subscriptions, "a/b/+")
+	require.Equal(t, clients.LWT{}, cl.LWT)
+	require.Empty(t, s.Topics.Messages("a/b/c"))
 
-	require.Equal(t, "a/b/c", unsubscribeEvent)
-	require.Equal(t, cl.ID, unsubscribeClient)
+	stored, err := store.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	require.Equal(t, persistence.LWT{}, stored[0].LWT)
 }
 
-func TestServerProcessUnsubscribeWriteError(t *testing.T) {
+func TestServerProcessDisconnectWithWill(t *testing.T) {
 	s, cl, _, _ := setupClient()
-	cl.Stop(errTestStop)
+	cl.ProtocolVersion = 5
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("hello"),
+		Retain:  true,
+	}
+	s.Clients.Add(cl)
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Unsubscribe,
+			Type: packets.Disconnect,
 		},
-		PacketID: 12,
-		Topics:   []string{"a/b/c", "d/e/f"},
+		ProtocolVersion: 5,
+		ReturnCode:      packets.CodeDisconnectWillMessage,
 	})
-
-	require.Error(t, err)
-	require.Equal(t, errTestStop, cl.StopCause())
+	require.NoError(t, err)
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
 }
 
-func TestEventLoop(t *testing.T) {
-	s := New()
-	s.sysTicker = time.NewTicker(2 * time.Millisecond)
+func TestServerProcessDisconnectSessionExpiry(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.ProtocolVersion = 5
+	cl.SessionExpiryInterval = 30
+	s.Clients.Add(cl)
 
-	go func() {
-		s.eventLoop()
-	}()
-	time.Sleep(time.Millisecond * 3)
-	close(s.done)
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Disconnect,
+		},
+		ProtocolVersion: 5,
+		Properties: packets.Properties{
+			SessionExpiryInterval:     120,
+			SessionExpiryIntervalFlag: true,
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(120), cl.SessionExpiryInterval)
 }
 
-func TestServerClose(t *testing.T) {
+func TestServerProcessDisconnectSessionExpiryZero(t *testing.T) {
 	s, cl, _, _ := setupClient()
-	cl.Listener = "t1"
+	cl.ProtocolVersion = 5
 	s.Clients.Add(cl)
 
-	p := new(persistence.MockStore)
-	err := s.AddStore(p)
-	require.NoError(t, err)
-
-	err = s.AddListener(listeners.NewMockListener("t1", ":1882"), nil)
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Disconnect,
+		},
+		ProtocolVersion: 5,
+		Properties: packets.Properties{
+			SessionExpiryInterval:     120,
+			SessionExpiryIntervalFlag: true,
+		},
+	})
 	require.NoError(t, err)
-	s.Serve()
-	time.Sleep(time.Millisecond)
-	require.Equal(t, 1, s.Listeners.Len())
-
-	listener, ok := s.Listeners.Get("t1")
-	require.Equal(t, true, ok)
-	require.Equal(t, true, listener.(*listeners.MockListener).IsServing())
-
-	s.Close()
-	time.Sleep(time.Millisecond)
-	require.Equal(t, false, listener.(*listeners.MockListener).IsServing())
-	require.Equal(t, true, p.Closed)
+	require.Equal(t, uint32(0), cl.SessionExpiryInterval)
 }
 
-func TestServerCloseClientLWT(t *testing.T) {
-	s, cl1, _, _ := setupClient()
-	cl1.Listener = "t1"
-	cl1.LWT = clients.LWT{
-		Topic:   "a/b/c",
-		Message: []byte{'h', 'e', 'l', 'l', 'o'},
-	}
-	s.Clients.Add(cl1)
-
-	cl2, r2, w2 := setupServerClient(s)
-	cl2.ID = "mochi2"
-	s.Clients.Add(cl2)
+func TestServerReadStoreSendsLWT(t *testing.T) {
+	s := New()
+	store := mem.New()
+	require.NoError(t, store.WriteClient(persistence.Client{
+		ID:       "cl_mochi",
+		ClientID: "mochi",
+		T:        persistence.KClient,
+		Listener: "tcp1",
+		LWT: persistence.LWT{
+			Topic:   "a/b/c",
+			Message: []byte("hello"),
+			Retain:  true,
+		},
+	}))
+	require.NoError(t, store.WriteClient(persistence.Client{
+		ID:       "cl_zen",
+		ClientID: "zen",
+		T:        persistence.KClient,
+		Listener: "tcp1",
+		LWT: persistence.LWT{
+			Topic:   "d/e/f",
+			Message: []byte("hello"),
+			Retain:  true,
+			Delay:   60,
+		},
+	}))
+	s.Store = store
 
-	s.Topics.Subscribe("a/b/c", cl2.ID, 0)
+	now := time.Now().Unix()
+	require.NoError(t, s.readStore())
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
+	require.Empty(t, s.Topics.Messages("d/e/f"))
+	require.Contains(t, s.wills, "zen")
 
-	ack2 := make(chan []byte)
-	go func() {
-		buf, err := ioutil.ReadAll(r2)
-		if err != nil {
-			panic(err)
+	stored, err := store.ReadClients()
+	require.NoError(t, err)
+	for _, c := range stored {
+		if c.ClientID == "mochi" {
+			require.Equal(t, persistence.LWT{}, c.LWT)
+		} else {
+			require.Equal(t, "d/e/f", c.LWT.Topic)
+			require.InDelta(t, now+60, c.LWT.Due, 1) // the delay starts from the restart.
 		}
-		ack2 <- buf
-	}()
+	}
 
-	s.sendLWT(cl1)
-	cl1.Stop(fmt.Errorf("goodbye"))
+	require.True(t, s.cancelLWT("zen"))
+}
 
-	time.Sleep(time.Millisecond)
-	w2.Close()
+func TestServerReadStoreDelayedLWTDue(t *testing.T) {
+	s := New()
+	store := mem.New()
+	require.NoError(t, store.WriteClient(persistence.Client{
+		ID:       "cl_mochi",
+		ClientID: "mochi",
+		T:        persistence.KClient,
+		LWT: persistence.LWT{
+			Topic:   "a/b/c",
+			Message: []byte("hello"),
+			Retain:  true,
+			Delay:   60,
+			Due:     time.Now().Unix() - 5, // due while the server was stopped.
+		},
+	}))
+	require.NoError(t, store.WriteClient(persistence.Client{
+		ID:       "cl_zen",
+		ClientID: "zen",
+		T:        persistence.KClient,
+		LWT: persistence.LWT{
+			Topic:   "d/e/f",
+			Message: []byte("hello"),
+			Retain:  true,
+			Delay:   60,
+			Due:     time.Now().Unix() + 30,
+		},
+	}))
+	s.Store = store
 
-	require.Equal(t, []byte{
-		byte(packets.Publish << 4), 12,
-		0, 5,
-		'a', '/', 'b', '/', 'c',
-		'h', 'e', 'l', 'l', 'o',
-	}, <-ack2)
-}
+	require.NoError(t, s.readStore())
+	require.Eventually(t, func() bool {
+		return len(s.Topics.Messages("a/b/c")) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Empty(t, s.Topics.Messages("d/e/f"))
 
-func TestServerCloseClientClosed(t *testing.T) {
-	s, cl, _, _ := setupClient()
+	zen, ok := s.Clients.Get("zen")
+	require.True(t, ok)
+	require.InDelta(t, time.Now().Unix()+30, zen.LWT.Due, 1) // the original due time is kept.
+	require.True(t, s.cancelLWT("zen"))
+}
 
-	var hook errorHook
-	s.Events.OnError = hook.onError
+func TestServerExportImportState(t *testing.T) {
+	src := New()
+	src.Store = mem.New()
+	require.NoError(t, src.Store.WriteServerInfo(persistence.ServerInfo{
+		Info: system.Info{Started: 100, MessagesRecv: 5},
+		ID:   persistence.KServerInfo,
+	}))
+	require.NoError(t, src.Store.WriteClient(persistence.Client{ID: "cl_a", ClientID: "a", T: persistence.KClient, Username: []byte("u")}))
+	require.NoError(t, src.Store.WriteSubscription(persistence.Subscription{ID: "a:x/y", T: persistence.KSubscription, Client: "a", Filter: "x/y", QoS: 1}))
+	require.NoError(t, src.Store.WriteInflight(persistence.Message{ID: "if_a_1", T: persistence.KInflight, Client: "a", PacketID: 1, TopicName: "x/y", Payload: []byte("p"), Created: 10}))
+	require.NoError(t, src.Store.WriteRetained(persistence.Message{ID: "ret_x/y", T: persistence.KRetained, TopicName: "x/y", Payload: []byte("r")}))
+
+	var buf bytes.Buffer
+	require.NoError(t, src.ExportState(&buf))
+
+	dst := New()
+	dst.Store = mem.New()
+	require.NoError(t, dst.Store.WriteClient(persistence.Client{ID: "cl_b", ClientID: "b", T: persistence.KClient}))
+	require.NoError(t, dst.ImportState(bytes.NewReader(buf.Bytes())))
+
+	want, err := persistence.ReadState(src.Store)
+	require.NoError(t, err)
+	got, err := persistence.ReadState(dst.Store)
+	require.NoError(t, err)
+	require.Equal(t, want.ServerInfo, got.ServerInfo)
+	require.Equal(t, want.Subscriptions, got.Subscriptions)
+	require.Equal(t, want.Inflight, got.Inflight)
+	require.Equal(t, want.Retained, got.Retained)
+	require.Len(t, got.Clients, 2)
+
+	dst.Options.StateImport = StateReplace
+	require.NoError(t, dst.ImportState(bytes.NewReader(buf.Bytes())))
+	got, err = persistence.ReadState(dst.Store)
+	require.NoError(t, err)
+	require.Equal(t, want.Clients, got.Clients)
+}
 
-	cl.Listener = "t1"
-	cl.LWT = clients.LWT{
-		Qos:     1,
-		Topic:   "a/b/c",
-		Message: []byte{'h', 'e', 'l', 'l', 'o'},
-	}
-	// Close the client connection abruptly, e.g., as if the
-	// seession were taken over or a protocol error had occurred.
-	cl.Stop(errTestStop)
+func TestServerExportImportStateErrors(t *testing.T) {
+	s := New()
+	require.ErrorIs(t, s.ExportState(io.Discard), ErrNoStore)
+	require.ErrorIs(t, s.ImportState(strings.NewReader("{}")), ErrNoStore)
 
-	s.sendLWT(cl)
-	cl.Stop(clients.ErrConnectionClosed)
+	s.Store = &persistence.MockStore{Fail: map[string]bool{"read_clients": true}}
+	require.Error(t, s.ExportState(io.Discard))
 
-	// We see the original error that caused the connection to stop.
-	err := cl.StopCause()
-	require.Equal(t, true, errors.Is(err, errTestStop) || errors.Is(err, io.EOF))
+	s.Store = mem.New()
+	require.Error(t, s.ImportState(strings.NewReader("{")))
+	require.ErrorIs(t, s.ImportState(strings.NewReader(`{"Version":99}`)), persistence.ErrStateVersion)
 
-	// Errors were generated in the closeClient() code path.
-	require.Equal(t, 1, hook.cnt)
-	require.ErrorIs(t, hook.err, clients.ErrConnectionClosed)
+	s.serving = true
+	require.ErrorIs(t, s.ImportState(strings.NewReader("{}")), ErrServing)
 }
 
 func TestServerReadStore(t *testing.T) {
@@ -2310,7 +10794,8 @@ func TestServerReadStore(t *testing.T) {
 	err := s.readStore()
 	require.NoError(t, err)
 
-	require.Equal(t, int64(100), s.System.Started)
+	require.Equal(t, s.StartTime().Unix(), s.System.Started)
+	require.Equal(t, int64(100), s.System.FirstStarted)
 	require.Equal(t, topics.Subscriptions{"test": 1}, s.Topics.Subscribers("a/b/c"))
 
 	cl1, ok := s.Clients.Get("client1")
@@ -2364,14 +10849,53 @@ func TestServerLoadServerInfo(t *testing.T) {
 
 	s.loadServerInfo(persistence.ServerInfo{
 		Info: system.Info{
-			Version: "test",
-			Started: 100,
+			Version:      "test",
+			Started:      100,
+			FirstStarted: 50,
+			MessagesRecv: 10,
 		},
 		ID: persistence.KServerInfo,
 	})
 
 	require.Equal(t, "original", s.System.Version)
-	require.Equal(t, int64(100), s.System.Started)
+	require.Equal(t, s.StartTime().Unix(), s.System.Started)
+	require.Equal(t, int64(50), s.System.FirstStarted)
+	require.Equal(t, int64(10), s.System.MessagesRecv)
+}
+
+func TestServerLoadServerInfoFirstStarted(t *testing.T) {
+	s := New()
+
+	// info stored before the first start was recorded.
+	s.loadServerInfo(persistence.ServerInfo{
+		Info: system.Info{Started: 100},
+		ID:   persistence.KServerInfo,
+	})
+	require.Equal(t, int64(100), s.System.FirstStarted)
+
+	// an empty store.
+	s = New()
+	s.loadServerInfo(persistence.ServerInfo{})
+	require.Equal(t, s.StartTime().Unix(), s.System.FirstStarted)
+	require.Equal(t, s.StartTime().Unix(), s.System.Started)
+}
+
+func TestServerUptime(t *testing.T) {
+	before := time.Now()
+	s := New()
+	require.False(t, s.StartTime().Before(before))
+	require.False(t, s.StartTime().After(time.Now()))
+	require.Equal(t, s.StartTime().Unix(), s.System.Started)
+	require.Equal(t, s.StartTime().Unix(), s.FirstStartTime().Unix())
+
+	time.Sleep(5 * time.Millisecond)
+	require.GreaterOrEqual(t, s.Uptime(), 5*time.Millisecond)
+
+	s.loadServerInfo(persistence.ServerInfo{
+		Info: system.Info{Started: 200, FirstStarted: 100},
+		ID:   persistence.KServerInfo,
+	})
+	require.Equal(t, time.Unix(100, 0), s.FirstStartTime())
 }
 
 func TestServerLoadSubscriptions(t *testing.T) {
@@ -2404,6 +10928,54 @@ func TestServerLoadSubscriptions(t *testing.T) {
 	require.Equal(t, topics.Subscriptions{"test": 0}, s.Topics.Subscribers("d/e/f"))
 }
 
+func TestServerLoadSubscriptionsIdentifier(t *testing.T) {
+	s := New()
+	cl := clients.NewClientStub(s.System)
+	cl.ID = "test"
+	s.Clients.Add(cl)
+
+	s.loadSubscriptions([]persistence.Subscription{
+		{
+			ID:     "test:$share/g1/a/b/c",
+			Client: "test",
+			Filter: "$share/g1/a/b/c",
+			QoS:    1,
+			T:      persistence.KSubscription,
+			Group:  "g1",
+
+			SubscriptionIdentifier: 7,
+		},
+	})
+
+	require.Equal(t, topics.Subscriptions{"test": 1}, s.Topics.SharedMembers("$share/g1/a/b/c"))
+	require.Equal(t, 7, cl.SubscriptionIDs["$share/g1/a/b/c"])
+}
+
+func TestServerLoadSubscriptionsOptions(t *testing.T) {
+	s := New()
+	cl := clients.NewClientStub(s.System)
+	cl.ID = "test"
+	s.Clients.Add(cl)
+
+	s.loadSubscriptions([]persistence.Subscription{
+		{
+			ID:     "test:a/b/c",
+			Client: "test",
+			Filter: "a/b/c",
+			QoS:    1,
+			T:      persistence.KSubscription,
+
+			RetainAsPublished: true,
+			RetainHandling:    packets.RetainDoNotSend,
+		},
+	})
+
+	require.Equal(t, packets.SubOptions{
+		RetainAsPublished: true,
+		RetainHandling:    packets.RetainDoNotSend,
+	}, cl.SubOptions["a/b/c"])
+}
+
 func TestServerLoadClients(t *testing.T) {
 	s := New()
 	require.NotNil(t, s)
@@ -2435,6 +11007,46 @@ func TestServerLoadClients(t *testing.T) {
 
 }
 
+func TestServerLoadClientsSessionExpiry(t *testing.T) {
+	s := New()
+	now := time.Now().Unix()
+
+	s.loadClients([]persistence.Client{
+		{
+			ID:                    "cl_client1",
+			ClientID:              "client1",
+			T:                     persistence.KClient,
+			SessionExpiryInterval: 30,
+			Expires:               now - 5,
+		},
+		{
+			ID:                    "cl_client2",
+			ClientID:              "client2",
+			T:                     persistence.KClient,
+			SessionExpiryInterval: 30,
+		},
+		{
+			ID:                    "cl_client3",
+			ClientID:              "client3",
+			T:                     persistence.KClient,
+			SessionExpiryInterval: clients.SessionExpiryNever,
+		},
+	})
+
+	cl1, ok := s.Clients.Get("client1")
+	require.True(t, ok)
+	require.Equal(t, uint32(30), cl1.SessionExpiryInterval)
+	require.Equal(t, now-5, cl1.SessionExpires())
+
+	cl2, ok := s.Clients.Get("client2")
+	require.True(t, ok)
+	require.InDelta(t, now+30, cl2.SessionExpires(), 1)
+
+	cl3, ok := s.Clients.Get("client3")
+	require.True(t, ok)
+	require.Equal(t, int64(0), cl3.SessionExpires())
+}
+
 func TestServerLoadInflight(t *testing.T) {
 	s := New()
 	require.NotNil(t, s)
@@ -2477,7 +11089,81 @@ func TestServerLoadInflight(t *testing.T) {
 	msg, ok := cl1.Inflight.Get(100)
 	require.Equal(t, true, ok)
 	require.Equal(t, []byte{'y', 'e', 's'}, msg.Packet.Payload)
+	require.Equal(t, int64(200), msg.Sent)
+	require.Equal(t, 1, msg.Resends)
+}
+
+func TestServerLoadInflightSequence(t *testing.T) {
+	s := New()
+
+	w, _ := net.Pipe()
+	defer w.Close()
+	c1 := clients.NewClient(w, nil, nil, nil)
+	c1.ID = "client1"
+	s.Clients.Add(c1)
+
+	s.loadInflight([]persistence.Message{
+		{ID: "client1_if_1", T: persistence.KInflight, Client: "client1", PacketID: 1, Sequence: 4},
+		{ID: "client1_if_2", T: persistence.KInflight, Client: "client1", PacketID: 2, Sequence: 7},
+		{ID: "client2_if_1", T: persistence.KInflight, Client: "client2", PacketID: 1, Sequence: 9},
+	})
+
+	msg, ok := c1.Inflight.Get(2)
+	require.True(t, ok)
+	require.Equal(t, int64(7), msg.Sequence)
+	require.Equal(t, int64(9), s.inflightSeq)
+}
+
+func TestServerLoadRetainedExpiry(t *testing.T) {
+	s := New()
+	now := time.Now().Unix()
+
+	s.loadRetained([]persistence.Message{
+		{
+			ID:             "ret_a/b/c",
+			T:              persistence.KRetained,
+			FixedHeader:    persistence.FixedHeader{Retain: true},
+			TopicName:      "a/b/c",
+			Payload:        []byte("old"),
+			Created:        now - 20,
+			ExpiryInterval: 10,
+		},
+		{
+			ID:             "ret_d/e/f",
+			T:              persistence.KRetained,
+			FixedHeader:    persistence.FixedHeader{Retain: true},
+			TopicName:      "d/e/f",
+			Payload:        []byte("new"),
+			Created:        now - 20,
+			ExpiryInterval: 30,
+		},
+	})
+
+	require.Len(t, s.Topics.Messages("a/b/c"), 0)
+	msgs := s.Topics.Messages("d/e/f")
+	require.Len(t, msgs, 1)
+	require.Equal(t, uint32(30), msgs[0].Properties.MessageExpiryInterval)
+	require.Equal(t, now-20, msgs[0].Created)
+}
+
+func TestServerLoadInflightQuota(t *testing.T) {
+	s := NewServer(&Options{MaxInflight: 1})
+	s.Store = new(persistence.MockStore)
+
+	w, _ := net.Pipe()
+	defer w.Close()
+	c1 := clients.NewClient(w, nil, nil, nil)
+	c1.ID = "client1"
+	s.Clients.Add(c1)
+
+	s.loadInflight([]persistence.Message{
+		{ID: "client1_if_1", T: persistence.KInflight, Client: "client1", PacketID: 1, TopicName: "a/b/c"},
+		{ID: "client1_if_2", T: persistence.KInflight, Client: "client1", PacketID: 2, TopicName: "a/b/c"},
+	})
 
+	n, ok := s.ClientInflight("client1")
+	require.True(t, ok)
+	require.Equal(t, 1, n)
 }
 
 func TestServerLoadRetained(t *testing.T) {
@@ -2570,9 +11256,55 @@ func TestServerResendClientInflight(t *testing.T) {
 		0, 11,
 		'h', 'e', 'l', 'l', 'o',
 	}, rcv)
-
-	m := cl.Inflight.GetAll()
-	require.Equal(t, 1, m[11].Resends) // index is packet id
+
+	m := cl.Inflight.GetAll()
+	require.Equal(t, 1, m[11].Resends) // index is packet id
+}
+
+func TestServerResendClientInflightOrder(t *testing.T) {
+	s := New()
+
+	r, w := net.Pipe()
+	cl := clients.NewClient(r, circ.NewReader(128, 8), circ.NewWriter(128, 8), new(system.Info))
+	cl.Start()
+	s.Clients.Add(cl)
+
+	o := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		require.NoError(t, err)
+		o <- buf
+	}()
+
+	for i, seq := range []int64{3, 1, 2} {
+		pk := packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: "a",
+			PacketID:  uint16(i + 1),
+		}
+		cl.Inflight.Set(pk.PacketID, clients.InflightMessage{
+			Packet:   pk,
+			Sent:     time.Now().Unix(),
+			Sequence: seq,
+		})
+	}
+
+	err := s.ResendClientInflight(cl, true)
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond)
+
+	r.Close()
+
+	rcv := <-o
+	require.Equal(t, []byte{
+		byte(packets.Publish<<4 | 1<<1 | 1<<3), 5, 0, 1, 'a', 0, 2,
+		byte(packets.Publish<<4 | 1<<1 | 1<<3), 5, 0, 1, 'a', 0, 3,
+		byte(packets.Publish<<4 | 1<<1 | 1<<3), 5, 0, 1, 'a', 0, 1,
+	}, rcv)
 }
 
 func TestServerResendClientInflightBackoff(t *testing.T) {
@@ -2689,6 +11421,109 @@ func TestServerResendClientInflightDropMessage(t *testing.T) {
 	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.PublishDropped))
 }
 
+func TestServerResendClientInflightDropMaxResends(t *testing.T) {
+	l := new(testLogger)
+	s := NewServer(&Options{InflightMaxResends: 2, Logger: l})
+	s.Store = new(persistence.MockStore)
+
+	r, _ := net.Pipe()
+	cl := clients.NewClient(r, circ.NewReader(128, 8), circ.NewWriter(128, 8), new(system.Info))
+	cl.ID = "mochi"
+	cl.Inflight.Set(11, clients.InflightMessage{
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: "a/b/c",
+			PacketID:  11,
+		},
+		Resends: 2,
+	})
+	atomic.StoreInt64(&s.System.Inflight, 1)
+
+	err := s.ResendClientInflight(cl, true)
+	require.NoError(t, err)
+	r.Close()
+
+	require.Equal(t, 0, cl.Inflight.Len())
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Inflight))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.PublishDropped))
+
+	log, ok := l.find("dropped unacknowledged inflight message")
+	require.True(t, ok)
+	require.Equal(t, "warn", log.level)
+	require.Equal(t, "mochi", log.kv[logger.KeyClientID])
+	require.Equal(t, uint16(11), log.kv["packet_id"])
+	require.Equal(t, 2, log.kv["resends"])
+}
+
+func TestServerResendDue(t *testing.T) {
+	s := New()
+	now := time.Now().Unix()
+
+	require.True(t, s.resendDue(clients.InflightMessage{Sent: now}, now))
+	require.False(t, s.resendDue(clients.InflightMessage{Sent: now, Resends: 3}, now))
+	require.True(t, s.resendDue(clients.InflightMessage{Sent: now - 10, Resends: 3}, now))
+	require.False(t, s.resendDue(clients.InflightMessage{Sent: now - 10, Resends: 20}, now))
+	require.True(t, s.resendDue(clients.InflightMessage{Sent: now - 21600, Resends: 20}, now))
+
+	s.Options.InflightResendInterval = 30
+	require.False(t, s.resendDue(clients.InflightMessage{Sent: now - 29}, now))
+	require.True(t, s.resendDue(clients.InflightMessage{Sent: now - 30, Resends: 5}, now))
+}
+
+func TestServerResendClientInflightInterval(t *testing.T) {
+	s := NewServer(&Options{InflightResendInterval: 30})
+
+	r, w := net.Pipe()
+	cl := clients.NewClient(r, circ.NewReader(128, 8), circ.NewWriter(128, 8), new(system.Info))
+	cl.Start()
+
+	o := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		require.NoError(t, err)
+		o <- buf
+	}()
+
+	now := time.Now().Unix()
+	for i, sent := range []int64{now - 10, now - 40} {
+		cl.Inflight.Set(uint16(i+1), clients.InflightMessage{
+			Packet: packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type: packets.Publish,
+					Qos:  1,
+				},
+				TopicName: "a",
+				PacketID:  uint16(i + 1),
+			},
+			Sent:     sent,
+			Sequence: int64(i),
+		})
+	}
+
+	err := s.ResendClientInflight(cl, false)
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond)
+	r.Close()
+
+	rcv := <-o
+	require.Equal(t, []byte{
+		byte(packets.Publish<<4 | 1<<1 | 1<<3), 5, 0, 1, 'a', 0, 2,
+	}, rcv)
+
+	in, ok := cl.Inflight.Get(2)
+	require.True(t, ok)
+	require.Equal(t, 1, in.Resends)
+	require.True(t, in.Packet.FixedHeader.Dup)
+
+	in, ok = cl.Inflight.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 0, in.Resends)
+}
+
 func TestServerResendClientInflightError(t *testing.T) {
 	s := New()
 	require.NotNil(t, s)
@@ -2705,6 +11540,380 @@ func TestServerResendClientInflightError(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestServerClearExpiredRetained(t *testing.T) {
+	s := New()
+	s.Store = new(persistence.MockStore)
+	now := time.Now().Unix()
+
+	for i, expiry := range []uint32{0, 5, 50} {
+		s.retainMessage(&s.inline, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Retain: true,
+			},
+			Properties: packets.Properties{
+				MessageExpiryInterval: expiry,
+			},
+			TopicName: "a/b/" + strconv.Itoa(i),
+			Payload:   []byte("hello"),
+			Created:   now - 10,
+		})
+	}
+	require.Equal(t, int64(3), atomic.LoadInt64(&s.System.Retained))
+
+	s.clearExpiredRetained(now)
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.System.Retained))
+	require.Len(t, s.Topics.Messages("a/b/1"), 0)
+	require.Len(t, s.Topics.Messages("a/b/+"), 2)
+}
+
+func TestServerDeleteAllRetained(t *testing.T) {
+	s := New()
+	store := mem.New()
+	s.Store = store
+
+	for _, topic := range []string{"a/b/c", "a/b/d", "e"} {
+		s.retainMessage(&s.inline, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Retain: true,
+			},
+			TopicName: topic,
+			Payload:   []byte("hello"),
+		})
+	}
+	s.publishSysTopics()
+	sys := atomic.LoadInt64(&s.System.Retained) - 3
+	require.NotZero(t, sys)
+
+	err := s.DeleteAllRetained()
+	require.NoError(t, err)
+	require.Len(t, s.Topics.Messages("#"), 0)
+	require.NotEmpty(t, s.Topics.Messages("$SYS/#"))
+	require.Equal(t, sys, atomic.LoadInt64(&s.System.Retained))
+
+	n, err := store.CountRetained()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestServerDeleteAllRetainedStoreError(t *testing.T) {
+	s := New()
+	s.Store = &persistence.MockStore{
+		Fail: map[string]bool{
+			"delete_all_retained": true,
+		},
+	}
+
+	err := s.DeleteAllRetained()
+	require.Error(t, err)
+}
+
+func TestServerEndSessionDiscard(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	store := mem.New()
+	s.Store = store
+	s.Clients.Add(cl)
+	cl.NoteSubscription("a/b/c", 1)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+	cl.Inflight.Set(1, clients.InflightMessage{
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			PacketID:  1,
+			TopicName: "a/b/c",
+		},
+	})
+	atomic.AddInt64(&s.System.Inflight, 1)
+	s.flushClient(cl)
+
+	s.endSession(cl)
+	_, ok := s.Clients.Get(cl.ID)
+	require.False(t, ok)
+	require.Empty(t, s.Topics.Subscribers("a/b/c"))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Inflight))
+
+	cls, err := store.ReadClients()
+	require.NoError(t, err)
+	require.Empty(t, cls)
+
+	subs, err := store.ReadSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	msgs, err := store.ReadInflight()
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestServerEndSessionNever(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.SessionExpiryInterval = clients.SessionExpiryNever
+	s.Clients.Add(cl)
+
+	s.endSession(cl)
+	_, ok := s.Clients.Get(cl.ID)
+	require.True(t, ok)
+	require.Equal(t, int64(0), cl.SessionExpires())
+}
+
+func TestServerEndSessionInterval(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	store := mem.New()
+	s.Store = store
+	cl.SessionExpiryInterval = 30
+	s.Clients.Add(cl)
+
+	s.endSession(cl)
+	_, ok := s.Clients.Get(cl.ID)
+	require.True(t, ok)
+	require.InDelta(t, time.Now().Unix()+30, cl.SessionExpires(), 1)
+
+	cls, err := store.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, cls, 1)
+	require.Equal(t, uint32(30), cls[0].SessionExpiryInterval)
+	require.Equal(t, cl.SessionExpires(), cls[0].Expires)
+}
+
+func TestServerPurgeSessionTakenOver(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = cl.ID
+	s.Clients.Add(cl2)
+
+	s.purgeSession(cl)
+	existing, ok := s.Clients.Get(cl.ID)
+	require.True(t, ok)
+	require.Equal(t, cl2, existing)
+	require.NotEmpty(t, s.Topics.Subscribers("a/b/c"))
+}
+
+func TestServerPurgeSessionSendsDelayedLWT(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("hello"),
+		Retain:  true,
+		Delay:   60,
+	}
+	s.Clients.Add(cl)
+	s.sendLWT(cl)
+	require.Empty(t, s.Topics.Messages("a/b/c"))
+
+	s.purgeSession(cl)
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
+}
+
+func TestServerClearExpiredSessions(t *testing.T) {
+	s := New()
+	store := mem.New()
+	s.Store = store
+	now := time.Now().Unix()
+
+	for i, expires := range []int64{now - 10, now + 10, 0} {
+		cl, _, _ := setupServerClient(s)
+		cl.ID = "mochi" + strconv.Itoa(i)
+		cl.SessionExpiryInterval = 20
+		cl.SetSessionExpires(expires)
+		cl.Stop(nil)
+		s.Clients.Add(cl)
+		s.flushClient(cl)
+	}
+
+	s.clearExpiredSessions(now)
+	_, ok := s.Clients.Get("mochi0")
+	require.False(t, ok)
+	_, ok = s.Clients.Get("mochi1")
+	require.True(t, ok)
+	_, ok = s.Clients.Get("mochi2")
+	require.True(t, ok)
+
+	cls, err := store.ReadClients()
+	require.NoError(t, err)
+	require.Len(t, cls, 2)
+}
+
+func TestServerClearExpiredSessionsStoreError(t *testing.T) {
+	s := New()
+	s.Store = &persistence.MockStore{
+		Fail: map[string]bool{
+			"clear_expired_sessions": true,
+		},
+	}
+
+	var errs []error
+	s.Events.OnError = func(cl events.Client, err error) {
+		errs = append(errs, err)
+	}
+
+	s.clearExpiredSessions(time.Now().Unix())
+	require.Len(t, errs, 1)
+}
+
+func TestServerRetainMessageMaxMessageBytes(t *testing.T) {
+	s := NewServer(&Options{
+		MaxRetainedMessageBytes: 5,
+	})
+	store := mem.New()
+	s.Store = store
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+	s.retainMessage(&s.inline, pk)
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
+
+	stored, err := store.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+
+	// The oversized message is not retained, and the older message it
+	// replaces is cleared rather than left to be sent to new subscribers.
+	pk.Payload = []byte("hello world")
+	s.retainMessage(&s.inline, pk)
+	require.Empty(t, s.Topics.Messages("a/b/c"))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.RetainedRejected))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.RetainedBytes))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.Retained))
+
+	stored, err = store.ReadRetained()
+	require.NoError(t, err)
+	require.Empty(t, stored)
+
+	// A message within the limit is retained again.
+	pk.Payload = []byte("hi")
+	s.retainMessage(&s.inline, pk)
+	require.Equal(t, []byte("hi"), s.Topics.Messages("a/b/c")[0].Payload)
+
+	// An empty payload still clears the retained message.
+	pk.Payload = []byte{}
+	s.retainMessage(&s.inline, pk)
+	require.Empty(t, s.Topics.Messages("a/b/c"))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.RetainedBytes))
+}
+
+func TestServerRetainMessageEvict(t *testing.T) {
+	s := NewServer(&Options{
+		MaxRetainedBytes: 12,
+	})
+	store := mem.New()
+	s.Store = store
+	now := time.Now().Unix()
+
+	for i, created := range []int64{now - 5, now - 10, now - 1} {
+		s.retainMessage(&s.inline, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Retain: true,
+			},
+			TopicName: "a/b/" + strconv.Itoa(i),
+			Payload:   []byte("hello"),
+			Created:   created,
+		})
+	}
+
+	// a/b/1 was the oldest message, so it was evicted to make room for a/b/2.
+	require.Len(t, s.Topics.Messages("a/b/1"), 0)
+	require.Len(t, s.Topics.Messages("a/b/+"), 2)
+	require.Equal(t, int64(10), atomic.LoadInt64(&s.System.RetainedBytes))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.RetainedEvicted))
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.System.Retained))
+
+	stored, err := store.ReadRetained()
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+
+	// Replacing a message with a larger one evicts the oldest of the others.
+	s.retainMessage(&s.inline, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: "a/b/2",
+		Payload:   []byte("hello world"),
+		Created:   now,
+	})
+	require.Len(t, s.Topics.Messages("a/b/0"), 0)
+	require.Len(t, s.Topics.Messages("a/b/2"), 1)
+	require.Equal(t, int64(11), atomic.LoadInt64(&s.System.RetainedBytes))
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.System.RetainedEvicted))
+}
+
+func TestServerLoadRetainedEvict(t *testing.T) {
+	s := NewServer(&Options{
+		MaxRetainedBytes: 5,
+	})
+
+	s.loadRetained([]persistence.Message{
+		{
+			ID:          "ret_a/b/c",
+			T:           persistence.KRetained,
+			FixedHeader: persistence.FixedHeader{Type: packets.Publish, Retain: true},
+			TopicName:   "a/b/c",
+			Payload:     []byte("hello"),
+			Created:     2,
+		},
+		{
+			ID:          "ret_d/e/f",
+			T:           persistence.KRetained,
+			FixedHeader: persistence.FixedHeader{Type: packets.Publish, Retain: true},
+			TopicName:   "d/e/f",
+			Payload:     []byte("hello"),
+			Created:     1,
+		},
+	})
+
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
+	require.Empty(t, s.Topics.Messages("d/e/f"))
+	require.Equal(t, int64(5), atomic.LoadInt64(&s.System.RetainedBytes))
+}
+
+func TestServerClearExpiredRetainedStoreError(t *testing.T) {
+	s := New()
+	s.Store = &persistence.MockStore{
+		Fail: map[string]bool{
+			"clear_expired_retained": true,
+		},
+	}
+
+	var errs []error
+	s.Events.OnError = func(cl events.Client, err error) {
+		errs = append(errs, err)
+	}
+
+	s.clearExpiredRetained(time.Now().Unix())
+	require.Len(t, errs, 1)
+}
+
+func TestServerClearExpiredInflightsStoreError(t *testing.T) {
+	s := New()
+	s.Store = &persistence.MockStore{
+		Fail: map[string]bool{
+			"clear_expired_inflight": true,
+		},
+	}
+
+	var errs []error
+	s.Events.OnError = func(cl events.Client, err error) {
+		errs = append(errs, err)
+	}
+
+	s.clearExpiredInflights(time.Now().Unix())
+	require.Len(t, errs, 1)
+	require.True(t, s.StoreFailing())
+}
+
 func TestServerClearExpiredInflights(t *testing.T) {
 	n := time.Now().Unix()
 
@@ -2742,6 +11951,40 @@ func TestServerClearExpiredInflights(t *testing.T) {
 	require.Equal(t, int64(-2), s.System.Inflight)
 }
 
+func TestServerClearExpiredInflightsQos(t *testing.T) {
+	n := time.Now().Unix()
+
+	s := New()
+	s.Options.InflightTTL = 10
+	s.Options.InflightTTLForQoS = map[byte]int64{1: 2, 2: 0}
+	require.NotNil(t, s)
+
+	r, _ := net.Pipe()
+	cl := clients.NewClient(r, circ.NewReader(128, 8), circ.NewWriter(128, 8), new(system.Info))
+	cl.Inflight.Set(1, clients.InflightMessage{
+		Packet:  packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}},
+		Created: n - 3,
+	})
+	cl.Inflight.Set(2, clients.InflightMessage{
+		Packet:  packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 2}},
+		Created: n - 3,
+	})
+	cl.Inflight.Set(3, clients.InflightMessage{
+		Packet:  packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}},
+		Created: n - 11,
+	})
+	s.Clients.Add(cl)
+
+	s.clearExpiredInflights(n)
+	_, ok := cl.Inflight.Get(1)
+	require.False(t, ok)
+	_, ok = cl.Inflight.Get(2)
+	require.True(t, ok)
+	_, ok = cl.Inflight.Get(3)
+	require.False(t, ok)
+	require.Equal(t, int64(-2), s.System.Inflight)
+}
+
 func TestServerClearAbandonedInflights(t *testing.T) {
 	s := New()
 	require.NotNil(t, s)
@@ -3,22 +3,35 @@ package system
 // Info contains atomic counters and values for various server statistics
 // commonly found in $SYS topics.
 type Info struct {
-	Version             string `json:"version"`              // the current version of the server.
-	Started             int64  `json:"started"`              // the time the server started in unix seconds.
-	Uptime              int64  `json:"uptime"`               // the number of seconds the server has been online.
-	BytesRecv           int64  `json:"bytes_recv"`           // the total number of bytes received in all packets.
-	BytesSent           int64  `json:"bytes_sent"`           // the total number of bytes sent to clients.
-	ClientsConnected    int64  `json:"clients_connected"`    // the number of currently connected clients.
-	ClientsDisconnected int64  `json:"clients_disconnected"` // the number of disconnected non-cleansession clients.
-	ClientsMax          int64  `json:"clients_max"`          // the maximum number of clients that have been concurrently connected.
-	ClientsTotal        int64  `json:"clients_total"`        // the sum of all clients, connected and disconnected.
-	ConnectionsTotal    int64  `json:"connections_total"`    // the sum number of clients which have ever connected.
-	MessagesRecv        int64  `json:"messages_recv"`        // the total number of packets received.
-	MessagesSent        int64  `json:"messages_sent"`        // the total number of packets sent.
-	PublishDropped      int64  `json:"publish_dropped"`      // the number of in-flight publish messages which were dropped.
-	PublishRecv         int64  `json:"publish_recv"`         // the total number of received publish packets.
-	PublishSent         int64  `json:"publish_sent"`         // the total number of sent publish packets.
-	Retained            int64  `json:"retained"`             // the number of messages currently retained.
-	Inflight            int64  `json:"inflight"`             // the number of messages currently in-flight.
-	Subscriptions       int64  `json:"subscriptions"`        // the total number of filter subscriptions.
+	Version             string   `json:"version"`              // the current version of the server.
+	Started             int64    `json:"started"`              // the time the server started in unix seconds.
+	FirstStarted        int64    `json:"first_started"`        // the time the server first started with its store in unix seconds, kept across restarts.
+	Uptime              int64    `json:"uptime"`               // the number of seconds the server has been online.
+	BytesRecv           int64    `json:"bytes_recv"`           // the total number of bytes received in all packets.
+	BytesSent           int64    `json:"bytes_sent"`           // the total number of bytes sent to clients.
+	ClientsConnected    int64    `json:"clients_connected"`    // the number of currently connected clients.
+	ClientsDisconnected int64    `json:"clients_disconnected"` // the number of disconnected non-cleansession clients.
+	ClientsMax          int64    `json:"clients_max"`          // the maximum number of clients that have been concurrently connected.
+	ClientsTotal        int64    `json:"clients_total"`        // the sum of all clients, connected and disconnected.
+	ConnectionsTotal    int64    `json:"connections_total"`    // the sum number of clients which have ever connected.
+	ConnectionsRejected int64    `json:"connections_rejected"` // the number of connections refused by a listener connection limit.
+	MessagesRecv        int64    `json:"messages_recv"`        // the total number of packets received.
+	MessagesSent        int64    `json:"messages_sent"`        // the total number of packets sent.
+	PublishDropped      int64    `json:"publish_dropped"`      // the number of in-flight publish messages which were dropped.
+	PublishDeduplicated int64    `json:"publish_deduplicated"` // the number of received publish messages suppressed as duplicates.
+	PublishRecv         int64    `json:"publish_recv"`         // the total number of received publish packets.
+	PublishSent         int64    `json:"publish_sent"`         // the total number of sent publish packets.
+	PublishRecvQos      [3]int64 `json:"publish_recv_qos"`     // the number of received publish packets, by qos.
+	PublishSentQos      [3]int64 `json:"publish_sent_qos"`     // the number of sent publish packets, by qos.
+	Retained            int64    `json:"retained"`             // the number of messages currently retained.
+	RetainedBytes       int64    `json:"retained_bytes"`       // the total payload size of the messages currently retained.
+	RetainedEvicted     int64    `json:"retained_evicted"`     // the number of retained messages evicted to stay under the size limit.
+	RetainedRejected    int64    `json:"retained_rejected"`    // the number of messages not retained because they exceeded the size limit.
+	RetainedReplays     int64    `json:"retained_replays"`     // the number of completed replays of retained messages to new subscriptions.
+	RetainedReplayTime  int64    `json:"retained_replay_time"` // the total time spent replaying retained messages, in microseconds.
+	Inflight            int64    `json:"inflight"`             // the number of messages currently in-flight.
+	Subscriptions       int64    `json:"subscriptions"`        // the total number of filter subscriptions.
+	StoreQueued         int64    `json:"store_queued"`         // the number of writes waiting in the write-behind queue of the store.
+	StoreDropped        int64    `json:"store_dropped"`        // the number of writes dropped because the write-behind queue was full.
+	StoreRejected       int64    `json:"store_rejected"`       // the number of qos 1 and 2 publishes rejected because the store was failing or saturated.
 }